@@ -129,7 +129,7 @@ fi
 
 # Start camera simulator
 print_header "Starting camera simulator"
-LOG_LEVEL=info ./bin/camerasim -id cam1 -addr "ws://localhost:8080/camera/connect" &
+LOG_LEVEL=info ./bin/camerasim -id cam1 -addr "ws://localhost:8081/camera/connect" &
 SIM_PID=$!
 echo "$SIM_PID:simulator" >> "$PID_FILE"
 
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/wire"
+)
+
+// Bounds of what adaptation changes; without -adaptive frames are sent at
+// the maximum of both
+const (
+	maxQuality = 90
+	minQuality = 40
+	maxFPS     = 30
+	minFPS     = 5
+)
+
+// qualityStep is how much the JPEG quality changes per feedback message.
+const qualityStep = 10
+
+// Server feedback above either pressure threshold is backed off from;
+// below both healthy thresholds, quality and frame rate are restored.
+const (
+	pressureLoad    = 0.5
+	pressureLatency = 100 // milliseconds
+	healthyLoad     = 0.1
+	healthyLatency  = 20
+)
+
+// frameInterval is the time between frames at the current frame rate.
+func (cs *CameraSimulator) frameInterval() time.Duration {
+	return time.Second / time.Duration(cs.fps)
+}
+
+// adapt applies the server's feedback with -adaptive, as a camera adapts
+// its bitrate to its link: under pressure it lowers the JPEG quality first,
+// which costs the least, then the frame rate. Once the server keeps up
+// again the frame rate comes back first. It reports whether the frame rate
+// changed.
+func (cs *CameraSimulator) adapt(fb wire.Control) bool {
+	if !cs.adaptive {
+		return false
+	}
+	quality, fps := cs.quality, cs.fps
+	switch {
+	case fb.QueueLoad >= pressureLoad || fb.LatencyMs >= pressureLatency:
+		if quality > minQuality {
+			quality = max(quality-qualityStep, minQuality)
+		} else {
+			fps = max(fps*2/3, minFPS)
+		}
+	case fb.QueueLoad < healthyLoad && fb.LatencyMs < healthyLatency:
+		if fps < maxFPS {
+			fps = min(fps*3/2, maxFPS)
+		} else {
+			quality = min(quality+qualityStep/2, maxQuality)
+		}
+	}
+	if quality == cs.quality && fps == cs.fps {
+		return false
+	}
+
+	fpsChanged := fps != cs.fps
+	if fpsChanged {
+		// The local video plays its frames at one rate
+		cs.saveBuffered()
+	}
+	cs.quality, cs.fps = quality, fps
+	cs.metrics.JPEGQuality.Set(float64(quality))
+	cs.metrics.TargetFPS.Set(float64(fps))
+	cs.out.event("adapted", fmt.Sprintf("Adapted to server load %.2f, latency %.0fms: quality %d at %d fps",
+		fb.QueueLoad, fb.LatencyMs, quality, fps),
+		map[string]interface{}{
+			"queue_load": fb.QueueLoad,
+			"latency_ms": fb.LatencyMs,
+			"quality":    quality,
+			"target_fps": fps,
+		})
+	return fpsChanged
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"os"
+)
+
+// The A/V sync pattern flashes one frame white every avSyncPeriod frames and
+// beeps for exactly the duration of that frame. Comparing flash and beep
+// times in a recording shows how far audio and video drifted apart.
+const (
+	avSyncPeriod     = 30    // frames between flashes, one second at 30fps
+	avSyncSampleRate = 48000 // divides evenly into 30fps frames
+	avSyncBeepHz     = 1000
+)
+
+func isFlashFrame(frameNum uint64) bool {
+	return frameNum%avSyncPeriod == 0
+}
+
+func (cs *CameraSimulator) drawAVSyncFrame(img *image.RGBA) {
+	c := color.RGBA{0, 0, 0, 255}
+	if isFlashFrame(cs.frameCount) {
+		c = color.RGBA{255, 255, 255, 255}
+	}
+	draw.Draw(img, img.Bounds(), &image.Uniform{c}, image.Point{}, draw.Src)
+}
+
+// avSyncAudio returns the mono samples covering one frame: a sine beep on
+// flash frames and silence otherwise.
+func avSyncAudio(frameNum uint64) []int16 {
+	samples := make([]int16, avSyncSampleRate/30)
+	if !isFlashFrame(frameNum) {
+		return samples
+	}
+	for i := range samples {
+		t := float64(i) / avSyncSampleRate
+		samples[i] = int16(math.Sin(2*math.Pi*avSyncBeepHz*t) * 0.8 * math.MaxInt16)
+	}
+	return samples
+}
+
+// writeWAV stores 16-bit mono PCM samples as a WAV file.
+func writeWAV(path string, samples []int16) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create audio file: %w", err)
+	}
+	defer f.Close()
+
+	dataSize := uint32(len(samples) * 2)
+	header := []interface{}{
+		[4]byte{'R', 'I', 'F', 'F'}, 36 + dataSize, [4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '}, uint32(16),
+		uint16(1),                    // PCM
+		uint16(1),                    // mono
+		uint32(avSyncSampleRate),     // sample rate
+		uint32(avSyncSampleRate * 2), // byte rate
+		uint16(2),                    // block align
+		uint16(16),                   // bits per sample
+		[4]byte{'d', 'a', 't', 'a'}, dataSize,
+	}
+	for _, v := range header {
+		if err := binary.Write(f, binary.LittleEndian, v); err != nil {
+			return fmt.Errorf("failed to write audio header: %w", err)
+		}
+	}
+	if err := binary.Write(f, binary.LittleEndian, samples); err != nil {
+		return fmt.Errorf("failed to write audio: %w", err)
+	}
+	return f.Close()
+}
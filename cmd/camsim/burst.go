@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/raeeceip/cctv/pkg/client"
+)
+
+// finalUploadTimeout bounds the upload of what is left when the simulator
+// stops in burst mode.
+const finalUploadTimeout = time.Minute
+
+// localVideo is a video the simulator recorded and has not uploaded yet.
+type localVideo struct {
+	path   string
+	start  time.Time
+	end    time.Time
+	frames int
+}
+
+// burstUploader uploads recorded videos through the server's resumable
+// upload API, like a body cam or dashcam that only has bandwidth now and
+// then. The client carries the camera's token, which the server files the
+// videos under.
+type burstUploader struct {
+	client   *client.Client
+	interval time.Duration
+	// pending is what has been recorded since the last burst, or failed to
+	// upload in it
+	pending []localVideo
+}
+
+// uploadResult is the outcome of one burst.
+type uploadResult struct {
+	uploaded int
+	bytes    int64
+	failed   []localVideo // to retry in the next burst
+	err      error
+}
+
+// upload sends videos in order, stopping at the first failure. A failed
+// upload resumes where it stopped in the next burst.
+func (cs *CameraSimulator) upload(ctx context.Context, videos []localVideo) uploadResult {
+	var res uploadResult
+	for i, v := range videos {
+		n, err := cs.uploadVideo(ctx, v)
+		if err != nil {
+			res.failed = videos[i:]
+			res.err = fmt.Errorf("failed to upload %s: %w", filepath.Base(v.path), err)
+			return res
+		}
+		res.uploaded++
+		res.bytes += n
+	}
+	return res
+}
+
+func (cs *CameraSimulator) uploadVideo(ctx context.Context, v localVideo) (int64, error) {
+	f, err := os.Open(v.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	_, err = cs.burst.client.UploadCameraRecording(ctx, client.Upload{
+		Name: filepath.Base(v.path),
+		File: f,
+		Size: info.Size(),
+		Recording: client.Recording{
+			CameraID:   cs.id,
+			StartTime:  v.start,
+			EndTime:    v.end,
+			FrameCount: v.frames,
+			SizeBytes:  info.Size(),
+			Codec:      "libx264",
+		},
+	})
+	return info.Size(), err
+}
+
+// uploaded accounts for a finished burst.
+func (cs *CameraSimulator) uploaded(res uploadResult) {
+	cs.burst.pending = append(res.failed, cs.burst.pending...)
+	cs.stats.uploaded += uint64(res.uploaded)
+	cs.metrics.UploadedBytes.Add(float64(res.bytes))
+	cs.metrics.PendingUploads.Set(float64(len(cs.burst.pending)))
+	if res.uploaded > 0 {
+		cs.out.event("uploaded", fmt.Sprintf("Uploaded %d videos, %d bytes", res.uploaded, res.bytes),
+			map[string]interface{}{"videos": res.uploaded, "bytes": res.bytes})
+	}
+	if res.err != nil {
+		cs.stats.uploadErrors++
+		cs.metrics.UploadErrors.Inc()
+		cs.out.event("upload_failed", fmt.Sprintf("Upload failed, %d videos left for the next burst: %v", len(cs.burst.pending), res.err),
+			map[string]interface{}{"error": res.err.Error(), "pending_uploads": len(cs.burst.pending)})
+	}
+}
+
+// Record generates frames into local videos without streaming them, and
+// uploads the videos every burst interval. When stopped, it records what
+// is buffered and uploads everything left.
+func (cs *CameraSimulator) Record(ctx context.Context) error {
+	ticker := time.NewTicker(cs.frameInterval())
+	defer ticker.Stop()
+	burstTicker := time.NewTicker(cs.burst.interval)
+	defer burstTicker.Stop()
+	rateTicker := time.NewTicker(time.Second)
+	defer rateTicker.Stop()
+
+	// At most one burst runs at a time, reporting back on done
+	var done chan uploadResult
+	for running := true; running; {
+		select {
+		case <-ctx.Done():
+			running = false
+		case <-cs.done:
+			running = false
+		case <-ticker.C:
+			if _, err := cs.nextFrame(); err != nil {
+				return err
+			}
+		case <-burstTicker.C:
+			if done == nil && len(cs.burst.pending) > 0 {
+				videos := cs.burst.pending
+				cs.burst.pending = nil
+				done = make(chan uploadResult, 1)
+				go func(done chan<- uploadResult) { done <- cs.upload(ctx, videos) }(done)
+			}
+		case res := <-done:
+			done = nil
+			cs.uploaded(res)
+		case <-rateTicker.C:
+			cs.status(0)
+		}
+	}
+
+	// Stopped: let a running burst finish, then upload the rest
+	if done != nil {
+		cs.uploaded(<-done)
+	}
+	cs.frameBufferLock.Lock()
+	if len(cs.frameBuffer) > 0 {
+		if err := cs.saveVideo(); err != nil {
+			log.Printf("Failed to save video: %v", err)
+		}
+	}
+	cs.frameBufferLock.Unlock()
+	if len(cs.burst.pending) > 0 {
+		log.Printf("Uploading %d videos before stopping", len(cs.burst.pending))
+		uploadCtx, cancel := context.WithTimeout(context.Background(), finalUploadTimeout)
+		defer cancel()
+		videos := cs.burst.pending
+		cs.burst.pending = nil
+		cs.uploaded(cs.upload(uploadCtx, videos))
+	}
+	return nil
+}
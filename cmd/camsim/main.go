@@ -3,26 +3,59 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"image"
-	"image/color"
-	"image/draw"
 	"image/jpeg"
 	"log"
-	"math"
+	"math/rand"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/raeeceip/cctv/internal/codec"
+	"github.com/raeeceip/cctv/internal/wire"
+	"github.com/raeeceip/cctv/pkg/client"
+	"github.com/raeeceip/cctv/pkg/metrics"
 )
 
+// Reconnection backoff bounds
+const (
+	reconnectMin = time.Second
+	reconnectMax = 30 * time.Second
+)
+
+// catchUp is how many frames are sent per tick after an outage, so the
+// server gets them at up to three times the frame rate rather than in a
+// burst that overflows its queue.
+const catchUp = 3
+
+// pendingFrame is an encoded frame waiting to be sent.
+type pendingFrame struct {
+	number   uint64
+	time     time.Time // when it was generated
+	pattern  string
+	data     []byte
+	webp     []byte // also set with -encoding webp
+	location *wire.Location
+	keyFrame bool
+	gop      *wire.GOP // set with -gop
+	ptz      *wire.PTZ // set with -ptz
+}
+
 type CameraSimulator struct {
 	id              string
 	signalAddr      string
@@ -32,15 +65,65 @@ type CameraSimulator struct {
 	frameCount      uint64
 	done            chan struct{}
 	wg              sync.WaitGroup
-	frameBuffer     []*image.RGBA
+	frameBuffer     [][]byte // JPEG frames for the next local video
+	audioBuffer     []int16
 	frameBufferLock sync.Mutex
 	videoOutputDir  string
+	avSync          bool
+	version         int    // latest protocol version to declare
+	binary          bool   // send wire format frames instead of JSON, as negotiated
+	token           string // camera token or JWT presented when connecting
+	metrics         *metrics.SimulatorMetrics
+	sentSince       uint64 // frames sent since FramesPerSecond was last set
+	reconnect       bool   // reconnect when the connection fails
+	// outage holds the frames not sent yet, up to outageFrames, so the
+	// server gets the frames of an outage once it is over
+	outage       []pendingFrame
+	outageFrames int
+	reconnecting bool
+	out          *reporter
+	stats        stats
+	route        *route // moves the camera, if it is a mobile one
+	// burst uploads the local videos instead of streaming, if set
+	burst       *burstUploader
+	bufferStart time.Time // when the first buffered frame was generated
+	// controls passes the server's control messages from the reader to
+	// the frame loop
+	controls chan wire.Control
+	// hellos passes the server's hellos, with the protocol the connection
+	// settled on, the same way
+	hellos   chan wire.Hello
+	patterns *patternTables // for the current resolution
+	overlay  *overlay       // nil to leave frames bare
+	tls      *tls.Config    // for wss:// servers, nil for the defaults
+	// adaptive follows the server's feedback, changing quality and fps
+	adaptive bool
+	quality  int // JPEG quality
+	// encoding is what frames are sent as: JPEG, or WebP once webp is set,
+	// when the server's hello accepts it
+	encoding string
+	webp     bool
+	fps      int // frames generated per second
+	// source supplies the frames from a video file instead of the test
+	// patterns, if set
+	source *videoSource
+	// heartbeatInterval is how often heartbeats are sent, 0 for never;
+	// only to servers whose hello said they read them
+	heartbeatInterval time.Duration
+	heartbeats        bool
+	lastFPS           float64 // frames sent per second, as last measured
+	// gop is how many frames each group of pictures has, 0 to leave
+	// frames unmarked; keyFrame numbers the current group's keyframe, and
+	// forceKeyFrame starts a new group with the next frame
+	gop           int
+	keyFrame      uint64
+	forceKeyFrame bool
+	ptz           *ptzHead // nil without -ptz
 }
 
+// saveVideo writes the buffered frames as a local video. It is called with
+// frameBufferLock held.
 func (cs *CameraSimulator) saveVideo() error {
-	cs.frameBufferLock.Lock()
-	defer cs.frameBufferLock.Unlock()
-
 	if len(cs.frameBuffer) == 0 {
 		return fmt.Errorf("no frames to save")
 	}
@@ -58,18 +141,11 @@ func (cs *CameraSimulator) saveVideo() error {
 	defer os.RemoveAll(tempDir)
 
 	// Save frames as JPEG files
-	// could be a utility function on its own later
 	for i, frame := range cs.frameBuffer {
 		framePath := filepath.Join(tempDir, fmt.Sprintf("frame_%05d.jpg", i))
-		f, err := os.Create(framePath)
-		if err != nil {
-			return fmt.Errorf("failed to create frame file: %w", err)
-		}
-		if err := jpeg.Encode(f, frame, &jpeg.Options{Quality: 90}); err != nil {
-			f.Close()
-			return fmt.Errorf("failed to encode frame: %w", err)
+		if err := os.WriteFile(framePath, frame, 0644); err != nil {
+			return fmt.Errorf("failed to write frame file: %w", err)
 		}
-		f.Close()
 	}
 
 	// Create video file
@@ -77,16 +153,26 @@ func (cs *CameraSimulator) saveVideo() error {
 		fmt.Sprintf("%s_%s.mp4", cs.id, time.Now().Format("20060102_150405")))
 
 	// FFmpeg command to create video
-	cmd := exec.Command("ffmpeg",
+	args := []string{
 		"-y",
-		"-framerate", "30",
+		"-framerate", strconv.Itoa(cs.fps),
 		"-i", filepath.Join(tempDir, "frame_%05d.jpg"),
+	}
+	if len(cs.audioBuffer) > 0 {
+		audioPath := filepath.Join(tempDir, "audio.wav")
+		if err := writeWAV(audioPath, cs.audioBuffer); err != nil {
+			return err
+		}
+		args = append(args, "-i", audioPath, "-c:a", "aac")
+	}
+	args = append(args,
 		"-c:v", "libx264",
 		"-preset", "medium",
 		"-crf", "23",
 		"-pix_fmt", "yuv420p",
 		"-movflags", "+faststart",
 		outputPath)
+	cmd := exec.Command("ffmpeg", args...)
 
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
@@ -96,21 +182,38 @@ func (cs *CameraSimulator) saveVideo() error {
 	}
 
 	log.Printf("Created video with %d frames: %s", len(cs.frameBuffer), outputPath)
+	if cs.burst != nil {
+		cs.burst.pending = append(cs.burst.pending, localVideo{
+			path:   outputPath,
+			start:  cs.bufferStart,
+			end:    time.Now(),
+			frames: len(cs.frameBuffer),
+		})
+		cs.metrics.PendingUploads.Set(float64(len(cs.burst.pending)))
+	}
 
 	// Clear buffer after successful save
 	cs.frameBuffer = nil
+	cs.audioBuffer = nil
+	cs.metrics.BufferedFrames.Set(0)
 
 	return nil
 }
 
-func (cs *CameraSimulator) addFrameToBuffer(frame *image.RGBA) {
+// addFrameToBuffer keeps an encoded frame for the local video, together
+// with the audio covering it, if any. Frames are kept encoded, as a few
+// seconds of raw 4K frames would take gigabytes.
+func (cs *CameraSimulator) addFrameToBuffer(frame []byte, audio []int16) {
 	cs.frameBufferLock.Lock()
 	defer cs.frameBufferLock.Unlock()
 
-	// Create a copy of the frame
-	frameCopy := image.NewRGBA(frame.Bounds())
-	draw.Draw(frameCopy, frame.Bounds(), frame, frame.Bounds().Min, draw.Src)
-	cs.frameBuffer = append(cs.frameBuffer, frameCopy)
+	if len(cs.frameBuffer) == 0 {
+		cs.bufferStart = time.Now()
+	}
+
+	cs.frameBuffer = append(cs.frameBuffer, frame)
+	cs.audioBuffer = append(cs.audioBuffer, audio...)
+	cs.metrics.BufferedFrames.Set(float64(len(cs.frameBuffer)))
 
 	// Save video every 300 frames (10 seconds at 30fps)
 	if len(cs.frameBuffer) >= 300 {
@@ -120,7 +223,7 @@ func (cs *CameraSimulator) addFrameToBuffer(frame *image.RGBA) {
 	}
 }
 
-func NewCameraSimulator(id, signalAddr string, width, height int) *CameraSimulator {
+func NewCameraSimulator(id, signalAddr string, width, height int, labels map[string]string) *CameraSimulator {
 	if id == "" {
 		id = fmt.Sprintf("cam-%d", time.Now().UnixNano())
 	}
@@ -131,13 +234,21 @@ func NewCameraSimulator(id, signalAddr string, width, height int) *CameraSimulat
 		height = 480
 	}
 
-	return &CameraSimulator{
+	cs := &CameraSimulator{
 		id:         id,
 		signalAddr: signalAddr,
 		width:      width,
 		height:     height,
 		done:       make(chan struct{}),
+		metrics:    metrics.NewSimulatorMetrics(id, labels),
+		controls:   make(chan wire.Control, 1),
+		hellos:     make(chan wire.Hello, 1),
+		quality:    maxQuality,
+		fps:        maxFPS,
 	}
+	cs.metrics.JPEGQuality.Set(maxQuality)
+	cs.metrics.TargetFPS.Set(maxFPS)
+	return cs
 }
 
 func (cs *CameraSimulator) Connect() error {
@@ -147,13 +258,73 @@ func (cs *CameraSimulator) Connect() error {
 		HandshakeTimeout: 10 * time.Second,
 		ReadBufferSize:   1024 * 1024,
 		WriteBufferSize:  1024 * 1024,
+		TLSClientConfig:  cs.tls,
 	}
 
-	conn, _, err := dialer.Dial(cs.signalAddr, nil)
+	// Declare the latest protocol version, and offer the frame formats it
+	// allows as subprotocols for servers from before versioning; those
+	// that negotiate neither get JSON, which every version reads
+	dialer.Subprotocols = []string{wire.JSONProtocol}
+	if cs.version >= wire.VersionBinary {
+		dialer.Subprotocols = wire.Protocols
+	}
+	dialer.EnableCompression = cs.version >= wire.VersionCompressed
+	header := http.Header{}
+	header.Set(wire.CameraIDHeader, cs.id)
+	header.Set(wire.VersionHeader, strconv.Itoa(cs.version))
+	if cs.token != "" {
+		header.Set("Authorization", "Bearer "+cs.token)
+	}
+	conn, resp, err := dialer.Dial(cs.signalAddr, header)
 	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return fmt.Errorf("server requires a valid camera token for %s", cs.id)
+		}
+		if resp != nil && resp.StatusCode == http.StatusBadRequest {
+			return fmt.Errorf("server refused camera ID %q", cs.id)
+		}
+		if resp != nil && resp.StatusCode == http.StatusUpgradeRequired {
+			var body struct {
+				Error string `json:"error"`
+			}
+			json.NewDecoder(resp.Body).Decode(&body)
+			return fmt.Errorf("server refused protocol version %d: %s", cs.version, body.Error)
+		}
+		if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+			var body struct {
+				Error string `json:"error"`
+			}
+			json.NewDecoder(resp.Body).Decode(&body)
+			return fmt.Errorf("server refused connection: %s", body.Error)
+		}
 		return fmt.Errorf("websocket connection failed: %w", err)
 	}
+	// Servers from before versioning answer with a subprotocol only
+	caps := wire.Capabilities{BinaryFrames: conn.Subprotocol() == wire.BinaryProtocol}
+	if v := resp.Header.Get(wire.VersionHeader); v != "" {
+		version, err := wire.ParseVersion(v)
+		if err != nil || version > cs.version {
+			conn.Close()
+			return fmt.Errorf("server picked protocol version %q, declared %d", v, cs.version)
+		}
+		caps = wire.CapabilitiesOf(version)
+
+		// Confirm what the camera speaks; the server's hello answering it
+		// has the final say
+		want := wire.CapabilitiesOf(cs.version)
+		want.WebP = cs.encoding == codec.WebP
+		hello := wire.NewHello(want)
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := conn.WriteJSON(hello); err != nil {
+			conn.Close()
+			return fmt.Errorf("failed to send hello: %w", err)
+		}
+	}
 	cs.conn = conn
+	cs.binary = caps.BinaryFrames
+	cs.heartbeats = false
+	cs.webp = false
+	conn.EnableWriteCompression(caps.Compression)
 
 	conn.SetReadLimit(32 * 1024 * 1024)
 	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
@@ -163,11 +334,16 @@ func (cs *CameraSimulator) Connect() error {
 		return nil
 	})
 
-	log.Printf("Connected successfully to %s", cs.signalAddr)
+	format := "json"
+	if cs.binary {
+		format = "binary"
+	}
+	cs.out.event("connected", fmt.Sprintf("Connected successfully to %s, sending %s frames (protocol version %d)", cs.signalAddr, format, caps.Version),
+		map[string]interface{}{"addr": cs.signalAddr, "format": format, "version": caps.Version})
 	return nil
 }
 
-func (cs *CameraSimulator) handlePing(ctx context.Context) error {
+func (cs *CameraSimulator) handlePing(ctx context.Context, conn *websocket.Conn) error {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
@@ -176,23 +352,24 @@ func (cs *CameraSimulator) handlePing(ctx context.Context) error {
 		case <-ctx.Done():
 			return nil
 		case <-ticker.C:
-			if err := cs.conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(10*time.Second)); err != nil {
+			if err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(10*time.Second)); err != nil {
 				return fmt.Errorf("failed to write ping: %w", err)
 			}
 		}
 	}
 }
 
-func (cs *CameraSimulator) Start(ctx context.Context) error {
-	if cs.conn == nil {
-		return fmt.Errorf("not connected")
-	}
+// serve runs the ping handler and message reader of the current
+// connection until the returned function is called or ctx is cancelled.
+func (cs *CameraSimulator) serve(ctx context.Context) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	conn := cs.conn
 
 	// Start ping handler
 	cs.wg.Add(1)
 	go func() {
 		defer cs.wg.Done()
-		if err := cs.handlePing(ctx); err != nil {
+		if err := cs.handlePing(ctx, conn); err != nil {
 			log.Printf("Ping handler error: %v", err)
 		}
 	}()
@@ -206,77 +383,378 @@ func (cs *CameraSimulator) Start(ctx context.Context) error {
 			case <-ctx.Done():
 				return
 			default:
-				_, _, err := cs.conn.ReadMessage()
+				kind, data, err := conn.ReadMessage()
 				if err != nil {
 					if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
 						log.Printf("Read error: %v", err)
 					}
 					return
 				}
+				if kind != websocket.TextMessage {
+					continue
+				}
+				var msg wire.Control
+				if err := json.Unmarshal(data, &msg); err != nil {
+					log.Printf("Ignoring malformed control message: %v", err)
+					continue
+				}
+				switch msg.Type {
+				case wire.HelloType:
+					var hello wire.Hello
+					if err := json.Unmarshal(data, &hello); err != nil {
+						log.Printf("Ignoring malformed hello: %v", err)
+						continue
+					}
+					select {
+					case cs.hellos <- hello:
+					case <-ctx.Done():
+						return
+					}
+				case wire.ControlConfig, wire.ControlSnapshot, wire.ControlFeedback, wire.ControlPTZ:
+					select {
+					case cs.controls <- msg:
+					case <-ctx.Done():
+						return
+					}
+				default:
+					log.Printf("Ignoring control message of unknown type %q", msg.Type)
+				}
 			}
 		}
 	}()
+	return cancel
+}
+
+// checkResolution reports resolutions the local videos can't be encoded
+// at, before FFmpeg fails on them: yuv420p needs even dimensions.
+func checkResolution(width, height int) error {
+	switch {
+	case width <= 0 || height <= 0 || width > 7680 || height > 4320:
+		return fmt.Errorf("resolution %dx%d is outside 2x2 to 7680x4320", width, height)
+	case width%2 != 0 || height%2 != 0:
+		return fmt.Errorf("resolution %dx%d has an odd dimension", width, height)
+	}
+	return nil
+}
+
+// configure applies a config control message between frames. Frames
+// buffered for the local video are saved first, as a video can't change
+// resolution part way.
+func (cs *CameraSimulator) configure(msg wire.Control) {
+	if err := checkResolution(msg.Width, msg.Height); err != nil {
+		log.Printf("Ignoring resolution change: %v", err)
+		return
+	}
+	if msg.Width == cs.width && msg.Height == cs.height {
+		return
+	}
+	cs.saveBuffered()
+
+	from := fmt.Sprintf("%dx%d", cs.width, cs.height)
+	cs.width, cs.height = msg.Width, msg.Height
+	cs.forceKeyFrame = true
+	cs.out.event("resolution_changed", fmt.Sprintf("Resolution changed from %s to %dx%d", from, cs.width, cs.height),
+		map[string]interface{}{"width": cs.width, "height": cs.height})
+}
+
+// greet applies the protocol a server's hello settled on between frames.
+func (cs *CameraSimulator) greet(hello wire.Hello) {
+	binary := hello.Has(wire.CapBinaryFrames)
+	if !binary && !hello.Has(wire.CapJSONFrames) {
+		log.Printf("Ignoring hello without a frame format")
+		return
+	}
+	cs.conn.EnableWriteCompression(hello.Has(wire.CapCompression))
+	cs.heartbeats = hello.Has(wire.CapHeartbeat)
+	if webp := cs.encoding == codec.WebP && hello.Has(wire.CapWebP); webp != cs.webp {
+		cs.webp = webp
+		encoding := codec.JPEG
+		if webp {
+			encoding = codec.WebP
+		}
+		cs.out.event("encoding_changed", fmt.Sprintf("Server settled on %s frames", encoding),
+			map[string]interface{}{"encoding": encoding})
+	}
+	if binary == cs.binary {
+		return
+	}
+	cs.binary = binary
+	format := "json"
+	if cs.binary {
+		format = "binary"
+	}
+	cs.out.event("protocol_changed", fmt.Sprintf("Server settled on protocol version %d, sending %s frames", hello.Proto, format),
+		map[string]interface{}{"format": format, "version": hello.Proto, "capabilities": hello.Capabilities})
+}
+
+// saveBuffered saves the frames buffered for the local video before the
+// frames change in a way one video can't hold, dropping them if that fails.
+func (cs *CameraSimulator) saveBuffered() {
+	cs.frameBufferLock.Lock()
+	defer cs.frameBufferLock.Unlock()
+	if len(cs.frameBuffer) == 0 {
+		return
+	}
+	if err := cs.saveVideo(); err != nil {
+		log.Printf("Failed to save video: %v", err)
+		cs.frameBuffer = nil
+		cs.audioBuffer = nil
+		cs.metrics.BufferedFrames.Set(0)
+	}
+}
+
+func (cs *CameraSimulator) Start(ctx context.Context) error {
+	if cs.conn == nil {
+		return fmt.Errorf("not connected")
+	}
+	stopConn := cs.serve(ctx)
+	defer func() { stopConn() }()
+
+	// While reconnecting, frames keep being generated into the outage
+	// buffer, and reconnected receives the outcome
+	reconnected := make(chan error, 1)
+	stopping := func() {
+		if cs.reconnecting {
+			<-reconnected
+		}
+	}
 
 	// Start frame generator
-	ticker := time.NewTicker(time.Second / 30)
+	ticker := time.NewTicker(cs.frameInterval())
 	defer ticker.Stop()
+	rateTicker := time.NewTicker(time.Second)
+	defer rateTicker.Stop()
+	rateFrom := time.Now()
+	var heartbeat <-chan time.Time
+	if cs.heartbeatInterval > 0 {
+		heartbeatTicker := time.NewTicker(cs.heartbeatInterval)
+		defer heartbeatTicker.Stop()
+		heartbeat = heartbeatTicker.C
+	}
+
+	// sendFrame generates the next frame and sends it after any buffered
+	// ones, starting to reconnect if that fails
+	sendFrame := func() error {
+		f, err := cs.nextFrame()
+		if err != nil {
+			return err
+		}
+		cs.buffer(f)
+		if cs.reconnecting {
+			return nil
+		}
+		if err := cs.flush(catchUp); err != nil {
+			cs.out.event("disconnected", fmt.Sprintf("Connection lost: %v", err),
+				map[string]interface{}{"error": err.Error()})
+			if !cs.reconnect {
+				return err
+			}
+			stopConn()
+			cs.reconnecting = true
+			go func() { reconnected <- cs.Reconnect(ctx) }()
+		}
+		return nil
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
 			log.Println("Context cancelled, stopping frame generation")
+			stopping()
 			return nil
 		case <-cs.done:
 			log.Println("Received stop signal, stopping frame generation")
+			stopping()
 			return nil
 		case <-ticker.C:
-			if err := cs.sendFrame(); err != nil {
-				log.Printf("Failed to send frame: %v", err)
+			if err := sendFrame(); err != nil {
 				return err
 			}
+		case err := <-reconnected:
+			cs.reconnecting = false
+			if err != nil {
+				// Stopped while reconnecting
+				return nil
+			}
+			cs.stats.reconnects++
+			stopConn = cs.serve(ctx)
+			cs.out.event("reconnected", fmt.Sprintf("Reconnected, sending %d frames buffered during the outage", len(cs.outage)),
+				map[string]interface{}{"outage_frames": len(cs.outage)})
+		case hello := <-cs.hellos:
+			// One from the lost connection; the new one sends its own
+			if !cs.reconnecting {
+				cs.greet(hello)
+			}
+		case msg := <-cs.controls:
+			switch msg.Type {
+			case wire.ControlConfig:
+				cs.configure(msg)
+			case wire.ControlFeedback:
+				if cs.adapt(msg) {
+					ticker.Reset(cs.frameInterval())
+				}
+			case wire.ControlSnapshot:
+				// Send a keyframe now, and the following frame a full
+				// interval later
+				ticker.Reset(cs.frameInterval())
+				cs.forceKeyFrame = true
+				if err := sendFrame(); err != nil {
+					return err
+				}
+			case wire.ControlPTZ:
+				if cs.ptz != nil && msg.PTZ != nil {
+					cs.ptz.move(*msg.PTZ)
+				}
+			}
+		case now := <-heartbeat:
+			// A failed heartbeat shows as a failed frame soon enough
+			if cs.heartbeats && !cs.reconnecting {
+				if err := cs.sendHeartbeat(now); err != nil {
+					log.Printf("Failed to send heartbeat: %v", err)
+				}
+			}
+		case now := <-rateTicker.C:
+			fps := float64(cs.sentSince) / now.Sub(rateFrom).Seconds()
+			cs.metrics.FramesPerSecond.Set(fps)
+			cs.lastFPS = fps
+			cs.status(fps)
+			cs.sentSince = 0
+			rateFrom = now
 		}
 	}
 }
 
-func (cs *CameraSimulator) sendFrame() error {
-	if cs.conn == nil {
-		return fmt.Errorf("not connected")
+// nextFrame generates and encodes the next frame, numbering it.
+func (cs *CameraSimulator) nextFrame() (pendingFrame, error) {
+	// Generate frame, numbered and timed as it will be sent
+	now := time.Now()
+	var img *image.RGBA
+	var pattern string
+	if cs.source != nil {
+		var err error
+		if img, err = cs.source.frame(cs.width, cs.height, cs.fps); err != nil {
+			return pendingFrame{}, err
+		}
+		pattern = cs.source.name
+	} else {
+		img, pattern = cs.generateFrame()
 	}
-
-	// Generate frame
-	img, pattern := cs.generateFrame()
+	var ptz *wire.PTZ
+	if cs.ptz != nil {
+		p := cs.ptz.at(now)
+		img = ptzView(img, p)
+		ptz = &p
+	}
+	cs.addTimestamp(img, cs.frameCount+1, now)
 
 	// Encode frame
 	var buf bytes.Buffer
-	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
-		return fmt.Errorf("jpeg encoding failed: %w", err)
+	encodeStart := time.Now()
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: cs.quality}); err != nil {
+		return pendingFrame{}, fmt.Errorf("jpeg encoding failed: %w", err)
 	}
-
-	frameData := base64.StdEncoding.EncodeToString(buf.Bytes())
+	// The JPEG is still needed for the local video, and in case the server
+	// turns WebP down by the time the frame is sent
+	var webp []byte
+	if cs.encoding == codec.WebP {
+		var err error
+		if webp, err = encodeWebP(img, cs.quality); err != nil {
+			return pendingFrame{}, fmt.Errorf("webp encoding failed: %w", err)
+		}
+	}
+	cs.metrics.EncodeDuration.Observe(time.Since(encodeStart).Seconds())
+	cs.stats.encode.add(time.Since(encodeStart))
 
 	// Add frame to buffer for video creation
-	cs.addFrameToBuffer(img)
+	var audio []int16
+	if cs.avSync {
+		audio = avSyncAudio(cs.frameCount)
+	}
+	cs.addFrameToBuffer(buf.Bytes(), audio)
 
-	// Create message
-	msg := struct {
-		Type     string    `json:"type"`
-		Data     string    `json:"data"`
-		Camera   string    `json:"camera"`
-		Time     time.Time `json:"time"`
-		Pattern  string    `json:"pattern"`
-		FrameNum uint64    `json:"frame_num"`
-	}{
-		Type:     "frame",
-		Data:     frameData,
-		Camera:   cs.id,
-		Time:     time.Now(),
-		Pattern:  pattern,
-		FrameNum: cs.frameCount + 1,
+	cs.frameCount++
+	f := pendingFrame{
+		number:  cs.frameCount,
+		time:    now,
+		pattern: pattern,
+		data:    buf.Bytes(),
+		webp:    webp,
+		ptz:     ptz,
+	}
+	if cs.route != nil {
+		loc := cs.route.at(f.time)
+		f.location = &loc
+	}
+	cs.markGOP(&f)
+	return f, nil
+}
+
+// markGOP marks a frame as a keyframe or a delta of the last one, with
+// -gop. Groups start every gop frames, and early for snapshots and
+// resolution changes, as an encoder would restart them.
+func (cs *CameraSimulator) markGOP(f *pendingFrame) {
+	if cs.gop <= 0 {
+		return
+	}
+	if cs.keyFrame == 0 || cs.forceKeyFrame || f.number-cs.keyFrame >= uint64(cs.gop) {
+		cs.keyFrame = f.number
+		cs.forceKeyFrame = false
+	}
+	f.keyFrame = f.number == cs.keyFrame
+	f.gop = &wire.GOP{Size: cs.gop, KeyFrame: cs.keyFrame, Index: int(f.number - cs.keyFrame)}
+}
+
+// buffer queues a frame to be sent, dropping the oldest frame when the
+// outage buffer is full.
+func (cs *CameraSimulator) buffer(f pendingFrame) {
+	if len(cs.outage) >= cs.outageFrames {
+		cs.outage = cs.outage[1:]
+		cs.metrics.DroppedFrames.Inc()
+		cs.stats.dropped++
+	}
+	cs.outage = append(cs.outage, f)
+	cs.metrics.OutageFrames.Set(float64(len(cs.outage)))
+}
+
+// flush sends up to n queued frames in order. A frame that fails to send
+// stays queued, with those after it.
+func (cs *CameraSimulator) flush(n int) error {
+	for ; n > 0 && len(cs.outage) > 0; n-- {
+		if err := cs.sendFrame(cs.outage[0]); err != nil {
+			return err
+		}
+		cs.outage = cs.outage[1:]
+		cs.metrics.OutageFrames.Set(float64(len(cs.outage)))
+	}
+	if len(cs.outage) == 0 {
+		// Let the backing array go once an outage is over
+		cs.outage = nil
+	}
+	return nil
+}
+
+func (cs *CameraSimulator) sendFrame(f pendingFrame) error {
+	if cs.conn == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	encoding := codec.JPEG
+	if cs.webp && f.webp != nil {
+		f.data, encoding = f.webp, codec.WebP
 	}
 
 	// Write message with deadline
-	cs.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-	if err := cs.conn.WriteJSON(msg); err != nil {
+	sendStart := time.Now()
+	cs.conn.SetWriteDeadline(sendStart.Add(10 * time.Second))
+	var err error
+	if cs.binary {
+		err = cs.writeBinaryFrame(f)
+	} else {
+		err = cs.writeJSONFrame(f)
+	}
+	if err != nil {
+		cs.metrics.SendErrors.Inc()
+		cs.stats.sendErrors++
 		if closeErr := cs.conn.WriteMessage(websocket.CloseMessage,
 			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")); closeErr != nil {
 			log.Printf("Error sending close message: %v", closeErr)
@@ -284,91 +762,148 @@ func (cs *CameraSimulator) sendFrame() error {
 		return fmt.Errorf("failed to send frame: %w", err)
 	}
 
-	cs.frameCount++
-	if cs.frameCount%30 == 0 {
-		log.Printf("Sent frame %d (Pattern: %s)", cs.frameCount, pattern)
+	cs.stats.send.add(time.Since(sendStart))
+	cs.sentSince++
+	cs.stats.framesSent++
+	cs.stats.bytesSent += uint64(len(f.data))
+	cs.metrics.FramesSent.Inc()
+	cs.metrics.SentBytes.WithLabelValues(encoding).Add(float64(len(f.data)))
+	if f.number%30 == 0 && !cs.out.json {
+		log.Printf("Sent frame %d (Pattern: %s)", f.number, f.pattern)
 	}
 
 	return nil
 }
 
+// sendHeartbeat tells the server the camera is alive, whether or not it
+// has frames to send.
+func (cs *CameraSimulator) sendHeartbeat(now time.Time) error {
+	cs.conn.SetWriteDeadline(now.Add(10 * time.Second))
+	return cs.conn.WriteJSON(wire.Heartbeat{
+		Type:       wire.HeartbeatType,
+		Time:       now,
+		FramesSent: cs.stats.framesSent,
+		FPS:        cs.lastFPS,
+	})
+}
+
+func (cs *CameraSimulator) writeJSONFrame(f pendingFrame) error {
+	msg := struct {
+		Type     string         `json:"type"`
+		Data     string         `json:"data"`
+		Camera   string         `json:"camera"`
+		Time     time.Time      `json:"time"`
+		Pattern  string         `json:"pattern"`
+		FrameNum uint64         `json:"frame_num"`
+		Location *wire.Location `json:"location,omitempty"`
+		KeyFrame bool           `json:"key_frame,omitempty"`
+		GOP      *wire.GOP      `json:"gop,omitempty"`
+		PTZ      *wire.PTZ      `json:"ptz,omitempty"`
+	}{
+		Type:     "frame",
+		Data:     base64.StdEncoding.EncodeToString(f.data),
+		Camera:   cs.id,
+		Time:     f.time,
+		Pattern:  f.pattern,
+		FrameNum: f.number,
+		Location: f.location,
+		KeyFrame: f.keyFrame,
+		GOP:      f.gop,
+		PTZ:      f.ptz,
+	}
+	return cs.conn.WriteJSON(msg)
+}
+
+// writeBinaryFrame sends the JPEG without base64 encoding it.
+func (cs *CameraSimulator) writeBinaryFrame(f pendingFrame) error {
+	w, err := cs.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	header := wire.Header{
+		Camera:   cs.id,
+		Time:     f.time,
+		FrameNum: f.number,
+		Pattern:  f.pattern,
+		Location: f.location,
+		KeyFrame: f.keyFrame,
+		GOP:      f.gop,
+		PTZ:      f.ptz,
+	}
+	if err := wire.WriteFrame(w, header, f.data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// generateFrame draws the test pattern of the next frame, returning its
+// name.
 func (cs *CameraSimulator) generateFrame() (*image.RGBA, string) {
 	img := image.NewRGBA(image.Rect(0, 0, cs.width, cs.height))
-	pattern := ""
 
-	// Fill background with dark gray
-	draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{40, 40, 40, 255}}, image.Point{}, draw.Src)
+	if cs.avSync {
+		cs.drawAVSyncFrame(img)
+		return img, "AV Sync"
+	}
 
 	// Choose pattern based on time
+	var pattern string
 	switch (cs.frameCount / 150) % 4 {
 	case 0:
 		pattern = "Gradient"
-		for y := 0; y < cs.height; y++ {
-			for x := 0; x < cs.width; x++ {
-				gradient := uint8((float64(x) / float64(cs.width)) * 255)
-				img.Set(x, y, color.RGBA{gradient, gradient, gradient, 255})
-			}
-		}
-
+		cs.drawGradient(img)
 	case 1:
 		pattern = "Sine Wave"
-		offset := float64(cs.frameCount) * 0.1
-		for x := 0; x < cs.width; x++ {
-			wave := math.Sin(float64(x)*0.05 + offset)
-			mid := float64(cs.height) / 2
-			pos := mid + wave*50
-
-			// Draw thick line
-			for y := 0; y < cs.height; y++ {
-				if math.Abs(float64(y)-pos) < 3 {
-					img.Set(x, y, color.RGBA{255, 255, 255, 255})
-				}
-			}
-		}
-
+		cs.drawSineWave(img)
 	case 2:
 		pattern = "Checkerboard"
-		squareSize := 40
-		for y := 0; y < cs.height; y++ {
-			for x := 0; x < cs.width; x++ {
-				if ((x/squareSize)+(y/squareSize))%2 == 0 {
-					img.Set(x, y, color.RGBA{255, 255, 255, 255})
-				}
-			}
-		}
-
+		cs.drawCheckerboard(img)
 	case 3:
 		pattern = "Moving Circle"
-		centerX := cs.width/2 + int(math.Cos(float64(cs.frameCount)*0.05)*100)
-		centerY := cs.height/2 + int(math.Sin(float64(cs.frameCount)*0.05)*100)
-		radius := 50
-
-		for y := 0; y < cs.height; y++ {
-			for x := 0; x < cs.width; x++ {
-				dx := float64(x - centerX)
-				dy := float64(y - centerY)
-				dist := math.Sqrt(dx*dx + dy*dy)
-				if dist < float64(radius) {
-					img.Set(x, y, color.RGBA{255, 255, 255, 255})
-				}
-			}
-		}
+		cs.drawMovingCircle(img)
 	}
-
-	// Add timestamp
-	cs.addTimestamp(img)
 	return img, pattern
 }
 
-func (cs *CameraSimulator) addTimestamp(img *image.RGBA) {
-	timestamp := fmt.Sprintf("Frame: %d | Time: %s", cs.frameCount, time.Now().Format("15:04:05"))
-	draw.Draw(img,
-		image.Rect(10, 10, 300, 40),
-		&image.Uniform{color.RGBA{0, 0, 0, 255}},
-		image.Point{},
-		draw.Over)
+// addTimestamp burns the camera ID, frame number and time into the frame,
+// unless the overlay is off.
+func (cs *CameraSimulator) addTimestamp(img *image.RGBA, number uint64, now time.Time) {
+	if cs.overlay == nil {
+		return
+	}
+	cs.overlay.draw(img, cs.overlay.text(cs.id, number, now))
+}
+
+// Reconnect replaces a failed connection, retrying with exponential
+// backoff until ctx is cancelled or the simulator is stopped. Delays are
+// jittered so simulators that lost the same server don't all come back at
+// once.
+func (cs *CameraSimulator) Reconnect(ctx context.Context) error {
+	// Ends the message reader; Start already ended the ping handler
+	cs.conn.Close()
+	cs.wg.Wait()
 
-	log.Printf("Timestamp: %s", timestamp)
+	delay := reconnectMin
+	for {
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-cs.done:
+			return fmt.Errorf("stopped")
+		case <-time.After(wait):
+		}
+		if err := cs.Connect(); err != nil {
+			cs.out.event("reconnect_failed",
+				fmt.Sprintf("Reconnect failed, retrying in up to %s: %v", min(2*delay, reconnectMax), err),
+				map[string]interface{}{"error": err.Error()})
+			delay = min(2*delay, reconnectMax)
+			continue
+		}
+		cs.metrics.Reconnects.Inc()
+		return nil
+	}
 }
 
 func (cs *CameraSimulator) Stop() {
@@ -385,24 +920,151 @@ func (cs *CameraSimulator) Stop() {
 	}
 
 	cs.wg.Wait()
+	if cs.source != nil {
+		cs.source.close()
+	}
 	log.Println("Camera simulator stopped")
 }
 func main() {
 	// Parse command line flags
 	id := flag.String("id", "cam1", "Camera ID")
-	addr := flag.String("addr", "ws://localhost:8080/camera/connect", "Signal server address")
+	addr := flag.String("addr", "ws://localhost:8081/camera/connect", "Signal server address, ws:// or wss://")
 	width := flag.Int("width", 640, "Frame width")
 	height := flag.Int("height", 480, "Frame height")
 	videoDir := flag.String("video-dir", "videos", "Video output directory")
+	format := flag.String("format", "binary", "Frame message format: binary or json (base64 JPEG)")
+	encoding := flag.String("encoding", codec.JPEG, "Frame image encoding: jpeg, or webp to servers that accept it (needs camsim built with -tags webp)")
+	token := flag.String("token", "", "Camera token or JWT, if the server requires one")
+	pattern := flag.String("pattern", "cycle", "Test pattern: cycle or avsync (white flash with a beep every second)")
+	reconnect := flag.Bool("reconnect", true, "Reconnect when the connection fails instead of exiting")
+	outageFrames := flag.Int("outage-frames", 300, "Frames to buffer while disconnected, sent once reconnected")
+	metricsAddr := flag.String("metrics-addr", "", "Address to serve Prometheus metrics on, e.g. :9101")
+	labels := flag.String("labels", "", "Extra labels for the metrics, e.g. run=soak,host=pi4")
+	output := flag.String("output", "text", "Output: text log lines, or json records on stdout, one per line")
+	routeFlag := flag.String("route", "", "GPS waypoints to move along, lat,lon[,alt];..., or a file of them, one per line")
+	speed := flag.Float64("speed", 10, "Speed along -route in meters per second")
+	mode := flag.String("mode", "stream", "Mode: stream frames, or burst to record locally and upload the videos periodically")
+	burstInterval := flag.Duration("burst-interval", 5*time.Minute, "How often to upload in burst mode")
+	uploadURL := flag.String("upload-url", "http://localhost:8080", "Server API to upload to in burst mode")
+	overlayPos := flag.String("overlay", overlayTopLeft, "Where to draw the text overlay: top-left, top-right, bottom-left, bottom-right or none")
+	overlayFormat := flag.String("overlay-format", "{camera} #{frame} {time}", "Overlay text; {camera}, {frame} and {time} are replaced")
+	overlayTime := flag.String("overlay-time", "2006-01-02 15:04:05.000", "Go time layout for {time} in the overlay")
+	caFile := flag.String("ca", "", "PEM file of CAs to trust for wss:// and https:// instead of the system's")
+	certFile := flag.String("cert", "", "Client certificate to present to servers requiring one (PEM)")
+	keyFile := flag.String("key", "", "Private key of -cert (PEM)")
+	insecure := flag.Bool("insecure", false, "Skip verifying the server's certificate, for testing")
+	source := flag.String("source", "", "Video file to stream the frames of, looping, instead of test patterns; decoded with FFmpeg")
+	adaptive := flag.Bool("adaptive", false, "Lower JPEG quality, then frame rate, while the server reports it is falling behind")
+	heartbeat := flag.Duration("heartbeat", 5*time.Second, "How often to send heartbeats to servers that read them; 0 for never")
+	ptz := flag.Bool("ptz", false, "Simulate a pan/tilt/zoom head the server can move, reporting its position with each frame")
+	gop := flag.Int("gop", 0, "Mark every Nth frame as a keyframe and those between as its deltas; 0 leaves frames unmarked")
+	protocol := flag.Int("protocol", wire.LatestVersion, "Latest protocol version to declare: 1 JSON frames, 2 binary, 3 compressed binary; -format json declares 1")
 	flag.Parse()
 
+	if *pattern != "cycle" && *pattern != "avsync" {
+		log.Fatalf("Unknown pattern %q", *pattern)
+	}
+	if *source != "" && *pattern == "avsync" {
+		log.Fatalf("-source and -pattern avsync can't be combined")
+	}
+	if *format != "binary" && *format != "json" {
+		log.Fatalf("Unknown format %q", *format)
+	}
+	if *encoding != codec.JPEG && *encoding != codec.WebP {
+		log.Fatalf("Unknown encoding %q", *encoding)
+	}
+	if *encoding == codec.WebP && encodeWebP == nil {
+		log.Fatalf("-encoding webp needs camsim built with the webp tag and cgo, and libwebp")
+	}
+	if *protocol < 1 || *protocol > wire.LatestVersion {
+		log.Fatalf("Unknown protocol version %d, expected 1 to %d", *protocol, wire.LatestVersion)
+	}
+	if *output != "text" && *output != "json" {
+		log.Fatalf("Unknown output %q", *output)
+	}
+	if *mode != "stream" && *mode != "burst" {
+		log.Fatalf("Unknown mode %q", *mode)
+	}
+	if *gop < 0 {
+		log.Fatalf("-gop can't be negative")
+	}
+	out := newReporter(*output)
+	metricLabels, err := parseLabels(*labels)
+	if err != nil {
+		log.Fatalf("Invalid labels: %v", err)
+	}
+
+	if err := checkResolution(*width, *height); err != nil {
+		log.Fatalf("Invalid -width/-height: %v", err)
+	}
+	tlsConfig, err := loadTLS(*caFile, *certFile, *keyFile, *insecure)
+	if err != nil {
+		log.Fatalf("Invalid TLS settings: %v", err)
+	}
+	textOverlay, err := newOverlay(*overlayPos, *overlayFormat, *overlayTime)
+	if err != nil {
+		log.Fatalf("Invalid -overlay: %v", err)
+	}
+
+	var src *videoSource
+	if *source != "" {
+		if src, err = newVideoSource(*source); err != nil {
+			log.Fatalf("Invalid -source: %v", err)
+		}
+	}
+
+	var rt *route
+	if *routeFlag != "" {
+		if rt, err = parseRoute(*routeFlag, *speed); err != nil {
+			log.Fatalf("Invalid route: %v", err)
+		}
+	}
+
 	log.Printf("Starting camera simulator with ID: %s", *id)
 	log.Printf("Resolution: %dx%d", *width, *height)
 	log.Printf("Server address: %s", *addr)
 
 	// Create and configure simulator
-	sim := NewCameraSimulator(*id, *addr, *width, *height)
+	sim := NewCameraSimulator(*id, *addr, *width, *height, metricLabels)
 	sim.videoOutputDir = *videoDir
+	sim.avSync = *pattern == "avsync"
+	sim.version = *protocol
+	if *format == "json" {
+		sim.version = wire.VersionJSON
+	}
+	sim.encoding = *encoding
+	sim.token = *token
+	sim.reconnect = *reconnect
+	sim.out = out
+	sim.outageFrames = max(*outageFrames, 1)
+	sim.route = rt
+	sim.overlay = textOverlay
+	sim.tls = tlsConfig
+	sim.adaptive = *adaptive
+	sim.heartbeatInterval = *heartbeat
+	sim.gop = *gop
+	if *ptz {
+		sim.ptz = &ptzHead{}
+	}
+	sim.source = src
+	if *mode == "burst" {
+		if *burstInterval <= 0 {
+			log.Fatalf("-burst-interval must be positive")
+		}
+		if *token == "" {
+			log.Fatalf("-mode burst needs the camera's -token to upload with")
+		}
+		c, err := client.New(*uploadURL, *token)
+		if err != nil {
+			log.Fatalf("Invalid -upload-url: %v", err)
+		}
+		if tlsConfig != nil {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = tlsConfig
+			c.HTTPClient = &http.Client{Transport: transport}
+		}
+		sim.burst = &burstUploader{client: c, interval: *burstInterval}
+	}
 
 	// Create context with cancellation
 	ctx, cancel := context.WithCancel(context.Background())
@@ -417,6 +1079,26 @@ func main() {
 		cancel()
 	}()
 
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			log.Printf("Serving metrics on %s/metrics", *metricsAddr)
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				log.Printf("Metrics server error: %v", err)
+			}
+		}()
+	}
+
+	if sim.burst != nil {
+		log.Printf("Recording locally, uploading to %s every %s", *uploadURL, *burstInterval)
+		if err := sim.Record(ctx); err != nil {
+			log.Printf("Recording error: %v", err)
+		}
+		sim.Stop()
+		return
+	}
+
 	// Connect and start streaming
 	if err := sim.Connect(); err != nil {
 		log.Fatalf("Failed to connect: %v", err)
@@ -429,3 +1111,26 @@ func main() {
 	// Final cleanup
 	sim.Stop()
 }
+
+// labelName matches valid Prometheus label names.
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// parseLabels parses comma-separated name=value pairs.
+func parseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	if s == "" {
+		return labels, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !labelName.MatchString(name) {
+			return nil, fmt.Errorf("%q is not name=value", pair)
+		}
+		if name == "camera_id" {
+			return nil, fmt.Errorf("camera_id is set from -id")
+		}
+		labels[name] = strings.TrimSpace(value)
+	}
+	return labels, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reporter writes what the simulator does: log lines by default, or, with
+// -output json, one JSON record per line on stdout for test harnesses.
+// Records have a time and a type: "status" every second, an event type
+// such as "reconnected", or "log" for anything else logged.
+type reporter struct {
+	json bool
+	mu   sync.Mutex
+	out  io.Writer
+}
+
+func newReporter(output string) *reporter {
+	r := &reporter{json: output == "json", out: os.Stdout}
+	if r.json {
+		log.SetFlags(0)
+		log.SetOutput(logWriter{r})
+	}
+	return r
+}
+
+// record writes a JSON record of type kind with fields.
+func (r *reporter) record(kind string, fields map[string]interface{}) {
+	rec := map[string]interface{}{"time": time.Now(), "type": kind}
+	for k, v := range fields {
+		rec[k] = v
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.out.Write(append(line, '\n'))
+}
+
+// event reports something that happened, with msg as its log line.
+func (r *reporter) event(kind, msg string, fields map[string]interface{}) {
+	if !r.json {
+		log.Print(msg)
+		return
+	}
+	if fields == nil {
+		fields = make(map[string]interface{})
+	}
+	fields["message"] = msg
+	r.record(kind, fields)
+}
+
+// logWriter turns log lines into "log" records.
+type logWriter struct{ r *reporter }
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.r.record("log", map[string]interface{}{"message": strings.TrimRight(string(p), "\n")})
+	return len(p), nil
+}
+
+// latency summarizes the durations sampled over a status interval.
+type latency struct {
+	count int
+	total time.Duration
+	max   time.Duration
+}
+
+func (l *latency) add(d time.Duration) {
+	l.count++
+	l.total += d
+	l.max = max(l.max, d)
+}
+
+func (l latency) fields() map[string]interface{} {
+	f := map[string]interface{}{"count": l.count, "avg_ms": 0.0, "max_ms": l.max.Seconds() * 1000}
+	if l.count > 0 {
+		f["avg_ms"] = (l.total / time.Duration(l.count)).Seconds() * 1000
+	}
+	return f
+}
+
+// stats are the totals reported in status records.
+type stats struct {
+	framesSent uint64
+	bytesSent  uint64 // of frame images
+	sendErrors uint64
+	reconnects uint64
+	dropped    uint64
+	// uploaded counts videos uploaded in burst mode, uploadErrors the
+	// bursts that failed
+	uploaded     uint64
+	uploadErrors uint64
+	encode       latency // since the last status
+	send         latency
+}
+
+// status reports the simulator's totals and the latencies sampled since
+// the last status, which it resets.
+func (cs *CameraSimulator) status(fps float64) {
+	if cs.out.json {
+		fields := map[string]interface{}{
+			"camera":            cs.id,
+			"connected":         !cs.reconnecting,
+			"frames_generated":  cs.frameCount,
+			"frames_sent":       cs.stats.framesSent,
+			"bytes_sent":        cs.stats.bytesSent,
+			"frames_per_second": fps,
+			"send_errors":       cs.stats.sendErrors,
+			"reconnects":        cs.stats.reconnects,
+			"outage_frames":     len(cs.outage),
+			"dropped_frames":    cs.stats.dropped,
+			"encode_latency":    cs.stats.encode.fields(),
+			"send_latency":      cs.stats.send.fields(),
+			"jpeg_quality":      cs.quality,
+			"target_fps":        cs.fps,
+		}
+		if cs.burst != nil {
+			fields["connected"] = false
+			fields["pending_uploads"] = len(cs.burst.pending)
+			fields["uploaded_videos"] = cs.stats.uploaded
+			fields["upload_errors"] = cs.stats.uploadErrors
+		}
+		cs.out.record("status", fields)
+	}
+	cs.stats.encode = latency{}
+	cs.stats.send = latency{}
+}
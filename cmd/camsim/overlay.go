@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Overlay positions
+const (
+	overlayTopLeft     = "top-left"
+	overlayTopRight    = "top-right"
+	overlayBottomLeft  = "bottom-left"
+	overlayBottomRight = "bottom-right"
+	overlayNone        = "none"
+)
+
+const (
+	overlayMargin  = 10 // pixels between the box and the frame's edge
+	overlayPadding = 4  // pixels between the text and the box's edge, before scaling
+	// overlayLineHeight is the height of one line of text in frames of
+	// this many rows; the text is scaled up by whole pixels from there.
+	overlayLineHeight = 360
+)
+
+// overlay burns a line of text into frames: the camera ID, frame number and
+// time, as laid out by format. {camera}, {frame} and {time} in format are
+// replaced, the time formatted with timeLayout.
+type overlay struct {
+	position   string
+	format     string
+	timeLayout string
+	face       font.Face
+}
+
+// newOverlay checks position and returns an overlay for it, or nil for
+// none.
+func newOverlay(position, format, timeLayout string) (*overlay, error) {
+	switch position {
+	case overlayTopLeft, overlayTopRight, overlayBottomLeft, overlayBottomRight:
+	case overlayNone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown overlay position %q", position)
+	}
+	return &overlay{
+		position:   position,
+		format:     format,
+		timeLayout: timeLayout,
+		face:       basicfont.Face7x13,
+	}, nil
+}
+
+// text formats the overlay for a frame.
+func (o *overlay) text(camera string, frame uint64, t time.Time) string {
+	return strings.NewReplacer(
+		"{camera}", camera,
+		"{frame}", strconv.FormatUint(frame, 10),
+		"{time}", t.Format(o.timeLayout),
+	).Replace(o.format)
+}
+
+// draw renders text in white on a black box in the overlay's corner. The
+// text is drawn at the font's size and scaled up by whole pixels for frames
+// taller than overlayLineHeight, so it stays legible at high resolutions.
+// Text wider than the frame is cut off.
+func (o *overlay) draw(img *image.RGBA, text string) {
+	metrics := o.face.Metrics()
+	ascent := metrics.Ascent.Ceil()
+	textWidth := font.MeasureString(o.face, text).Ceil()
+	lineHeight := metrics.Height.Ceil()
+
+	// The text at the font's own size, on its box
+	box := image.NewRGBA(image.Rect(0, 0, textWidth+2*overlayPadding, lineHeight+2*overlayPadding))
+	draw.Draw(box, box.Bounds(), image.Black, image.Point{}, draw.Src)
+	d := font.Drawer{
+		Dst:  box,
+		Src:  image.White,
+		Face: o.face,
+		Dot:  fixed.P(overlayPadding, overlayPadding+ascent),
+	}
+	d.DrawString(text)
+
+	bounds := img.Bounds()
+	scale := max(1, bounds.Dy()/overlayLineHeight)
+	w, h := box.Bounds().Dx()*scale, box.Bounds().Dy()*scale
+	x, y := bounds.Min.X+overlayMargin, bounds.Min.Y+overlayMargin
+	if o.position == overlayTopRight || o.position == overlayBottomRight {
+		x = bounds.Max.X - overlayMargin - w
+	}
+	if o.position == overlayBottomLeft || o.position == overlayBottomRight {
+		y = bounds.Max.Y - overlayMargin - h
+	}
+	dst := image.Rect(x, y, x+w, y+h).Intersect(bounds)
+
+	// Nearest-neighbor scaling keeps the bitmap font's pixels sharp
+	for py := dst.Min.Y; py < dst.Max.Y; py++ {
+		sy := (py - y) / scale
+		for px := dst.Min.X; px < dst.Max.X; px++ {
+			img.SetRGBA(px, py, box.RGBAAt((px-x)/scale, sy))
+		}
+	}
+}
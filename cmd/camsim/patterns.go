@@ -0,0 +1,178 @@
+package main
+
+import (
+	"image"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// Patterns are rendered straight into the RGBA Pix slice, a band of rows
+// per CPU, rather than pixel by pixel through Set, so 4K frames render in a
+// fraction of a frame interval.
+
+// minBandRows keeps bands large enough to be worth a goroutine.
+const minBandRows = 32
+
+var (
+	background = [4]uint8{40, 40, 40, 255}
+	white      = [4]uint8{255, 255, 255, 255}
+)
+
+const (
+	checkerSize  = 40  // pixels per checkerboard square
+	sineAmp      = 50  // pixels the sine wave swings either side of the middle
+	sineHalf     = 3   // half the thickness of the sine wave, in pixels
+	circleRadius = 50  // pixels
+	circleOrbit  = 100 // pixels the circle's center moves from the middle
+)
+
+// patternTables holds what the patterns need that only depends on the
+// resolution: whole rows to copy, and the sine and cosine of each column's
+// phase.
+type patternTables struct {
+	width, height int
+	gradient      []uint8
+	checker       [2][]uint8 // rows starting with a white and a dark square
+	sin, cos      []float64
+}
+
+func newPatternTables(width, height int) *patternTables {
+	t := &patternTables{
+		width:    width,
+		height:   height,
+		gradient: make([]uint8, width*4),
+		checker:  [2][]uint8{make([]uint8, width*4), make([]uint8, width*4)},
+		sin:      make([]float64, width),
+		cos:      make([]float64, width),
+	}
+	for x := 0; x < width; x++ {
+		g := uint8((float64(x) / float64(width)) * 255)
+		copy(t.gradient[x*4:], []uint8{g, g, g, 255})
+		if (x/checkerSize)%2 == 0 {
+			copy(t.checker[0][x*4:], white[:])
+			copy(t.checker[1][x*4:], background[:])
+		} else {
+			copy(t.checker[0][x*4:], background[:])
+			copy(t.checker[1][x*4:], white[:])
+		}
+		t.sin[x], t.cos[x] = math.Sincos(float64(x) * 0.05)
+	}
+	return t
+}
+
+// tables returns the pattern tables for the current resolution.
+func (cs *CameraSimulator) tables() *patternTables {
+	if cs.patterns == nil || cs.patterns.width != cs.width || cs.patterns.height != cs.height {
+		cs.patterns = newPatternTables(cs.width, cs.height)
+	}
+	return cs.patterns
+}
+
+// parallelRows calls fn for bands of rows [y0, y1) covering img, in
+// parallel, and waits for them.
+func parallelRows(img *image.RGBA, fn func(y0, y1 int)) {
+	height := img.Bounds().Dy()
+	bands := min(runtime.GOMAXPROCS(0), (height+minBandRows-1)/minBandRows)
+	if bands <= 1 {
+		fn(0, height)
+		return
+	}
+	step := (height + bands - 1) / bands
+	var wg sync.WaitGroup
+	for y0 := 0; y0 < height; y0 += step {
+		wg.Add(1)
+		go func(y0, y1 int) {
+			defer wg.Done()
+			fn(y0, y1)
+		}(y0, min(y0+step, height))
+	}
+	wg.Wait()
+}
+
+// row returns row y of img's pixels.
+func row(img *image.RGBA, y int) []uint8 {
+	start := y * img.Stride
+	return img.Pix[start : start+img.Rect.Dx()*4]
+}
+
+// fill sets every pixel of a row, or part of one, to c.
+func fill(pix []uint8, c [4]uint8) {
+	if len(pix) == 0 {
+		return
+	}
+	copy(pix, c[:])
+	// Double the filled part until the row is full
+	for n := 4; n < len(pix); n *= 2 {
+		copy(pix[n:], pix[:n])
+	}
+}
+
+func (cs *CameraSimulator) drawGradient(img *image.RGBA) {
+	t := cs.tables()
+	parallelRows(img, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			copy(row(img, y), t.gradient)
+		}
+	})
+}
+
+func (cs *CameraSimulator) drawCheckerboard(img *image.RGBA) {
+	t := cs.tables()
+	parallelRows(img, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			copy(row(img, y), t.checker[(y/checkerSize)%2])
+		}
+	})
+}
+
+// drawSineWave draws a thick sine wave moving along with the frame count.
+// The wave itself is a few pixels per column, drawn on this goroutine.
+func (cs *CameraSimulator) drawSineWave(img *image.RGBA) {
+	t := cs.tables()
+	parallelRows(img, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			fill(row(img, y), background)
+		}
+	})
+
+	// sin(a+b) from the columns' tables and the frame's offset
+	sinOff, cosOff := math.Sincos(float64(cs.frameCount) * 0.1)
+	mid := float64(cs.height) / 2
+	for x := 0; x < cs.width; x++ {
+		pos := mid + (t.sin[x]*cosOff+t.cos[x]*sinOff)*sineAmp
+		// Rows strictly within sineHalf of pos
+		top := max(int(math.Floor(pos-sineHalf))+1, 0)
+		bottom := min(int(math.Ceil(pos+sineHalf))-1, cs.height-1)
+		for y := top; y <= bottom; y++ {
+			i := y*img.Stride + x*4
+			copy(img.Pix[i:i+4], white[:])
+		}
+	}
+}
+
+// drawMovingCircle draws a disc circling the middle of the frame, filling
+// each row's span of it at once.
+func (cs *CameraSimulator) drawMovingCircle(img *image.RGBA) {
+	s, c := math.Sincos(float64(cs.frameCount) * 0.05)
+	centerX := cs.width/2 + int(c*circleOrbit)
+	centerY := cs.height/2 + int(s*circleOrbit)
+	parallelRows(img, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			pix := row(img, y)
+			fill(pix, background)
+			dy := y - centerY
+			rest := circleRadius*circleRadius - dy*dy
+			if rest <= 0 {
+				continue
+			}
+			// The widest dx with dx*dx < rest
+			dx := int(math.Sqrt(float64(rest - 1)))
+			left := max(centerX-dx, 0)
+			right := min(centerX+dx, cs.width-1)
+			if left <= right {
+				fill(pix[left*4:(right+1)*4], white)
+			}
+		}
+	})
+}
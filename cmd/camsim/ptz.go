@@ -0,0 +1,103 @@
+package main
+
+import (
+	"image"
+	"math"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/wire"
+)
+
+// How fast the simulated head moves, in position units per second: across
+// the whole pan, tilt or zoom range in two seconds.
+const (
+	panTiltSpeed = 1.0
+	zoomSpeed    = 0.5
+)
+
+// maxZoom is the magnification at full zoom.
+const maxZoom = 4
+
+// ptzHead simulates the pan/tilt/zoom head of a camera with -ptz. The
+// scene it looks at is the frame the camera would send without one, tiled
+// so panning and tilting never run out of it; panning fully either way
+// shifts the view by half a frame, and zooming magnifies up to maxZoom.
+// It moves toward its target at a constant speed, as a motorized head
+// would.
+type ptzHead struct {
+	pos    wire.PTZ
+	target wire.PTZ
+	moved  time.Time // when pos was last updated
+}
+
+// move sets where the head is heading, as a PTZ control message says.
+func (h *ptzHead) move(m wire.PTZMove) {
+	if !m.Valid() {
+		return
+	}
+	h.target = m.Apply(h.target)
+}
+
+// at moves the head toward its target for the time since it last moved,
+// and returns its position.
+func (h *ptzHead) at(now time.Time) wire.PTZ {
+	if !h.moved.IsZero() {
+		dt := now.Sub(h.moved).Seconds()
+		h.pos.Pan = approach(h.pos.Pan, h.target.Pan, panTiltSpeed*dt)
+		h.pos.Tilt = approach(h.pos.Tilt, h.target.Tilt, panTiltSpeed*dt)
+		h.pos.Zoom = approach(h.pos.Zoom, h.target.Zoom, zoomSpeed*dt)
+	}
+	h.moved = now
+	return h.pos
+}
+
+// approach returns v moved toward target by at most step.
+func approach(v, target, step float64) float64 {
+	if math.Abs(target-v) <= step {
+		return target
+	}
+	if target > v {
+		return v + step
+	}
+	return v - step
+}
+
+// ptzView returns what a head at p sees of scene. At home, with neither
+// pan, tilt nor zoom, that is the scene itself.
+func ptzView(scene *image.RGBA, p wire.PTZ) *image.RGBA {
+	if p == (wire.PTZ{}) {
+		return scene
+	}
+	b := scene.Bounds()
+	w, ht := b.Dx(), b.Dy()
+	mag := 1 + (maxZoom-1)*p.Zoom
+	// The scene point at the center of the view; tilting up looks higher
+	cx := float64(w)/2 + p.Pan*float64(w)/2
+	cy := float64(ht)/2 - p.Tilt*float64(ht)/2
+
+	// Nearest neighbor, with the source column of each view column worked
+	// out once
+	cols := make([]int, w)
+	for x := range cols {
+		cols[x] = wrap(int(math.Floor(cx+(float64(x)-float64(w)/2)/mag)), w) * 4
+	}
+	out := image.NewRGBA(image.Rect(0, 0, w, ht))
+	for y := 0; y < ht; y++ {
+		sy := wrap(int(math.Floor(cy+(float64(y)-float64(ht)/2)/mag)), ht)
+		src := scene.Pix[sy*scene.Stride:]
+		dst := out.Pix[y*out.Stride:]
+		for x, sx := range cols {
+			copy(dst[x*4:x*4+4], src[sx:sx+4])
+		}
+	}
+	return out
+}
+
+// wrap returns v within [0, n), tiling the scene.
+func wrap(v, n int) int {
+	v %= n
+	if v < 0 {
+		v += n
+	}
+	return v
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/wire"
+)
+
+// earthRadius is the mean radius of the Earth in meters.
+const earthRadius = 6371000
+
+// route moves a simulated mobile camera along waypoints at a constant
+// speed, looping from the last back to the first, so its frames carry the
+// locations a dashcam or drone would report.
+type route struct {
+	points []wire.Location
+	// legs[i] is the distance in meters from points[i] to the next point
+	legs  []float64
+	total float64
+	speed float64 // meters per second
+	start time.Time
+}
+
+// parseRoute reads waypoints given as "lat,lon[,alt]" separated by
+// semicolons, or, if s names a file, one per line with # comments.
+func parseRoute(s string, speed float64) (*route, error) {
+	var fields []string
+	if data, err := os.ReadFile(s); err == nil {
+		sc := bufio.NewScanner(strings.NewReader(string(data)))
+		for sc.Scan() {
+			line, _, _ := strings.Cut(sc.Text(), "#")
+			if line = strings.TrimSpace(line); line != "" {
+				fields = append(fields, line)
+			}
+		}
+	} else {
+		fields = strings.Split(s, ";")
+	}
+	if speed < 0 {
+		return nil, fmt.Errorf("speed must not be negative")
+	}
+
+	r := &route{speed: speed}
+	for _, f := range fields {
+		parts := strings.Split(strings.TrimSpace(f), ",")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("%q is not lat,lon[,alt]", f)
+		}
+		var v [3]float64
+		for i, p := range parts {
+			n, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not lat,lon[,alt]", f)
+			}
+			v[i] = n
+		}
+		p := wire.Location{Latitude: v[0], Longitude: v[1], Altitude: v[2]}
+		if !p.Valid() {
+			return nil, fmt.Errorf("%q is off the globe", f)
+		}
+		r.points = append(r.points, p)
+	}
+	if len(r.points) == 0 {
+		return nil, fmt.Errorf("no waypoints")
+	}
+
+	for i, p := range r.points {
+		d := distance(p, r.points[(i+1)%len(r.points)])
+		r.legs = append(r.legs, d)
+		r.total += d
+	}
+	return r, nil
+}
+
+// at returns where the camera is at t, having set off when first asked.
+func (r *route) at(t time.Time) wire.Location {
+	if r.start.IsZero() {
+		r.start = t
+	}
+	if r.total == 0 || r.speed == 0 {
+		return r.points[0]
+	}
+
+	travelled := math.Mod(t.Sub(r.start).Seconds()*r.speed, r.total)
+	i := 0
+	for i < len(r.legs)-1 && travelled > r.legs[i] {
+		travelled -= r.legs[i]
+		i++
+	}
+	from, to := r.points[i], r.points[(i+1)%len(r.points)]
+	// Legs are short enough to interpolate the coordinates linearly
+	f := 0.0
+	if r.legs[i] > 0 {
+		f = travelled / r.legs[i]
+	}
+	return wire.Location{
+		Latitude:  from.Latitude + (to.Latitude-from.Latitude)*f,
+		Longitude: from.Longitude + (to.Longitude-from.Longitude)*f,
+		Altitude:  from.Altitude + (to.Altitude-from.Altitude)*f,
+		Heading:   bearing(from, to),
+		Speed:     r.speed,
+	}
+}
+
+func radians(deg float64) float64 { return deg * math.Pi / 180 }
+
+// distance is the great-circle distance in meters between a and b.
+func distance(a, b wire.Location) float64 {
+	lat1, lat2 := radians(a.Latitude), radians(b.Latitude)
+	dLat, dLon := lat2-lat1, radians(b.Longitude-a.Longitude)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// bearing is the initial heading from a to b in degrees clockwise from
+// north.
+func bearing(a, b wire.Location) float64 {
+	lat1, lat2 := radians(a.Latitude), radians(b.Latitude)
+	dLon := radians(b.Longitude - a.Longitude)
+	y := math.Sin(dLon) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLon)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/raeeceip/cctv/pkg/pathutil"
+)
+
+// videoSource decodes a video file with FFmpeg into raw frames for
+// -source, looping it when it ends. FFmpeg scales and resamples the video
+// to the resolution and frame rate the simulator sends at, and is
+// restarted from the beginning of the file when those change.
+type videoSource struct {
+	path string // as FFmpeg takes it
+	name string // shown as the frames' pattern
+
+	cmd    *exec.Cmd
+	out    io.ReadCloser
+	stderr bytes.Buffer
+	// What the running FFmpeg produces
+	width, height, fps int
+}
+
+func newVideoSource(path string) (*videoSource, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	p, err := pathutil.FFmpeg(path)
+	if err != nil {
+		return nil, err
+	}
+	return &videoSource{path: p, name: filepath.Base(path)}, nil
+}
+
+// frame decodes the next frame of the video at width x height, as sent at
+// fps, into a new image.
+func (v *videoSource) frame(width, height, fps int) (*image.RGBA, error) {
+	if v.cmd == nil || width != v.width || height != v.height || fps != v.fps {
+		v.close()
+		if err := v.start(width, height, fps); err != nil {
+			return nil, err
+		}
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	if _, err := io.ReadFull(v.out, img.Pix); err != nil {
+		v.close()
+		return nil, fmt.Errorf("ffmpeg stopped decoding %s: %v\nOutput: %s",
+			v.name, err, strings.TrimSpace(v.stderr.String()))
+	}
+	return img, nil
+}
+
+func (v *videoSource) start(width, height, fps int) error {
+	v.stderr.Reset()
+	cmd := exec.Command("ffmpeg",
+		"-nostdin",
+		"-loglevel", "error",
+		"-stream_loop", "-1",
+		"-i", v.path,
+		"-an",
+		"-vf", fmt.Sprintf("fps=%d,scale=%d:%d", fps, width, height),
+		"-pix_fmt", "rgba",
+		"-f", "rawvideo",
+		"-")
+	cmd.Stderr = &v.stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+	v.cmd, v.out = cmd, out
+	v.width, v.height, v.fps = width, height, fps
+	return nil
+}
+
+// close stops FFmpeg, if it is running.
+func (v *videoSource) close() {
+	if v.cmd == nil {
+		return
+	}
+	v.cmd.Process.Kill()
+	v.cmd.Wait()
+	v.cmd, v.out = nil, nil
+}
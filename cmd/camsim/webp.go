@@ -0,0 +1,29 @@
+//go:build webp && cgo
+
+package main
+
+/*
+#cgo LDFLAGS: -lwebp
+#include <stdlib.h>
+#include <webp/encode.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"image"
+	"unsafe"
+)
+
+// encodeWebP encodes a frame as a lossy WebP with libwebp.
+var encodeWebP = func(img *image.RGBA, quality int) ([]byte, error) {
+	b := img.Rect
+	var out *C.uint8_t
+	size := C.WebPEncodeRGBA((*C.uint8_t)(unsafe.Pointer(&img.Pix[img.PixOffset(b.Min.X, b.Min.Y)])),
+		C.int(b.Dx()), C.int(b.Dy()), C.int(img.Stride), C.float(quality), &out)
+	if size == 0 {
+		return nil, errors.New("libwebp failed to encode the frame")
+	}
+	defer C.WebPFree(unsafe.Pointer(out))
+	return C.GoBytes(unsafe.Pointer(out), C.int(size)), nil
+}
@@ -0,0 +1,9 @@
+//go:build !webp || !cgo
+
+package main
+
+import "image"
+
+// encodeWebP encodes a frame as a WebP with libwebp, which needs the webp
+// build tag and cgo.
+var encodeWebP func(img *image.RGBA, quality int) ([]byte, error)
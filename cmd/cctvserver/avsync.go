@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/raeeceip/cctv/internal/avsync"
+)
+
+// runAVSync handles "cctvserver avsync [-json] <video>", which measures the
+// A/V offset in a recording of camsim's avsync pattern.
+func runAVSync(args []string) error {
+	fs := flag.NewFlagSet("avsync", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "Print the full report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: cctvserver avsync [-json] <video>")
+	}
+
+	report, err := avsync.Analyze(context.Background(), fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	fmt.Printf("Flashes: %d (interval %.1f-%.1f ms)\n",
+		len(report.Flashes), report.MinFlashIntervalMs, report.MaxFlashIntervalMs)
+	if !report.HasAudio {
+		fmt.Println("No audio stream; offset not measured")
+		return nil
+	}
+	fmt.Printf("Beeps:   %d\n", len(report.Beeps))
+	if report.Pairs == 0 {
+		return fmt.Errorf("no flash had a beep within 500ms")
+	}
+	fmt.Printf("Offset:  mean %.2f ms, min %.2f ms, max %.2f ms, drift %.2f ms over %d pairs (positive: audio late)\n",
+		report.MeanOffsetMs, report.MinOffsetMs, report.MaxOffsetMs, report.DriftMs, report.Pairs)
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/backup"
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/index"
+)
+
+// runBackup handles "cctvserver backup [-o file] [-videos 24h]". It can run
+// alongside the server; the index is copied with a consistent snapshot.
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	output := fs.String("o", "", "Archive to write (default cctv-backup-<time>.tar.gz)")
+	videos := fs.Duration("videos", 0, "Include videos that ended within this window")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	ctx := context.Background()
+	ix, _, err := index.OpenAndMigrate(ctx, cfg.Storage.IndexPath)
+	if err != nil {
+		return err
+	}
+	defer ix.Close()
+
+	opts := backup.Options{Index: ix, ConfigFile: config.File()}
+	if *videos > 0 {
+		if opts.Videos, err = backup.RecentVideos(ctx, ix, *videos); err != nil {
+			return err
+		}
+	}
+
+	name := *output
+	if name == "" {
+		name = fmt.Sprintf("cctv-backup-%s.tar.gz", time.Now().Format("20060102_150405"))
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+
+	manifest, err := backup.Create(ctx, f, opts)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+		return err
+	}
+
+	fmt.Printf("Wrote %s (%d files, index schema version %d)\n",
+		name, len(manifest.Files), manifest.SchemaVersion)
+	return nil
+}
+
+// runRestore handles "cctvserver restore [-force] <archive>". The server
+// must be stopped first.
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	force := fs.Bool("force", false, "Overwrite an existing index and videos")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: cctvserver restore [-force] <archive>")
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	configFile := config.File()
+	if configFile == "" {
+		configFile = "config.yaml"
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	manifest, err := backup.Restore(f, backup.RestoreOptions{
+		IndexPath:  cfg.Storage.IndexPath,
+		ConfigFile: configFile,
+		OutputDir:  cfg.Storage.OutputDir,
+		Force:      *force,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %d files from backup taken %s\n",
+		len(manifest.Files), manifest.CreatedAt.Local().Format(time.RFC1123))
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/codec"
+	"github.com/raeeceip/cctv/internal/index"
+)
+
+// runBench handles "cctvserver bench index" and "cctvserver bench codec".
+func runBench(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "index":
+			return runBenchIndex(args[1:])
+		case "codec":
+			return runBenchCodec(args[1:])
+		}
+	}
+	return fmt.Errorf("usage: cctvserver bench index [-cameras n] [-fps n] [-duration d] [-batch n] [-dir path]\n" +
+		"       cctvserver bench codec [-image file.jpg] [-duration d]")
+}
+
+// runBenchIndex feeds the frame index from simulated cameras at their frame
+// rate and reports whether it keeps up. The scratch database goes in -dir
+// so it is on the same disk as the real index.
+func runBenchIndex(args []string) error {
+	fs := flag.NewFlagSet("bench index", flag.ContinueOnError)
+	cameras := fs.Int("cameras", 64, "Simulated cameras")
+	fps := fs.Int("fps", 30, "Frames per second per camera")
+	duration := fs.Duration("duration", 10*time.Second, "How long to run")
+	batch := fs.Int("batch", 500, "Frames per group commit")
+	interval := fs.Duration("flush-interval", time.Second, "Longest time between commits")
+	dir := fs.String("dir", ".", "Directory for the scratch database")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp(*dir, "bench-index-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	ctx := context.Background()
+	ix, _, err := index.OpenAndMigrate(ctx, filepath.Join(tmp, "index.db"))
+	if err != nil {
+		return err
+	}
+	defer ix.Close()
+
+	w := ix.NewFrameWriter(*batch, *interval)
+	runCtx, stop := context.WithCancel(ctx)
+	writerDone := make(chan struct{})
+	var failures int
+	go func() {
+		defer close(writerDone)
+		w.Run(runCtx, func(error) { failures++ })
+	}()
+
+	fmt.Printf("Feeding %d frames/sec from %d cameras for %s...\n", *cameras**fps, *cameras, *duration)
+	start := time.Now()
+	deadline := start.Add(*duration)
+	var wg sync.WaitGroup
+	for c := 0; c < *cameras; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			camera := fmt.Sprintf("cam-%d", c)
+			ticker := time.NewTicker(time.Second / time.Duration(*fps))
+			defer ticker.Stop()
+			for n := uint64(1); time.Now().Before(deadline); n++ {
+				t := <-ticker.C
+				w.Add(index.Frame{
+					CameraID:  camera,
+					Number:    n,
+					Time:      t,
+					Path:      filepath.Join("frames", camera, fmt.Sprintf("frame_%05d.jpg", n)),
+					SizeBytes: 50000,
+				})
+			}
+		}(c)
+	}
+	wg.Wait()
+	stop()
+	<-writerDone
+
+	flushStart := time.Now()
+	if err := w.Flush(ctx); err != nil {
+		failures++
+	}
+	elapsed := time.Since(start)
+	written, dropped := w.Stats()
+
+	fmt.Printf("Indexed %d frames in %s (%.0f frames/sec), %d dropped, final commit took %s\n",
+		written, elapsed.Round(time.Millisecond), float64(written)/elapsed.Seconds(),
+		dropped, time.Since(flushStart).Round(time.Millisecond))
+	if dropped > 0 || failures > 0 {
+		return fmt.Errorf("the index did not keep up")
+	}
+	return nil
+}
+
+// runBenchCodec decodes and encodes a frame with each JPEG codec built in,
+// as the server does with every frame, and reports how many frames a second
+// each manages on one core. Without -image, the frame is a generated 720p
+// one.
+func runBenchCodec(args []string) error {
+	fs := flag.NewFlagSet("bench codec", flag.ContinueOnError)
+	imagePath := fs.String("image", "", "JPEG to use instead of a generated frame")
+	duration := fs.Duration("duration", 3*time.Second, "How long to run each test")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var data []byte
+	if *imagePath != "" {
+		var err error
+		if data, err = os.ReadFile(*imagePath); err != nil {
+			return err
+		}
+	} else {
+		// Gradients with noise compress like camera frames do
+		img := image.NewRGBA(image.Rect(0, 0, 1280, 720))
+		rng := rand.New(rand.NewSource(1))
+		for y := 0; y < 720; y++ {
+			for x := 0; x < 1280; x++ {
+				n := uint8(rng.Intn(24))
+				img.SetRGBA(x, y, color.RGBA{uint8(x/5) + n, uint8(y/3) + n, uint8((x+y)/8) + n, 255})
+			}
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+
+	// rate runs fn for the duration and returns how often it ran per second
+	rate := func(fn func() error) (float64, error) {
+		start := time.Now()
+		n := 0
+		for time.Since(start) < *duration {
+			if err := fn(); err != nil {
+				return 0, err
+			}
+			n++
+		}
+		return float64(n) / time.Since(start).Seconds(), nil
+	}
+
+	fmt.Printf("Frame of %d KB, %s per test\n", len(data)>>10, *duration)
+	var baseDecode, baseEncode float64
+	for _, name := range codec.Available() {
+		c, _ := codec.Get(name)
+		img, err := c.Decode(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		decode, err := rate(func() error { _, err := c.Decode(data); return err })
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		encode, err := rate(func() error { return c.Encode(io.Discard, img, 80) })
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if name == "go" {
+			baseDecode, baseEncode = decode, encode
+		}
+		fmt.Printf("%-10s decode %7.1f frames/sec (%.1fx)   encode %7.1f frames/sec (%.1fx)\n",
+			name, decode, decode/baseDecode, encode, encode/baseEncode)
+	}
+	return nil
+}
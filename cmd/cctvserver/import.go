@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/framestore"
+	"github.com/raeeceip/cctv/internal/importer"
+	"github.com/raeeceip/cctv/internal/index"
+)
+
+// runImport handles "cctvserver import [-camera id] [-dry-run] <dir>...".
+// File names are matched against storage.import.patterns.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	camera := fs.String("camera", "", "Camera ID for all imported files instead of inferring it")
+	dryRun := fs.Bool("dry-run", false, "Show what would be imported without changing the index")
+	verbose := fs.Bool("v", false, "List every imported file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: cctvserver import [-camera id] [-dry-run] <dir>...")
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	ctx := context.Background()
+	ix, _, err := index.OpenAndMigrate(ctx, cfg.Storage.IndexPath)
+	if err != nil {
+		return err
+	}
+	defer ix.Close()
+
+	im, err := importer.New(ix, cfg.Storage.Import)
+	if err != nil {
+		return err
+	}
+	im.Camera = *camera
+	im.Site = cfg.Site
+	im.Layout = framestore.Layout(cfg.Storage.FrameLayout)
+	im.DryRun = *dryRun
+
+	report := func(path string, r *index.Recording, err error) {
+		switch {
+		case err != nil:
+			fmt.Printf("FAILED %s: %v\n", path, err)
+		case *verbose || *dryRun:
+			fmt.Printf("%s  %-20s  %s\n", r.StartTime.Format("2006-01-02 15:04:05"), r.CameraID, path)
+		}
+	}
+
+	var total importer.Result
+	for _, dir := range fs.Args() {
+		res, err := im.Import(ctx, dir, report)
+		total.Imported += res.Imported
+		total.Skipped += res.Skipped
+		total.Failed += res.Failed
+		if err != nil {
+			return err
+		}
+	}
+
+	verb := "Imported"
+	if *dryRun {
+		verb = "Would import"
+	}
+	fmt.Printf("%s %d files (%d unrecognized, %d failed)\n", verb, total.Imported, total.Skipped, total.Failed)
+	if total.Failed > 0 {
+		return fmt.Errorf("%d files failed to import", total.Failed)
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/index"
+	"github.com/raeeceip/cctv/internal/server"
+)
+
+// Where init puts the certificate it generates, relative to the working
+// directory
+const (
+	initCertFile = "certs/cert.pem"
+	initKeyFile  = "certs/key.pem"
+)
+
+// certValidity is how long the self-signed certificate is valid.
+const certValidity = 2 * 365 * 24 * time.Hour
+
+// starterConfig is the config.yaml init writes. Everything not in it keeps
+// its default.
+var starterConfig = template.Must(template.New("config").Parse(`# CCTV System Configuration, written by cctvserver init
+log_level: "info"
+
+server:
+  host: "0.0.0.0" # every interface, so cameras on the network can connect
+  port: 8080 # operator API
+  signal_port: 8081 # camera ingest websockets
+  ssl:
+    enabled: true
+    cert_file: "{{.CertFile}}" # self-signed; replace with a CA-issued one to avoid warnings
+    key_file: "{{.KeyFile}}"
+  admin:
+    token: "{{.AdminToken}}" # bearer token for /api/v1/admin/*
+  auth:
+    required: {{.RequireAuth}} # refuse cameras without a valid token
+
+storage:
+  output_dir: "{{.OutputDir}}"
+  index_path: "{{.IndexPath}}"
+`))
+
+// runInit handles "cctvserver init", which sets up a new install in the
+// working directory: a config.yaml with TLS on and an admin token, a
+// self-signed certificate, the first user and tokens for the first
+// cameras. The secrets are printed once.
+func runInit(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	storage := fs.String("storage", "frames", "Directory to store frames, videos and the index in")
+	user := fs.String("user", "admin", "Name of the first user")
+	cameras := fs.String("cameras", "", "Comma-separated IDs of cameras to issue tokens for; cameras then need one to connect")
+	hosts := fs.String("hosts", "localhost", "Comma-separated host names and IPs the certificate is for; the first is the server's host")
+	force := fs.Bool("force", false, "Overwrite an existing config.yaml")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cameraIDs := splitList(*cameras)
+	hostNames := splitList(*hosts)
+	if len(hostNames) == 0 {
+		return fmt.Errorf("-hosts needs at least one host")
+	}
+
+	if _, err := os.Stat("config.yaml"); err == nil && !*force {
+		return fmt.Errorf("config.yaml already exists; use -force to overwrite it")
+	}
+
+	// Refuse before writing anything if the install is already set up
+	ctx := context.Background()
+	indexPath := filepath.Join(*storage, "index.db")
+	if err := os.MkdirAll(*storage, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", *storage, err)
+	}
+	ix, _, err := index.OpenAndMigrate(ctx, indexPath)
+	if err != nil {
+		return err
+	}
+	defer ix.Close()
+	users, err := ix.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return fmt.Errorf("%s already has users, so this install is set up", indexPath)
+	}
+
+	if err := writeCertificate(initCertFile, initKeyFile, hostNames); err != nil {
+		return err
+	}
+	adminToken := make([]byte, 32)
+	if _, err := rand.Read(adminToken); err != nil {
+		return err
+	}
+	f, err := os.OpenFile("config.yaml", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write config.yaml: %w", err)
+	}
+	err = starterConfig.Execute(f, map[string]interface{}{
+		"CertFile":    initCertFile,
+		"KeyFile":     initKeyFile,
+		"AdminToken":  hex.EncodeToString(adminToken),
+		"RequireAuth": len(cameraIDs) > 0,
+		"OutputDir":   filepath.ToSlash(*storage),
+		"IndexPath":   filepath.ToSlash(indexPath),
+	})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write config.yaml: %w", err)
+	}
+	if _, err := config.Load(); err != nil {
+		return fmt.Errorf("written config.yaml is invalid: %w", err)
+	}
+
+	creds, err := server.Bootstrap(ctx, ix, *user, cameraIDs)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Wrote config.yaml and a self-signed certificate in", initCertFile)
+	fmt.Println()
+	fmt.Println("Keep these, they are not shown again:")
+	fmt.Printf("  admin token: %s\n", hex.EncodeToString(adminToken))
+	fmt.Printf("  token of user %s: %s\n", creds.User.Name, creds.UserToken)
+	ids := make([]string, 0, len(creds.CameraTokens))
+	for id := range creds.CameraTokens {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		fmt.Printf("  token of camera %s: %s\n", id, creds.CameraTokens[id])
+	}
+	fmt.Println()
+	fmt.Printf("Start the server with cctvserver; cameras connect to wss://%s:8081/camera/connect\n", hostNames[0])
+	return nil
+}
+
+// writeCertificate writes a self-signed certificate for hosts and its key,
+// keeping a pair that already exists.
+func writeCertificate(certFile, keyFile string, hosts []string) error {
+	if _, err := os.Stat(certFile); err == nil {
+		if _, err := os.Stat(keyFile); err == nil {
+			return nil
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(certFile), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(certFile), err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0], Organization: []string{"cctvserver"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := writePEM(keyFile, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+	return writePEM(certFile, "CERTIFICATE", der, 0644)
+}
+
+func writePEM(name, blockType string, der []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	err = pem.Encode(f, &pem.Block{Type: blockType, Bytes: der})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+// splitList splits a comma-separated flag, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
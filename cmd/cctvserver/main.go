@@ -2,13 +2,13 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"os"
-	"os/signal"
 	"strings"
-	"syscall"
 	"time"
 
+	"github.com/kardianos/service"
 	"github.com/raeeceip/cctv/internal/config"
 	"github.com/raeeceip/cctv/internal/server"
 	"github.com/raeeceip/cctv/pkg/logger"
@@ -20,29 +20,95 @@ const (
 )
 
 func main() {
+	workDir := flag.String("workdir", "", "Directory containing config.yaml and runtime data")
+	ui := flag.Bool("ui", false, "Show a dashboard of cameras, the processor, disk space and logs in a terminal UI")
+	flag.Parse()
+
+	if *workDir != "" {
+		if err := os.Chdir(*workDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to change to %s: %v\n", *workDir, err)
+			os.Exit(1)
+		}
+	}
+
+	// Subcommands
+	if args := flag.Args(); len(args) > 0 {
+		var err error
+		switch args[0] {
+		case "init":
+			err = runInit(args[1:])
+		case "service":
+			err = controlService(args[1:])
+		case "migrate":
+			err = runMigrate(args[1:])
+		case "backup":
+			err = runBackup(args[1:])
+		case "restore":
+			err = runRestore(args[1:])
+		case "import":
+			err = runImport(args[1:])
+		case "avsync":
+			err = runAVSync(args[1:])
+		case "worker":
+			err = runWorker(args[1:])
+		case "bench":
+			err = runBench(args[1:])
+		case "soak":
+			err = runSoak(args[1:])
+		case "replay":
+			err = runReplay(args[1:])
+		default:
+			err = fmt.Errorf("unknown command %q", args[0])
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Started by the service manager rather than from a terminal
+	if !service.Interactive() {
+		if err := runService(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := run(context.Background(), *ui); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run starts the server and blocks until parent is cancelled, a shutdown
+// signal arrives or shutdown is requested through the admin API. With ui
+// set, quitting the terminal UI shuts down too.
+func run(parent context.Context, ui bool) error {
 	// Initialize configuration
 	cfg, err := config.Load()
 	if err != nil {
-		panic("Failed to load config: " + err.Error())
+		return fmt.Errorf("failed to load config: %w", err)
 	}
 
 	// Initialize enhanced logger with UI disabled initially
 	logConfig := logger.Config{
-		OutputPath: "logs/cctv.log",
-		EnableUI:   false, // Start with UI disabled
-		UseConsole: true,  // Enable console output
+		OutputPath: cfg.Log.OutputPath,
+		MaxSize:    cfg.Log.MaxSize,
+		MaxBackups: cfg.Log.MaxBackups,
+		MaxAge:     cfg.Log.MaxAge,
+		Compress:   cfg.Log.Compress,
+		EnableUI:   ui,
+		UseConsole: true, // Enable console output
 	}
 
 	log, err := logger.NewLogger(cfg.LogLevel, logConfig)
 	if err != nil {
-		panic("Failed to initialize logger: " + err.Error())
+		return fmt.Errorf("failed to initialize logger: %w", err)
 	}
 
-	// Setup signal handling
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
-
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(parent)
 	defer cancel()
 
 	// Cleanup handling
@@ -58,22 +124,62 @@ func main() {
 		}
 	}()
 
-	// Handle shutdown signal in a separate goroutine
-	go func() {
-		sig := <-signalChan
-		log.Info("Received shutdown signal", zap.String("signal", sig.String()))
-		cancel()
-	}()
-
 	// Initialize and start server
 	srv, err := server.New(cfg, log)
 	if err != nil {
-		log.Fatal("Failed to initialize server", zap.Error(err))
+		log.Error("Failed to initialize server", zap.Error(err))
+		return err
 	}
 
+	if logConfig.EnableUI {
+		log.SetStatusProvider(srv)
+		log.AddPane("Consolidation backlog", srv.BacklogView)
+		if err := log.StartUI(); err != nil {
+			return fmt.Errorf("failed to start UI: %w", err)
+		}
+	}
+
+	// Setup signal handling
+	signalChan := make(chan os.Signal, 1)
+	notifySignals(signalChan)
+
+	// Signals and the admin API share the same server lifecycle methods
+	go func() {
+		for {
+			select {
+			case sig := <-signalChan:
+				switch sig {
+				case reloadSignal:
+					log.Info("Received reload signal", zap.String("signal", sig.String()))
+					if err := srv.Reload(); err != nil {
+						log.Error("Reload failed", zap.Error(err))
+					}
+				case drainSignal:
+					log.Info("Received drain signal", zap.String("signal", sig.String()))
+					srv.Drain()
+				default:
+					log.Info("Received shutdown signal", zap.String("signal", sig.String()))
+					cancel()
+					return
+				}
+			case <-srv.ShutdownRequested():
+				cancel()
+				return
+			case <-log.UIClosed():
+				log.Info("UI closed, shutting down")
+				cancel()
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
 	// Start server
+	var serveErr error
 	if err := srv.Start(ctx); err != nil && err != context.Canceled {
 		log.Error("Server error", zap.Error(err))
+		serveErr = err
 	}
 
 	// Graceful shutdown
@@ -97,4 +203,5 @@ func main() {
 	// Final cleanup
 	time.Sleep(100 * time.Millisecond) // Brief pause for final logs
 	log.Info("Server shutdown complete")
+	return serveErr
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/index"
+)
+
+// runMigrate handles "cctvserver migrate [up|down|status]". The server
+// also migrates to the latest version at startup; this is for inspecting
+// the schema and rolling back before a downgrade.
+func runMigrate(args []string) error {
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	ix, err := index.Open(cfg.Storage.IndexPath)
+	if err != nil {
+		return err
+	}
+	defer ix.Close()
+
+	ctx := context.Background()
+	switch action {
+	case "up":
+		applied, err := ix.Migrate(ctx)
+		for _, m := range applied {
+			fmt.Printf("Applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("Index schema is up to date")
+		}
+
+	case "down":
+		m, err := ix.Rollback(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Rolled back %04d_%s\n", m.Version, m.Name)
+
+	case "status":
+		status, err := ix.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, m := range status {
+			applied := "pending"
+			if m.Applied {
+				applied = m.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", m.Version, m.Name, applied)
+		}
+		w.Flush()
+
+	default:
+		return fmt.Errorf("usage: cctvserver migrate [up|down|status]")
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/codec"
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/detect"
+	"github.com/raeeceip/cctv/internal/framestore"
+	"github.com/raeeceip/cctv/internal/index"
+	"github.com/raeeceip/cctv/internal/jobs"
+	"github.com/raeeceip/cctv/internal/processor"
+	"github.com/raeeceip/cctv/internal/replay"
+	"github.com/raeeceip/cctv/internal/retention"
+	"github.com/raeeceip/cctv/internal/server"
+	"github.com/raeeceip/cctv/pkg/logger"
+)
+
+// replayTimeLayout is the local time format -from and -to take besides
+// RFC 3339, as frame names use local time.
+const replayTimeLayout = "2006-01-02 15:04:05"
+
+// runReplay handles "cctvserver replay -camera id -from t [-to t]
+// [-detect] [-consolidate] [-dry-run]". Without -detect or -consolidate
+// both are done.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	camera := fs.String("camera", "", "Camera whose frames to replay")
+	fromFlag := fs.String("from", "", `Replay frames taken from this time, RFC 3339 or local "2006-01-02 15:04:05"`)
+	toFlag := fs.String("to", "", "Replay frames taken before this time; defaults to now")
+	detectFlag := fs.Bool("detect", false, "Run motion detection again, replacing the motion events of the range")
+	consolidate := fs.Bool("consolidate", false, "Make videos of the frames no recording covers")
+	dryRun := fs.Bool("dry-run", false, "Show what would be replayed without changing anything")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *camera == "" || *fromFlag == "" || fs.NArg() > 0 {
+		return fmt.Errorf("usage: cctvserver replay -camera id -from time [-to time] [-detect] [-consolidate] [-dry-run]")
+	}
+	from, err := parseReplayTime(*fromFlag)
+	if err != nil {
+		return fmt.Errorf("invalid -from: %w", err)
+	}
+	to := time.Now()
+	if *toFlag != "" {
+		if to, err = parseReplayTime(*toFlag); err != nil {
+			return fmt.Errorf("invalid -to: %w", err)
+		}
+	}
+	if !*detectFlag && !*consolidate {
+		*detectFlag, *consolidate = true, true
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	// The summary is printed; only problems are logged
+	log, err := logger.NewLogger("warn", logger.Config{
+		OutputPath: filepath.Join(filepath.Dir(cfg.Log.OutputPath), "replay.log"),
+		MaxSize:    cfg.Log.MaxSize,
+		MaxBackups: cfg.Log.MaxBackups,
+		MaxAge:     cfg.Log.MaxAge,
+		Compress:   cfg.Log.Compress,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to initialize logger: %w", err)
+	}
+	defer log.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ix, _, err := index.OpenAndMigrate(ctx, cfg.Storage.IndexPath)
+	if err != nil {
+		return err
+	}
+	defer ix.Close()
+
+	store, err := framestore.New(cfg.Storage.OutputDir, framestore.Layout(cfg.Storage.FrameLayout), cfg.Storage.Naming.Frame, cfg.Site)
+	if err != nil {
+		return err
+	}
+	var detector *detect.Detector
+	if *detectFlag {
+		detector = detect.New(cfg.Motion.Interval, ix.MotionSettings, log)
+	}
+	var proc *processor.FrameProcessor
+	if *consolidate {
+		if _, err := codec.Use(cfg.Processor.JPEGCodec); err != nil {
+			return err
+		}
+		if proc, err = processor.NewFrameProcessor(server.ProcessorConfig(cfg), log); err != nil {
+			return fmt.Errorf("failed to create processor: %w", err)
+		}
+		// Jobs the recordings need, such as retention transcodes, are
+		// queued in the index for the server to run
+		sealer := retention.New(ix, jobs.New(ix, log, cfg.Jobs), log, cfg)
+		proc.OnVideoCreated(func(v processor.Video) {
+			indexReplayedVideo(ctx, ix, sealer, cfg, v)
+		})
+	}
+
+	res, err := replay.New(ix, store, detector, proc, log).Replay(ctx, replay.Options{
+		CameraID:    *camera,
+		From:        from,
+		To:          to,
+		Detect:      *detectFlag,
+		Consolidate: *consolidate,
+		DryRun:      *dryRun,
+	})
+	fmt.Printf("%d frames of %s from %s to %s\n", res.Frames, *camera,
+		from.Local().Format(replayTimeLayout), to.Local().Format(replayTimeLayout))
+	if *detectFlag {
+		verb := "Found"
+		if *dryRun {
+			verb = "Would find"
+		}
+		fmt.Printf("%s %d motion events, replacing %d\n", verb, res.MotionEvents, res.Replaced)
+	}
+	if *consolidate {
+		if *dryRun {
+			fmt.Printf("Would consolidate %d frames no recording covers\n", res.Unconsolidated)
+		} else {
+			fmt.Printf("Made %d videos of %d frames no recording covered\n", res.Videos, res.Unconsolidated)
+		}
+	}
+	return err
+}
+
+// parseReplayTime reads an RFC 3339 time, or a local one in
+// replayTimeLayout.
+func parseReplayTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(replayTimeLayout, v, time.Local)
+}
+
+// indexReplayedVideo seals and indexes a video made by a replay, as the
+// server does its own.
+func indexReplayedVideo(ctx context.Context, ix *index.Index, sealer *retention.Manager, cfg *config.Config, v processor.Video) {
+	if err := sealer.Seal(v.Path); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to make %s read-only: %v\n", v.Path, err)
+	}
+	rec := &index.Recording{
+		CameraID:   v.CameraID,
+		Path:       v.Path,
+		StartTime:  v.StartTime,
+		EndTime:    v.EndTime,
+		FrameCount: v.FrameCount,
+		SizeBytes:  v.SizeBytes,
+		Codec:      v.Codec,
+	}
+	if err := ix.AddRecording(ctx, rec); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to index %s: %v\n", v.Path, err)
+		return
+	}
+	fmt.Printf("Created %s (%d frames)\n", v.Path, v.FrameCount)
+
+	// The frames are gone once consolidated with delete_originals
+	if cfg.Storage.FrameIndex.Enabled && cfg.Storage.VideoConsolidation.DeleteOriginals {
+		if _, err := ix.DeleteFrames(ctx, v.CameraID, v.StartTime, v.EndTime); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to remove consolidated frames from index: %v\n", err)
+		}
+	}
+}
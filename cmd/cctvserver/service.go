@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/kardianos/service"
+)
+
+// program adapts the server lifecycle to the OS service manager (Windows
+// SCM, systemd, launchd).
+type program struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (p *program) Start(s service.Service) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.done = make(chan struct{})
+
+	// Start must not block; the service manager waits for it to return
+	go func() {
+		defer close(p.done)
+		if err := run(ctx, false); err != nil {
+			fmt.Fprintf(os.Stderr, "cctvserver: %v\n", err)
+			// Let the service manager see the failure and apply its
+			// restart policy
+			os.Exit(1)
+		}
+	}()
+	return nil
+}
+
+func (p *program) Stop(s service.Service) error {
+	p.cancel()
+	<-p.done
+	return nil
+}
+
+func newService() (service.Service, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get working directory: %w", err)
+	}
+
+	return service.New(&program{}, &service.Config{
+		Name:        "cctvserver",
+		DisplayName: "CCTV Server",
+		Description: "Receives camera streams and records them to disk.",
+		// Services start in the system directory; remember where config.yaml
+		// and the frame store live. WorkingDirectory is ignored on Windows.
+		Arguments:        []string{"-workdir", wd},
+		WorkingDirectory: wd,
+	})
+}
+
+// runService runs under the service manager until it asks us to stop.
+func runService() error {
+	svc, err := newService()
+	if err != nil {
+		return err
+	}
+	return svc.Run()
+}
+
+// controlService handles "cctvserver service <action>".
+func controlService(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: cctvserver service %v", service.ControlAction)
+	}
+
+	svc, err := newService()
+	if err != nil {
+		return err
+	}
+	if err := service.Control(svc, args[0]); err != nil {
+		return fmt.Errorf("service %s failed: %w", args[0], err)
+	}
+
+	fmt.Printf("Service %s: ok\n", args[0])
+	return nil
+}
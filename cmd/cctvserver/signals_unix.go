@@ -0,0 +1,18 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+var (
+	reloadSignal os.Signal = syscall.SIGHUP
+	drainSignal  os.Signal = syscall.SIGUSR1
+)
+
+func notifySignals(c chan<- os.Signal) {
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, reloadSignal, drainSignal)
+}
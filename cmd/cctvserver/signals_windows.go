@@ -0,0 +1,19 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Windows has no SIGHUP/SIGUSR1 equivalents; use the admin API instead.
+var (
+	reloadSignal os.Signal
+	drainSignal  os.Signal
+)
+
+func notifySignals(c chan<- os.Signal) {
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/index"
+	"github.com/raeeceip/cctv/internal/server"
+	"github.com/raeeceip/cctv/internal/soak"
+	"github.com/raeeceip/cctv/pkg/logger"
+)
+
+// soakReport is what -report writes.
+type soakReport struct {
+	Start    time.Time     `json:"start"`
+	End      time.Time     `json:"end"`
+	Duration string        `json:"duration"`
+	Cameras  int           `json:"cameras"`
+	FPS      int           `json:"fps"`
+	Passed   bool          `json:"passed"`
+	Checks   []*soak.Check `json:"checks"`
+}
+
+// runSoak handles "cctvserver soak". It runs the server from config.yaml
+// against a scratch output directory, with simulated cameras connected for
+// -duration, checks the invariants every -check-interval while they run
+// and once more after the server has stopped, and fails unless every check
+// passed. The scratch directory is kept when the run fails, or with -keep.
+func runSoak(args []string) error {
+	fs := flag.NewFlagSet("soak", flag.ContinueOnError)
+	duration := fs.Duration("duration", 10*time.Minute, "How long the cameras send frames")
+	cameras := fs.Int("cameras", 4, "Simulated cameras")
+	fps := fs.Int("fps", 10, "Frames per second per camera")
+	width := fs.Int("width", 320, "Frame width")
+	height := fs.Int("height", 240, "Frame height")
+	maxGap := fs.Duration("max-gap", 2*time.Second, "Longest a camera may go without a stored frame")
+	interval := fs.Duration("check-interval", 30*time.Second, "How often to check while the cameras run")
+	port := fs.Int("port", 18080, "Port the server listens on for both cameras and the API")
+	dir := fs.String("dir", ".", "Directory for the scratch output directory")
+	keep := fs.Bool("keep", false, "Keep the scratch output directory even if the run passes")
+	reportPath := fs.String("report", "", "Write the report as JSON to this file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *duration <= 0 || *interval <= 0 || *maxGap <= 0 {
+		return fmt.Errorf("-duration, -check-interval and -max-gap must be positive")
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	tmp, err := os.MkdirTemp(*dir, "soak-")
+	if err != nil {
+		return err
+	}
+	soakConfig(cfg, tmp, *port)
+
+	// The server logs to the scratch directory; only its errors are shown
+	gin.SetMode(gin.ReleaseMode)
+	gin.DefaultWriter = io.Discard
+	log, err := logger.NewLogger("error", logger.Config{OutputPath: filepath.Join(tmp, "soak.log")})
+	if err != nil {
+		return fmt.Errorf("failed to initialize logger: %w", err)
+	}
+	defer log.Close()
+
+	srv, err := server.New(cfg, log)
+	if err != nil {
+		return err
+	}
+	// The server's index is closed when it stops, so the checks have their
+	// own connection
+	ix, err := index.Open(cfg.Storage.IndexPath)
+	if err != nil {
+		return err
+	}
+	defer ix.Close()
+
+	runner, err := soak.New(soak.Options{
+		Addr:          fmt.Sprintf("ws://127.0.0.1:%d/camera/connect", *port),
+		Cameras:       *cameras,
+		FPS:           *fps,
+		Width:         *width,
+		Height:        *height,
+		Site:          cfg.Site,
+		MaxGap:        *maxGap,
+		Consolidation: cfg.Storage.VideoConsolidation.Enabled,
+		OutputDir:     cfg.Storage.OutputDir,
+		FrameLayout:   cfg.Storage.FrameLayout,
+		FrameName:     cfg.Storage.Naming.Frame,
+	})
+	if err != nil {
+		return err
+	}
+
+	serverCtx, stopServer := context.WithCancel(context.Background())
+	defer stopServer()
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Start(serverCtx)
+	}()
+	if err := waitListening(*port, served); err != nil {
+		return err
+	}
+
+	// An interrupt ends the run early; the checks still run
+	camCtx, stopCameras := context.WithTimeout(context.Background(), *duration)
+	defer stopCameras()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+	go func() {
+		select {
+		case <-sigChan:
+			fmt.Println("Interrupted, stopping the cameras")
+			stopCameras()
+		case <-camCtx.Done():
+		}
+	}()
+
+	report := soakReport{Start: time.Now(), Cameras: *cameras, FPS: *fps, Passed: true}
+	record := func(check *soak.Check) {
+		report.Checks = append(report.Checks, check)
+		report.Passed = report.Passed && check.Passed()
+		printCheck(check)
+	}
+
+	fmt.Printf("Soaking with %d cameras at %d fps for %s in %s\n", *cameras, *fps, *duration, tmp)
+	camerasDone := make(chan struct{})
+	go func() {
+		defer close(camerasDone)
+		runner.Run(camCtx)
+	}()
+
+	// Frames still being saved or indexed are left to later checks
+	settle := 2*cfg.Storage.FrameIndex.FlushInterval + *maxGap
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+running:
+	for {
+		select {
+		case <-camerasDone:
+			break running
+		case err := <-served:
+			stopCameras()
+			<-camerasDone
+			srv.Stop()
+			return fmt.Errorf("server stopped during the soak: %w", err)
+		case <-ticker.C:
+			check, err := runner.Check(context.Background(), ix, time.Now().Add(-settle), false)
+			if err != nil {
+				return err
+			}
+			record(check)
+		}
+	}
+
+	// Stopping the server consolidates the frames left and flushes the
+	// frame index
+	fmt.Println("Stopping the server")
+	stopServer()
+	if err := <-served; err != nil && err != context.Canceled {
+		return fmt.Errorf("server error: %w", err)
+	}
+	srv.Stop()
+
+	check, err := runner.Check(context.Background(), ix, time.Time{}, true)
+	if err != nil {
+		return err
+	}
+	record(check)
+	report.End = time.Now()
+	report.Duration = report.End.Sub(report.Start).Round(time.Second).String()
+
+	if *reportPath != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(*reportPath, data, 0644); err != nil {
+			return err
+		}
+	}
+	if !report.Passed {
+		return fmt.Errorf("soak FAILED; the server's files and log are in %s", tmp)
+	}
+	fmt.Println("Soak PASSED")
+	if !*keep {
+		return os.RemoveAll(tmp)
+	}
+	return nil
+}
+
+// soakConfig points cfg at the scratch directory and a local listener, and
+// turns off what would reach outside the run or hide what it checks:
+// pulled cameras, replication, uploads, schedules, ONVIF and camera auth.
+// Frames are kept and indexed so they can be checked.
+func soakConfig(cfg *config.Config, dir string, port int) {
+	cfg.Storage.OutputDir = dir
+	cfg.Storage.IndexPath = filepath.Join(dir, "index.db")
+	cfg.Storage.SaveFrames = true
+	cfg.Storage.VideoConsolidation.DeleteOriginals = false
+	cfg.Storage.FrameIndex.Enabled = true
+	cfg.Storage.Backend = config.BackendConfig{Type: "local"}
+
+	cfg.Server.Host = "127.0.0.1"
+	cfg.Server.Port = port
+	cfg.Server.SignalPort = port
+	cfg.Server.SSL = config.SSLConfig{}
+	cfg.Server.Ingest.Socket, cfg.Server.Ingest.SSL = "", config.SSLConfig{}
+	cfg.Server.API.Socket, cfg.Server.API.SSL = "", config.SSLConfig{}
+	cfg.Server.Auth = config.CameraAuthConfig{}
+	cfg.Server.RateLimits = nil
+
+	cfg.Sources = config.SourcesConfig{}
+	cfg.Replication = config.ReplicationConfig{}
+	cfg.Aggregator = config.AggregatorConfig{}
+	cfg.Schedules = config.SchedulesConfig{}
+	cfg.ONVIF = config.ONVIFConfig{}
+}
+
+// waitListening waits for the server to accept connections on port, or
+// fails if it stops first.
+func waitListening(port int, served <-chan error) error {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case err := <-served:
+			return fmt.Errorf("server failed to start: %w", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("server not listening on port %d: %w", port, err)
+		}
+	}
+}
+
+// printCheck prints a check's outcome and its failures.
+func printCheck(check *soak.Check) {
+	var sent, lost uint64
+	var stored, recordings int
+	var longest float64
+	for _, cam := range check.Cameras {
+		sent += cam.Sent
+		stored += cam.Stored
+		lost += cam.Lost
+		recordings += cam.Recordings
+		longest = max(longest, cam.LongestGapSeconds)
+	}
+	result := "PASS"
+	if !check.Passed() {
+		result = "FAIL"
+	}
+	kind := "check"
+	if check.Final {
+		kind = "final"
+	}
+	fmt.Printf("%s %-5s %s  %d sent, %d stored, %d lost, %d recordings, longest gap %.2fs\n",
+		check.Time.Format("15:04:05"), kind, result, sent, stored, lost, recordings, longest)
+	for _, f := range check.Failures {
+		fmt.Printf("    %s\n", f)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/raeeceip/cctv/internal/codec"
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/processor"
+	"github.com/raeeceip/cctv/internal/server"
+	"github.com/raeeceip/cctv/internal/shard"
+	"github.com/raeeceip/cctv/pkg/logger"
+)
+
+// runWorker handles "cctvserver worker -shard n", which the server starts for
+// each processor shard. Frames arrive on stdin and events leave on stdout, so
+// console logs go to stderr.
+func runWorker(args []string) error {
+	fs := flag.NewFlagSet("worker", flag.ContinueOnError)
+	shardNum := fs.Int("shard", 0, "Shard number")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// The server stops workers by closing stdin once it has stopped sending
+	// frames; Ctrl-C and the service manager's signals are meant for it
+	signal.Ignore(os.Interrupt, syscall.SIGTERM)
+
+	events := os.Stdout
+	os.Stdout = os.Stderr
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	log, err := logger.NewLogger(cfg.LogLevel, logger.Config{
+		OutputPath: filepath.Join(filepath.Dir(cfg.Log.OutputPath), fmt.Sprintf("shard-%d.log", *shardNum)),
+		MaxSize:    cfg.Log.MaxSize,
+		MaxBackups: cfg.Log.MaxBackups,
+		MaxAge:     cfg.Log.MaxAge,
+		Compress:   cfg.Log.Compress,
+		UseConsole: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to initialize logger: %w", err)
+	}
+	defer log.Close()
+
+	if _, err := codec.Use(cfg.Processor.JPEGCodec); err != nil {
+		return err
+	}
+	proc, err := processor.NewFrameProcessor(server.ProcessorConfig(cfg), log)
+	if err != nil {
+		return fmt.Errorf("failed to create processor: %w", err)
+	}
+	return shard.RunWorker(proc, log, os.Stdin, events)
+}
@@ -0,0 +1,350 @@
+// Package aggregator presents several servers, its nodes, as one: a single
+// camera list, one event stream and recording searches across all of them.
+// Nodes are consumed through their API with the client SDK. Their cameras
+// are listed every poll interval and whenever their events say a camera
+// came or went; recording searches and playback go to the nodes as they
+// are asked for, so nothing of the nodes is stored here.
+package aggregator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/events"
+	"github.com/raeeceip/cctv/pkg/client"
+	"github.com/raeeceip/cctv/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// requestTimeout bounds polling and searching a node.
+const requestTimeout = 10 * time.Second
+
+// Delays before following a node's events again, doubling up to the
+// maximum
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Minute
+)
+
+// ErrUnknownNode is returned for node names that aren't configured.
+var ErrUnknownNode = errors.New("unknown node")
+
+// Node is the state of a node as last seen.
+type Node struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Reachable is whether the last poll succeeded; Error says why not
+	Reachable bool       `json:"reachable"`
+	Error     string     `json:"error,omitempty"`
+	LastPoll  *time.Time `json:"last_poll,omitempty"`
+	// Following is whether the node's events are being received
+	Following bool `json:"following"`
+}
+
+// Camera is a camera of a node.
+type Camera struct {
+	Node string `json:"node"`
+	client.Camera
+}
+
+// Recording is a recording of a node.
+type Recording struct {
+	Node string `json:"node"`
+	client.Recording
+}
+
+// Aggregator follows the nodes.
+type Aggregator struct {
+	nodes    []*node
+	byName   map[string]*node
+	interval time.Duration
+	logger   *logger.Logger
+	events   events.Bus
+}
+
+type node struct {
+	cfg     config.AggregatorNode
+	client  *client.Client
+	refresh chan struct{} // asks for the cameras to be listed again
+
+	mu      sync.Mutex
+	state   Node
+	cameras []client.Camera
+}
+
+// New returns an aggregator of the configured nodes.
+func New(cfg config.AggregatorConfig, log *logger.Logger) (*Aggregator, error) {
+	a := &Aggregator{
+		byName:   make(map[string]*node),
+		interval: cfg.PollInterval,
+		logger:   log,
+	}
+	for _, nc := range cfg.Nodes {
+		c, err := client.New(nc.URL, nc.Token)
+		if err != nil {
+			return nil, fmt.Errorf("aggregator node %s: %w", nc.Name, err)
+		}
+		n := &node{
+			cfg:     nc,
+			client:  c,
+			refresh: make(chan struct{}, 1),
+			state:   Node{Name: nc.Name, URL: nc.URL},
+		}
+		a.nodes = append(a.nodes, n)
+		a.byName[nc.Name] = n
+	}
+	return a, nil
+}
+
+// Run polls the nodes and follows their events until ctx is cancelled.
+func (a *Aggregator) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, n := range a.nodes {
+		wg.Add(2)
+		go func(n *node) {
+			defer wg.Done()
+			a.poll(ctx, n)
+		}(n)
+		go func(n *node) {
+			defer wg.Done()
+			a.follow(ctx, n)
+		}(n)
+	}
+	wg.Wait()
+}
+
+// Nodes returns the state of every node, in configuration order.
+func (a *Aggregator) Nodes() []Node {
+	nodes := make([]Node, 0, len(a.nodes))
+	for _, n := range a.nodes {
+		n.mu.Lock()
+		nodes = append(nodes, n.state)
+		n.mu.Unlock()
+	}
+	return nodes
+}
+
+// Cameras returns the cameras of every node as last listed, by node and
+// camera ID. Cameras of unreachable nodes are kept as they were.
+func (a *Aggregator) Cameras() []Camera {
+	cameras := []Camera{}
+	for _, n := range a.nodes {
+		n.mu.Lock()
+		for _, cam := range n.cameras {
+			cameras = append(cameras, Camera{Node: n.cfg.Name, Camera: cam})
+		}
+		n.mu.Unlock()
+	}
+	sort.SliceStable(cameras, func(i, j int) bool {
+		if cameras[i].Node != cameras[j].Node {
+			return cameras[i].Node < cameras[j].Node
+		}
+		return cameras[i].ID < cameras[j].ID
+	})
+	return cameras
+}
+
+// Subscribe returns a channel receiving the events of every node, with
+// Node set, until Unsubscribe.
+func (a *Aggregator) Subscribe() chan events.Event {
+	return a.events.Subscribe()
+}
+
+// Unsubscribe stops deliveries to ch.
+func (a *Aggregator) Unsubscribe(ch chan events.Event) {
+	a.events.Unsubscribe(ch)
+}
+
+// Recordings searches every node at once and returns up to q.Limit of the
+// newest matches. Nodes that fail are left out, with their errors by node
+// name; the search only fails if every node does.
+func (a *Aggregator) Recordings(ctx context.Context, q client.RecordingQuery) ([]Recording, map[string]error, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	type result struct {
+		node       string
+		recordings []client.Recording
+		err        error
+	}
+	results := make(chan result, len(a.nodes))
+	for _, n := range a.nodes {
+		go func(n *node) {
+			recordings, err := n.client.Recordings(ctx, q)
+			results <- result{node: n.cfg.Name, recordings: recordings, err: err}
+		}(n)
+	}
+
+	recordings := []Recording{}
+	failed := make(map[string]error)
+	for range a.nodes {
+		r := <-results
+		if r.err != nil {
+			failed[r.node] = r.err
+			continue
+		}
+		for _, rec := range r.recordings {
+			recordings = append(recordings, Recording{Node: r.node, Recording: rec})
+		}
+	}
+	if len(a.nodes) > 0 && len(failed) == len(a.nodes) {
+		return nil, failed, errors.New("no node could be searched")
+	}
+
+	// Each node returns its newest; merged, the newest overall come first
+	sort.SliceStable(recordings, func(i, j int) bool {
+		return recordings[i].StartTime.After(recordings[j].StartTime)
+	})
+	if q.Limit > 0 && len(recordings) > q.Limit {
+		recordings = recordings[:q.Limit]
+	}
+	return recordings, failed, nil
+}
+
+// RecordingFile returns a handler serving a recording's file from its
+// node. Range and conditional requests pass through, so players can seek.
+func (a *Aggregator) RecordingFile(nodeName string, id int64) (http.Handler, error) {
+	n, ok := a.byName[nodeName]
+	if !ok {
+		return nil, ErrUnknownNode
+	}
+	target := n.client.RecordingFileURL(id)
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			u := *target
+			req.URL = &u
+			req.Host = u.Host
+			// The caller's credentials are for the aggregator
+			req.Header.Del("Authorization")
+			if n.cfg.Token != "" {
+				req.Header.Set("Authorization", "Bearer "+n.cfg.Token)
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			a.logger.Warn("Failed to proxy recording",
+				zap.String("node", nodeName),
+				zap.Int64("recording", id),
+				zap.Error(err))
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}, nil
+}
+
+// poll lists a node's cameras every interval and when asked to.
+func (a *Aggregator) poll(ctx context.Context, n *node) {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		pollCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+		cameras, err := n.client.Cameras(pollCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		now := time.Now()
+		n.mu.Lock()
+		wasReachable := n.state.Reachable
+		n.state.LastPoll = &now
+		n.state.Reachable = err == nil
+		n.state.Error = ""
+		if err != nil {
+			n.state.Error = err.Error()
+		} else {
+			n.cameras = cameras
+		}
+		n.mu.Unlock()
+
+		if err != nil && wasReachable {
+			a.logger.Warn("Aggregator node unreachable", zap.String("node", n.cfg.Name), zap.Error(err))
+		} else if err == nil && !wasReachable {
+			a.logger.Info("Aggregator node reachable",
+				zap.String("node", n.cfg.Name),
+				zap.Int("cameras", len(cameras)))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-n.refresh:
+		}
+	}
+}
+
+// follow receives a node's events, reconnecting when the stream ends.
+func (a *Aggregator) follow(ctx context.Context, n *node) {
+	delay := minRetryDelay
+	for {
+		err := a.receive(ctx, n)
+		if ctx.Err() != nil {
+			return
+		}
+
+		n.mu.Lock()
+		was := n.state.Following
+		n.state.Following = false
+		n.mu.Unlock()
+		if was {
+			// The node was up; it is likely back soon, e.g. after a restart
+			a.logger.Warn("Aggregator node events interrupted", zap.String("node", n.cfg.Name), zap.Error(err))
+			delay = minRetryDelay
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// receive passes on a node's events until its stream ends.
+func (a *Aggregator) receive(ctx context.Context, n *node) error {
+	stream, err := n.client.Events(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	n.mu.Lock()
+	n.state.Following = true
+	n.mu.Unlock()
+	a.logger.Info("Following aggregator node events", zap.String("node", n.cfg.Name))
+	// Cameras may have come and gone while not following
+	n.requestRefresh()
+
+	for {
+		e, err := stream.Next()
+		if err != nil {
+			return err
+		}
+		if e.Type == client.CameraConnected || e.Type == client.CameraDisconnected {
+			n.requestRefresh()
+		}
+		a.events.Publish(events.Event{
+			Type:     e.Type,
+			Time:     e.Time,
+			CameraID: e.CameraID,
+			Node:     n.cfg.Name,
+			Data:     e.Data,
+		})
+	}
+}
+
+func (n *node) requestRefresh() {
+	select {
+	case n.refresh <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,269 @@
+// Package avsync measures the offset between audio and video in a recording
+// of the simulator's A/V sync pattern, which flashes the picture white at the
+// same instant it beeps.
+package avsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/raeeceip/cctv/pkg/pathutil"
+)
+
+const (
+	// audioRate is what the audio track is resampled to for analysis
+	audioRate = 8000
+	// envelopeWindow is the number of samples per loudness measurement, 5ms
+	envelopeWindow = audioRate / 200
+	// minLumaRange is how much brighter than the darkest frame the brightest
+	// must be for the video to contain flashes at all
+	minLumaRange = 64
+	// maxPairDistance is how far apart a flash and a beep may be and still be
+	// taken for the same event; the pattern repeats every second
+	maxPairDistance = 0.5
+)
+
+// Report is the outcome of Analyze. Times are in seconds from the start of
+// the file, offsets in milliseconds; a positive offset means audio lags video.
+type Report struct {
+	HasAudio bool      `json:"has_audio"`
+	Flashes  []float64 `json:"flashes"`
+	Beeps    []float64 `json:"beeps"`
+	Pairs    int       `json:"pairs"`
+
+	MeanOffsetMs float64 `json:"mean_offset_ms"`
+	MinOffsetMs  float64 `json:"min_offset_ms"`
+	MaxOffsetMs  float64 `json:"max_offset_ms"`
+	// DriftMs is how much the offset changed from the first pair to the last
+	DriftMs float64 `json:"drift_ms"`
+
+	// FlashInterval spreads show dropped or duplicated frames even when the
+	// recording has no audio
+	MinFlashIntervalMs float64 `json:"min_flash_interval_ms"`
+	MaxFlashIntervalMs float64 `json:"max_flash_interval_ms"`
+}
+
+// Analyze finds the flashes and beeps in a video file using ffmpeg and pairs
+// them up. A file without an audio stream still reports its flashes.
+func Analyze(ctx context.Context, path string) (*Report, error) {
+	p, err := pathutil.FFmpeg(path)
+	if err != nil {
+		return nil, err
+	}
+
+	hasAudio, audioStart, err := probeAudio(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{HasAudio: hasAudio, Beeps: []float64{}}
+	if report.Flashes, err = findFlashes(ctx, p); err != nil {
+		return nil, err
+	}
+	if len(report.Flashes) == 0 {
+		return nil, fmt.Errorf("no flashes found; was the recording made with the avsync pattern?")
+	}
+	if hasAudio {
+		beeps, err := findBeeps(ctx, p, audioStart)
+		if err != nil {
+			return nil, err
+		}
+		report.Beeps = append(report.Beeps, beeps...)
+	}
+
+	for i := 1; i < len(report.Flashes); i++ {
+		ms := round2((report.Flashes[i] - report.Flashes[i-1]) * 1000)
+		if i == 1 || ms < report.MinFlashIntervalMs {
+			report.MinFlashIntervalMs = ms
+		}
+		if ms > report.MaxFlashIntervalMs {
+			report.MaxFlashIntervalMs = ms
+		}
+	}
+
+	var offsets []float64
+	for _, f := range report.Flashes {
+		best := math.Inf(1)
+		for _, b := range report.Beeps {
+			if math.Abs(b-f) < math.Abs(best) {
+				best = b - f
+			}
+		}
+		if math.Abs(best) <= maxPairDistance {
+			offsets = append(offsets, best*1000)
+		}
+	}
+	report.Pairs = len(offsets)
+	if len(offsets) > 0 {
+		sum := 0.0
+		report.MinOffsetMs, report.MaxOffsetMs = offsets[0], offsets[0]
+		for _, o := range offsets {
+			sum += o
+			report.MinOffsetMs = math.Min(report.MinOffsetMs, o)
+			report.MaxOffsetMs = math.Max(report.MaxOffsetMs, o)
+		}
+		report.MeanOffsetMs = round2(sum / float64(len(offsets)))
+		report.MinOffsetMs = round2(report.MinOffsetMs)
+		report.MaxOffsetMs = round2(report.MaxOffsetMs)
+		report.DriftMs = round2(offsets[len(offsets)-1] - offsets[0])
+	}
+	return report, nil
+}
+
+// probeAudio reports whether the file has an audio stream and when it starts.
+func probeAudio(ctx context.Context, path string) (bool, float64, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "a:0",
+		"-show_entries", "stream=start_time", "-of", "default=noprint_wrappers=1", path)
+	out, err := cmd.Output()
+	if err != nil {
+		return false, 0, fmt.Errorf("ffprobe failed: %w", err)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), "=")
+		if key != "start_time" {
+			continue
+		}
+		start, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			// "N/A" for containers without timestamps
+			start = 0
+		}
+		return true, start, nil
+	}
+	return false, 0, nil
+}
+
+// findFlashes returns the presentation times of frames that turn bright
+// after a dark one.
+func findFlashes(ctx context.Context, path string) ([]float64, error) {
+	// signalstats measures the average luma of every frame; metadata prints
+	// it to stdout next to the frame's timestamp
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-v", "error", "-i", path, "-map", "0:v:0",
+		"-vf", "signalstats,metadata=print:key=lavfi.signalstats.YAVG:file=-",
+		"-f", "null", "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg error: %v\nOutput: %s", err, stderr.String())
+	}
+
+	type frame struct{ time, luma float64 }
+	var frames []frame
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "frame:") {
+			for _, field := range strings.Fields(line) {
+				if v, ok := strings.CutPrefix(field, "pts_time:"); ok {
+					t, err := strconv.ParseFloat(v, 64)
+					if err != nil {
+						return nil, fmt.Errorf("unexpected frame time %q", v)
+					}
+					frames = append(frames, frame{time: t})
+				}
+			}
+		} else if v, ok := strings.CutPrefix(line, "lavfi.signalstats.YAVG="); ok && len(frames) > 0 {
+			luma, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("unexpected luma %q", v)
+			}
+			frames[len(frames)-1].luma = luma
+		}
+	}
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("no video frames found")
+	}
+
+	lo, hi := frames[0].luma, frames[0].luma
+	for _, f := range frames {
+		lo = math.Min(lo, f.luma)
+		hi = math.Max(hi, f.luma)
+	}
+	if hi-lo < minLumaRange {
+		return nil, nil
+	}
+
+	threshold := (lo + hi) / 2
+	var flashes []float64
+	for i, f := range frames {
+		if f.luma >= threshold && (i == 0 || frames[i-1].luma < threshold) {
+			flashes = append(flashes, round4(f.time))
+		}
+	}
+	return flashes, nil
+}
+
+// findBeeps returns the times at which the audio turns loud after silence.
+// start is the timestamp of the first audio sample.
+func findBeeps(ctx context.Context, path string, start float64) ([]float64, error) {
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-v", "error", "-i", path, "-map", "0:a:0",
+		"-ac", "1", "-ar", strconv.Itoa(audioRate), "-f", "s16le", "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg error: %v\nOutput: %s", err, stderr.String())
+	}
+
+	samples := make([]int16, len(out)/2)
+	if err := binary.Read(bytes.NewReader(out), binary.LittleEndian, samples); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read audio: %w", err)
+	}
+
+	// Loudness per window
+	var envelope []float64
+	peak := 0.0
+	for i := 0; i+envelopeWindow <= len(samples); i += envelopeWindow {
+		sum := 0.0
+		for _, s := range samples[i : i+envelopeWindow] {
+			sum += float64(s) * float64(s)
+		}
+		rms := math.Sqrt(sum / envelopeWindow)
+		envelope = append(envelope, rms)
+		peak = math.Max(peak, rms)
+	}
+	if peak < 0.01*math.MaxInt16 {
+		return nil, nil
+	}
+
+	// The onset is the first loud sample, which may already be in the
+	// window before; that is more precise than the window start
+	threshold := peak / 4
+	var beeps []float64
+	for w, rms := range envelope {
+		if rms < threshold || (w > 0 && envelope[w-1] >= threshold) {
+			continue
+		}
+		onset := w * envelopeWindow
+		from := onset - envelopeWindow
+		if from < 0 {
+			from = 0
+		}
+		for i := from; i < onset+envelopeWindow; i++ {
+			if math.Abs(float64(samples[i])) >= threshold {
+				onset = i
+				break
+			}
+		}
+		beeps = append(beeps, round4(start+float64(onset)/audioRate))
+	}
+	return beeps, nil
+}
+
+func round2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
+
+func round4(f float64) float64 {
+	return math.Round(f*10000) / 10000
+}
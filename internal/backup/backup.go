@@ -0,0 +1,196 @@
+// Package backup writes and restores disaster-recovery archives: a gzipped
+// tarball holding a snapshot of the recording index, the configuration file
+// and optionally recent videos, plus a manifest of SHA-256 checksums that is
+// verified before anything is restored.
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/index"
+)
+
+// FormatVersion is bumped when the archive layout changes. Version 1
+// archives kept videos by file name alone; Restore still reads them.
+const FormatVersion = 2
+
+// Archive layout
+const (
+	manifestName = "manifest.json"
+	indexName    = "index.db"
+	configName   = "config.yaml"
+	videosDir    = "videos"
+)
+
+// File is a manifest entry. Videos are named after their recording, as
+// videos/<id>-<file name>, and also list where the index has them.
+type File struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	RecordingID int64  `json:"recording_id,omitempty"`
+	Path        string `json:"path,omitempty"`
+}
+
+// Manifest describes an archive. It is written last so the archive can be
+// streamed, which means Restore stages everything before checking it.
+type Manifest struct {
+	Format        int       `json:"format"`
+	CreatedAt     time.Time `json:"created_at"`
+	SchemaVersion int       `json:"schema_version"`
+	Files         []File    `json:"files"`
+}
+
+// Options selects what goes into a backup.
+type Options struct {
+	Index      *index.Index
+	ConfigFile string  // skipped when empty
+	Videos     []Video // video files to include
+}
+
+// Video is the file of an indexed recording.
+type Video struct {
+	RecordingID int64
+	Path        string
+}
+
+// Create writes a backup archive to w.
+func Create(ctx context.Context, w io.Writer, opts Options) (*Manifest, error) {
+	schema, err := opts.Index.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// VACUUM INTO needs a path that doesn't exist yet
+	tmpDir, err := os.MkdirTemp("", "cctv-backup-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	snapshot := filepath.Join(tmpDir, indexName)
+	if err := opts.Index.Snapshot(ctx, snapshot); err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	manifest := &Manifest{
+		Format:        FormatVersion,
+		CreatedAt:     time.Now().UTC(),
+		SchemaVersion: schema,
+	}
+
+	add := func(name, src string) (*File, error) {
+		f, err := addFile(tw, name, src)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, f)
+		return &manifest.Files[len(manifest.Files)-1], nil
+	}
+
+	if _, err := add(indexName, snapshot); err != nil {
+		return nil, err
+	}
+	if opts.ConfigFile != "" {
+		if _, err := add(configName, opts.ConfigFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, video := range opts.Videos {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		name := path.Join(videosDir, fmt.Sprintf("%d-%s", video.RecordingID, filepath.Base(video.Path)))
+		f, err := add(name, video.Path)
+		if err != nil {
+			return nil, err
+		}
+		f.RecordingID, f.Path = video.RecordingID, video.Path
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	hdr := &tar.Header{
+		Name:    manifestName,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: manifest.CreatedAt,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return nil, fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish archive: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish archive: %w", err)
+	}
+	return manifest, nil
+}
+
+func addFile(tw *tar.Writer, name, src string) (File, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return File{}, fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return File{}, fmt.Errorf("failed to stat %s: %w", src, err)
+	}
+
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return File{}, fmt.Errorf("failed to add %s: %w", name, err)
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tw, h), f)
+	if err != nil {
+		return File{}, fmt.Errorf("failed to add %s: %w", name, err)
+	}
+
+	return File{Name: name, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// RecentVideos lists indexed videos that ended within the last d and are
+// still on disk.
+func RecentVideos(ctx context.Context, ix *index.Index, d time.Duration) ([]Video, error) {
+	recordings, err := ix.ListRecordings(ctx, index.RecordingQuery{Since: time.Now().Add(-d)})
+	if err != nil {
+		return nil, err
+	}
+
+	var videos []Video
+	for _, r := range recordings {
+		if _, err := os.Stat(r.Path); err == nil {
+			videos = append(videos, Video{RecordingID: r.ID, Path: r.Path})
+		}
+	}
+	return videos, nil
+}
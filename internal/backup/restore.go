@@ -0,0 +1,302 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/raeeceip/cctv/internal/index"
+)
+
+// RestoreOptions says where restored files go. The server must not be
+// running against IndexPath.
+//
+// Videos are put back where the index has them if that is inside
+// OutputDir. The others, such as imports from elsewhere, go to
+// <OutputDir>/videos/restored and the restored index is pointed at them.
+type RestoreOptions struct {
+	IndexPath  string
+	ConfigFile string // config.yaml is skipped when empty
+	OutputDir  string
+	Force      bool // overwrite an existing index and videos
+}
+
+// Restore unpacks an archive written by Create. Every file is staged and
+// checked against the manifest before anything in place is touched.
+func Restore(r io.Reader, opts RestoreOptions) (*Manifest, error) {
+	if !opts.Force {
+		if _, err := os.Stat(opts.IndexPath); err == nil {
+			return nil, fmt.Errorf("index %s already exists", opts.IndexPath)
+		}
+		videoDir := filepath.Join(opts.OutputDir, videosDir)
+		if entries, err := os.ReadDir(videoDir); err == nil && len(entries) > 0 {
+			return nil, fmt.Errorf("video directory %s is not empty", videoDir)
+		}
+	}
+
+	// Stage next to the index so the final moves are renames
+	if err := os.MkdirAll(filepath.Dir(opts.IndexPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create index directory: %w", err)
+	}
+	staging, err := os.MkdirTemp(filepath.Dir(opts.IndexPath), ".restore-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging dir: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	manifest, staged, err := extract(r, staging)
+	if err != nil {
+		return nil, err
+	}
+	if err := verify(manifest, staged); err != nil {
+		return nil, err
+	}
+
+	latest, err := index.LatestVersion()
+	if err != nil {
+		return nil, err
+	}
+	if manifest.SchemaVersion > latest {
+		return nil, fmt.Errorf("backup has index schema version %d, this binary supports up to %d",
+			manifest.SchemaVersion, latest)
+	}
+
+	dests := make(map[string]string, len(manifest.Files))
+	moved := make(map[int64]string)
+	for _, f := range manifest.Files {
+		switch {
+		case f.Name == indexName:
+			dests[f.Name] = opts.IndexPath
+		case f.Name == configName:
+			if opts.ConfigFile != "" {
+				dests[f.Name] = opts.ConfigFile
+			}
+		default:
+			dest := videoDest(f, opts.OutputDir)
+			if !opts.Force {
+				if _, err := os.Stat(dest); err == nil {
+					return nil, fmt.Errorf("video %s already exists", dest)
+				}
+			}
+			if f.RecordingID != 0 && dest != f.Path {
+				moved[f.RecordingID] = dest
+			}
+			dests[f.Name] = dest
+		}
+	}
+	if len(moved) > 0 {
+		if err := setPaths(staged[indexName], moved); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range manifest.Files {
+		dest, ok := dests[f.Name]
+		if !ok {
+			continue
+		}
+		if f.Name == indexName {
+			// Stale WAL files would be replayed over the restored database
+			os.Remove(dest + "-wal")
+			os.Remove(dest + "-shm")
+		}
+		if err := moveFile(staged[f.Name], dest); err != nil {
+			return nil, err
+		}
+	}
+
+	return manifest, nil
+}
+
+// videoDest returns where a video of the archive is restored to: its
+// indexed path when that is inside outputDir, and otherwise a path under
+// <outputDir>/videos/restored named after the archive entry. Videos of
+// version 1 archives, which have no indexed path, go to <outputDir>/videos.
+func videoDest(f File, outputDir string) string {
+	if f.RecordingID == 0 {
+		return filepath.Join(outputDir, videosDir, path.Base(f.Name))
+	}
+	if rel, err := filepath.Rel(outputDir, f.Path); err == nil && filepath.IsLocal(rel) {
+		return f.Path
+	}
+	return filepath.Join(outputDir, videosDir, "restored", path.Base(f.Name))
+}
+
+// setPaths points the recordings of the staged index at the paths their
+// videos are restored to.
+func setPaths(indexPath string, paths map[int64]string) error {
+	ix, err := index.Open(indexPath)
+	if err != nil {
+		return err
+	}
+	for id, p := range paths {
+		if err := ix.SetRecordingPath(context.Background(), id, p); err != nil {
+			ix.Close()
+			return err
+		}
+	}
+	return ix.Close()
+}
+
+// extract unpacks the archive into dir and returns the manifest and the
+// staged path of every other entry.
+func extract(r io.Reader, dir string) (*Manifest, map[string]string, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("not a backup archive: %w", err)
+	}
+	defer gz.Close()
+
+	var manifest *Manifest
+	staged := make(map[string]string)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, nil, fmt.Errorf("unexpected archive entry %q", hdr.Name)
+		}
+
+		if hdr.Name == manifestName {
+			manifest = &Manifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, nil, fmt.Errorf("invalid manifest: %w", err)
+			}
+			continue
+		}
+
+		if !validName(hdr.Name) {
+			return nil, nil, fmt.Errorf("unexpected archive entry %q", hdr.Name)
+		}
+		if _, dup := staged[hdr.Name]; dup {
+			return nil, nil, fmt.Errorf("duplicate archive entry %q", hdr.Name)
+		}
+
+		dest := filepath.Join(dir, fmt.Sprintf("%d", len(staged)))
+		if err := writeFile(dest, tr); err != nil {
+			return nil, nil, err
+		}
+		staged[hdr.Name] = dest
+	}
+
+	if manifest == nil {
+		return nil, nil, errors.New("archive has no manifest")
+	}
+	if manifest.Format < 1 || manifest.Format > FormatVersion {
+		return nil, nil, fmt.Errorf("unsupported backup format %d", manifest.Format)
+	}
+	return manifest, staged, nil
+}
+
+// validName accepts only the names Create writes, so nothing can be
+// unpacked outside the target directories.
+func validName(name string) bool {
+	if name == indexName || name == configName {
+		return true
+	}
+	dir, base := path.Split(name)
+	return dir == videosDir+"/" && base != "" && base != "." && base != ".." &&
+		!strings.ContainsAny(base, `/\`)
+}
+
+func verify(manifest *Manifest, staged map[string]string) error {
+	listed := make(map[string]bool, len(manifest.Files))
+	hasIndex := false
+	for _, f := range manifest.Files {
+		listed[f.Name] = true
+		if f.Name == indexName {
+			hasIndex = true
+		}
+
+		src, ok := staged[f.Name]
+		if !ok {
+			return fmt.Errorf("archive is missing %s", f.Name)
+		}
+		size, sum, err := checksum(src)
+		if err != nil {
+			return err
+		}
+		if size != f.Size || sum != f.SHA256 {
+			return fmt.Errorf("checksum mismatch for %s", f.Name)
+		}
+	}
+	for name := range staged {
+		if !listed[name] {
+			return fmt.Errorf("archive entry %s is not in the manifest", name)
+		}
+	}
+	if !hasIndex {
+		return errors.New("archive has no index")
+	}
+	return nil
+}
+
+func checksum(name string) (int64, string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeFile(name string, r io.Reader) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to extract archive: %w", err)
+	}
+	return f.Close()
+}
+
+// moveFile renames src over dest, copying when they are on different
+// filesystems.
+func moveFile(src, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dest); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dest + ".restore"
+	if err := writeFile(tmp, in); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to restore %s: %w", dest, err)
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to restore %s: %w", dest, err)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+// Package calibration measures what cameras actually deliver, frame rate,
+// frame sizes and bitrate, over sliding windows of recent frames.
+package calibration
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Windows reported, shortest first. The longest bounds the history kept.
+var Windows = []time.Duration{5 * time.Second, time.Minute}
+
+type sample struct {
+	at   time.Time
+	size int
+}
+
+type cameraSamples struct {
+	since   time.Time // first frame, so short-lived cameras aren't under-reported
+	samples []sample  // oldest first
+}
+
+// Tracker records frame arrivals per camera.
+type Tracker struct {
+	mu      sync.Mutex
+	cameras map[string]*cameraSamples
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{cameras: make(map[string]*cameraSamples)}
+}
+
+// Record notes a frame of size bytes arriving from camera at time at.
+func (t *Tracker) Record(camera string, size int, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.cameras[camera]
+	if !ok {
+		c = &cameraSamples{since: at}
+		t.cameras[camera] = c
+	}
+	c.samples = append(c.samples, sample{at: at, size: size})
+
+	// Drop what the longest window no longer covers
+	cutoff := at.Add(-Windows[len(Windows)-1])
+	i := 0
+	for i < len(c.samples) && c.samples[i].at.Before(cutoff) {
+		i++
+	}
+	if i > 0 {
+		c.samples = append(c.samples[:0], c.samples[i:]...)
+	}
+}
+
+// Remove forgets a camera, e.g. once it disconnects.
+func (t *Tracker) Remove(camera string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.cameras, camera)
+}
+
+// SizeStats summarizes frame sizes in bytes.
+type SizeStats struct {
+	Avg int `json:"avg"`
+	P50 int `json:"p50"`
+	P95 int `json:"p95"`
+	P99 int `json:"p99"`
+	Max int `json:"max"`
+}
+
+// Window is the measurement over one window.
+type Window struct {
+	Seconds     float64   `json:"window_seconds"`
+	Frames      int       `json:"frames"`
+	FPS         float64   `json:"fps"`
+	BitrateKbps float64   `json:"bitrate_kbps"`
+	FrameSize   SizeStats `json:"frame_size"`
+	// IntervalP95Ms is the 95th percentile gap between frames, which shows
+	// stalls that an average frame rate hides
+	IntervalP95Ms float64 `json:"interval_p95_ms"`
+}
+
+// Measure reports each of Windows for a camera as of now. ok is false for
+// a camera that has sent nothing.
+func (t *Tracker) Measure(camera string, now time.Time) (windows []Window, ok bool) {
+	t.mu.Lock()
+	c, ok := t.cameras[camera]
+	var samples []sample
+	var since time.Time
+	if ok {
+		samples = append(samples, c.samples...)
+		since = c.since
+	}
+	t.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	for _, d := range Windows {
+		// A camera connected for less than the window is measured over the
+		// time it has been connected
+		span := d
+		if elapsed := now.Sub(since); elapsed < span {
+			span = elapsed
+		}
+
+		var sizes []int
+		var intervals []float64
+		total := 0
+		var prev time.Time
+		for _, s := range samples {
+			if s.at.Before(now.Add(-d)) {
+				continue
+			}
+			sizes = append(sizes, s.size)
+			total += s.size
+			if !prev.IsZero() {
+				intervals = append(intervals, float64(s.at.Sub(prev))/float64(time.Millisecond))
+			}
+			prev = s.at
+		}
+
+		w := Window{Seconds: d.Seconds(), Frames: len(sizes)}
+		if span > 0 {
+			w.FPS = round2(float64(len(sizes)) / span.Seconds())
+			w.BitrateKbps = round2(float64(total) * 8 / 1000 / span.Seconds())
+		}
+		if len(sizes) > 0 {
+			sort.Ints(sizes)
+			w.FrameSize = SizeStats{
+				Avg: total / len(sizes),
+				P50: sizes[percentileIndex(len(sizes), 50)],
+				P95: sizes[percentileIndex(len(sizes), 95)],
+				P99: sizes[percentileIndex(len(sizes), 99)],
+				Max: sizes[len(sizes)-1],
+			}
+		}
+		if len(intervals) > 0 {
+			sort.Float64s(intervals)
+			w.IntervalP95Ms = round2(intervals[percentileIndex(len(intervals), 95)])
+		}
+		windows = append(windows, w)
+	}
+	return windows, true
+}
+
+// percentileIndex uses the nearest-rank method.
+func percentileIndex(n, p int) int {
+	i := (p*n + 99) / 100
+	if i < 1 {
+		i = 1
+	}
+	return i - 1
+}
+
+func round2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
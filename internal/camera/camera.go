@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/raeeceip/cctv/internal/wire"
 	"go.uber.org/zap"
 )
 
@@ -19,6 +20,9 @@ type SignalMessage struct {
 	Data   json.RawMessage `json:"data"`
 	Camera string          `json:"camera"`
 	Time   time.Time       `json:"time"`
+	// KeyFrame and GOP are as in wire.Header
+	KeyFrame bool      `json:"key_frame,omitempty"`
+	GOP      *wire.GOP `json:"gop,omitempty"`
 }
 
 // CameraEvent represents processed camera data
@@ -27,6 +31,8 @@ type CameraEvent struct {
 	EventType string    `json:"event_type"`
 	Data      []byte    `json:"data"`
 	Timestamp time.Time `json:"timestamp"`
+	// KeyFrame is false for frames that are deltas of an earlier one
+	KeyFrame bool `json:"key_frame"`
 }
 
 type CameraManager struct {
@@ -153,6 +159,7 @@ func (cm *CameraManager) handleCameraConnection(conn *websocket.Conn) {
 			EventType: msg.Type,
 			Data:      []byte(msg.Data),
 			Timestamp: msg.Time,
+			KeyFrame:  msg.GOP == nil || msg.KeyFrame,
 		}
 
 		// Process the event
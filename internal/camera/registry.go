@@ -0,0 +1,316 @@
+package camera
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/raeeceip/cctv/internal/wire"
+)
+
+// Status describes a connected camera.
+type Status struct {
+	ID          string    `json:"id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	// Frames and Bytes were received over this connection
+	Frames    uint64     `json:"frames"`
+	Bytes     uint64     `json:"bytes"`
+	LastFrame *time.Time `json:"last_frame,omitempty"` // when it was received
+	// Protocol is what the connection negotiated
+	Protocol wire.Capabilities `json:"protocol"`
+	// IngestLatencyMs is how long its frames take from being read to
+	// being queued for storage, smoothed over recent frames
+	IngestLatencyMs float64 `json:"ingest_latency_ms"`
+	// GOP is set once the camera sends in groups of pictures
+	GOP *GOPStatus `json:"gop,omitempty"`
+	// PTZ is where a pan/tilt/zoom camera last reported pointing
+	PTZ *wire.PTZ `json:"ptz,omitempty"`
+}
+
+// GOPStatus counts the keyframes and deltas a camera sent over its
+// connection. Broken deltas depend on a keyframe that wasn't received, or
+// not as the last one, so couldn't be decoded.
+type GOPStatus struct {
+	Size         int    `json:"size"` // as last declared
+	KeyFrames    uint64 `json:"key_frames"`
+	DeltaFrames  uint64 `json:"delta_frames"`
+	BrokenDeltas uint64 `json:"broken_deltas"`
+}
+
+// latencyWeight is the weight of each frame in IngestLatencyMs.
+const latencyWeight = 0.2
+
+type entry struct {
+	conn   *websocket.Conn
+	status Status
+	// writeMu serializes data messages, as a connection takes one writer
+	// at a time
+	writeMu sync.Mutex
+	// keyFrame is the number of the last keyframe received, if any
+	keyFrame    uint64
+	hasKeyFrame bool
+}
+
+// CameraRegistry tracks the cameras connected over WebSocket, one
+// connection per camera ID.
+type CameraRegistry struct {
+	mu      sync.RWMutex
+	cameras map[string]*entry
+	// reserved counts the places Reserve holds, and reservedFrom them by
+	// remote address
+	reserved     int
+	reservedFrom map[string]int
+}
+
+func NewCameraRegistry() *CameraRegistry {
+	return &CameraRegistry{cameras: make(map[string]*entry), reservedFrom: make(map[string]int)}
+}
+
+// Add registers a camera's connection, with the capabilities it
+// negotiated. It returns the connection it replaces, if the camera was
+// already connected.
+func (r *CameraRegistry) Add(id string, conn *websocket.Conn, remoteAddr string, caps wire.Capabilities) (old *websocket.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.cameras[id]; ok {
+		old = e.conn
+	}
+	r.cameras[id] = &entry{
+		conn:   conn,
+		status: Status{ID: id, RemoteAddr: remoteAddr, ConnectedAt: time.Now(), Protocol: caps},
+	}
+	return old
+}
+
+// Remove unregisters a camera if conn is still its connection, and reports
+// whether it was.
+func (r *CameraRegistry) Remove(id string, conn *websocket.Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.cameras[id]; ok && e.conn == conn {
+		delete(r.cameras, id)
+		return true
+	}
+	return false
+}
+
+// Conn returns a camera's connection.
+func (r *CameraRegistry) Conn(id string) (*websocket.Conn, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if e, ok := r.cameras[id]; ok {
+		return e.conn, true
+	}
+	return nil, false
+}
+
+// ErrNoControl is returned by Send for cameras whose protocol has no
+// control messages.
+var ErrNoControl = errors.New("camera does not read control messages")
+
+// Send writes v to a camera as a JSON control message. It reports whether
+// the camera was connected.
+func (r *CameraRegistry) Send(id string, v interface{}) (bool, error) {
+	r.mu.RLock()
+	e, ok := r.cameras[id]
+	r.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	if !e.status.Protocol.Control {
+		return true, ErrNoControl
+	}
+	return true, e.write(v)
+}
+
+// SendHello writes a hello to a camera over conn, whether or not it reads
+// control messages, as the reply to its own. Nothing is written if conn is
+// no longer the camera's connection.
+func (r *CameraRegistry) SendHello(id string, conn *websocket.Conn, h wire.Hello) error {
+	r.mu.RLock()
+	e, ok := r.cameras[id]
+	r.mu.RUnlock()
+	if !ok || e.conn != conn {
+		return nil
+	}
+	return e.write(h)
+}
+
+func (e *entry) write(v interface{}) error {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+	e.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return e.conn.WriteJSON(v)
+}
+
+// SetProtocol replaces the capabilities of a camera's connection conn,
+// renegotiated with a hello, if it is still the camera's connection.
+func (r *CameraRegistry) SetProtocol(id string, conn *websocket.Conn, caps wire.Capabilities) {
+	r.mu.Lock()
+	e, ok := r.cameras[id]
+	if ok && e.conn == conn {
+		e.status.Protocol = caps
+	}
+	r.mu.Unlock()
+	if ok && e.conn == conn {
+		e.writeMu.Lock()
+		conn.EnableWriteCompression(caps.Compression)
+		e.writeMu.Unlock()
+	}
+}
+
+// Record counts a frame of size bytes received from a camera at t. Frames
+// of cameras that aren't registered, such as pulled ones, are ignored.
+func (r *CameraRegistry) Record(id string, size int, t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.cameras[id]; ok {
+		e.status.Frames++
+		e.status.Bytes += uint64(size)
+		e.status.LastFrame = &t
+	}
+}
+
+// RecordGOP counts a frame of a camera that sends in groups of pictures,
+// numbered number, as a keyframe or a delta of the one gop names.
+func (r *CameraRegistry) RecordGOP(id string, number uint64, delta bool, gop wire.GOP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.cameras[id]
+	if !ok {
+		return
+	}
+	if e.status.GOP == nil {
+		e.status.GOP = &GOPStatus{}
+	}
+	st := e.status.GOP
+	st.Size = gop.Size
+	if !delta {
+		st.KeyFrames++
+		e.keyFrame, e.hasKeyFrame = number, true
+		return
+	}
+	st.DeltaFrames++
+	if !e.hasKeyFrame || gop.KeyFrame != e.keyFrame {
+		st.BrokenDeltas++
+	}
+}
+
+// RecordPTZ notes the position a PTZ camera reported with a frame.
+func (r *CameraRegistry) RecordPTZ(id string, p wire.PTZ) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.cameras[id]; ok {
+		// Replaced rather than changed, so snapshots can share it
+		e.status.PTZ = &p
+	}
+}
+
+// RecordLatency adds how long a camera's frame took to be queued for
+// storage to its IngestLatencyMs.
+func (r *CameraRegistry) RecordLatency(id string, d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.cameras[id]; ok {
+		if e.status.Frames <= 1 {
+			e.status.IngestLatencyMs = ms
+		} else {
+			e.status.IngestLatencyMs += latencyWeight * (ms - e.status.IngestLatencyMs)
+		}
+	}
+}
+
+// Status returns a connected camera's status.
+func (r *CameraRegistry) Status(id string) (Status, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if e, ok := r.cameras[id]; ok {
+		return e.snapshot(), true
+	}
+	return Status{}, false
+}
+
+// snapshot returns a copy of the status that later frames don't change.
+// It is called with r.mu held.
+func (e *entry) snapshot() Status {
+	st := e.status
+	if st.GOP != nil {
+		gop := *st.GOP
+		st.GOP = &gop
+	}
+	return st
+}
+
+// List returns the status of every connected camera, ordered by ID.
+func (r *CameraRegistry) List() []Status {
+	r.mu.RLock()
+	list := make([]Status, 0, len(r.cameras))
+	for _, e := range r.cameras {
+		list = append(list, e.snapshot())
+	}
+	r.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Range calls fn for each connected camera until it returns false. fn must
+// not call back into the registry.
+func (r *CameraRegistry) Range(fn func(id string, conn *websocket.Conn) bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for id, e := range r.cameras {
+		if !fn(id, e.conn) {
+			return
+		}
+	}
+}
+
+// Reserve holds a place for a camera about to connect from remoteAddr,
+// counted with those connected until release is called, so cameras
+// connecting at once can't all get past a limit. admit decides, under the
+// registry's lock, from how many cameras are connected or reserved, and
+// how many of them from remoteAddr, leaving out the camera's own
+// connection, which a new one would replace. Its error refuses the
+// reservation.
+func (r *CameraRegistry) Reserve(id, remoteAddr string, admit func(total, fromAddr int) error) (release func(), err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	total, fromAddr := r.reserved, r.reservedFrom[remoteAddr]
+	for cid, e := range r.cameras {
+		if cid == id {
+			continue
+		}
+		total++
+		if e.status.RemoteAddr == remoteAddr {
+			fromAddr++
+		}
+	}
+	if err := admit(total, fromAddr); err != nil {
+		return nil, err
+	}
+
+	r.reserved++
+	r.reservedFrom[remoteAddr]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.reserved--
+			if r.reservedFrom[remoteAddr]--; r.reservedFrom[remoteAddr] == 0 {
+				delete(r.reservedFrom, remoteAddr)
+			}
+		})
+	}, nil
+}
+
+// Len returns how many cameras are connected.
+func (r *CameraRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.cameras)
+}
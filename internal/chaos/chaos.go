@@ -0,0 +1,185 @@
+// Package chaos injects faults into a running server, so operators can
+// rehearse how cameras, dashboards and alerting cope with failures before
+// they happen for real. It is only wired in with chaos.enabled, and every
+// fault is off until set through the admin API. A nil Injector injects
+// nothing.
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrInjected is returned for failures the injector made up.
+var ErrInjected = errors.New("injected fault")
+
+// Faults are the faults to inject. The zero value injects none.
+type Faults struct {
+	// DropFrames is the fraction of ingested frames dropped, 0 to 1
+	DropFrames float64 `json:"drop_frames"`
+	// PersistDelayMs is added before each frame is stored
+	PersistDelayMs int `json:"persist_delay_ms"`
+	// FailFFmpegEvery fails every Nth FFmpeg run, 0 for none
+	FailFFmpegEvery int `json:"fail_ffmpeg_every"`
+	// APIErrors is the fraction of API requests answered with a 500, 0 to 1
+	APIErrors float64 `json:"api_errors"`
+}
+
+// Validate checks that fractions are between 0 and 1 and nothing is
+// negative.
+func (f Faults) Validate() error {
+	switch {
+	case f.DropFrames < 0 || f.DropFrames > 1:
+		return fmt.Errorf("drop_frames must be between 0 and 1, got %g", f.DropFrames)
+	case f.APIErrors < 0 || f.APIErrors > 1:
+		return fmt.Errorf("api_errors must be between 0 and 1, got %g", f.APIErrors)
+	case f.PersistDelayMs < 0:
+		return fmt.Errorf("persist_delay_ms must not be negative, got %d", f.PersistDelayMs)
+	case f.FailFFmpegEvery < 0:
+		return fmt.Errorf("fail_ffmpeg_every must not be negative, got %d", f.FailFFmpegEvery)
+	}
+	return nil
+}
+
+// Status is what is being injected, and how often it has been.
+type Status struct {
+	Faults Faults `json:"faults"`
+	// Until is when the faults turn themselves off, if they do
+	Until *time.Time `json:"until,omitempty"`
+	// Injected counts the faults injected since they were last set, by
+	// fault
+	Injected map[string]int64 `json:"injected"`
+}
+
+// Injector decides which operations fail.
+type Injector struct {
+	// ffmpegKinds are the job kinds that run FFmpeg
+	ffmpegKinds map[string]bool
+
+	mu         sync.Mutex
+	faults     Faults
+	until      time.Time
+	ffmpegRuns int
+	injected   map[string]int64
+	rand       *rand.Rand
+}
+
+// New returns an injector with no faults set. Jobs of ffmpegKinds count as
+// FFmpeg runs.
+func New(ffmpegKinds ...string) *Injector {
+	inj := &Injector{
+		ffmpegKinds: make(map[string]bool),
+		injected:    make(map[string]int64),
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, kind := range ffmpegKinds {
+		inj.ffmpegKinds[kind] = true
+	}
+	return inj
+}
+
+// Set replaces the faults, until the given time or, if it is zero, until
+// they are set again. The counts start over.
+func (inj *Injector) Set(f Faults, until time.Time) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.faults, inj.until = f, until
+	inj.ffmpegRuns = 0
+	inj.injected = make(map[string]int64)
+}
+
+// Status returns the faults in effect.
+func (inj *Injector) Status() Status {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	s := Status{Faults: inj.active(), Injected: make(map[string]int64, len(inj.injected))}
+	if !inj.until.IsZero() && time.Now().Before(inj.until) {
+		until := inj.until
+		s.Until = &until
+	}
+	for fault, n := range inj.injected {
+		s.Injected[fault] = n
+	}
+	return s
+}
+
+// DropFrame reports whether an ingested frame should be dropped.
+func (inj *Injector) DropFrame() bool {
+	return inj.chance("drop_frames", func(f Faults) float64 { return f.DropFrames })
+}
+
+// FailRequest reports whether an API request should be answered with a
+// 500.
+func (inj *Injector) FailRequest() bool {
+	return inj.chance("api_errors", func(f Faults) float64 { return f.APIErrors })
+}
+
+// PersistDelay returns how long to wait before storing a frame.
+func (inj *Injector) PersistDelay() time.Duration {
+	if inj == nil {
+		return 0
+	}
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	ms := inj.active().PersistDelayMs
+	if ms > 0 {
+		inj.injected["persist_delay_ms"]++
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// FailFFmpeg counts an FFmpeg run about to start, and returns ErrInjected
+// for every Nth.
+func (inj *Injector) FailFFmpeg() error {
+	if inj == nil {
+		return nil
+	}
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	every := inj.active().FailFFmpegEvery
+	if every <= 0 {
+		return nil
+	}
+	inj.ffmpegRuns++
+	if inj.ffmpegRuns%every != 0 {
+		return nil
+	}
+	inj.injected["fail_ffmpeg_every"]++
+	return fmt.Errorf("%w: FFmpeg run %d failed", ErrInjected, inj.ffmpegRuns)
+}
+
+// FailJob is FailFFmpeg for a job of kind about to run, if the kind runs
+// FFmpeg.
+func (inj *Injector) FailJob(kind string) error {
+	if inj == nil || !inj.ffmpegKinds[kind] {
+		return nil
+	}
+	return inj.FailFFmpeg()
+}
+
+// chance draws whether to inject a fault with the probability fraction
+// returns, counting it under name.
+func (inj *Injector) chance(name string, fraction func(Faults) float64) bool {
+	if inj == nil {
+		return false
+	}
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	p := fraction(inj.active())
+	if p <= 0 || inj.rand.Float64() >= p {
+		return false
+	}
+	inj.injected[name]++
+	return true
+}
+
+// active returns the faults unless they have run out. inj.mu must be held.
+func (inj *Injector) active() Faults {
+	if !inj.until.IsZero() && !time.Now().Before(inj.until) {
+		return Faults{}
+	}
+	return inj.faults
+}
@@ -0,0 +1,406 @@
+// Package cluster lets several servers, its nodes, act as one through a
+// shared Redis. Each node registers itself and the cameras connected to it
+// under a key that expires unless renewed, and publishes its events and
+// the live frames of its cameras, thinned to a frame rate, on channels of
+// its own that the other nodes follow. Nothing else is kept in Redis:
+// recordings stay on the node that made them.
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/events"
+	"github.com/raeeceip/cctv/internal/ratelimit"
+	"github.com/raeeceip/cctv/internal/wire"
+	"github.com/raeeceip/cctv/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// outBuffer is how many frames and events can wait to be published; more
+// are dropped while Redis is slow or away.
+const outBuffer = 256
+
+// Delays before reconnecting to Redis, doubling up to the maximum
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = 30 * time.Second
+)
+
+// Node is a node of the cluster as it last registered.
+type Node struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url,omitempty"`
+	Cameras []string  `json:"cameras"`
+	Seen    time.Time `json:"seen"`
+}
+
+// Frame is a live frame of another node's camera.
+type Frame struct {
+	Node     string
+	CameraID string
+	Number   uint64
+	Time     time.Time
+	Data     []byte
+}
+
+// message is a frame or event waiting to be published.
+type message struct {
+	channel string
+	data    []byte
+}
+
+// Cluster is this server's membership of a cluster.
+type Cluster struct {
+	cfg     config.ClusterConfig
+	logger  *logger.Logger
+	cameras func() []string
+	out     chan message
+	frames  *ratelimit.Limiter // nil to share every frame
+
+	mu      sync.RWMutex
+	nodes   []Node // the other nodes, as of the last registration
+	onFrame []func(Frame)
+	onEvent []func(events.Event)
+}
+
+// New returns the membership of the cluster cfg describes, registering the
+// cameras the function lists once Run.
+func New(cfg config.ClusterConfig, cameras func() []string, log *logger.Logger) *Cluster {
+	c := &Cluster{
+		cfg:     cfg,
+		logger:  log,
+		cameras: cameras,
+		out:     make(chan message, outBuffer),
+	}
+	if cfg.FrameFPS > 0 {
+		c.frames = ratelimit.New(cfg.FrameFPS, 1)
+	}
+	return c
+}
+
+// Node returns the name of this node.
+func (c *Cluster) Node() string {
+	return c.cfg.Node
+}
+
+// OnFrame calls fn with every frame the other nodes share.
+func (c *Cluster) OnFrame(fn func(Frame)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onFrame = append(c.onFrame, fn)
+}
+
+// OnEvent calls fn with every event of the other nodes, its Node set.
+func (c *Cluster) OnEvent(fn func(events.Event)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onEvent = append(c.onEvent, fn)
+}
+
+// Nodes returns the other nodes, sorted by name.
+func (c *Cluster) Nodes() []Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.nodes
+}
+
+// NodeOf returns the other node a camera is connected to, if any.
+func (c *Cluster) NodeOf(cameraID string) (Node, bool) {
+	for _, n := range c.Nodes() {
+		for _, id := range n.Cameras {
+			if id == cameraID {
+				return n, true
+			}
+		}
+	}
+	return Node{}, false
+}
+
+// PublishFrame shares a live frame of one of this node's cameras, unless
+// the camera's frame rate has been shared already.
+func (c *Cluster) PublishFrame(cameraID string, number uint64, t time.Time, data []byte) {
+	if c.frames != nil {
+		if ok, _ := c.frames.Allow(cameraID, time.Now()); !ok {
+			return
+		}
+	}
+	var buf bytes.Buffer
+	if err := wire.WriteFrame(&buf, wire.Header{Camera: cameraID, Time: t, FrameNum: number}, data); err != nil {
+		return
+	}
+	c.queue(c.channel("frames", c.cfg.Node), buf.Bytes())
+}
+
+// PublishEvent shares an event of this node. Events from other nodes,
+// which have Node set, aren't shared again.
+func (c *Cluster) PublishEvent(e events.Event) {
+	if e.Node != "" {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	c.queue(c.channel("events", c.cfg.Node), data)
+}
+
+func (c *Cluster) queue(channel string, data []byte) {
+	select {
+	case c.out <- message{channel: channel, data: data}:
+	default:
+		// Live frames and events are only worth having now
+	}
+}
+
+// channel returns the name of a node's channel of a kind, or with "*" the
+// pattern of every node's.
+func (c *Cluster) channel(kind, node string) string {
+	return c.cfg.Prefix + ":" + kind + ":" + node
+}
+
+func (c *Cluster) nodeKey(node string) string {
+	return c.cfg.Prefix + ":node:" + node
+}
+
+// Run registers the node and publishes and follows the cluster's frames
+// and events until ctx is done, reconnecting to Redis whenever the
+// connection fails. The node leaves the cluster as it returns.
+func (c *Cluster) Run(ctx context.Context) {
+	c.logger.Info("Joining cluster",
+		zap.String("node", c.cfg.Node),
+		zap.String("prefix", c.cfg.Prefix))
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c.reconnecting(ctx, "publish", c.publish)
+	}()
+	go func() {
+		defer wg.Done()
+		c.reconnecting(ctx, "subscribe", c.subscribe)
+	}()
+	wg.Wait()
+}
+
+// reconnecting runs fn on a new connection to Redis each time it fails,
+// backing off unless it was up for a while.
+func (c *Cluster) reconnecting(ctx context.Context, role string, fn func(context.Context, *redisConn) error) {
+	delay := minRetryDelay
+	for {
+		started := time.Now()
+		conn, err := dialRedis(ctx, c.cfg.Redis)
+		if err == nil {
+			err = fn(ctx, conn)
+			conn.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > maxRetryDelay {
+			delay = minRetryDelay
+		}
+		c.logger.Warn("Cluster connection to Redis failed",
+			zap.String("role", role),
+			zap.Duration("retry_in", delay),
+			zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
+
+// publish registers the node every interval and publishes what is queued.
+func (c *Cluster) publish(ctx context.Context, conn *redisConn) error {
+	if err := c.register(conn); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if _, err := conn.do("DEL", c.nodeKey(c.cfg.Node)); err != nil {
+				c.logger.Warn("Failed to leave cluster", zap.Error(err))
+			}
+			return nil
+		case <-ticker.C:
+			if err := c.register(conn); err != nil {
+				return err
+			}
+		case m := <-c.out:
+			if _, err := conn.do("PUBLISH", m.channel, m.data); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// register renews the node's registration, which expires after three
+// intervals, and lists the other nodes.
+func (c *Cluster) register(conn *redisConn) error {
+	self := Node{ID: c.cfg.Node, URL: c.cfg.URL, Cameras: c.cameras(), Seen: time.Now().UTC()}
+	if self.Cameras == nil {
+		self.Cameras = []string{}
+	}
+	data, err := json.Marshal(self)
+	if err != nil {
+		return err
+	}
+	ttl := 3 * c.cfg.Interval.Milliseconds()
+	if _, err := conn.do("SET", c.nodeKey(c.cfg.Node), data, "PX", ttl); err != nil {
+		return err
+	}
+
+	var keys []any
+	cursor := "0"
+	for {
+		reply, err := conn.do("SCAN", cursor, "MATCH", c.nodeKey("*"), "COUNT", 100)
+		if err != nil {
+			return err
+		}
+		page, ok := reply.([]any)
+		if !ok || len(page) != 2 {
+			return errors.New("redis: unexpected SCAN reply")
+		}
+		next, _ := page[0].([]byte)
+		found, _ := page[1].([]any)
+		keys = append(keys, found...)
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			break
+		}
+	}
+
+	var nodes []Node
+	if len(keys) > 0 {
+		reply, err := conn.do(append([]any{"MGET"}, keys...)...)
+		if err != nil {
+			return err
+		}
+		values, _ := reply.([]any)
+		for _, v := range values {
+			data, ok := v.([]byte)
+			if !ok {
+				// Expired since it was listed
+				continue
+			}
+			var n Node
+			if err := json.Unmarshal(data, &n); err != nil || n.ID == c.cfg.Node {
+				continue
+			}
+			nodes = append(nodes, n)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	c.mu.Lock()
+	c.nodes = nodes
+	c.mu.Unlock()
+	return nil
+}
+
+// subscribe follows the other nodes' frames and events. It pings Redis
+// every interval and gives up on a connection that hasn't replied in three,
+// so a half-open one is replaced rather than followed forever.
+func (c *Cluster) subscribe(ctx context.Context, conn *redisConn) error {
+	if err := conn.send("PSUBSCRIBE", c.channel("frames", "*"), c.channel("events", "*")); err != nil {
+		return err
+	}
+	// Reads block, so closing the connection is what stops them
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// Only this goroutine writes while the loop below reads
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(c.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := conn.send("PING"); err != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		conn.conn.SetReadDeadline(time.Now().Add(3 * c.cfg.Interval))
+		reply, err := conn.read()
+		if err != nil {
+			return err
+		}
+		msg, ok := reply.([]any)
+		if !ok || len(msg) != 4 || string(bytesOf(msg[0])) != "pmessage" {
+			// Subscription confirmations and pongs
+			continue
+		}
+		channel, data := string(bytesOf(msg[2])), bytesOf(msg[3])
+		node := channel[strings.LastIndexByte(channel, ':')+1:]
+		if node == c.cfg.Node {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(channel, c.cfg.Prefix+":frames:"):
+			c.receiveFrame(node, data)
+		case strings.HasPrefix(channel, c.cfg.Prefix+":events:"):
+			c.receiveEvent(node, data)
+		}
+	}
+}
+
+func (c *Cluster) receiveFrame(node string, data []byte) {
+	r := bytes.NewReader(data)
+	h, err := wire.ReadHeader(r)
+	if err != nil {
+		c.logger.Debug("Ignoring malformed cluster frame", zap.String("node", node), zap.Error(err))
+		return
+	}
+	frame, _ := io.ReadAll(r)
+	f := Frame{Node: node, CameraID: h.Camera, Number: h.FrameNum, Time: h.Time, Data: frame}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, fn := range c.onFrame {
+		fn(f)
+	}
+}
+
+func (c *Cluster) receiveEvent(node string, data []byte) {
+	var e events.Event
+	if err := json.Unmarshal(data, &e); err != nil {
+		c.logger.Debug("Ignoring malformed cluster event", zap.String("node", node), zap.Error(err))
+		return
+	}
+	e.Node = node
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, fn := range c.onEvent {
+		fn(e)
+	}
+}
+
+// bytesOf returns a bulk or simple string reply as bytes.
+func bytesOf(v any) []byte {
+	switch s := v.(type) {
+	case []byte:
+		return s
+	case string:
+		return []byte(s)
+	}
+	return nil
+}
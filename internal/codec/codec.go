@@ -0,0 +1,127 @@
+// Package codec decodes and encodes the JPEG images on the server's hot
+// paths: checking ingested frames, motion detection and motion previews.
+// The pure Go image/jpeg codec is always there. Servers built with the
+// turbojpeg tag (and cgo) also get one backed by libjpeg-turbo, which is
+// preferred, as it decodes and encodes several times faster. Cameras may
+// also send WebP frames, which are decoded, but never encoded.
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"sort"
+	"sync/atomic"
+)
+
+// Codec decodes and encodes JPEG images.
+type Codec interface {
+	// Name identifies the codec in the configuration and logs
+	Name() string
+	DecodeConfig(data []byte) (image.Config, error)
+	Decode(data []byte) (image.Image, error)
+	Encode(w io.Writer, img image.Image, quality int) error
+}
+
+// Auto picks the fastest codec built in.
+const Auto = "auto"
+
+var (
+	codecs    = map[string]Codec{}
+	preferred Codec
+	// current holds a holder, as an atomic.Value only takes one concrete
+	// type
+	current atomic.Value
+)
+
+type holder struct{ Codec }
+
+func init() {
+	register(goCodec{})
+	if native != nil {
+		register(native)
+	}
+}
+
+// register adds a codec, preferring it over those added before.
+func register(c Codec) {
+	codecs[c.Name()] = c
+	preferred = c
+	current.Store(holder{c})
+}
+
+// Use selects the codec used from then on, by name or with Auto. It is
+// meant to be called once at startup.
+func Use(name string) (Codec, error) {
+	c := preferred
+	if name != "" && name != Auto {
+		var ok bool
+		if c, ok = codecs[name]; !ok {
+			return nil, fmt.Errorf("JPEG codec %q is not built in, have %v", name, Available())
+		}
+	}
+	current.Store(holder{c})
+	return c, nil
+}
+
+// Current returns the codec in use.
+func Current() Codec {
+	return current.Load().(holder).Codec
+}
+
+// Available lists the names of the codecs built in.
+func Available() []string {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get returns a codec by name, for comparing them.
+func Get(name string) (Codec, bool) {
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// DecodeConfig reads the dimensions of a JPEG with the codec in use, or
+// of a WebP.
+func DecodeConfig(data []byte) (image.Config, error) {
+	if Encoding(data) == WebP {
+		return decodeWebPConfig(data)
+	}
+	return Current().DecodeConfig(data)
+}
+
+// Decode decodes a JPEG with the codec in use, or a WebP.
+func Decode(data []byte) (image.Image, error) {
+	if Encoding(data) == WebP {
+		return decodeWebP(data)
+	}
+	return Current().Decode(data)
+}
+
+// Encode encodes img as a JPEG of quality 1 to 100 with the codec in use.
+func Encode(w io.Writer, img image.Image, quality int) error {
+	return Current().Encode(w, img, quality)
+}
+
+// goCodec is the standard library's codec.
+type goCodec struct{}
+
+func (goCodec) Name() string { return "go" }
+
+func (goCodec) DecodeConfig(data []byte) (image.Config, error) {
+	return jpeg.DecodeConfig(bytes.NewReader(data))
+}
+
+func (goCodec) Decode(data []byte) (image.Image, error) {
+	return jpeg.Decode(bytes.NewReader(data))
+}
+
+func (goCodec) Encode(w io.Writer, img image.Image, quality int) error {
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+}
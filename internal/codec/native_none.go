@@ -0,0 +1,7 @@
+//go:build !turbojpeg || !cgo
+
+package codec
+
+// native is the codec backed by libjpeg-turbo, which needs the turbojpeg
+// build tag and cgo.
+var native Codec
@@ -0,0 +1,208 @@
+//go:build turbojpeg && cgo
+
+package codec
+
+/*
+#cgo LDFLAGS: -lturbojpeg
+#include <stdlib.h>
+#include <turbojpeg.h>
+
+// The planes are passed one by one: cgo doesn't allow Go memory holding Go
+// pointers, which an array of plane pointers would be.
+static int decompress_planes(tjhandle h, const unsigned char *buf, unsigned long size,
+		unsigned char *y, unsigned char *cb, unsigned char *cr,
+		int width, int ystride, int cstride, int height) {
+	unsigned char *planes[3] = {y, cb, cr};
+	int strides[3] = {ystride, cstride, cstride};
+	return tjDecompressToYUVPlanes(h, buf, size, planes, width, strides, height, 0);
+}
+
+static int compress_planes(tjhandle h, const unsigned char *y, const unsigned char *cb,
+		const unsigned char *cr, int width, int ystride, int cstride, int height,
+		int subsamp, unsigned char **out, unsigned long *size, int quality) {
+	const unsigned char *planes[3] = {y, cb, cr};
+	int strides[3] = {ystride, cstride, cstride};
+	return tjCompressFromYUVPlanes(h, planes, width, strides, height, subsamp, out, size, quality, 0);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"unsafe"
+)
+
+var native Codec = turbo{}
+
+// turboRatios maps the chroma subsamplings both libjpeg-turbo and
+// image.YCbCr know.
+var turboRatios = map[C.int]image.YCbCrSubsampleRatio{
+	C.TJSAMP_444: image.YCbCrSubsampleRatio444,
+	C.TJSAMP_422: image.YCbCrSubsampleRatio422,
+	C.TJSAMP_420: image.YCbCrSubsampleRatio420,
+	C.TJSAMP_440: image.YCbCrSubsampleRatio440,
+	C.TJSAMP_411: image.YCbCrSubsampleRatio411,
+}
+
+// turbo is libjpeg-turbo's TurboJPEG API. Images are decoded to the same
+// types image/jpeg returns, *image.YCbCr or *image.Gray, so callers' fast
+// paths still apply. CMYK images and unusual subsamplings are left to the
+// Go codec.
+type turbo struct{}
+
+func (turbo) Name() string { return "turbojpeg" }
+
+// header reads the dimensions, subsampling and color space of a JPEG.
+func header(h C.tjhandle, data []byte) (width, height int, subsamp, colorspace C.int, err error) {
+	var w, ht C.int
+	if C.tjDecompressHeader3(h, (*C.uchar)(unsafe.Pointer(&data[0])), C.ulong(len(data)), &w, &ht, &subsamp, &colorspace) != 0 {
+		return 0, 0, 0, 0, turboError(h)
+	}
+	return int(w), int(ht), subsamp, colorspace, nil
+}
+
+func (t turbo) DecodeConfig(data []byte) (image.Config, error) {
+	if len(data) == 0 {
+		return image.Config{}, errors.New("empty JPEG")
+	}
+	h := C.tjInitDecompress()
+	if h == nil {
+		return image.Config{}, turboError(nil)
+	}
+	defer C.tjDestroy(h)
+
+	w, ht, subsamp, colorspace, err := header(h, data)
+	if err != nil {
+		return image.Config{}, err
+	}
+	model := color.YCbCrModel
+	switch {
+	case subsamp == C.TJSAMP_GRAY:
+		model = color.GrayModel
+	case colorspace == C.TJCS_CMYK || colorspace == C.TJCS_YCCK:
+		model = color.CMYKModel
+	}
+	return image.Config{ColorModel: model, Width: w, Height: ht}, nil
+}
+
+func (t turbo) Decode(data []byte) (image.Image, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty JPEG")
+	}
+	h := C.tjInitDecompress()
+	if h == nil {
+		return nil, turboError(nil)
+	}
+	defer C.tjDestroy(h)
+
+	w, ht, subsamp, colorspace, err := header(h, data)
+	if err != nil {
+		return nil, err
+	}
+	src := (*C.uchar)(unsafe.Pointer(&data[0]))
+
+	if subsamp == C.TJSAMP_GRAY {
+		img := image.NewGray(image.Rect(0, 0, w, ht))
+		if C.tjDecompress2(h, src, C.ulong(len(data)), (*C.uchar)(unsafe.Pointer(&img.Pix[0])),
+			C.int(w), C.int(img.Stride), C.int(ht), C.TJPF_GRAY, 0) != 0 {
+			return nil, turboError(h)
+		}
+		return img, nil
+	}
+	ratio, ok := turboRatios[subsamp]
+	if !ok || colorspace != C.TJCS_YCbCr {
+		return goCodec{}.Decode(data)
+	}
+
+	img := image.NewYCbCr(image.Rect(0, 0, w, ht), ratio)
+	if C.decompress_planes(h, src, C.ulong(len(data)),
+		(*C.uchar)(unsafe.Pointer(&img.Y[0])), (*C.uchar)(unsafe.Pointer(&img.Cb[0])), (*C.uchar)(unsafe.Pointer(&img.Cr[0])),
+		C.int(w), C.int(img.YStride), C.int(img.CStride), C.int(ht)) != 0 {
+		return nil, turboError(h)
+	}
+	return img, nil
+}
+
+func (t turbo) Encode(w io.Writer, img image.Image, quality int) error {
+	b := img.Bounds()
+	if b.Empty() {
+		return errors.New("empty image")
+	}
+	h := C.tjInitCompress()
+	if h == nil {
+		return turboError(nil)
+	}
+	defer C.tjDestroy(h)
+
+	var out *C.uchar
+	var size C.ulong
+	var rc C.int
+	switch m := img.(type) {
+	case *image.YCbCr:
+		if subsamp, ok := turboSubsamp(m.SubsampleRatio); ok && b.Min == (image.Point{}) {
+			rc = C.compress_planes(h,
+				(*C.uchar)(unsafe.Pointer(&m.Y[0])), (*C.uchar)(unsafe.Pointer(&m.Cb[0])), (*C.uchar)(unsafe.Pointer(&m.Cr[0])),
+				C.int(b.Dx()), C.int(m.YStride), C.int(m.CStride), C.int(b.Dy()),
+				subsamp, &out, &size, C.int(quality))
+			break
+		}
+		return t.encodeRGBA(h, w, toRGBA(img), quality)
+	case *image.Gray:
+		rc = C.tjCompress2(h, (*C.uchar)(unsafe.Pointer(&m.Pix[m.PixOffset(b.Min.X, b.Min.Y)])),
+			C.int(b.Dx()), C.int(m.Stride), C.int(b.Dy()), C.TJPF_GRAY,
+			&out, &size, C.TJSAMP_GRAY, C.int(quality), 0)
+	case *image.RGBA:
+		return t.encodeRGBA(h, w, m, quality)
+	default:
+		return t.encodeRGBA(h, w, toRGBA(img), quality)
+	}
+	return writeOut(h, w, rc, out, size)
+}
+
+// encodeRGBA encodes with 4:2:0 subsampling, like image/jpeg. Alpha is
+// ignored.
+func (turbo) encodeRGBA(h C.tjhandle, w io.Writer, m *image.RGBA, quality int) error {
+	b := m.Bounds()
+	var out *C.uchar
+	var size C.ulong
+	rc := C.tjCompress2(h, (*C.uchar)(unsafe.Pointer(&m.Pix[m.PixOffset(b.Min.X, b.Min.Y)])),
+		C.int(b.Dx()), C.int(m.Stride), C.int(b.Dy()), C.TJPF_RGBX,
+		&out, &size, C.TJSAMP_420, C.int(quality), 0)
+	return writeOut(h, w, rc, out, size)
+}
+
+// writeOut copies a JPEG libjpeg-turbo allocated to w and frees it.
+func writeOut(h C.tjhandle, w io.Writer, rc C.int, out *C.uchar, size C.ulong) error {
+	if out != nil {
+		defer C.tjFree(out)
+	}
+	if rc != 0 {
+		return turboError(h)
+	}
+	_, err := w.Write(C.GoBytes(unsafe.Pointer(out), C.int(size)))
+	return err
+}
+
+func turboSubsamp(ratio image.YCbCrSubsampleRatio) (C.int, bool) {
+	for subsamp, r := range turboRatios {
+		if r == ratio {
+			return subsamp, true
+		}
+	}
+	return 0, false
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	m := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(m, m.Bounds(), img, b.Min, draw.Src)
+	return m
+}
+
+func turboError(h C.tjhandle) error {
+	return errors.New("turbojpeg: " + C.GoString(C.tjGetErrorStr2(h)))
+}
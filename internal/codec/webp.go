@@ -0,0 +1,49 @@
+package codec
+
+import (
+	"bytes"
+	"image"
+
+	"golang.org/x/image/webp"
+)
+
+// Encodings of the frames cameras send. Everything stored is JPEG; WebP
+// frames are only decoded, with the pure Go golang.org/x/image/webp.
+const (
+	JPEG = "jpeg"
+	WebP = "webp"
+)
+
+// Encoding returns the encoding of an image from its header, JPEG for
+// anything not WebP.
+func Encoding(data []byte) string {
+	if len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP" {
+		return WebP
+	}
+	return JPEG
+}
+
+// ToJPEG returns data as a JPEG, encoding it at quality unless it is one
+// already.
+func ToJPEG(data []byte, quality int) ([]byte, error) {
+	if Encoding(data) == JPEG {
+		return data, nil
+	}
+	img, err := Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, quality); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeWebPConfig(data []byte) (image.Config, error) {
+	return webp.DecodeConfig(bytes.NewReader(data))
+}
+
+func decodeWebP(data []byte) (image.Image, error) {
+	return webp.Decode(bytes.NewReader(data))
+}
@@ -2,24 +2,456 @@ package config
 
 import (
 	"fmt"
+	"math"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/raeeceip/cctv/internal/codec"
+	"github.com/raeeceip/cctv/internal/naming"
+	"github.com/raeeceip/cctv/internal/privacy"
+	"github.com/raeeceip/cctv/internal/videocodec"
+	"github.com/raeeceip/cctv/internal/wire"
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	LogLevel string        `mapstructure:"log_level"`
-	Server   ServerConfig  `mapstructure:"server"`
-	Stream   StreamConfig  `mapstructure:"stream"`
-	Storage  StorageConfig `mapstructure:"storage"`
+	LogLevel string    `mapstructure:"log_level"`
+	Log      LogConfig `mapstructure:"log"`
+	Profile  string    `mapstructure:"profile"`
+	// WatchConfig reloads the configuration whenever its file changes
+	WatchConfig bool `mapstructure:"watch_config"`
+	// Site is prefixed to the IDs of the cameras ingested here, so several
+	// sites can be aggregated without their camera IDs colliding
+	Site        string            `mapstructure:"site"`
+	Server      ServerConfig      `mapstructure:"server"`
+	Stream      StreamConfig      `mapstructure:"stream"`
+	Storage     StorageConfig     `mapstructure:"storage"`
+	Jobs        JobsConfig        `mapstructure:"jobs"`
+	Processor   ProcessorConfig   `mapstructure:"processor"`
+	Sources     SourcesConfig     `mapstructure:"sources"`
+	Replication ReplicationConfig `mapstructure:"replication"`
+	Aggregator  AggregatorConfig  `mapstructure:"aggregator"`
+	Cluster     ClusterConfig     `mapstructure:"cluster"`
+	Motion      MotionConfig      `mapstructure:"motion"`
+	Objects     ObjectsConfig     `mapstructure:"objects"`
+	Privacy     PrivacyConfig     `mapstructure:"privacy"`
+	Schedules   SchedulesConfig   `mapstructure:"schedules"`
+	ONVIF       ONVIFConfig       `mapstructure:"onvif"`
+	Chaos       ChaosConfig       `mapstructure:"chaos"`
+}
+
+// ChaosConfig lets admins inject faults through the API, to rehearse
+// failures against a running server. Leave it off in production.
+type ChaosConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+}
+
+// ONVIFConfig exposes the cameras as ONVIF devices, so NVR software can
+// discover them and find their streams. The services are served on the API
+// listener.
+type ONVIFConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Discovery answers WS-Discovery probes on UDP port 3702
+	Discovery bool `mapstructure:"discovery"`
+	// Address is the host:port put in the service addresses sent to
+	// discovery probes; the server's address on the network the probe came
+	// from, with server.port, when empty
+	Address string `mapstructure:"address"`
+	// Username and Password are asked for with WS-UsernameToken; any
+	// client is let in when Username is empty
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+}
+
+// SchedulesConfig pauses recording or alerts for cameras during planned
+// windows, such as cleaning crew hours, set here or listed as events in
+// iCalendar feeds.
+type SchedulesConfig struct {
+	Windows   []ScheduleWindow   `mapstructure:"windows"`
+	Calendars []ScheduleCalendar `mapstructure:"calendars"`
+	// Refresh is how often calendars are fetched again
+	Refresh time.Duration `mapstructure:"refresh"`
+	// Timezone of the windows and of calendar times without one; the
+	// server's local time when empty
+	Timezone string `mapstructure:"timezone"`
+}
+
+// ScheduleWindow is a window that recurs every week.
+type ScheduleWindow struct {
+	Name    string   `mapstructure:"name"`
+	Cameras []string `mapstructure:"cameras"` // every camera when empty
+	Pause   []string `mapstructure:"pause"`   // "recording" and/or "alerts"
+	Days    []string `mapstructure:"days"`    // "mon" to "sun"; every day when empty
+	Start   string   `mapstructure:"start"`   // "22:00"
+	End     string   `mapstructure:"end"`     // not after start means the next day
+}
+
+// ScheduleCalendar is an iCalendar feed whose events are windows.
+type ScheduleCalendar struct {
+	Name    string   `mapstructure:"name"`
+	URL     string   `mapstructure:"url"` // http(s):// or webcal://
+	Cameras []string `mapstructure:"cameras"`
+	Pause   []string `mapstructure:"pause"`
+	// Match keeps only events whose summary contains it, ignoring case
+	Match string `mapstructure:"match"`
+}
+
+// MotionConfig controls motion detection on incoming frames. What counts
+// as motion is tuned per camera through the API.
+type MotionConfig struct {
+	Detection bool `mapstructure:"detection"`
+	// Interval is how far apart the frames compared are
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+// ObjectsConfig runs sampled frames through an object detector, such as
+// an ONNX model finding people and vehicles. Off by default, as it costs
+// far more than motion detection.
+type ObjectsConfig struct {
+	Detection bool `mapstructure:"detection"`
+	// Detector names the implementation, "onnx" by default
+	Detector string `mapstructure:"detector"`
+	// Model is the file the detector loads, for onnx a YOLO style model
+	// taking 1x3xSxS RGB input
+	Model string `mapstructure:"model"`
+	// InputSize is S, the side frames are scaled to for the model
+	InputSize int `mapstructure:"input_size"`
+	// Labels names the model's classes in order; the COCO classes when
+	// empty
+	Labels []string `mapstructure:"labels"`
+	// Classes are the labels reported, the others being ignored; people
+	// and vehicles when empty
+	Classes []string `mapstructure:"classes"`
+	// MinScore is the confidence below which objects are ignored
+	MinScore float64 `mapstructure:"min_score"`
+	// Interval is how far apart the frames of a camera run through the
+	// detector are
+	Interval time.Duration `mapstructure:"interval"`
+	// Cooldown is the least time between events of a camera
+	Cooldown time.Duration `mapstructure:"cooldown"`
+	// Threads bounds the CPU threads the detector runs on, 0 for its
+	// default
+	Threads int `mapstructure:"threads"`
+}
+
+// PrivacyConfig hides areas of cameras' frames before they are stored or
+// viewed, besides the masks saved per camera through the API.
+type PrivacyConfig struct {
+	Masks []PrivacyMask `mapstructure:"masks"`
+}
+
+// PrivacyMask is a mask applied to the frames of some cameras.
+type PrivacyMask struct {
+	Cameras      []string `mapstructure:"cameras"` // every camera when empty
+	privacy.Mask `mapstructure:",squash"`
+}
+
+// MasksFor returns the masks of a camera.
+func (c PrivacyConfig) MasksFor(cameraID string) privacy.Masks {
+	var masks privacy.Masks
+	for _, m := range c.Masks {
+		if len(m.Cameras) == 0 || slices.Contains(m.Cameras, cameraID) {
+			masks = append(masks, m.Mask)
+		}
+	}
+	return masks
+}
+
+// AggregatorConfig lets the server present the cameras, events and
+// recordings of other servers, its nodes, alongside its own.
+type AggregatorConfig struct {
+	Nodes []AggregatorNode `mapstructure:"nodes"`
+	// PollInterval is how often the nodes' cameras are listed; their
+	// events update the list in between
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+}
+
+// AggregatorNode is a server whose API the aggregator consumes.
+type AggregatorNode struct {
+	Name  string `mapstructure:"name"` // used in URLs and events
+	URL   string `mapstructure:"url"`  // base URL of its operator API
+	Token string `mapstructure:"token"`
+}
+
+// ClusterConfig runs the server as one node of several sharing a Redis:
+// each registers its cameras there and publishes their live frames and
+// events, so cameras can connect to any node and be viewed from any.
+type ClusterConfig struct {
+	// Redis is the URL of the Redis, redis:// or rediss:// with TLS, with
+	// a password and database if needed; empty disables cluster mode
+	Redis string `mapstructure:"redis"`
+	// Node names this server in the cluster. Defaults to the site, or
+	// else the host name.
+	Node string `mapstructure:"node"`
+	// URL is this node's API as the other nodes and clients reach it
+	URL string `mapstructure:"url"`
+	// Prefix starts every Redis key and channel of the cluster
+	Prefix string `mapstructure:"prefix"`
+	// Interval is how often the node registers; it is dropped from the
+	// cluster after three missed
+	Interval time.Duration `mapstructure:"interval"`
+	// FrameFPS is how many live frames per second of each camera are
+	// shared with the other nodes; 0 shares them all
+	FrameFPS float64 `mapstructure:"frame_fps"`
+}
+
+// ReplicationConfig pushes new recordings to a peer server for an off-site
+// copy, and lets this server receive them from others. Either side may be
+// configured on its own.
+type ReplicationConfig struct {
+	// Peer is the base URL of the server recordings are pushed to; empty
+	// disables pushing
+	Peer  string `mapstructure:"peer"`
+	Token string `mapstructure:"token"` // the peer's accept_token
+	// Origin names this server on the peer, which files the recordings it
+	// receives under it. Defaults to the site, or else the host name.
+	Origin   string        `mapstructure:"origin"`
+	ChunkMB  int           `mapstructure:"chunk_mb"` // upload chunk size
+	Interval time.Duration `mapstructure:"interval"` // how often missed recordings are retried
+
+	// AcceptToken enables receiving recordings from servers that present it
+	AcceptToken string `mapstructure:"accept_token"`
+}
+
+// SourcesConfig lists cameras the server pulls frames from, as opposed to
+// cameras that connect to the ingest listener.
+type SourcesConfig struct {
+	RTSP []RTSPSource `mapstructure:"rtsp"`
+}
+
+// RTSPSource is an RTSP camera whose stream FFmpeg decodes into JPEG frames.
+type RTSPSource struct {
+	ID        string `mapstructure:"id"` // camera ID the frames are stored under
+	URL       string `mapstructure:"url"`
+	FPS       int    `mapstructure:"fps"`       // frames kept per second
+	Transport string `mapstructure:"transport"` // "tcp" or "udp"
+	Quality   int    `mapstructure:"quality"`   // JPEG quality scale, 2 (best) to 31
+}
+
+// ProcessorConfig controls where frames are processed. With more than one
+// shard each runs as a worker process handling the cameras that hash to it,
+// so an FFmpeg or decoder crash only takes down that shard.
+type ProcessorConfig struct {
+	Shards int `mapstructure:"shards"`
+	// Workers is how many frames each processor saves at once, with every
+	// camera's frames saved by the same worker in order; one per CPU if 0
+	Workers int `mapstructure:"workers"`
+	// Launcher is prepended to the worker command line, e.g. numactl to pin
+	// shards to NUMA nodes; "{shard}" is replaced by the shard number
+	Launcher []string `mapstructure:"launcher"`
+	// JPEGCodec decodes and encodes the JPEGs on the server's hot paths:
+	// "go", "turbojpeg" in builds with that tag, or "auto" for the fastest
+	JPEGCodec string `mapstructure:"jpeg_codec"`
+	// Plugins are Go plugins, built with -buildmode=plugin, that register
+	// frame stages for Stages to add to the pipeline
+	Plugins []string      `mapstructure:"plugins"`
+	Stages  []StageConfig `mapstructure:"stages"`
+}
+
+// StageConfig adds a registered frame stage to the processor's pipeline;
+// see processor.Stage.
+type StageConfig struct {
+	Name    string         `mapstructure:"name"`
+	Cameras []string       `mapstructure:"cameras"` // those it runs for, all when empty
+	Options map[string]any `mapstructure:"options"` // passed to the stage
+}
+
+// JobsConfig sizes the background job queue used for retention work.
+type JobsConfig struct {
+	Workers     int `mapstructure:"workers"`
+	MaxAttempts int `mapstructure:"max_attempts"`
+}
+
+// LogConfig is where the server logs, at every level, and how the log file
+// is rotated. Shard workers log next to OutputPath, as shard-N.log.
+type LogConfig struct {
+	OutputPath string `mapstructure:"output_path"`
+	MaxSize    int    `mapstructure:"max_size"`    // megabytes before rotating
+	MaxBackups int    `mapstructure:"max_backups"` // rotated files kept, 0 for all
+	MaxAge     int    `mapstructure:"max_age"`     // days rotated files are kept, 0 for ever
+	Compress   bool   `mapstructure:"compress"`    // gzip rotated files
 }
 
 type ServerConfig struct {
-	Port       int    `mapstructure:"port"`
-	Host       string `mapstructure:"host"`
-	SignalPort int    `mapstructure:"signal_port"`
-	StreamPort int    `mapstructure:"stream_port"`
+	Port       int              `mapstructure:"port"`
+	Host       string           `mapstructure:"host"`
+	SignalPort int              `mapstructure:"signal_port"`
+	StreamPort int              `mapstructure:"stream_port"`
+	SSL        SSLConfig        `mapstructure:"ssl"`
+	Ingest     ListenerConfig   `mapstructure:"ingest"`
+	API        ListenerConfig   `mapstructure:"api"`
+	Admin      AdminConfig      `mapstructure:"admin"`
+	Auth       CameraAuthConfig `mapstructure:"auth"`
+
+	// WebsocketBufferSize sizes the read/write buffers of camera connections
+	WebsocketBufferSize int `mapstructure:"websocket_buffer_size"`
+
+	// ProtocolVersions are the wire protocol versions cameras may connect
+	// with; cameras too old for all of them are refused
+	ProtocolVersions []int `mapstructure:"protocol_versions"`
+	// FrameEncodings are the image encodings cameras may send frames in:
+	// jpeg, and webp to offer it in hellos
+	FrameEncodings []string `mapstructure:"frame_encodings"`
+
+	// FeedbackInterval is how often cameras that read control messages
+	// are told how the server is keeping up with their frames; 0 never
+	FeedbackInterval time.Duration `mapstructure:"feedback_interval"`
+
+	// TrustedProxies are the addresses or CIDRs of reverse proxies whose
+	// X-Forwarded-For headers are believed; without any, clients are told
+	// apart by the address they connect from
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+
+	// RateLimits protect expensive API routes from clients asking too often
+	RateLimits []RateLimitPolicy `mapstructure:"rate_limits"`
+
+	// BodyLimits bound the size of what clients send in one request
+	BodyLimits BodyLimitsConfig `mapstructure:"body_limits"`
+
+	// Limits bound the camera connections and how fast cameras send frames
+	Limits CameraLimitsConfig `mapstructure:"limits"`
+
+	// Health tells working cameras from those that stopped sending
+	Health HealthConfig `mapstructure:"health"`
+}
+
+// HealthConfig marks a camera degraded once it has sent no frames for
+// DegradedAfter, and offline once it has sent neither frames nor
+// heartbeats for OfflineAfter, or disconnected.
+type HealthConfig struct {
+	DegradedAfter time.Duration `mapstructure:"degraded_after"`
+	OfflineAfter  time.Duration `mapstructure:"offline_after"`
+	// Webhooks are URLs camera.health events are posted to
+	Webhooks []string `mapstructure:"webhooks"`
+}
+
+// BodyLimitsConfig bounds request bodies, so a single request can't run the
+// server out of memory or disk. Larger requests are refused with 413.
+type BodyLimitsConfig struct {
+	JSONKB   int `mapstructure:"json_kb"`   // JSON and other small bodies
+	UploadMB int `mapstructure:"upload_mb"` // one chunk of a recording upload
+	FrameMB  int `mapstructure:"frame_mb"`  // one websocket message from a camera
+}
+
+// CameraLimitsConfig bounds camera connections, so one misbehaving network
+// or camera can't take the ingest capacity of all. Zero is no limit.
+type CameraLimitsConfig struct {
+	MaxConnections      int `mapstructure:"max_connections"`        // cameras connected at once
+	MaxConnectionsPerIP int `mapstructure:"max_connections_per_ip"` // of those, from one address
+	// MaxFPS is the most frames per second a camera may send, over a
+	// second's burst; frames beyond it are dropped, or with
+	// FrameRateAction "disconnect" the camera is disconnected
+	MaxFPS          float64 `mapstructure:"max_fps"`
+	FrameRateAction string  `mapstructure:"frame_rate_action"`
+	// Cameras are what some cameras are expected to send, overriding
+	// MaxFPS; the first policy listing a camera, or listing none, is its
+	Cameras []CameraPolicy `mapstructure:"cameras"`
+}
+
+// CameraPolicy is the frame rate and resolution expected of some cameras,
+// all of them when Cameras is empty. Zero is no limit.
+type CameraPolicy struct {
+	Cameras []string `mapstructure:"cameras"`
+	MaxFPS  float64  `mapstructure:"max_fps"`
+	// Frames larger than MaxWidth by MaxHeight are downscaled to fit by
+	// the processor, or with ResolutionAction "drop" not stored
+	MaxWidth         int    `mapstructure:"max_width"`
+	MaxHeight        int    `mapstructure:"max_height"`
+	ResolutionAction string `mapstructure:"resolution_action"`
+}
+
+// What happens to a camera sending frames faster than its limit
+const (
+	FrameRateDrop       = "drop"
+	FrameRateDisconnect = "disconnect"
+)
+
+// What happens to frames larger than their camera's policy
+const (
+	ResolutionDownscale = "downscale"
+	ResolutionDrop      = "drop"
+)
+
+// PolicyFor returns the policy of a camera, with MaxFPS the limit that
+// applies to it.
+func (c CameraLimitsConfig) PolicyFor(cameraID string) CameraPolicy {
+	policy := CameraPolicy{MaxFPS: c.MaxFPS}
+	for _, p := range c.Cameras {
+		if len(p.Cameras) == 0 || slices.Contains(p.Cameras, cameraID) {
+			policy = p
+			if policy.MaxFPS == 0 {
+				policy.MaxFPS = c.MaxFPS
+			}
+			break
+		}
+	}
+	return policy
+}
+
+// RateLimitPolicy limits the requests each client makes to some API routes
+// with a token bucket. Routes are gin patterns, optionally preceded by a
+// method: "GET /api/v1/search" or "/api/v1/cameras/:id/frame".
+type RateLimitPolicy struct {
+	Name   string   `mapstructure:"name"`
+	Routes []string `mapstructure:"routes"`
+	Rate   float64  `mapstructure:"rate"`  // requests per second
+	Burst  int      `mapstructure:"burst"` // requests allowed at once; rate rounded up if 0
+	// Key tells clients apart: "ip" (default), or "token" for the bearer
+	// token, falling back to the IP for requests without one
+	Key string `mapstructure:"key"`
+}
+
+// AdminConfig controls the /api/v1/admin endpoints. They are disabled while
+// no token is configured.
+type AdminConfig struct {
+	Token string `mapstructure:"token"`
+}
+
+// CameraAuthConfig controls how cameras authenticate on /camera/connect. A
+// camera presenting a valid token connects as the camera ID the token is
+// for.
+type CameraAuthConfig struct {
+	// Required refuses cameras without a valid token. Otherwise cameras
+	// may connect without one and are given a generated ID.
+	Required bool `mapstructure:"required"`
+	// JWTSecret accepts HS256 JWTs signed with it whose subject is the
+	// camera ID, besides the tokens issued through the admin API
+	JWTSecret string `mapstructure:"jwt_secret"`
+}
+
+type SSLConfig struct {
+	Enabled  bool   `mapstructure:"enabled"`
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// ClientCAFile requires clients to present a certificate signed by one
+	// of the CAs in this PEM file (mutual TLS)
+	ClientCAFile string `mapstructure:"client_ca_file"`
+}
+
+// ListenerConfig holds the HTTP settings of a single listener. Camera ingest
+// is served on signal_port and the operator API on port; when both ports are
+// equal the two route sets share one listener. A listener without its own
+// ssl block falls back to server.ssl.
+//
+// Setting Socket binds a Unix domain socket instead of the TCP port. Sockets
+// passed by systemd (LISTEN_FDS) take precedence over both.
+type ListenerConfig struct {
+	Socket            string        `mapstructure:"socket"`
+	SocketMode        string        `mapstructure:"socket_mode"`
+	ReadTimeout       time.Duration `mapstructure:"read_timeout"`
+	ReadHeaderTimeout time.Duration `mapstructure:"read_header_timeout"`
+	WriteTimeout      time.Duration `mapstructure:"write_timeout"`
+	IdleTimeout       time.Duration `mapstructure:"idle_timeout"`
+	SSL               SSLConfig     `mapstructure:"ssl"`
 }
 
 type StreamConfig struct {
@@ -31,16 +463,275 @@ type StreamConfig struct {
 	Width         int               `mapstructure:"width"`
 	Height        int               `mapstructure:"height"`
 	Options       map[string]string `mapstructure:"options"`
+	WebRTC        WebRTCConfig      `mapstructure:"webrtc"`
+	RTSP          RTSPOutputConfig  `mapstructure:"rtsp"`
+}
+
+// RTSPOutputConfig republishes each camera's live stream over RTSP, at
+// rtsp://host:port/<camera>, encoded as for WebRTC.
+type RTSPOutputConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	Port    int  `mapstructure:"port"` // on server.host
+}
+
+// WebRTCConfig controls live viewing over WebRTC. The video is encoded with
+// the bitrate, framerate and options above.
+type WebRTCConfig struct {
+	ICEServers []ICEServer `mapstructure:"ice_servers"` // STUN/TURN servers offered to viewers
+	// PublicIPs are announced instead of the host's own addresses, for
+	// servers behind 1:1 NAT
+	PublicIPs []string `mapstructure:"public_ips"`
+	// PortMin and PortMax limit the UDP ports used for media, e.g. to open
+	// them in a firewall; zero uses any port
+	PortMin uint16 `mapstructure:"port_min"`
+	PortMax uint16 `mapstructure:"port_max"`
+	// MaxSessions bounds the viewers watching at once, over all cameras;
+	// 0 for no limit
+	MaxSessions int `mapstructure:"max_sessions"`
+}
+
+type ICEServer struct {
+	URLs       []string `mapstructure:"urls"`
+	Username   string   `mapstructure:"username"`
+	Credential string   `mapstructure:"credential"`
 }
 
 type StorageConfig struct {
-	OutputDir      string `mapstructure:"output_dir"`
-	SaveFrames     bool   `mapstructure:"save_frames"`
-	MaxFrames      int    `mapstructure:"max_frames"`
-	MaxDiskUsage   int64  `mapstructure:"max_disk_usage"`
-	RetentionHours int64  `mapstructure:"retention_hours"`
+	OutputDir          string                   `mapstructure:"output_dir"`
+	FrameLayout        string                   `mapstructure:"frame_layout"`   // "dated" or "flat"
+	FrameMetadata      string                   `mapstructure:"frame_metadata"` // "sidecar", "embed", or empty for none
+	SaveFrames         bool                     `mapstructure:"save_frames"`
+	MaxFrames          int                      `mapstructure:"max_frames"`
+	MaxDiskUsage       int64                    `mapstructure:"max_disk_usage"`
+	RetentionHours     int64                    `mapstructure:"retention_hours"`
+	BufferSize         int                      `mapstructure:"buffer_size"`
+	IndexPath          string                   `mapstructure:"index_path"`
+	FrameIndex         FrameIndexConfig         `mapstructure:"frame_index"`
+	FrameCache         FrameCacheConfig         `mapstructure:"frame_cache"`
+	VideoConsolidation VideoConsolidationConfig `mapstructure:"video_consolidation"`
+	Import             ImportConfig             `mapstructure:"import"`
+	Retention          RetentionConfig          `mapstructure:"retention"`
+	Throttle           ThrottleConfig           `mapstructure:"throttle"`
+	Dedup              DedupConfig              `mapstructure:"dedup"`
+	HLS                HLSConfig                `mapstructure:"hls"`
+	Backend            BackendConfig            `mapstructure:"backend"`
+	Export             ExportConfig             `mapstructure:"export"`
+	Naming             NamingConfig             `mapstructure:"naming"`
+	DiskMonitor        DiskMonitorConfig        `mapstructure:"disk_monitor"`
+	DeadLetter         DeadLetterConfig         `mapstructure:"dead_letter"`
+}
+
+// DeadLetterConfig keeps frames that fail to be stored, such as corrupt
+// JPEGs or those met by a disk error, rather than only counting them.
+type DeadLetterConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Dir     string `mapstructure:"dir"` // defaults to <output_dir>/dead-letter
+	// MaxMB caps the frames kept, the oldest going first; 0 for no cap
+	MaxMB int64         `mapstructure:"max_mb"`
+	Keep  time.Duration `mapstructure:"keep"` // 0 keeps them until reprocessed or deleted
+}
+
+// DiskMonitorConfig stops frames being stored while the volume of
+// output_dir is low on space. The low-water mark is the larger of
+// MinFreeMB and MinFreePercent of the volume; with both zero frames are
+// always stored.
+type DiskMonitorConfig struct {
+	Interval       time.Duration `mapstructure:"interval"`
+	MinFreeMB      int64         `mapstructure:"min_free_mb"`
+	MinFreePercent float64       `mapstructure:"min_free_percent"`
+	// Webhooks are URLs the disk.low and disk.recovered events are posted to
+	Webhooks []string `mapstructure:"webhooks"`
+}
+
+// NamingConfig holds the Go templates naming stored frames, videos and
+// exported clips, without their extensions; see package naming for what
+// they can use. Empty templates give the default names.
+type NamingConfig struct {
+	Frame  string `mapstructure:"frame"`
+	Video  string `mapstructure:"video"`
+	Export string `mapstructure:"export"`
+}
+
+// ExportConfig converts recordings to other formats on request, for
+// investigators and editors whose tools want something other than MP4.
+// Formats are added to, or replace, the built-in mkv, webm and prores.
+type ExportConfig struct {
+	Formats map[string]ExportFormat `mapstructure:"formats"`
+	Keep    time.Duration           `mapstructure:"keep"` // how long finished exports stay on disk
+	// OverlayFont is the font for event overlays burnt into clips; empty
+	// leaves FFmpeg to find one through fontconfig
+	OverlayFont string `mapstructure:"overlay_font"`
+}
+
+// ExportFormat is an FFmpeg argument template: Args go between the input
+// and the output file, which is named with Extension.
+type ExportFormat struct {
+	Extension string   `mapstructure:"extension"`
+	Args      []string `mapstructure:"args"`
+}
+
+// defaultExportFormats are the formats offered without configuration.
+var defaultExportFormats = map[string]ExportFormat{
+	// Same streams in a Matroska container, without re-encoding
+	"mkv": {Extension: "mkv", Args: []string{"-map", "0", "-c", "copy"}},
+	"webm": {Extension: "webm", Args: []string{
+		"-c:v", "libvpx-vp9", "-crf", "32", "-b:v", "0", "-row-mt", "1", "-c:a", "libopus",
+	}},
+	// ProRes 422 HQ for editing suites
+	"prores": {Extension: "mov", Args: []string{
+		"-c:v", "prores_ks", "-profile:v", "3", "-pix_fmt", "yuv422p10le", "-c:a", "pcm_s16le",
+	}},
+}
+
+// BackendConfig copies finished videos, and optionally frames, from the
+// output directory to another directory or an S3 or GCS bucket. The output
+// directory stays the working copy.
+type BackendConfig struct {
+	Type string `mapstructure:"type"` // "local" (default), "s3" or "gcs"
+	// Path is the directory a local backend copies to, e.g. a network
+	// mount; empty copies nothing
+	Path     string `mapstructure:"path"`
+	Bucket   string `mapstructure:"bucket"`
+	Prefix   string `mapstructure:"prefix"` // prepended to object keys
+	Region   string `mapstructure:"region"`
+	Endpoint string `mapstructure:"endpoint"` // for S3-compatible stores
+	// PathStyle puts the bucket in the URL path rather than the host name,
+	// as MinIO and other S3-compatible stores may need
+	PathStyle bool `mapstructure:"path_style"`
+	// AccessKeyID and SecretAccessKey default to AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY. For GCS they are an HMAC key.
+	AccessKeyID     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+	Frames          bool   `mapstructure:"frames"`  // copy frames too, not just videos
+	Workers         int    `mapstructure:"workers"` // concurrent uploads
+}
+
+// HLSConfig also packages each camera's consolidated videos as a rolling
+// HLS playlist of PlaylistSize segments of about SegmentDuration.
+type HLSConfig struct {
+	Enabled         bool          `mapstructure:"enabled"`
+	SegmentDuration time.Duration `mapstructure:"segment_duration"`
+	PlaylistSize    int           `mapstructure:"playlist_size"`
+	SegmentType     string        `mapstructure:"segment_type"` // "mpegts" or "fmp4"
+}
+
+// DedupConfig stores identical frames once, as hard links to a blob named
+// by their content hash. A camera whose frames are shared less than
+// MinRatio of the time goes back to plain files for a while.
+type DedupConfig struct {
+	Enabled  bool    `mapstructure:"enabled"`
+	MinRatio float64 `mapstructure:"min_ratio"` // 0 to 1
+}
+
+// ThrottleConfig limits how fast frames are written, so recording can share
+// a disk with other workloads. Zero leaves a limit off.
+type ThrottleConfig struct {
+	CameraMBPerSec float64 `mapstructure:"camera_mb_per_sec"` // each camera
+	GlobalMBPerSec float64 `mapstructure:"global_mb_per_sec"` // all cameras together
+}
+
+// RetentionConfig controls the periodic retention pass. Recordings older
+// than retention_hours are deleted; before that, each tier re-encodes
+// recordings older than After to a lower quality.
+type RetentionConfig struct {
+	Interval time.Duration   `mapstructure:"interval"`
+	Tiers    []RetentionTier `mapstructure:"tiers"`
+	// TrashGrace is how long recordings deleted through the API stay in
+	// the trash before they are purged
+	TrashGrace time.Duration `mapstructure:"trash_grace"`
+	// WORM is how long after they are written recordings can't be deleted,
+	// trashed or re-encoded, and their files stay read-only; 0 turns
+	// write-once storage off
+	WORM time.Duration `mapstructure:"worm"`
+}
+
+type RetentionTier struct {
+	After   time.Duration `mapstructure:"after"`
+	Height  int           `mapstructure:"height"`  // output height, 0 keeps the resolution
+	Bitrate int           `mapstructure:"bitrate"` // kbps, 0 lets the encoder choose
+}
+
+// FrameIndexConfig controls recording every stored frame in the index.
+// Frames are written in group commits of up to BatchSize, at least every
+// FlushInterval.
+type FrameIndexConfig struct {
+	Enabled       bool          `mapstructure:"enabled"`
+	BatchSize     int           `mapstructure:"batch_size"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+}
+
+// FrameCacheConfig keeps each camera's latest frames in memory for
+// scrubbing near live. A camera's ring holds Window of frames or CameraMB,
+// whichever fills first.
+type FrameCacheConfig struct {
+	Enabled  bool          `mapstructure:"enabled"`
+	Window   time.Duration `mapstructure:"window"`
+	CameraMB int           `mapstructure:"camera_mb"`
+}
+
+// ImportConfig controls how "cctvserver import" reads legacy footage.
+type ImportConfig struct {
+	Patterns []ImportPattern `mapstructure:"patterns"`
 }
 
+// ImportPattern matches a file's base name. The named group "camera" gives
+// the camera ID (the parent directory is used without it) and "time" the
+// start time, parsed with TimeLayout in local time.
+type ImportPattern struct {
+	Regex      string `mapstructure:"regex"`
+	TimeLayout string `mapstructure:"time_layout"`
+}
+
+type VideoConsolidationConfig struct {
+	Enabled         bool          `mapstructure:"enabled"`
+	Interval        time.Duration `mapstructure:"interval"`
+	MinFrames       int           `mapstructure:"min_frames"`
+	DeleteOriginals bool          `mapstructure:"delete_originals"`
+	// Codec is h264, h265, vp9 or av1, encoded as HWAccel allows, the
+	// name of an FFmpeg encoder, or "copy" to pass the camera's JPEGs
+	// through as MJPEG without transcoding. See package videocodec.
+	Codec string `mapstructure:"codec"`
+	// HWAccel is the hardware encoder to use: none, auto, nvenc, vaapi,
+	// videotoolbox or v4l2m2m. Whatever fails its probe at startup falls
+	// back to software.
+	HWAccel string `mapstructure:"hwaccel"`
+	// Device is the VAAPI render node, /dev/dri/renderD128 when empty
+	Device string `mapstructure:"device"`
+	// Width and Height are the size of consolidated videos. Frames of
+	// another size or aspect ratio are scaled to fit and letterboxed; zero
+	// uses the largest frame of each video, rounded up to even.
+	Width  int `mapstructure:"width"`
+	Height int `mapstructure:"height"`
+	// Pipe streams each camera's frames into an FFmpeg running for the
+	// length of a video, instead of reading batches of stored frames back
+	// and running FFmpeg on each. Only with it may save_frames be false.
+	Pipe bool `mapstructure:"pipe"`
+	// SegmentDuration, if set, records continuously in videos covering
+	// fixed spans of capture time, aligned to local midnight and named
+	// after their start, instead of min_frames frames each
+	SegmentDuration time.Duration `mapstructure:"segment_duration"`
+}
+
+// VideoCodecOptions returns what consolidated videos are to be encoded
+// with.
+func VideoCodecOptions(cfg *Config) videocodec.Options {
+	vc := cfg.Storage.VideoConsolidation
+	return videocodec.Options{Codec: vc.Codec, HWAccel: vc.HWAccel, Device: vc.Device, Bitrate: cfg.Stream.VideoBitrate}
+}
+
+// H264Options are the encoder options of videos that have to be H.264,
+// such as HLS segments, clips and the live stream: the configured encoder
+// if it makes H.264, otherwise H.264 with its hardware acceleration.
+func H264Options(cfg *Config) videocodec.Options {
+	return VideoCodecOptions(cfg).H264()
+}
+
+// validCameraID matches camera IDs that are safe as directory names.
+var validCameraID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// invalidIDChars matches what validCameraID rejects.
+var invalidIDChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
 func Load() (*Config, error) {
 	// Set default configuration values
 	setDefaults()
@@ -58,6 +749,12 @@ func Load() (*Config, error) {
 		}
 	}
 
+	// The profile only replaces defaults, so it has to be applied after the
+	// file that selects it has been read
+	if err := applyProfile(viper.GetString("profile")); err != nil {
+		return nil, err
+	}
+
 	var config Config
 	if err := viper.Unmarshal(&config); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
@@ -71,27 +768,92 @@ func Load() (*Config, error) {
 	return &config, nil
 }
 
+// File returns the configuration file read by Load, or "" when running on
+// defaults alone.
+func File() string {
+	return viper.ConfigFileUsed()
+}
+
 func setDefaults() {
 	// Server defaults
 	viper.SetDefault("log_level", "info")
+	viper.SetDefault("log.output_path", "logs/cctv.log")
+	viper.SetDefault("log.max_size", 100)
+	viper.SetDefault("log.max_backups", 3)
+	viper.SetDefault("log.max_age", 7)
+	viper.SetDefault("log.compress", true)
+	viper.SetDefault("watch_config", true)
 	viper.SetDefault("server.port", 8080)
 	viper.SetDefault("server.host", "localhost")
 	viper.SetDefault("server.signal_port", 8081)
 	viper.SetDefault("server.stream_port", 8082)
 
+	// Ingest connections are long-lived websockets, so only the handshake is
+	// bounded; read deadlines are managed per connection.
+	viper.SetDefault("server.ingest.read_header_timeout", "10s")
+	viper.SetDefault("server.ingest.idle_timeout", "120s")
+	viper.SetDefault("server.api.read_timeout", "30s")
+	viper.SetDefault("server.api.read_header_timeout", "10s")
+	viper.SetDefault("server.api.idle_timeout", "120s")
+	viper.SetDefault("server.websocket_buffer_size", 1024*1024) // 1MB
+	viper.SetDefault("server.protocol_versions", []int{wire.VersionJSON, wire.VersionBinary, wire.VersionCompressed})
+	viper.SetDefault("server.frame_encodings", []string{codec.JPEG, codec.WebP})
+	viper.SetDefault("server.feedback_interval", "1s")
+	viper.SetDefault("server.health.degraded_after", "10s")
+	viper.SetDefault("server.health.offline_after", "60s")
+
 	// Stream defaults
 	viper.SetDefault("stream.video_codec", "h264")
 	viper.SetDefault("stream.video_bitrate", 2000)
 	viper.SetDefault("stream.framerate", 30)
 	viper.SetDefault("stream.width", 1280)
 	viper.SetDefault("stream.height", 720)
+	viper.SetDefault("stream.rtsp.port", 8554)
+	viper.SetDefault("stream.webrtc.max_sessions", 16)
 
 	// Storage defaults
 	viper.SetDefault("storage.output_dir", "frames")
+	viper.SetDefault("storage.frame_layout", "dated")
 	viper.SetDefault("storage.save_frames", true)
 	viper.SetDefault("storage.max_frames", 1000)
 	viper.SetDefault("storage.max_disk_usage", 1024*1024*1024) // 1GB
 	viper.SetDefault("storage.retention_hours", 24)
+	viper.SetDefault("storage.buffer_size", 100)
+	viper.SetDefault("storage.video_consolidation.enabled", false)
+	viper.SetDefault("storage.video_consolidation.interval", "10s")
+	viper.SetDefault("storage.video_consolidation.codec", "libx264")
+	viper.SetDefault("storage.video_consolidation.hwaccel", "auto")
+	viper.SetDefault("storage.video_consolidation.pipe", false)
+	viper.SetDefault("storage.retention.interval", "1h")
+	viper.SetDefault("storage.retention.trash_grace", "72h")
+	viper.SetDefault("storage.export.keep", "24h")
+	viper.SetDefault("storage.frame_index.enabled", true)
+	viper.SetDefault("storage.frame_index.batch_size", 500)
+	viper.SetDefault("storage.frame_index.flush_interval", "1s")
+	viper.SetDefault("storage.frame_cache.window", "2m")
+	viper.SetDefault("storage.frame_cache.camera_mb", 32)
+	viper.SetDefault("storage.disk_monitor.interval", "10s")
+	viper.SetDefault("storage.dead_letter.enabled", true)
+	viper.SetDefault("storage.dead_letter.max_mb", 100)
+	viper.SetDefault("storage.dead_letter.keep", "168h")
+	viper.SetDefault("jobs.workers", 1)
+	viper.SetDefault("jobs.max_attempts", 3)
+	viper.SetDefault("processor.shards", 1)
+	viper.SetDefault("processor.jpeg_codec", "auto")
+	viper.SetDefault("cluster.frame_fps", 5)
+	viper.SetDefault("replication.chunk_mb", 8)
+	viper.SetDefault("replication.interval", "10m")
+	viper.SetDefault("onvif.discovery", true)
+	viper.SetDefault("chaos.enabled", false)
+	viper.SetDefault("server.body_limits.json_kb", 1024)
+	viper.SetDefault("server.body_limits.upload_mb", 256)
+	viper.SetDefault("server.body_limits.frame_mb", 32)
+	viper.SetDefault("server.limits.frame_rate_action", FrameRateDrop)
+	// Import understands this server's own file names out of the box
+	viper.SetDefault("storage.import.patterns", []map[string]interface{}{
+		{"regex": `^(?P<camera>.+)_(?P<time>\d{8}_\d{6})\.mp4$`, "time_layout": "20060102_150405"},
+		{"regex": `^frame_\d+_(?P<time>\d{8}_\d{6}\.\d{3})\.jpe?g$`, "time_layout": "20060102_150405.000"},
+	})
 }
 
 func validateConfig(cfg *Config) error {
@@ -105,6 +867,12 @@ func validateConfig(cfg *Config) error {
 	if !validLogLevels[cfg.LogLevel] {
 		cfg.LogLevel = "info" // Set default if invalid
 	}
+	if cfg.Log.OutputPath == "" {
+		cfg.Log.OutputPath = "logs/cctv.log"
+	}
+	if cfg.Log.MaxSize < 0 || cfg.Log.MaxBackups < 0 || cfg.Log.MaxAge < 0 {
+		return fmt.Errorf("log: max_size, max_backups and max_age must not be negative")
+	}
 
 	// Ensure valid server configuration
 	if cfg.Server.Port <= 0 {
@@ -113,6 +881,28 @@ func validateConfig(cfg *Config) error {
 	if cfg.Server.Host == "" {
 		cfg.Server.Host = "localhost"
 	}
+	if cfg.Server.SignalPort <= 0 {
+		cfg.Server.SignalPort = cfg.Server.Port
+	}
+	for name, l := range map[string]ListenerConfig{"ingest": cfg.Server.Ingest, "api": cfg.Server.API} {
+		ssl := l.SSL
+		if !ssl.Enabled {
+			ssl = cfg.Server.SSL
+		}
+		if ssl.Enabled && (ssl.CertFile == "" || ssl.KeyFile == "") {
+			return fmt.Errorf("%s listener: ssl enabled but cert_file/key_file not set", name)
+		}
+		if ssl.Enabled && ssl.ClientCAFile != "" {
+			if _, err := os.Stat(ssl.ClientCAFile); err != nil {
+				return fmt.Errorf("%s listener: client_ca_file: %w", name, err)
+			}
+		}
+		if l.SocketMode != "" {
+			if _, err := strconv.ParseUint(l.SocketMode, 8, 32); err != nil {
+				return fmt.Errorf("%s listener: invalid socket_mode %q: %w", name, l.SocketMode, err)
+			}
+		}
+	}
 
 	// Ensure valid stream configuration
 	if cfg.Stream.VideoBitrate <= 0 {
@@ -127,17 +917,283 @@ func validateConfig(cfg *Config) error {
 	if cfg.Stream.Height <= 0 {
 		cfg.Stream.Height = 720
 	}
+	if rtsp := cfg.Stream.RTSP; rtsp.Enabled && (rtsp.Port <= 0 || rtsp.Port > 65535) {
+		return fmt.Errorf("stream.rtsp: invalid port %d", rtsp.Port)
+	}
+	if rtc := cfg.Stream.WebRTC; (rtc.PortMin == 0) != (rtc.PortMax == 0) || rtc.PortMin > rtc.PortMax {
+		return fmt.Errorf("stream.webrtc: port_min and port_max must both be set, in order")
+	}
+	if cfg.Stream.WebRTC.MaxSessions < 0 {
+		return fmt.Errorf("stream.webrtc: max_sessions must not be negative")
+	}
 
 	// Ensure valid storage configuration
 	if cfg.Storage.OutputDir == "" {
 		cfg.Storage.OutputDir = "frames"
 	}
+	switch cfg.Storage.FrameLayout {
+	case "":
+		cfg.Storage.FrameLayout = "dated"
+	case "dated", "flat":
+	default:
+		return fmt.Errorf("storage.frame_layout must be \"dated\" or \"flat\", got %q", cfg.Storage.FrameLayout)
+	}
+	switch cfg.Storage.FrameMetadata {
+	case "", "sidecar", "embed":
+	default:
+		return fmt.Errorf("storage.frame_metadata must be \"sidecar\" or \"embed\", got %q", cfg.Storage.FrameMetadata)
+	}
+	if n := cfg.Storage.Naming; n.Frame != "" {
+		if _, err := naming.ParseFrame("storage.naming.frame", n.Frame); err != nil {
+			return err
+		}
+	}
+	for key, text := range map[string]string{
+		"storage.naming.video":  cfg.Storage.Naming.Video,
+		"storage.naming.export": cfg.Storage.Naming.Export,
+	} {
+		if text == "" {
+			continue
+		}
+		if _, err := naming.Parse(key, text); err != nil {
+			return err
+		}
+	}
 	if cfg.Storage.MaxFrames <= 0 {
 		cfg.Storage.MaxFrames = 1000
 	}
 	if cfg.Storage.RetentionHours <= 0 {
 		cfg.Storage.RetentionHours = 24
 	}
+	if cfg.Storage.BufferSize <= 0 {
+		cfg.Storage.BufferSize = 100
+	}
+	if cfg.Storage.IndexPath == "" {
+		cfg.Storage.IndexPath = filepath.Join(cfg.Storage.OutputDir, "index.db")
+	}
+	if cfg.Storage.DeadLetter.Dir == "" {
+		cfg.Storage.DeadLetter.Dir = filepath.Join(cfg.Storage.OutputDir, "dead-letter")
+	}
+	if cfg.Storage.DeadLetter.MaxMB < 0 || cfg.Storage.DeadLetter.Keep < 0 {
+		return fmt.Errorf("storage.dead_letter: max_mb and keep must not be negative")
+	}
+	if cfg.Storage.FrameIndex.BatchSize <= 0 {
+		cfg.Storage.FrameIndex.BatchSize = 500
+	}
+	if cfg.Storage.FrameIndex.FlushInterval <= 0 {
+		cfg.Storage.FrameIndex.FlushInterval = time.Second
+	}
+	if cfg.Storage.FrameCache.Window <= 0 {
+		cfg.Storage.FrameCache.Window = 2 * time.Minute
+	}
+	if cfg.Storage.FrameCache.CameraMB <= 0 {
+		cfg.Storage.FrameCache.CameraMB = 32
+	}
+	if dm := &cfg.Storage.DiskMonitor; dm.MinFreeMB < 0 || dm.MinFreePercent < 0 || dm.MinFreePercent >= 100 {
+		return fmt.Errorf("storage.disk_monitor: min_free_mb must not be negative, min_free_percent must be from 0 up to 100")
+	}
+	if cfg.Storage.DiskMonitor.Interval <= 0 {
+		cfg.Storage.DiskMonitor.Interval = 10 * time.Second
+	}
+	if err := validateWebhooks("storage.disk_monitor.webhooks", cfg.Storage.DiskMonitor.Webhooks); err != nil {
+		return err
+	}
+	if cfg.Storage.Dedup.MinRatio < 0 || cfg.Storage.Dedup.MinRatio > 1 {
+		return fmt.Errorf("storage.dedup.min_ratio must be between 0 and 1")
+	}
+	if cfg.Storage.Dedup.MinRatio == 0 {
+		cfg.Storage.Dedup.MinRatio = 0.1
+	}
+	if cfg.Storage.HLS.SegmentDuration <= 0 {
+		cfg.Storage.HLS.SegmentDuration = 4 * time.Second
+	}
+	if cfg.Storage.HLS.PlaylistSize <= 0 {
+		cfg.Storage.HLS.PlaylistSize = 15
+	}
+	switch cfg.Storage.HLS.SegmentType {
+	case "":
+		cfg.Storage.HLS.SegmentType = "mpegts"
+	case "mpegts", "fmp4":
+	default:
+		return fmt.Errorf("storage.hls.segment_type must be \"mpegts\" or \"fmp4\", got %q", cfg.Storage.HLS.SegmentType)
+	}
+	if err := validateBackend(&cfg.Storage.Backend); err != nil {
+		return err
+	}
+	if err := validateExport(&cfg.Storage.Export); err != nil {
+		return err
+	}
+	if cfg.Storage.VideoConsolidation.Interval <= 0 {
+		cfg.Storage.VideoConsolidation.Interval = 10 * time.Second
+	}
+	if cfg.Storage.VideoConsolidation.Codec == "" {
+		cfg.Storage.VideoConsolidation.Codec = videocodec.Fallback
+	}
+	if err := VideoCodecOptions(cfg).Validate(); err != nil {
+		return fmt.Errorf("storage.video_consolidation: %w", err)
+	}
+	if err := validateVideoSize(cfg.Storage.VideoConsolidation.Width, cfg.Storage.VideoConsolidation.Height); err != nil {
+		return fmt.Errorf("storage.video_consolidation: %w", err)
+	}
+	if d := cfg.Storage.VideoConsolidation.SegmentDuration; d < 0 || (d > 0 && (d < time.Second || (24*time.Hour)%d != 0)) {
+		return fmt.Errorf("storage.video_consolidation.segment_duration must divide a day into spans of at least a second, got %s", d)
+	}
+	// Batch consolidation reads stored frames back, so only pipe can do without
+	if vc := cfg.Storage.VideoConsolidation; !cfg.Storage.SaveFrames && !(vc.Enabled && vc.Pipe) {
+		return fmt.Errorf("storage.save_frames can only be false with video_consolidation enabled and pipe set")
+	}
+	if cfg.Server.WebsocketBufferSize <= 0 {
+		cfg.Server.WebsocketBufferSize = 1024 * 1024
+	}
+	if len(cfg.Server.ProtocolVersions) == 0 {
+		return fmt.Errorf("server.protocol_versions must accept at least one version")
+	}
+	for _, v := range cfg.Server.ProtocolVersions {
+		if v < 1 || v > wire.LatestVersion {
+			return fmt.Errorf("server.protocol_versions: unknown version %d, expected 1 to %d", v, wire.LatestVersion)
+		}
+	}
+	if !slices.Contains(cfg.Server.FrameEncodings, codec.JPEG) {
+		return fmt.Errorf("server.frame_encodings must include %s", codec.JPEG)
+	}
+	for _, e := range cfg.Server.FrameEncodings {
+		if e != codec.JPEG && e != codec.WebP {
+			return fmt.Errorf("server.frame_encodings: unknown encoding %q, expected %s or %s", e, codec.JPEG, codec.WebP)
+		}
+	}
+	if cfg.Server.FeedbackInterval < 0 {
+		return fmt.Errorf("server.feedback_interval must not be negative")
+	}
+
+	// Retention tiers apply in order of age and must fall inside retention
+	retention := cfg.Storage.Retention
+	if retention.Interval <= 0 {
+		cfg.Storage.Retention.Interval = time.Hour
+	}
+	if retention.TrashGrace <= 0 {
+		cfg.Storage.Retention.TrashGrace = 72 * time.Hour
+	}
+	sort.Slice(retention.Tiers, func(i, j int) bool {
+		return retention.Tiers[i].After < retention.Tiers[j].After
+	})
+	maxAge := time.Duration(cfg.Storage.RetentionHours) * time.Hour
+	if retention.WORM < 0 || retention.WORM > maxAge {
+		return fmt.Errorf("storage.retention.worm must be between 0 and retention_hours, got %s", retention.WORM)
+	}
+	for _, tier := range retention.Tiers {
+		if tier.After <= 0 || tier.After >= maxAge {
+			return fmt.Errorf("retention tier after %s must be between 0 and retention_hours", tier.After)
+		}
+		if tier.After < retention.WORM {
+			return fmt.Errorf("retention tier after %s would re-encode recordings still within storage.retention.worm", tier.After)
+		}
+		if tier.Height < 0 || tier.Bitrate < 0 || (tier.Height == 0 && tier.Bitrate == 0) {
+			return fmt.Errorf("retention tier after %s needs a height or bitrate", tier.After)
+		}
+		if tier.Height%2 != 0 {
+			return fmt.Errorf("retention tier after %s: height must be even, got %d", tier.After, tier.Height)
+		}
+	}
+
+	if cfg.Storage.MaxDiskUsage < 0 {
+		return fmt.Errorf("storage.max_disk_usage can't be negative")
+	}
+	if cfg.Storage.Throttle.CameraMBPerSec < 0 || cfg.Storage.Throttle.GlobalMBPerSec < 0 {
+		return fmt.Errorf("storage throttle limits can't be negative")
+	}
+
+	if cfg.Jobs.Workers <= 0 {
+		cfg.Jobs.Workers = 1
+	}
+	if cfg.Jobs.MaxAttempts <= 0 {
+		cfg.Jobs.MaxAttempts = 3
+	}
+	if cfg.Processor.Shards <= 0 {
+		cfg.Processor.Shards = 1
+	}
+	for _, proxy := range cfg.Server.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				return fmt.Errorf("server.trusted_proxies: %q is not an IP address or CIDR", proxy)
+			}
+		}
+	}
+	if err := validateRateLimits(cfg.Server.RateLimits); err != nil {
+		return err
+	}
+	if l := cfg.Server.BodyLimits; l.JSONKB <= 0 || l.UploadMB <= 0 || l.FrameMB <= 0 {
+		return fmt.Errorf("server.body_limits must all be above 0")
+	}
+	limits := cfg.Server.Limits
+	if limits.MaxConnections < 0 || limits.MaxConnectionsPerIP < 0 || limits.MaxFPS < 0 {
+		return fmt.Errorf("server.limits can't be negative")
+	}
+	if limits.FrameRateAction != FrameRateDrop && limits.FrameRateAction != FrameRateDisconnect {
+		return fmt.Errorf("server.limits.frame_rate_action must be %q or %q", FrameRateDrop, FrameRateDisconnect)
+	}
+	for i, p := range limits.Cameras {
+		field := fmt.Sprintf("server.limits.cameras[%d]", i)
+		if p.MaxFPS < 0 || p.MaxWidth < 0 || p.MaxHeight < 0 {
+			return fmt.Errorf("%s: limits can't be negative", field)
+		}
+		switch p.ResolutionAction {
+		case "", ResolutionDownscale, ResolutionDrop:
+		default:
+			return fmt.Errorf("%s.resolution_action must be %q or %q", field, ResolutionDownscale, ResolutionDrop)
+		}
+	}
+	if h := cfg.Server.Health; h.DegradedAfter <= 0 || h.OfflineAfter <= h.DegradedAfter {
+		return fmt.Errorf("server.health: degraded_after must be above 0, and offline_after longer")
+	}
+	if err := validateWebhooks("server.health.webhooks", cfg.Server.Health.Webhooks); err != nil {
+		return err
+	}
+	if cfg.Processor.Workers <= 0 {
+		cfg.Processor.Workers = runtime.NumCPU()
+	}
+	for i, st := range cfg.Processor.Stages {
+		if st.Name == "" {
+			return fmt.Errorf("processor.stages[%d]: name is required", i)
+		}
+	}
+	if err := validateSources(&cfg.Sources); err != nil {
+		return err
+	}
+	if cfg.Site != "" && !validCameraID.MatchString(cfg.Site) {
+		return fmt.Errorf("site must be letters, digits, '-' and '_', got %q", cfg.Site)
+	}
+	if cfg.Replication.Origin == "" {
+		cfg.Replication.Origin = cfg.Site
+	}
+	if err := validateReplication(&cfg.Replication); err != nil {
+		return err
+	}
+	if err := validateAggregator(&cfg.Aggregator); err != nil {
+		return err
+	}
+	if cfg.Cluster.Node == "" {
+		cfg.Cluster.Node = cfg.Site
+	}
+	if err := validateCluster(&cfg.Cluster); err != nil {
+		return err
+	}
+	if cfg.Motion.Interval <= 0 {
+		cfg.Motion.Interval = time.Second
+	}
+	if err := validateObjects(&cfg.Objects); err != nil {
+		return err
+	}
+	for i, m := range cfg.Privacy.Masks {
+		if err := m.Validate(); err != nil {
+			return fmt.Errorf("privacy.masks[%d]: %w", i, err)
+		}
+	}
+	if err := validateSchedules(&cfg.Schedules); err != nil {
+		return err
+	}
+	if err := validateONVIF(cfg); err != nil {
+		return err
+	}
 
 	// Create required directories
 	dirs := []string{
@@ -154,3 +1210,410 @@ func validateConfig(cfg *Config) error {
 
 	return nil
 }
+
+// validateWebhooks checks that the webhooks under key are http(s) URLs.
+func validateWebhooks(key string, hooks []string) error {
+	for _, hook := range hooks {
+		if u, err := url.Parse(hook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s: %q is not an http(s) URL", key, hook)
+		}
+	}
+	return nil
+}
+
+// validateRateLimits checks the rate limit policies and fills in their
+// defaults.
+func validateRateLimits(policies []RateLimitPolicy) error {
+	for i := range policies {
+		p := &policies[i]
+		field := fmt.Sprintf("server.rate_limits[%d]", i)
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("policy-%d", i+1)
+		}
+		if p.Rate <= 0 {
+			return fmt.Errorf("%s: rate must be above 0", field)
+		}
+		if p.Burst <= 0 {
+			p.Burst = int(math.Ceil(p.Rate))
+		}
+		switch p.Key {
+		case "":
+			p.Key = "ip"
+		case "ip", "token":
+		default:
+			return fmt.Errorf("%s: key must be ip or token, got %q", field, p.Key)
+		}
+		if len(p.Routes) == 0 {
+			return fmt.Errorf("%s: routes is empty", field)
+		}
+		for _, route := range p.Routes {
+			if !strings.HasPrefix(route, "/") && !strings.Contains(route, " /") {
+				return fmt.Errorf("%s: route %q must be a path, optionally after a method", field, route)
+			}
+		}
+	}
+	return nil
+}
+
+// validateSources checks the pulled cameras and fills in their defaults.
+func validateSources(cfg *SourcesConfig) error {
+	ids := make(map[string]bool)
+	for i := range cfg.RTSP {
+		src := &cfg.RTSP[i]
+		if !validCameraID.MatchString(src.ID) {
+			return fmt.Errorf("sources.rtsp[%d]: id must be letters, digits, '-' and '_', got %q", i, src.ID)
+		}
+		if ids[src.ID] {
+			return fmt.Errorf("sources.rtsp: duplicate id %q", src.ID)
+		}
+		ids[src.ID] = true
+
+		u, err := url.Parse(src.URL)
+		if err != nil || (u.Scheme != "rtsp" && u.Scheme != "rtsps") || u.Host == "" {
+			return fmt.Errorf("sources.rtsp %s: url must be rtsp:// or rtsps://", src.ID)
+		}
+		if src.FPS <= 0 {
+			src.FPS = 10
+		}
+		switch src.Transport {
+		case "":
+			src.Transport = "tcp"
+		case "tcp", "udp":
+		default:
+			return fmt.Errorf("sources.rtsp %s: transport must be \"tcp\" or \"udp\", got %q", src.ID, src.Transport)
+		}
+		if src.Quality == 0 {
+			src.Quality = 5
+		}
+		if src.Quality < 2 || src.Quality > 31 {
+			return fmt.Errorf("sources.rtsp %s: quality must be between 2 and 31", src.ID)
+		}
+	}
+	return nil
+}
+
+// validateAggregator checks the nodes and fills in the aggregator defaults.
+func validateAggregator(cfg *AggregatorConfig) error {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 30 * time.Second
+	}
+	seen := make(map[string]bool)
+	for i, node := range cfg.Nodes {
+		if !validCameraID.MatchString(node.Name) {
+			return fmt.Errorf("aggregator.nodes[%d]: name must be letters, digits, '-' and '_', got %q", i, node.Name)
+		}
+		if seen[node.Name] {
+			return fmt.Errorf("aggregator.nodes[%d]: duplicate name %q", i, node.Name)
+		}
+		seen[node.Name] = true
+		u, err := url.Parse(node.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("aggregator.nodes[%d]: url must be an http:// or https:// URL", i)
+		}
+	}
+	return nil
+}
+
+// validateCluster checks the Redis URL and fills in the cluster defaults.
+func validateCluster(cfg *ClusterConfig) error {
+	if cfg.Redis == "" {
+		return nil
+	}
+	u, err := url.Parse(cfg.Redis)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+		return fmt.Errorf("cluster.redis must be a redis:// or rediss:// URL")
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if _, err := strconv.Atoi(db); err != nil {
+			return fmt.Errorf("cluster.redis: database must be a number, got %q", db)
+		}
+	}
+	if cfg.Node == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			host = "node"
+		}
+		cfg.Node = invalidIDChars.ReplaceAllString(host, "-")
+	}
+	if !validCameraID.MatchString(cfg.Node) {
+		return fmt.Errorf("cluster.node must be letters, digits, '-' and '_', got %q", cfg.Node)
+	}
+	if cfg.URL != "" {
+		if u, err := url.Parse(cfg.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("cluster.url must be an http:// or https:// URL")
+		}
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "cctv"
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 5 * time.Second
+	}
+	if cfg.FrameFPS < 0 {
+		return fmt.Errorf("cluster.frame_fps can't be negative")
+	}
+	return nil
+}
+
+func validateONVIF(cfg *Config) error {
+	o := &cfg.ONVIF
+	if !o.Enabled {
+		return nil
+	}
+	if o.Address != "" {
+		if _, _, err := net.SplitHostPort(o.Address); err != nil {
+			return fmt.Errorf("onvif.address must be host:port: %w", err)
+		}
+	} else if o.Discovery && cfg.Server.API.Socket != "" {
+		return fmt.Errorf("onvif.address is required for discovery while the API listens on a unix socket")
+	}
+	if o.Username == "" && o.Password != "" {
+		return fmt.Errorf("onvif.password is set without onvif.username")
+	}
+	return nil
+}
+
+func validateObjects(o *ObjectsConfig) error {
+	if !o.Detection {
+		return nil
+	}
+	if o.Detector == "" {
+		o.Detector = "onnx"
+	}
+	if o.Model == "" {
+		return fmt.Errorf("objects.model is required for object detection")
+	}
+	if o.InputSize == 0 {
+		o.InputSize = 640
+	}
+	if o.InputSize < 32 || o.InputSize%32 != 0 {
+		return fmt.Errorf("objects.input_size must be a multiple of 32, got %d", o.InputSize)
+	}
+	if o.MinScore == 0 {
+		o.MinScore = 0.5
+	}
+	if o.MinScore < 0 || o.MinScore > 1 {
+		return fmt.Errorf("objects.min_score must be between 0 and 1, got %g", o.MinScore)
+	}
+	if o.Interval <= 0 {
+		o.Interval = time.Second
+	}
+	if o.Cooldown < 0 {
+		return fmt.Errorf("objects.cooldown can't be negative")
+	}
+	if o.Threads < 0 {
+		return fmt.Errorf("objects.threads can't be negative")
+	}
+	return nil
+}
+
+// Things a schedule can pause and the days of schedule windows
+var (
+	schedulePauses = map[string]bool{"recording": true, "alerts": true}
+	scheduleDays   = map[string]bool{"mon": true, "tue": true, "wed": true, "thu": true, "fri": true, "sat": true, "sun": true}
+)
+
+func validateSchedules(cfg *SchedulesConfig) error {
+	if cfg.Refresh <= 0 {
+		cfg.Refresh = 15 * time.Minute
+	}
+	if _, err := time.LoadLocation(cfg.Timezone); err != nil {
+		return fmt.Errorf("schedules.timezone: %w", err)
+	}
+	validPause := func(field string, pause []string) error {
+		if len(pause) == 0 {
+			return fmt.Errorf("%s.pause must list recording and/or alerts", field)
+		}
+		for _, p := range pause {
+			if !schedulePauses[p] {
+				return fmt.Errorf("%s.pause: unknown %q, want recording or alerts", field, p)
+			}
+		}
+		return nil
+	}
+
+	for i := range cfg.Windows {
+		w := &cfg.Windows[i]
+		field := fmt.Sprintf("schedules.windows[%d]", i)
+		if err := validPause(field, w.Pause); err != nil {
+			return err
+		}
+		for j, day := range w.Days {
+			w.Days[j] = strings.ToLower(day)
+			if !scheduleDays[w.Days[j]] {
+				return fmt.Errorf("%s.days: unknown day %q", field, day)
+			}
+		}
+		start, err := time.Parse("15:04", w.Start)
+		if err != nil {
+			return fmt.Errorf("%s.start must be HH:MM", field)
+		}
+		end, err := time.Parse("15:04", w.End)
+		if err != nil {
+			return fmt.Errorf("%s.end must be HH:MM", field)
+		}
+		if start.Equal(end) {
+			return fmt.Errorf("%s: start and end are the same", field)
+		}
+		if w.Name == "" {
+			w.Name = fmt.Sprintf("window-%d", i+1)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i := range cfg.Calendars {
+		cal := &cfg.Calendars[i]
+		field := fmt.Sprintf("schedules.calendars[%d]", i)
+		if !validCameraID.MatchString(cal.Name) {
+			return fmt.Errorf("%s: name must be letters, digits, '-' and '_', got %q", field, cal.Name)
+		}
+		if seen[cal.Name] {
+			return fmt.Errorf("%s: duplicate name %q", field, cal.Name)
+		}
+		seen[cal.Name] = true
+		if err := validPause(field, cal.Pause); err != nil {
+			return err
+		}
+		// webcal:// is how calendar apps link to feeds served over HTTPS
+		if rest, ok := strings.CutPrefix(cal.URL, "webcal://"); ok {
+			cal.URL = "https://" + rest
+		}
+		u, err := url.Parse(cal.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s: url must be an http://, https:// or webcal:// URL", field)
+		}
+	}
+	return nil
+}
+
+// validateBackend checks the storage backend and fills in its defaults.
+func validateBackend(cfg *BackendConfig) error {
+	switch cfg.Type {
+	case "":
+		cfg.Type = "local"
+	case "local":
+	case "s3", "gcs":
+		if cfg.Bucket == "" {
+			return fmt.Errorf("storage.backend.bucket is required for %s", cfg.Type)
+		}
+		if cfg.Endpoint != "" {
+			if u, err := url.Parse(cfg.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("storage.backend.endpoint must be an http:// or https:// URL")
+			}
+		}
+	default:
+		return fmt.Errorf("storage.backend.type must be \"local\", \"s3\" or \"gcs\", got %q", cfg.Type)
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+		if cfg.Type == "gcs" {
+			cfg.Region = "auto"
+		}
+	}
+	if cfg.AccessKeyID == "" {
+		cfg.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if cfg.SecretAccessKey == "" {
+		cfg.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if cfg.Type != "local" && (cfg.AccessKeyID == "" || cfg.SecretAccessKey == "") {
+		return fmt.Errorf("storage.backend needs access_key_id and secret_access_key for %s", cfg.Type)
+	}
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+	if cfg.Workers <= 0 {
+		cfg.Workers = 4
+	}
+	return nil
+}
+
+var (
+	validExportName      = regexp.MustCompile(`^[a-z0-9_-]+$`)
+	validExportExtension = regexp.MustCompile(`^[a-z0-9]+$`)
+)
+
+// validateExport adds the built-in formats the configuration doesn't
+// replace and checks every template, so a broken one is found at startup
+// rather than by the first export.
+func validateExport(cfg *ExportConfig) error {
+	if cfg.Keep <= 0 {
+		cfg.Keep = 24 * time.Hour
+	}
+	if cfg.Formats == nil {
+		cfg.Formats = make(map[string]ExportFormat)
+	}
+	for name, f := range defaultExportFormats {
+		if _, ok := cfg.Formats[name]; !ok {
+			cfg.Formats[name] = f
+		}
+	}
+	for name, f := range cfg.Formats {
+		if !validExportName.MatchString(name) {
+			return fmt.Errorf("storage.export.formats: invalid format name %q", name)
+		}
+		if !validExportExtension.MatchString(f.Extension) {
+			return fmt.Errorf("storage.export.formats.%s: invalid extension %q", name, f.Extension)
+		}
+		if len(f.Args) == 0 {
+			return fmt.Errorf("storage.export.formats.%s: args must be set", name)
+		}
+		for _, arg := range f.Args {
+			switch arg {
+			case "":
+				return fmt.Errorf("storage.export.formats.%s: empty argument", name)
+			case "-i", "-y", "-n":
+				// The input and overwriting are up to the server
+				return fmt.Errorf("storage.export.formats.%s: %s is not allowed", name, arg)
+			}
+		}
+	}
+	return nil
+}
+
+// validateVideoSize checks an encoded video size, where zero for both means
+// the frames' own. H.264 in yuv420p needs even dimensions.
+func validateVideoSize(width, height int) error {
+	switch {
+	case width == 0 && height == 0:
+		return nil
+	case width <= 0 || height <= 0:
+		return fmt.Errorf("width and height must both be set, got %dx%d", width, height)
+	case width%2 != 0 || height%2 != 0:
+		return fmt.Errorf("width and height must be even, got %dx%d", width, height)
+	}
+	return nil
+}
+
+// validateReplication checks the peer and fills in the replication defaults.
+func validateReplication(cfg *ReplicationConfig) error {
+	if cfg.ChunkMB <= 0 {
+		cfg.ChunkMB = 8
+	}
+	if cfg.ChunkMB > 256 {
+		return fmt.Errorf("replication.chunk_mb must be at most 256")
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Minute
+	}
+	if cfg.Origin == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			host = "origin"
+		}
+		cfg.Origin = invalidIDChars.ReplaceAllString(host, "-")
+	}
+	if !validCameraID.MatchString(cfg.Origin) {
+		return fmt.Errorf("replication.origin must be letters, digits, '-' and '_', got %q", cfg.Origin)
+	}
+
+	if cfg.Peer == "" {
+		return nil
+	}
+	u, err := url.Parse(cfg.Peer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("replication.peer must be an http:// or https:// URL")
+	}
+	if cfg.Token == "" {
+		return fmt.Errorf("replication.token is required with a peer")
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// Profiles are presets layered over the built-in defaults. Anything set
+// explicitly in config.yaml still takes precedence.
+var profiles = map[string]func(){
+	"":         func() {},
+	"default":  func() {},
+	"lowpower": applyLowPowerProfile,
+}
+
+func applyProfile(name string) error {
+	apply, ok := profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+	apply()
+	return nil
+}
+
+// applyLowPowerProfile targets single-board computers such as the Raspberry
+// Pi: small buffers, infrequent consolidation and no software H.264 encoding.
+func applyLowPowerProfile() {
+	viper.SetDefault("server.websocket_buffer_size", 256*1024)
+	viper.SetDefault("storage.buffer_size", 30)
+	// SD cards gain nothing from parallel writes
+	viper.SetDefault("processor.workers", 1)
+
+	// Camera frames are already JPEG, so store them as MJPEG instead of
+	// transcoding every batch on a weak CPU
+	viper.SetDefault("storage.video_consolidation.interval", "30m")
+	viper.SetDefault("storage.video_consolidation.codec", "copy")
+	// What has to be H.264, such as retention transcodes, uses the
+	// Raspberry Pi's bcm2835-codec where there is one
+	viper.SetDefault("storage.video_consolidation.hwaccel", "v4l2m2m")
+
+	// Fewer, larger index commits spare the SD card
+	viper.SetDefault("storage.frame_index.flush_interval", "10s")
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long the configuration file has to stay unchanged
+// before Watch reports it, since editors write a file in several steps.
+const watchDebounce = 500 * time.Millisecond
+
+// Watch calls changed whenever the configuration file read by Load is
+// written, until ctx is cancelled. The file's directory is watched rather
+// than the file, so files replaced by renaming, as editors and config
+// management do, keep being watched. Without a configuration file it
+// returns right away.
+func Watch(ctx context.Context, changed func()) error {
+	file := File()
+	if file == "" {
+		return nil
+	}
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if err := w.Add(filepath.Dir(file)); err != nil {
+		return err
+	}
+
+	settle := time.NewTimer(watchDebounce)
+	settle.Stop()
+	defer settle.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(ev.Name) == file && ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				settle.Reset(watchDebounce)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			return err
+		case <-settle.C:
+			changed()
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// Package detect runs motion detection on the frames cameras deliver. A
+// frame of each camera is sampled every interval and compared with the
+// previous sample under the camera's motion settings; motion that counts,
+// outside the camera's cooldown, becomes a MotionEvent for the hooks.
+// Successive frames are too close together to show movement, and decoding
+// every frame would cost more than storing it, hence the sampling.
+package detect
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/motion"
+	"github.com/raeeceip/cctv/internal/processor"
+	"github.com/raeeceip/cctv/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// queueSize bounds the samples waiting to be compared. Samples beyond it
+// are skipped, which only delays detection by an interval.
+const queueSize = 64
+
+// MotionEvent is motion detected in a camera's frames.
+type MotionEvent struct {
+	CameraID string    `json:"camera_id"`
+	Time     time.Time `json:"time"` // when the frame was taken
+	// Box bounds the moving regions, normalized to the frame size
+	Box motion.Box `json:"box"`
+	// Intensity is how strongly those regions changed, from 0 to 1
+	Intensity float64 `json:"intensity"`
+	// Zone names the motion zone the box overlaps most, if any
+	Zone string `json:"zone,omitempty"`
+	// Frame is where the frame is stored
+	Frame string `json:"-"`
+}
+
+// SettingsFunc returns the motion settings of a camera.
+type SettingsFunc func(ctx context.Context, cameraID string) (motion.Settings, error)
+
+type sample struct {
+	cameraID string
+	time     time.Time
+	path     string
+	data     []byte
+}
+
+type camera struct {
+	sampledAt time.Time
+	prev      *motion.Gray
+	settings  *motion.Settings // nil until loaded
+	lastEvent time.Time
+}
+
+// Detector samples frames and detects motion in them.
+type Detector struct {
+	interval time.Duration
+	settings SettingsFunc
+	logger   *logger.Logger
+	queue    chan sample
+	onMotion []func(MotionEvent)
+
+	mu      sync.Mutex
+	cameras map[string]*camera
+}
+
+// New returns a detector sampling each camera every interval, with the
+// settings returned by settings.
+func New(interval time.Duration, settings SettingsFunc, log *logger.Logger) *Detector {
+	return &Detector{
+		interval: interval,
+		settings: settings,
+		logger:   log,
+		queue:    make(chan sample, queueSize),
+		cameras:  make(map[string]*camera),
+	}
+}
+
+// OnMotion registers fn to be called for each motion event. Register hooks
+// before Run.
+func (d *Detector) OnMotion(fn func(MotionEvent)) {
+	d.onMotion = append(d.onMotion, fn)
+}
+
+// Observe offers a stored frame for sampling without blocking. It copies
+// the data of the frames it samples.
+func (d *Detector) Observe(f processor.FrameData) {
+	if !d.due(f) {
+		return
+	}
+
+	select {
+	case d.queue <- sample{cameraID: f.CameraID, time: f.Timestamp, path: f.Path, data: append([]byte(nil), f.Data...)}:
+	default:
+		d.logger.Debug("Motion detection behind, skipped sample", zap.String("camera", f.CameraID))
+	}
+}
+
+// Detect samples a frame like Observe, but compares it before returning
+// rather than queueing it, so frames replayed from storage are all
+// sampled however fast they are read. Don't mix it with Observe for a
+// camera.
+func (d *Detector) Detect(ctx context.Context, f processor.FrameData) {
+	if d.due(f) {
+		d.detect(ctx, sample{cameraID: f.CameraID, time: f.Timestamp, path: f.Path, data: f.Data})
+	}
+}
+
+// due reports whether a frame is to be sampled, a camera's frames being
+// sampled an interval apart.
+func (d *Detector) due(f processor.FrameData) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cam, ok := d.cameras[f.CameraID]
+	if !ok {
+		cam = &camera{}
+		d.cameras[f.CameraID] = cam
+	}
+	due := f.Timestamp.Sub(cam.sampledAt) >= d.interval || f.Timestamp.Before(cam.sampledAt)
+	if due {
+		cam.sampledAt = f.Timestamp
+	}
+	return due
+}
+
+// Invalidate makes the detector reload a camera's settings, e.g. after they
+// were saved.
+func (d *Detector) Invalidate(cameraID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if cam, ok := d.cameras[cameraID]; ok {
+		cam.settings = nil
+	}
+}
+
+// Remove forgets a camera, e.g. once it disconnects.
+func (d *Detector) Remove(cameraID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.cameras, cameraID)
+}
+
+// Run compares the samples until ctx is cancelled.
+func (d *Detector) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case s := <-d.queue:
+			d.detect(ctx, s)
+		}
+	}
+}
+
+func (d *Detector) detect(ctx context.Context, s sample) {
+	d.mu.Lock()
+	cam, ok := d.cameras[s.cameraID]
+	if !ok {
+		// Removed since it was sampled
+		d.mu.Unlock()
+		return
+	}
+	settings := cam.settings
+	prev := cam.prev
+	d.mu.Unlock()
+
+	if settings == nil {
+		loaded, err := d.settings(ctx, s.cameraID)
+		if err != nil {
+			d.logger.Warn("Failed to load motion settings",
+				zap.String("camera", s.cameraID),
+				zap.Error(err))
+			return
+		}
+		settings = &loaded
+	}
+
+	var gray *motion.Gray
+	if settings.Enabled {
+		var err error
+		if _, gray, err = motion.DecodeGray(s.data); err != nil {
+			d.logger.Debug("Skipped sample for motion detection",
+				zap.String("camera", s.cameraID),
+				zap.Error(err))
+			return
+		}
+	}
+
+	var event *MotionEvent
+	d.mu.Lock()
+	if cam, ok = d.cameras[s.cameraID]; ok {
+		if cam.settings == nil {
+			cam.settings = settings
+		}
+		cam.prev = gray
+		if prev != nil && gray != nil {
+			// A resolution change just starts the comparison over
+			res, err := motion.Detect(prev, gray, *settings)
+			cooldown := time.Duration(settings.CooldownSeconds) * time.Second
+			if err == nil && res.Motion && s.time.Sub(cam.lastEvent) >= cooldown {
+				cam.lastEvent = s.time
+				event = &MotionEvent{
+					CameraID:  s.cameraID,
+					Time:      s.time,
+					Box:       res.Box,
+					Intensity: res.Intensity,
+					Zone:      settings.ZoneOf(res.Box),
+					Frame:     s.path,
+				}
+			}
+		}
+	}
+	d.mu.Unlock()
+
+	if event != nil {
+		for _, fn := range d.onMotion {
+			fn(*event)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// Package diskspace watches the free space of the volume frames are stored
+// on. Below a low-water mark frames stop being stored, so recordings never
+// fill the disk; storing resumes once the space is back above the mark by
+// a margin, so it doesn't flap around it. Crossing the mark either way is
+// logged and announced to hooks and webhooks.
+package diskspace
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/events"
+	"github.com/raeeceip/cctv/internal/webhook"
+	"github.com/raeeceip/cctv/pkg/logger"
+	"github.com/raeeceip/cctv/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// resumeMargin is how far above the low-water mark, as a fraction of it,
+// free space has to be for frames to be stored again.
+const resumeMargin = 0.1
+
+// Usage is the space of a volume.
+type Usage struct {
+	FreeBytes  uint64 `json:"free_bytes"`
+	TotalBytes uint64 `json:"total_bytes"`
+}
+
+// Status is the last check of the volume.
+type Status struct {
+	Path string `json:"path"`
+	Usage
+	LowWaterBytes uint64 `json:"low_water_bytes"`
+	// Low is whether frames are not being stored
+	Low bool `json:"low"`
+	// Since is when Low last changed, zero if it hasn't
+	Since   time.Time `json:"since,omitempty"`
+	Checked time.Time `json:"checked"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Monitor checks the free space of a directory's volume.
+type Monitor struct {
+	dir     string
+	logger  *logger.Logger
+	metrics *metrics.DiskMetrics
+	low     atomic.Bool
+
+	mu       sync.Mutex
+	cfg      config.DiskMonitorConfig
+	status   Status
+	onChange []func(events.Event)
+}
+
+// New returns a monitor of the volume holding dir, checking it once Run.
+func New(cfg config.DiskMonitorConfig, dir string, log *logger.Logger) *Monitor {
+	return &Monitor{
+		dir:     dir,
+		logger:  log,
+		metrics: metrics.NewDiskMetrics(),
+		cfg:     cfg,
+		status:  Status{Path: dir},
+	}
+}
+
+// Apply replaces the low-water mark, interval and webhooks with those of
+// a reloaded configuration; the mark applies from the next check.
+func (m *Monitor) Apply(cfg config.DiskMonitorConfig) {
+	m.mu.Lock()
+	m.cfg = cfg
+	m.mu.Unlock()
+}
+
+// OnChange registers fn to be called with a disk.low or disk.recovered
+// event when free space crosses the low-water mark. Register hooks before
+// Run.
+func (m *Monitor) OnChange(fn func(events.Event)) {
+	m.onChange = append(m.onChange, fn)
+}
+
+// Writable reports whether frames may be stored, counting those that may
+// not as dropped.
+func (m *Monitor) Writable() bool {
+	if m.low.Load() {
+		m.metrics.Dropped.Inc()
+		return false
+	}
+	return true
+}
+
+// Status returns the last check.
+func (m *Monitor) Status() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// Run checks the volume at once and then every interval until ctx is
+// cancelled.
+func (m *Monitor) Run(ctx context.Context) {
+	for {
+		m.check(ctx)
+
+		m.mu.Lock()
+		interval := m.cfg.Interval
+		m.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// check measures the volume and moves across the low-water mark if free
+// space calls for it. A volume that can't be measured keeps its state.
+func (m *Monitor) check(ctx context.Context) {
+	u, err := usage(m.dir)
+
+	m.mu.Lock()
+	cfg := m.cfg
+	st := &m.status
+	st.Checked = time.Now()
+	if err != nil {
+		st.Error = err.Error()
+		m.mu.Unlock()
+		m.logger.Error("Failed to check free disk space", zap.String("path", m.dir), zap.Error(err))
+		return
+	}
+	st.Error = ""
+	st.Usage = u
+	st.LowWaterBytes = lowWater(cfg, u.TotalBytes)
+	changed := false
+	switch {
+	case !st.Low && u.FreeBytes < st.LowWaterBytes:
+		st.Low, changed = true, true
+	case st.Low && float64(u.FreeBytes) >= float64(st.LowWaterBytes)*(1+resumeMargin):
+		st.Low, changed = false, true
+	}
+	if changed {
+		st.Since = st.Checked
+		m.low.Store(st.Low)
+	}
+	snapshot := *st
+	m.mu.Unlock()
+
+	m.metrics.FreeBytes.Set(float64(u.FreeBytes))
+	m.metrics.TotalBytes.Set(float64(u.TotalBytes))
+	m.metrics.LowWaterBytes.Set(float64(snapshot.LowWaterBytes))
+	if !changed {
+		return
+	}
+
+	typ := events.DiskRecovered
+	if snapshot.Low {
+		typ = events.DiskLow
+		m.metrics.Low.Set(1)
+		m.logger.Warn("Disk space low, frames are no longer stored",
+			zap.String("path", m.dir),
+			zap.Uint64("free_bytes", u.FreeBytes),
+			zap.Uint64("low_water_bytes", snapshot.LowWaterBytes))
+	} else {
+		m.metrics.Low.Set(0)
+		m.logger.Info("Disk space recovered, storing frames again",
+			zap.String("path", m.dir),
+			zap.Uint64("free_bytes", u.FreeBytes))
+	}
+	e := events.New(typ, "", snapshot)
+	for _, fn := range m.onChange {
+		fn(e)
+	}
+	for _, url := range cfg.Webhooks {
+		go m.notify(ctx, url, e)
+	}
+}
+
+// lowWater returns the low-water mark of a volume of total bytes: the
+// larger of the configured size and share, 0 when neither is set.
+func lowWater(cfg config.DiskMonitorConfig, total uint64) uint64 {
+	mark := uint64(cfg.MinFreeMB) << 20
+	if share := uint64(float64(total) * cfg.MinFreePercent / 100); share > mark {
+		mark = share
+	}
+	return mark
+}
+
+// notify posts an event to a webhook, as JSON.
+func (m *Monitor) notify(ctx context.Context, url string, e events.Event) {
+	if err := webhook.Post(ctx, url, e); err != nil {
+		m.metrics.Webhooks.WithLabelValues("failed").Inc()
+		m.logger.Error("Failed to deliver disk space webhook",
+			zap.String("url", url),
+			zap.String("event", e.Type),
+			zap.Error(err))
+		return
+	}
+	m.metrics.Webhooks.WithLabelValues("ok").Inc()
+}
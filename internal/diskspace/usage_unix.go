@@ -0,0 +1,17 @@
+//go:build !windows
+
+package diskspace
+
+import "syscall"
+
+// usage returns the space of the volume holding path.
+func usage(path string) (Usage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return Usage{}, err
+	}
+	return Usage{
+		FreeBytes:  uint64(st.Bavail) * uint64(st.Bsize),
+		TotalBytes: uint64(st.Blocks) * uint64(st.Bsize),
+	}, nil
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package diskspace
+
+import "golang.org/x/sys/windows"
+
+// usage returns the space of the volume holding path.
+func usage(path string) (Usage, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return Usage{}, err
+	}
+	var u Usage
+	if err := windows.GetDiskFreeSpaceEx(p, &u.FreeBytes, &u.TotalBytes, nil); err != nil {
+		return Usage{}, err
+	}
+	return u, nil
+}
@@ -29,6 +29,9 @@ type Encoder struct {
 	config    EncoderConfig
 	inputPipe io.WriteCloser
 	cmd       *exec.Cmd
+	// started is set by the first keyframe; deltas before it have nothing
+	// to be decoded against
+	started bool
 }
 
 func NewEncoder(config EncoderConfig) (*Encoder, error) {
@@ -71,7 +74,15 @@ func NewEncoder(config EncoderConfig) (*Encoder, error) {
 	}, nil
 }
 
+// Encode feeds a frame to the encoder. Frames are skipped until the first
+// keyframe.
 func (e *Encoder) Encode(frameData []byte, isKeyFrame bool) error {
+	if !e.started {
+		if !isKeyFrame {
+			return nil
+		}
+		e.started = true
+	}
 	_, err := e.inputPipe.Write(frameData)
 	return err
 }
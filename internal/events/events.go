@@ -0,0 +1,98 @@
+// Package events fans out what happens on a server, such as cameras
+// connecting and recordings being indexed, to API clients following it.
+// Events are not stored: a subscriber only gets those published while it
+// is subscribed, and one that falls behind loses the oldest.
+package events
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	CameraConnected    = "camera.connected"
+	CameraDisconnected = "camera.disconnected"
+	CameraHealth       = "camera.health"
+	RecordingCreated   = "recording.created"
+	MotionDetected     = "motion.detected"
+	ObjectsDetected    = "objects.detected"
+	DiskLow            = "disk.low"
+	DiskRecovered      = "disk.recovered"
+)
+
+// subscriberBuffer is how many events a subscriber can fall behind by.
+const subscriberBuffer = 64
+
+// Event is something that happened to a camera.
+type Event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	CameraID string    `json:"camera_id"`
+	// Node is the server the event happened on, set by aggregators and
+	// cluster nodes
+	Node string `json:"node,omitempty"`
+	// Data describes the event further, e.g. the recording for
+	// recording.created
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// Bus delivers published events to every subscriber. The zero value is
+// ready to use.
+type Bus struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// Subscribe returns a channel receiving the events published from now on,
+// until Unsubscribe.
+func (b *Bus) Subscribe() chan Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs == nil {
+		b.subs = make(map[chan Event]struct{})
+	}
+	ch := make(chan Event, subscriberBuffer)
+	b.subs[ch] = struct{}{}
+	return ch
+}
+
+// Unsubscribe stops deliveries to ch.
+func (b *Bus) Unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, ch)
+}
+
+// Publish hands an event to the subscribers without blocking. A subscriber
+// that is full loses its oldest event to make room.
+func (b *Bus) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		for {
+			select {
+			case ch <- e:
+			default:
+				select {
+				case <-ch:
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+// New returns an event of a type for a camera, happening now, with data
+// marshalled into Data.
+func New(typ, cameraID string, data interface{}) Event {
+	e := Event{Type: typ, Time: time.Now(), CameraID: cameraID}
+	if data != nil {
+		// Only called with API types, which always marshal
+		e.Data, _ = json.Marshal(data)
+	}
+	return e
+}
@@ -0,0 +1,140 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/index"
+	"github.com/raeeceip/cctv/internal/videocodec"
+	"github.com/raeeceip/cctv/pkg/pathutil"
+	"go.uber.org/zap"
+)
+
+// MaxClip bounds the time range of one clip.
+const MaxClip = 24 * time.Hour
+
+// ErrNoFootage is returned for clips of a range no recording covers.
+var ErrNoFootage = errors.New("no footage in range")
+
+// Stitch writes the footage of recordings between from and to to w as one
+// MP4, fragmented so it can be sent as it is encoded. Recordings that
+// share a codec and quality tier are trimmed and joined without
+// re-encoding, so cuts fall on the keyframes before from and after to.
+// precise re-encodes for frame-exact cuts, as do recordings of mixed
+// quality, scaled to the lowest resolution among them, and overlays, which
+// are drawn onto the clip.
+func (m *Manager) Stitch(ctx context.Context, w io.Writer, recordings []index.Recording, from, to time.Time, precise bool, overlays []Overlay) error {
+	var parts []index.Recording
+	for _, r := range recordings {
+		// Single frames have no duration to trim
+		if r.Codec != "jpeg" && r.EndTime.After(from) && r.StartTime.Before(to) {
+			parts = append(parts, r)
+		}
+	}
+	if len(parts) == 0 {
+		return ErrNoFootage
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].StartTime.Before(parts[j].StartTime) })
+
+	list, err := os.CreateTemp("", "clip-*.txt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(list.Name())
+	var entries strings.Builder
+	entries.WriteString("ffconcat version 1.0\n")
+	for _, r := range parts {
+		entry, err := pathutil.ConcatEntry(r.Path)
+		if err != nil {
+			list.Close()
+			return err
+		}
+		entries.WriteString(entry + "\n")
+		if from.After(r.StartTime) {
+			entries.WriteString("inpoint " + seconds(from.Sub(r.StartTime)) + "\n")
+		}
+		if to.Before(r.EndTime) {
+			entries.WriteString("outpoint " + seconds(to.Sub(r.StartTime)) + "\n")
+		}
+	}
+	_, err = list.WriteString(entries.String())
+	if closeErr := list.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write clip list: %w", err)
+	}
+	listPath, err := pathutil.FFmpeg(list.Name())
+	if err != nil {
+		return err
+	}
+
+	var args []string
+	if precise || mixed(parts) || len(overlays) > 0 {
+		enc := videocodec.Select(m.codec, m.logger)
+		filters := append([]string{m.clipScale(parts)}, m.overlayFilters(parts, from, to, overlays)...)
+		args = append(args, enc.InputArgs()...)
+		args = append(args, "-f", "concat", "-safe", "0", "-i", listPath)
+		args = append(args, enc.FilterArgs(strings.Join(filters, ","))...)
+		args = append(args, enc.FastArgs()...)
+		args = append(args, "-c:a", "aac")
+	} else {
+		args = append(args, "-f", "concat", "-safe", "0", "-i", listPath, "-c", "copy")
+	}
+	args = append(args, "-f", "mp4", "-movflags", "frag_keyframe+empty_moov+default_base_moof", "pipe:1")
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stdout = w
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	m.logger.Debug("Running FFmpeg command",
+		zap.String("command", fmt.Sprintf("ffmpeg %s", strings.Join(args, " "))))
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg error: %v\nOutput: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// mixed reports whether recordings differ in codec or quality tier, and so
+// can't be joined without re-encoding.
+func mixed(recordings []index.Recording) bool {
+	for _, r := range recordings[1:] {
+		if r.Codec != recordings[0].Codec || r.Tier != recordings[0].Tier {
+			return true
+		}
+	}
+	return false
+}
+
+// clipScale returns the filter bringing recordings to one resolution: the
+// lowest tier height among them, or their own rounded to even if none of
+// their tiers scales.
+func (m *Manager) clipScale(recordings []index.Recording) string {
+	height := 0
+	for _, r := range recordings {
+		if r.Tier < len(m.tierHeights) {
+			if h := m.tierHeights[r.Tier]; h > 0 && (height == 0 || h < height) {
+				height = h
+			}
+		}
+	}
+	if height == 0 {
+		return "scale=trunc(iw/2)*2:trunc(ih/2)*2"
+	}
+	return fmt.Sprintf("scale=-2:%d", height)
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
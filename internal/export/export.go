@@ -0,0 +1,344 @@
+// Package export converts recordings to the formats investigators and
+// editors ask for, such as Matroska, WebM or ProRes, as jobs on the queue.
+// Each format is an FFmpeg argument template from storage.export. A
+// recording is exported to a format once; the file is kept in
+// <output_dir>/exports for storage.export.keep and then deleted. Clips of a
+// time range are stitched from a camera's recordings as they are sent,
+// without a job or a file.
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/index"
+	"github.com/raeeceip/cctv/internal/jobs"
+	"github.com/raeeceip/cctv/internal/naming"
+	"github.com/raeeceip/cctv/internal/videocodec"
+	"github.com/raeeceip/cctv/pkg/logger"
+	"github.com/raeeceip/cctv/pkg/metrics"
+	"github.com/raeeceip/cctv/pkg/pathutil"
+	"go.uber.org/zap"
+)
+
+// KindExport is the job kind that exports one recording to one format.
+const KindExport = "export"
+
+// pruneInterval is how often exports past storage.export.keep are deleted.
+const pruneInterval = time.Hour
+
+var (
+	// ErrUnknownFormat is returned for formats not configured.
+	ErrUnknownFormat = errors.New("unknown export format")
+	// ErrNotFound is returned for exports never asked for, or deleted.
+	ErrNotFound = errors.New("export not found")
+)
+
+// Export is the state of a recording's export to a format.
+type Export struct {
+	RecordingID int64  `json:"recording_id"`
+	Format      string `json:"format"`
+	// Status is the job's: "pending", "running", "done" or "failed"
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	SizeBytes int64  `json:"size_bytes,omitempty"`
+	// Path is the exported file, once done
+	Path string `json:"-"`
+}
+
+type exportPayload struct {
+	RecordingID int64  `json:"recording_id"`
+	Format      string `json:"format"`
+}
+
+// Manager queues exports and runs them.
+type Manager struct {
+	index   *index.Index
+	queue   *jobs.Queue
+	logger  *logger.Logger
+	dir     string
+	formats map[string]config.ExportFormat
+	keep    time.Duration
+	encodes *metrics.EncodeMetrics
+	// tierHeights are the heights recordings of each retention tier are
+	// scaled to, 0 for none, with the original recordings' first
+	tierHeights []int
+	// name names downloaded exports; site is given for {{.Site}}
+	name *naming.Template
+	site string
+	// overlayFont is the font file drawtext uses for overlays, if set
+	overlayFont string
+	// codec selects the H.264 encoder clips are re-encoded with
+	codec videocodec.Options
+}
+
+// New creates the manager and registers its job handler on q.
+func New(ix *index.Index, q *jobs.Queue, log *logger.Logger, cfg *config.Config) *Manager {
+	m := &Manager{
+		index:   ix,
+		queue:   q,
+		logger:  log,
+		dir:     filepath.Join(cfg.Storage.OutputDir, "exports"),
+		formats: cfg.Storage.Export.Formats,
+		keep:    cfg.Storage.Export.Keep,
+		encodes: metrics.NewEncodeMetrics(KindExport),
+
+		tierHeights: []int{cfg.Storage.VideoConsolidation.Height},
+		site:        cfg.Site,
+		overlayFont: cfg.Storage.Export.OverlayFont,
+		codec:       config.H264Options(cfg),
+	}
+	for _, tier := range cfg.Storage.Retention.Tiers {
+		m.tierHeights = append(m.tierHeights, tier.Height)
+	}
+	// The template was checked with the rest of the configuration
+	text := cfg.Storage.Naming.Export
+	if text == "" {
+		text = naming.DefaultExport
+	}
+	var err error
+	if m.name, err = naming.Parse("export name", text); err != nil {
+		m.name, _ = naming.Parse("export name", naming.DefaultExport)
+	}
+	q.Handle(KindExport, m.handleExport)
+	return m
+}
+
+// FileName names the download of a camera's footage from from to to,
+// with extension ext. Times are in UTC.
+func (m *Manager) FileName(cameraID string, from, to time.Time, ext string) string {
+	name, err := m.name.Name(naming.Fields{Camera: cameraID, Site: m.site, Time: from.UTC(), End: to.UTC()})
+	if err != nil {
+		m.logger.Warn("Failed to name export", zap.Error(err))
+		name = fmt.Sprintf("%s_%s_%s", cameraID, from.UTC().Format("20060102_150405"), to.UTC().Format("20060102_150405"))
+	}
+	return name + "." + ext
+}
+
+// Formats returns the names of the formats, sorted.
+func (m *Manager) Formats() []string {
+	names := make([]string, 0, len(m.formats))
+	for name := range m.formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Start queues the export of r to format, unless it is already exported or
+// queued, and returns its state.
+func (m *Manager) Start(ctx context.Context, r *index.Recording, format string) (*Export, error) {
+	if _, ok := m.formats[format]; !ok {
+		return nil, ErrUnknownFormat
+	}
+	if e, err := m.Status(ctx, r.ID, format); err == nil && e.Status != index.JobFailed {
+		return e, nil
+	} else if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	_, err := m.queue.Enqueue(ctx, KindExport, jobKey(r.ID, format),
+		exportPayload{RecordingID: r.ID, Format: format})
+	if err != nil {
+		return nil, err
+	}
+	return m.Status(ctx, r.ID, format)
+}
+
+// Status returns the state of a recording's export to format.
+func (m *Manager) Status(ctx context.Context, id int64, format string) (*Export, error) {
+	f, ok := m.formats[format]
+	if !ok {
+		return nil, ErrUnknownFormat
+	}
+	e := &Export{RecordingID: id, Format: format}
+
+	job, err := m.index.LatestJob(ctx, jobKey(id, format))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if job != nil && job.Status != index.JobDone {
+		e.Status, e.Error = job.Status, job.Error
+		return e, nil
+	}
+
+	// Done, or done so long ago the job was pruned
+	path := m.path(id, format, f)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	e.Status, e.SizeBytes, e.Path = index.JobDone, info.Size(), path
+	return e, nil
+}
+
+// Run deletes exports older than storage.export.keep, and warns about
+// formats whose encoders FFmpeg lacks, until ctx is cancelled.
+func (m *Manager) Run(ctx context.Context) {
+	m.checkEncoders(ctx)
+
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		m.prune(time.Now().Add(-m.keep))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Manager) handleExport(ctx context.Context, raw json.RawMessage) error {
+	var p exportPayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return fmt.Errorf("invalid export payload: %w", err)
+	}
+	f, ok := m.formats[p.Format]
+	if !ok {
+		// Removed from the configuration since it was queued
+		return fmt.Errorf("%w %q", ErrUnknownFormat, p.Format)
+	}
+
+	r, err := m.index.GetRecording(ctx, p.RecordingID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("recording %d no longer exists", p.RecordingID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(m.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create export directory: %w", err)
+	}
+	out := m.path(r.ID, p.Format, f)
+	// FFmpeg picks the container from the extension, so it stays last
+	tmp := strings.TrimSuffix(out, "."+f.Extension) + ".tmp." + f.Extension
+	defer os.Remove(tmp)
+
+	start := time.Now()
+	if err := m.encode(ctx, r.Path, tmp, f); err != nil {
+		return err
+	}
+	if elapsed := time.Since(start); r.FrameCount > 0 && elapsed > 0 {
+		m.encodes.FramesPerSecond.Set(float64(r.FrameCount) / elapsed.Seconds())
+		m.encodes.Frames.Add(float64(r.FrameCount))
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		return fmt.Errorf("failed to save export: %w", err)
+	}
+
+	m.logger.Info("Recording exported",
+		zap.Int64("id", r.ID),
+		zap.String("format", p.Format),
+		zap.String("path", out),
+		zap.Duration("took", time.Since(start)))
+	return nil
+}
+
+func (m *Manager) encode(ctx context.Context, input, output string, f config.ExportFormat) error {
+	in, err := pathutil.FFmpeg(input)
+	if err != nil {
+		return err
+	}
+	out, err := pathutil.FFmpeg(output)
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{"-y", "-i", in}, f.Args...)
+	args = append(args, out)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	m.logger.Debug("Running FFmpeg command",
+		zap.String("command", fmt.Sprintf("ffmpeg %s", strings.Join(args, " "))))
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg error: %v\nOutput: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// path returns where a recording's export to a format is stored.
+func (m *Manager) path(id int64, format string, f config.ExportFormat) string {
+	return filepath.Join(m.dir, fmt.Sprintf("%d_%s.%s", id, format, f.Extension))
+}
+
+func jobKey(id int64, format string) string {
+	return fmt.Sprintf("export:%d:%s", id, format)
+}
+
+// prune deletes exports last written before cutoff, along with temporary
+// files left by an interrupted export.
+func (m *Manager) prune(cutoff time.Time) {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			m.logger.Warn("Failed to list exports", zap.Error(err))
+		}
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		path := filepath.Join(m.dir, entry.Name())
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			m.logger.Warn("Failed to delete export", zap.String("path", path), zap.Error(err))
+		}
+	}
+}
+
+// codecOptions are the FFmpeg options naming an encoder.
+var codecOptions = map[string]bool{
+	"-c": true, "-codec": true, "-c:v": true, "-c:a": true,
+	"-codec:v": true, "-codec:a": true, "-vcodec": true, "-acodec": true,
+}
+
+// checkEncoders warns about formats naming encoders this FFmpeg wasn't
+// built with, which would fail every export to them.
+func (m *Manager) checkEncoders(ctx context.Context) {
+	out, err := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-encoders").Output()
+	if err != nil {
+		m.logger.Warn("Failed to list FFmpeg encoders; exports may fail", zap.Error(err))
+		return
+	}
+	// Lines look like " V....D libx264   libx264 H.264 / AVC ..."
+	available := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) >= 2 {
+			available[fields[1]] = true
+		}
+	}
+
+	for _, name := range m.Formats() {
+		args := m.formats[name].Args
+		for i := 0; i+1 < len(args); i++ {
+			if enc := args[i+1]; codecOptions[args[i]] && enc != "copy" && !available[enc] {
+				m.logger.Warn("FFmpeg lacks an encoder an export format needs",
+					zap.String("format", name),
+					zap.String("encoder", enc))
+			}
+		}
+	}
+}
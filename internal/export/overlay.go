@@ -0,0 +1,79 @@
+package export
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/index"
+	"github.com/raeeceip/cctv/internal/motion"
+)
+
+// overlayHold is how long an event stays drawn on a clip.
+const overlayHold = 2 * time.Second
+
+// Overlay is an event burnt into a clip, so the clip explains itself
+// outside the system: Label across the top of the frame and a box around
+// what was detected, from Time for overlayHold.
+type Overlay struct {
+	Time  time.Time
+	Label string
+	// Box is normalized to the frame size; a zero box draws none
+	Box motion.Box
+}
+
+// overlayFilters returns the drawbox and drawtext filters drawing
+// overlays on the clip of parts between from and to. An event's place in
+// the clip skips the gaps between recordings, as the clip does; events in
+// a gap are left out.
+func (m *Manager) overlayFilters(parts []index.Recording, from, to time.Time, overlays []Overlay) []string {
+	var filters []string
+	for _, o := range overlays {
+		start, ok := clipOffset(parts, from, to, o.Time)
+		if !ok {
+			continue
+		}
+		enable := "enable=" + filterEscape(fmt.Sprintf("between(t,%s,%s)",
+			seconds(start), seconds(start+overlayHold)))
+		if b := o.Box; b.Width > 0 && b.Height > 0 {
+			filters = append(filters, fmt.Sprintf(
+				"drawbox=x=iw*%.4f:y=ih*%.4f:w=iw*%.4f:h=ih*%.4f:color=red@0.8:t=3:%s",
+				b.X, b.Y, b.Width, b.Height, enable))
+		}
+		text := fmt.Sprintf("drawtext=text=%s:expansion=none:fontcolor=white:fontsize=h/24"+
+			":box=1:boxcolor=black@0.6:boxborderw=6:x=10:y=10:%s",
+			filterEscape(o.Label+" "+o.Time.UTC().Format("2006-01-02 15:04:05Z")), enable)
+		if m.overlayFont != "" {
+			text += ":fontfile=" + filterEscape(m.overlayFont)
+		}
+		filters = append(filters, text)
+	}
+	return filters
+}
+
+// clipOffset returns how far into the clip of parts, trimmed to from and
+// to, the footage taken at t is.
+func clipOffset(parts []index.Recording, from, to, t time.Time) (time.Duration, bool) {
+	var offset time.Duration
+	for _, r := range parts {
+		start, end := r.StartTime, r.EndTime
+		if from.After(start) {
+			start = from
+		}
+		if to.Before(end) {
+			end = to
+		}
+		if !t.Before(start) && t.Before(end) {
+			return offset + t.Sub(start), true
+		}
+		offset += end.Sub(start)
+	}
+	return 0, false
+}
+
+// filterEscape escapes s as an option value in an FFmpeg filtergraph: once
+// for the filter's options and again for the graph.
+func filterEscape(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`).Replace(s)
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`).Replace(s)
+}
@@ -0,0 +1,206 @@
+// Package framecache keeps the last minutes of each camera's stored frames
+// in memory, so dashboards scrubbing near live don't read a JPEG file per
+// frame. Each camera gets a fixed-size ring in memory mapped outside the Go
+// heap, which the garbage collector never scans however large it is.
+// Frames are evicted once they are older than the window or their space is
+// needed for newer ones, whichever comes first.
+package framecache
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/raeeceip/cctv/pkg/metrics"
+)
+
+// Frame is a cached frame. Data is a copy the caller may keep.
+type Frame struct {
+	Number uint64
+	Time   time.Time
+	Path   string
+	Data   []byte
+}
+
+// entry is where a frame sits in its camera's ring.
+type entry struct {
+	number uint64
+	time   time.Time
+	path   string
+	off    int
+	n      int
+}
+
+// ring holds a camera's frames in a mapped region, oldest first in entries.
+type ring struct {
+	data    []byte
+	head    int // where the next frame is written
+	entries []entry
+	byPath  map[string]int // entry by path, offset by dropped
+	dropped int            // entries evicted since byPath offsets were taken
+}
+
+// Cache holds the rings of the cameras. A nil Cache caches nothing.
+type Cache struct {
+	window   time.Duration
+	ringSize int
+	metrics  *metrics.FrameCacheMetrics
+
+	mu      sync.RWMutex
+	cameras map[string]*ring
+}
+
+// New returns a cache keeping window of frames for each camera, in a ring
+// of ringSize bytes.
+func New(window time.Duration, ringSize int) *Cache {
+	return &Cache{
+		window:   window,
+		ringSize: ringSize,
+		metrics:  metrics.NewFrameCacheMetrics(),
+		cameras:  make(map[string]*ring),
+	}
+}
+
+// Put caches a stored frame, copying data. Frames larger than the ring are
+// left to disk.
+func (c *Cache) Put(cameraID string, number uint64, t time.Time, path string, data []byte) error {
+	if c == nil || len(data) == 0 || len(data) > c.ringSize {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, ok := c.cameras[cameraID]
+	if !ok {
+		mem, err := mapRing(c.ringSize)
+		if err != nil {
+			return fmt.Errorf("failed to map frame cache for %s: %w", cameraID, err)
+		}
+		r = &ring{data: mem, byPath: make(map[string]int)}
+		c.cameras[cameraID] = r
+		c.metrics.Mapped.Add(float64(c.ringSize))
+	}
+
+	off := r.head
+	if off+len(data) > len(r.data) {
+		// Wrap; what is left at the end is older than anything at the start
+		for len(r.entries) > 0 && r.entries[0].off >= off {
+			r.evict()
+		}
+		off = 0
+	}
+	for len(r.entries) > 0 && r.entries[0].off < off+len(data) && r.entries[0].off+r.entries[0].n > off {
+		r.evict()
+	}
+	cutoff := t.Add(-c.window)
+	for len(r.entries) > 0 && r.entries[0].time.Before(cutoff) {
+		r.evict()
+	}
+
+	copy(r.data[off:], data)
+	r.head = off + len(data)
+	r.byPath[path] = len(r.entries) + r.dropped
+	r.entries = append(r.entries, entry{number: number, time: t, path: path, off: off, n: len(data)})
+	return nil
+}
+
+// evict drops the oldest entry. The slice is compacted now and then rather
+// than on every eviction, keeping byPath offsets cheap to maintain.
+func (r *ring) evict() {
+	delete(r.byPath, r.entries[0].path)
+	r.entries = r.entries[1:]
+	r.dropped++
+	if r.dropped > 1024 && r.dropped > len(r.entries) {
+		r.entries = append([]entry(nil), r.entries...)
+		for path, i := range r.byPath {
+			r.byPath[path] = i - r.dropped
+		}
+		r.dropped = 0
+	}
+}
+
+func (r *ring) frame(e entry) Frame {
+	return Frame{
+		Number: e.number,
+		Time:   e.time,
+		Path:   e.path,
+		Data:   append([]byte(nil), r.data[e.off:e.off+e.n]...),
+	}
+}
+
+// At returns a camera's latest cached frame taken at or before t, or the
+// latest one if t is zero. ok is false if the cache doesn't reach back to
+// t, in which case the frame has to come from disk.
+func (c *Cache) At(cameraID string, t time.Time) (f Frame, ok bool) {
+	if c == nil {
+		return Frame{}, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	r := c.cameras[cameraID]
+	if r == nil || len(r.entries) == 0 {
+		c.metrics.Misses.Inc()
+		return Frame{}, false
+	}
+	i := len(r.entries) - 1
+	if !t.IsZero() {
+		// Frames arrive in capture order, near enough to search by time
+		i = sort.Search(len(r.entries), func(i int) bool {
+			return r.entries[i].time.After(t)
+		}) - 1
+	}
+	if i < 0 {
+		c.metrics.Misses.Inc()
+		return Frame{}, false
+	}
+	c.metrics.Hits.Inc()
+	return r.frame(r.entries[i]), true
+}
+
+// Read returns the cached data of the frame stored at path.
+func (c *Cache) Read(cameraID, path string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if r := c.cameras[cameraID]; r != nil {
+		if i, ok := r.byPath[path]; ok {
+			c.metrics.Hits.Inc()
+			return r.frame(r.entries[i-r.dropped]).Data, true
+		}
+	}
+	c.metrics.Misses.Inc()
+	return nil, false
+}
+
+// Remove drops a camera's ring, e.g. once it disconnects.
+func (c *Cache) Remove(cameraID string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r, ok := c.cameras[cameraID]; ok {
+		delete(c.cameras, cameraID)
+		unmapRing(r.data)
+		c.metrics.Mapped.Sub(float64(c.ringSize))
+	}
+}
+
+// Close drops every ring.
+func (c *Cache) Close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, r := range c.cameras {
+		delete(c.cameras, id)
+		unmapRing(r.data)
+		c.metrics.Mapped.Sub(float64(c.ringSize))
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package framecache
+
+import "syscall"
+
+// mapRing maps anonymous memory for a ring. Untouched pages cost nothing
+// until frames are written to them.
+func mapRing(size int) ([]byte, error) {
+	return syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+}
+
+func unmapRing(b []byte) {
+	syscall.Munmap(b)
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package framecache
+
+// mapRing allocates a ring on the heap; Windows has no anonymous mmap in
+// the syscall package.
+func mapRing(size int) ([]byte, error) {
+	return make([]byte, size), nil
+}
+
+func unmapRing(b []byte) {}
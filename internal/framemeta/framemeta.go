@@ -0,0 +1,142 @@
+// Package framemeta records what is known about each stored frame, so
+// analysis tools can tell which camera took it and when without parsing
+// its file name. The metadata is written either as a JSON sidecar next to
+// the frame:
+//
+//	<camera>/.../frame_00001_20241220_150405.000.jpg
+//	<camera>/.../frame_00001_20241220_150405.000.json
+//
+// or embedded in the JPEG, as a comment segment holding the same JSON and
+// EXIF tags with the camera and capture time, which photo tools read.
+package framemeta
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/motion"
+	"github.com/raeeceip/cctv/internal/wire"
+)
+
+// Modes of storage.frame_metadata; empty writes no metadata
+const (
+	ModeSidecar = "sidecar"
+	ModeEmbed   = "embed"
+)
+
+// Metadata describes a frame.
+type Metadata struct {
+	Camera   string    `json:"camera"`
+	Sequence uint64    `json:"sequence"`
+	Time     time.Time `json:"time"` // when the camera took the frame
+	// Pattern is the test pattern a simulated camera drew, if it said
+	Pattern  string         `json:"pattern,omitempty"`
+	Location *wire.Location `json:"location,omitempty"`
+	// Delta frames depend on the keyframe their GOP names
+	Delta bool      `json:"delta,omitempty"`
+	GOP   *wire.GOP `json:"gop,omitempty"`
+	PTZ   *wire.PTZ `json:"ptz,omitempty"`
+	// Detections are added to sidecars as the frame is analyzed
+	Detections []Detection `json:"detections,omitempty"`
+}
+
+// Detection is something found in a frame.
+type Detection struct {
+	Type string `json:"type"` // "motion" or "object"
+	// Box bounds what was found, normalized to the frame size
+	Box       motion.Box `json:"box"`
+	Intensity float64    `json:"intensity,omitempty"`
+	Zone      string     `json:"zone,omitempty"`
+	// Label and Score are what an object is and the detector's confidence
+	Label string  `json:"label,omitempty"`
+	Score float64 `json:"score,omitempty"`
+}
+
+// SidecarPath returns the path of a frame's sidecar.
+func SidecarPath(framePath string) string {
+	return strings.TrimSuffix(framePath, filepath.Ext(framePath)) + ".json"
+}
+
+// WriteSidecar writes the sidecar of a frame.
+func WriteSidecar(framePath string, m Metadata) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Readers never see half a sidecar
+	path := SidecarPath(framePath)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// ReadSidecar reads the sidecar of a frame.
+func ReadSidecar(framePath string) (Metadata, error) {
+	var m Metadata
+	data, err := os.ReadFile(SidecarPath(framePath))
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("invalid frame metadata: %w", err)
+	}
+	return m, nil
+}
+
+// AddDetection adds detections to the sidecar of a frame. Frames without
+// a sidecar, such as those stored without metadata or since deleted, are
+// left alone.
+func AddDetection(framePath string, ds ...Detection) error {
+	m, err := ReadSidecar(framePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	m.Detections = append(m.Detections, ds...)
+	return WriteSidecar(framePath, m)
+}
+
+// ClearDetections removes the detections of a type from the sidecar of a
+// frame, before it is analyzed for them again. Frames without a sidecar
+// are left alone.
+func ClearDetections(framePath, typ string) error {
+	m, err := ReadSidecar(framePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	kept := m.Detections[:0]
+	for _, d := range m.Detections {
+		if d.Type != typ {
+			kept = append(kept, d)
+		}
+	}
+	if len(kept) == len(m.Detections) {
+		return nil
+	}
+	m.Detections = kept
+	return WriteSidecar(framePath, m)
+}
+
+// RemoveSidecar deletes the sidecar of a frame, if it has one.
+func RemoveSidecar(framePath string) error {
+	if err := os.Remove(SidecarPath(framePath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
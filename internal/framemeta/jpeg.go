@@ -0,0 +1,199 @@
+package framemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// JPEG markers
+const (
+	markerSOI  = 0xD8
+	markerAPP0 = 0xE0
+	markerAPP1 = 0xE1
+	markerAPPF = 0xEF
+	markerCOM  = 0xFE
+	markerSOS  = 0xDA
+)
+
+// maxSegment is the most a JPEG segment holds, after its length.
+const maxSegment = 0xFFFF - 2
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// Embed returns a copy of a JPEG with the metadata in it: a comment segment
+// holding it as JSON and, unless the JPEG has EXIF data already, an EXIF
+// segment with the camera as the model and the capture time. They go right
+// after the JFIF header, if any.
+func Embed(jpeg []byte, m Metadata) ([]byte, error) {
+	if len(jpeg) < 4 || jpeg[0] != 0xFF || jpeg[1] != markerSOI {
+		return nil, fmt.Errorf("not a JPEG")
+	}
+
+	// Find the end of the JFIF header, and any EXIF, among the application
+	// segments at the start
+	insert, hasExif := 2, false
+	for pos := 2; pos+4 <= len(jpeg) && jpeg[pos] == 0xFF; {
+		marker := jpeg[pos+1]
+		if marker < markerAPP0 || marker > markerAPPF {
+			break
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(jpeg[pos+2:]))
+		if end > len(jpeg) {
+			return nil, fmt.Errorf("truncated JPEG segment")
+		}
+		if marker == markerAPP1 && bytes.HasPrefix(jpeg[pos+4:end], exifHeader) {
+			hasExif = true
+		}
+		if marker == markerAPP0 && insert == pos {
+			insert = end
+		}
+		pos = end
+	}
+
+	comment, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	if len(comment) > maxSegment {
+		return nil, fmt.Errorf("frame metadata too large to embed")
+	}
+
+	out := make([]byte, 0, len(jpeg)+len(comment)+256)
+	out = append(out, jpeg[:insert]...)
+	if !hasExif {
+		out = appendSegment(out, markerAPP1, append(append([]byte(nil), exifHeader...), exif(m)...))
+	}
+	out = appendSegment(out, markerCOM, comment)
+	return append(out, jpeg[insert:]...), nil
+}
+
+func appendSegment(b []byte, marker byte, data []byte) []byte {
+	b = append(b, 0xFF, marker)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)+2))
+	return append(b, data...)
+}
+
+// Extract returns the metadata embedded in a JPEG, if any.
+func Extract(jpeg []byte) (Metadata, bool) {
+	var m Metadata
+	if len(jpeg) < 4 || jpeg[0] != 0xFF || jpeg[1] != markerSOI {
+		return m, false
+	}
+	for pos := 2; pos+4 <= len(jpeg) && jpeg[pos] == 0xFF; {
+		marker := jpeg[pos+1]
+		end := pos + 2 + int(binary.BigEndian.Uint16(jpeg[pos+2:]))
+		if end > len(jpeg) || marker == markerSOS {
+			// Past the headers
+			break
+		}
+		if marker == markerCOM && json.Unmarshal(jpeg[pos+4:end], &m) == nil && m.Camera != "" {
+			return m, true
+		}
+		pos = end
+	}
+	return Metadata{}, false
+}
+
+// EXIF tags
+const (
+	tagModel              = 0x0110
+	tagDateTime           = 0x0132
+	tagExifIFD            = 0x8769
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagSubSecTimeOriginal = 0x9291
+)
+
+// EXIF value types
+const (
+	typeASCII = 2
+	typeLong  = 4
+)
+
+type ifdEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func asciiEntry(tag uint16, s string) ifdEntry {
+	v := append([]byte(s), 0)
+	return ifdEntry{tag: tag, typ: typeASCII, count: uint32(len(v)), value: v}
+}
+
+func longEntry(tag uint16, n uint32) ifdEntry {
+	return ifdEntry{tag: tag, typ: typeLong, count: 1, value: binary.LittleEndian.AppendUint32(nil, n)}
+}
+
+// exif returns the TIFF structure of the EXIF segment: the camera as the
+// model in IFD0, and the capture time, in the local time frames are named
+// by, to the millisecond with its UTC offset in the EXIF IFD.
+func exif(m Metadata) []byte {
+	t := m.Time.Local()
+	stamp := t.Format("2006:01:02 15:04:05")
+	ifd0 := []ifdEntry{
+		asciiEntry(tagModel, m.Camera),
+		asciiEntry(tagDateTime, stamp),
+		longEntry(tagExifIFD, 0), // set below
+	}
+	exifIFD := []ifdEntry{
+		asciiEntry(tagDateTimeOriginal, stamp),
+		asciiEntry(tagOffsetTimeOriginal, t.Format("-07:00")),
+		asciiEntry(tagSubSecTimeOriginal, fmt.Sprintf("%03d", t.Nanosecond()/int(time.Millisecond))),
+	}
+
+	// The TIFF header is 8 bytes, followed by IFD0 and the EXIF IFD
+	ifd0[2].value = binary.LittleEndian.AppendUint32(nil, uint32(8+ifdSize(ifd0)))
+	var b bytes.Buffer
+	b.WriteString("II")
+	b.Write(binary.LittleEndian.AppendUint16(nil, 42))
+	b.Write(binary.LittleEndian.AppendUint32(nil, 8))
+	writeIFD(&b, ifd0)
+	writeIFD(&b, exifIFD)
+	return b.Bytes()
+}
+
+// ifdSize returns the bytes an IFD takes along with the values that don't
+// fit in its entries.
+func ifdSize(entries []ifdEntry) int {
+	n := 2 + 12*len(entries) + 4
+	for _, e := range entries {
+		if len(e.value) > 4 {
+			n += len(e.value) + len(e.value)%2
+		}
+	}
+	return n
+}
+
+// writeIFD appends an IFD, and then the values that don't fit in its
+// entries, to b, which starts at the TIFF header. Entries must be sorted by
+// tag.
+func writeIFD(b *bytes.Buffer, entries []ifdEntry) {
+	le := binary.LittleEndian
+	values := b.Len() + 2 + 12*len(entries) + 4
+	var extra []byte
+	b.Write(le.AppendUint16(nil, uint16(len(entries))))
+	for _, e := range entries {
+		b.Write(le.AppendUint16(nil, e.tag))
+		b.Write(le.AppendUint16(nil, e.typ))
+		b.Write(le.AppendUint32(nil, e.count))
+		if len(e.value) <= 4 {
+			var v [4]byte
+			copy(v[:], e.value)
+			b.Write(v[:])
+			continue
+		}
+		b.Write(le.AppendUint32(nil, uint32(values+len(extra))))
+		extra = append(extra, e.value...)
+		if len(extra)%2 == 1 {
+			extra = append(extra, 0)
+		}
+	}
+	// No next IFD
+	b.Write(le.AppendUint32(nil, 0))
+	b.Write(extra)
+}
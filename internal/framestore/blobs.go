@@ -0,0 +1,74 @@
+package framestore
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// blobDir holds frame contents by hash, for stores that deduplicate
+// identical frames. Frames are hard links to their blob, so everything
+// reading frames by path works the same; a blob's link count is its
+// reference count.
+//
+//	<output>/.blobs/ab/ab12...ef.jpg
+const blobDir = ".blobs"
+
+// strayAge is how old a temporary blob must be before it is considered
+// left behind by a crash rather than being written.
+const strayAge = time.Hour
+
+// BlobDir returns the directory holding frame blobs.
+func (s *Store) BlobDir() string {
+	return filepath.Join(s.root, blobDir)
+}
+
+// BlobPath returns where the frame content with hex hash sum is kept.
+func (s *Store) BlobPath(sum string) string {
+	return filepath.Join(s.root, blobDir, sum[:2], sum+".jpg")
+}
+
+// IsBlob reports whether path lies in the blob directory.
+func (s *Store) IsBlob(path string) bool {
+	rel, err := filepath.Rel(s.BlobDir(), path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// CollectBlobs deletes the blobs no frame links to any more, and
+// temporary blobs left behind, returning the bytes freed.
+func (s *Store) CollectBlobs() (int64, error) {
+	var freed int64
+	err := filepath.WalkDir(s.BlobDir(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			if time.Since(info.ModTime()) < strayAge {
+				// Being written
+				return nil
+			}
+		} else if LinkCount(path, info) > 1 {
+			return nil
+		}
+		if err := os.Remove(path); err == nil {
+			freed += info.Size()
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	return freed, err
+}
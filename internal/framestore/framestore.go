@@ -0,0 +1,283 @@
+// Package framestore decides where frames are stored below the output
+// directory. The flat layout keeps every frame of a camera in one directory:
+//
+//	<output>/<camera>/frame_00001_20241220_150405.000.jpg
+//
+// which gets slow to list once a camera has tens of thousands of frames. The
+// dated layout shards them by the hour the frame was taken:
+//
+//	<output>/<camera>/2024/12/20/15/frame_00001_20241220_150405.000.jpg
+//
+// Listing always reads both, so frames written before switching layouts are
+// still found. File names follow storage.naming.frame when it is set; frames
+// named by the default template are still read.
+package framestore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/framemeta"
+	"github.com/raeeceip/cctv/internal/naming"
+)
+
+// Layout names a directory layout for frames.
+type Layout string
+
+const (
+	Flat  Layout = "flat"
+	Dated Layout = "dated"
+)
+
+// Store places the frames of each camera under its directory in root.
+type Store struct {
+	root   string
+	layout Layout
+	// name is the frame name template, nil for the default; site is
+	// what it is given for {{.Site}}
+	name *naming.Template
+	site string
+}
+
+// New returns a store rooted at the output directory. An empty layout is
+// Dated; an empty name template is naming.DefaultFrame.
+func New(root string, layout Layout, name, site string) (*Store, error) {
+	switch layout {
+	case "":
+		layout = Dated
+	case Flat, Dated:
+	default:
+		return nil, fmt.Errorf("unknown frame layout %q", layout)
+	}
+	s := &Store{root: root, layout: layout, site: site}
+	if name != "" && name != naming.DefaultFrame {
+		t, err := naming.ParseFrame("frame name", name)
+		if err != nil {
+			return nil, err
+		}
+		s.name = t
+	}
+	return s, nil
+}
+
+// Root returns the directory the store is in.
+func (s *Store) Root() string {
+	return s.root
+}
+
+// CameraDir returns the directory holding a camera's frames.
+func (s *Store) CameraDir(cameraID string) string {
+	return filepath.Join(s.root, cameraID)
+}
+
+// Path returns where frame number n of a camera, taken at t, is stored.
+// Names and directories use local time, which is how they are read back.
+func (s *Store) Path(cameraID string, n uint64, t time.Time) (string, error) {
+	t = t.Local()
+	name := fmt.Sprintf("frame_%05d_%s.jpg", n, t.Format("20060102_150405.000"))
+	if s.name != nil {
+		base, err := s.name.Name(naming.Fields{Camera: cameraID, Site: s.site, Seq: n, Time: t})
+		if err != nil {
+			return "", err
+		}
+		name = base + ".jpg"
+	}
+	if s.layout == Flat {
+		return filepath.Join(s.CameraDir(cameraID), name), nil
+	}
+	return filepath.Join(s.CameraDir(cameraID),
+		t.Format("2006"), t.Format("01"), t.Format("02"), t.Format("15"), name), nil
+}
+
+// Frames lists a camera's frame files in both layouts, in no particular
+// order. Hour directories that end before since are skipped; a zero since
+// lists everything. Flat frames are always listed since their directory
+// cannot be narrowed down.
+func (s *Store) Frames(cameraID string, since time.Time) ([]string, error) {
+	var frames []string
+	err := s.walk(s.CameraDir(cameraID), nil, since, func(path string) {
+		frames = append(frames, path)
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return frames, err
+}
+
+// Remove deletes a frame, its metadata sidecar if it has one, and then
+// whichever of its dated directories that leaves empty.
+func (s *Store) Remove(path string) error {
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if err := framemeta.RemoveSidecar(path); err != nil {
+		return err
+	}
+	cameraDir := s.CameraDir(s.CameraID(path))
+	for dir := filepath.Dir(path); dir != cameraDir && strings.HasPrefix(dir, cameraDir); dir = filepath.Dir(dir) {
+		// Fails, harmlessly, while other frames are left
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// CameraID returns the camera a frame file of the store belongs to, the
+// directory below the root it is in, whichever layout it was written in.
+func (s *Store) CameraID(path string) string {
+	root, err := filepath.Abs(s.root)
+	if err == nil {
+		path, err = filepath.Abs(path)
+	}
+	if err == nil {
+		if rel, err := filepath.Rel(root, path); err == nil && filepath.IsLocal(rel) {
+			if camera, _, ok := strings.Cut(filepath.ToSlash(rel), "/"); ok {
+				return camera
+			}
+		}
+	}
+	return CameraID(path, s.layout)
+}
+
+// CameraID returns the camera a frame file outside any store belongs to,
+// such as footage being imported, going by layout: the directory above the
+// hour directories in the dated layout, if the file is in one, or the one
+// the file is in.
+func CameraID(path string, layout Layout) string {
+	dir := filepath.Dir(path)
+	if layout != Flat && isHourDir(dir) {
+		for i := 0; i < 4; i++ {
+			dir = filepath.Dir(dir)
+		}
+	}
+	return filepath.Base(dir)
+}
+
+// walk calls fn for the frames in dir, which is a camera directory when
+// date is empty and otherwise the dated directory for the year, month, day
+// and hour in date.
+func (s *Store) walk(dir string, date []int, since time.Time, fn func(string)) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() {
+			if s.IsFrame(name) {
+				fn(filepath.Join(dir, name))
+			}
+			continue
+		}
+		if len(date) == 4 || !isDateDir(name) {
+			continue
+		}
+		n, _ := strconv.Atoi(name)
+		sub := append(date[:len(date):len(date)], n)
+		if !since.IsZero() && !periodEnd(sub).After(since) {
+			continue
+		}
+		if err := s.walk(filepath.Join(dir, name), sub, since, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// periodEnd returns when the year, month, day or hour described by date
+// ends.
+func periodEnd(date []int) time.Time {
+	parts := [4]int{0, 1, 1, 0}
+	copy(parts[:], date)
+	t := time.Date(parts[0], time.Month(parts[1]), parts[2], parts[3], 0, 0, 0, time.Local)
+	switch len(date) {
+	case 1:
+		return t.AddDate(1, 0, 0)
+	case 2:
+		return t.AddDate(0, 1, 0)
+	case 3:
+		return t.AddDate(0, 0, 1)
+	default:
+		return t.Add(time.Hour)
+	}
+}
+
+// IsFrame reports whether name is the file name of one of the store's
+// frames.
+func (s *Store) IsFrame(name string) bool {
+	if s.name != nil && strings.HasSuffix(name, ".jpg") {
+		if _, ok := s.name.Match(strings.TrimSuffix(name, ".jpg")); ok {
+			return true
+		}
+	}
+	return IsFrame(name)
+}
+
+// ParseName returns the frame number and capture time in a frame file name,
+// the reverse of Path, for names from the store's template and the default
+// one. The time is in local time.
+func (s *Store) ParseName(name string) (n uint64, t time.Time, ok bool) {
+	if s.name != nil && strings.HasSuffix(name, ".jpg") {
+		if f, ok := s.name.Match(strings.TrimSuffix(name, ".jpg")); ok {
+			return f.Seq, f.Time, true
+		}
+	}
+	return ParseName(name)
+}
+
+// IsFrame reports whether name is a frame file name from the default
+// template.
+func IsFrame(name string) bool {
+	return strings.HasPrefix(name, "frame_") && strings.HasSuffix(name, ".jpg")
+}
+
+// ParseName returns the frame number and capture time in a frame file name
+// from the default template. The time is in local time.
+func ParseName(name string) (n uint64, t time.Time, ok bool) {
+	if !IsFrame(name) {
+		return 0, time.Time{}, false
+	}
+	parts := strings.SplitN(strings.TrimSuffix(name, ".jpg"), "_", 3)
+	if len(parts) < 3 {
+		return 0, time.Time{}, false
+	}
+	n, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	t, err = time.ParseInLocation("20060102_150405.000", parts[2], time.Local)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	return n, t, true
+}
+
+// isHourDir reports whether dir ends in the year, month, day and hour
+// directories of the dated layout.
+func isHourDir(dir string) bool {
+	for _, width := range []int{2, 2, 2, 4} {
+		if name := filepath.Base(dir); len(name) != width || !isDateDir(name) {
+			return false
+		}
+		dir = filepath.Dir(dir)
+	}
+	return true
+}
+
+// isDateDir reports whether name could be one of the dated directories.
+func isDateDir(name string) bool {
+	if len(name) != 2 && len(name) != 4 {
+		return false
+	}
+	for _, c := range name {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package framestore
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// LinkCount returns how many hard links the file at path, described by
+// info, has.
+func LinkCount(path string, info fs.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 1
+}
@@ -0,0 +1,290 @@
+// Package health tells which cameras are working. A connected camera is
+// online while its frames arrive, degraded once they stop while it still
+// sends heartbeats, or has only lately gone quiet, and offline once it has
+// been silent for offline_after or disconnects. Changes of state are
+// logged and announced to hooks and webhooks.
+package health
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/events"
+	"github.com/raeeceip/cctv/internal/webhook"
+	"github.com/raeeceip/cctv/internal/wire"
+	"github.com/raeeceip/cctv/pkg/logger"
+	"github.com/raeeceip/cctv/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// Camera states
+const (
+	Online   = "online"
+	Degraded = "degraded"
+	Offline  = "offline"
+)
+
+var states = []string{Online, Degraded, Offline}
+
+const (
+	// checkInterval is how often cameras going quiet are looked for
+	checkInterval = time.Second
+	// forgetAfter is how long an offline camera is kept
+	forgetAfter = 24 * time.Hour
+)
+
+// Camera is the health of one camera.
+type Camera struct {
+	ID    string    `json:"id"`
+	State string    `json:"state"`
+	Since time.Time `json:"since"` // when it entered State
+	// LastFrame and LastHeartbeat are when they were received
+	LastFrame     *time.Time `json:"last_frame,omitempty"`
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+	// Heartbeat is the last one the camera sent
+	Heartbeat *wire.Heartbeat `json:"heartbeat,omitempty"`
+
+	connected   bool
+	connectedAt time.Time
+}
+
+// Change is the data of camera.health events.
+type Change struct {
+	Camera
+	Previous string `json:"previous"`
+}
+
+// Tracker follows the health of cameras.
+type Tracker struct {
+	logger  *logger.Logger
+	metrics *metrics.HealthMetrics
+
+	mu       sync.Mutex
+	cfg      config.HealthConfig
+	cameras  map[string]*Camera
+	onChange []func(events.Event)
+}
+
+// New returns a tracker judging cameras by cfg.
+func New(cfg config.HealthConfig, log *logger.Logger) *Tracker {
+	return &Tracker{
+		logger:  log,
+		metrics: metrics.NewHealthMetrics(),
+		cfg:     cfg,
+		cameras: make(map[string]*Camera),
+	}
+}
+
+// Apply replaces the thresholds and webhooks with those of a reloaded
+// configuration.
+func (t *Tracker) Apply(cfg config.HealthConfig) {
+	t.mu.Lock()
+	t.cfg = cfg
+	t.mu.Unlock()
+}
+
+// OnChange registers fn to be called with a camera.health event whenever a
+// camera changes state. Register hooks before Run.
+func (t *Tracker) OnChange(fn func(events.Event)) {
+	t.onChange = append(t.onChange, fn)
+}
+
+// Connected records a camera connecting, which makes it online until it
+// has had DegradedAfter to send a frame.
+func (t *Tracker) Connected(id string, now time.Time) {
+	t.update(id, now, func(c *Camera) {
+		c.connected = true
+		c.connectedAt = now
+	})
+}
+
+// Disconnected records a camera disconnecting, which makes it offline.
+func (t *Tracker) Disconnected(id string, now time.Time) {
+	t.update(id, now, func(c *Camera) {
+		c.connected = false
+	})
+}
+
+// Frame records a frame of a camera received at now.
+func (t *Tracker) Frame(id string, now time.Time) {
+	t.update(id, now, func(c *Camera) {
+		c.LastFrame = &now
+		if !c.connected {
+			// Cameras the server pulls from may report streaming late
+			c.connected = true
+			c.connectedAt = now
+		}
+	})
+}
+
+// Heartbeat records a heartbeat of a camera received at now.
+func (t *Tracker) Heartbeat(id string, hb wire.Heartbeat, now time.Time) {
+	t.update(id, now, func(c *Camera) {
+		c.LastHeartbeat = &now
+		c.Heartbeat = &hb
+	})
+}
+
+// Get returns the health of a camera.
+func (t *Tracker) Get(id string) (Camera, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.cameras[id]
+	if !ok {
+		return Camera{}, false
+	}
+	return *c, true
+}
+
+// List returns the health of every camera seen lately, by ID.
+func (t *Tracker) List() []Camera {
+	t.mu.Lock()
+	list := make([]Camera, 0, len(t.cameras))
+	for _, c := range t.cameras {
+		list = append(list, *c)
+	}
+	t.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Run looks for cameras going quiet every second until ctx is cancelled.
+func (t *Tracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			t.check(ctx, now)
+		}
+	}
+}
+
+// update applies fn to a camera, adding it if it is new, and announces a
+// change of state it makes.
+func (t *Tracker) update(id string, now time.Time, fn func(*Camera)) {
+	t.mu.Lock()
+	c, ok := t.cameras[id]
+	if !ok {
+		c = &Camera{ID: id, State: Offline, Since: now}
+		t.cameras[id] = c
+		t.setState(id, Offline)
+	}
+	fn(c)
+	change, changed := t.transition(c, now)
+	cfg := t.cfg
+	t.mu.Unlock()
+	if changed {
+		t.announce(context.Background(), cfg, change)
+	}
+}
+
+// check moves cameras that have gone quiet to their new state, and forgets
+// those offline for long.
+func (t *Tracker) check(ctx context.Context, now time.Time) {
+	var changes []Change
+	t.mu.Lock()
+	for id, c := range t.cameras {
+		if c.State == Offline && now.Sub(c.Since) > forgetAfter {
+			delete(t.cameras, id)
+			for _, state := range states {
+				t.metrics.State.DeleteLabelValues(id, state)
+			}
+			continue
+		}
+		if change, changed := t.transition(c, now); changed {
+			changes = append(changes, change)
+		}
+	}
+	cfg := t.cfg
+	t.mu.Unlock()
+	for _, change := range changes {
+		t.announce(ctx, cfg, change)
+	}
+}
+
+// transition moves a camera, which must be locked, to the state it is in
+// at now, and returns the change if it is a new one.
+func (t *Tracker) transition(c *Camera, now time.Time) (Change, bool) {
+	state := t.state(c, now)
+	if state == c.State {
+		return Change{}, false
+	}
+	previous := c.State
+	c.State, c.Since = state, now
+	t.setState(c.ID, state)
+	t.metrics.Transitions.WithLabelValues(state).Inc()
+	return Change{Camera: *c, Previous: previous}, true
+}
+
+// state works out what state a camera is in at now.
+func (t *Tracker) state(c *Camera, now time.Time) string {
+	if !c.connected {
+		return Offline
+	}
+	frame := c.connectedAt
+	if c.LastFrame != nil && c.LastFrame.After(frame) {
+		frame = *c.LastFrame
+	}
+	if now.Sub(frame) < t.cfg.DegradedAfter {
+		return Online
+	}
+	seen := frame
+	if c.LastHeartbeat != nil && c.LastHeartbeat.After(seen) {
+		seen = *c.LastHeartbeat
+	}
+	if now.Sub(seen) < t.cfg.OfflineAfter {
+		return Degraded
+	}
+	return Offline
+}
+
+func (t *Tracker) setState(id, current string) {
+	for _, state := range states {
+		value := 0.0
+		if state == current {
+			value = 1
+		}
+		t.metrics.State.WithLabelValues(id, state).Set(value)
+	}
+}
+
+// announce logs a change of state and hands it to the hooks and webhooks.
+func (t *Tracker) announce(ctx context.Context, cfg config.HealthConfig, change Change) {
+	fields := []zap.Field{
+		zap.String("camera", change.ID),
+		zap.String("state", change.State),
+		zap.String("previous", change.Previous),
+	}
+	if change.State == Online {
+		t.logger.Info("Camera is online", fields...)
+	} else {
+		t.logger.Warn("Camera is "+change.State, fields...)
+	}
+
+	e := events.New(events.CameraHealth, change.ID, change)
+	for _, fn := range t.onChange {
+		fn(e)
+	}
+	for _, url := range cfg.Webhooks {
+		go t.notify(ctx, url, e)
+	}
+}
+
+// notify posts an event to a webhook.
+func (t *Tracker) notify(ctx context.Context, url string, e events.Event) {
+	if err := webhook.Post(ctx, url, e); err != nil {
+		t.metrics.Webhooks.WithLabelValues("failed").Inc()
+		t.logger.Error("Failed to deliver camera health webhook",
+			zap.String("url", url),
+			zap.String("camera", e.CameraID),
+			zap.Error(err))
+		return
+	}
+	t.metrics.Webhooks.WithLabelValues("ok").Inc()
+}
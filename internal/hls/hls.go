@@ -0,0 +1,171 @@
+// Package hls packages each camera's consolidated videos as an HTTP Live
+// Streaming playlist, for players and dashboards that can't use the
+// WebSocket or WebRTC streams. Every video is cut into segments appended to
+// the camera's rolling playlist.m3u8; segments that fall off the playlist
+// are deleted. Videos are packaged one at a time, in the order they were
+// created, so each playlist stays in order.
+package hls
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/processor"
+	"github.com/raeeceip/cctv/internal/videocodec"
+	"github.com/raeeceip/cctv/pkg/logger"
+	"github.com/raeeceip/cctv/pkg/pathutil"
+	"go.uber.org/zap"
+)
+
+// PlaylistName is the name of each camera's playlist.
+const PlaylistName = "playlist.m3u8"
+
+// queueSize bounds the videos waiting to be packaged. Videos beyond it are
+// skipped, leaving a gap in the playlist.
+const queueSize = 64
+
+// Segment types
+const (
+	MPEGTS = "mpegts"
+	FMP4   = "fmp4"
+)
+
+// Packager packages consolidated videos into per-camera playlists.
+type Packager struct {
+	dir       string
+	cfg       config.HLSConfig
+	transcode bool
+	codec     videocodec.Options // H.264 encoder transcodes use
+	logger    *logger.Logger
+	queue     chan processor.Video
+}
+
+// New returns a packager writing each camera's playlist to a directory
+// under dir. With transcode the videos are re-encoded as H.264, which HLS
+// requires, with the encoder codec selects; otherwise their video stream is
+// copied as is.
+func New(dir string, cfg config.HLSConfig, transcode bool, codec videocodec.Options, log *logger.Logger) *Packager {
+	return &Packager{
+		dir:       dir,
+		cfg:       cfg,
+		transcode: transcode,
+		codec:     codec,
+		logger:    log,
+		queue:     make(chan processor.Video, queueSize),
+	}
+}
+
+// Add queues a consolidated video without blocking.
+func (p *Packager) Add(v processor.Video) {
+	select {
+	case p.queue <- v:
+	default:
+		p.logger.Warn("HLS packaging behind, skipped video",
+			zap.String("camera", v.CameraID),
+			zap.String("path", v.Path))
+	}
+}
+
+// Run packages the queued videos until ctx is cancelled.
+func (p *Packager) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case v := <-p.queue:
+			if err := p.pack(ctx, v); err != nil && ctx.Err() == nil {
+				p.logger.Error("Failed to package video for HLS",
+					zap.String("camera", v.CameraID),
+					zap.String("path", v.Path),
+					zap.Error(err))
+			}
+		}
+	}
+}
+
+// CameraDir returns the directory holding a camera's playlist and
+// segments.
+func (p *Packager) CameraDir(cameraID string) string {
+	return filepath.Join(p.dir, cameraID)
+}
+
+// File returns the path of a camera's playlist or segment called name. ok
+// is false for names that could lead out of the camera's directory.
+func (p *Packager) File(cameraID, name string) (path string, ok bool) {
+	for _, part := range []string{cameraID, name} {
+		if part == "" || strings.HasPrefix(part, ".") || strings.ContainsAny(part, `/\`) {
+			return "", false
+		}
+	}
+	return filepath.Join(p.CameraDir(cameraID), name), true
+}
+
+func (p *Packager) pack(ctx context.Context, v processor.Video) error {
+	dir := p.CameraDir(v.CameraID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create HLS directory: %w", err)
+	}
+	in, err := pathutil.FFmpeg(v.Path)
+	if err != nil {
+		return err
+	}
+	playlist, err := pathutil.FFmpeg(filepath.Join(dir, PlaylistName))
+	if err != nil {
+		return err
+	}
+	ext := ".ts"
+	if p.cfg.SegmentType == FMP4 {
+		ext = ".m4s"
+	}
+	segments, err := pathutil.FFmpeg(filepath.Join(dir, "segment_%06d"+ext))
+	if err != nil {
+		return err
+	}
+
+	seconds := p.cfg.SegmentDuration.Seconds()
+	args := []string{"-y"}
+	if p.transcode {
+		enc := videocodec.Select(p.codec, p.logger)
+		args = append(args, enc.InputArgs()...)
+		args = append(args, "-i", in, "-map", "0:v:0", "-an")
+		// yuv420p needs even dimensions, which MJPEG sources may lack
+		args = append(args, enc.FilterArgs("scale=trunc(iw/2)*2:trunc(ih/2)*2")...)
+		args = append(args, enc.FastArgs()...)
+		// Segments can only start on a keyframe
+		args = append(args, "-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%g)", seconds))
+	} else {
+		args = append(args, "-i", in, "-map", "0:v:0", "-an", "-c:v", "copy")
+	}
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", strconv.FormatFloat(seconds, 'f', -1, 64),
+		"-hls_list_size", strconv.Itoa(p.cfg.PlaylistSize),
+		"-hls_segment_type", p.cfg.SegmentType,
+		// Continue the playlist the previous video left, marking the
+		// break between the two, and keep it open for the next one
+		"-hls_flags", "append_list+delete_segments+discont_start+omit_endlist",
+		"-hls_segment_filename", segments)
+	if p.cfg.SegmentType == FMP4 {
+		args = append(args, "-hls_fmp4_init_filename", "init.mp4")
+	}
+	args = append(args, playlist)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	p.logger.Debug("Running FFmpeg command",
+		zap.String("command", fmt.Sprintf("ffmpeg %s", strings.Join(args, " "))))
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg error: %v\nOutput: %s", err, stderr.String())
+	}
+	return nil
+}
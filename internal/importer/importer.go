@@ -0,0 +1,202 @@
+// Package importer registers footage recorded elsewhere, such as the output
+// of an older system, in the recording index so it can be searched and
+// played back like live recordings.
+package importer
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/framestore"
+	"github.com/raeeceip/cctv/internal/index"
+	"github.com/raeeceip/cctv/internal/site"
+	"github.com/raeeceip/cctv/pkg/pathutil"
+)
+
+type pattern struct {
+	re     *regexp.Regexp
+	layout string
+}
+
+// Importer walks directories and adds the footage it recognizes to an index.
+type Importer struct {
+	index    *index.Index
+	patterns []pattern
+
+	// Camera overrides the camera ID inferred from file names
+	Camera string
+	// Site qualifies the camera IDs that don't have a site yet
+	Site string
+	// Layout is how frames are laid out in directories, to find the camera
+	// directory of those neither a pattern nor Camera names the camera of
+	Layout framestore.Layout
+	// DryRun reports what would be imported without writing to the index
+	DryRun bool
+}
+
+// Result summarizes an Import run.
+type Result struct {
+	Imported int
+	Skipped  int // files no pattern matched
+	Failed   int
+}
+
+// New compiles the configured patterns.
+func New(ix *index.Index, cfg config.ImportConfig) (*Importer, error) {
+	im := &Importer{index: ix}
+	for _, p := range cfg.Patterns {
+		re, err := regexp.Compile(p.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid import pattern %q: %w", p.Regex, err)
+		}
+		if re.SubexpIndex("time") >= 0 && p.TimeLayout == "" {
+			return nil, fmt.Errorf("import pattern %q has a time group but no time_layout", p.Regex)
+		}
+		im.patterns = append(im.patterns, pattern{re: re, layout: p.TimeLayout})
+	}
+	if len(im.patterns) == 0 {
+		return nil, fmt.Errorf("no import patterns configured")
+	}
+	return im, nil
+}
+
+// Import walks root and registers every MP4 and JPEG a pattern matches.
+// report, if set, is called for each file with the recording it produced or
+// the reason it was not imported.
+func (im *Importer) Import(ctx context.Context, root string, report func(path string, r *index.Recording, err error)) (Result, error) {
+	var res Result
+	if report == nil {
+		report = func(string, *index.Recording, error) {}
+	}
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		r, ok, err := im.recording(path)
+		if !ok {
+			res.Skipped++
+			return nil
+		}
+		if err == nil && !im.DryRun {
+			err = im.index.AddRecording(ctx, r)
+		}
+		if err != nil {
+			res.Failed++
+		} else {
+			res.Imported++
+		}
+		report(path, r, err)
+		return nil
+	})
+	return res, err
+}
+
+// recording builds the index entry for path. ok is false when the file is
+// not footage or no pattern matches its name.
+func (im *Importer) recording(path string) (*index.Recording, bool, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".mp4" && ext != ".jpg" && ext != ".jpeg" {
+		return nil, false, nil
+	}
+
+	name := filepath.Base(path)
+	for _, p := range im.patterns {
+		m := p.re.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, true, err
+		}
+		info, err := os.Stat(abs)
+		if err != nil {
+			return nil, true, err
+		}
+
+		r := &index.Recording{
+			CameraID:   im.Camera,
+			Path:       abs,
+			StartTime:  info.ModTime(),
+			FrameCount: 1,
+			SizeBytes:  info.Size(),
+			Codec:      "jpeg",
+		}
+		if i := p.re.SubexpIndex("camera"); r.CameraID == "" && i >= 0 {
+			r.CameraID = m[i]
+		}
+		if r.CameraID == "" {
+			r.CameraID = framestore.CameraID(abs, im.Layout)
+		}
+		r.CameraID = site.Qualify(im.Site, r.CameraID)
+		if i := p.re.SubexpIndex("time"); i >= 0 {
+			if r.StartTime, err = time.ParseInLocation(p.layout, m[i], time.Local); err != nil {
+				return nil, true, fmt.Errorf("bad timestamp in %s: %w", name, err)
+			}
+		}
+
+		r.EndTime = r.StartTime
+		if ext == ".mp4" {
+			// Without ffprobe the video is indexed as a single instant
+			r.FrameCount = 0
+			r.Codec = ""
+			if d, codec, err := probe(abs); err == nil {
+				r.EndTime = r.StartTime.Add(d)
+				r.Codec = codec
+			}
+		}
+		return r, true, nil
+	}
+	return nil, false, nil
+}
+
+// probe returns the duration and video codec of a media file.
+func probe(path string) (time.Duration, string, error) {
+	p, err := pathutil.FFmpeg(path)
+	if err != nil {
+		return 0, "", err
+	}
+
+	cmd := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "format=duration:stream=codec_name",
+		"-of", "default=noprint_wrappers=1", p)
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, "", fmt.Errorf("ffprobe failed: %w", err)
+	}
+
+	var duration time.Duration
+	var codec string
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), "=")
+		switch key {
+		case "codec_name":
+			codec = value
+		case "duration":
+			secs, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return 0, "", fmt.Errorf("unexpected ffprobe duration %q", value)
+			}
+			duration = time.Duration(secs * float64(time.Second))
+		}
+	}
+	return duration, codec, nil
+}
@@ -0,0 +1,92 @@
+package index
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// CameraBan refuses a camera's connections.
+type CameraBan struct {
+	CameraID  string     `json:"camera_id"`
+	Reason    string     `json:"reason,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // nil for a permanent ban
+}
+
+const cameraBanColumns = `camera_id, reason, created_at, expires_at`
+
+func scanCameraBan(row scanner) (*CameraBan, error) {
+	var b CameraBan
+	var created, expires int64
+	if err := row.Scan(&b.CameraID, &b.Reason, &created, &expires); err != nil {
+		return nil, err
+	}
+	b.CreatedAt = fromMillis(created)
+	if expires != 0 {
+		at := fromMillis(expires)
+		b.ExpiresAt = &at
+	}
+	return &b, nil
+}
+
+// BanCamera bans a camera, replacing any ban it already has.
+func (ix *Index) BanCamera(ctx context.Context, b *CameraBan) error {
+	if b.CreatedAt.IsZero() {
+		b.CreatedAt = time.Now()
+	}
+	var expires int64
+	if b.ExpiresAt != nil {
+		expires = toMillis(*b.ExpiresAt)
+	}
+	_, err := ix.db.ExecContext(ctx, `
+		INSERT OR REPLACE INTO camera_bans (camera_id, reason, created_at, expires_at)
+		VALUES (?, ?, ?, ?)`,
+		b.CameraID, b.Reason, toMillis(b.CreatedAt), expires)
+	if err != nil {
+		return fmt.Errorf("failed to ban camera: %w", err)
+	}
+	return nil
+}
+
+// CameraBan returns a camera's ban in force at now, or sql.ErrNoRows.
+func (ix *Index) CameraBan(ctx context.Context, cameraID string, now time.Time) (*CameraBan, error) {
+	return scanCameraBan(ix.db.QueryRowContext(ctx,
+		`SELECT `+cameraBanColumns+` FROM camera_bans
+		WHERE camera_id = ? AND (expires_at = 0 OR expires_at > ?)`, cameraID, toMillis(now)))
+}
+
+// ListCameraBans returns the bans in force at now, by camera.
+func (ix *Index) ListCameraBans(ctx context.Context, now time.Time) ([]CameraBan, error) {
+	rows, err := ix.db.QueryContext(ctx,
+		`SELECT `+cameraBanColumns+` FROM camera_bans
+		WHERE expires_at = 0 OR expires_at > ? ORDER BY camera_id`, toMillis(now))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list camera bans: %w", err)
+	}
+	defer rows.Close()
+
+	var bans []CameraBan
+	for rows.Next() {
+		b, err := scanCameraBan(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read camera ban: %w", err)
+		}
+		bans = append(bans, *b)
+	}
+	return bans, rows.Err()
+}
+
+// UnbanCamera lifts a camera's ban, returning sql.ErrNoRows if it has
+// none.
+func (ix *Index) UnbanCamera(ctx context.Context, cameraID string) error {
+	res, err := ix.db.ExecContext(ctx, `DELETE FROM camera_bans WHERE camera_id = ?`, cameraID)
+	if err != nil {
+		return fmt.Errorf("failed to unban camera: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
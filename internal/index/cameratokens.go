@@ -0,0 +1,97 @@
+package index
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// CameraToken describes a token a camera connects with. The token itself
+// is never stored.
+type CameraToken struct {
+	ID         int64      `json:"id"`
+	CameraID   string     `json:"camera_id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+const cameraTokenColumns = `id, camera_id, name, created_at, last_used_at`
+
+func scanCameraToken(row scanner) (*CameraToken, error) {
+	var t CameraToken
+	var created, used int64
+	if err := row.Scan(&t.ID, &t.CameraID, &t.Name, &created, &used); err != nil {
+		return nil, err
+	}
+	t.CreatedAt = fromMillis(created)
+	if used != 0 {
+		at := fromMillis(used)
+		t.LastUsedAt = &at
+	}
+	return &t, nil
+}
+
+// CreateCameraToken stores a camera token by the hash of its secret and
+// sets t.ID.
+func (ix *Index) CreateCameraToken(ctx context.Context, t *CameraToken, hash string) error {
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = time.Now()
+	}
+	row := ix.db.QueryRowContext(ctx, `
+		INSERT INTO camera_tokens (camera_id, name, hash, created_at)
+		VALUES (?, ?, ?, ?) RETURNING id`,
+		t.CameraID, t.Name, hash, toMillis(t.CreatedAt))
+	if err := row.Scan(&t.ID); err != nil {
+		return fmt.Errorf("failed to create camera token: %w", err)
+	}
+	return nil
+}
+
+// ListCameraTokens returns a camera's tokens, newest first.
+func (ix *Index) ListCameraTokens(ctx context.Context, cameraID string) ([]CameraToken, error) {
+	rows, err := ix.db.QueryContext(ctx,
+		`SELECT `+cameraTokenColumns+` FROM camera_tokens WHERE camera_id = ? ORDER BY id DESC`, cameraID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list camera tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []CameraToken
+	for rows.Next() {
+		t, err := scanCameraToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read camera token: %w", err)
+		}
+		tokens = append(tokens, *t)
+	}
+	return tokens, rows.Err()
+}
+
+// CameraTokenByHash returns the camera token with the given hash, or
+// sql.ErrNoRows.
+func (ix *Index) CameraTokenByHash(ctx context.Context, hash string) (*CameraToken, error) {
+	return scanCameraToken(ix.db.QueryRowContext(ctx,
+		`SELECT `+cameraTokenColumns+` FROM camera_tokens WHERE hash = ?`, hash))
+}
+
+// TouchCameraToken records that a camera token was used at.
+func (ix *Index) TouchCameraToken(ctx context.Context, id int64, at time.Time) error {
+	_, err := ix.db.ExecContext(ctx, `UPDATE camera_tokens SET last_used_at = ? WHERE id = ?`, toMillis(at), id)
+	return err
+}
+
+// DeleteCameraToken revokes one of a camera's tokens, returning
+// sql.ErrNoRows if the camera has no such token.
+func (ix *Index) DeleteCameraToken(ctx context.Context, cameraID string, id int64) error {
+	res, err := ix.db.ExecContext(ctx,
+		`DELETE FROM camera_tokens WHERE id = ? AND camera_id = ?`, id, cameraID)
+	if err != nil {
+		return fmt.Errorf("failed to delete camera token: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/site"
+)
+
+// DayLayout formats the days of daily statistics.
+const DayLayout = "2006-01-02"
+
+// DailyStats summarize a camera's footage over one day of local time.
+type DailyStats struct {
+	CameraID   string `json:"camera_id"`
+	Day        string `json:"day"`
+	Recordings int    `json:"recordings"`
+	// RecordedHours is the time the camera's recordings cover
+	RecordedHours float64 `json:"recorded_hours"`
+	// GapMinutes is the time between its first and last recording of the
+	// day that no recording covers
+	GapMinutes float64 `json:"gap_minutes"`
+	// MotionMinutes counts the minutes with at least one motion event
+	MotionMinutes int `json:"motion_minutes"`
+	// StorageBytes is the size of the recordings started that day
+	StorageBytes int64     `json:"storage_bytes"`
+	RolledUpAt   time.Time `json:"rolled_up_at"`
+}
+
+// DailyStatsQuery filters ListDailyStats. Zero fields match everything;
+// From and To are days, inclusive.
+type DailyStatsQuery struct {
+	CameraID string
+	Site     string
+	From     string
+	To       string
+}
+
+// RollupDay computes the statistics of every camera for the local day
+// containing day, replacing any computed before, and returns how many
+// cameras had footage or motion. Recordings retention has deleted are gone
+// from the statistics too, so days are rolled up once they are over.
+func (ix *Index) RollupDay(ctx context.Context, day time.Time) (int, error) {
+	day = day.Local()
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.Local)
+	end := start.AddDate(0, 0, 1)
+	stats := make(map[string]*DailyStats)
+	camera := func(id string) *DailyStats {
+		if stats[id] == nil {
+			stats[id] = &DailyStats{CameraID: id, Day: start.Format(DayLayout)}
+		}
+		return stats[id]
+	}
+
+	rows, err := ix.db.QueryContext(ctx, `
+		SELECT camera_id, start_time, end_time, size_bytes FROM recordings
+		WHERE deleted_at IS NULL AND start_time < ? AND end_time > ?
+		ORDER BY camera_id, start_time`,
+		toMillis(end), toMillis(start))
+	if err != nil {
+		return 0, fmt.Errorf("failed to roll up recordings: %w", err)
+	}
+	// Recordings overlap, e.g. imported ones, so each camera's covered
+	// time is the union of its recordings
+	var covered struct {
+		camera     string
+		first, end time.Time
+		recorded   time.Duration
+	}
+	flush := func() {
+		if covered.camera != "" {
+			s := camera(covered.camera)
+			s.RecordedHours = covered.recorded.Hours()
+			s.GapMinutes = (covered.end.Sub(covered.first) - covered.recorded).Minutes()
+		}
+	}
+	for rows.Next() {
+		var id string
+		var from, to, size int64
+		if err := rows.Scan(&id, &from, &to, &size); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to roll up recordings: %w", err)
+		}
+		rs, re := fromMillis(from), fromMillis(to)
+		s := camera(id)
+		s.Recordings++
+		if !rs.Before(start) {
+			s.StorageBytes += size
+		}
+		if rs.Before(start) {
+			rs = start
+		}
+		if re.After(end) {
+			re = end
+		}
+		if id != covered.camera {
+			flush()
+			covered.camera, covered.first, covered.end, covered.recorded = id, rs, rs, 0
+		}
+		if rs.Before(covered.end) {
+			rs = covered.end
+		}
+		if re.After(rs) {
+			covered.recorded += re.Sub(rs)
+			covered.end = re
+		}
+	}
+	flush()
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to roll up recordings: %w", err)
+	}
+
+	rows, err = ix.db.QueryContext(ctx, `
+		SELECT camera_id, COUNT(DISTINCT time / 60000) FROM motion_events
+		WHERE time >= ? AND time < ? GROUP BY camera_id`,
+		toMillis(start), toMillis(end))
+	if err != nil {
+		return 0, fmt.Errorf("failed to roll up motion events: %w", err)
+	}
+	for rows.Next() {
+		var id string
+		var minutes int
+		if err := rows.Scan(&id, &minutes); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to roll up motion events: %w", err)
+		}
+		camera(id).MotionMinutes = minutes
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to roll up motion events: %w", err)
+	}
+
+	tx, err := ix.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save daily stats: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM daily_stats WHERE day = ?`, start.Format(DayLayout)); err != nil {
+		return 0, fmt.Errorf("failed to save daily stats: %w", err)
+	}
+	now := toMillis(time.Now())
+	for _, s := range stats {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO daily_stats (camera_id, day, recordings, recorded_seconds, gap_seconds,
+				motion_minutes, storage_bytes, rolled_up_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			s.CameraID, s.Day, s.Recordings, s.RecordedHours*3600, s.GapMinutes*60,
+			s.MotionMinutes, s.StorageBytes, now); err != nil {
+			return 0, fmt.Errorf("failed to save daily stats: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to save daily stats: %w", err)
+	}
+	return len(stats), nil
+}
+
+// RolledUpDays returns which of the days from from to to, inclusive, have
+// statistics.
+func (ix *Index) RolledUpDays(ctx context.Context, from, to string) (map[string]bool, error) {
+	rows, err := ix.db.QueryContext(ctx,
+		`SELECT DISTINCT day FROM daily_stats WHERE day >= ? AND day <= ?`, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rolled up days: %w", err)
+	}
+	defer rows.Close()
+	days := make(map[string]bool)
+	for rows.Next() {
+		var day string
+		if err := rows.Scan(&day); err != nil {
+			return nil, fmt.Errorf("failed to list rolled up days: %w", err)
+		}
+		days[day] = true
+	}
+	return days, rows.Err()
+}
+
+// ListDailyStats returns matching statistics by day, then camera.
+func (ix *Index) ListDailyStats(ctx context.Context, q DailyStatsQuery) ([]DailyStats, error) {
+	query := `SELECT camera_id, day, recordings, recorded_seconds, gap_seconds, motion_minutes,
+		storage_bytes, rolled_up_at FROM daily_stats WHERE 1 = 1`
+	var args []interface{}
+	if q.CameraID != "" {
+		query += ` AND camera_id = ?`
+		args = append(args, q.CameraID)
+	}
+	if q.Site != "" {
+		prefix := site.Prefix(q.Site)
+		query += ` AND substr(camera_id, 1, ?) = ?`
+		args = append(args, len(prefix), prefix)
+	}
+	if q.From != "" {
+		query += ` AND day >= ?`
+		args = append(args, q.From)
+	}
+	if q.To != "" {
+		query += ` AND day <= ?`
+		args = append(args, q.To)
+	}
+	query += ` ORDER BY day, camera_id`
+
+	rows, err := ix.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list daily stats: %w", err)
+	}
+	defer rows.Close()
+
+	var stats []DailyStats
+	for rows.Next() {
+		var s DailyStats
+		var recorded, gap float64
+		var rolledUp int64
+		if err := rows.Scan(&s.CameraID, &s.Day, &s.Recordings, &recorded, &gap,
+			&s.MotionMinutes, &s.StorageBytes, &rolledUp); err != nil {
+			return nil, fmt.Errorf("failed to read daily stats: %w", err)
+		}
+		s.RecordedHours = recorded / 3600
+		s.GapMinutes = gap / 60
+		s.RolledUpAt = fromMillis(rolledUp)
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
@@ -0,0 +1,258 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/wire"
+)
+
+// Frame is a single stored JPEG.
+type Frame struct {
+	CameraID  string
+	Number    uint64
+	Time      time.Time
+	Path      string
+	SizeBytes int64
+	// Location is where a mobile camera took the frame
+	Location *wire.Location
+}
+
+// AddFrames inserts frames in one transaction.
+func (ix *Index) AddFrames(ctx context.Context, frames []Frame) error {
+	tx, err := ix.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to add frames: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx,
+		`INSERT INTO frames (camera_id, number, time, path, size_bytes, latitude, longitude, altitude, heading, speed)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("failed to add frames: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, f := range frames {
+		// Frames without a location leave its columns NULL
+		loc := make([]interface{}, 5)
+		if l := f.Location; l != nil {
+			loc = []interface{}{l.Latitude, l.Longitude, l.Altitude, l.Heading, l.Speed}
+		}
+		if _, err := stmt.ExecContext(ctx, append([]interface{}{f.CameraID, f.Number, toMillis(f.Time), f.Path, f.SizeBytes}, loc...)...); err != nil {
+			return fmt.Errorf("failed to add frames: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to add frames: %w", err)
+	}
+	return nil
+}
+
+// TrackPoint is where a camera was when it took a frame.
+type TrackPoint struct {
+	Time     time.Time     `json:"time"`
+	Number   uint64        `json:"number"`
+	Location wire.Location `json:"location"`
+}
+
+// FrameTrack returns the locations of a camera's frames, oldest first.
+// Zero since and until leave the range open; limit, if positive, caps the
+// number of points.
+func (ix *Index) FrameTrack(ctx context.Context, cameraID string, since, until time.Time, limit int) ([]TrackPoint, error) {
+	query := `SELECT time, number, latitude, longitude, altitude, heading, speed FROM frames
+		WHERE camera_id = ? AND latitude IS NOT NULL`
+	args := []interface{}{cameraID}
+	if !since.IsZero() {
+		query += ` AND time >= ?`
+		args = append(args, toMillis(since))
+	}
+	if !until.IsZero() {
+		query += ` AND time < ?`
+		args = append(args, toMillis(until))
+	}
+	query += ` ORDER BY time`
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+	rows, err := ix.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get frame track: %w", err)
+	}
+	defer rows.Close()
+
+	var track []TrackPoint
+	for rows.Next() {
+		var p TrackPoint
+		var t int64
+		l := &p.Location
+		if err := rows.Scan(&t, &p.Number, &l.Latitude, &l.Longitude, &l.Altitude, &l.Heading, &l.Speed); err != nil {
+			return nil, fmt.Errorf("failed to read frame track: %w", err)
+		}
+		p.Time = fromMillis(t)
+		track = append(track, p)
+	}
+	return track, rows.Err()
+}
+
+// ListFrames returns a camera's frames taken before until, or all of them
+// if it is zero, in frame number order. Locations are left out.
+func (ix *Index) ListFrames(ctx context.Context, cameraID string, until time.Time) ([]Frame, error) {
+	query := `SELECT number, time, path, size_bytes FROM frames WHERE camera_id = ?`
+	args := []interface{}{cameraID}
+	if !until.IsZero() {
+		query += ` AND time < ?`
+		args = append(args, toMillis(until))
+	}
+	query += ` ORDER BY number`
+	rows, err := ix.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list frames: %w", err)
+	}
+	defer rows.Close()
+
+	var frames []Frame
+	for rows.Next() {
+		f := Frame{CameraID: cameraID}
+		var t int64
+		if err := rows.Scan(&f.Number, &t, &f.Path, &f.SizeBytes); err != nil {
+			return nil, fmt.Errorf("failed to read frame: %w", err)
+		}
+		f.Time = fromMillis(t)
+		frames = append(frames, f)
+	}
+	return frames, rows.Err()
+}
+
+// DeleteFrames removes the frames of a camera taken between from and to,
+// inclusive, e.g. once they have been consolidated and deleted.
+func (ix *Index) DeleteFrames(ctx context.Context, cameraID string, from, to time.Time) (int64, error) {
+	res, err := ix.db.ExecContext(ctx,
+		`DELETE FROM frames WHERE camera_id = ? AND time BETWEEN ? AND ?`,
+		cameraID, toMillis(from), toMillis(to))
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete frames: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// PruneFrames deletes frames taken before cutoff.
+func (ix *Index) PruneFrames(ctx context.Context, cutoff time.Time) (int64, error) {
+	res, err := ix.db.ExecContext(ctx, `DELETE FROM frames WHERE time < ?`, toMillis(cutoff))
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune frames: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// FrameWriter collects frames and writes them with AddFrames in group
+// commits, either once BatchSize frames are pending or every FlushInterval,
+// so the index keeps up with every camera's frame rate.
+type FrameWriter struct {
+	ix            *Index
+	batchSize     int
+	flushInterval time.Duration
+	// maxPending bounds memory while the database is slow; further frames
+	// are dropped and counted
+	maxPending int
+
+	mu      sync.Mutex
+	pending []Frame
+	dropped int
+	full    chan struct{}
+
+	// Totals since the writer was created
+	written      atomic.Int64
+	droppedTotal atomic.Int64
+	// flushMu keeps batches in order
+	flushMu sync.Mutex
+}
+
+func (ix *Index) NewFrameWriter(batchSize int, flushInterval time.Duration) *FrameWriter {
+	return &FrameWriter{
+		ix:            ix,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		maxPending:    batchSize * 20,
+		pending:       make([]Frame, 0, batchSize),
+		full:          make(chan struct{}, 1),
+	}
+}
+
+// Add queues a frame. It never blocks on the database.
+func (w *FrameWriter) Add(f Frame) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.pending) >= w.maxPending {
+		w.dropped++
+		w.droppedTotal.Add(1)
+		return
+	}
+	w.pending = append(w.pending, f)
+	if len(w.pending) >= w.batchSize {
+		select {
+		case w.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run writes batches until ctx is cancelled. onError reports failed
+// batches, which are not retried.
+func (w *FrameWriter) Run(ctx context.Context, onError func(error)) {
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.full:
+		case <-ticker.C:
+		}
+		if err := w.Flush(ctx); err != nil {
+			onError(err)
+		}
+	}
+}
+
+// Flush writes everything pending.
+func (w *FrameWriter) Flush(ctx context.Context) error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.mu.Lock()
+	batch := w.pending
+	dropped := w.dropped
+	w.pending = make([]Frame, 0, w.batchSize)
+	w.dropped = 0
+	w.mu.Unlock()
+
+	// A backlog goes in batch-sized transactions
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > w.batchSize {
+			n = w.batchSize
+		}
+		if err := w.ix.AddFrames(ctx, batch[:n]); err != nil {
+			return fmt.Errorf("lost %d frames: %w", len(batch), err)
+		}
+		w.written.Add(int64(n))
+		batch = batch[n:]
+	}
+	if dropped > 0 {
+		return fmt.Errorf("dropped %d frames while the index was behind", dropped)
+	}
+	return nil
+}
+
+// Stats returns how many frames were written and dropped so far.
+func (w *FrameWriter) Stats() (written, dropped int64) {
+	return w.written.Load(), w.droppedTotal.Load()
+}
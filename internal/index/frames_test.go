@@ -0,0 +1,51 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// BenchmarkFrameWriter measures how many frames a second the frame index
+// takes in group commits of 500, as the server writes them. It has to
+// keep well above 1000 for 64 cameras at 30 fps to keep up.
+func BenchmarkFrameWriter(b *testing.B) {
+	ctx := context.Background()
+	ix, _, err := OpenAndMigrate(ctx, filepath.Join(b.TempDir(), "index.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ix.Close()
+
+	const batch = 500
+	w := ix.NewFrameWriter(batch, time.Second)
+	start := time.Unix(1700000000, 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		camera := i % 64
+		n := uint64(i/64 + 1)
+		w.Add(Frame{
+			CameraID:  fmt.Sprintf("cam%d", camera),
+			Number:    n,
+			Time:      start.Add(time.Duration(n) * time.Second / 30),
+			Path:      fmt.Sprintf("cam%d/frame_%05d.jpg", camera, n),
+			SizeBytes: 48 << 10,
+		})
+		if (i+1)%batch == 0 {
+			if err := w.Flush(ctx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	if err := w.Flush(ctx); err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+
+	if written, dropped := w.Stats(); written != int64(b.N) || dropped != 0 {
+		b.Fatalf("wrote %d and dropped %d of %d frames", written, dropped, b.N)
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "frames/s")
+}
@@ -0,0 +1,78 @@
+// Package index keeps a SQLite database of recorded footage so it can be
+// queried without walking the frame store.
+package index
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+type Index struct {
+	db *sql.DB
+}
+
+// Open opens the index database at path without touching its schema. Use
+// Migrate to bring the schema up to date.
+func Open(path string) (*Index, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create index directory: %w", err)
+	}
+
+	// WAL lets readers run alongside the frame writer's group commits, and
+	// with it synchronous=NORMAL only syncs at checkpoints
+	dsn := fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)"+
+		"&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open index: %w", err)
+	}
+
+	return &Index{db: db}, nil
+}
+
+// OpenAndMigrate opens the index and applies all pending migrations, as the
+// server does at startup.
+func OpenAndMigrate(ctx context.Context, path string) (*Index, []Migration, error) {
+	ix, err := Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	applied, err := ix.Migrate(ctx)
+	if err != nil {
+		ix.Close()
+		return nil, nil, err
+	}
+	return ix, applied, nil
+}
+
+func (ix *Index) Close() error {
+	return ix.db.Close()
+}
+
+// Times are stored as Unix milliseconds so range queries compare integers.
+func toMillis(t time.Time) int64 {
+	return t.UnixMilli()
+}
+
+func fromMillis(ms int64) time.Time {
+	return time.UnixMilli(ms)
+}
+
+// Snapshot writes a consistent copy of the database to path, which must not
+// exist. It is safe to call while the server is writing.
+func (ix *Index) Snapshot(ctx context.Context, path string) error {
+	if _, err := ix.db.ExecContext(ctx, `VACUUM INTO ?`, path); err != nil {
+		return fmt.Errorf("failed to snapshot index: %w", err)
+	}
+	return nil
+}
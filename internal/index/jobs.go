@@ -0,0 +1,199 @@
+package index
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Job states
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// Job is a queued unit of background work. Payload is JSON interpreted by
+// the handler registered for Kind.
+type Job struct {
+	ID        int64     `json:"id"`
+	Kind      string    `json:"kind"`
+	Key       string    `json:"key,omitempty"`
+	Payload   string    `json:"payload"`
+	Status    string    `json:"status"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error,omitempty"`
+	RunAt     time.Time `json:"run_at"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+const jobColumns = `id, kind, key, payload, status, attempts, error, run_at, created_at, updated_at`
+
+func scanJob(row scanner) (*Job, error) {
+	var j Job
+	var runAt, created, updated int64
+	if err := row.Scan(&j.ID, &j.Kind, &j.Key, &j.Payload, &j.Status,
+		&j.Attempts, &j.Error, &runAt, &created, &updated); err != nil {
+		return nil, err
+	}
+	j.RunAt = fromMillis(runAt)
+	j.CreatedAt = fromMillis(created)
+	j.UpdatedAt = fromMillis(updated)
+	return &j, nil
+}
+
+// EnqueueJob adds j as pending and sets j.ID. When j.Key is set and a job
+// with the same key is already pending or running, nothing is added and
+// false is returned.
+func (ix *Index) EnqueueJob(ctx context.Context, j *Job) (bool, error) {
+	now := time.Now()
+	if j.RunAt.IsZero() {
+		j.RunAt = now
+	}
+	if j.Payload == "" {
+		j.Payload = "{}"
+	}
+	j.Status = JobPending
+	j.CreatedAt = now
+	j.UpdatedAt = now
+
+	err := ix.db.QueryRowContext(ctx, `
+		INSERT INTO jobs (kind, key, payload, status, run_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT DO NOTHING
+		RETURNING id`,
+		j.Kind, j.Key, j.Payload, j.Status, toMillis(j.RunAt), toMillis(now), toMillis(now)).
+		Scan(&j.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to enqueue job: %w", err)
+	}
+	return true, nil
+}
+
+// ClaimJob marks the oldest due pending job as running and returns it, or
+// nil when nothing is due.
+func (ix *Index) ClaimJob(ctx context.Context) (*Job, error) {
+	now := toMillis(time.Now())
+	j, err := scanJob(ix.db.QueryRowContext(ctx, `
+		UPDATE jobs SET status = ?, attempts = attempts + 1, updated_at = ?
+		WHERE id = (
+			SELECT id FROM jobs WHERE status = ? AND run_at <= ?
+			ORDER BY run_at, id LIMIT 1
+		)
+		RETURNING `+jobColumns,
+		JobRunning, now, JobPending, now))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim job: %w", err)
+	}
+	return j, nil
+}
+
+// FinishJob records the outcome of a running job. A failed job is retried
+// at retryAt unless retryAt is zero.
+func (ix *Index) FinishJob(ctx context.Context, id int64, jobErr error, retryAt time.Time) error {
+	status, msg, runAt := JobDone, "", time.Now()
+	if jobErr != nil {
+		msg = jobErr.Error()
+		status = JobFailed
+		if !retryAt.IsZero() {
+			status, runAt = JobPending, retryAt
+		}
+	}
+
+	_, err := ix.db.ExecContext(ctx,
+		`UPDATE jobs SET status = ?, error = ?, run_at = ?, updated_at = ? WHERE id = ?`,
+		status, msg, toMillis(runAt), toMillis(time.Now()), id)
+	if err != nil {
+		return fmt.Errorf("failed to update job: %w", err)
+	}
+	return nil
+}
+
+// RequeueRunningJobs returns jobs left running by a previous process to the
+// queue.
+func (ix *Index) RequeueRunningJobs(ctx context.Context) (int64, error) {
+	res, err := ix.db.ExecContext(ctx,
+		`UPDATE jobs SET status = ?, updated_at = ? WHERE status = ?`,
+		JobPending, toMillis(time.Now()), JobRunning)
+	if err != nil {
+		return 0, fmt.Errorf("failed to requeue jobs: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// ListJobs returns the most recent jobs, optionally only those in status.
+func (ix *Index) ListJobs(ctx context.Context, status string, limit int) ([]Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM jobs`
+	var args []interface{}
+	if status != "" {
+		query += ` WHERE status = ?`
+		args = append(args, status)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := ix.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read job: %w", err)
+		}
+		jobs = append(jobs, *j)
+	}
+	return jobs, rows.Err()
+}
+
+// LatestJob returns the newest job with key, or sql.ErrNoRows if there is
+// none.
+func (ix *Index) LatestJob(ctx context.Context, key string) (*Job, error) {
+	return scanJob(ix.db.QueryRowContext(ctx,
+		`SELECT `+jobColumns+` FROM jobs WHERE key = ? ORDER BY id DESC LIMIT 1`, key))
+}
+
+// CountJobs returns the number of jobs in status for each kind that has any.
+func (ix *Index) CountJobs(ctx context.Context, status string) (map[string]int, error) {
+	rows, err := ix.db.QueryContext(ctx,
+		`SELECT kind, COUNT(*) FROM jobs WHERE status = ? GROUP BY kind`, status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count jobs: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var kind string
+		var n int
+		if err := rows.Scan(&kind, &n); err != nil {
+			return nil, fmt.Errorf("failed to read job count: %w", err)
+		}
+		counts[kind] = n
+	}
+	return counts, rows.Err()
+}
+
+// PruneJobs deletes finished jobs last updated before cutoff.
+func (ix *Index) PruneJobs(ctx context.Context, cutoff time.Time) (int64, error) {
+	res, err := ix.db.ExecContext(ctx,
+		`DELETE FROM jobs WHERE status IN (?, ?) AND updated_at < ?`,
+		JobDone, JobFailed, toMillis(cutoff))
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune jobs: %w", err)
+	}
+	return res.RowsAffected()
+}
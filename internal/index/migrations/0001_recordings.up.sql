@@ -0,0 +1,13 @@
+CREATE TABLE recordings (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    camera_id   TEXT    NOT NULL,
+    path        TEXT    NOT NULL UNIQUE,
+    start_time  INTEGER NOT NULL,
+    end_time    INTEGER NOT NULL,
+    frame_count INTEGER NOT NULL DEFAULT 0,
+    size_bytes  INTEGER NOT NULL DEFAULT 0,
+    codec       TEXT    NOT NULL DEFAULT '',
+    created_at  INTEGER NOT NULL
+);
+
+CREATE INDEX idx_recordings_camera_start ON recordings (camera_id, start_time);
@@ -0,0 +1,18 @@
+CREATE TABLE jobs (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    kind       TEXT    NOT NULL,
+    key        TEXT    NOT NULL DEFAULT '',
+    payload    TEXT    NOT NULL DEFAULT '{}',
+    status     TEXT    NOT NULL DEFAULT 'pending',
+    attempts   INTEGER NOT NULL DEFAULT 0,
+    error      TEXT    NOT NULL DEFAULT '',
+    run_at     INTEGER NOT NULL,
+    created_at INTEGER NOT NULL,
+    updated_at INTEGER NOT NULL
+);
+
+CREATE INDEX idx_jobs_status_run_at ON jobs (status, run_at);
+
+-- At most one queued or running job per key
+CREATE UNIQUE INDEX idx_jobs_active_key ON jobs (key)
+    WHERE key <> '' AND status IN ('pending', 'running');
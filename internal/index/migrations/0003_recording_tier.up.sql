@@ -0,0 +1,2 @@
+-- Quality tier applied by retention; 0 is the original recording
+ALTER TABLE recordings ADD COLUMN tier INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,6 @@
+-- Per-camera tuning; each setting group is a JSON document, '' for defaults
+CREATE TABLE camera_profiles (
+    camera_id  TEXT PRIMARY KEY,
+    motion     TEXT    NOT NULL DEFAULT '',
+    updated_at INTEGER NOT NULL
+);
@@ -0,0 +1,11 @@
+-- Individual stored frames, written in batches by FrameWriter
+CREATE TABLE frames (
+    id         INTEGER PRIMARY KEY,
+    camera_id  TEXT    NOT NULL,
+    number     INTEGER NOT NULL,
+    time       INTEGER NOT NULL,
+    path       TEXT    NOT NULL,
+    size_bytes INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX idx_frames_camera_time ON frames (camera_id, time);
@@ -0,0 +1,3 @@
+DROP INDEX idx_recordings_deleted;
+ALTER TABLE recordings DROP COLUMN trash_path;
+ALTER TABLE recordings DROP COLUMN deleted_at;
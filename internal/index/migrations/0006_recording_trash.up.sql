@@ -0,0 +1,6 @@
+-- Soft delete: recordings deleted through the API stay in the trash, with
+-- their file moved to trash_path, until retention purges them
+ALTER TABLE recordings ADD COLUMN deleted_at INTEGER;
+ALTER TABLE recordings ADD COLUMN trash_path TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX idx_recordings_deleted ON recordings (deleted_at);
@@ -0,0 +1,11 @@
+-- Named recording queries; cameras is a JSON array, empty for all cameras.
+-- A window of 0 and since/until of 0 leave that bound open.
+CREATE TABLE saved_searches (
+    id         INTEGER PRIMARY KEY,
+    name       TEXT    NOT NULL UNIQUE,
+    cameras    TEXT    NOT NULL DEFAULT '[]',
+    window_ms  INTEGER NOT NULL DEFAULT 0,
+    since      INTEGER NOT NULL DEFAULT 0,
+    until      INTEGER NOT NULL DEFAULT 0,
+    updated_at INTEGER NOT NULL
+);
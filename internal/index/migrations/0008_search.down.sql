@@ -0,0 +1,7 @@
+DROP TRIGGER search_saved_search_delete;
+DROP TRIGGER search_saved_search_update;
+DROP TRIGGER search_saved_search_insert;
+DROP TRIGGER search_recording_delete;
+DROP TRIGGER search_recording_update;
+DROP TRIGGER search_recording_insert;
+DROP TABLE search;
@@ -0,0 +1,52 @@
+-- Full-text search over the index. Each row is a document of some kind with
+-- ref naming it in that kind's API; time places it on the timeline. The
+-- rowid is the source row's id times 4 plus the kind's number, so triggers
+-- can find a document without scanning:
+--   0 recording     ref is the recording id; trashed recordings are left out
+--   1 saved search  ref is the search name
+CREATE VIRTUAL TABLE search USING fts5(
+    kind UNINDEXED,
+    ref UNINDEXED,
+    camera_id,
+    body,
+    time UNINDEXED
+);
+
+INSERT INTO search (rowid, kind, ref, camera_id, body, time)
+SELECT id * 4, 'recording', id, camera_id, path || ' ' || codec, start_time
+FROM recordings WHERE deleted_at IS NULL;
+
+INSERT INTO search (rowid, kind, ref, camera_id, body, time)
+SELECT id * 4 + 1, 'search', name, cameras, name, updated_at FROM saved_searches;
+
+CREATE TRIGGER search_recording_insert AFTER INSERT ON recordings
+WHEN new.deleted_at IS NULL BEGIN
+    INSERT INTO search (rowid, kind, ref, camera_id, body, time)
+    VALUES (new.id * 4, 'recording', new.id, new.camera_id, new.path || ' ' || new.codec, new.start_time);
+END;
+
+CREATE TRIGGER search_recording_update AFTER UPDATE ON recordings BEGIN
+    DELETE FROM search WHERE rowid = old.id * 4;
+    INSERT INTO search (rowid, kind, ref, camera_id, body, time)
+    SELECT new.id * 4, 'recording', new.id, new.camera_id, new.path || ' ' || new.codec, new.start_time
+    WHERE new.deleted_at IS NULL;
+END;
+
+CREATE TRIGGER search_recording_delete AFTER DELETE ON recordings BEGIN
+    DELETE FROM search WHERE rowid = old.id * 4;
+END;
+
+CREATE TRIGGER search_saved_search_insert AFTER INSERT ON saved_searches BEGIN
+    INSERT INTO search (rowid, kind, ref, camera_id, body, time)
+    VALUES (new.id * 4 + 1, 'search', new.name, new.cameras, new.name, new.updated_at);
+END;
+
+CREATE TRIGGER search_saved_search_update AFTER UPDATE ON saved_searches BEGIN
+    DELETE FROM search WHERE rowid = old.id * 4 + 1;
+    INSERT INTO search (rowid, kind, ref, camera_id, body, time)
+    VALUES (new.id * 4 + 1, 'search', new.name, new.cameras, new.name, new.updated_at);
+END;
+
+CREATE TRIGGER search_saved_search_delete AFTER DELETE ON saved_searches BEGIN
+    DELETE FROM search WHERE rowid = old.id * 4 + 1;
+END;
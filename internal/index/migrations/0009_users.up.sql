@@ -0,0 +1,24 @@
+-- API users and their preferences; notifications is a JSON object
+CREATE TABLE users (
+    id                   INTEGER PRIMARY KEY,
+    name                 TEXT    NOT NULL UNIQUE,
+    timezone             TEXT    NOT NULL DEFAULT '',
+    default_camera_group TEXT    NOT NULL DEFAULT '',
+    notifications        TEXT    NOT NULL DEFAULT '{}',
+    created_at           INTEGER NOT NULL
+);
+
+-- Bearer tokens of users. Only the SHA-256 of a token is kept; scopes is a
+-- JSON array. 0 in expires_at or last_used_at means never.
+CREATE TABLE api_tokens (
+    id           INTEGER PRIMARY KEY,
+    user_id      INTEGER NOT NULL REFERENCES users (id),
+    name         TEXT    NOT NULL DEFAULT '',
+    hash         TEXT    NOT NULL UNIQUE,
+    scopes       TEXT    NOT NULL DEFAULT '[]',
+    created_at   INTEGER NOT NULL,
+    expires_at   INTEGER NOT NULL DEFAULT 0,
+    last_used_at INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX idx_api_tokens_user ON api_tokens (user_id);
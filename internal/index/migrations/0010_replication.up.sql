@@ -0,0 +1,14 @@
+-- Recordings pushed to the replication peer
+CREATE TABLE replicated (
+    recording_id  INTEGER PRIMARY KEY REFERENCES recordings (id) ON DELETE CASCADE,
+    replicated_at INTEGER NOT NULL
+);
+
+-- Recordings received from other servers, which are not pushed on
+CREATE TABLE replicas (
+    recording_id INTEGER PRIMARY KEY REFERENCES recordings (id) ON DELETE CASCADE,
+    origin       TEXT    NOT NULL,
+    origin_id    INTEGER NOT NULL,
+    received_at  INTEGER NOT NULL,
+    UNIQUE (origin, origin_id)
+);
@@ -0,0 +1,13 @@
+-- Tokens cameras present on /camera/connect. Each belongs to one camera ID,
+-- which the camera then connects as. Only the SHA-256 of a token is kept;
+-- 0 in last_used_at means never.
+CREATE TABLE camera_tokens (
+    id           INTEGER PRIMARY KEY,
+    camera_id    TEXT    NOT NULL,
+    name         TEXT    NOT NULL DEFAULT '',
+    hash         TEXT    NOT NULL UNIQUE,
+    created_at   INTEGER NOT NULL,
+    last_used_at INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX idx_camera_tokens_camera ON camera_tokens (camera_id);
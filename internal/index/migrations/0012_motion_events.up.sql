@@ -0,0 +1,14 @@
+-- Motion detected in frames. The box is normalized to the frame size.
+CREATE TABLE motion_events (
+    id        INTEGER PRIMARY KEY,
+    camera_id TEXT    NOT NULL,
+    time      INTEGER NOT NULL,
+    x         REAL    NOT NULL,
+    y         REAL    NOT NULL,
+    width     REAL    NOT NULL,
+    height    REAL    NOT NULL,
+    intensity REAL    NOT NULL
+);
+
+CREATE INDEX idx_motion_events_camera_time ON motion_events (camera_id, time);
+CREATE INDEX idx_motion_events_time ON motion_events (time);
@@ -0,0 +1 @@
+DROP TABLE camera_bans;
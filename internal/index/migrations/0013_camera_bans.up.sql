@@ -0,0 +1,8 @@
+-- Cameras refused on /camera/connect, by camera ID. 0 in expires_at means
+-- the ban doesn't expire.
+CREATE TABLE camera_bans (
+    camera_id  TEXT    PRIMARY KEY,
+    reason     TEXT    NOT NULL DEFAULT '',
+    created_at INTEGER NOT NULL,
+    expires_at INTEGER NOT NULL DEFAULT 0
+);
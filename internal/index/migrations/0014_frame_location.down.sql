@@ -0,0 +1,5 @@
+ALTER TABLE frames DROP COLUMN speed;
+ALTER TABLE frames DROP COLUMN heading;
+ALTER TABLE frames DROP COLUMN altitude;
+ALTER TABLE frames DROP COLUMN longitude;
+ALTER TABLE frames DROP COLUMN latitude;
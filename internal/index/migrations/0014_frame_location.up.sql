@@ -0,0 +1,6 @@
+-- Where mobile cameras took their frames; NULL for fixed cameras
+ALTER TABLE frames ADD COLUMN latitude REAL;
+ALTER TABLE frames ADD COLUMN longitude REAL;
+ALTER TABLE frames ADD COLUMN altitude REAL;
+ALTER TABLE frames ADD COLUMN heading REAL;
+ALTER TABLE frames ADD COLUMN speed REAL;
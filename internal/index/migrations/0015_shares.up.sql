@@ -0,0 +1,19 @@
+-- Links for sharing a recording outside the system. Only the SHA-256 of a
+-- link's token is kept, and the bcrypt hash of its password if it has one.
+-- 0 in expires_at and max_views means no limit, in last_viewed_at never
+-- and in revoked_at not revoked.
+CREATE TABLE shares (
+    id             INTEGER PRIMARY KEY,
+    recording_id   INTEGER NOT NULL,
+    hash           TEXT    NOT NULL UNIQUE,
+    note           TEXT    NOT NULL DEFAULT '',
+    password_hash  TEXT    NOT NULL DEFAULT '',
+    created_at     INTEGER NOT NULL,
+    expires_at     INTEGER NOT NULL DEFAULT 0,
+    max_views      INTEGER NOT NULL DEFAULT 0,
+    views          INTEGER NOT NULL DEFAULT 0,
+    last_viewed_at INTEGER NOT NULL DEFAULT 0,
+    revoked_at     INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX idx_shares_recording ON shares (recording_id);
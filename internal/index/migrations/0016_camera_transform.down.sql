@@ -0,0 +1 @@
+ALTER TABLE camera_profiles DROP COLUMN transform;
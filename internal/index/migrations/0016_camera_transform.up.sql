@@ -0,0 +1,2 @@
+-- How a camera's frames are rotated and mirrored, '' for as they come
+ALTER TABLE camera_profiles ADD COLUMN transform TEXT NOT NULL DEFAULT '';
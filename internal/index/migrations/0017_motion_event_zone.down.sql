@@ -0,0 +1 @@
+ALTER TABLE motion_events DROP COLUMN zone;
@@ -0,0 +1,2 @@
+-- The motion zone an event's box overlaps most, '' for none
+ALTER TABLE motion_events ADD COLUMN zone TEXT NOT NULL DEFAULT '';
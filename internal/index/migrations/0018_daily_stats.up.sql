@@ -0,0 +1,15 @@
+-- Per-camera statistics for each local day, rolled up nightly so they
+-- outlive the recordings and events they summarize
+CREATE TABLE daily_stats (
+    camera_id        TEXT    NOT NULL,
+    day              TEXT    NOT NULL, -- YYYY-MM-DD
+    recordings       INTEGER NOT NULL,
+    recorded_seconds REAL    NOT NULL,
+    gap_seconds      REAL    NOT NULL,
+    motion_minutes   INTEGER NOT NULL,
+    storage_bytes    INTEGER NOT NULL,
+    rolled_up_at     INTEGER NOT NULL,
+    PRIMARY KEY (camera_id, day)
+);
+
+CREATE INDEX idx_daily_stats_day ON daily_stats (day);
@@ -0,0 +1,2 @@
+-- Areas of a camera's frames hidden before they are stored, '' for none
+ALTER TABLE camera_profiles ADD COLUMN privacy TEXT NOT NULL DEFAULT '';
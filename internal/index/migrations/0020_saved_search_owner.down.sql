@@ -0,0 +1,33 @@
+-- Users' own searches are dropped; their names may clash with shared ones.
+DELETE FROM saved_searches WHERE user_id != 0;
+
+CREATE TABLE saved_searches_old (
+    id         INTEGER PRIMARY KEY,
+    name       TEXT    NOT NULL UNIQUE,
+    cameras    TEXT    NOT NULL DEFAULT '[]',
+    window_ms  INTEGER NOT NULL DEFAULT 0,
+    since      INTEGER NOT NULL DEFAULT 0,
+    until      INTEGER NOT NULL DEFAULT 0,
+    updated_at INTEGER NOT NULL
+);
+
+INSERT INTO saved_searches_old (id, name, cameras, window_ms, since, until, updated_at)
+SELECT id, name, cameras, window_ms, since, until, updated_at FROM saved_searches;
+
+DROP TABLE saved_searches;
+ALTER TABLE saved_searches_old RENAME TO saved_searches;
+
+CREATE TRIGGER search_saved_search_insert AFTER INSERT ON saved_searches BEGIN
+    INSERT INTO search (rowid, kind, ref, camera_id, body, time)
+    VALUES (new.id * 4 + 1, 'search', new.name, new.cameras, new.name, new.updated_at);
+END;
+
+CREATE TRIGGER search_saved_search_update AFTER UPDATE ON saved_searches BEGIN
+    DELETE FROM search WHERE rowid = old.id * 4 + 1;
+    INSERT INTO search (rowid, kind, ref, camera_id, body, time)
+    VALUES (new.id * 4 + 1, 'search', new.name, new.cameras, new.name, new.updated_at);
+END;
+
+CREATE TRIGGER search_saved_search_delete AFTER DELETE ON saved_searches BEGIN
+    DELETE FROM search WHERE rowid = old.id * 4 + 1;
+END;
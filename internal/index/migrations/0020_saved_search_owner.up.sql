@@ -0,0 +1,40 @@
+-- Saved searches belong to the user who saved them; user_id 0 holds the
+-- shared searches saved with the admin token. Names are unique per owner.
+-- motion_only keeps only recordings with a motion event in their span.
+-- SQLite can't change a UNIQUE constraint in place, so the table is
+-- rebuilt; only shared searches stay in the full-text search.
+CREATE TABLE saved_searches_new (
+    id          INTEGER PRIMARY KEY,
+    user_id     INTEGER NOT NULL DEFAULT 0,
+    name        TEXT    NOT NULL,
+    cameras     TEXT    NOT NULL DEFAULT '[]',
+    window_ms   INTEGER NOT NULL DEFAULT 0,
+    since       INTEGER NOT NULL DEFAULT 0,
+    until       INTEGER NOT NULL DEFAULT 0,
+    motion_only INTEGER NOT NULL DEFAULT 0,
+    updated_at  INTEGER NOT NULL,
+    UNIQUE (user_id, name)
+);
+
+INSERT INTO saved_searches_new (id, name, cameras, window_ms, since, until, updated_at)
+SELECT id, name, cameras, window_ms, since, until, updated_at FROM saved_searches;
+
+DROP TABLE saved_searches;
+ALTER TABLE saved_searches_new RENAME TO saved_searches;
+
+CREATE TRIGGER search_saved_search_insert AFTER INSERT ON saved_searches
+WHEN new.user_id = 0 BEGIN
+    INSERT INTO search (rowid, kind, ref, camera_id, body, time)
+    VALUES (new.id * 4 + 1, 'search', new.name, new.cameras, new.name, new.updated_at);
+END;
+
+CREATE TRIGGER search_saved_search_update AFTER UPDATE ON saved_searches BEGIN
+    DELETE FROM search WHERE rowid = old.id * 4 + 1;
+    INSERT INTO search (rowid, kind, ref, camera_id, body, time)
+    SELECT new.id * 4 + 1, 'search', new.name, new.cameras, new.name, new.updated_at
+    WHERE new.user_id = 0;
+END;
+
+CREATE TRIGGER search_saved_search_delete AFTER DELETE ON saved_searches BEGIN
+    DELETE FROM search WHERE rowid = old.id * 4 + 1;
+END;
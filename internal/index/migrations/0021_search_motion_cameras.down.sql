@@ -0,0 +1,22 @@
+DROP TRIGGER search_camera_delete;
+DROP TRIGGER search_camera_update;
+DROP TRIGGER search_camera_insert;
+DROP TRIGGER search_motion_delete;
+DROP TRIGGER search_motion_update;
+DROP TRIGGER search_motion_insert;
+DELETE FROM search WHERE kind IN ('motion', 'camera');
+DROP VIEW camera_search;
+
+CREATE TABLE camera_profiles_old (
+    camera_id  TEXT PRIMARY KEY,
+    motion     TEXT    NOT NULL DEFAULT '',
+    updated_at INTEGER NOT NULL,
+    transform  TEXT    NOT NULL DEFAULT '',
+    privacy    TEXT    NOT NULL DEFAULT ''
+);
+
+INSERT INTO camera_profiles_old (camera_id, motion, updated_at, transform, privacy)
+SELECT camera_id, motion, updated_at, transform, privacy FROM camera_profiles;
+
+DROP TABLE camera_profiles;
+ALTER TABLE camera_profiles_old RENAME TO camera_profiles;
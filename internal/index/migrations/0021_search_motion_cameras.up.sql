@@ -0,0 +1,66 @@
+-- Motion events and camera profiles join the full-text search (see 0008):
+--   2 motion  ref is the event id; the body is "motion" and its zone
+--   3 camera  ref is the camera id; the body is the camera id and the
+--             names of its motion zones and privacy masks
+-- Camera profiles are keyed by camera ID, so they are rebuilt with an
+-- integer id for their search rowids to survive a VACUUM.
+CREATE TABLE camera_profiles_new (
+    id         INTEGER PRIMARY KEY,
+    camera_id  TEXT    NOT NULL UNIQUE,
+    motion     TEXT    NOT NULL DEFAULT '',
+    updated_at INTEGER NOT NULL,
+    transform  TEXT    NOT NULL DEFAULT '',
+    privacy    TEXT    NOT NULL DEFAULT ''
+);
+
+INSERT INTO camera_profiles_new (id, camera_id, motion, updated_at, transform, privacy)
+SELECT rowid, camera_id, motion, updated_at, transform, privacy FROM camera_profiles;
+
+DROP TABLE camera_profiles;
+ALTER TABLE camera_profiles_new RENAME TO camera_profiles;
+
+CREATE VIEW camera_search AS
+SELECT id, camera_id, updated_at, camera_id
+    || ' ' || coalesce((SELECT group_concat(json_extract(value, '$.name'), ' ')
+        FROM json_each(CASE WHEN json_valid(motion) THEN motion ELSE '{}' END, '$.zones')), '')
+    || ' ' || coalesce((SELECT group_concat(json_extract(value, '$.name'), ' ')
+        FROM json_each(CASE WHEN json_valid(privacy) THEN privacy ELSE '[]' END)), '') AS body
+FROM camera_profiles;
+
+INSERT INTO search (rowid, kind, ref, camera_id, body, time)
+SELECT id * 4 + 2, 'motion', id, camera_id, trim('motion ' || zone), time FROM motion_events;
+
+INSERT INTO search (rowid, kind, ref, camera_id, body, time)
+SELECT id * 4 + 3, 'camera', camera_id, camera_id, body, updated_at FROM camera_search;
+
+CREATE TRIGGER search_motion_insert AFTER INSERT ON motion_events BEGIN
+    INSERT INTO search (rowid, kind, ref, camera_id, body, time)
+    VALUES (new.id * 4 + 2, 'motion', new.id, new.camera_id, trim('motion ' || new.zone), new.time);
+END;
+
+CREATE TRIGGER search_motion_update AFTER UPDATE ON motion_events BEGIN
+    DELETE FROM search WHERE rowid = old.id * 4 + 2;
+    INSERT INTO search (rowid, kind, ref, camera_id, body, time)
+    VALUES (new.id * 4 + 2, 'motion', new.id, new.camera_id, trim('motion ' || new.zone), new.time);
+END;
+
+CREATE TRIGGER search_motion_delete AFTER DELETE ON motion_events BEGIN
+    DELETE FROM search WHERE rowid = old.id * 4 + 2;
+END;
+
+CREATE TRIGGER search_camera_insert AFTER INSERT ON camera_profiles BEGIN
+    INSERT INTO search (rowid, kind, ref, camera_id, body, time)
+    SELECT id * 4 + 3, 'camera', camera_id, camera_id, body, updated_at
+    FROM camera_search WHERE id = new.id;
+END;
+
+CREATE TRIGGER search_camera_update AFTER UPDATE ON camera_profiles BEGIN
+    DELETE FROM search WHERE rowid = old.id * 4 + 3;
+    INSERT INTO search (rowid, kind, ref, camera_id, body, time)
+    SELECT id * 4 + 3, 'camera', camera_id, camera_id, body, updated_at
+    FROM camera_search WHERE id = new.id;
+END;
+
+CREATE TRIGGER search_camera_delete AFTER DELETE ON camera_profiles BEGIN
+    DELETE FROM search WHERE rowid = old.id * 4 + 3;
+END;
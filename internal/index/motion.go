@@ -0,0 +1,123 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/motion"
+	"github.com/raeeceip/cctv/internal/site"
+)
+
+// MotionEvent is motion detected in a camera's frames.
+type MotionEvent struct {
+	ID        int64      `json:"id"`
+	CameraID  string     `json:"camera_id"`
+	Time      time.Time  `json:"time"`
+	Box       motion.Box `json:"box"`
+	Intensity float64    `json:"intensity"`
+	Zone      string     `json:"zone,omitempty"`
+}
+
+// MotionQuery filters ListMotionEvents. Zero fields match everything.
+type MotionQuery struct {
+	CameraID string
+	Site     string    // cameras of this site
+	Since    time.Time // events at or after Since
+	Until    time.Time // events before Until
+	Limit    int
+}
+
+const motionColumns = `id, camera_id, time, x, y, width, height, intensity, zone`
+
+func scanMotionEvent(row scanner) (*MotionEvent, error) {
+	var e MotionEvent
+	var t int64
+	if err := row.Scan(&e.ID, &e.CameraID, &t, &e.Box.X, &e.Box.Y, &e.Box.Width, &e.Box.Height, &e.Intensity, &e.Zone); err != nil {
+		return nil, err
+	}
+	e.Time = fromMillis(t)
+	return &e, nil
+}
+
+// AddMotionEvent stores a motion event and sets e.ID.
+func (ix *Index) AddMotionEvent(ctx context.Context, e *MotionEvent) error {
+	row := ix.db.QueryRowContext(ctx, `
+		INSERT INTO motion_events (camera_id, time, x, y, width, height, intensity, zone)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		e.CameraID, toMillis(e.Time), e.Box.X, e.Box.Y, e.Box.Width, e.Box.Height, e.Intensity, e.Zone)
+	if err := row.Scan(&e.ID); err != nil {
+		return fmt.Errorf("failed to add motion event: %w", err)
+	}
+	return nil
+}
+
+// ListMotionEvents returns matching motion events, newest first.
+func (ix *Index) ListMotionEvents(ctx context.Context, q MotionQuery) ([]MotionEvent, error) {
+	query := `SELECT ` + motionColumns + ` FROM motion_events WHERE 1 = 1`
+	var args []interface{}
+	if q.CameraID != "" {
+		query += ` AND camera_id = ?`
+		args = append(args, q.CameraID)
+	}
+	if q.Site != "" {
+		prefix := site.Prefix(q.Site)
+		query += ` AND substr(camera_id, 1, ?) = ?`
+		args = append(args, len(prefix), prefix)
+	}
+	if !q.Since.IsZero() {
+		query += ` AND time >= ?`
+		args = append(args, toMillis(q.Since))
+	}
+	if !q.Until.IsZero() {
+		query += ` AND time < ?`
+		args = append(args, toMillis(q.Until))
+	}
+	query += ` ORDER BY time DESC`
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+
+	rows, err := ix.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list motion events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []MotionEvent
+	for rows.Next() {
+		e, err := scanMotionEvent(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read motion event: %w", err)
+		}
+		events = append(events, *e)
+	}
+	return events, rows.Err()
+}
+
+// GetMotionEvent returns a motion event by ID, or sql.ErrNoRows.
+func (ix *Index) GetMotionEvent(ctx context.Context, id int64) (*MotionEvent, error) {
+	row := ix.db.QueryRowContext(ctx, `SELECT `+motionColumns+` FROM motion_events WHERE id = ?`, id)
+	return scanMotionEvent(row)
+}
+
+// PruneMotionEvents deletes motion events from before cutoff.
+func (ix *Index) PruneMotionEvents(ctx context.Context, cutoff time.Time) (int64, error) {
+	res, err := ix.db.ExecContext(ctx, `DELETE FROM motion_events WHERE time < ?`, toMillis(cutoff))
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune motion events: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// DeleteMotionEvents deletes a camera's motion events from since until
+// before until, e.g. before detection is run over them again.
+func (ix *Index) DeleteMotionEvents(ctx context.Context, cameraID string, since, until time.Time) (int64, error) {
+	res, err := ix.db.ExecContext(ctx, `DELETE FROM motion_events WHERE camera_id = ? AND time >= ? AND time < ?`,
+		cameraID, toMillis(since), toMillis(until))
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete motion events: %w", err)
+	}
+	return res.RowsAffected()
+}
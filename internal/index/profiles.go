@@ -0,0 +1,98 @@
+package index
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/motion"
+)
+
+// CameraProfile holds per-camera settings as JSON documents owned by the
+// packages that interpret them. Empty means defaults.
+type CameraProfile struct {
+	CameraID  string    `json:"camera_id"`
+	Motion    string    `json:"motion"`
+	Transform string    `json:"transform"`
+	Privacy   string    `json:"privacy"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// GetCameraProfile returns the profile of a camera, or an empty one if none
+// was saved.
+func (ix *Index) GetCameraProfile(ctx context.Context, cameraID string) (*CameraProfile, error) {
+	p := &CameraProfile{CameraID: cameraID}
+	var updated int64
+	err := ix.db.QueryRowContext(ctx,
+		`SELECT motion, transform, privacy, updated_at FROM camera_profiles WHERE camera_id = ?`, cameraID).
+		Scan(&p.Motion, &p.Transform, &p.Privacy, &updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read camera profile: %w", err)
+	}
+	p.UpdatedAt = fromMillis(updated)
+	return p, nil
+}
+
+// MotionSettings returns the saved motion settings of a camera, or the
+// defaults.
+func (ix *Index) MotionSettings(ctx context.Context, cameraID string) (motion.Settings, error) {
+	settings := motion.DefaultSettings()
+	profile, err := ix.GetCameraProfile(ctx, cameraID)
+	if err != nil {
+		return settings, err
+	}
+	if profile.Motion != "" {
+		if err := json.Unmarshal([]byte(profile.Motion), &settings); err != nil {
+			return settings, fmt.Errorf("invalid saved motion settings: %w", err)
+		}
+	}
+	return settings, nil
+}
+
+// SaveCameraMotion stores the motion settings of a camera.
+func (ix *Index) SaveCameraMotion(ctx context.Context, cameraID, motion string) error {
+	_, err := ix.db.ExecContext(ctx, `
+		INSERT INTO camera_profiles (camera_id, motion, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (camera_id) DO UPDATE SET
+			motion = excluded.motion,
+			updated_at = excluded.updated_at`,
+		cameraID, motion, toMillis(time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to save camera profile: %w", err)
+	}
+	return nil
+}
+
+// SaveCameraTransform stores how a camera's frames are rotated and mirrored.
+func (ix *Index) SaveCameraTransform(ctx context.Context, cameraID, transform string) error {
+	_, err := ix.db.ExecContext(ctx, `
+		INSERT INTO camera_profiles (camera_id, transform, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (camera_id) DO UPDATE SET
+			transform = excluded.transform,
+			updated_at = excluded.updated_at`,
+		cameraID, transform, toMillis(time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to save camera profile: %w", err)
+	}
+	return nil
+}
+
+// SaveCameraPrivacy stores the privacy masks of a camera.
+func (ix *Index) SaveCameraPrivacy(ctx context.Context, cameraID, privacy string) error {
+	_, err := ix.db.ExecContext(ctx, `
+		INSERT INTO camera_profiles (camera_id, privacy, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (camera_id) DO UPDATE SET
+			privacy = excluded.privacy,
+			updated_at = excluded.updated_at`,
+		cameraID, privacy, toMillis(time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to save camera profile: %w", err)
+	}
+	return nil
+}
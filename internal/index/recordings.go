@@ -0,0 +1,229 @@
+package index
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/site"
+)
+
+// Recording is a consolidated video file.
+type Recording struct {
+	ID         int64     `json:"id"`
+	CameraID   string    `json:"camera_id"`
+	Path       string    `json:"path"`
+	StartTime  time.Time `json:"start_time"`
+	EndTime    time.Time `json:"end_time"`
+	FrameCount int       `json:"frame_count"`
+	SizeBytes  int64     `json:"size_bytes"`
+	Codec      string    `json:"codec"`
+	Tier       int       `json:"tier"` // retention quality tier, 0 for the original
+	CreatedAt  time.Time `json:"created_at"`
+	// DeletedAt is set while the recording is in the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// TrashPath is where the file was moved to in the trash; empty if it
+	// was left in place
+	TrashPath string `json:"trash_path,omitempty"`
+	// DurationSeconds is EndTime less StartTime, filled in when read
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+const recordingColumns = `id, camera_id, path, start_time, end_time, frame_count, size_bytes, codec, tier, created_at, deleted_at, trash_path`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRecording(row scanner) (*Recording, error) {
+	var r Recording
+	var start, end, created int64
+	var deleted sql.NullInt64
+	if err := row.Scan(&r.ID, &r.CameraID, &r.Path, &start, &end,
+		&r.FrameCount, &r.SizeBytes, &r.Codec, &r.Tier, &created, &deleted, &r.TrashPath); err != nil {
+		return nil, err
+	}
+	r.StartTime = fromMillis(start)
+	r.EndTime = fromMillis(end)
+	r.DurationSeconds = r.EndTime.Sub(r.StartTime).Seconds()
+	r.CreatedAt = fromMillis(created)
+	if deleted.Valid {
+		t := fromMillis(deleted.Int64)
+		r.DeletedAt = &t
+	}
+	return &r, nil
+}
+
+// AddRecording inserts r, or updates the existing row for the same path,
+// and sets r.ID.
+func (ix *Index) AddRecording(ctx context.Context, r *Recording) error {
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = time.Now()
+	}
+
+	row := ix.db.QueryRowContext(ctx, `
+		INSERT INTO recordings (camera_id, path, start_time, end_time, frame_count, size_bytes, codec, tier, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (path) DO UPDATE SET
+			camera_id = excluded.camera_id,
+			start_time = excluded.start_time,
+			end_time = excluded.end_time,
+			frame_count = excluded.frame_count,
+			size_bytes = excluded.size_bytes,
+			codec = excluded.codec,
+			tier = excluded.tier
+		RETURNING id`,
+		r.CameraID, r.Path, toMillis(r.StartTime), toMillis(r.EndTime),
+		r.FrameCount, r.SizeBytes, r.Codec, r.Tier, toMillis(r.CreatedAt))
+	if err := row.Scan(&r.ID); err != nil {
+		return fmt.Errorf("failed to add recording: %w", err)
+	}
+	return nil
+}
+
+// RecordingQuery filters ListRecordings. Zero fields match everything.
+type RecordingQuery struct {
+	CameraID  string
+	CameraIDs []string  // any of these cameras
+	Site      string    // cameras of this site
+	Since     time.Time // recordings ending at or after Since
+	Until     time.Time // recordings starting before Until
+	Before    time.Time // recordings ending before Before
+	Motion    bool      // only recordings with a motion event in their span
+	Limit     int
+	// Trashed lists the trash instead of live recordings
+	Trashed       bool
+	DeletedBefore time.Time // trashed recordings deleted before DeletedBefore
+}
+
+// ListRecordings returns matching recordings, newest first.
+func (ix *Index) ListRecordings(ctx context.Context, q RecordingQuery) ([]Recording, error) {
+	query := `SELECT ` + recordingColumns + ` FROM recordings WHERE deleted_at IS NULL`
+	if q.Trashed {
+		query = `SELECT ` + recordingColumns + ` FROM recordings WHERE deleted_at IS NOT NULL`
+	}
+	var args []interface{}
+	if q.CameraID != "" {
+		query += ` AND camera_id = ?`
+		args = append(args, q.CameraID)
+	}
+	if len(q.CameraIDs) > 0 {
+		query += ` AND camera_id IN (?` + strings.Repeat(`, ?`, len(q.CameraIDs)-1) + `)`
+		for _, id := range q.CameraIDs {
+			args = append(args, id)
+		}
+	}
+	if q.Site != "" {
+		prefix := site.Prefix(q.Site)
+		query += ` AND substr(camera_id, 1, ?) = ?`
+		args = append(args, len(prefix), prefix)
+	}
+	if !q.Since.IsZero() {
+		query += ` AND end_time >= ?`
+		args = append(args, toMillis(q.Since))
+	}
+	if !q.Until.IsZero() {
+		query += ` AND start_time < ?`
+		args = append(args, toMillis(q.Until))
+	}
+	if !q.Before.IsZero() {
+		query += ` AND end_time < ?`
+		args = append(args, toMillis(q.Before))
+	}
+	if !q.DeletedBefore.IsZero() {
+		query += ` AND deleted_at < ?`
+		args = append(args, toMillis(q.DeletedBefore))
+	}
+	if q.Motion {
+		query += ` AND EXISTS (SELECT 1 FROM motion_events m WHERE m.camera_id = recordings.camera_id
+			AND m.time >= recordings.start_time AND m.time <= recordings.end_time)`
+	}
+	query += ` ORDER BY start_time DESC`
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+
+	rows, err := ix.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list recordings: %w", err)
+	}
+	defer rows.Close()
+
+	var recordings []Recording
+	for rows.Next() {
+		r, err := scanRecording(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read recording: %w", err)
+		}
+		recordings = append(recordings, *r)
+	}
+	return recordings, rows.Err()
+}
+
+// GetRecording returns the recording with the given ID, or sql.ErrNoRows if
+// there is none or it is in the trash.
+func (ix *Index) GetRecording(ctx context.Context, id int64) (*Recording, error) {
+	return scanRecording(ix.db.QueryRowContext(ctx,
+		`SELECT `+recordingColumns+` FROM recordings WHERE id = ? AND deleted_at IS NULL`, id))
+}
+
+// GetTrashedRecording returns the recording with the given ID if it is in
+// the trash, or sql.ErrNoRows.
+func (ix *Index) GetTrashedRecording(ctx context.Context, id int64) (*Recording, error) {
+	return scanRecording(ix.db.QueryRowContext(ctx,
+		`SELECT `+recordingColumns+` FROM recordings WHERE id = ? AND deleted_at IS NOT NULL`, id))
+}
+
+// TrashRecording moves a recording to the trash as of at. trashPath is
+// where the caller moved its file.
+func (ix *Index) TrashRecording(ctx context.Context, id int64, trashPath string, at time.Time) error {
+	_, err := ix.db.ExecContext(ctx,
+		`UPDATE recordings SET deleted_at = ?, trash_path = ? WHERE id = ?`,
+		toMillis(at), trashPath, id)
+	if err != nil {
+		return fmt.Errorf("failed to trash recording: %w", err)
+	}
+	return nil
+}
+
+// RestoreRecording takes a recording out of the trash. The caller moves
+// its file back first.
+func (ix *Index) RestoreRecording(ctx context.Context, id int64) error {
+	_, err := ix.db.ExecContext(ctx,
+		`UPDATE recordings SET deleted_at = NULL, trash_path = '' WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to restore recording: %w", err)
+	}
+	return nil
+}
+
+// UpdateRecordingQuality records that a recording was re-encoded in place.
+func (ix *Index) UpdateRecordingQuality(ctx context.Context, id int64, tier int, codec string, size int64) error {
+	_, err := ix.db.ExecContext(ctx,
+		`UPDATE recordings SET tier = ?, codec = ?, size_bytes = ? WHERE id = ?`,
+		tier, codec, size, id)
+	if err != nil {
+		return fmt.Errorf("failed to update recording: %w", err)
+	}
+	return nil
+}
+
+// SetRecordingPath records that a recording's file was moved to path.
+func (ix *Index) SetRecordingPath(ctx context.Context, id int64, path string) error {
+	if _, err := ix.db.ExecContext(ctx, `UPDATE recordings SET path = ? WHERE id = ?`, path, id); err != nil {
+		return fmt.Errorf("failed to update recording path: %w", err)
+	}
+	return nil
+}
+
+// DeleteRecording removes a recording from the index. The file is left to
+// the caller.
+func (ix *Index) DeleteRecording(ctx context.Context, id int64) error {
+	if _, err := ix.db.ExecContext(ctx, `DELETE FROM recordings WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete recording: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// UnreplicatedRecordings returns up to limit recordings, oldest first, that
+// have not been pushed to the replication peer. Recordings in the trash or
+// received from another server are left out.
+func (ix *Index) UnreplicatedRecordings(ctx context.Context, limit int) ([]Recording, error) {
+	rows, err := ix.db.QueryContext(ctx, `
+		SELECT `+recordingColumns+` FROM recordings
+		WHERE deleted_at IS NULL
+			AND id NOT IN (SELECT recording_id FROM replicated)
+			AND id NOT IN (SELECT recording_id FROM replicas)
+		ORDER BY id LIMIT ?`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list unreplicated recordings: %w", err)
+	}
+	defer rows.Close()
+
+	var recordings []Recording
+	for rows.Next() {
+		r, err := scanRecording(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read recording: %w", err)
+		}
+		recordings = append(recordings, *r)
+	}
+	return recordings, rows.Err()
+}
+
+// IsReplica reports whether a recording was received from another server.
+func (ix *Index) IsReplica(ctx context.Context, id int64) (bool, error) {
+	var n int
+	err := ix.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM replicas WHERE recording_id = ?`, id).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up replica: %w", err)
+	}
+	return n > 0, nil
+}
+
+// MarkReplicated records that a recording has been pushed to the peer.
+func (ix *Index) MarkReplicated(ctx context.Context, id int64, at time.Time) error {
+	_, err := ix.db.ExecContext(ctx,
+		`INSERT OR REPLACE INTO replicated (recording_id, replicated_at) VALUES (?, ?)`,
+		id, toMillis(at))
+	if err != nil {
+		return fmt.Errorf("failed to mark recording replicated: %w", err)
+	}
+	return nil
+}
+
+// AddReplica indexes a recording received from another server, where it
+// has originID, and sets r.ID. Receiving the same recording again updates
+// it.
+func (ix *Index) AddReplica(ctx context.Context, r *Recording, origin string, originID int64) error {
+	if err := ix.AddRecording(ctx, r); err != nil {
+		return err
+	}
+	_, err := ix.db.ExecContext(ctx, `
+		INSERT OR REPLACE INTO replicas (recording_id, origin, origin_id, received_at)
+		VALUES (?, ?, ?, ?)`,
+		r.ID, origin, originID, toMillis(time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to add replica: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/site"
+)
+
+// ErrEmptySearch is returned by Search for text without a word to match,
+// such as "*".
+var ErrEmptySearch = errors.New("search has no words to match")
+
+// SearchResult is one document matching a full-text search.
+type SearchResult struct {
+	Kind     string    `json:"type"` // "recording", "search", "motion" or "camera"
+	Ref      string    `json:"ref"`  // recording id, saved search name, motion event id or camera id
+	CameraID string    `json:"camera_id,omitempty"`
+	Time     time.Time `json:"time"`
+	Snippet  string    `json:"snippet"`
+}
+
+// Search runs a full-text search and returns the best matches first. Each
+// word of text must match, as a prefix if it ends in '*'. With siteID only
+// recordings, motion events and cameras of that site's cameras are
+// returned.
+func (ix *Index) Search(ctx context.Context, text, siteID string, limit int) ([]SearchResult, error) {
+	match := matchQuery(text)
+	if match == "" {
+		return nil, ErrEmptySearch
+	}
+
+	query := `
+		SELECT kind, ref, camera_id, time, snippet(search, 3, '[', ']', '...', 8)
+		FROM search WHERE search MATCH ?`
+	args := []interface{}{match}
+	if siteID != "" {
+		prefix := site.Prefix(siteID)
+		query += ` AND kind != 'search' AND substr(camera_id, 1, ?) = ?`
+		args = append(args, len(prefix), prefix)
+	}
+	rows, err := ix.db.QueryContext(ctx, query+` ORDER BY rank LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search: %w", err)
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		var r SearchResult
+		var t int64
+		if err := rows.Scan(&r.Kind, &r.Ref, &r.CameraID, &t, &r.Snippet); err != nil {
+			return nil, fmt.Errorf("failed to read search result: %w", err)
+		}
+		r.Time = fromMillis(t)
+		if r.Kind == "search" {
+			r.CameraID = ""
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// matchQuery turns free text into an FTS5 query that can't be a syntax
+// error: every word becomes a quoted phrase, so "cam-12" matches the tokens
+// "cam" and "12" next to each other.
+func matchQuery(text string) string {
+	var terms []string
+	for _, word := range strings.Fields(text) {
+		prefix := strings.HasSuffix(word, "*")
+		word = strings.TrimRight(word, "*")
+		if word == "" {
+			continue
+		}
+		term := `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+		if prefix {
+			term += "*"
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, " ")
+}
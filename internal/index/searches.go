@@ -0,0 +1,134 @@
+package index
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SavedSearch is a named recording query.
+type SavedSearch struct {
+	UserID  int64 // owner; 0 for shared searches saved with the admin token
+	Name    string
+	Cameras []string // empty for all cameras
+	// Window limits the search to recordings from the last Window, as of
+	// when it is run; 0 leaves it open
+	Window time.Duration
+	Since  time.Time
+	Until  time.Time
+	// MotionOnly keeps only recordings with a motion event in their span
+	MotionOnly bool
+	UpdatedAt  time.Time
+}
+
+// Query returns the recording query the search stands for at now.
+func (s *SavedSearch) Query(now time.Time) RecordingQuery {
+	q := RecordingQuery{CameraIDs: s.Cameras, Since: s.Since, Until: s.Until, Motion: s.MotionOnly}
+	if s.Window > 0 {
+		if since := now.Add(-s.Window); since.After(q.Since) {
+			q.Since = since
+		}
+	}
+	return q
+}
+
+func scanSavedSearch(row scanner) (*SavedSearch, error) {
+	var s SavedSearch
+	var cameras string
+	var window, since, until, updated int64
+	if err := row.Scan(&s.UserID, &s.Name, &cameras, &window, &since, &until, &s.MotionOnly, &updated); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(cameras), &s.Cameras); err != nil {
+		return nil, fmt.Errorf("invalid cameras in saved search %q: %w", s.Name, err)
+	}
+	s.Window = time.Duration(window) * time.Millisecond
+	if since != 0 {
+		s.Since = fromMillis(since)
+	}
+	if until != 0 {
+		s.Until = fromMillis(until)
+	}
+	s.UpdatedAt = fromMillis(updated)
+	return &s, nil
+}
+
+// SaveSearch stores s, replacing any search of the same name and owner.
+func (ix *Index) SaveSearch(ctx context.Context, s *SavedSearch) error {
+	cameras, err := json.Marshal(s.Cameras)
+	if err != nil {
+		return err
+	}
+	if s.Cameras == nil {
+		cameras = []byte("[]")
+	}
+	var since, until int64
+	if !s.Since.IsZero() {
+		since = toMillis(s.Since)
+	}
+	if !s.Until.IsZero() {
+		until = toMillis(s.Until)
+	}
+	s.UpdatedAt = time.Now()
+
+	_, err = ix.db.ExecContext(ctx, `
+		INSERT INTO saved_searches (user_id, name, cameras, window_ms, since, until, motion_only, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, name) DO UPDATE SET
+			cameras = excluded.cameras,
+			window_ms = excluded.window_ms,
+			since = excluded.since,
+			until = excluded.until,
+			motion_only = excluded.motion_only,
+			updated_at = excluded.updated_at`,
+		s.UserID, s.Name, string(cameras), s.Window.Milliseconds(), since, until, s.MotionOnly, toMillis(s.UpdatedAt))
+	if err != nil {
+		return fmt.Errorf("failed to save search: %w", err)
+	}
+	return nil
+}
+
+const savedSearchColumns = `user_id, name, cameras, window_ms, since, until, motion_only, updated_at`
+
+// ListSearches returns the saved searches of a user, or the shared ones for
+// userID 0, by name.
+func (ix *Index) ListSearches(ctx context.Context, userID int64) ([]SavedSearch, error) {
+	rows, err := ix.db.QueryContext(ctx,
+		`SELECT `+savedSearchColumns+` FROM saved_searches WHERE user_id = ? ORDER BY name`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list saved searches: %w", err)
+	}
+	defer rows.Close()
+
+	var searches []SavedSearch
+	for rows.Next() {
+		s, err := scanSavedSearch(rows)
+		if err != nil {
+			return nil, err
+		}
+		searches = append(searches, *s)
+	}
+	return searches, rows.Err()
+}
+
+// GetSearch returns the saved search of a user with the given name, or
+// sql.ErrNoRows.
+func (ix *Index) GetSearch(ctx context.Context, userID int64, name string) (*SavedSearch, error) {
+	return scanSavedSearch(ix.db.QueryRowContext(ctx,
+		`SELECT `+savedSearchColumns+` FROM saved_searches WHERE user_id = ? AND name = ?`, userID, name))
+}
+
+// DeleteSearch removes a saved search of a user, returning sql.ErrNoRows if
+// there was none by that name.
+func (ix *Index) DeleteSearch(ctx context.Context, userID int64, name string) error {
+	res, err := ix.db.ExecContext(ctx, `DELETE FROM saved_searches WHERE user_id = ? AND name = ?`, userID, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete saved search: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// SeriesQuery selects a time series: one value per camera for each Step
+// from From up to To. An empty CameraID means every camera.
+type SeriesQuery struct {
+	CameraID string
+	From     time.Time
+	To       time.Time
+	Step     time.Duration
+}
+
+// Buckets returns the number of steps the query covers.
+func (q SeriesQuery) Buckets() int {
+	if q.Step <= 0 || !q.From.Before(q.To) {
+		return 0
+	}
+	return int((q.To.Sub(q.From) + q.Step - 1) / q.Step)
+}
+
+// SeriesPoint is the value of one camera's series for the step starting at
+// Time.
+type SeriesPoint struct {
+	Time     time.Time `json:"time"`
+	CameraID string    `json:"camera_id"`
+	Value    float64   `json:"value"`
+}
+
+// FrameSeries counts the indexed frames of each camera per step. Steps
+// without frames count zero, for every camera that has any in the range.
+func (ix *Index) FrameSeries(ctx context.Context, q SeriesQuery) ([]SeriesPoint, error) {
+	query := `SELECT camera_id, (time - ?) / ?, COUNT(*) FROM frames WHERE time >= ? AND time < ?`
+	args := []interface{}{toMillis(q.From), q.Step.Milliseconds(), toMillis(q.From), toMillis(q.To)}
+	if q.CameraID != "" {
+		query += ` AND camera_id = ?`
+		args = append(args, q.CameraID)
+	}
+	query += ` GROUP BY 1, 2`
+
+	counts, err := ix.bucketSums(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count frames: %w", err)
+	}
+	return q.fill(counts, nil), nil
+}
+
+// StorageSeries returns the bytes of each camera's recordings, outside the
+// trash, that started before the end of each step. Recordings retention has
+// already deleted are not counted, so this is how today's footage built up
+// rather than what the disk held at the time.
+func (ix *Index) StorageSeries(ctx context.Context, q SeriesQuery) ([]SeriesPoint, error) {
+	filter := ` WHERE deleted_at IS NULL`
+	var filterArgs []interface{}
+	if q.CameraID != "" {
+		filter += ` AND camera_id = ?`
+		filterArgs = append(filterArgs, q.CameraID)
+	}
+
+	base, err := ix.bucketSums(ctx,
+		`SELECT camera_id, 0, SUM(size_bytes) FROM recordings`+filter+` AND start_time < ? GROUP BY 1`,
+		append(filterArgs, toMillis(q.From))...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sum recordings: %w", err)
+	}
+	added, err := ix.bucketSums(ctx,
+		`SELECT camera_id, (start_time - ?) / ?, SUM(size_bytes) FROM recordings`+filter+
+			` AND start_time >= ? AND start_time < ? GROUP BY 1, 2`,
+		append(append([]interface{}{toMillis(q.From), q.Step.Milliseconds()}, filterArgs...),
+			toMillis(q.From), toMillis(q.To))...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sum recordings: %w", err)
+	}
+
+	totals := make(map[string]float64)
+	for camera, buckets := range base {
+		totals[camera] = buckets[0]
+	}
+	return q.fill(added, totals), nil
+}
+
+// bucketSums runs a query returning camera, bucket and value rows.
+func (ix *Index) bucketSums(ctx context.Context, query string, args ...interface{}) (map[string]map[int64]float64, error) {
+	rows, err := ix.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sums := make(map[string]map[int64]float64)
+	for rows.Next() {
+		var camera string
+		var bucket int64
+		var value float64
+		if err := rows.Scan(&camera, &bucket, &value); err != nil {
+			return nil, err
+		}
+		if sums[camera] == nil {
+			sums[camera] = make(map[int64]float64)
+		}
+		sums[camera][bucket] = value
+	}
+	return sums, rows.Err()
+}
+
+// fill turns bucket values into a point for every step and camera, ordered
+// by time and then camera. With totals set, the series are running totals
+// starting from them.
+func (q SeriesQuery) fill(values map[string]map[int64]float64, totals map[string]float64) []SeriesPoint {
+	cameras := make([]string, 0, len(values)+len(totals))
+	for camera := range values {
+		cameras = append(cameras, camera)
+	}
+	for camera := range totals {
+		if _, ok := values[camera]; !ok {
+			cameras = append(cameras, camera)
+		}
+	}
+	sort.Strings(cameras)
+
+	n := q.Buckets()
+	points := make([]SeriesPoint, 0, n*len(cameras))
+	for i := 0; i < n; i++ {
+		t := q.From.Add(time.Duration(i) * q.Step)
+		for _, camera := range cameras {
+			v := values[camera][int64(i)]
+			if totals != nil {
+				totals[camera] += v
+				v = totals[camera]
+			}
+			points = append(points, SeriesPoint{Time: t, CameraID: camera, Value: v})
+		}
+	}
+	return points
+}
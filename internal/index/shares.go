@@ -0,0 +1,142 @@
+package index
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Share is a link to a recording for people without an API token. The
+// link's token is never stored.
+type Share struct {
+	ID           int64      `json:"id"`
+	RecordingID  int64      `json:"recording_id"`
+	Note         string     `json:"note,omitempty"`
+	PasswordHash string     `json:"-"`
+	Password     bool       `json:"password"` // whether viewing asks for one
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	MaxViews     int        `json:"max_views,omitempty"`
+	Views        int        `json:"views"`
+	LastViewedAt *time.Time `json:"last_viewed_at,omitempty"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Expired reports whether the share has expired by now.
+func (s *Share) Expired(now time.Time) bool {
+	return s.ExpiresAt != nil && !now.Before(*s.ExpiresAt)
+}
+
+// UsedUp reports whether the share has been viewed as often as it may be.
+func (s *Share) UsedUp() bool {
+	return s.MaxViews > 0 && s.Views >= s.MaxViews
+}
+
+const shareColumns = `id, recording_id, note, password_hash, created_at, expires_at,
+	max_views, views, last_viewed_at, revoked_at`
+
+func scanShare(row scanner) (*Share, error) {
+	var s Share
+	var created, expires, viewed, revoked int64
+	if err := row.Scan(&s.ID, &s.RecordingID, &s.Note, &s.PasswordHash, &created, &expires,
+		&s.MaxViews, &s.Views, &viewed, &revoked); err != nil {
+		return nil, err
+	}
+	s.Password = s.PasswordHash != ""
+	s.CreatedAt = fromMillis(created)
+	s.ExpiresAt = optionalTime(expires)
+	s.LastViewedAt = optionalTime(viewed)
+	s.RevokedAt = optionalTime(revoked)
+	return &s, nil
+}
+
+// optionalTime converts a time column where 0 means none.
+func optionalTime(ms int64) *time.Time {
+	if ms == 0 {
+		return nil
+	}
+	t := fromMillis(ms)
+	return &t
+}
+
+// CreateShare stores a share by the hash of its token and sets s.ID.
+func (ix *Index) CreateShare(ctx context.Context, s *Share, hash string) error {
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = time.Now()
+	}
+	var expires int64
+	if s.ExpiresAt != nil {
+		expires = toMillis(*s.ExpiresAt)
+	}
+	row := ix.db.QueryRowContext(ctx, `
+		INSERT INTO shares (recording_id, hash, note, password_hash, created_at, expires_at, max_views)
+		VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		s.RecordingID, hash, s.Note, s.PasswordHash, toMillis(s.CreatedAt), expires, s.MaxViews)
+	if err := row.Scan(&s.ID); err != nil {
+		return fmt.Errorf("failed to create share: %w", err)
+	}
+	s.Password = s.PasswordHash != ""
+	return nil
+}
+
+// ListShares returns the shares of a recording, or of every recording if
+// recordingID is 0, newest first.
+func (ix *Index) ListShares(ctx context.Context, recordingID int64) ([]Share, error) {
+	rows, err := ix.db.QueryContext(ctx,
+		`SELECT `+shareColumns+` FROM shares WHERE ? = 0 OR recording_id = ? ORDER BY id DESC`,
+		recordingID, recordingID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list shares: %w", err)
+	}
+	defer rows.Close()
+
+	var shares []Share
+	for rows.Next() {
+		s, err := scanShare(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read share: %w", err)
+		}
+		shares = append(shares, *s)
+	}
+	return shares, rows.Err()
+}
+
+// ShareByHash returns the share with the given hash, or sql.ErrNoRows.
+func (ix *Index) ShareByHash(ctx context.Context, hash string) (*Share, error) {
+	return scanShare(ix.db.QueryRowContext(ctx,
+		`SELECT `+shareColumns+` FROM shares WHERE hash = ?`, hash))
+}
+
+// CountShareView records a view of a share at now. It returns false
+// without counting if the share has been revoked, has expired or has no
+// views left, which it checks in the same statement so concurrent viewers
+// can't exceed max_views.
+func (ix *Index) CountShareView(ctx context.Context, id int64, now time.Time) (bool, error) {
+	at := toMillis(now)
+	res, err := ix.db.ExecContext(ctx, `
+		UPDATE shares SET views = views + 1, last_viewed_at = ?
+		WHERE id = ? AND revoked_at = 0
+			AND (expires_at = 0 OR expires_at > ?)
+			AND (max_views = 0 OR views < max_views)`,
+		at, id, at)
+	if err != nil {
+		return false, fmt.Errorf("failed to count share view: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// RevokeShare revokes a share at now, returning sql.ErrNoRows if there is
+// no such share or it was revoked already.
+func (ix *Index) RevokeShare(ctx context.Context, id int64, now time.Time) error {
+	res, err := ix.db.ExecContext(ctx,
+		`UPDATE shares SET revoked_at = ? WHERE id = ? AND revoked_at = 0`, toMillis(now), id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke share: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
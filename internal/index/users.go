@@ -0,0 +1,233 @@
+package index
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// ErrUserExists is returned by CreateUser for a name already taken.
+var ErrUserExists = errors.New("user already exists")
+
+// User is someone using the API with their own tokens.
+type User struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// UserSettings are a user's preferences. The server stores them for the
+// dashboard and SDKs and does not interpret them.
+type UserSettings struct {
+	Timezone           string          `json:"timezone"`
+	DefaultCameraGroup string          `json:"default_camera_group"`
+	Notifications      json.RawMessage `json:"notifications"` // JSON object
+}
+
+// APIToken describes a user's token. The token itself is never stored.
+type APIToken struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"user_id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// Expired reports whether the token has expired by now.
+func (t *APIToken) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+// HasScope reports whether the token carries scope.
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateUser adds a user with default settings.
+func (ix *Index) CreateUser(ctx context.Context, name string) (*User, error) {
+	u := &User{Name: name, CreatedAt: time.Now()}
+	row := ix.db.QueryRowContext(ctx,
+		`INSERT INTO users (name, created_at) VALUES (?, ?) RETURNING id`,
+		name, toMillis(u.CreatedAt))
+	if err := row.Scan(&u.ID); err != nil {
+		var serr *sqlite.Error
+		if errors.As(err, &serr) && serr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+			return nil, fmt.Errorf("%w: %s", ErrUserExists, name)
+		}
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+	return u, nil
+}
+
+// ListUsers returns the users by name.
+func (ix *Index) ListUsers(ctx context.Context) ([]User, error) {
+	rows, err := ix.db.QueryContext(ctx, `SELECT id, name, created_at FROM users ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		var created int64
+		if err := rows.Scan(&u.ID, &u.Name, &created); err != nil {
+			return nil, fmt.Errorf("failed to read user: %w", err)
+		}
+		u.CreatedAt = fromMillis(created)
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// GetUserSettings returns a user's preferences, or sql.ErrNoRows.
+func (ix *Index) GetUserSettings(ctx context.Context, userID int64) (*UserSettings, error) {
+	var s UserSettings
+	var notifications string
+	err := ix.db.QueryRowContext(ctx,
+		`SELECT timezone, default_camera_group, notifications FROM users WHERE id = ?`, userID).
+		Scan(&s.Timezone, &s.DefaultCameraGroup, &notifications)
+	if err != nil {
+		return nil, err
+	}
+	s.Notifications = json.RawMessage(notifications)
+	return &s, nil
+}
+
+// SaveUserSettings replaces a user's preferences.
+func (ix *Index) SaveUserSettings(ctx context.Context, userID int64, s *UserSettings) error {
+	notifications := "{}"
+	if len(s.Notifications) > 0 {
+		notifications = string(s.Notifications)
+	}
+	_, err := ix.db.ExecContext(ctx,
+		`UPDATE users SET timezone = ?, default_camera_group = ?, notifications = ? WHERE id = ?`,
+		s.Timezone, s.DefaultCameraGroup, notifications, userID)
+	if err != nil {
+		return fmt.Errorf("failed to save user settings: %w", err)
+	}
+	return nil
+}
+
+const tokenColumns = `id, user_id, name, scopes, created_at, expires_at, last_used_at`
+
+func scanToken(row scanner) (*APIToken, error) {
+	var t APIToken
+	var scopes string
+	var created, expires, used int64
+	if err := row.Scan(&t.ID, &t.UserID, &t.Name, &scopes, &created, &expires, &used); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(scopes), &t.Scopes); err != nil {
+		return nil, fmt.Errorf("invalid scopes on token %d: %w", t.ID, err)
+	}
+	t.CreatedAt = fromMillis(created)
+	if expires != 0 {
+		at := fromMillis(expires)
+		t.ExpiresAt = &at
+	}
+	if used != 0 {
+		at := fromMillis(used)
+		t.LastUsedAt = &at
+	}
+	return &t, nil
+}
+
+// CreateToken stores a token by the hash of its secret and sets t.ID.
+func (ix *Index) CreateToken(ctx context.Context, t *APIToken, hash string) error {
+	scopes, err := json.Marshal(t.Scopes)
+	if err != nil {
+		return err
+	}
+	if t.Scopes == nil {
+		scopes = []byte("[]")
+	}
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = time.Now()
+	}
+	var expires int64
+	if t.ExpiresAt != nil {
+		expires = toMillis(*t.ExpiresAt)
+	}
+
+	row := ix.db.QueryRowContext(ctx, `
+		INSERT INTO api_tokens (user_id, name, hash, scopes, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?) RETURNING id`,
+		t.UserID, t.Name, hash, string(scopes), toMillis(t.CreatedAt), expires)
+	if err := row.Scan(&t.ID); err != nil {
+		return fmt.Errorf("failed to create token: %w", err)
+	}
+	return nil
+}
+
+// ListTokens returns a user's tokens, newest first.
+func (ix *Index) ListTokens(ctx context.Context, userID int64) ([]APIToken, error) {
+	rows, err := ix.db.QueryContext(ctx,
+		`SELECT `+tokenColumns+` FROM api_tokens WHERE user_id = ? ORDER BY id DESC`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *t)
+	}
+	return tokens, rows.Err()
+}
+
+// TokenByHash returns the token with the given hash and its user, or
+// sql.ErrNoRows.
+func (ix *Index) TokenByHash(ctx context.Context, hash string) (*APIToken, *User, error) {
+	t, err := scanToken(ix.db.QueryRowContext(ctx,
+		`SELECT `+tokenColumns+` FROM api_tokens WHERE hash = ?`, hash))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	u := &User{ID: t.UserID}
+	var created int64
+	err = ix.db.QueryRowContext(ctx, `SELECT name, created_at FROM users WHERE id = ?`, t.UserID).
+		Scan(&u.Name, &created)
+	if err != nil {
+		return nil, nil, err
+	}
+	u.CreatedAt = fromMillis(created)
+	return t, u, nil
+}
+
+// TouchToken records that a token was used at.
+func (ix *Index) TouchToken(ctx context.Context, id int64, at time.Time) error {
+	_, err := ix.db.ExecContext(ctx, `UPDATE api_tokens SET last_used_at = ? WHERE id = ?`, toMillis(at), id)
+	return err
+}
+
+// DeleteToken revokes one of a user's tokens, returning sql.ErrNoRows if the
+// user has no such token.
+func (ix *Index) DeleteToken(ctx context.Context, userID, id int64) error {
+	res, err := ix.db.ExecContext(ctx, `DELETE FROM api_tokens WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete token: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
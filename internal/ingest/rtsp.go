@@ -0,0 +1,275 @@
+// Package ingest pulls frames from cameras the server connects to itself,
+// such as RTSP cameras, as opposed to cameras that connect to the ingest
+// listener. FFmpeg decodes each stream into JPEGs, which are handed to the
+// server like frames received over a WebSocket.
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/framestore"
+	"github.com/raeeceip/cctv/internal/processor"
+	"github.com/raeeceip/cctv/internal/site"
+	"github.com/raeeceip/cctv/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// Restart delays after a stream fails, doubling up to the maximum
+const (
+	minRestartDelay = time.Second
+	maxRestartDelay = time.Minute
+)
+
+// stallTimeout is how long a stream may go without a frame before FFmpeg
+// is restarted. FFmpeg's own RTSP timeouts differ between versions.
+const stallTimeout = 15 * time.Second
+
+// maxFrameSize guards against reading a broken stream into memory.
+const maxFrameSize = 32 << 20
+
+// Sink receives each decoded frame and takes over its buffer.
+type Sink func(processor.FrameData)
+
+// RTSP pulls frames from the configured RTSP cameras.
+type RTSP struct {
+	sources []config.RTSPSource
+	site    string
+	store   *framestore.Store
+	logger  *logger.Logger
+	sink    Sink
+	// onStream is told when streams start and stop delivering frames
+	onStream func(cameraID string, streaming bool)
+}
+
+// NewRTSP returns a puller for sources, whose camera IDs are qualified with
+// siteID. store is where frames end up, which is used to carry on the
+// numbering of frames stored by an earlier run.
+func NewRTSP(sources []config.RTSPSource, siteID string, store *framestore.Store, log *logger.Logger, sink Sink) *RTSP {
+	return &RTSP{sources: sources, site: siteID, store: store, logger: log, sink: sink}
+}
+
+// OnStream registers fn to be called when a stream starts delivering frames
+// and when it stops. It must be called before Run.
+func (r *RTSP) OnStream(fn func(cameraID string, streaming bool)) {
+	r.onStream = fn
+}
+
+// Cameras returns the camera IDs of the sources.
+func (r *RTSP) Cameras() []string {
+	ids := make([]string, len(r.sources))
+	for i, src := range r.sources {
+		ids[i] = site.Qualify(r.site, src.ID)
+	}
+	return ids
+}
+
+// Run pulls every source until ctx is cancelled, restarting streams that
+// fail.
+func (r *RTSP) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, src := range r.sources {
+		src.ID = site.Qualify(r.site, src.ID)
+		wg.Add(1)
+		go func(src config.RTSPSource) {
+			defer wg.Done()
+			r.supervise(ctx, src)
+		}(src)
+	}
+	wg.Wait()
+}
+
+func (r *RTSP) supervise(ctx context.Context, src config.RTSPSource) {
+	next := r.lastFrameNumber(src.ID) + 1
+	delay := minRestartDelay
+	for {
+		start := time.Now()
+		r.logger.Info("RTSP stream starting",
+			zap.String("camera", src.ID),
+			zap.String("url", redact(src.URL)))
+
+		err := r.pull(ctx, src, &next)
+		if ctx.Err() != nil {
+			return
+		}
+		// A stream that ran for a while was healthy; start over quickly
+		if time.Since(start) > maxRestartDelay {
+			delay = minRestartDelay
+		}
+		r.logger.Error("RTSP stream ended, restarting",
+			zap.String("camera", src.ID),
+			zap.Duration("restart_in", delay),
+			zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
+
+// pull runs FFmpeg on one source until the stream ends, stalls or ctx is
+// cancelled. next is the number of the next frame.
+func (r *RTSP) pull(parent context.Context, src config.RTSPSource, next *uint64) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	args := []string{
+		"-nostdin", "-hide_banner", "-loglevel", "error",
+		"-rtsp_transport", src.Transport,
+		"-i", src.URL,
+		"-an",
+		"-vf", "fps=" + strconv.Itoa(src.FPS),
+		"-c:v", "mjpeg", "-q:v", strconv.Itoa(src.Quality),
+		"-f", "image2pipe", "-",
+	}
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+
+	// Kill FFmpeg when no frame arrives in time
+	stall := time.AfterFunc(stallTimeout, cancel)
+	defer stall.Stop()
+
+	br := bufio.NewReaderSize(stdout, 256<<10)
+	frames := 0
+	var readErr error
+	for {
+		buf := processor.GetBuffer()
+		if readErr = readJPEG(br, buf); readErr != nil {
+			processor.PutBuffer(buf)
+			break
+		}
+		stall.Reset(stallTimeout)
+
+		frame := processor.PooledFrame(buf)
+		frame.CameraID = src.ID
+		frame.Timestamp = time.Now()
+		frame.Number = *next
+		*next++
+		frames++
+		if frames == 1 {
+			r.logger.Info("RTSP stream receiving frames", zap.String("camera", src.ID))
+			if r.onStream != nil {
+				r.onStream(src.ID, true)
+			}
+		}
+		r.sink(frame)
+	}
+	if frames > 0 && r.onStream != nil {
+		r.onStream(src.ID, false)
+	}
+
+	stalled := !stall.Stop()
+	if !errors.Is(readErr, io.EOF) {
+		// FFmpeg is still running, or hung
+		cancel()
+	}
+	// Drain so FFmpeg isn't blocked on a full pipe while it exits
+	io.Copy(io.Discard, br)
+	waitErr := cmd.Wait()
+	switch {
+	case parent.Err() != nil:
+		return parent.Err()
+	case stalled:
+		return fmt.Errorf("no frame for %s", stallTimeout)
+	case !errors.Is(readErr, io.EOF):
+		return readErr
+	case waitErr != nil:
+		// FFmpeg repeats the URL, credentials and all, in its errors
+		output := strings.ReplaceAll(stderr.String(), src.URL, redact(src.URL))
+		return fmt.Errorf("ffmpeg error: %v\nOutput: %s", waitErr, output)
+	default:
+		return fmt.Errorf("stream ended after %d frames", frames)
+	}
+}
+
+// readJPEG reads one JPEG from a stream of concatenated JPEGs into buf, up
+// to and including its end of image marker. Entropy-coded data escapes 0xFF
+// bytes, so the marker can't occur inside the image.
+func readJPEG(r *bufio.Reader, buf *bytes.Buffer) error {
+	for {
+		chunk, err := r.ReadSlice(0xFF)
+		buf.Write(chunk)
+		if buf.Len() > maxFrameSize {
+			return fmt.Errorf("frame larger than %d bytes", maxFrameSize)
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && buf.Len() > 0 {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		b, err := r.ReadByte()
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if b == 0xFF {
+			// Fill byte; the marker may follow it
+			r.UnreadByte()
+			continue
+		}
+		buf.WriteByte(b)
+		if b == 0xD9 {
+			break
+		}
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte{0xFF, 0xD8}) {
+		return fmt.Errorf("stream is not JPEG")
+	}
+	return nil
+}
+
+// lastFrameNumber returns the highest frame number stored for a camera.
+// Consolidation takes frames in number order, so a restarted server must
+// not number new frames below ones still waiting on disk.
+func (r *RTSP) lastFrameNumber(cameraID string) uint64 {
+	frames, err := r.store.Frames(cameraID, time.Time{})
+	if err != nil {
+		r.logger.Warn("Failed to list stored frames", zap.String("camera", cameraID), zap.Error(err))
+		return 0
+	}
+	var last uint64
+	for _, f := range frames {
+		if n, _, ok := r.store.ParseName(filepath.Base(f)); ok && n > last {
+			last = n
+		}
+	}
+	return last
+}
+
+// redact hides the credentials in a camera URL for logging.
+func redact(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "<invalid url>"
+	}
+	return u.Redacted()
+}
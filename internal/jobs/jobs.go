@@ -0,0 +1,248 @@
+// Package jobs runs background work, such as retention transcodes, from a
+// queue persisted in the index so it survives restarts.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/raeeceip/cctv/internal/chaos"
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/index"
+	"github.com/raeeceip/cctv/pkg/logger"
+	"github.com/raeeceip/cctv/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// pollInterval bounds how long a due job waits when nobody calls Enqueue,
+// e.g. a retry scheduled for later.
+const pollInterval = 5 * time.Second
+
+// reportInterval is how often the queued and failed job gauges are updated
+// from the index.
+const reportInterval = 15 * time.Second
+
+// Handler runs one job. A returned error schedules a retry until the
+// configured attempts are used up.
+type Handler func(ctx context.Context, payload json.RawMessage) error
+
+type Queue struct {
+	index       *index.Index
+	logger      *logger.Logger
+	workers     int
+	maxAttempts int
+	metrics     *metrics.JobMetrics
+	chaos       *chaos.Injector // nil unless chaos.enabled
+
+	mu       sync.RWMutex
+	handlers map[string]Handler
+
+	wake chan struct{}
+}
+
+func New(ix *index.Index, log *logger.Logger, cfg config.JobsConfig) *Queue {
+	return &Queue{
+		index:       ix,
+		logger:      log,
+		workers:     cfg.Workers,
+		maxAttempts: cfg.MaxAttempts,
+		metrics:     metrics.NewJobMetrics(),
+		handlers:    make(map[string]Handler),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// InjectFaults fails jobs that run FFmpeg as inj says. Call it before Run.
+func (q *Queue) InjectFaults(inj *chaos.Injector) {
+	q.chaos = inj
+}
+
+// Handle registers the handler for a job kind. Register handlers before
+// calling Run.
+func (q *Queue) Handle(kind string, h Handler) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handlers[kind] = h
+}
+
+// Enqueue adds a job. A non-empty key deduplicates: while a job with the same
+// key is pending or running the call is a no-op and returns false.
+func (q *Queue) Enqueue(ctx context.Context, kind, key string, payload interface{}) (bool, error) {
+	job := &index.Job{Kind: kind, Key: key}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return false, fmt.Errorf("failed to encode %s payload: %w", kind, err)
+		}
+		job.Payload = string(data)
+	}
+
+	added, err := q.index.EnqueueJob(ctx, job)
+	if err != nil {
+		return false, err
+	}
+	if added {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+	return added, nil
+}
+
+// Run starts the workers and blocks until ctx is cancelled and they have
+// finished. Jobs interrupted by a previous shutdown are picked up again.
+func (q *Queue) Run(ctx context.Context) {
+	if n, err := q.index.RequeueRunningJobs(ctx); err != nil {
+		q.logger.Error("Failed to requeue interrupted jobs", zap.Error(err))
+	} else if n > 0 {
+		q.logger.Info("Requeued interrupted jobs", zap.Int64("count", n))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		q.report(ctx)
+	}()
+	for i := 0; i < q.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *Queue) work(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		job, err := q.index.ClaimJob(ctx)
+		if err != nil && ctx.Err() == nil {
+			q.logger.Error("Failed to claim job", zap.Error(err))
+		}
+		if job != nil {
+			q.run(ctx, job)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *Queue) run(ctx context.Context, job *index.Job) {
+	q.mu.RLock()
+	h, ok := q.handlers[job.Kind]
+	q.mu.RUnlock()
+
+	running := q.metrics.Running.WithLabelValues(job.Kind)
+	running.Inc()
+	start := time.Now()
+	var err error
+	if ok {
+		if err = q.chaos.FailJob(job.Kind); err == nil {
+			err = h(ctx, json.RawMessage(job.Payload))
+		}
+	} else {
+		err = fmt.Errorf("no handler for job kind %q", job.Kind)
+	}
+	running.Dec()
+
+	// Interrupted by shutdown: leave it running so the next start requeues it
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+
+	var retryAt time.Time
+	if err != nil && ok && job.Attempts < q.maxAttempts {
+		retryAt = time.Now().Add(backoff(job.Attempts))
+	}
+
+	// Record the outcome even though ctx may be cancelled by now
+	if ferr := q.index.FinishJob(context.Background(), job.ID, err, retryAt); ferr != nil {
+		q.logger.Error("Failed to record job result", zap.Int64("job", job.ID), zap.Error(ferr))
+	}
+
+	result := metrics.JobOK
+	if err != nil {
+		result = metrics.JobFailed
+		if !retryAt.IsZero() {
+			result = metrics.JobRetry
+		}
+	}
+	q.metrics.Runs.WithLabelValues(job.Kind, result).Inc()
+	q.metrics.Duration.WithLabelValues(job.Kind).Observe(time.Since(start).Seconds())
+
+	fields := []zap.Field{
+		zap.Int64("job", job.ID),
+		zap.String("kind", job.Kind),
+		zap.Int("attempt", job.Attempts),
+		zap.Duration("duration", time.Since(start)),
+	}
+	switch {
+	case err == nil:
+		q.logger.Debug("Job completed", fields...)
+	case !retryAt.IsZero():
+		q.logger.Warn("Job failed, will retry", append(fields, zap.Time("retry_at", retryAt), zap.Error(err))...)
+	default:
+		q.logger.Error("Job failed", append(fields, zap.Error(err))...)
+	}
+}
+
+// report keeps the queued and failed job gauges up to date until ctx is
+// cancelled.
+func (q *Queue) report(ctx context.Context) {
+	ticker := time.NewTicker(reportInterval)
+	defer ticker.Stop()
+
+	for {
+		q.updateGauge(ctx, q.metrics.Queued, index.JobPending)
+		q.updateGauge(ctx, q.metrics.Failed, index.JobFailed)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// updateGauge sets gauge to the number of jobs in status for each kind. Kinds
+// with a handler are reported even when they have none.
+func (q *Queue) updateGauge(ctx context.Context, gauge *prometheus.GaugeVec, status string) {
+	counts, err := q.index.CountJobs(ctx, status)
+	if err != nil {
+		if ctx.Err() == nil {
+			q.logger.Warn("Failed to count jobs", zap.String("status", status), zap.Error(err))
+		}
+		return
+	}
+
+	q.mu.RLock()
+	for kind := range q.handlers {
+		if _, ok := counts[kind]; !ok {
+			counts[kind] = 0
+		}
+	}
+	q.mu.RUnlock()
+	for kind, n := range counts {
+		gauge.WithLabelValues(kind).Set(float64(n))
+	}
+}
+
+// backoff grows quadratically: 30s, 2m, 4m30s, ...
+func backoff(attempt int) time.Duration {
+	return time.Duration(attempt*attempt) * 30 * time.Second
+}
@@ -0,0 +1,262 @@
+// Package live lets browsers watch cameras over WebRTC, and NVRs and
+// players over RTSP. Each camera being watched gets one FFmpeg process that
+// encodes its JPEG frames to H.264 and packetizes them as RTP. The packets
+// feed a single track per camera that is added to every viewer's peer
+// connection, and are copied to every RTSP client. Encoding starts with the
+// first viewer and stops when the last one leaves.
+//
+// Signaling is a single HTTP exchange: the browser posts its SDP offer and
+// gets back an answer that already holds all ICE candidates.
+package live
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/processor"
+	"github.com/raeeceip/cctv/internal/videocodec"
+	"github.com/raeeceip/cctv/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// Errors of Watch and Close
+var (
+	ErrNoSession       = errors.New("no such session")
+	ErrInvalidOffer    = errors.New("invalid offer")
+	ErrTooManySessions = errors.New("too many viewers")
+)
+
+// Manager holds the viewers' peer connections and the camera streams they
+// watch.
+type Manager struct {
+	api      *webrtc.API
+	config   webrtc.Configuration
+	encoding encodeSettings
+	logger   *logger.Logger
+	// maxSessions bounds the viewers, 0 for no limit
+	maxSessions int
+
+	mu       sync.Mutex
+	streams  map[string]*stream
+	sessions map[string]*session
+	pending  int // sessions being set up
+}
+
+type session struct {
+	cameraID string
+	pc       *webrtc.PeerConnection
+}
+
+// New returns a manager encoding with the stream settings and the H.264
+// encoder codec selects.
+func New(cfg config.StreamConfig, codec videocodec.Options, log *logger.Logger) (*Manager, error) {
+	media := &webrtc.MediaEngine{}
+	if err := media.RegisterDefaultCodecs(); err != nil {
+		return nil, fmt.Errorf("failed to register codecs: %w", err)
+	}
+	// NACKs and receiver reports from the browser
+	interceptors := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(media, interceptors); err != nil {
+		return nil, fmt.Errorf("failed to register interceptors: %w", err)
+	}
+
+	settings := webrtc.SettingEngine{}
+	if cfg.WebRTC.PortMin > 0 {
+		if err := settings.SetEphemeralUDPPortRange(cfg.WebRTC.PortMin, cfg.WebRTC.PortMax); err != nil {
+			return nil, fmt.Errorf("invalid WebRTC port range: %w", err)
+		}
+	}
+	if len(cfg.WebRTC.PublicIPs) > 0 {
+		settings.SetNAT1To1IPs(cfg.WebRTC.PublicIPs, webrtc.ICECandidateTypeHost)
+	}
+
+	var servers []webrtc.ICEServer
+	for _, s := range cfg.WebRTC.ICEServers {
+		servers = append(servers, webrtc.ICEServer{
+			URLs:       s.URLs,
+			Username:   s.Username,
+			Credential: s.Credential,
+		})
+	}
+
+	return &Manager{
+		api: webrtc.NewAPI(
+			webrtc.WithMediaEngine(media),
+			webrtc.WithInterceptorRegistry(interceptors),
+			webrtc.WithSettingEngine(settings)),
+		config:      webrtc.Configuration{ICEServers: servers},
+		encoding:    newEncodeSettings(cfg, codec),
+		logger:      log,
+		maxSessions: cfg.WebRTC.MaxSessions,
+		streams:     make(map[string]*stream),
+		sessions:    make(map[string]*session),
+	}, nil
+}
+
+// Publish hands a saved frame to the camera's stream, if it is being
+// watched, without blocking.
+func (m *Manager) Publish(f processor.FrameData) {
+	m.mu.Lock()
+	st := m.streams[f.CameraID]
+	m.mu.Unlock()
+	if st != nil {
+		// Data is recycled once the hook returns
+		st.push(append([]byte(nil), f.Data...))
+	}
+}
+
+// Watch answers a viewer's SDP offer for a camera and returns the session
+// ID along with the answer. ICE gathering is finished before returning, so
+// no candidates have to be exchanged afterwards. It fails with
+// ErrTooManySessions once there are as many viewers as allowed.
+func (m *Manager) Watch(ctx context.Context, cameraID, offer string) (id, answer string, err error) {
+	m.mu.Lock()
+	if m.maxSessions > 0 && len(m.sessions)+m.pending >= m.maxSessions {
+		m.mu.Unlock()
+		return "", "", ErrTooManySessions
+	}
+	// The slot is held until the session is added or fails
+	m.pending++
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.pending--
+		m.mu.Unlock()
+	}()
+
+	pc, err := m.api.NewPeerConnection(m.config)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create peer connection: %w", err)
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		pc.Close()
+		return "", "", fmt.Errorf("%w: %w", ErrInvalidOffer, err)
+	}
+	st := m.acquire(cameraID)
+	defer func() {
+		if err != nil {
+			pc.Close()
+			m.release(cameraID)
+		}
+	}()
+
+	sender, err := pc.AddTrack(st.track)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to add track: %w", err)
+	}
+	go func() {
+		// RTCP has to be read for the interceptors to act on it
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	desc, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create answer: %w", err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(desc); err != nil {
+		return "", "", fmt.Errorf("failed to set answer: %w", err)
+	}
+	select {
+	case <-gathered:
+	case <-ctx.Done():
+		return "", "", ctx.Err()
+	}
+
+	id, err = newSessionID()
+	if err != nil {
+		return "", "", err
+	}
+	m.mu.Lock()
+	m.sessions[id] = &session{cameraID: cameraID, pc: pc}
+	m.mu.Unlock()
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		m.logger.Debug("Viewer connection state changed",
+			zap.String("camera", cameraID),
+			zap.String("session", id),
+			zap.String("state", state.String()))
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			m.Close(id)
+		}
+	})
+	m.logger.Info("Viewer joined", zap.String("camera", cameraID), zap.String("session", id))
+	return id, pc.LocalDescription().SDP, nil
+}
+
+// Close ends a viewer's session.
+func (m *Manager) Close(id string) error {
+	m.mu.Lock()
+	s, ok := m.sessions[id]
+	delete(m.sessions, id)
+	m.mu.Unlock()
+	if !ok {
+		return ErrNoSession
+	}
+
+	err := s.pc.Close()
+	m.release(s.cameraID)
+	m.logger.Info("Viewer left", zap.String("camera", s.cameraID), zap.String("session", id))
+	return err
+}
+
+// Shutdown ends every session, which stops the encoders.
+func (m *Manager) Shutdown() {
+	m.mu.Lock()
+	ids := make([]string, 0, len(m.sessions))
+	for id := range m.sessions {
+		ids = append(ids, id)
+	}
+	m.mu.Unlock()
+
+	for _, id := range ids {
+		m.Close(id)
+	}
+}
+
+// acquire returns the camera's stream, starting it for the first viewer.
+func (m *Manager) acquire(cameraID string) *stream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.streams[cameraID]
+	if st == nil {
+		st = m.startStream(cameraID)
+		m.streams[cameraID] = st
+	}
+	st.viewers++
+	return st
+}
+
+// release drops a viewer, stopping the stream after the last one.
+func (m *Manager) release(cameraID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.streams[cameraID]
+	if st == nil {
+		return
+	}
+	if st.viewers--; st.viewers == 0 {
+		delete(m.streams, cameraID)
+		st.stop()
+	}
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate session id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,483 @@
+package live
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raeeceip/cctv/pkg/logger"
+	"github.com/raeeceip/cctv/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	// rtspPacketBuffer is how many packets may wait for an RTSP client.
+	// Packets beyond it are dropped rather than holding up the others.
+	rtspPacketBuffer = 256
+	// rtspWriteTimeout bounds a write to an RTSP client's connection
+	rtspWriteTimeout = 5 * time.Second
+	// rtspPayloadType is the payload type of the video in the SDP
+	rtspPayloadType = 96
+	// maxRTSPBody bounds the body of a request, which is skipped
+	maxRTSPBody = 64 << 10
+	// rtspTrack is the control URL of the video, relative to the camera's
+	rtspTrack = "trackID=0"
+)
+
+// rtspStatus holds the RTSP status texts that HTTP doesn't have.
+var rtspStatus = map[int]string{
+	454: "Session Not Found",
+	455: "Method Not Valid in This State",
+	461: "Unsupported Transport",
+}
+
+// RTSPServer republishes the cameras' live streams over RTSP, at
+// rtsp://host:port/<camera>, for NVRs and players such as VLC. It shares
+// the encoders of the WebRTC viewers: a camera is encoded while anyone
+// watches it, in a browser or over RTSP.
+//
+// RTP is sent over the RTSP connection (interleaved) or over UDP, as the
+// client asks. A session ends with its connection.
+type RTSPServer struct {
+	manager *Manager
+	addr    string
+	known   func(cameraID string) bool
+	metrics *metrics.RTSPMetrics
+	logger  *logger.Logger
+}
+
+// NewRTSPServer returns a server listening on addr for the streams of m.
+// Cameras known reports false for are not found.
+func NewRTSPServer(m *Manager, addr string, known func(cameraID string) bool, log *logger.Logger) *RTSPServer {
+	return &RTSPServer{
+		manager: m,
+		addr:    addr,
+		known:   known,
+		metrics: metrics.NewRTSPMetrics(),
+		logger:  log,
+	}
+}
+
+// Run serves RTSP clients until ctx is cancelled, then waits for their
+// connections to close.
+func (r *RTSPServer) Run(ctx context.Context) {
+	ln, err := net.Listen("tcp", r.addr)
+	if err != nil {
+		r.logger.Error("Failed to listen for RTSP clients", zap.String("addr", r.addr), zap.Error(err))
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	r.logger.Info("Serving live streams over RTSP", zap.String("addr", ln.Addr().String()))
+
+	var conns sync.WaitGroup
+	defer conns.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			r.logger.Warn("Failed to accept RTSP client", zap.Error(err))
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			stop := context.AfterFunc(ctx, func() { conn.Close() })
+			defer stop()
+			c := &rtspConn{server: r, conn: conn, r: bufio.NewReader(conn)}
+			c.serve()
+		}()
+	}
+}
+
+// rtspConn is a client's connection.
+type rtspConn struct {
+	server *RTSPServer
+	conn   net.Conn
+	r      *bufio.Reader
+	// writeMu orders responses and interleaved packets
+	writeMu sync.Mutex
+	session *rtspSession // once set up
+}
+
+type rtspRequest struct {
+	method string
+	url    string
+	header textproto.MIMEHeader
+}
+
+// rtspSession is a client watching a camera.
+type rtspSession struct {
+	id        string
+	cameraID  string
+	conn      *rtspConn
+	transport string // tcp or udp
+	channel   byte   // of RTP over the connection
+	udp       *net.UDPConn
+	dest      *net.UDPAddr
+	packets   chan []byte
+	done      chan struct{}
+	stream    *stream // while playing
+	metrics   *metrics.RTSPMetrics
+}
+
+// serve answers requests until the connection closes.
+func (c *rtspConn) serve() {
+	defer c.conn.Close()
+	defer c.teardown()
+	for {
+		req, err := c.read()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				c.server.logger.Debug("RTSP connection ended",
+					zap.String("remote", c.conn.RemoteAddr().String()),
+					zap.Error(err))
+			}
+			return
+		}
+		if err := c.handle(req); err != nil {
+			return
+		}
+	}
+}
+
+// read returns the next request, skipping the RTCP packets clients send
+// over the connection.
+func (c *rtspConn) read() (*rtspRequest, error) {
+	for {
+		b, err := c.r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != '$' {
+			break
+		}
+		var hdr [4]byte
+		if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+			return nil, err
+		}
+		if _, err := c.r.Discard(int(binary.BigEndian.Uint16(hdr[2:]))); err != nil {
+			return nil, err
+		}
+	}
+
+	tp := textproto.NewReader(c.r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Fields(line)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "RTSP/") {
+		return nil, fmt.Errorf("malformed request line %q", line)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := strconv.Atoi(header.Get("Content-Length")); n > 0 {
+		if n > maxRTSPBody {
+			return nil, fmt.Errorf("request body too large")
+		}
+		if _, err := c.r.Discard(n); err != nil {
+			return nil, err
+		}
+	}
+	return &rtspRequest{method: parts[0], url: parts[1], header: header}, nil
+}
+
+// handle answers a request. An error closes the connection.
+func (c *rtspConn) handle(req *rtspRequest) error {
+	if id := req.header.Get("Session"); id != "" && (c.session == nil || sessionID(id) != c.session.id) {
+		return c.respond(req, 454, nil, "")
+	}
+
+	switch req.method {
+	case "OPTIONS":
+		return c.respond(req, http.StatusOK, []string{"Public: OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER"}, "")
+
+	case "DESCRIBE":
+		cameraID, ok := c.camera(req.url)
+		if !ok {
+			return c.respond(req, http.StatusNotFound, nil, "")
+		}
+		return c.respond(req, http.StatusOK, []string{
+			"Content-Base: " + strings.TrimSuffix(req.url, "/") + "/",
+			"Content-Type: application/sdp",
+		}, c.sdp(cameraID))
+
+	case "SETUP":
+		if c.session != nil {
+			// One camera per connection
+			return c.respond(req, 455, nil, "")
+		}
+		cameraID, ok := c.camera(req.url)
+		if !ok {
+			return c.respond(req, http.StatusNotFound, nil, "")
+		}
+		s, transport, err := c.setup(cameraID, req.header.Get("Transport"))
+		if err != nil {
+			c.server.logger.Debug("Rejected RTSP transport",
+				zap.String("camera", cameraID),
+				zap.String("transport", req.header.Get("Transport")),
+				zap.Error(err))
+			return c.respond(req, 461, nil, "")
+		}
+		c.session = s
+		go s.run()
+		return c.respond(req, http.StatusOK, []string{"Transport: " + transport, "Session: " + s.id}, "")
+
+	case "PLAY":
+		if c.session == nil {
+			return c.respond(req, 455, nil, "")
+		}
+		c.session.play(c.server.manager)
+		c.server.logger.Info("RTSP client playing",
+			zap.String("camera", c.session.cameraID),
+			zap.String("remote", c.conn.RemoteAddr().String()),
+			zap.String("transport", c.session.transport))
+		return c.respond(req, http.StatusOK, []string{"Range: npt=0.000-", "Session: " + c.session.id}, "")
+
+	case "TEARDOWN":
+		var header []string
+		if c.session != nil {
+			header = []string{"Session: " + c.session.id}
+		}
+		c.teardown()
+		return c.respond(req, http.StatusOK, header, "")
+
+	case "GET_PARAMETER", "SET_PARAMETER":
+		// Keep-alives
+		var header []string
+		if c.session != nil {
+			header = []string{"Session: " + c.session.id}
+		}
+		return c.respond(req, http.StatusOK, header, "")
+
+	default:
+		return c.respond(req, http.StatusNotImplemented, nil, "")
+	}
+}
+
+// camera returns the camera a request URL names, without the track, if it
+// is known.
+func (c *rtspConn) camera(rawURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+	id := strings.Trim(u.Path, "/")
+	id = strings.TrimSuffix(strings.TrimSuffix(id, rtspTrack), "/")
+	if id == "" || !c.server.known(id) {
+		return "", false
+	}
+	return id, true
+}
+
+// sdp describes the camera's stream: a single H.264 track, whose parameter
+// sets come in-band with every keyframe.
+func (c *rtspConn) sdp(cameraID string) string {
+	host := "0.0.0.0"
+	if addr, ok := c.conn.LocalAddr().(*net.TCPAddr); ok {
+		host = addr.IP.String()
+	}
+	return fmt.Sprintf("v=0\r\n"+
+		"o=- 0 0 IN IP4 %s\r\n"+
+		"s=%s\r\n"+
+		"c=IN IP4 0.0.0.0\r\n"+
+		"t=0 0\r\n"+
+		"m=video 0 RTP/AVP %d\r\n"+
+		"a=rtpmap:%d H264/90000\r\n"+
+		"a=fmtp:%d packetization-mode=1;profile-level-id=42e01f\r\n"+
+		"a=control:%s\r\n",
+		host, cameraID, rtspPayloadType, rtspPayloadType, rtspPayloadType, rtspTrack)
+}
+
+// setup prepares a session for the first transport of a Transport header
+// that can be served: RTP over the connection, or unicast UDP. It returns
+// the session and the transport to answer with.
+func (c *rtspConn) setup(cameraID, header string) (*rtspSession, string, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, "", err
+	}
+	s := &rtspSession{
+		id:       id[:16],
+		cameraID: cameraID,
+		conn:     c,
+		packets:  make(chan []byte, rtspPacketBuffer),
+		done:     make(chan struct{}),
+		metrics:  c.server.metrics,
+	}
+
+	for _, spec := range strings.Split(header, ",") {
+		params := strings.Split(strings.TrimSpace(spec), ";")
+		options := make(map[string]string)
+		for _, p := range params[1:] {
+			k, v, _ := strings.Cut(p, "=")
+			options[strings.ToLower(k)] = v
+		}
+		if _, ok := options["multicast"]; ok {
+			continue
+		}
+
+		switch params[0] {
+		case "RTP/AVP/TCP":
+			channels := "0-1"
+			if v, ok := options["interleaved"]; ok {
+				channels = v
+			}
+			first, _, _ := strings.Cut(channels, "-")
+			ch, err := strconv.Atoi(first)
+			if err != nil || ch < 0 || ch > 254 {
+				continue
+			}
+			s.transport, s.channel = "tcp", byte(ch)
+			return s, fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", ch, ch+1), nil
+
+		case "RTP/AVP", "RTP/AVP/UDP":
+			ports, ok := options["client_port"]
+			if !ok {
+				continue
+			}
+			first, _, _ := strings.Cut(ports, "-")
+			port, err := strconv.Atoi(first)
+			if err != nil || port <= 0 || port > 65535 {
+				continue
+			}
+			remote, ok := c.conn.RemoteAddr().(*net.TCPAddr)
+			if !ok {
+				continue
+			}
+			udp, err := net.ListenUDP("udp", &net.UDPAddr{})
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to open RTP socket: %w", err)
+			}
+			local := udp.LocalAddr().(*net.UDPAddr).Port
+			s.transport, s.udp = "udp", udp
+			s.dest = &net.UDPAddr{IP: remote.IP, Port: port, Zone: remote.Zone}
+			return s, fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d", port, port+1, local, local+1), nil
+		}
+	}
+	return nil, "", fmt.Errorf("no supported transport")
+}
+
+// teardown ends the connection's session, if any.
+func (c *rtspConn) teardown() {
+	s := c.session
+	if s == nil {
+		return
+	}
+	c.session = nil
+	close(s.done)
+	if s.stream != nil {
+		s.stream.removeClient(s)
+		c.server.manager.release(s.cameraID)
+		s.metrics.Sessions.WithLabelValues(s.transport).Dec()
+		c.server.logger.Info("RTSP client stopped",
+			zap.String("camera", s.cameraID),
+			zap.String("remote", c.conn.RemoteAddr().String()))
+	}
+	if s.udp != nil {
+		s.udp.Close()
+	}
+}
+
+// respond writes a response with the request's CSeq, extra header lines
+// and body.
+func (c *rtspConn) respond(req *rtspRequest, status int, header []string, body string) error {
+	text, ok := rtspStatus[status]
+	if !ok {
+		text = http.StatusText(status)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "RTSP/1.0 %d %s\r\n", status, text)
+	fmt.Fprintf(&b, "CSeq: %s\r\n", req.header.Get("CSeq"))
+	for _, h := range header {
+		b.WriteString(h + "\r\n")
+	}
+	if body != "" {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(body))
+	}
+	b.WriteString("\r\n" + body)
+	return c.write([]byte(b.String()))
+}
+
+func (c *rtspConn) write(p []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(rtspWriteTimeout))
+	_, err := c.conn.Write(p)
+	return err
+}
+
+// sessionID returns the ID of a Session header, without its timeout.
+func sessionID(header string) string {
+	id, _, _ := strings.Cut(header, ";")
+	return strings.TrimSpace(id)
+}
+
+// play starts forwarding the camera's stream to the client.
+func (s *rtspSession) play(m *Manager) {
+	if s.stream != nil {
+		return
+	}
+	s.stream = m.acquire(s.cameraID)
+	s.stream.addClient(s)
+	s.metrics.Sessions.WithLabelValues(s.transport).Inc()
+}
+
+// send queues a packet for the client without blocking.
+func (s *rtspSession) send(packet []byte) {
+	p := append([]byte(nil), packet...)
+	// FFmpeg picks its own payload type
+	if len(p) > 1 {
+		p[1] = p[1]&0x80 | rtspPayloadType
+	}
+	select {
+	case s.packets <- p:
+	default:
+		s.metrics.PacketsDropped.Inc()
+	}
+}
+
+// run writes the queued packets to the client until the session ends. A
+// client that can't take them over the connection is disconnected.
+func (s *rtspSession) run() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case p := <-s.packets:
+			if s.udp != nil {
+				// Clients that went away without a TEARDOWN are noticed
+				// when their connection closes
+				s.udp.WriteToUDP(p, s.dest)
+				continue
+			}
+			frame := make([]byte, 4+len(p))
+			frame[0], frame[1] = '$', s.channel
+			binary.BigEndian.PutUint16(frame[2:], uint16(len(p)))
+			copy(frame[4:], p)
+			if err := s.conn.write(frame); err != nil {
+				s.conn.conn.Close()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package live
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/videocodec"
+	"go.uber.org/zap"
+)
+
+// frameBuffer is how many frames may wait for the encoder. Live viewing
+// drops frames rather than falling behind.
+const frameBuffer = 8
+
+// restartDelay is how long a failed encoder waits before starting again.
+const restartDelay = time.Second
+
+// rtpPacketSize leaves room for SRTP and tunnel overhead within a typical
+// MTU.
+const rtpPacketSize = 1200
+
+// h264Format is what the encoder produces: constrained baseline, which every
+// browser decodes.
+var h264Format = webrtc.RTPCodecCapability{
+	MimeType:    webrtc.MimeTypeH264,
+	ClockRate:   90000,
+	SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+}
+
+// baselineProfiles name the constrained baseline profile for the H.264
+// encoders that can be asked for it. The others make what they make.
+var baselineProfiles = map[string]string{
+	"libx264":           "baseline",
+	"h264_nvenc":        "baseline",
+	"h264_vaapi":        "constrained_baseline",
+	"h264_videotoolbox": "baseline",
+}
+
+type encodeSettings struct {
+	codec     videocodec.Options
+	bitrate   int
+	framerate int
+	// options are libx264's; other encoders don't take its presets
+	options map[string]string
+}
+
+func newEncodeSettings(cfg config.StreamConfig, codec videocodec.Options) encodeSettings {
+	options := cfg.Options
+	if len(options) == 0 {
+		options = map[string]string{"preset": "ultrafast", "tune": "zerolatency"}
+	}
+	return encodeSettings{codec: codec, bitrate: cfg.VideoBitrate, framerate: cfg.Framerate, options: options}
+}
+
+// args returns the FFmpeg command line that reads JPEGs from stdin, encodes
+// them with enc and sends RTP to addr. Frames are timed by when they
+// arrive, so the video keeps pace with cameras whatever their frame rate. A
+// keyframe every second bounds how long a new viewer waits for the picture.
+func (e encodeSettings) args(addr string, enc videocodec.Encoder) []string {
+	args := []string{
+		"-hide_banner", "-loglevel", "error",
+		"-fflags", "nobuffer",
+		"-use_wallclock_as_timestamps", "1",
+	}
+	args = append(args, enc.InputArgs()...)
+	args = append(args, "-f", "image2pipe", "-c:v", "mjpeg", "-i", "-", "-an")
+	args = append(args, enc.FilterArgs("scale=trunc(iw/2)*2:trunc(ih/2)*2")...)
+	args = append(args, enc.Args(e.bitrate)...)
+	if profile := baselineProfiles[enc.Name]; profile != "" {
+		args = append(args, "-profile:v", profile)
+	}
+	args = append(args, "-g", strconv.Itoa(e.framerate))
+	if enc.Name == "libx264" {
+		keys := make([]string, 0, len(e.options))
+		for k := range e.options {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			args = append(args, "-"+k, e.options[k])
+		}
+	}
+	return append(args,
+		"-vsync", "passthrough",
+		"-f", "rtp", "-pkt_size", strconv.Itoa(rtpPacketSize),
+		"rtp://"+addr)
+}
+
+// stream encodes one camera for its viewers.
+type stream struct {
+	cameraID string
+	track    *webrtc.TrackLocalStaticRTP
+	frames   chan []byte
+	cancel   context.CancelFunc
+	viewers  int
+
+	// RTSP clients playing the stream get the packets too
+	mu      sync.Mutex
+	clients map[*rtspSession]struct{}
+}
+
+func (m *Manager) startStream(cameraID string) *stream {
+	// The codec is fixed, so this can't fail
+	track, _ := webrtc.NewTrackLocalStaticRTP(h264Format, "video", cameraID)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	st := &stream{
+		cameraID: cameraID,
+		track:    track,
+		frames:   make(chan []byte, frameBuffer),
+		cancel:   cancel,
+		clients:  make(map[*rtspSession]struct{}),
+	}
+	go m.run(ctx, st)
+	return st
+}
+
+func (st *stream) push(frame []byte) {
+	select {
+	case st.frames <- frame:
+	default:
+	}
+}
+
+func (st *stream) stop() {
+	st.cancel()
+}
+
+func (st *stream) addClient(s *rtspSession) {
+	st.mu.Lock()
+	st.clients[s] = struct{}{}
+	st.mu.Unlock()
+}
+
+func (st *stream) removeClient(s *rtspSession) {
+	st.mu.Lock()
+	delete(st.clients, s)
+	st.mu.Unlock()
+}
+
+// forward hands an RTP packet to the RTSP clients without blocking.
+func (st *stream) forward(packet []byte) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for s := range st.clients {
+		s.send(packet)
+	}
+}
+
+// run keeps the encoder going until the stream is stopped.
+func (m *Manager) run(ctx context.Context, st *stream) {
+	m.logger.Info("Live encoder starting", zap.String("camera", st.cameraID))
+	for {
+		err := m.encode(ctx, st)
+		if ctx.Err() != nil {
+			m.logger.Info("Live encoder stopped", zap.String("camera", st.cameraID))
+			return
+		}
+		m.logger.Error("Live encoder failed, restarting",
+			zap.String("camera", st.cameraID),
+			zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(restartDelay):
+		}
+	}
+}
+
+// encode runs FFmpeg once, feeding it the stream's frames and forwarding the
+// RTP packets it sends to a local UDP socket to the track.
+func (m *Manager) encode(ctx context.Context, st *stream) error {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to open RTP socket: %w", err)
+	}
+	defer conn.Close()
+
+	enc := videocodec.Select(m.encoding.codec, m.logger)
+	cmd := exec.CommandContext(ctx, "ffmpeg", m.encoding.args(conn.LocalAddr().String(), enc)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// Packets are rewritten for each viewer's payload type and SSRC
+			if _, err := st.track.Write(buf[:n]); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+				m.logger.Debug("Failed to forward RTP packet",
+					zap.String("camera", st.cameraID),
+					zap.Error(err))
+			}
+			st.forward(buf[:n])
+		}
+	}()
+
+	var writeErr error
+	for writeErr == nil {
+		select {
+		case <-ctx.Done():
+			writeErr = ctx.Err()
+		case frame := <-st.frames:
+			_, writeErr = stdin.Write(frame)
+		}
+	}
+	stdin.Close()
+
+	if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("ffmpeg error: %v\nOutput: %s", err, stderr.String())
+	}
+	return writeErr
+}
@@ -0,0 +1,222 @@
+package motion
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/raeeceip/cctv/internal/codec"
+)
+
+// analysisWidth is the width frames are reduced to before comparison. It
+// keeps detection cheap and ignores sensor noise at full resolution.
+const analysisWidth = 160
+
+// Gray is a downscaled luminance plane.
+type Gray struct {
+	Width, Height int
+	Pix           []uint8
+}
+
+// NewGray reduces img to analysisWidth, keeping its aspect ratio.
+func NewGray(img image.Image) *Gray {
+	b := img.Bounds()
+	w := analysisWidth
+	if b.Dx() < w {
+		w = b.Dx()
+	}
+	h := b.Dy() * w / b.Dx()
+	if h < 1 {
+		h = 1
+	}
+
+	g := &Gray{Width: w, Height: h, Pix: make([]uint8, w*h)}
+	ycc, isYCbCr := img.(*image.YCbCr)
+	for y := 0; y < h; y++ {
+		sy := b.Min.Y + y*b.Dy()/h
+		for x := 0; x < w; x++ {
+			sx := b.Min.X + x*b.Dx()/w
+			if isYCbCr {
+				// JPEGs decode to YCbCr; Y is the luminance already
+				g.Pix[y*w+x] = ycc.Y[ycc.YOffset(sx, sy)]
+				continue
+			}
+			r, gg, bb, _ := img.At(sx, sy).RGBA()
+			g.Pix[y*w+x] = uint8((19595*r + 38470*gg + 7471*bb + 1<<15) >> 24)
+		}
+	}
+	return g
+}
+
+// DecodeGray decodes a JPEG and reduces it with NewGray.
+func DecodeGray(data []byte) (image.Image, *Gray, error) {
+	img, err := codec.Decode(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode frame: %w", err)
+	}
+	return img, NewGray(img), nil
+}
+
+// Result describes the change between two frames.
+type Result struct {
+	Motion bool `json:"motion"`
+	// Changed is the fraction of the watched area that changed
+	Changed float64 `json:"changed"`
+	// LargestBlob is the fraction of the frame covered by the largest
+	// connected changed region
+	LargestBlob float64 `json:"largest_blob"`
+	// Blobs counts regions at least MinBlobSize large
+	Blobs int `json:"blobs"`
+	// Box bounds the blobs that count, in coordinates normalized to the
+	// frame size; zero without any
+	Box Box `json:"box"`
+	// Intensity is how strongly the pixels of those blobs changed on
+	// average, from 0 to 1
+	Intensity float64 `json:"intensity"`
+
+	width, height int
+	watched       []bool
+	cells         []cell
+}
+
+// Box is a rectangle in coordinates normalized to the frame size.
+type Box struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+type cell uint8
+
+const (
+	cellStill  cell = iota
+	cellNoise       // changed, in a blob below MinBlobSize
+	cellMotion      // changed, in a blob that counts
+)
+
+// Detect compares prev and cur, which must come from frames of the same
+// size, under settings s.
+func Detect(prev, cur *Gray, s Settings) (Result, error) {
+	if prev.Width != cur.Width || prev.Height != cur.Height {
+		return Result{}, fmt.Errorf("frame size changed from %dx%d to %dx%d",
+			prev.Width, prev.Height, cur.Width, cur.Height)
+	}
+
+	w, h := cur.Width, cur.Height
+	res := Result{
+		width:   w,
+		height:  h,
+		watched: zoneMask(s.Zones, w, h),
+		cells:   make([]cell, w*h),
+	}
+
+	threshold := s.threshold()
+	changed := make([]bool, w*h)
+	diff := make([]uint8, w*h)
+	watched, changedCount := 0, 0
+	for i := range cur.Pix {
+		if !res.watched[i] {
+			continue
+		}
+		watched++
+		d := int(cur.Pix[i]) - int(prev.Pix[i])
+		if d < 0 {
+			d = -d
+		}
+		diff[i] = uint8(d)
+		if d > threshold {
+			changed[i] = true
+			changedCount++
+		}
+	}
+	if watched > 0 {
+		res.Changed = float64(changedCount) / float64(watched)
+	}
+
+	// Group changed pixels into 4-connected blobs
+	minPixels := int(s.MinBlobSize * float64(w*h))
+	seen := make([]bool, w*h)
+	minX, minY, maxX, maxY := w, h, -1, -1
+	motionPixels, motionDiff := 0, 0
+	var stack, blob []int
+	for start := range changed {
+		if !changed[start] || seen[start] {
+			continue
+		}
+
+		blob = blob[:0]
+		stack = append(stack[:0], start)
+		seen[start] = true
+		for len(stack) > 0 {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			blob = append(blob, i)
+
+			x, y := i%w, i/w
+			for _, n := range [4][2]int{{x - 1, y}, {x + 1, y}, {x, y - 1}, {x, y + 1}} {
+				if n[0] < 0 || n[0] >= w || n[1] < 0 || n[1] >= h {
+					continue
+				}
+				j := n[1]*w + n[0]
+				if changed[j] && !seen[j] {
+					seen[j] = true
+					stack = append(stack, j)
+				}
+			}
+		}
+
+		mark := cellNoise
+		if len(blob) >= minPixels {
+			mark = cellMotion
+			res.Blobs++
+			for _, i := range blob {
+				x, y := i%w, i/w
+				minX, minY = min(minX, x), min(minY, y)
+				maxX, maxY = max(maxX, x), max(maxY, y)
+				motionDiff += int(diff[i])
+			}
+			motionPixels += len(blob)
+		}
+		for _, i := range blob {
+			res.cells[i] = mark
+		}
+		if size := float64(len(blob)) / float64(w*h); size > res.LargestBlob {
+			res.LargestBlob = size
+		}
+	}
+
+	if motionPixels > 0 {
+		res.Box = Box{
+			X:      float64(minX) / float64(w),
+			Y:      float64(minY) / float64(h),
+			Width:  float64(maxX-minX+1) / float64(w),
+			Height: float64(maxY-minY+1) / float64(h),
+		}
+		res.Intensity = float64(motionDiff) / float64(motionPixels) / 255
+	}
+
+	res.Motion = s.Enabled && res.Blobs > 0
+	return res, nil
+}
+
+// zoneMask marks the pixels covered by any zone, or all of them.
+func zoneMask(zones []Zone, w, h int) []bool {
+	mask := make([]bool, w*h)
+	if len(zones) == 0 {
+		for i := range mask {
+			mask[i] = true
+		}
+		return mask
+	}
+
+	for _, z := range zones {
+		x0, y0 := int(z.X*float64(w)), int(z.Y*float64(h))
+		x1, y1 := int((z.X+z.Width)*float64(w)+0.5), int((z.Y+z.Height)*float64(h)+0.5)
+		for y := y0; y < y1 && y < h; y++ {
+			for x := x0; x < x1 && x < w; x++ {
+				mask[y*w+x] = true
+			}
+		}
+	}
+	return mask
+}
@@ -0,0 +1,141 @@
+package motion
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"sync"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/codec"
+)
+
+var (
+	zoneColor   = color.RGBA{0, 220, 0, 255}
+	motionColor = color.RGBA{255, 0, 0, 255}
+	noiseColor  = color.RGBA{255, 200, 0, 255}
+)
+
+// RenderPreview draws res over img as a JPEG: areas outside the zones are
+// dimmed, blobs that count as motion are tinted red, smaller changes yellow,
+// and zone outlines are drawn in green.
+func RenderPreview(img image.Image, res Result, s Settings) ([]byte, error) {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+
+	for y := 0; y < b.Dy(); y++ {
+		gy := y * res.height / b.Dy()
+		for x := 0; x < b.Dx(); x++ {
+			gx := x * res.width / b.Dx()
+			i := gy*res.width + gx
+
+			c := color.RGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.RGBA)
+			switch {
+			case !res.watched[i]:
+				c = color.RGBA{c.R / 3, c.G / 3, c.B / 3, 255}
+			case res.cells[i] == cellMotion:
+				c = blend(c, motionColor)
+			case res.cells[i] == cellNoise:
+				c = blend(c, noiseColor)
+			}
+			out.SetRGBA(x, y, c)
+		}
+	}
+
+	for _, z := range s.Zones {
+		drawRect(out, image.Rect(
+			int(z.X*float64(b.Dx())), int(z.Y*float64(b.Dy())),
+			int((z.X+z.Width)*float64(b.Dx())), int((z.Y+z.Height)*float64(b.Dy()))))
+	}
+
+	var buf bytes.Buffer
+	if err := codec.Encode(&buf, out, 80); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func blend(c, tint color.RGBA) color.RGBA {
+	return color.RGBA{
+		uint8((uint16(c.R) + uint16(tint.R)) / 2),
+		uint8((uint16(c.G) + uint16(tint.G)) / 2),
+		uint8((uint16(c.B) + uint16(tint.B)) / 2),
+		255,
+	}
+}
+
+func drawRect(img *image.RGBA, r image.Rectangle) {
+	const thickness = 2
+	r = r.Intersect(img.Bounds())
+	for t := 0; t < thickness; t++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			img.SetRGBA(x, r.Min.Y+t, zoneColor)
+			img.SetRGBA(x, r.Max.Y-1-t, zoneColor)
+		}
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			img.SetRGBA(r.Min.X+t, y, zoneColor)
+			img.SetRGBA(r.Max.X-1-t, y, zoneColor)
+		}
+	}
+}
+
+// Frame is a stored JPEG.
+type Frame struct {
+	Data []byte
+	Time time.Time
+}
+
+// Snapshots keeps the latest frame of each camera together with a
+// reference frame roughly gap older, which is what a preview compares it
+// with. Successive frames are too close together to show movement.
+type Snapshots struct {
+	gap    time.Duration
+	mu     sync.RWMutex
+	frames map[string]*snapshotPair
+}
+
+type snapshotPair struct {
+	ref, cur Frame
+}
+
+func NewSnapshots(gap time.Duration) *Snapshots {
+	return &Snapshots{gap: gap, frames: make(map[string]*snapshotPair)}
+}
+
+// Put records a copy of the latest frame of a camera. The copy reuses the
+// buffer of the frame it replaces, so a steady stream does not allocate.
+func (s *Snapshots) Put(camera string, data []byte, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.frames[camera]
+	if !ok {
+		s.frames[camera] = &snapshotPair{
+			ref: Frame{Data: append([]byte(nil), data...), Time: t},
+			cur: Frame{Data: append([]byte(nil), data...), Time: t},
+		}
+		return
+	}
+
+	buf := p.cur.Data
+	if p.cur.Time.Sub(p.ref.Time) >= s.gap {
+		// The current frame becomes the reference instead of being replaced
+		buf = p.ref.Data
+		p.ref = p.cur
+	}
+	p.cur = Frame{Data: append(buf[:0], data...), Time: t}
+}
+
+// Get returns copies of the reference and latest frame of a camera.
+func (s *Snapshots) Get(camera string) (ref, cur Frame, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.frames[camera]
+	if !ok {
+		return Frame{}, Frame{}, false
+	}
+	ref = Frame{Data: append([]byte(nil), p.ref.Data...), Time: p.ref.Time}
+	cur = Frame{Data: append([]byte(nil), p.cur.Data...), Time: p.cur.Time}
+	return ref, cur, true
+}
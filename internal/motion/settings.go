@@ -0,0 +1,87 @@
+// Package motion detects movement by comparing downscaled luminance of
+// successive frames and grouping the changed pixels into blobs.
+package motion
+
+import (
+	"fmt"
+	"math"
+)
+
+// Settings tune detection for one camera.
+type Settings struct {
+	Enabled bool `json:"enabled"`
+	// Sensitivity from 1 to 100; higher values react to fainter changes
+	Sensitivity int `json:"sensitivity"`
+	// MinBlobSize is the fraction of the frame a connected changed region
+	// must cover to count as motion
+	MinBlobSize float64 `json:"min_blob_size"`
+	// Zones restrict detection to parts of the frame; empty watches all of it
+	Zones []Zone `json:"zones"`
+	// CooldownSeconds is the minimum time between motion events
+	CooldownSeconds int `json:"cooldown_seconds"`
+}
+
+// Zone is a rectangle in coordinates normalized to the frame size, so it
+// survives resolution changes.
+type Zone struct {
+	Name   string  `json:"name,omitempty"`
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// ZoneOf names the zone a box overlaps most, e.g. to say where motion was.
+// Zones without a name are called "zone 1", "zone 2" and so on; it is
+// empty without zones or when the box lies outside all of them.
+func (s Settings) ZoneOf(b Box) string {
+	name, most := "", 0.0
+	for i, z := range s.Zones {
+		w := math.Min(b.X+b.Width, z.X+z.Width) - math.Max(b.X, z.X)
+		h := math.Min(b.Y+b.Height, z.Y+z.Height) - math.Max(b.Y, z.Y)
+		if w <= 0 || h <= 0 || w*h <= most {
+			continue
+		}
+		most = w * h
+		name = z.Name
+		if name == "" {
+			name = fmt.Sprintf("zone %d", i+1)
+		}
+	}
+	return name
+}
+
+// DefaultSettings apply to cameras without a saved profile.
+func DefaultSettings() Settings {
+	return Settings{
+		Enabled:         true,
+		Sensitivity:     50,
+		MinBlobSize:     0.005,
+		CooldownSeconds: 10,
+	}
+}
+
+func (s Settings) Validate() error {
+	if s.Sensitivity < 1 || s.Sensitivity > 100 {
+		return fmt.Errorf("sensitivity must be between 1 and 100")
+	}
+	if s.MinBlobSize < 0 || s.MinBlobSize > 1 {
+		return fmt.Errorf("min_blob_size must be between 0 and 1")
+	}
+	if s.CooldownSeconds < 0 {
+		return fmt.Errorf("cooldown_seconds must not be negative")
+	}
+	for i, z := range s.Zones {
+		if z.X < 0 || z.Y < 0 || z.Width <= 0 || z.Height <= 0 ||
+			z.X+z.Width > 1 || z.Y+z.Height > 1 {
+			return fmt.Errorf("zone %d must lie within the frame (0-1 coordinates)", i)
+		}
+	}
+	return nil
+}
+
+// threshold is the luminance difference, out of 255, at which a pixel
+// counts as changed.
+func (s Settings) threshold() int {
+	return 5 + (100-s.Sensitivity)*60/100
+}
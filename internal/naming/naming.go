@@ -0,0 +1,203 @@
+// Package naming names stored frames, videos and exported clips with the
+// Go templates in storage.naming, so output fits the conventions of
+// archival tools outside the system. Templates see:
+//
+//	{{.Camera}}  camera ID, with its site prefix
+//	{{.Site}}    site
+//	{{.Seq}}     frame number, zero-padded to 5 digits; a video's first frame
+//	{{.Year}} {{.Month}} {{.Day}} {{.Hour}} {{.Minute}} {{.Second}} {{.Millis}}
+//	{{.Date}}    20241220
+//	{{.Clock}}   150405
+//	{{.EndDate}} {{.EndClock}}  the end of an exported clip
+//
+// Templates give the name without its extension, and no directories.
+// Every field is a string so that a template can be run backwards: frame
+// names are parsed for the frame number and capture time, so a frame
+// template has to keep both.
+package naming
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Default templates, which give the names of earlier versions.
+const (
+	DefaultFrame  = "frame_{{.Seq}}_{{.Date}}_{{.Clock}}.{{.Millis}}"
+	DefaultVideo  = "{{.Camera}}_{{.Date}}_{{.Clock}}"
+	DefaultExport = "{{.Camera}}_{{.Date}}_{{.Clock}}_{{.EndDate}}_{{.EndClock}}"
+)
+
+// Fields describe the file being named. Times are formatted in their own
+// location.
+type Fields struct {
+	Camera string
+	Site   string
+	Seq    uint64
+	Time   time.Time
+	End    time.Time
+}
+
+// patterns match what each field can be, for parsing names.
+var patterns = map[string]string{
+	"Camera": `(.+?)`, "Site": `(.*?)`, "Seq": `(\d{5,})`,
+	"Year": `(\d{4})`, "Month": `(\d{2})`, "Day": `(\d{2})`,
+	"Hour": `(\d{2})`, "Minute": `(\d{2})`, "Second": `(\d{2})`, "Millis": `(\d{3})`,
+	"Date": `(\d{8})`, "Clock": `(\d{6})`, "EndDate": `(\d{8})`, "EndClock": `(\d{6})`,
+}
+
+// timeFields are the parts of a parsed time, in time.Date's order.
+var timeFields = []string{"Year", "Month", "Day", "Hour", "Minute", "Second", "Millis"}
+
+// marker stands in for a field while a template is run backwards.
+var marker = regexp.MustCompile("\x00([A-Za-z]+)\x00")
+
+// data returns what templates are executed with.
+func data(f Fields) map[string]string {
+	t, end := f.Time, f.End
+	return map[string]string{
+		"Camera": f.Camera, "Site": f.Site, "Seq": fmt.Sprintf("%05d", f.Seq),
+		"Year": t.Format("2006"), "Month": t.Format("01"), "Day": t.Format("02"),
+		"Hour": t.Format("15"), "Minute": t.Format("04"), "Second": t.Format("05"),
+		"Millis": fmt.Sprintf("%03d", t.Nanosecond()/int(time.Millisecond)),
+		"Date":   t.Format("20060102"), "Clock": t.Format("150405"),
+		"EndDate": end.Format("20060102"), "EndClock": end.Format("150405"),
+	}
+}
+
+// Template names files of one kind.
+type Template struct {
+	name string
+	tmpl *template.Template
+	// re matches names the template gives, capturing the fields in
+	// groups; nil when the template can't be run backwards
+	re     *regexp.Regexp
+	groups []string
+}
+
+// Parse compiles text, which is described by name in errors, and checks
+// that it gives a usable file name.
+func Parse(name, text string) (*Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	t := &Template{name: name, tmpl: tmpl}
+	sample, err := t.Name(Fields{Camera: "cam1", Site: "hq", Seq: 1, Time: time.Now(), End: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	if sample == "" || sample == "." || sample == ".." || strings.ContainsAny(sample, `/\`) {
+		return nil, fmt.Errorf("%s: %q is not a file name", name, sample)
+	}
+	t.reverse()
+	return t, nil
+}
+
+// ParseFrame compiles a frame template, which has to keep the frame
+// number and the capture time to the millisecond.
+func ParseFrame(name, text string) (*Template, error) {
+	t, err := Parse(name, text)
+	if err != nil {
+		return nil, err
+	}
+	want := Fields{Camera: "cam1", Site: "hq", Seq: 123456, Time: time.Date(2024, 12, 20, 15, 4, 5, 678e6, time.Local)}
+	sample, _ := t.Name(want)
+	got, ok := t.Match(sample)
+	if !ok || got.Seq != want.Seq || !got.Time.Equal(want.Time) {
+		return nil, fmt.Errorf("%s: frame names must include the frame number and capture time down to the millisecond, e.g. %s", name, DefaultFrame)
+	}
+	return t, nil
+}
+
+// Name executes the template for f.
+func (t *Template) Name(f Fields) (string, error) {
+	var b strings.Builder
+	if err := t.tmpl.Execute(&b, data(f)); err != nil {
+		return "", fmt.Errorf("%s: %w", t.name, err)
+	}
+	return b.String(), nil
+}
+
+// reverse builds the expression matching the template's names, by
+// executing it with markers for the fields.
+func (t *Template) reverse() {
+	d := make(map[string]string, len(patterns))
+	for field := range patterns {
+		d[field] = "\x00" + field + "\x00"
+	}
+	var b strings.Builder
+	if err := t.tmpl.Execute(&b, d); err != nil {
+		return
+	}
+	out := b.String()
+
+	expr := "^"
+	var groups []string
+	last := 0
+	for _, m := range marker.FindAllStringSubmatchIndex(out, -1) {
+		field := out[m[2]:m[3]]
+		expr += regexp.QuoteMeta(out[last:m[0]]) + patterns[field]
+		groups = append(groups, field)
+		last = m[1]
+	}
+	if strings.Contains(out[last:], "\x00") {
+		// A function cut a marker apart
+		return
+	}
+	expr += regexp.QuoteMeta(out[last:]) + "$"
+	t.re, t.groups = regexp.MustCompile(expr), groups
+}
+
+// Match parses a name the template gave, without its extension. Times are
+// read in local time, and are zero unless the name has the date.
+func (t *Template) Match(name string) (Fields, bool) {
+	if t.re == nil {
+		return Fields{}, false
+	}
+	m := t.re.FindStringSubmatch(name)
+	if m == nil {
+		return Fields{}, false
+	}
+	var f Fields
+	var parts [7]int
+	var have [7]bool
+	set := func(field, v string) {
+		for i, name := range timeFields {
+			if name == field {
+				parts[i], _ = strconv.Atoi(v)
+				have[i] = true
+			}
+		}
+	}
+	for i, field := range t.groups {
+		v := m[i+1]
+		switch field {
+		case "Camera":
+			f.Camera = v
+		case "Site":
+			f.Site = v
+		case "Seq":
+			f.Seq, _ = strconv.ParseUint(v, 10, 64)
+		case "Date":
+			set("Year", v[:4])
+			set("Month", v[4:6])
+			set("Day", v[6:])
+		case "Clock":
+			set("Hour", v[:2])
+			set("Minute", v[2:4])
+			set("Second", v[4:])
+		default:
+			set(field, v)
+		}
+	}
+	if have[0] && have[1] && have[2] {
+		f.Time = time.Date(parts[0], time.Month(parts[1]), parts[2],
+			parts[3], parts[4], parts[5], parts[6]*int(time.Millisecond), time.Local)
+	}
+	return f, true
+}
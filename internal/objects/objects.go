@@ -0,0 +1,230 @@
+// Package objects runs the frames cameras deliver through an object
+// detector, finding people and vehicles. Like motion detection, a frame of
+// each camera is sampled every interval, as running a model on every frame
+// would cost far more than storing it. Detectors are pluggable: ONNX
+// models are run by the onnx detector in servers built with the
+// onnxruntime tag (and cgo).
+package objects
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/codec"
+	"github.com/raeeceip/cctv/internal/motion"
+	"github.com/raeeceip/cctv/internal/processor"
+	"github.com/raeeceip/cctv/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// queueSize bounds the samples waiting for the detector. Samples beyond it
+// are skipped, which only delays detection by an interval.
+const queueSize = 16
+
+// Object is something a detector found in a frame.
+type Object struct {
+	Label string  `json:"label"`
+	Score float64 `json:"score"` // confidence, from 0 to 1
+	// Box bounds the object, normalized to the frame size
+	Box motion.Box `json:"box"`
+}
+
+// Detector finds objects in images. Detect may be called from one
+// goroutine at a time.
+type Detector interface {
+	Detect(img image.Image) ([]Object, error)
+	Close() error
+}
+
+// Options configure a detector.
+type Options struct {
+	// Model is the file the detector loads
+	Model string
+	// InputSize is the side images are scaled to for the model
+	InputSize int
+	// Labels names the model's classes in order
+	Labels []string
+	// MinScore is the confidence below which objects are dropped
+	MinScore float64
+	// Threads bounds the CPU threads the detector uses, 0 for its default
+	Threads int
+}
+
+// Factory opens a detector.
+type Factory func(opts Options) (Detector, error)
+
+var factories = map[string]Factory{}
+
+// Register makes a detector available by name, from an init function.
+func Register(name string, f Factory) {
+	factories[name] = f
+}
+
+// Open opens the detector registered as name.
+func Open(name string, opts Options) (Detector, error) {
+	f, ok := factories[name]
+	if !ok {
+		names := make([]string, 0, len(factories))
+		for n := range factories {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown object detector %q, have %v", name, names)
+	}
+	if len(opts.Labels) == 0 {
+		opts.Labels = COCOLabels
+	}
+	return f(opts)
+}
+
+// Event is objects found in a frame of a camera.
+type Event struct {
+	CameraID string    `json:"camera_id"`
+	Time     time.Time `json:"time"` // when the frame was taken
+	Objects  []Object  `json:"objects"`
+	// Frame is where the frame is stored
+	Frame string `json:"-"`
+}
+
+type sample struct {
+	cameraID string
+	time     time.Time
+	path     string
+	data     []byte
+}
+
+type camera struct {
+	sampledAt time.Time
+	lastEvent time.Time
+}
+
+// Stage samples frames and runs them through a detector.
+type Stage struct {
+	detector Detector
+	interval time.Duration
+	cooldown time.Duration
+	classes  []string // reported, all when empty
+	logger   *logger.Logger
+	queue    chan sample
+	onEvent  []func(Event)
+
+	mu      sync.Mutex
+	cameras map[string]*camera
+}
+
+// NewStage returns a stage running each camera's frames through d every
+// interval, reporting the objects labelled one of classes at most once per
+// cooldown.
+func NewStage(d Detector, interval, cooldown time.Duration, classes []string, log *logger.Logger) *Stage {
+	return &Stage{
+		detector: d,
+		interval: interval,
+		cooldown: cooldown,
+		classes:  classes,
+		logger:   log,
+		queue:    make(chan sample, queueSize),
+		cameras:  make(map[string]*camera),
+	}
+}
+
+// OnEvent registers fn to be called for each event. Register hooks before
+// Run.
+func (s *Stage) OnEvent(fn func(Event)) {
+	s.onEvent = append(s.onEvent, fn)
+}
+
+// Observe offers a stored frame for sampling without blocking. It copies
+// the data of the frames it samples.
+func (s *Stage) Observe(f processor.FrameData) {
+	s.mu.Lock()
+	cam, ok := s.cameras[f.CameraID]
+	if !ok {
+		cam = &camera{}
+		s.cameras[f.CameraID] = cam
+	}
+	due := f.Timestamp.Sub(cam.sampledAt) >= s.interval || f.Timestamp.Before(cam.sampledAt)
+	if due {
+		cam.sampledAt = f.Timestamp
+	}
+	s.mu.Unlock()
+	if !due {
+		return
+	}
+
+	select {
+	case s.queue <- sample{cameraID: f.CameraID, time: f.Timestamp, path: f.Path, data: append([]byte(nil), f.Data...)}:
+	default:
+		s.logger.Debug("Object detection behind, skipped sample", zap.String("camera", f.CameraID))
+	}
+}
+
+// Remove forgets a camera, e.g. once it disconnects.
+func (s *Stage) Remove(cameraID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.cameras, cameraID)
+}
+
+// Run detects objects in the samples until ctx is cancelled.
+func (s *Stage) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case smp := <-s.queue:
+			s.detect(smp)
+		}
+	}
+}
+
+// Close closes the detector, once Run has returned.
+func (s *Stage) Close() error {
+	return s.detector.Close()
+}
+
+func (s *Stage) detect(smp sample) {
+	img, err := codec.Decode(smp.data)
+	if err != nil {
+		s.logger.Debug("Skipped sample for object detection",
+			zap.String("camera", smp.cameraID),
+			zap.Error(err))
+		return
+	}
+	found, err := s.detector.Detect(img)
+	if err != nil {
+		s.logger.Warn("Object detection failed",
+			zap.String("camera", smp.cameraID),
+			zap.Error(err))
+		return
+	}
+	var objects []Object
+	for _, o := range found {
+		if len(s.classes) == 0 || slices.Contains(s.classes, o.Label) {
+			objects = append(objects, o)
+		}
+	}
+	if len(objects) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	cam, ok := s.cameras[smp.cameraID]
+	report := ok && smp.time.Sub(cam.lastEvent) >= s.cooldown
+	if report {
+		cam.lastEvent = smp.time
+	}
+	s.mu.Unlock()
+	if !report {
+		return
+	}
+
+	e := Event{CameraID: smp.cameraID, Time: smp.time, Objects: objects, Frame: smp.path}
+	for _, fn := range s.onEvent {
+		fn(e)
+	}
+}
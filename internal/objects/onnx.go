@@ -0,0 +1,210 @@
+//go:build onnxruntime && cgo
+
+package objects
+
+/*
+#cgo LDFLAGS: -lonnxruntime
+#include <stdlib.h>
+#include <string.h>
+#include <onnxruntime_c_api.h>
+
+// The API is a table of function pointers, which cgo can't call, hence the
+// wrappers. Errors are returned as messages for the caller to free.
+
+static const OrtApi *ort;
+
+static char *ort_error(OrtStatus *status) {
+	if (status == NULL) {
+		return NULL;
+	}
+	char *msg = strdup(ort->GetErrorMessage(status));
+	ort->ReleaseStatus(status);
+	return msg;
+}
+
+static char *ort_open(const char *model, int threads, OrtEnv **env, OrtSession **session,
+		OrtMemoryInfo **mem, char **input, char **output) {
+	if (ort == NULL) {
+		ort = OrtGetApiBase()->GetApi(ORT_API_VERSION);
+		if (ort == NULL) {
+			return strdup("ONNX Runtime library too old");
+		}
+	}
+	char *err;
+	OrtSessionOptions *opts = NULL;
+	OrtAllocator *alloc = NULL;
+	char *name = NULL;
+	if ((err = ort_error(ort->CreateEnv(ORT_LOGGING_LEVEL_WARNING, "cctv", env)))) {
+		return err;
+	}
+	if ((err = ort_error(ort->CreateSessionOptions(&opts)))) {
+		return err;
+	}
+	if (threads > 0 && (err = ort_error(ort->SetIntraOpNumThreads(opts, threads)))) {
+		ort->ReleaseSessionOptions(opts);
+		return err;
+	}
+	err = ort_error(ort->CreateSession(*env, model, opts, session));
+	ort->ReleaseSessionOptions(opts);
+	if (err) {
+		return err;
+	}
+	if ((err = ort_error(ort->CreateCpuMemoryInfo(OrtArenaAllocator, OrtMemTypeDefault, mem)))) {
+		return err;
+	}
+	if ((err = ort_error(ort->GetAllocatorWithDefaultOptions(&alloc)))) {
+		return err;
+	}
+	if ((err = ort_error(ort->SessionGetInputName(*session, 0, alloc, &name)))) {
+		return err;
+	}
+	*input = strdup(name);
+	ort->AllocatorFree(alloc, name);
+	if ((err = ort_error(ort->SessionGetOutputName(*session, 0, alloc, &name)))) {
+		return err;
+	}
+	*output = strdup(name);
+	ort->AllocatorFree(alloc, name);
+	return NULL;
+}
+
+// ort_run runs the model on a 1x3xSxS input. The output stays valid until
+// the value is released.
+static char *ort_run(OrtSession *session, OrtMemoryInfo *mem, const char *input, const char *output,
+		float *data, int64_t size, OrtValue **out, float **result, int64_t *dims, size_t *ndims) {
+	int64_t shape[4] = {1, 3, size, size};
+	OrtValue *in = NULL;
+	char *err = ort_error(ort->CreateTensorWithDataAsOrtValue(mem, data, 3 * size * size * sizeof(float),
+		shape, 4, ONNX_TENSOR_ELEMENT_DATA_TYPE_FLOAT, &in));
+	if (err) {
+		return err;
+	}
+	*out = NULL;
+	err = ort_error(ort->Run(session, NULL, &input, (const OrtValue *const *)&in, 1, &output, 1, out));
+	ort->ReleaseValue(in);
+	if (err) {
+		return err;
+	}
+	if ((err = ort_error(ort->GetTensorMutableData(*out, (void **)result)))) {
+		return err;
+	}
+	OrtTensorTypeAndShapeInfo *info = NULL;
+	if ((err = ort_error(ort->GetTensorTypeAndShape(*out, &info)))) {
+		return err;
+	}
+	size_t n = 0;
+	err = ort_error(ort->GetDimensionsCount(info, &n));
+	if (!err) {
+		if (n > *ndims) {
+			err = strdup("output has too many dimensions");
+		} else {
+			*ndims = n;
+			err = ort_error(ort->GetDimensions(info, dims, n));
+		}
+	}
+	ort->ReleaseTensorTypeAndShapeInfo(info);
+	return err;
+}
+
+static void ort_release_value(OrtValue *v) {
+	if (v) ort->ReleaseValue(v);
+}
+
+static void ort_close(OrtEnv *env, OrtSession *session, OrtMemoryInfo *mem) {
+	if (mem) ort->ReleaseMemoryInfo(mem);
+	if (session) ort->ReleaseSession(session);
+	if (env) ort->ReleaseEnv(env);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"sync"
+	"unsafe"
+)
+
+func init() {
+	Register("onnx", openONNX)
+}
+
+// onnxDetector runs a YOLO style ONNX model with ONNX Runtime, on the CPU.
+type onnxDetector struct {
+	opts Options
+
+	mu      sync.Mutex
+	env     *C.OrtEnv
+	session *C.OrtSession
+	mem     *C.OrtMemoryInfo
+	input   *C.char // names of the model's first input and output
+	output  *C.char
+	// data is the input tensor, in C memory as the runtime keeps a pointer
+	// to it
+	data *C.float
+}
+
+func openONNX(opts Options) (Detector, error) {
+	if opts.InputSize <= 0 {
+		return nil, errors.New("onnx detector needs an input size")
+	}
+	d := &onnxDetector{opts: opts}
+	model := C.CString(opts.Model)
+	defer C.free(unsafe.Pointer(model))
+	if msg := C.ort_open(model, C.int(opts.Threads), &d.env, &d.session, &d.mem, &d.input, &d.output); msg != nil {
+		d.Close()
+		return nil, fmt.Errorf("failed to load %s: %s", opts.Model, cError(msg))
+	}
+	d.data = (*C.float)(C.malloc(C.size_t(3 * opts.InputSize * opts.InputSize * 4)))
+	return d, nil
+}
+
+// cError returns a message from C, freeing it.
+func cError(msg *C.char) string {
+	defer C.free(unsafe.Pointer(msg))
+	return C.GoString(msg)
+}
+
+func (d *onnxDetector) Detect(img image.Image) ([]Object, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.session == nil {
+		return nil, errors.New("onnx detector closed")
+	}
+	size := d.opts.InputSize
+	in := unsafe.Slice((*float32)(unsafe.Pointer(d.data)), 3*size*size)
+	lb := fill(in, img, size)
+
+	var out *C.OrtValue
+	var result *C.float
+	var dims [8]C.int64_t
+	ndims := C.size_t(len(dims))
+	msg := C.ort_run(d.session, d.mem, d.input, d.output, d.data, C.int64_t(size), &out, &result, &dims[0], &ndims)
+	defer func() { C.ort_release_value(out) }()
+	if msg != nil {
+		return nil, fmt.Errorf("onnx inference failed: %s", cError(msg))
+	}
+
+	shape := make([]int64, ndims)
+	count := 1
+	for i := range shape {
+		shape[i] = int64(dims[i])
+		count *= int(dims[i])
+	}
+	// Read in place; the value is released once decoded
+	output := unsafe.Slice((*float32)(unsafe.Pointer(result)), count)
+	return decodeYOLO(output, shape, lb, d.opts.Labels, d.opts.MinScore)
+}
+
+func (d *onnxDetector) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	C.ort_close(d.env, d.session, d.mem)
+	d.env, d.session, d.mem = nil, nil, nil
+	C.free(unsafe.Pointer(d.input))
+	C.free(unsafe.Pointer(d.output))
+	C.free(unsafe.Pointer(d.data))
+	d.input, d.output, d.data = nil, nil, nil
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !onnxruntime || !cgo
+
+package objects
+
+import "errors"
+
+func init() {
+	Register("onnx", func(Options) (Detector, error) {
+		return nil, errors.New("the onnx detector needs a server built with the onnxruntime tag and cgo")
+	})
+}
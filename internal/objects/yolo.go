@@ -0,0 +1,161 @@
+package objects
+
+import (
+	"fmt"
+	"image"
+	"sort"
+
+	"github.com/raeeceip/cctv/internal/motion"
+)
+
+// nmsOverlap is the intersection over union above which the lower scoring
+// of two boxes of a class is dropped as the same object.
+const nmsOverlap = 0.45
+
+// letterbox is how an image was fitted into a model's square input: scaled
+// to fit, keeping its aspect ratio, and centered on gray padding.
+type letterbox struct {
+	scale         float64
+	padX, padY    float64
+	width, height int // of the image
+}
+
+// fill writes img into in, a size x size planar RGB input with values from
+// 0 to 1, as YOLO models take it.
+func fill(in []float32, img image.Image, size int) letterbox {
+	b := img.Bounds()
+	lb := letterbox{width: b.Dx(), height: b.Dy()}
+	lb.scale = min(float64(size)/float64(b.Dx()), float64(size)/float64(b.Dy()))
+	w, h := int(float64(b.Dx())*lb.scale), int(float64(b.Dy())*lb.scale)
+	lb.padX, lb.padY = float64(size-w)/2, float64(size-h)/2
+
+	const pad = 114.0 / 255
+	for i := range in {
+		in[i] = pad
+	}
+	plane := size * size
+	x0, y0 := int(lb.padX), int(lb.padY)
+	for y := 0; y < h; y++ {
+		sy := b.Min.Y + int(float64(y)/lb.scale)
+		row := (y0 + y) * size
+		for x := 0; x < w; x++ {
+			// Nearest neighbor is good enough for detection
+			r, g, bl, _ := img.At(b.Min.X+int(float64(x)/lb.scale), sy).RGBA()
+			i := row + x0 + x
+			in[i] = float32(r) / 0xffff
+			in[plane+i] = float32(g) / 0xffff
+			in[2*plane+i] = float32(bl) / 0xffff
+		}
+	}
+	return lb
+}
+
+// decodeYOLO reads the output of a YOLOv8 style model: for each of n
+// candidate boxes, its center, width and height in input pixels followed
+// by a score per class. dims is the output shape, [1, 4+classes, n] or
+// transposed as [1, n, 4+classes]. Boxes scoring under minScore are
+// dropped, as are those overlapping a better one of the same class.
+func decodeYOLO(out []float32, dims []int64, lb letterbox, labels []string, minScore float64) ([]Object, error) {
+	if len(dims) != 3 || dims[0] != 1 {
+		return nil, fmt.Errorf("unexpected output shape %v", dims)
+	}
+	attrs, n := int(dims[1]), int(dims[2])
+	at := func(box, attr int) float32 { return out[attr*n+box] }
+	// Models have far fewer classes than candidates
+	if attrs > n {
+		attrs, n = n, attrs
+		at = func(box, attr int) float32 { return out[box*attrs+attr] }
+	}
+	if attrs < 5 || len(out) < attrs*n {
+		return nil, fmt.Errorf("unexpected output shape %v", dims)
+	}
+
+	type candidate struct {
+		class int
+		score float64
+		box   motion.Box
+	}
+	var found []candidate
+	for i := 0; i < n; i++ {
+		class, score := -1, minScore
+		for c := 0; c < attrs-4; c++ {
+			if s := float64(at(i, 4+c)); s >= score {
+				class, score = c, s
+			}
+		}
+		if class < 0 {
+			continue
+		}
+		cx, cy := float64(at(i, 0)), float64(at(i, 1))
+		w, h := float64(at(i, 2)), float64(at(i, 3))
+		found = append(found, candidate{class: class, score: score, box: lb.unfit(cx-w/2, cy-h/2, w, h)})
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].score > found[j].score })
+	var objects []Object
+	var kept []candidate
+	for _, c := range found {
+		dup := false
+		for _, k := range kept {
+			if k.class == c.class && iou(k.box, c.box) > nmsOverlap {
+				dup = true
+				break
+			}
+		}
+		if dup {
+			continue
+		}
+		kept = append(kept, c)
+		label := fmt.Sprintf("class%d", c.class)
+		if c.class < len(labels) {
+			label = labels[c.class]
+		}
+		objects = append(objects, Object{Label: label, Score: c.score, Box: c.box})
+	}
+	return objects, nil
+}
+
+// unfit maps a box in input pixels back to the image, normalized to its
+// size and clipped to it.
+func (lb letterbox) unfit(x, y, w, h float64) motion.Box {
+	x0 := clip((x - lb.padX) / lb.scale / float64(lb.width))
+	y0 := clip((y - lb.padY) / lb.scale / float64(lb.height))
+	x1 := clip((x + w - lb.padX) / lb.scale / float64(lb.width))
+	y1 := clip((y + h - lb.padY) / lb.scale / float64(lb.height))
+	return motion.Box{X: x0, Y: y0, Width: x1 - x0, Height: y1 - y0}
+}
+
+func clip(v float64) float64 {
+	return max(0, min(v, 1))
+}
+
+// iou is the intersection over union of two boxes.
+func iou(a, b motion.Box) float64 {
+	w := min(a.X+a.Width, b.X+b.Width) - max(a.X, b.X)
+	h := min(a.Y+a.Height, b.Y+b.Height) - max(a.Y, b.Y)
+	if w <= 0 || h <= 0 {
+		return 0
+	}
+	inter := w * h
+	return inter / (a.Width*a.Height + b.Width*b.Height - inter)
+}
+
+// COCOLabels are the classes of models trained on COCO, such as the
+// published YOLO ones, in order.
+var COCOLabels = []string{
+	"person", "bicycle", "car", "motorcycle", "airplane", "bus", "train", "truck", "boat",
+	"traffic light", "fire hydrant", "stop sign", "parking meter", "bench", "bird", "cat",
+	"dog", "horse", "sheep", "cow", "elephant", "bear", "zebra", "giraffe", "backpack",
+	"umbrella", "handbag", "tie", "suitcase", "frisbee", "skis", "snowboard", "sports ball",
+	"kite", "baseball bat", "baseball glove", "skateboard", "surfboard", "tennis racket",
+	"bottle", "wine glass", "cup", "fork", "knife", "spoon", "bowl", "banana", "apple",
+	"sandwich", "orange", "broccoli", "carrot", "hot dog", "pizza", "donut", "cake", "chair",
+	"couch", "potted plant", "bed", "dining table", "toilet", "tv", "laptop", "mouse",
+	"remote", "keyboard", "cell phone", "microwave", "oven", "toaster", "sink",
+	"refrigerator", "book", "clock", "vase", "scissors", "teddy bear", "hair drier",
+	"toothbrush",
+}
+
+// DefaultClasses are the labels reported when none are configured: people
+// and vehicles.
+var DefaultClasses = []string{"person", "bicycle", "car", "motorcycle", "bus", "truck"}
@@ -0,0 +1,178 @@
+package onvif
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// discoveryAddr is the WS-Discovery multicast group.
+const discoveryAddr = "239.255.255.250:3702"
+
+// maxProbe bounds the size of a probe.
+const maxProbe = 64 << 10
+
+// probe is a WS-Discovery message; Probe is nil for the other kinds, such
+// as other devices' Hello.
+type probe struct {
+	Header struct {
+		MessageID string `xml:"MessageID"`
+	} `xml:"Header"`
+	Body struct {
+		Probe *struct {
+			Types  string `xml:"Types"`
+			Scopes string `xml:"Scopes"`
+		} `xml:"Probe"`
+	} `xml:"Body"`
+}
+
+// Run answers WS-Discovery probes until ctx is done. Each exposed camera
+// answers a probe with a match of its own, as separate devices would. It
+// returns at once when discovery is off.
+func (s *Service) Run(ctx context.Context) {
+	if !s.cfg.Discovery {
+		return
+	}
+	group, err := net.ResolveUDPAddr("udp4", discoveryAddr)
+	if err != nil {
+		s.logger.Error("Invalid discovery address", zap.Error(err))
+		return
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		s.logger.Error("Failed to listen for ONVIF discovery probes", zap.Error(err))
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	s.logger.Info("Answering ONVIF discovery probes", zap.String("group", discoveryAddr))
+
+	buf := make([]byte, maxProbe)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			s.logger.Warn("Failed to read discovery probe", zap.Error(err))
+			continue
+		}
+		s.answer(conn, buf[:n], src)
+	}
+}
+
+// answer sends a camera's matches for a probe to whoever sent it.
+func (s *Service) answer(conn *net.UDPConn, data []byte, src *net.UDPAddr) {
+	var p probe
+	if err := xml.Unmarshal(data, &p); err != nil || p.Body.Probe == nil {
+		return
+	}
+	if !matchTypes(p.Body.Probe.Types) {
+		return
+	}
+	host, err := s.advertised(src)
+	if err != nil {
+		s.logger.Warn("Failed to find the address to advertise", zap.Stringer("prober", src), zap.Error(err))
+		return
+	}
+	base := "http://" + host
+	if s.opts.TLS {
+		base = "https://" + host
+	}
+
+	answered := 0
+	for _, cameraID := range s.opts.Cameras() {
+		if !matchScopes(p.Body.Probe.Scopes, scopes(cameraID)) {
+			continue
+		}
+		msg := probeMatch(p.Header.MessageID, cameraID, serviceURL(base, cameraID, DeviceService))
+		if _, err := conn.WriteToUDP([]byte(msg), src); err != nil {
+			s.logger.Warn("Failed to answer discovery probe", zap.Stringer("prober", src), zap.Error(err))
+			return
+		}
+		answered++
+	}
+	if answered > 0 {
+		s.metrics.Probes.Inc()
+		s.logger.Debug("Answered discovery probe", zap.Stringer("prober", src), zap.Int("cameras", answered))
+	}
+}
+
+// advertised returns the host:port probers are told to reach the services
+// at: the configured address, or else the address of this host on the
+// route back to the prober.
+func (s *Service) advertised(prober *net.UDPAddr) (string, error) {
+	if s.cfg.Address != "" {
+		return s.cfg.Address, nil
+	}
+	// Connecting a UDP socket sends nothing, it only picks the route
+	c, err := net.DialUDP("udp4", nil, prober)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	ip := c.LocalAddr().(*net.UDPAddr).IP
+	return net.JoinHostPort(ip.String(), strconv.Itoa(s.opts.Port)), nil
+}
+
+// matchTypes reports whether a probe is for video transmitters or devices
+// in general. Types are QNames, whose prefixes are the prober's own.
+func matchTypes(types string) bool {
+	fields := strings.Fields(types)
+	if len(fields) == 0 {
+		return true
+	}
+	for _, t := range fields {
+		if i := strings.LastIndex(t, ":"); i >= 0 {
+			t = t[i+1:]
+		}
+		if t == "NetworkVideoTransmitter" || t == "Device" {
+			return true
+		}
+	}
+	return false
+}
+
+// matchScopes reports whether every scope of a probe is one of have, or a
+// prefix of one ending at a path segment.
+func matchScopes(want string, have []string) bool {
+	for _, w := range strings.Fields(want) {
+		w = strings.TrimSuffix(w, "/")
+		found := false
+		for _, h := range have {
+			if h == w || strings.HasPrefix(h, w+"/") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// probeMatch is a camera's answer to the probe with ID relatesTo.
+func probeMatch(relatesTo, cameraID, xaddr string) string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>`+
+		`<s:Envelope xmlns:s="%s" xmlns:a="%s" xmlns:d="%s" xmlns:dn="%s">`+
+		`<s:Header><a:MessageID>%s</a:MessageID><a:RelatesTo>%s</a:RelatesTo>`+
+		`<a:To>http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:To>`+
+		`<a:Action>http://schemas.xmlsoap.org/ws/2005/04/discovery/ProbeMatches</a:Action></s:Header>`+
+		`<s:Body><d:ProbeMatches><d:ProbeMatch>`+
+		`<a:EndpointReference><a:Address>%s</a:Address></a:EndpointReference>`+
+		`<d:Types>dn:NetworkVideoTransmitter</d:Types><d:Scopes>%s</d:Scopes>`+
+		`<d:XAddrs>%s</d:XAddrs><d:MetadataVersion>1</d:MetadataVersion>`+
+		`</d:ProbeMatch></d:ProbeMatches></s:Body></s:Envelope>`,
+		nsSOAP, nsAddress, nsDiscovery, nsNetwork,
+		uuid.New().URN(), esc(relatesTo), endpoint(cameraID),
+		esc(strings.Join(scopes(cameraID), " ")), esc(xaddr))
+}
@@ -0,0 +1,318 @@
+// Package onvif exposes cameras as ONVIF devices, so NVR software can be
+// tried against the simulator. Every camera is a device of its own, with
+// the basic Device and Media services at /onvif/<camera>/device_service and
+// /onvif/<camera>/media_service, and answers WS-Discovery probes.
+//
+// Each device has a single profile. GetStreamUri hands out the camera's
+// RTSP stream when the RTSP output is enabled, its HLS playlist when HLS
+// is, and its MJPEG preview otherwise; NVRs that only take RTSP can
+// discover the cameras but only play them through the RTSP output.
+package onvif
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/hls"
+	"github.com/raeeceip/cctv/pkg/logger"
+	"github.com/raeeceip/cctv/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// Services of each camera, the last element of their paths
+const (
+	DeviceService = "device_service"
+	MediaService  = "media_service"
+)
+
+// What the devices say they are
+const (
+	manufacturer = "cctv"
+	model        = "camsim"
+	firmware     = "1.0"
+)
+
+// profileToken names the only profile of each camera.
+const profileToken = "main"
+
+// maxRequest bounds the size of a request.
+const maxRequest = 64 << 10
+
+// preAuth are the operations answered without credentials, so clients can
+// find the services and fix their clocks before authenticating.
+var preAuth = map[string]bool{
+	"GetSystemDateAndTime": true,
+	"GetCapabilities":      true,
+	"GetServices":          true,
+}
+
+// Options describe the server the cameras are exposed by.
+type Options struct {
+	// Cameras lists the IDs of the cameras to expose
+	Cameras func() []string
+	// Port and TLS of the API listener, for the addresses sent to
+	// discovery probes
+	Port int
+	TLS  bool
+	// HLS tells whether streams are HLS playlists rather than MJPEG
+	HLS bool
+	// RTSPPort is the port of the RTSP output, which is handed out before
+	// HLS; 0 when it is disabled
+	RTSPPort int
+	// Stream gives the resolution and frame rate of the profiles
+	Stream config.StreamConfig
+}
+
+// Service answers ONVIF requests and discovery probes.
+type Service struct {
+	cfg     config.ONVIFConfig
+	opts    Options
+	metrics *metrics.ONVIFMetrics
+	logger  *logger.Logger
+}
+
+// New returns a service for the cameras of opts.
+func New(cfg config.ONVIFConfig, opts Options, log *logger.Logger) *Service {
+	return &Service{cfg: cfg, opts: opts, metrics: metrics.NewONVIFMetrics(), logger: log}
+}
+
+// operations answer requests to a camera. Each returns the content of the
+// response Body.
+var operations = map[string]func(s *Service, r *request) (string, *fault){
+	"GetDeviceInformation": (*Service).getDeviceInformation,
+	"GetSystemDateAndTime": (*Service).getSystemDateAndTime,
+	"GetCapabilities":      (*Service).getCapabilities,
+	"GetServices":          (*Service).getServices,
+	"GetScopes":            (*Service).getScopes,
+	"GetProfiles":          (*Service).getProfiles,
+	"GetProfile":           (*Service).getProfile,
+	"GetVideoSources":      (*Service).getVideoSources,
+	"GetStreamUri":         (*Service).getStreamURI,
+	"GetSnapshotUri":       (*Service).getSnapshotURI,
+}
+
+// request is a request to one of a camera's services.
+type request struct {
+	cameraID string
+	// base is the scheme and host the client reached the server at
+	base string
+	env  envelope
+}
+
+// Serve answers a SOAP request to one of a camera's services. Operations
+// are answered on either service, as some clients don't keep them apart.
+func (s *Service) Serve(w http.ResponseWriter, r *http.Request, cameraID, service string) {
+	if (service != DeviceService && service != MediaService) || !s.exposed(cameraID) {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequest))
+	if err != nil {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	req := &request{cameraID: cameraID, base: "http://" + r.Host}
+	if r.TLS != nil {
+		req.base = "https://" + r.Host
+	}
+	if err := xml.Unmarshal(body, &req.env); err != nil {
+		writeEnvelope(w, http.StatusBadRequest, (&fault{http.StatusBadRequest, "Sender", []string{"WellFormed"}, err.Error()}).body())
+		return
+	}
+
+	name := req.env.Body.Operation.XMLName.Local
+	op, ok := operations[name]
+	if !ok {
+		s.metrics.Requests.WithLabelValues("unsupported").Inc()
+		s.logger.Debug("Unsupported ONVIF operation",
+			zap.String("camera", cameraID),
+			zap.String("operation", name))
+		writeEnvelope(w, errNotSupported.status, errNotSupported.body())
+		return
+	}
+	s.metrics.Requests.WithLabelValues(name).Inc()
+
+	if s.cfg.Username != "" && !preAuth[name] && !req.env.Header.Token.valid(s.cfg.Username, s.cfg.Password) {
+		s.logger.Warn("Refused ONVIF request without valid credentials",
+			zap.String("camera", cameraID),
+			zap.String("operation", name),
+			zap.String("remote", r.RemoteAddr))
+		writeEnvelope(w, errNotAuthorized.status, errNotAuthorized.body())
+		return
+	}
+
+	resp, f := op(s, req)
+	if f != nil {
+		writeEnvelope(w, f.status, f.body())
+		return
+	}
+	writeEnvelope(w, http.StatusOK, resp)
+}
+
+// exposed reports whether a camera is one of those exposed.
+func (s *Service) exposed(cameraID string) bool {
+	for _, id := range s.opts.Cameras() {
+		if id == cameraID {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceURL returns the address of one of a camera's services.
+func serviceURL(base, cameraID, service string) string {
+	return fmt.Sprintf("%s/onvif/%s/%s", base, url.PathEscape(cameraID), service)
+}
+
+// endpoint returns a camera's WS-Addressing endpoint reference, the same
+// every time so clients recognize the device across restarts.
+func endpoint(cameraID string) string {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte("cctv-onvif:"+cameraID)).URN()
+}
+
+// scopes returns the scopes a camera is found by.
+func scopes(cameraID string) []string {
+	return []string{
+		"onvif://www.onvif.org/type/video_encoder",
+		"onvif://www.onvif.org/Profile/Streaming",
+		"onvif://www.onvif.org/hardware/" + model,
+		"onvif://www.onvif.org/name/" + url.PathEscape(cameraID),
+	}
+}
+
+func (s *Service) getDeviceInformation(r *request) (string, *fault) {
+	return fmt.Sprintf(`<tds:GetDeviceInformationResponse>`+
+		`<tds:Manufacturer>%s</tds:Manufacturer><tds:Model>%s</tds:Model>`+
+		`<tds:FirmwareVersion>%s</tds:FirmwareVersion><tds:SerialNumber>%s</tds:SerialNumber>`+
+		`<tds:HardwareId>%s</tds:HardwareId></tds:GetDeviceInformationResponse>`,
+		manufacturer, model, firmware, esc(r.cameraID), model), nil
+}
+
+func (s *Service) getSystemDateAndTime(r *request) (string, *fault) {
+	now := time.Now().UTC()
+	return fmt.Sprintf(`<tds:GetSystemDateAndTimeResponse><tds:SystemDateAndTime>`+
+		`<tt:DateTimeType>NTP</tt:DateTimeType><tt:DaylightSavings>false</tt:DaylightSavings>`+
+		`<tt:TimeZone><tt:TZ>UTC0</tt:TZ></tt:TimeZone><tt:UTCDateTime>`+
+		`<tt:Time><tt:Hour>%d</tt:Hour><tt:Minute>%d</tt:Minute><tt:Second>%d</tt:Second></tt:Time>`+
+		`<tt:Date><tt:Year>%d</tt:Year><tt:Month>%d</tt:Month><tt:Day>%d</tt:Day></tt:Date>`+
+		`</tt:UTCDateTime></tds:SystemDateAndTime></tds:GetSystemDateAndTimeResponse>`,
+		now.Hour(), now.Minute(), now.Second(), now.Year(), int(now.Month()), now.Day()), nil
+}
+
+func (s *Service) getCapabilities(r *request) (string, *fault) {
+	return fmt.Sprintf(`<tds:GetCapabilitiesResponse><tds:Capabilities>`+
+		`<tt:Device><tt:XAddr>%s</tt:XAddr></tt:Device>`+
+		`<tt:Media><tt:XAddr>%s</tt:XAddr><tt:StreamingCapabilities>`+
+		`<tt:RTPMulticast>false</tt:RTPMulticast><tt:RTP_TCP>false</tt:RTP_TCP><tt:RTP_RTSP_TCP>false</tt:RTP_RTSP_TCP>`+
+		`</tt:StreamingCapabilities></tt:Media></tds:Capabilities></tds:GetCapabilitiesResponse>`,
+		esc(serviceURL(r.base, r.cameraID, DeviceService)),
+		esc(serviceURL(r.base, r.cameraID, MediaService))), nil
+}
+
+func (s *Service) getServices(r *request) (string, *fault) {
+	service := func(ns, name string) string {
+		return fmt.Sprintf(`<tds:Service><tds:Namespace>%s</tds:Namespace><tds:XAddr>%s</tds:XAddr>`+
+			`<tds:Version><tt:Major>2</tt:Major><tt:Minor>0</tt:Minor></tds:Version></tds:Service>`,
+			ns, esc(serviceURL(r.base, r.cameraID, name)))
+	}
+	return `<tds:GetServicesResponse>` + service(nsDevice, DeviceService) + service(nsMedia, MediaService) +
+		`</tds:GetServicesResponse>`, nil
+}
+
+func (s *Service) getScopes(r *request) (string, *fault) {
+	resp := `<tds:GetScopesResponse>`
+	for _, scope := range scopes(r.cameraID) {
+		resp += fmt.Sprintf(`<tds:Scopes><tt:ScopeDef>Fixed</tt:ScopeDef><tt:ScopeItem>%s</tt:ScopeItem></tds:Scopes>`, esc(scope))
+	}
+	return resp + `</tds:GetScopesResponse>`, nil
+}
+
+// profile describes the camera's only profile.
+func (s *Service) profile() string {
+	st := s.opts.Stream
+	encoding := "JPEG"
+	if s.opts.HLS || s.opts.RTSPPort > 0 {
+		encoding = "H264"
+	}
+	return fmt.Sprintf(`<tt:Name>%[1]s</tt:Name>`+
+		`<tt:VideoSourceConfiguration token="source"><tt:Name>source</tt:Name><tt:UseCount>1</tt:UseCount>`+
+		`<tt:SourceToken>source</tt:SourceToken><tt:Bounds x="0" y="0" width="%[2]d" height="%[3]d"/>`+
+		`</tt:VideoSourceConfiguration>`+
+		`<tt:VideoEncoderConfiguration token="encoder"><tt:Name>encoder</tt:Name><tt:UseCount>1</tt:UseCount>`+
+		`<tt:Encoding>%[4]s</tt:Encoding><tt:Resolution><tt:Width>%[2]d</tt:Width><tt:Height>%[3]d</tt:Height></tt:Resolution>`+
+		`<tt:Quality>5</tt:Quality><tt:RateControl><tt:FrameRateLimit>%[5]d</tt:FrameRateLimit>`+
+		`<tt:EncodingInterval>1</tt:EncodingInterval><tt:BitrateLimit>%[6]d</tt:BitrateLimit></tt:RateControl>`+
+		`<tt:SessionTimeout>PT60S</tt:SessionTimeout></tt:VideoEncoderConfiguration>`,
+		profileToken, st.Width, st.Height, encoding, st.Framerate, st.VideoBitrate)
+}
+
+func (s *Service) getProfiles(r *request) (string, *fault) {
+	return fmt.Sprintf(`<trt:GetProfilesResponse><trt:Profiles token="%s" fixed="true">%s</trt:Profiles></trt:GetProfilesResponse>`,
+		profileToken, s.profile()), nil
+}
+
+func (s *Service) getProfile(r *request) (string, *fault) {
+	if r.env.Body.Operation.ProfileToken != profileToken {
+		return "", errNoProfile
+	}
+	return fmt.Sprintf(`<trt:GetProfileResponse><trt:Profile token="%s" fixed="true">%s</trt:Profile></trt:GetProfileResponse>`,
+		profileToken, s.profile()), nil
+}
+
+func (s *Service) getVideoSources(r *request) (string, *fault) {
+	st := s.opts.Stream
+	return fmt.Sprintf(`<trt:GetVideoSourcesResponse><trt:VideoSources token="source">`+
+		`<tt:Framerate>%d</tt:Framerate><tt:Resolution><tt:Width>%d</tt:Width><tt:Height>%d</tt:Height></tt:Resolution>`+
+		`</trt:VideoSources></trt:GetVideoSourcesResponse>`,
+		st.Framerate, st.Width, st.Height), nil
+}
+
+// mediaURI is the content of GetStreamUri and GetSnapshotUri responses.
+func mediaURI(uri string) string {
+	return fmt.Sprintf(`<trt:MediaUri><tt:Uri>%s</tt:Uri><tt:InvalidAfterConnect>false</tt:InvalidAfterConnect>`+
+		`<tt:InvalidAfterReboot>false</tt:InvalidAfterReboot><tt:Timeout>PT0S</tt:Timeout></trt:MediaUri>`,
+		esc(uri))
+}
+
+// getStreamURI hands out the RTSP stream, the HLS playlist or the MJPEG
+// preview, whatever transport was asked for.
+func (s *Service) getStreamURI(r *request) (string, *fault) {
+	op := r.env.Body.Operation
+	if op.ProfileToken != profileToken {
+		return "", errNoProfile
+	}
+	uri := r.base + "/live/" + url.PathEscape(r.cameraID)
+	switch {
+	case s.opts.RTSPPort > 0:
+		// On the host the client reached the API at
+		host := r.base
+		if u, err := url.Parse(r.base); err == nil {
+			host = u.Hostname()
+		}
+		uri = "rtsp://" + net.JoinHostPort(host, strconv.Itoa(s.opts.RTSPPort)) + "/" + url.PathEscape(r.cameraID)
+	case s.opts.HLS:
+		uri = r.base + "/hls/" + url.PathEscape(r.cameraID) + "/" + hls.PlaylistName
+	}
+	s.logger.Debug("Handed out ONVIF stream",
+		zap.String("camera", r.cameraID),
+		zap.String("protocol", op.Protocol),
+		zap.String("uri", uri))
+	return `<trt:GetStreamUriResponse>` + mediaURI(uri) + `</trt:GetStreamUriResponse>`, nil
+}
+
+func (s *Service) getSnapshotURI(r *request) (string, *fault) {
+	if r.env.Body.Operation.ProfileToken != profileToken {
+		return "", errNoProfile
+	}
+	uri := r.base + "/api/v1/cameras/" + url.PathEscape(r.cameraID) + "/frame"
+	return `<trt:GetSnapshotUriResponse>` + mediaURI(uri) + `</trt:GetSnapshotUriResponse>`, nil
+}
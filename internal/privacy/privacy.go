@@ -0,0 +1,216 @@
+// Package privacy hides parts of camera frames that mustn't be recorded,
+// such as a neighbour's windows, by blacking them out or pixelating them.
+// Masks are rectangles or polygons in coordinates normalized to the frame
+// size. Frames are masked plane by plane in their decoded color space, as
+// they are transformed.
+package privacy
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+)
+
+// Mask modes
+const (
+	Blackout = "blackout"
+	Pixelate = "pixelate"
+)
+
+// pixelBlocks is how many blocks a pixelated frame is across.
+const pixelBlocks = 32
+
+// Point is a polygon vertex, normalized to the frame size.
+type Point struct {
+	X float64 `json:"x" mapstructure:"x"`
+	Y float64 `json:"y" mapstructure:"y"`
+}
+
+// Mask is an area of a frame to hide: the rectangle X, Y, Width, Height,
+// or Polygon when it has vertices.
+type Mask struct {
+	Name string `json:"name,omitempty" mapstructure:"name"`
+	// Mode is Blackout, the default, or Pixelate
+	Mode    string  `json:"mode,omitempty" mapstructure:"mode"`
+	X       float64 `json:"x,omitempty" mapstructure:"x"`
+	Y       float64 `json:"y,omitempty" mapstructure:"y"`
+	Width   float64 `json:"width,omitempty" mapstructure:"width"`
+	Height  float64 `json:"height,omitempty" mapstructure:"height"`
+	Polygon []Point `json:"polygon,omitempty" mapstructure:"polygon"`
+}
+
+// Validate checks the mode and that the area is within the frame.
+func (m Mask) Validate() error {
+	switch m.Mode {
+	case "", Blackout, Pixelate:
+	default:
+		return fmt.Errorf("mask mode must be %s or %s, got %q", Blackout, Pixelate, m.Mode)
+	}
+	in := func(v float64) bool { return v >= 0 && v <= 1 }
+	if len(m.Polygon) > 0 {
+		if len(m.Polygon) < 3 {
+			return fmt.Errorf("mask polygon needs at least 3 points, got %d", len(m.Polygon))
+		}
+		for _, p := range m.Polygon {
+			if !in(p.X) || !in(p.Y) {
+				return fmt.Errorf("mask polygon points must be between 0 and 1, got %g,%g", p.X, p.Y)
+			}
+		}
+		return nil
+	}
+	if m.Width <= 0 || m.Height <= 0 || !in(m.X) || !in(m.Y) || m.X+m.Width > 1 || m.Y+m.Height > 1 {
+		return fmt.Errorf("mask rectangle must have a size and lie within the frame, normalized to 0-1")
+	}
+	return nil
+}
+
+// bounds returns the normalized box around the mask.
+func (m Mask) bounds() (x0, y0, x1, y1 float64) {
+	if len(m.Polygon) == 0 {
+		return m.X, m.Y, m.X + m.Width, m.Y + m.Height
+	}
+	x0, y0, x1, y1 = 1, 1, 0, 0
+	for _, p := range m.Polygon {
+		x0, y0 = min(x0, p.X), min(y0, p.Y)
+		x1, y1 = max(x1, p.X), max(y1, p.Y)
+	}
+	return x0, y0, x1, y1
+}
+
+// contains reports whether the normalized point is in the mask.
+func (m Mask) contains(x, y float64) bool {
+	if len(m.Polygon) == 0 {
+		return x >= m.X && x < m.X+m.Width && y >= m.Y && y < m.Y+m.Height
+	}
+	// Even-odd rule
+	in := false
+	for i, j := 0, len(m.Polygon)-1; i < len(m.Polygon); j, i = i, i+1 {
+		a, b := m.Polygon[i], m.Polygon[j]
+		if (a.Y > y) != (b.Y > y) && x < (b.X-a.X)*(y-a.Y)/(b.Y-a.Y)+a.X {
+			in = !in
+		}
+	}
+	return in
+}
+
+// Masks are the masks of a camera, applied in order.
+type Masks []Mask
+
+// Validate checks every mask.
+func (ms Masks) Validate() error {
+	for i, m := range ms {
+		if err := m.Validate(); err != nil {
+			return fmt.Errorf("mask %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Apply masks img, in place when it is YCbCr, gray or RGBA, and returns
+// it; other images are masked as an RGBA copy.
+func (ms Masks) Apply(img image.Image) image.Image {
+	if len(ms) == 0 {
+		return img
+	}
+	switch m := img.(type) {
+	case *image.YCbCr:
+		w, h := m.Rect.Dx(), m.Rect.Dy()
+		var cw, ch int
+		switch m.SubsampleRatio {
+		case image.YCbCrSubsampleRatio444:
+			cw, ch = w, h
+		case image.YCbCrSubsampleRatio422:
+			cw, ch = (w+1)/2, h
+		case image.YCbCrSubsampleRatio420:
+			cw, ch = (w+1)/2, (h+1)/2
+		case image.YCbCrSubsampleRatio440:
+			cw, ch = w, (h+1)/2
+		default:
+			// Rare ratios are masked as RGBA
+			return ms.rgba(m)
+		}
+		ms.plane(m.Y[m.YOffset(m.Rect.Min.X, m.Rect.Min.Y):], m.YStride, w, h, 1, 1, 0)
+		off := m.COffset(m.Rect.Min.X, m.Rect.Min.Y)
+		ms.plane(m.Cb[off:], m.CStride, cw, ch, 1, 1, 128)
+		ms.plane(m.Cr[off:], m.CStride, cw, ch, 1, 1, 128)
+		return m
+	case *image.Gray:
+		ms.plane(m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], m.Stride, m.Rect.Dx(), m.Rect.Dy(), 1, 1, 0)
+		return m
+	case *image.RGBA:
+		ms.rgbaPlane(m)
+		return m
+	}
+	return ms.rgba(img)
+}
+
+func (ms Masks) rgba(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(out, out.Rect, img, b.Min, draw.Src)
+	ms.rgbaPlane(out)
+	return out
+}
+
+// rgbaPlane masks the color of an RGBA image, leaving its alpha.
+func (ms Masks) rgbaPlane(m *image.RGBA) {
+	ms.plane(m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], m.Stride, m.Rect.Dx(), m.Rect.Dy(), 4, 3, 0)
+}
+
+// plane masks a w by h plane of bpp byte pixels, the first channels of
+// which are color, blacking out to black.
+func (ms Masks) plane(pix []byte, stride, w, h, bpp, channels int, black byte) {
+	block := max(1, int(math.Ceil(float64(w)/pixelBlocks)))
+	for _, m := range ms {
+		x0, y0, x1, y1 := m.bounds()
+		px0, py0 := int(x0*float64(w)), int(y0*float64(h))
+		px1, py1 := min(w, int(math.Ceil(x1*float64(w)))), min(h, int(math.Ceil(y1*float64(h))))
+		inside := func(x, y int) bool {
+			return m.contains((float64(x)+0.5)/float64(w), (float64(y)+0.5)/float64(h))
+		}
+		if m.Mode != Pixelate {
+			for y := py0; y < py1; y++ {
+				row := pix[y*stride:]
+				for x := px0; x < px1; x++ {
+					if inside(x, y) {
+						for c := 0; c < channels; c++ {
+							row[x*bpp+c] = black
+						}
+					}
+				}
+			}
+			continue
+		}
+		// Blocks are aligned to the frame, so neighbouring masks match;
+		// each takes the average of its pixels in the mask
+		for by := py0 / block * block; by < py1; by += block {
+			for bx := px0 / block * block; bx < px1; bx += block {
+				var sum [4]int
+				n := 0
+				for y := max(by, py0); y < min(by+block, py1); y++ {
+					for x := max(bx, px0); x < min(bx+block, px1); x++ {
+						if inside(x, y) {
+							for c := 0; c < channels; c++ {
+								sum[c] += int(pix[y*stride+x*bpp+c])
+							}
+							n++
+						}
+					}
+				}
+				if n == 0 {
+					continue
+				}
+				for y := max(by, py0); y < min(by+block, py1); y++ {
+					for x := max(bx, px0); x < min(bx+block, px1); x++ {
+						if inside(x, y) {
+							for c := 0; c < channels; c++ {
+								pix[y*stride+x*bpp+c] = byte(sum[c] / n)
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package processor
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// CameraBacklog is how far consolidation of one camera is behind.
+type CameraBacklog struct {
+	CameraID      string    `json:"camera_id"`
+	PendingFrames int       `json:"pending_frames"`
+	OldestPending time.Time `json:"oldest_pending"` // zero when nothing is pending
+	// LastConsolidation is the latest batch turned into a video, or that
+	// failed to be
+	LastConsolidation *ConsolidationResult `json:"last_consolidation,omitempty"`
+	// Dedup is set when frames are deduplicated
+	Dedup *DedupStats `json:"dedup,omitempty"`
+	// FramesStored and FrameErrors count the frames stored and those that
+	// failed to be since the processor started
+	FramesStored uint64 `json:"frames_stored"`
+	FrameErrors  uint64 `json:"frame_errors"`
+}
+
+// ConsolidationResult describes one attempt to consolidate a batch.
+type ConsolidationResult struct {
+	Time   time.Time `json:"time"`
+	Frames int       `json:"frames"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// backlog tracks pending frames per camera. It has its own lock so status
+// can be read while a consolidation holds the processor's.
+type backlog struct {
+	mu      sync.Mutex
+	cameras map[string]*CameraBacklog
+}
+
+func (b *backlog) camera(cameraID string) *CameraBacklog {
+	if b.cameras == nil {
+		b.cameras = make(map[string]*CameraBacklog)
+	}
+	c, ok := b.cameras[cameraID]
+	if !ok {
+		c = &CameraBacklog{CameraID: cameraID}
+		b.cameras[cameraID] = c
+	}
+	return c
+}
+
+// added counts a newly stored frame.
+func (b *backlog) added(cameraID string, t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.camera(cameraID)
+	c.PendingFrames++
+	c.FramesStored++
+	if c.OldestPending.IsZero() || t.Before(c.OldestPending) {
+		c.OldestPending = t
+	}
+}
+
+// failed counts a frame that couldn't be stored.
+func (b *backlog) failed(cameraID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.camera(cameraID).FrameErrors++
+}
+
+// pending replaces the count with the number of frames found on disk and
+// the capture time of the oldest, which corrects for anything the running
+// count missed.
+func (b *backlog) pending(cameraID string, frames int, oldest time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.camera(cameraID)
+	c.PendingFrames = frames
+	c.OldestPending = oldest
+}
+
+// consolidated records the outcome of consolidating a batch.
+func (b *backlog) consolidated(cameraID string, frames int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	res := &ConsolidationResult{Time: time.Now(), Frames: frames}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	b.camera(cameraID).LastConsolidation = res
+}
+
+// snapshot returns a copy of every camera's backlog, ordered by camera.
+func (b *backlog) snapshot() []CameraBacklog {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := make([]CameraBacklog, 0, len(b.cameras))
+	for _, c := range b.cameras {
+		cp := *c
+		if c.LastConsolidation != nil {
+			res := *c.LastConsolidation
+			cp.LastConsolidation = &res
+		}
+		list = append(list, cp)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CameraID < list[j].CameraID
+	})
+	return list
+}
+
+// Backlog returns the consolidation backlog of every camera that has
+// stored frames.
+func (fp *FrameProcessor) Backlog() []CameraBacklog {
+	list := fp.backlog.snapshot()
+	for i := range list {
+		list[i].Dedup = fp.dedup.stats(list[i].CameraID)
+	}
+	return list
+}
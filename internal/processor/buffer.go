@@ -0,0 +1,56 @@
+package processor
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxPooledBuffer keeps the occasional huge frame from pinning its buffer
+// in the pool.
+const maxPooledBuffer = 4 << 20
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// GetBuffer returns an empty buffer from the frame buffer pool.
+func GetBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// PutBuffer returns a buffer that did not end up in a frame to the pool.
+func PutBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		buf.Reset()
+		bufferPool.Put(buf)
+	}
+}
+
+// PooledFrame returns a frame whose Data is the contents of buf. The
+// processor returns buf to the pool once the frame is stored.
+func PooledFrame(buf *bytes.Buffer) FrameData {
+	return FrameData{Data: buf.Bytes(), buf: buf}
+}
+
+// Release returns the frame's buffer to the pool, if it came from there.
+// Data must not be used afterwards.
+func (f *FrameData) Release() {
+	if f.buf == nil {
+		return
+	}
+	PutBuffer(f.buf)
+	f.buf = nil
+	f.Data = nil
+}
+
+// SetData replaces the frame's Data, reusing its pooled buffer if it has
+// one. data may be discarded afterwards.
+func (f *FrameData) SetData(data []byte) {
+	if f.buf == nil {
+		f.Data = data
+		return
+	}
+	f.buf.Reset()
+	f.buf.Write(data)
+	f.Data = f.buf.Bytes()
+}
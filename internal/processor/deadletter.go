@@ -0,0 +1,252 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/codec"
+	"github.com/raeeceip/cctv/internal/wire"
+)
+
+// ErrDeadLetterNotFound is returned for dead letters that don't exist.
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// deadLetterPruneInterval is how often at most the dead letters are
+// checked against their limits, which may be overrun meanwhile.
+const deadLetterPruneInterval = 10 * time.Second
+
+// DeadLetter is a frame that failed to be stored, kept with why so it can
+// be inspected and reprocessed.
+type DeadLetter struct {
+	ID        string         `json:"id"`
+	CameraID  string         `json:"camera_id"`
+	Number    uint64         `json:"number"`
+	Timestamp time.Time      `json:"timestamp"`
+	Location  *wire.Location `json:"location,omitempty"`
+	Pattern   string         `json:"pattern,omitempty"`
+	Delta     bool           `json:"delta,omitempty"`
+	GOP       *wire.GOP      `json:"gop,omitempty"`
+	PTZ       *wire.PTZ      `json:"ptz,omitempty"`
+	// Encoding is what the payload looked like, and Size its length
+	Encoding string    `json:"encoding"`
+	Size     int       `json:"size"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// Frame returns the dead letter as the frame it was, with its payload.
+func (d DeadLetter) Frame(data []byte) FrameData {
+	return FrameData{
+		CameraID:  d.CameraID,
+		Data:      data,
+		Timestamp: d.Timestamp,
+		Number:    d.Number,
+		Location:  d.Location,
+		Pattern:   d.Pattern,
+		Delta:     d.Delta,
+		GOP:       d.GOP,
+		PTZ:       d.PTZ,
+	}
+}
+
+// DeadLetters keeps frames that failed to be stored in a directory, each
+// as its raw payload, <id>.frame, and what is known of it, <id>.json. IDs
+// start with when the frame failed, so they sort oldest first. Several
+// processes, such as shard workers, may share the directory.
+type DeadLetters struct {
+	dir      string
+	maxBytes int64         // 0 for no limit
+	keep     time.Duration // 0 to keep them until reprocessed or deleted
+
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+// NewDeadLetters returns the dead letters in dir, which is created if
+// needed, keeping them for keep and no more than maxMB of payloads.
+func NewDeadLetters(dir string, maxMB int64, keep time.Duration) (*DeadLetters, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create dead letter directory: %w", err)
+	}
+	return &DeadLetters{dir: dir, maxBytes: maxMB << 20, keep: keep}, nil
+}
+
+// Add keeps a frame that failed with cause.
+func (d *DeadLetters) Add(frame FrameData, cause error) (DeadLetter, error) {
+	now := time.Now().UTC()
+	letter := DeadLetter{
+		ID:        fmt.Sprintf("%s-%s-%d", now.Format("20060102T150405.000000000Z"), frame.CameraID, frame.Number),
+		CameraID:  frame.CameraID,
+		Number:    frame.Number,
+		Timestamp: frame.Timestamp,
+		Location:  frame.Location,
+		Pattern:   frame.Pattern,
+		Delta:     frame.Delta,
+		GOP:       frame.GOP,
+		PTZ:       frame.PTZ,
+		Encoding:  codec.Encoding(frame.Data),
+		Size:      len(frame.Data),
+		Error:     cause.Error(),
+		FailedAt:  now,
+	}
+	meta, err := json.MarshalIndent(letter, "", "  ")
+	if err != nil {
+		return DeadLetter{}, err
+	}
+	// The payload first, so a listed dead letter always has one
+	if err := writeFileAtomic(d.path(letter.ID, ".frame"), frame.Data); err != nil {
+		return DeadLetter{}, err
+	}
+	if err := writeFileAtomic(d.path(letter.ID, ".json"), meta); err != nil {
+		os.Remove(d.path(letter.ID, ".frame"))
+		return DeadLetter{}, err
+	}
+	d.prune(now)
+	return letter, nil
+}
+
+// List returns the dead letters of a camera, or of all with cameraID
+// empty, newest first.
+func (d *DeadLetters) List(cameraID string) ([]DeadLetter, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	letters := []DeadLetter{}
+	for i := len(entries) - 1; i >= 0; i-- {
+		id, ok := strings.CutSuffix(entries[i].Name(), ".json")
+		if !ok {
+			continue
+		}
+		letter, err := d.Get(id)
+		if err != nil {
+			// Reprocessed or pruned meanwhile
+			continue
+		}
+		if cameraID == "" || letter.CameraID == cameraID {
+			letters = append(letters, letter)
+		}
+	}
+	return letters, nil
+}
+
+// Get returns a dead letter.
+func (d *DeadLetters) Get(id string) (DeadLetter, error) {
+	if !validDeadLetterID(id) {
+		return DeadLetter{}, ErrDeadLetterNotFound
+	}
+	data, err := os.ReadFile(d.path(id, ".json"))
+	if os.IsNotExist(err) {
+		return DeadLetter{}, ErrDeadLetterNotFound
+	} else if err != nil {
+		return DeadLetter{}, err
+	}
+	var letter DeadLetter
+	if err := json.Unmarshal(data, &letter); err != nil {
+		return DeadLetter{}, fmt.Errorf("dead letter %s: %w", id, err)
+	}
+	return letter, nil
+}
+
+// Data returns a dead letter's payload.
+func (d *DeadLetters) Data(id string) ([]byte, error) {
+	if !validDeadLetterID(id) {
+		return nil, ErrDeadLetterNotFound
+	}
+	data, err := os.ReadFile(d.path(id, ".frame"))
+	if os.IsNotExist(err) {
+		return nil, ErrDeadLetterNotFound
+	}
+	return data, err
+}
+
+// Remove deletes a dead letter.
+func (d *DeadLetters) Remove(id string) error {
+	if !validDeadLetterID(id) {
+		return ErrDeadLetterNotFound
+	}
+	err := os.Remove(d.path(id, ".json"))
+	if os.IsNotExist(err) {
+		return ErrDeadLetterNotFound
+	} else if err != nil {
+		return err
+	}
+	if err := os.Remove(d.path(id, ".frame")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// prune removes the dead letters older than keep, then the oldest while
+// the payloads add up to more than maxBytes.
+func (d *DeadLetters) prune(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now.Sub(d.lastPrune) < deadLetterPruneInterval {
+		return
+	}
+	d.lastPrune = now
+
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return
+	}
+	type payload struct {
+		id   string
+		size int64
+		at   time.Time
+	}
+	var payloads []payload
+	var total int64
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".frame")
+		if !ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		payloads = append(payloads, payload{id: id, size: info.Size(), at: info.ModTime()})
+		total += info.Size()
+	}
+	// Names sort by when the frames failed
+	sort.Slice(payloads, func(i, j int) bool { return payloads[i].id < payloads[j].id })
+	for _, p := range payloads {
+		expired := d.keep > 0 && now.Sub(p.at) > d.keep
+		if !expired && (d.maxBytes <= 0 || total <= d.maxBytes) {
+			break
+		}
+		os.Remove(d.path(p.id, ".json"))
+		os.Remove(d.path(p.id, ".frame"))
+		total -= p.size
+	}
+}
+
+func (d *DeadLetters) path(id, ext string) string {
+	return filepath.Join(d.dir, id+ext)
+}
+
+// validDeadLetterID reports whether id can name a dead letter, rather than
+// a path out of the directory.
+func validDeadLetterID(id string) bool {
+	return id != "" && !strings.HasPrefix(id, ".") && !strings.ContainsAny(id, `/\`)
+}
+
+// writeFileAtomic writes a file under a temporary name and renames it into
+// place, so readers never see part of it.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,182 @@
+package processor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/raeeceip/cctv/internal/framestore"
+	"github.com/raeeceip/cctv/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// Deduplication is judged over windows of dedupWindow frames; a camera
+// below the minimum ratio stores dedupPause frames as plain files before
+// trying again.
+const (
+	dedupWindow = 100
+	dedupPause  = 1000
+)
+
+// DedupStats describes the deduplication of a camera's frames.
+type DedupStats struct {
+	// Active is false while the camera's frames are stored as plain files
+	// for lack of duplicates
+	Active bool `json:"active"`
+	// Frames were stored while deduplicating, Shared of them identical to
+	// an earlier frame of any camera
+	Frames     uint64 `json:"frames"`
+	Shared     uint64 `json:"shared"`
+	BytesSaved int64  `json:"bytes_saved"`
+}
+
+type dedupCamera struct {
+	stats      DedupStats
+	window     int
+	windowHits int
+	plainLeft  int
+}
+
+// dedup writes frames as hard links to blobs named by their content hash,
+// so identical frames, of one camera over time or of several cameras, take
+// the space of one. A nil dedup writes plain files.
+//
+// A blob's link count is its reference count; the index keeps no blob
+// table. Shard workers write frames without the index, and retention and
+// operators delete frame files directly, so a count in the index would
+// drift from the frames that exist, while the file system keeps the link
+// count exact. Retention counts each blob once towards max_disk_usage and
+// collects blobs whose count is down to one.
+type dedup struct {
+	store    *framestore.Store
+	minRatio float64
+	logger   *logger.Logger
+
+	mu      sync.Mutex
+	cameras map[string]*dedupCamera
+	broken  bool // the file system can't link; everything is plain
+}
+
+func newDedup(store *framestore.Store, minRatio float64, log *logger.Logger) *dedup {
+	return &dedup{store: store, minRatio: minRatio, logger: log, cameras: make(map[string]*dedupCamera)}
+}
+
+// write links a camera's frame at path to the blob of its content. It
+// reports false for frames to be written as plain files instead: without
+// deduplication, while the camera has too few duplicates, or once links
+// fail.
+func (d *dedup) write(cameraID, path string, data []byte) bool {
+	if d == nil {
+		return false
+	}
+
+	d.mu.Lock()
+	c, ok := d.cameras[cameraID]
+	if !ok {
+		c = &dedupCamera{stats: DedupStats{Active: true}}
+		d.cameras[cameraID] = c
+	}
+	plain := d.broken || c.plainLeft > 0
+	if c.plainLeft > 0 {
+		if c.plainLeft--; c.plainLeft == 0 {
+			c.stats.Active = true
+		}
+	}
+	d.mu.Unlock()
+	if plain {
+		return false
+	}
+
+	sum := sha256.Sum256(data)
+	shared, err := d.link(d.store.BlobPath(hex.EncodeToString(sum[:])), path, data)
+	if err != nil {
+		d.mu.Lock()
+		d.broken = true
+		d.mu.Unlock()
+		d.logger.Warn("Frame deduplication failed, storing plain frames from now on", zap.Error(err))
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c.stats.Frames++
+	c.window++
+	if shared {
+		c.stats.Shared++
+		c.stats.BytesSaved += int64(len(data))
+		c.windowHits++
+	}
+	if c.window == dedupWindow {
+		if ratio := float64(c.windowHits) / dedupWindow; ratio < d.minRatio {
+			c.plainLeft = dedupPause
+			c.stats.Active = false
+			d.logger.Info("Few duplicate frames, storing plain frames for a while",
+				zap.String("camera", cameraID),
+				zap.Float64("ratio", ratio))
+		}
+		c.window, c.windowHits = 0, 0
+	}
+	return true
+}
+
+// link makes path a link to the blob holding data, writing the blob first
+// unless it exists. shared reports whether it did. Errors mean links can't
+// be made at all.
+func (d *dedup) link(blob, path string, data []byte) (shared bool, err error) {
+	if err := linkReplacing(blob, path); err == nil {
+		return true, nil
+	}
+
+	// New content, or a blob collected just now. It is written under a
+	// temporary name, which also keeps its link count above one until the
+	// frame links to it, so it isn't collected meanwhile.
+	if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+		return false, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(blob), ".tmp-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	// Another shard worker may have written the same content meanwhile
+	if err := os.Link(tmp.Name(), blob); err != nil && !errors.Is(err, fs.ErrExist) {
+		return false, err
+	}
+	return false, linkReplacing(blob, path)
+}
+
+// linkReplacing links path to target, replacing a file already at path.
+func linkReplacing(target, path string) error {
+	err := os.Link(target, path)
+	if errors.Is(err, fs.ErrExist) {
+		os.Remove(path)
+		err = os.Link(target, path)
+	}
+	return err
+}
+
+// stats returns a camera's deduplication, nil if it isn't deduplicated.
+func (d *dedup) stats(cameraID string) *DedupStats {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.cameras[cameraID]
+	if !ok {
+		return nil
+	}
+	stats := c.stats
+	return &stats
+}
@@ -0,0 +1,93 @@
+package processor
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// LastFrame is the latest frame stored for a camera.
+type LastFrame struct {
+	Number    uint64
+	Timestamp time.Time // when the camera took it
+	Received  time.Time // when it was stored
+	Data      []byte
+}
+
+// LastFrames keeps the latest stored frame of each camera in memory, for
+// snapshots. Feed it from OnFrameSaved.
+type LastFrames struct {
+	mu      sync.Mutex
+	cameras map[string]*lastFrame
+}
+
+type lastFrame struct {
+	frame LastFrame
+	// updated is closed and replaced when the frame changes, waking Wait
+	updated chan struct{}
+}
+
+func NewLastFrames() *LastFrames {
+	return &LastFrames{cameras: make(map[string]*lastFrame)}
+}
+
+func (l *LastFrames) camera(id string) *lastFrame {
+	c, ok := l.cameras[id]
+	if !ok {
+		c = &lastFrame{updated: make(chan struct{})}
+		l.cameras[id] = c
+	}
+	return c
+}
+
+// Put records a copy of a camera's latest frame. The copy reuses the buffer
+// of the frame it replaces, so a steady stream does not allocate.
+func (l *LastFrames) Put(f FrameData) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.camera(f.CameraID)
+	c.frame = LastFrame{
+		Number:    f.Number,
+		Timestamp: f.Timestamp,
+		Received:  time.Now(),
+		Data:      append(c.frame.Data[:0], f.Data...),
+	}
+	close(c.updated)
+	c.updated = make(chan struct{})
+}
+
+// Get returns a copy of a camera's latest frame.
+func (l *LastFrames) Get(cameraID string) (LastFrame, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.cameras[cameraID]
+	if !ok || c.frame.Data == nil {
+		return LastFrame{}, false
+	}
+	f := c.frame
+	f.Data = append([]byte(nil), f.Data...)
+	return f, true
+}
+
+// Wait returns a copy of the first frame of a camera stored after after,
+// waiting for one until ctx is done.
+func (l *LastFrames) Wait(ctx context.Context, cameraID string, after time.Time) (LastFrame, error) {
+	for {
+		l.mu.Lock()
+		c := l.camera(cameraID)
+		if c.frame.Data != nil && c.frame.Received.After(after) {
+			f := c.frame
+			f.Data = append([]byte(nil), f.Data...)
+			l.mu.Unlock()
+			return f, nil
+		}
+		updated := c.updated
+		l.mu.Unlock()
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return LastFrame{}, ctx.Err()
+		}
+	}
+}
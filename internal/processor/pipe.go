@@ -0,0 +1,336 @@
+package processor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/codec"
+	"github.com/raeeceip/cctv/internal/thumbnail"
+	"github.com/raeeceip/cctv/internal/videocodec"
+	"github.com/raeeceip/cctv/pkg/pathutil"
+	"go.uber.org/zap"
+)
+
+// pipeFPS is the frame rate of piped videos, as of consolidated batches.
+const pipeFPS = 30
+
+// partSuffix marks a piped video FFmpeg is still writing.
+const partSuffix = ".part"
+
+// segment is a video being encoded by an FFmpeg reading a camera's JPEG
+// frames from stdin as they are saved.
+type segment struct {
+	mu       sync.Mutex
+	cameraID string
+	path     string // where the video goes once FFmpeg is done
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	stderr   bytes.Buffer
+	closed   bool
+
+	start, end time.Time // capture times of the first and last frames
+	slot       time.Time // start of the span of SegmentDuration it covers
+	frames     int
+	lastWrite  time.Time // when the last frame was written, to close idle videos
+	stored     []string  // frames also stored, for DeleteOriginals
+	samples    [][]byte  // copies of frames spread over the video, for thumbnails
+}
+
+// segments are the open videos of each camera, with VideoPipe.
+type segments struct {
+	mu        sync.Mutex
+	open      map[string]*segment
+	hooks     sync.Mutex // video hooks run one video at a time
+	finishing sync.WaitGroup
+}
+
+// encodeFrame writes a saved frame to its camera's video, starting one if
+// needed. path is where the frame was stored, if it was. The video is
+// finished once it has MaxFrames frames, or with SegmentDuration when a
+// frame of the next span comes.
+func (fp *FrameProcessor) encodeFrame(frame FrameData, path string) {
+	seg, err := fp.segment(frame)
+	if err != nil {
+		fp.backlog.consolidated(frame.CameraID, 0, err)
+		fp.logger.Error("Failed to start video encoder",
+			zap.String("camera", frame.CameraID),
+			zap.Error(err))
+		return
+	}
+	defer seg.mu.Unlock()
+
+	if _, err := seg.stdin.Write(frame.Data); err != nil {
+		// FFmpeg has exited; finishing the video reports why, and the next
+		// frame starts another
+		fp.closeSegment(seg)
+		return
+	}
+	if seg.frames == 0 {
+		seg.start = frame.Timestamp
+	}
+	if stride := max(fp.config.MaxFrames/10, 1); seg.frames%stride == 0 {
+		seg.samples = append(seg.samples, bytes.Clone(frame.Data))
+	}
+	seg.frames++
+	seg.end = frame.Timestamp
+	seg.lastWrite = time.Now()
+	if path != "" {
+		seg.stored = append(seg.stored, path)
+	}
+
+	if fp.config.SegmentDuration == 0 && seg.frames >= fp.config.MaxFrames {
+		fp.closeSegment(seg)
+	}
+}
+
+// segment returns the open video of a frame's camera, locked, starting one
+// sized for the frame if there is none.
+func (fp *FrameProcessor) segment(frame FrameData) (*segment, error) {
+	fp.segments.mu.Lock()
+	seg := fp.segments.open[frame.CameraID]
+	fp.segments.mu.Unlock()
+	if seg != nil {
+		seg.mu.Lock()
+		if !seg.closed && !fp.pastSlot(seg, frame.Timestamp) {
+			return seg, nil
+		}
+		// Closed as idle since it was looked up, or the frame starts the
+		// next span
+		if !seg.closed {
+			fp.closeSegment(seg)
+		}
+		seg.mu.Unlock()
+	}
+
+	seg, err := fp.startSegment(frame)
+	if err != nil {
+		return nil, err
+	}
+	seg.mu.Lock()
+	fp.segments.mu.Lock()
+	if fp.segments.open == nil {
+		fp.segments.open = make(map[string]*segment)
+	}
+	fp.segments.open[frame.CameraID] = seg
+	fp.segments.mu.Unlock()
+	return seg, nil
+}
+
+// startSegment runs the FFmpeg of a new video of frame's camera. Without a
+// configured size, the video takes the frame's, rounded up to even, and
+// later frames of other sizes are letterboxed into it.
+func (fp *FrameProcessor) startSegment(frame FrameData) (*segment, error) {
+	if err := fp.config.Chaos.FailFFmpeg(); err != nil {
+		return nil, err
+	}
+	at := time.Now()
+	if fp.config.SegmentDuration > 0 {
+		at = fp.segmentStart(frame.Timestamp)
+	}
+	videoPath, err := fp.videoPath(frame.CameraID, frame.Number, at)
+	if err != nil {
+		return nil, err
+	}
+	partPath, err := pathutil.FFmpeg(videoPath + partSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	enc := fp.videoEncoder()
+	args := []string{"-y"}
+	args = append(args, enc.InputArgs()...)
+	args = append(args,
+		"-f", "image2pipe", // Concatenated JPEGs on stdin
+		"-framerate", strconv.Itoa(pipeFPS),
+		"-c:v", "mjpeg",
+		"-i", "pipe:0",
+	)
+	var filter string
+	if fp.config.VideoCodec != videocodec.Copy {
+		width, height := fp.config.VideoWidth, fp.config.VideoHeight
+		if width == 0 || height == 0 {
+			cfg, err := codec.DecodeConfig(frame.Data)
+			if err != nil {
+				return nil, err
+			}
+			width, height = cfg.Width+cfg.Width%2, cfg.Height+cfg.Height%2
+		}
+		filter = fitFilter(width, height)
+	}
+	args = append(args, enc.FilterArgs(filter)...)
+	args = append(args, enc.Args(0)...)
+	args = append(args,
+		"-movflags", "+faststart",
+		"-f", "mp4", // The extension doesn't say while the video is partial
+		partPath,
+	)
+
+	seg := &segment{cameraID: frame.CameraID, path: videoPath, slot: at}
+	seg.cmd = exec.Command("ffmpeg", args...)
+	seg.cmd.Stderr = &seg.stderr
+	if seg.stdin, err = seg.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+
+	fp.logger.Debug("Running FFmpeg command",
+		zap.String("command", fmt.Sprintf("ffmpeg %s", strings.Join(args, " "))))
+
+	if err := seg.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+	fp.logger.Info("Starting video creation",
+		zap.String("camera", frame.CameraID),
+		zap.String("output", videoPath))
+	return seg, nil
+}
+
+// closeSegment ends a video's input, which must be locked, and finishes it
+// in the background.
+func (fp *FrameProcessor) closeSegment(seg *segment) {
+	seg.closed = true
+	seg.stdin.Close()
+
+	fp.segments.mu.Lock()
+	if fp.segments.open[seg.cameraID] == seg {
+		delete(fp.segments.open, seg.cameraID)
+	}
+	fp.segments.mu.Unlock()
+	// Every frame is with FFmpeg now
+	fp.backlog.pending(seg.cameraID, 0, time.Time{})
+
+	fp.segments.finishing.Add(1)
+	go fp.finishSegment(seg)
+}
+
+// pastSlot reports whether a frame captured at t belongs after the span of
+// a video, which must be locked; always false without SegmentDuration.
+func (fp *FrameProcessor) pastSlot(seg *segment, t time.Time) bool {
+	return fp.config.SegmentDuration > 0 && !t.Before(seg.slot.Add(fp.config.SegmentDuration))
+}
+
+// closeSegments finishes the videos of cameras that have sent nothing for
+// VideoInterval, and with SegmentDuration those whose span ended more than
+// segmentGrace ago. With force it finishes every open video, and waits
+// until they are written.
+func (fp *FrameProcessor) closeSegments(force bool) {
+	fp.segments.mu.Lock()
+	open := make([]*segment, 0, len(fp.segments.open))
+	for _, seg := range fp.segments.open {
+		open = append(open, seg)
+	}
+	fp.segments.mu.Unlock()
+
+	now := time.Now()
+	idle := now.Add(-time.Duration(fp.videoInterval.Load()))
+	for _, seg := range open {
+		seg.mu.Lock()
+		if !seg.closed && (force || seg.lastWrite.Before(idle) || fp.pastSlot(seg, now.Add(-segmentGrace))) {
+			fp.closeSegment(seg)
+		}
+		seg.mu.Unlock()
+	}
+	if force {
+		fp.segments.finishing.Wait()
+	}
+}
+
+// finishSegment waits for FFmpeg to write a closed video, then hands it on
+// as consolidated videos are.
+func (fp *FrameProcessor) finishSegment(seg *segment) {
+	defer fp.segments.finishing.Done()
+
+	err := fp.waitSegment(seg)
+	fp.backlog.consolidated(seg.cameraID, seg.frames, err)
+	if err != nil {
+		os.Remove(seg.path + partSuffix)
+		fp.metrics.RecordError()
+		fp.logger.Error("Failed to create video",
+			zap.String("camera", seg.cameraID),
+			zap.Int("frame_count", seg.frames),
+			zap.Error(err))
+		return
+	}
+	fp.metrics.RecordVideoGenerated()
+
+	// Thumbnails are a convenience for dashboards, so the video stands
+	// without them
+	if err := thumbnail.WriteData(seg.samples, seg.path); err != nil {
+		fp.logger.Warn("Failed to create video thumbnail",
+			zap.String("video", seg.path),
+			zap.Error(err))
+	}
+
+	video := Video{
+		CameraID:   seg.cameraID,
+		Path:       seg.path,
+		StartTime:  seg.start,
+		EndTime:    seg.end,
+		FrameCount: seg.frames,
+		Codec:      fp.videoEncoder().Name,
+	}
+	if info, err := os.Stat(seg.path); err == nil {
+		video.SizeBytes = info.Size()
+	}
+	fp.segments.hooks.Lock()
+	for _, fn := range fp.onVideo {
+		fn(video)
+	}
+	fp.segments.hooks.Unlock()
+
+	if fp.config.DeleteOriginals {
+		for _, frame := range seg.stored {
+			if err := fp.store.Remove(frame); err != nil {
+				fp.logger.Warn("Failed to delete frame",
+					zap.String("frame", frame),
+					zap.Error(err))
+			}
+		}
+	}
+}
+
+// waitSegment waits for a closed video's FFmpeg to exit and moves the
+// video into place.
+func (fp *FrameProcessor) waitSegment(seg *segment) error {
+	if err := seg.cmd.Wait(); err != nil {
+		return fmt.Errorf("ffmpeg error: %v\nOutput: %s", err, seg.stderr.String())
+	}
+	if seg.frames == 0 {
+		return errors.New("no frames were encoded")
+	}
+	if info, err := os.Stat(seg.path + partSuffix); err != nil || info.Size() == 0 {
+		return fmt.Errorf("video file creation failed or is empty")
+	}
+	if err := os.Rename(seg.path+partSuffix, seg.path); err != nil {
+		return fmt.Errorf("failed to save video: %w", err)
+	}
+
+	fp.logger.Info("Video created successfully",
+		zap.String("output", seg.path),
+		zap.Int("frame_count", seg.frames))
+	return nil
+}
+
+// removeParts deletes videos left partial by a crash, which lack the index
+// MP4 players need.
+func (fp *FrameProcessor) removeParts() {
+	parts, err := filepath.Glob(filepath.Join(fp.config.OutputDir, "videos", "*"+partSuffix))
+	if err != nil {
+		return
+	}
+	for _, part := range parts {
+		if err := os.Remove(part); err != nil {
+			fp.logger.Warn("Failed to delete partial video",
+				zap.String("path", part),
+				zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"plugin"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/raeeceip/cctv/pkg/logger"
+	"github.com/raeeceip/cctv/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// Phases of the frame pipeline, in the order frames go through them. The
+// built-in stages come first in their phase, then the others in the order
+// they were added.
+const (
+	// PhaseDecode checks a frame and makes it a JPEG within its camera's
+	// resolution limit: the built-in "decode" stage
+	PhaseDecode = "decode"
+	// PhaseTransform changes the image, such as to watermark it; nothing
+	// is built in
+	PhaseTransform = "transform"
+	// PhasePersist stores the frame: the built-in "store" stage
+	PhasePersist = "persist"
+	// PhaseIndex accounts for the stored frame and hands it on to video
+	// encoding and the OnFrameSaved hooks: the built-in "index" stage.
+	// Errors of stages in it are logged, as the frame is stored by then.
+	PhaseIndex = "index"
+)
+
+// Phases lists the phases in order.
+var Phases = []string{PhaseDecode, PhaseTransform, PhasePersist, PhaseIndex}
+
+// ErrDropFrame is returned by stages dropping a frame on purpose. The frame
+// goes no further, and isn't counted as failed.
+var ErrDropFrame = errors.New("frame dropped")
+
+// Frame is a frame on its way through the pipeline. After the decode phase
+// Data is a JPEG of Width by Height, which stages replacing it keep so.
+// Path is set by the persist phase, unless frames aren't stored.
+type Frame struct {
+	FrameData
+	Width, Height int
+	// Values carries what stages leave for later ones
+	Values map[string]any
+
+	started time.Time
+}
+
+// Stage is a step of the frame pipeline. Process is called by the
+// processor's workers: for one frame of a camera at a time, but for
+// several cameras at once.
+type Stage interface {
+	Name() string
+	Phase() string
+	Process(f *Frame) error
+}
+
+// NewStage returns a stage calling fn, for callbacks added with AddStage.
+func NewStage(name, phase string, fn func(f *Frame) error) Stage {
+	return funcStage{name: name, phase: phase, fn: fn}
+}
+
+type funcStage struct {
+	name, phase string
+	fn          func(f *Frame) error
+}
+
+func (s funcStage) Name() string           { return s.name }
+func (s funcStage) Phase() string          { return s.phase }
+func (s funcStage) Process(f *Frame) error { return s.fn(f) }
+
+// StageFactory builds a stage from its options in processor.stages.
+type StageFactory func(options map[string]any) (Stage, error)
+
+var stageFactories = map[string]StageFactory{}
+
+// RegisterStage makes a stage available to processor.stages by name, from
+// an init function of a package built in or of a plugin.
+func RegisterStage(name string, f StageFactory) {
+	stageFactories[name] = f
+}
+
+// StageConfig adds a registered stage to the pipeline.
+type StageConfig struct {
+	Name string `json:"name"`
+	// Cameras are those the stage runs for, all when empty
+	Cameras []string       `json:"cameras,omitempty"`
+	Options map[string]any `json:"options,omitempty"`
+}
+
+// LoadPlugins opens Go plugins, built with -buildmode=plugin against the
+// same source as the server, whose init functions call RegisterStage.
+func LoadPlugins(paths []string) error {
+	for _, path := range paths {
+		if _, err := plugin.Open(path); err != nil {
+			return fmt.Errorf("failed to load plugin %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// newStage builds the registered stage c names.
+func newStage(c StageConfig) (Stage, error) {
+	f, ok := stageFactories[c.Name]
+	if !ok {
+		names := make([]string, 0, len(stageFactories))
+		for n := range stageFactories {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown frame stage %q, have %v", c.Name, names)
+	}
+	s, err := f(c.Options)
+	if err != nil {
+		return nil, fmt.Errorf("frame stage %s: %w", c.Name, err)
+	}
+	return s, nil
+}
+
+// pipelineStage is a stage as the pipeline runs it.
+type pipelineStage struct {
+	Stage
+	phase   int
+	builtIn bool
+	cameras []string // all when empty
+}
+
+// pipeline is the stages frames go through, ordered by phase.
+type pipeline struct {
+	mu      sync.RWMutex
+	stages  []pipelineStage
+	metrics *metrics.StageMetrics
+}
+
+// add puts a stage after those of its phase.
+func (p *pipeline) add(s Stage, cameras []string, builtIn bool) error {
+	phase := slices.Index(Phases, s.Phase())
+	if phase < 0 {
+		return fmt.Errorf("frame stage %s: unknown phase %q, expected one of %v", s.Name(), s.Phase(), Phases)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := len(p.stages)
+	for i > 0 && p.stages[i-1].phase > phase {
+		i--
+	}
+	p.stages = slices.Insert(p.stages, i, pipelineStage{Stage: s, phase: phase, builtIn: builtIn, cameras: cameras})
+	return nil
+}
+
+// names lists the stages in order, as phase/name.
+func (p *pipeline) names() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	names := make([]string, len(p.stages))
+	for i, s := range p.stages {
+		names[i] = s.Phase() + "/" + s.Name()
+	}
+	return names
+}
+
+// run takes a frame through the stages, stopping at the first error
+// before the index phase.
+func (p *pipeline) run(f *Frame, log *logger.Logger) error {
+	p.mu.RLock()
+	stages := p.stages
+	p.mu.RUnlock()
+	for _, s := range stages {
+		if len(s.cameras) > 0 && !slices.Contains(s.cameras, f.CameraID) {
+			continue
+		}
+		start := time.Now()
+		err := s.Process(f)
+		p.metrics.Duration.WithLabelValues(s.Name()).Observe(time.Since(start).Seconds())
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, ErrDropFrame) {
+			return err
+		}
+		p.metrics.Errors.WithLabelValues(s.Name()).Inc()
+		if !s.builtIn {
+			err = fmt.Errorf("frame stage %s: %w", s.Name(), err)
+		}
+		if s.phase == slices.Index(Phases, PhaseIndex) {
+			log.Warn("Frame stage failed",
+				zap.String("camera", f.CameraID),
+				zap.Uint64("frame", f.Number),
+				zap.Error(err))
+			continue
+		}
+		return err
+	}
+	return nil
+}
@@ -38,6 +38,35 @@ func (pm *ProcessorMetrics) RecordError() {
 	atomic.AddUint64(&pm.TotalProcessingErrors, 1)
 }
 
+// Snapshot returns a copy of the metrics, for reading while they change.
+func (pm *ProcessorMetrics) Snapshot() ProcessorMetrics {
+	return ProcessorMetrics{
+		TotalFramesProcessed:     atomic.LoadUint64(&pm.TotalFramesProcessed),
+		TotalVideosGenerated:     atomic.LoadUint64(&pm.TotalVideosGenerated),
+		TotalProcessingErrors:    atomic.LoadUint64(&pm.TotalProcessingErrors),
+		LastFrameProcessedTimeNs: atomic.LoadInt64(&pm.LastFrameProcessedTimeNs),
+		LastVideoGeneratedTimeNs: atomic.LoadInt64(&pm.LastVideoGeneratedTimeNs),
+		AverageProcessingTime:    time.Duration(atomic.LoadInt64((*int64)(&pm.AverageProcessingTime))),
+		ProcessingTimeSum:        atomic.LoadInt64(&pm.ProcessingTimeSum),
+		ProcessingTimeCount:      atomic.LoadUint64(&pm.ProcessingTimeCount),
+	}
+}
+
+// Merge adds the totals of another processor, such as a shard's, to pm,
+// which no one else may be using.
+func (pm *ProcessorMetrics) Merge(o ProcessorMetrics) {
+	pm.TotalFramesProcessed += o.TotalFramesProcessed
+	pm.TotalVideosGenerated += o.TotalVideosGenerated
+	pm.TotalProcessingErrors += o.TotalProcessingErrors
+	pm.LastFrameProcessedTimeNs = max(pm.LastFrameProcessedTimeNs, o.LastFrameProcessedTimeNs)
+	pm.LastVideoGeneratedTimeNs = max(pm.LastVideoGeneratedTimeNs, o.LastVideoGeneratedTimeNs)
+	pm.ProcessingTimeSum += o.ProcessingTimeSum
+	pm.ProcessingTimeCount += o.ProcessingTimeCount
+	if pm.ProcessingTimeCount > 0 {
+		pm.AverageProcessingTime = time.Duration(pm.ProcessingTimeSum) / time.Duration(pm.ProcessingTimeCount)
+	}
+}
+
 func (pm *ProcessorMetrics) GetMetrics() map[string]interface{} {
 	return map[string]interface{}{
 		"total_frames_processed":     atomic.LoadUint64(&pm.TotalFramesProcessed),
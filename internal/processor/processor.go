@@ -1,12 +1,15 @@
 package processor
 
 import (
+	"bufio"
 	"bytes"
 	"context"
-	"encoding/base64"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"image"
 	"image/jpeg"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -14,27 +17,107 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/raeeceip/cctv/internal/chaos"
+	"github.com/raeeceip/cctv/internal/codec"
+	"github.com/raeeceip/cctv/internal/framemeta"
+	"github.com/raeeceip/cctv/internal/framestore"
+	"github.com/raeeceip/cctv/internal/naming"
+	"github.com/raeeceip/cctv/internal/storage"
+	"github.com/raeeceip/cctv/internal/thumbnail"
+	"github.com/raeeceip/cctv/internal/videocodec"
+	"github.com/raeeceip/cctv/internal/wire"
 	"github.com/raeeceip/cctv/pkg/logger"
+	"github.com/raeeceip/cctv/pkg/metrics"
+	"github.com/raeeceip/cctv/pkg/pathutil"
 	"go.uber.org/zap"
 )
 
+// FrameData is one JPEG frame of a camera. Frames built with PooledFrame
+// share their Data with a pooled buffer that the processor recycles.
 type FrameData struct {
 	CameraID  string    `json:"camera_id"`
 	Data      []byte    `json:"data"`
 	Timestamp time.Time `json:"timestamp"`
 	Number    uint64    `json:"number"`
+	// Location is where a mobile camera took the frame, if it said
+	Location *wire.Location `json:"location,omitempty"`
+	// Pattern is the test pattern a simulated camera drew, if it said
+	Pattern string `json:"pattern,omitempty"`
+	// Delta frames depend on the keyframe their GOP names; frames of
+	// cameras that don't send in groups of pictures stand alone
+	Delta bool      `json:"delta,omitempty"`
+	GOP   *wire.GOP `json:"gop,omitempty"`
+	// PTZ is where a pan/tilt/zoom camera pointed, if it said
+	PTZ *wire.PTZ `json:"ptz,omitempty"`
+	// Path is where the frame was stored, set for OnFrameSaved hooks
+	Path string `json:"path,omitempty"`
+
+	buf *bytes.Buffer
 }
 
 type ProcessorConfig struct {
-	OutputDir          string        `json:"output_dir"`
-	MaxFrames          int           `json:"max_frames"`
-	RetentionTime      time.Duration `json:"retention_time"`
-	BufferSize         int           `json:"buffer_size"`
+	OutputDir     string        `json:"output_dir"`
+	MaxFrames     int           `json:"max_frames"`
+	RetentionTime time.Duration `json:"retention_time"`
+	BufferSize    int           `json:"buffer_size"` // frames queued per worker
+	// Workers is how many frames are saved at once. Each camera is handled
+	// by one worker, so its frames are saved in the order they arrive.
+	Workers            int           `json:"workers"`
 	VideoInterval      time.Duration `json:"video_interval"`
 	DeleteOriginals    bool          `json:"delete_originals"`
 	VideoConsolidation bool          `json:"video_consolidation"`
+	// VideoCodec is the FFmpeg encoder for consolidated videos; "copy"
+	// stores the JPEG frames as MJPEG without transcoding.
+	VideoCodec   string `json:"video_codec"`
+	VideoBitrate int    `json:"video_bitrate"` // kbps, for hardware encoders
+	// VideoHWAccel and VideoDevice choose the hardware encoder; see
+	// package videocodec
+	VideoHWAccel string `json:"video_hwaccel"`
+	VideoDevice  string `json:"video_device"`
+	// VideoWidth and VideoHeight size transcoded videos, letterboxing
+	// frames of other shapes; zero uses the largest frame of each video
+	VideoWidth  int `json:"video_width"`
+	VideoHeight int `json:"video_height"`
+	// VideoPipe feeds each camera's frames to an FFmpeg as they are saved,
+	// rather than consolidating batches of stored frames
+	VideoPipe bool `json:"video_pipe"`
+	// SegmentDuration, if set, cuts videos at fixed spans of capture
+	// time, aligned to local midnight, rather than every MaxFrames frames
+	SegmentDuration time.Duration `json:"segment_duration"`
+	// DiscardFrames, with VideoPipe, encodes frames without storing them
+	DiscardFrames bool `json:"discard_frames"`
+	// Chaos injects storage delays and FFmpeg failures, if set
+	Chaos *chaos.Injector `json:"-"`
+	// FrameLayout is the directory layout for new frames
+	FrameLayout framestore.Layout `json:"frame_layout"`
+	// FrameName and VideoName are the templates naming frames and videos,
+	// empty for the defaults; Site is what they are given for {{.Site}}
+	FrameName string `json:"frame_name"`
+	VideoName string `json:"video_name"`
+	Site      string `json:"site"`
+	// Dedup stores identical frames once; cameras fall back to plain
+	// files while fewer than DedupMinRatio of their frames are shared
+	Dedup         bool    `json:"dedup"`
+	DedupMinRatio float64 `json:"dedup_min_ratio"`
+	// FrameMetadata writes each frame's metadata to a sidecar or into the
+	// JPEG; see framemeta
+	FrameMetadata string `json:"frame_metadata"`
+	// Resolution limits the size of cameras' frames; the first limit
+	// listing a camera, or listing none, is its
+	Resolution []ResolutionLimit `json:"resolution"`
+	// DeadLetterDir, if set, keeps frames that fail to be stored there,
+	// no more than DeadLetterMaxMB of them for DeadLetterKeep
+	DeadLetterDir   string        `json:"dead_letter_dir"`
+	DeadLetterMaxMB int64         `json:"dead_letter_max_mb"`
+	DeadLetterKeep  time.Duration `json:"dead_letter_keep"`
+	// Plugins are Go plugins registering frame stages, and Stages those
+	// added to the pipeline; see Stage
+	Plugins []string      `json:"plugins"`
+	Stages  []StageConfig `json:"stages"`
 }
 
 type ProcessResult struct {
@@ -44,17 +127,74 @@ type ProcessResult struct {
 	ProcessedTime time.Time     `json:"processed_time"`
 	Duration      time.Duration `json:"duration"`
 	Error         error         `json:"error,omitempty"`
+	Data          []byte        `json:"-"` // the stored JPEG
+}
+
+// Video describes a consolidated video file.
+type Video struct {
+	CameraID   string
+	Path       string
+	StartTime  time.Time
+	EndTime    time.Time
+	FrameCount int
+	SizeBytes  int64
+	Codec      string
+}
+
+// Processor stores frames and consolidates them into videos, either in this
+// process (FrameProcessor) or in shard worker processes.
+type Processor interface {
+	Start(ctx context.Context) error
+	ProcessFrame(frame FrameData) error
+	Flush() error
+	Stop()
+	Backlog() []CameraBacklog
+	OnVideoCreated(fn func(Video))
+	OnFrameSaved(fn func(FrameData))
+	SetVideoInterval(d time.Duration)
+	// Encoder returns what videos are encoded with, once it is chosen
+	Encoder() (videocodec.Encoder, bool)
+	QueueLoad(cameraID string) float64
+	QueueDepth() (queued, capacity int)
+	Metrics() ProcessorMetrics
 }
 
 type FrameProcessor struct {
 	config          ProcessorConfig
 	logger          *logger.Logger
-	frameChan       chan FrameData
+	store           *framestore.Store
+	frames          storage.Storage // the output directory, which frames are written to and read from
+	videoName       *naming.Template
+	dedup           *dedup             // nil unless enabled
+	queues          []chan queuedFrame // one per worker
 	consolidateChan chan struct{}
 	processingMap   sync.Map
 	frameCount      map[string]uint64
+	consolidated    map[string]int // last frame number turned into video
+	consolidatedAt  map[string]time.Time
+	backlog         backlog
 	metrics         *ProcessorMetrics
+	queueMetrics    *metrics.ProcessorQueueMetrics
+	queueLengths    []prometheus.Gauge
 	mu              sync.RWMutex
+	onVideo         []func(Video)
+	onFrame         []func(FrameData)
+	segments        segments // open videos, with VideoPipe
+	// videoInterval is config.VideoInterval as last set, in nanoseconds;
+	// intervalChanged wakes the consolidation routine when it changes
+	videoInterval   atomic.Int64
+	intervalChanged chan struct{}
+	// resolution counts frames over their camera's limit; overResolution
+	// holds the cameras whose dropped frames were logged
+	resolution     *metrics.ResolutionMetrics
+	overResolution sync.Map
+	deadLetters    *DeadLetters // nil unless DeadLetterDir is set
+	deadLettered   *metrics.DeadLetterMetrics
+	// encoder is what videos are encoded with, probed once needed
+	encoder     videocodec.Encoder
+	encoderOnce sync.Once
+	// pipeline is the stages frames are saved through
+	pipeline pipeline
 }
 
 func NewFrameProcessor(config ProcessorConfig, log *logger.Logger) (*FrameProcessor, error) {
@@ -64,27 +204,93 @@ func NewFrameProcessor(config ProcessorConfig, log *logger.Logger) (*FrameProces
 	if config.BufferSize <= 0 {
 		config.BufferSize = 100
 	}
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
 	if config.VideoInterval <= 0 {
 		config.VideoInterval = 10 * time.Second
 	}
+	if config.VideoCodec == "" {
+		config.VideoCodec = "libx264"
+	}
+	if config.VideoBitrate <= 0 {
+		config.VideoBitrate = 2000
+	}
 
 	if err := os.MkdirAll(config.OutputDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create output directory: %w", err)
 	}
+	store, err := framestore.New(config.OutputDir, config.FrameLayout, config.FrameName, config.Site)
+	if err != nil {
+		return nil, err
+	}
+	frames, err := storage.NewLocal(config.OutputDir)
+	if err != nil {
+		return nil, err
+	}
+	if config.VideoName == "" {
+		config.VideoName = naming.DefaultVideo
+	}
+	videoName, err := naming.Parse("video name", config.VideoName)
+	if err != nil {
+		return nil, err
+	}
 
 	log.Info("Initializing frame processor",
 		zap.String("output_dir", config.OutputDir),
 		zap.Int("buffer_size", config.BufferSize),
+		zap.Int("workers", config.Workers),
 		zap.Duration("retention_time", config.RetentionTime))
 
-	return &FrameProcessor{
+	fp := &FrameProcessor{
 		config:          config,
 		logger:          log,
-		frameChan:       make(chan FrameData, config.BufferSize),
+		store:           store,
+		frames:          frames,
+		videoName:       videoName,
+		queues:          make([]chan queuedFrame, config.Workers),
 		consolidateChan: make(chan struct{}, 1),
 		frameCount:      make(map[string]uint64),
+		consolidated:    make(map[string]int),
+		consolidatedAt:  make(map[string]time.Time),
 		metrics:         &ProcessorMetrics{},
-	}, nil
+		queueMetrics:    metrics.NewProcessorQueueMetrics(),
+		queueLengths:    make([]prometheus.Gauge, config.Workers),
+		resolution:      metrics.NewResolutionMetrics(),
+		intervalChanged: make(chan struct{}, 1),
+	}
+	fp.videoInterval.Store(int64(config.VideoInterval))
+	for i := range fp.queues {
+		fp.queues[i] = make(chan queuedFrame, config.BufferSize)
+		fp.queueLengths[i] = fp.queueMetrics.Length.WithLabelValues(strconv.Itoa(i))
+	}
+	fp.queueMetrics.Capacity.Set(float64(config.BufferSize))
+	if config.Dedup {
+		fp.dedup = newDedup(store, config.DedupMinRatio, log)
+	}
+	fp.pipeline.metrics = metrics.NewStageMetrics()
+	fp.pipeline.add(NewStage("decode", PhaseDecode, fp.decodeFrame), nil, true)
+	fp.pipeline.add(NewStage("store", PhasePersist, fp.storeFrame), nil, true)
+	fp.pipeline.add(NewStage("index", PhaseIndex, fp.indexFrame), nil, true)
+	if err := LoadPlugins(config.Plugins); err != nil {
+		return nil, err
+	}
+	for _, sc := range config.Stages {
+		stage, err := newStage(sc)
+		if err != nil {
+			return nil, err
+		}
+		if err := fp.pipeline.add(stage, sc.Cameras, false); err != nil {
+			return nil, err
+		}
+	}
+	if config.DeadLetterDir != "" {
+		if fp.deadLetters, err = NewDeadLetters(config.DeadLetterDir, config.DeadLetterMaxMB, config.DeadLetterKeep); err != nil {
+			return nil, err
+		}
+		fp.deadLettered = metrics.NewDeadLetterMetrics()
+	}
+	return fp, nil
 }
 
 func (fp *FrameProcessor) testFFmpeg() error {
@@ -97,9 +303,12 @@ func (fp *FrameProcessor) testFFmpeg() error {
 		return fmt.Errorf("FFmpeg test failed: %v\nOutput: %s", err, stderr.String())
 	}
 
-	// Test a simple conversion to ensure FFmpeg is working
-	testDir := filepath.Join(fp.config.OutputDir, "test")
-	if err := os.MkdirAll(testDir, 0755); err != nil {
+	// Test a simple conversion to ensure FFmpeg is working. The directory
+	// name contains a space and a quote so the same path handling used by
+	// createVideo is exercised on every platform. It is unique so shard
+	// workers sharing the output directory can test at the same time.
+	testDir, err := os.MkdirTemp(fp.config.OutputDir, "ffmpeg test's-")
+	if err != nil {
 		return fmt.Errorf("failed to create test directory: %w", err)
 	}
 	defer os.RemoveAll(testDir)
@@ -115,10 +324,36 @@ func (fp *FrameProcessor) testFFmpeg() error {
 	if err := jpeg.Encode(file, img, &jpeg.Options{Quality: 90}); err != nil {
 		return fmt.Errorf("failed to create test image: %w", err)
 	}
+	// Windows won't let FFmpeg open a file we still hold open
+	file.Close()
 
-	// Try to create a test video
-	testVideo := filepath.Join(testDir, "test.mp4")
-	cmd = exec.Command("ffmpeg", "-y", "-i", testImage, "-frames:v", "1", "-c:v", "libx264", testVideo)
+	// Try to create a test video through the concat demuxer
+	entry, err := pathutil.ConcatEntry(testImage)
+	if err != nil {
+		return err
+	}
+	listFile := filepath.Join(testDir, "list.txt")
+	if err := os.WriteFile(listFile, []byte(entry+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to create test frame list: %w", err)
+	}
+	listPath, err := pathutil.FFmpeg(listFile)
+	if err != nil {
+		return err
+	}
+	testVideo, err := pathutil.FFmpeg(filepath.Join(testDir, "test.mp4"))
+	if err != nil {
+		return err
+	}
+
+	// With the encoder videos will be made with, which choosing probes
+	enc := fp.videoEncoder()
+	args := append([]string{"-y"}, enc.InputArgs()...)
+	args = append(args, "-f", "concat", "-safe", "0", "-i", listPath, "-frames:v", "1")
+	args = append(args, enc.FilterArgs("")...)
+	args = append(args, enc.Args(0)...)
+	stderr.Reset()
+	cmd = exec.Command("ffmpeg", append(args, testVideo)...)
+	cmd.Stderr = &stderr
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("FFmpeg conversion test failed: %v\nOutput: %s", err, stderr.String())
 	}
@@ -134,86 +369,236 @@ func (fp *FrameProcessor) saveFrame(frame FrameData) ProcessResult {
 		ProcessedTime: startTime,
 	}
 
-	// Validate frame data
-	if len(frame.Data) == 0 {
-		result.Error = fmt.Errorf("empty frame data")
+	f := &Frame{FrameData: frame, started: startTime}
+	if err := fp.pipeline.run(f, fp.logger); err != nil {
+		result.Error = err
 		return result
 	}
 
-	if frame.CameraID == "" {
-		result.Error = fmt.Errorf("missing camera ID")
-		return result
+	result.FilePath = f.Path
+	result.Data = f.Data
+	result.Duration = time.Since(startTime)
+
+	return result
+}
+
+// decodeFrame is the built-in stage of PhaseDecode.
+func (fp *FrameProcessor) decodeFrame(f *Frame) error {
+	// Validate frame data
+	if len(f.Data) == 0 {
+		return fmt.Errorf("empty frame data")
+	}
+	if f.CameraID == "" {
+		return fmt.Errorf("missing camera ID")
 	}
 
-	// Create camera directory
-	cameraDir := filepath.Join(fp.config.OutputDir, frame.CameraID)
-	if err := os.MkdirAll(cameraDir, 0755); err != nil {
-		result.Error = fmt.Errorf("failed to create camera directory: %w", err)
-		return result
+	// Verify JPEG format
+	original := f.Data
+	cfg, err := codec.DecodeConfig(original)
+	if err != nil {
+		return fmt.Errorf("invalid %s format: %w", codec.Encoding(original), err)
+	}
+	data, err := fp.limitResolution(f.CameraID, original, cfg)
+	if err != nil {
+		return err
+	}
+	// Cameras may send WebP, but everything stored is JPEG
+	if data, err = codec.ToJPEG(data, encodeQuality); err != nil {
+		return fmt.Errorf("failed to convert %s frame: %w", codec.Encoding(original), err)
+	}
+	if len(data) != len(original) || &data[0] != &original[0] {
+		if cfg, err = codec.DecodeConfig(data); err != nil {
+			return err
+		}
+	}
+	f.Data, f.Width, f.Height = data, cfg.Width, cfg.Height
+	return nil
+}
+
+// storeFrame is the built-in stage of PhasePersist.
+func (fp *FrameProcessor) storeFrame(f *Frame) error {
+	if delay := fp.config.Chaos.PersistDelay(); delay > 0 {
+		time.Sleep(delay)
+	}
+	if fp.config.DiscardFrames {
+		return nil
 	}
 
-	// Process frame data with validation
-	var frameData []byte
-	if isBase64(frame.Data) {
-		decoded, err := base64.StdEncoding.DecodeString(string(frame.Data))
+	// Create the frame's directory in the configured layout
+	filename, err := fp.store.Path(f.CameraID, f.Number, f.Timestamp)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return fmt.Errorf("failed to create frame directory: %w", err)
+	}
+
+	meta := framemeta.Metadata{
+		Camera:   f.CameraID,
+		Sequence: f.Number,
+		Time:     f.Timestamp,
+		Pattern:  f.Pattern,
+		Location: f.Location,
+		Delta:    f.Delta,
+		GOP:      f.GOP,
+		PTZ:      f.PTZ,
+	}
+	if fp.config.FrameMetadata == framemeta.ModeEmbed {
+		embedded, err := framemeta.Embed(f.Data, meta)
 		if err != nil {
-			result.Error = fmt.Errorf("failed to decode base64: %w", err)
-			return result
+			return fmt.Errorf("failed to embed frame metadata: %w", err)
 		}
-		frameData = decoded
-	} else {
-		frameData = frame.Data
+		f.Data = embedded
 	}
 
-	// Validate decoded data
-	if len(frameData) == 0 {
-		result.Error = fmt.Errorf("invalid frame data after decoding")
-		return result
+	// Save the frame, as a link to identical content if deduplicating
+	if !fp.dedup.write(f.CameraID, filename, f.Data) {
+		if err := fp.putFrame(filename, f.Data); err != nil {
+			return fmt.Errorf("failed to write frame file: %w", err)
+		}
 	}
+	if fp.config.FrameMetadata == framemeta.ModeSidecar {
+		// The frame is there regardless
+		if err := framemeta.WriteSidecar(filename, meta); err != nil {
+			fp.logger.Warn("Failed to write frame metadata",
+				zap.String("camera", f.CameraID),
+				zap.String("path", filename),
+				zap.Error(err))
+		}
+	}
+	f.Path = filename
+	return nil
+}
 
-	// Verify JPEG format
-	if _, err := jpeg.DecodeConfig(bytes.NewReader(frameData)); err != nil {
-		result.Error = fmt.Errorf("invalid JPEG format: %w", err)
-		return result
+// putFrame writes a frame's file through the frame storage.
+func (fp *FrameProcessor) putFrame(path string, data []byte) error {
+	key, err := fp.frameKey(path)
+	if err != nil {
+		return err
 	}
+	return fp.frames.Put(context.Background(), key, bytes.NewReader(data), int64(len(data)))
+}
 
-	// Create filename with proper frame number
-	filename := filepath.Join(cameraDir,
-		fmt.Sprintf("frame_%05d_%s.jpg",
-			frame.Number,
-			frame.Timestamp.Format("20060102_150405.000")))
+// getFrame opens a frame's file through the frame storage.
+func (fp *FrameProcessor) getFrame(path string) (io.ReadCloser, error) {
+	key, err := fp.frameKey(path)
+	if err != nil {
+		return nil, err
+	}
+	f, _, err := fp.frames.Get(context.Background(), key)
+	return f, err
+}
 
-	// Save the frame
-	if err := os.WriteFile(filename, frameData, 0644); err != nil {
-		result.Error = fmt.Errorf("failed to write frame file: %w", err)
-		return result
+// frameKey returns the storage key of a frame's file, its path relative to
+// the output directory.
+func (fp *FrameProcessor) frameKey(path string) (string, error) {
+	rel, err := filepath.Rel(fp.config.OutputDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the output directory", path)
 	}
+	return filepath.ToSlash(rel), nil
+}
 
-	result.FilePath = filename
-	result.Duration = time.Since(startTime)
+// indexFrame is the built-in stage of PhaseIndex.
+func (fp *FrameProcessor) indexFrame(f *Frame) error {
+	fp.metrics.RecordFrameProcessed(time.Since(f.started))
+	fp.mu.Lock()
+	fp.frameCount[f.CameraID]++
+	count := fp.frameCount[f.CameraID]
+	fp.mu.Unlock()
 
-	return result
+	// Mark the camera as having frames to consolidate
+	fp.processingMap.Store(f.CameraID, time.Now())
+	fp.backlog.added(f.CameraID, f.Timestamp)
+
+	if fp.config.VideoPipe && fp.config.VideoConsolidation {
+		fp.encodeFrame(f.FrameData, f.Path)
+	}
+
+	for _, fn := range fp.onFrame {
+		fn(f.FrameData)
+	}
+
+	fp.logger.Debug("Frame processed successfully",
+		zap.String("camera", f.CameraID),
+		zap.Uint64("frame", f.Number),
+		zap.Duration("processing_time", time.Since(f.started)))
+
+	if count%30 == 0 {
+		select {
+		case fp.consolidateChan <- struct{}{}:
+			fp.logger.Debug("Triggered frame consolidation",
+				zap.String("camera", f.CameraID),
+				zap.Uint64("frame_count", count))
+		default:
+		}
+	}
+	return nil
+}
+
+// queuedFrame is a frame waiting for a worker.
+type queuedFrame struct {
+	frame    FrameData
+	queuedAt time.Time
+}
+
+// worker returns the worker handling a camera's frames.
+func (fp *FrameProcessor) worker(cameraID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(cameraID))
+	return int(h.Sum32() % uint32(len(fp.queues)))
+}
+
+// Metrics returns the processor's totals.
+func (fp *FrameProcessor) Metrics() ProcessorMetrics {
+	return fp.metrics.Snapshot()
+}
+
+// QueueLoad returns how full the queue of a camera's worker is, from 0 for
+// empty to 1 for full, when frames are dropped.
+func (fp *FrameProcessor) QueueLoad(cameraID string) float64 {
+	q := fp.queues[fp.worker(cameraID)]
+	return float64(len(q)) / float64(cap(q))
 }
 
-// ProcessFrame with improved error handling
+// QueueDepth returns how many frames wait in the workers' queues, and how
+// many they hold.
+func (fp *FrameProcessor) QueueDepth() (queued, capacity int) {
+	for _, q := range fp.queues {
+		queued += len(q)
+		capacity += cap(q)
+	}
+	return queued, capacity
+}
+
+// ProcessFrame queues a frame to be stored by the worker of its camera. It
+// takes over the frame's buffer, also when the frame is rejected.
 func (fp *FrameProcessor) ProcessFrame(frame FrameData) error {
 	if frame.CameraID == "" || frame.Number == 0 || len(frame.Data) == 0 {
+		frame.Release()
 		return fmt.Errorf("invalid frame data")
 	}
 
+	w := fp.worker(frame.CameraID)
 	select {
-	case fp.frameChan <- frame:
+	case fp.queues[w] <- queuedFrame{frame: frame, queuedAt: time.Now()}:
+		fp.queueLengths[w].Set(float64(len(fp.queues[w])))
 		fp.logger.Debug("Queued frame for processing",
 			zap.String("camera", frame.CameraID),
-			zap.Uint64("frame", frame.Number))
+			zap.Uint64("frame", frame.Number),
+			zap.Int("worker", w))
 		return nil
 	default:
+		fp.queueMetrics.Dropped.WithLabelValues(frame.CameraID).Inc()
+		frame.Release()
 		return fmt.Errorf("frame processing queue full")
 	}
 }
 
-// consolidateFrames with better control flow
-func (fp *FrameProcessor) consolidateFrames() error {
+// consolidateFrames turns full batches of not yet consolidated frames into
+// videos. With force set the trailing partial batch is included too, which
+// is used when flushing and on shutdown.
+func (fp *FrameProcessor) consolidateFrames(force bool) error {
 	fp.mu.Lock()
 	defer fp.mu.Unlock()
 
@@ -221,32 +606,52 @@ func (fp *FrameProcessor) consolidateFrames() error {
 	if !fp.config.VideoConsolidation {
 		return nil
 	}
+	if fp.config.VideoPipe {
+		fp.closeSegments(force)
+		return nil
+	}
 
 	var processedCameras []string
 	fp.processingMap.Range(func(key, value interface{}) bool {
 		cameraID := key.(string)
-		cameraDir := filepath.Join(fp.config.OutputDir, cameraID)
 
-		// Get frames for this camera
-		frames, err := filepath.Glob(filepath.Join(cameraDir, "frame_*.jpg"))
+		// Get frames for this camera. Dated directories from before the
+		// last consolidated frame only hold frames that are done.
+		frames, err := fp.store.Frames(cameraID, fp.consolidatedAt[cameraID])
 		if err != nil {
-			fp.logger.Error("Failed to glob frames",
+			fp.logger.Error("Failed to list frames",
 				zap.String("camera", cameraID),
 				zap.Error(err))
 			return true
 		}
 
-		// Skip if not enough frames
-		if len(frames) < fp.config.MaxFrames {
-			return true
+		// Only frames newer than the last consolidated batch are pending
+		last := fp.consolidated[cameraID]
+		pending := frames[:0]
+		for _, frame := range frames {
+			if fp.frameNumber(frame) > last {
+				pending = append(pending, frame)
+			}
 		}
+		frames = pending
 
 		// Sort frames by number
 		sort.Slice(frames, func(i, j int) bool {
-			numI := extractFrameNumber(frames[i])
-			numJ := extractFrameNumber(frames[j])
+			numI := fp.frameNumber(frames[i])
+			numJ := fp.frameNumber(frames[j])
 			return numI < numJ
 		})
+		fp.pending(cameraID, frames)
+
+		if fp.config.SegmentDuration > 0 {
+			fp.consolidateSegments(cameraID, frames, force)
+			return true
+		}
+
+		// Skip if not enough frames
+		if len(frames) == 0 || (len(frames) < fp.config.MaxFrames && !force) {
+			return true
+		}
 
 		processedCameras = append(processedCameras, cameraID)
 
@@ -254,15 +659,24 @@ func (fp *FrameProcessor) consolidateFrames() error {
 		for i := 0; i < len(frames); i += fp.config.MaxFrames {
 			end := i + fp.config.MaxFrames
 			if end > len(frames) {
+				if !force {
+					break
+				}
 				end = len(frames)
 			}
 
 			batch := frames[i:end]
-			if err := fp.processFrameBatch(cameraID, batch); err != nil {
+			err := fp.processFrameBatch(cameraID, batch, time.Now())
+			fp.backlog.consolidated(cameraID, len(batch), err)
+			if err != nil {
 				fp.logger.Error("Failed to process frame batch",
 					zap.String("camera", cameraID),
 					zap.Error(err))
+				break
 			}
+			fp.consolidated[cameraID] = fp.frameNumber(batch[len(batch)-1])
+			fp.consolidatedAt[cameraID] = fp.frameTime(batch[len(batch)-1])
+			fp.pending(cameraID, frames[end:])
 		}
 
 		return true
@@ -271,30 +685,124 @@ func (fp *FrameProcessor) consolidateFrames() error {
 	return nil
 }
 
-// New helper function to process frame batches
-func (fp *FrameProcessor) processFrameBatch(cameraID string, frames []string) error {
-	if len(frames) == 0 {
-		return nil
+// Consolidate makes videos of a camera's stored frames, in the order
+// given, whether or not they were consolidated before: a video per span of
+// SegmentDuration if set, or else per MaxFrames frames. It is for frames
+// replayed from storage, so it doesn't need Start. The videos go to the
+// OnVideoCreated hooks; it returns how many were made.
+func (fp *FrameProcessor) Consolidate(cameraID string, frames []string) (int, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	videos := 0
+	for len(frames) > 0 {
+		n, at := min(len(frames), max(fp.config.MaxFrames, 1)), time.Now()
+		if fp.config.SegmentDuration > 0 {
+			at = fp.segmentStart(fp.frameTime(frames[0]))
+			end := at.Add(fp.config.SegmentDuration)
+			n = 1
+			for n < len(frames) && fp.frameTime(frames[n]).Before(end) {
+				n++
+			}
+		}
+		if err := fp.processFrameBatch(cameraID, frames[:n], at); err != nil {
+			return videos, err
+		}
+		videos++
+		frames = frames[n:]
 	}
+	return videos, nil
+}
 
-	videoDir := filepath.Join(fp.config.OutputDir, "videos")
-	if err := os.MkdirAll(videoDir, 0755); err != nil {
-		return fmt.Errorf("failed to create video directory: %w", err)
+// segmentGrace is how long the video of a span of SegmentDuration waits
+// after the span for frames still queued.
+const segmentGrace = 5 * time.Second
+
+// consolidateSegments turns a camera's pending frames, sorted by number,
+// into one video per span of SegmentDuration. The last span is only
+// consolidated once segmentGrace has passed since it ended, for frames
+// still queued, or with force.
+func (fp *FrameProcessor) consolidateSegments(cameraID string, frames []string, force bool) {
+	now := time.Now()
+	for len(frames) > 0 {
+		start := fp.segmentStart(fp.frameTime(frames[0]))
+		end := start.Add(fp.config.SegmentDuration)
+		n := 1
+		for n < len(frames) && fp.frameTime(frames[n]).Before(end) {
+			n++
+		}
+		if n == len(frames) && !force && now.Before(end.Add(segmentGrace)) {
+			return
+		}
+
+		batch := frames[:n]
+		err := fp.processFrameBatch(cameraID, batch, start)
+		fp.backlog.consolidated(cameraID, len(batch), err)
+		if err != nil {
+			fp.logger.Error("Failed to process frame segment",
+				zap.String("camera", cameraID),
+				zap.Time("segment", start),
+				zap.Error(err))
+			return
+		}
+		fp.consolidated[cameraID] = fp.frameNumber(batch[n-1])
+		fp.consolidatedAt[cameraID] = fp.frameTime(batch[n-1])
+		frames = frames[n:]
+		fp.pending(cameraID, frames)
 	}
+}
 
-	videoPath := filepath.Join(videoDir,
-		fmt.Sprintf("%s_%s.mp4",
-			cameraID,
-			time.Now().Format("20060102_150405")))
+// segmentStart returns the start of the span of SegmentDuration holding
+// capture time t, counting from local midnight.
+func (fp *FrameProcessor) segmentStart(t time.Time) time.Time {
+	t = t.Local()
+	y, m, d := t.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+	return midnight.Add(t.Sub(midnight) / fp.config.SegmentDuration * fp.config.SegmentDuration)
+}
 
+// processFrameBatch makes a video of frames, named after at.
+func (fp *FrameProcessor) processFrameBatch(cameraID string, frames []string, at time.Time) error {
+	if len(frames) == 0 {
+		return nil
+	}
+
+	videoPath, err := fp.videoPath(cameraID, uint64(fp.frameNumber(frames[0])), at)
+	if err != nil {
+		return err
+	}
 	if err := fp.createVideo(frames, videoPath); err != nil {
 		return fmt.Errorf("failed to create video: %w", err)
 	}
+	fp.metrics.RecordVideoGenerated()
+
+	// Thumbnails are a convenience for dashboards, so the video stands
+	// without them
+	if err := thumbnail.Write(frames, videoPath); err != nil {
+		fp.logger.Warn("Failed to create video thumbnail",
+			zap.String("video", videoPath),
+			zap.Error(err))
+	}
+
+	video := Video{
+		CameraID:   cameraID,
+		Path:       videoPath,
+		StartTime:  fp.frameTime(frames[0]),
+		EndTime:    fp.frameTime(frames[len(frames)-1]),
+		FrameCount: len(frames),
+		Codec:      fp.videoEncoder().Name,
+	}
+	if info, err := os.Stat(videoPath); err == nil {
+		video.SizeBytes = info.Size()
+	}
+	for _, fn := range fp.onVideo {
+		fn(video)
+	}
 
 	// Clean up processed frames if configured
 	if fp.config.DeleteOriginals {
 		for _, frame := range frames {
-			if err := os.Remove(frame); err != nil {
+			if err := fp.store.Remove(frame); err != nil {
 				fp.logger.Warn("Failed to delete frame",
 					zap.String("frame", frame),
 					zap.Error(err))
@@ -305,50 +813,67 @@ func (fp *FrameProcessor) processFrameBatch(cameraID string, frames []string) er
 	return nil
 }
 
-func (fp *FrameProcessor) processFrames(ctx context.Context) {
-	fp.logger.Info("Starting frame processing routine")
+// processFrames saves the frames queued for worker w.
+func (fp *FrameProcessor) processFrames(ctx context.Context, w int) {
+	fp.logger.Info("Starting frame processing routine", zap.Int("worker", w))
 
+	queue := fp.queues[w]
 	for {
 		select {
 		case <-ctx.Done():
-			fp.logger.Info("Stopping frame processing routine")
+			fp.logger.Info("Stopping frame processing routine", zap.Int("worker", w))
 			return
-		case frame := <-fp.frameChan:
+		case queued := <-queue:
+			fp.queueLengths[w].Set(float64(len(queue)))
+			frame := queued.frame
 			processStart := time.Now()
+			fp.queueMetrics.Wait.Observe(processStart.Sub(queued.queuedAt).Seconds())
+			fp.queueMetrics.Busy.Inc()
 			result := fp.saveFrame(frame)
 
-			if result.Error != nil {
+			switch {
+			case errors.Is(result.Error, ErrDropFrame):
+				// Dropped by a stage on purpose
+			case errors.Is(result.Error, errOverResolution):
+				// Refused by policy rather than failed; logged once
+				if _, logged := fp.overResolution.LoadOrStore(frame.CameraID, true); !logged {
+					fp.logger.Warn("Camera exceeds its resolution limit, dropping frames",
+						zap.String("camera", frame.CameraID),
+						zap.Error(result.Error))
+				}
+				fp.backlog.failed(frame.CameraID)
+			case result.Error != nil:
 				fp.logger.Error("Failed to save frame",
 					zap.String("started_at", processStart.Format(time.RFC3339)),
 					zap.String("camera", frame.CameraID),
 					zap.Uint64("frame", frame.Number),
 					zap.Error(result.Error))
 				fp.metrics.RecordError()
-			} else {
-				fp.mu.Lock()
-				fp.frameCount[frame.CameraID]++
-				count := fp.frameCount[frame.CameraID]
-				fp.mu.Unlock()
-
-				fp.logger.Debug("Frame processed successfully",
-					zap.String("camera", frame.CameraID),
-					zap.Uint64("frame", frame.Number),
-					zap.Duration("processing_time", result.Duration))
-
-				if count%30 == 0 {
-					select {
-					case fp.consolidateChan <- struct{}{}:
-						fp.logger.Debug("Triggered frame consolidation",
-							zap.String("camera", frame.CameraID),
-							zap.Uint64("frame_count", count))
-					default:
-					}
-				}
+				fp.backlog.failed(frame.CameraID)
+				fp.deadLetter(frame, result.Error)
 			}
+			frame.Release()
+			fp.queueMetrics.Busy.Dec()
 		}
 	}
 }
 
+// deadLetter keeps a frame that failed to be stored, if dead letters are
+// kept.
+func (fp *FrameProcessor) deadLetter(frame FrameData, cause error) {
+	if fp.deadLetters == nil {
+		return
+	}
+	if _, err := fp.deadLetters.Add(frame, cause); err != nil {
+		fp.logger.Warn("Failed to keep dead letter",
+			zap.String("camera", frame.CameraID),
+			zap.Uint64("frame", frame.Number),
+			zap.Error(err))
+		return
+	}
+	fp.deadLettered.Frames.Inc()
+}
+
 func (fp *FrameProcessor) createVideo(frames []string, outputPath string) error {
 	if len(frames) == 0 {
 		return fmt.Errorf("no frames to process")
@@ -358,9 +883,12 @@ func (fp *FrameProcessor) createVideo(frames []string, outputPath string) error
 	if _, err := exec.LookPath("ffmpeg"); err != nil {
 		return fmt.Errorf("ffmpeg not found in system PATH: %w", err)
 	}
+	if err := fp.config.Chaos.FailFFmpeg(); err != nil {
+		return err
+	}
 
 	// Get the camera directory and ensure video directory exists
-	cameraDir := filepath.Dir(frames[0])
+	cameraDir := fp.store.CameraDir(fp.store.CameraID(frames[0]))
 	videoDir := filepath.Dir(outputPath)
 	if err := os.MkdirAll(videoDir, 0755); err != nil {
 		return fmt.Errorf("failed to create video directory: %w", err)
@@ -372,35 +900,29 @@ func (fp *FrameProcessor) createVideo(frames []string, outputPath string) error
 
 	// Sort frames by frame number
 	sort.Slice(frames, func(i, j int) bool {
-		numI := extractFrameNumber(frames[i])
-		numJ := extractFrameNumber(frames[j])
+		numI := fp.frameNumber(frames[i])
+		numJ := fp.frameNumber(frames[j])
 		return numI < numJ
 	})
 
 	// Create frame list content with absolute paths and proper escaping
 	var frameList strings.Builder
 	for _, frame := range frames {
-		absPath, err := filepath.Abs(frame)
+		entry, err := pathutil.ConcatEntry(frame)
 		if err != nil {
-			return fmt.Errorf("failed to get absolute path: %w", err)
+			return err
 		}
-		// Convert to forward slashes and escape for FFmpeg
-		framePath := strings.ReplaceAll(absPath, "\\", "/")
-		// Escape single quotes in path
-		framePath = strings.ReplaceAll(framePath, "'", "'\\''")
-		frameList.WriteString(fmt.Sprintf("file '%s'\n", framePath))
+		frameList.WriteString(entry + "\n")
 		frameList.WriteString("duration 0.0333333333\n") // 30fps
 	}
 
 	// Add last frame one more time (required for duration of last frame)
 	if len(frames) > 0 {
-		absPath, err := filepath.Abs(frames[len(frames)-1])
+		entry, err := pathutil.ConcatEntry(frames[len(frames)-1])
 		if err != nil {
-			return fmt.Errorf("failed to get absolute path for last frame: %w", err)
+			return fmt.Errorf("failed to add last frame: %w", err)
 		}
-		framePath := strings.ReplaceAll(absPath, "\\", "/")
-		framePath = strings.ReplaceAll(framePath, "'", "'\\''")
-		frameList.WriteString(fmt.Sprintf("file '%s'\n", framePath))
+		frameList.WriteString(entry + "\n")
 	}
 
 	// Write the list file
@@ -413,23 +935,30 @@ func (fp *FrameProcessor) createVideo(frames []string, outputPath string) error
 		zap.String("first_frame", frames[0]),
 		zap.String("output", outputPath))
 
-	// Convert paths to use forward slashes for FFmpeg
-	outputPathFFmpeg := strings.ReplaceAll(outputPath, "\\", "/")
-	tempListFileFFmpeg := strings.ReplaceAll(tempListFile, "\\", "/")
+	outputPathFFmpeg, err := pathutil.FFmpeg(outputPath)
+	if err != nil {
+		return err
+	}
+	tempListFileFFmpeg, err := pathutil.FFmpeg(tempListFile)
+	if err != nil {
+		return err
+	}
 
 	// Prepare FFmpeg command
-	args := []string{
-		"-y",           // Overwrite output file
+	enc := fp.videoEncoder()
+	args := []string{"-y"} // Overwrite output file
+	args = append(args, enc.InputArgs()...)
+	args = append(args,
 		"-f", "concat", // Use concat demuxer
 		"-safe", "0", // Allow absolute paths
 		"-i", tempListFileFFmpeg, // Input from list file
-		"-vcodec", "libx264", // Use H.264 codec
-		"-preset", "medium", // Balanced encoding speed/quality
-		"-crf", "23", // Quality factor
-		"-pix_fmt", "yuv420p", // Standard pixel format
+	)
+	args = append(args, enc.FilterArgs(fp.scaleFilter(frames))...)
+	args = append(args, enc.Args(0)...)
+	args = append(args,
 		"-movflags", "+faststart", // Enable fast start
 		outputPathFFmpeg, // Output file
-	}
+	)
 
 	// Create command
 	cmd := exec.Command("ffmpeg", args...)
@@ -468,25 +997,152 @@ func (fp *FrameProcessor) createVideo(frames []string, outputPath string) error
 	return nil
 }
 
-// extractFrameNumber gets the frame number from a filename like frame_00001_20241220_001507.773.jpg
-func extractFrameNumber(filename string) int {
-	base := filepath.Base(filename)
-	// Handle frame_XXXXX_YYYYMMDD_HHMMSS.mmm.jpg format
-	parts := strings.Split(base, "_")
-	if len(parts) >= 2 {
-		numStr := parts[1]
-		if num, err := strconv.Atoi(numStr); err == nil {
-			return num
+// scaleFilter returns the FFmpeg filter fitting every frame into one size,
+// scaled with its aspect ratio kept and letterboxed: an H.264 stream can't
+// change resolution part way, and yuv420p needs even dimensions. Copied
+// MJPEG keeps the frames as they are.
+func (fp *FrameProcessor) scaleFilter(frames []string) string {
+	if fp.config.VideoCodec == videocodec.Copy {
+		return ""
+	}
+	width, height := fp.config.VideoWidth, fp.config.VideoHeight
+	if width == 0 || height == 0 {
+		width, height = fp.largestFrame(frames)
+		if width == 0 {
+			// Nothing readable; FFmpeg will report why
+			return ""
 		}
+		width, height = width+width%2, height+height%2
+	}
+	return fitFilter(width, height)
+}
+
+// fitFilter returns the FFmpeg filter scaling and letterboxing frames to
+// width by height.
+func fitFilter(width, height int) string {
+	return fmt.Sprintf(
+		"scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1",
+		width, height, width, height)
+}
+
+// largestFrame returns the largest width and height among frames, which
+// may come from different frames. Only the JPEG headers are read; frames
+// that can't be are skipped.
+func (fp *FrameProcessor) largestFrame(frames []string) (width, height int) {
+	for _, path := range frames {
+		f, err := fp.getFrame(path)
+		if err != nil {
+			continue
+		}
+		cfg, err := jpeg.DecodeConfig(bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			continue
+		}
+		width = max(width, cfg.Width)
+		height = max(height, cfg.Height)
+	}
+	return width, height
+}
+
+// videoEncoder returns the encoder for videos, choosing it the first time.
+func (fp *FrameProcessor) videoEncoder() videocodec.Encoder {
+	fp.encoderOnce.Do(func() {
+		fp.encoder = videocodec.Select(fp.encoderOptions(), fp.logger)
+	})
+	return fp.encoder
+}
+
+// Encoder returns the encoder videos are made with, unless it is still
+// being probed.
+func (fp *FrameProcessor) Encoder() (videocodec.Encoder, bool) {
+	return videocodec.Selected(fp.encoderOptions())
+}
+
+func (fp *FrameProcessor) encoderOptions() videocodec.Options {
+	return videocodec.Options{
+		Codec:   fp.config.VideoCodec,
+		HWAccel: fp.config.VideoHWAccel,
+		Device:  fp.config.VideoDevice,
+		Bitrate: fp.config.VideoBitrate,
+	}
+}
+
+// frameNumber gets the frame number from a frame's file name.
+func (fp *FrameProcessor) frameNumber(filename string) int {
+	n, _, _ := fp.store.ParseName(filepath.Base(filename))
+	return int(n)
+}
+
+// frameTime gets the capture time from a frame's file name. The name
+// carries no zone, so it is interpreted as local time.
+func (fp *FrameProcessor) frameTime(filename string) time.Time {
+	_, t, _ := fp.store.ParseName(filepath.Base(filename))
+	return t
+}
+
+// pending updates the backlog with a camera's frames left to consolidate,
+// sorted by number.
+func (fp *FrameProcessor) pending(cameraID string, frames []string) {
+	var oldest time.Time
+	if len(frames) > 0 {
+		oldest = fp.frameTime(frames[0])
+	}
+	fp.backlog.pending(cameraID, len(frames), oldest)
+}
+
+// videoPath names a new video of a camera starting with frame number
+// first, at time at, creating the video directory. A name already taken,
+// such as by the first part of a segment cut short by a restart, gets a
+// numbered suffix.
+func (fp *FrameProcessor) videoPath(cameraID string, first uint64, at time.Time) (string, error) {
+	videoDir := filepath.Join(fp.config.OutputDir, "videos")
+	if err := os.MkdirAll(videoDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create video directory: %w", err)
+	}
+	name, err := fp.videoName.Name(naming.Fields{
+		Camera: cameraID,
+		Site:   fp.config.Site,
+		Seq:    first,
+		Time:   at,
+	})
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(videoDir, name+".mp4")
+	for n := 2; taken(path); n++ {
+		path = filepath.Join(videoDir, fmt.Sprintf("%s_%d.mp4", name, n))
+	}
+	return path, nil
+}
+
+// taken reports whether a video, finished or being piped, is at path.
+func taken(path string) bool {
+	for _, p := range []string{path, path + partSuffix} {
+		if _, err := os.Stat(p); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// SetVideoInterval changes how often frames are consolidated into videos.
+func (fp *FrameProcessor) SetVideoInterval(d time.Duration) {
+	if d <= 0 || time.Duration(fp.videoInterval.Swap(int64(d))) == d {
+		return
+	}
+	select {
+	case fp.intervalChanged <- struct{}{}:
+	default:
 	}
-	return 0
 }
 
 func (fp *FrameProcessor) consolidationRoutine(ctx context.Context) {
+	interval := time.Duration(fp.videoInterval.Load())
 	fp.logger.Info("Starting consolidation routine",
-		zap.Duration("interval", fp.config.VideoInterval))
+		zap.Duration("interval", interval))
 
-	ticker := time.NewTicker(fp.config.VideoInterval)
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
@@ -496,59 +1152,93 @@ func (fp *FrameProcessor) consolidationRoutine(ctx context.Context) {
 			return
 		case <-fp.consolidateChan:
 			fp.logger.Debug("Received immediate consolidation signal")
-			if err := fp.consolidateFrames(); err != nil {
+			if err := fp.consolidateFrames(false); err != nil {
 				fp.logger.Error("Consolidation failed",
 					zap.Error(err),
 					zap.Time("timestamp", time.Now()),
-					zap.Duration("interval", fp.config.VideoInterval))
+					zap.Duration("interval", interval))
 			}
+		case <-fp.intervalChanged:
+			interval = time.Duration(fp.videoInterval.Load())
+			ticker.Reset(interval)
+			fp.logger.Info("Consolidation interval changed", zap.Duration("interval", interval))
 		case <-ticker.C:
 			fp.logger.Debug("Running scheduled consolidation",
 				zap.Time("timestamp", time.Now()),
-				zap.Duration("interval", fp.config.VideoInterval))
-			if err := fp.consolidateFrames(); err != nil {
+				zap.Duration("interval", interval))
+			if err := fp.consolidateFrames(false); err != nil {
 				fp.logger.Error("Scheduled consolidation failed",
 					zap.Error(err),
 					zap.Time("timestamp", time.Now()),
-					zap.Duration("interval", fp.config.VideoInterval))
+					zap.Duration("interval", interval))
 			}
 		}
 	}
 }
 
-func isBase64(data []byte) bool {
-	_, err := base64.StdEncoding.DecodeString(string(data))
-	return err == nil && len(data) > 0 && len(data)%4 == 0
-}
-
 func (fp *FrameProcessor) Start(ctx context.Context) error {
 	// test ffmpeg
 	if err := fp.testFFmpeg(); err != nil {
 		return fmt.Errorf("FFmpeg validation failed: %w", err)
 	}
+	fp.logger.Info("Frame pipeline", zap.Strings("stages", fp.pipeline.names()))
 	//quit if logger is not initialized
 	if fp.logger == nil {
 		return fmt.Errorf("logger not initialized")
 	}
 
-	// Start frame processing goroutine
-	go fp.processFrames(ctx)
+	if fp.config.VideoPipe {
+		fp.removeParts()
+	}
+
+	// Start frame processing workers
+	for w := range fp.queues {
+		go fp.processFrames(ctx, w)
+	}
 
 	// Start consolidation goroutine
 	go fp.consolidationRoutine(ctx)
 
 	fp.logger.Info("Frame processor started successfully",
 		zap.Int("max_frames", fp.config.MaxFrames),
-		zap.Duration("video_interval", fp.config.VideoInterval),
+		zap.Int("workers", len(fp.queues)),
+		zap.Duration("video_interval", time.Duration(fp.videoInterval.Load())),
 		zap.String("output_dir", fp.config.OutputDir))
 
 	return nil
 }
 
+// OnVideoCreated registers fn to be called after each consolidated video is
+// written. Register hooks before Start.
+func (fp *FrameProcessor) OnVideoCreated(fn func(Video)) {
+	fp.onVideo = append(fp.onVideo, fn)
+}
+
+// AddStage adds a stage to the pipeline frames are saved through, after
+// those of its phase already there. Add stages before Start.
+func (fp *FrameProcessor) AddStage(stage Stage) error {
+	return fp.pipeline.add(stage, nil, false)
+}
+
+// OnFrameSaved registers fn to be called with each frame once it is stored.
+// Hooks run on the worker goroutines, so they are called for different
+// cameras at the same time, and must not block. Data may be
+// recycled after the call, so hooks that keep it must copy it. Register
+// hooks before Start.
+func (fp *FrameProcessor) OnFrameSaved(fn func(FrameData)) {
+	fp.onFrame = append(fp.onFrame, fn)
+}
+
+// Flush consolidates whatever frames are pending without waiting for the
+// next scheduled run.
+func (fp *FrameProcessor) Flush() error {
+	return fp.consolidateFrames(true)
+}
+
 func (fp *FrameProcessor) cleanup() error {
 	fp.logger.Info("Running final cleanup...")
 
-	return fp.consolidateFrames()
+	return fp.consolidateFrames(true)
 }
 
 // Update the Stop function
@@ -561,7 +1251,9 @@ func (fp *FrameProcessor) Stop() {
 		fp.logger.Error("Cleanup failed", zap.Error(err))
 	}
 
-	close(fp.frameChan)
+	for _, q := range fp.queues {
+		close(q)
+	}
 	close(fp.consolidateChan)
 
 	fp.logger.Info("Frame processor stopped",
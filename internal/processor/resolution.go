@@ -0,0 +1,83 @@
+package processor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"slices"
+
+	"github.com/raeeceip/cctv/internal/codec"
+	xdraw "golang.org/x/image/draw"
+)
+
+// encodeQuality is the JPEG quality frames the processor re-encodes, those
+// downscaled or sent as WebP, are stored at.
+const encodeQuality = 90
+
+// errOverResolution is the error of frames dropped for their size.
+var errOverResolution = errors.New("frame exceeds the camera's resolution limit")
+
+// ResolutionLimit is the largest frame some cameras may send, all of them
+// when Cameras is empty. Zero is no limit.
+type ResolutionLimit struct {
+	Cameras   []string `json:"cameras"`
+	MaxWidth  int      `json:"max_width"`
+	MaxHeight int      `json:"max_height"`
+	// Drop refuses larger frames rather than downscaling them
+	Drop bool `json:"drop"`
+}
+
+// resolutionLimit returns the limit of a camera, the first listing it.
+func (fp *FrameProcessor) resolutionLimit(cameraID string) ResolutionLimit {
+	for _, l := range fp.config.Resolution {
+		if len(l.Cameras) == 0 || slices.Contains(l.Cameras, cameraID) {
+			return l
+		}
+	}
+	return ResolutionLimit{}
+}
+
+// limitResolution holds a camera's frame of size cfg to its limit,
+// returning it downscaled to fit if it is larger, or errOverResolution if
+// such frames are dropped.
+func (fp *FrameProcessor) limitResolution(cameraID string, data []byte, cfg image.Config) ([]byte, error) {
+	limit := fp.resolutionLimit(cameraID)
+	w, h, ok := fit(cfg.Width, cfg.Height, limit.MaxWidth, limit.MaxHeight)
+	if ok {
+		return data, nil
+	}
+	if limit.Drop {
+		fp.resolution.Violations.WithLabelValues("drop").Inc()
+		return nil, fmt.Errorf("%w: %dx%d", errOverResolution, cfg.Width, cfg.Height)
+	}
+	img, err := codec.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode frame to downscale: %w", err)
+	}
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	xdraw.ApproxBiLinear.Scale(out, out.Rect, img, img.Bounds(), xdraw.Src, nil)
+	var buf bytes.Buffer
+	if err := codec.Encode(&buf, out, encodeQuality); err != nil {
+		return nil, fmt.Errorf("failed to encode downscaled frame: %w", err)
+	}
+	fp.resolution.Violations.WithLabelValues("downscale").Inc()
+	return buf.Bytes(), nil
+}
+
+// fit returns the largest size of the shape of w by h within maxW by
+// maxH, even so videos can be encoded from it, and whether w by h already
+// fits.
+func fit(w, h, maxW, maxH int) (int, int, bool) {
+	scale := 1.0
+	if maxW > 0 && w > maxW {
+		scale = float64(maxW) / float64(w)
+	}
+	if maxH > 0 && float64(h)*scale > float64(maxH) {
+		scale = float64(maxH) / float64(h)
+	}
+	if scale == 1 {
+		return w, h, true
+	}
+	return max(2, int(float64(w)*scale)&^1), max(2, int(float64(h)*scale)&^1), false
+}
@@ -0,0 +1,236 @@
+// Package replay feeds a camera's stored frames back through motion
+// detection and video consolidation, e.g. after its motion settings
+// changed or a consolidation failed. It works on the files and the index,
+// so the server needn't be running.
+package replay
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/detect"
+	"github.com/raeeceip/cctv/internal/framemeta"
+	"github.com/raeeceip/cctv/internal/framestore"
+	"github.com/raeeceip/cctv/internal/index"
+	"github.com/raeeceip/cctv/internal/processor"
+	"github.com/raeeceip/cctv/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// Options picks the frames to replay and what to do with them.
+type Options struct {
+	CameraID string
+	From, To time.Time // frames taken from From until before To
+	// Detect runs motion detection over the frames again, replacing the
+	// motion events of the range
+	Detect bool
+	// Consolidate makes videos of the frames that no recording covers
+	Consolidate bool
+	// DryRun counts the frames without changing anything
+	DryRun bool
+}
+
+// Result counts what a replay did.
+type Result struct {
+	Frames         int // in the range
+	MotionEvents   int // found
+	Replaced       int // motion events found before, deleted
+	Unconsolidated int // frames no recording covered
+	Videos         int
+}
+
+// Replayer replays a store's frames.
+type Replayer struct {
+	index     *index.Index
+	store     *framestore.Store
+	detector  *detect.Detector          // nil without detection
+	processor *processor.FrameProcessor // nil without consolidation
+	logger    *logger.Logger
+
+	motionEvents int
+}
+
+// New returns a replayer of the frames in store. The motion events the
+// detector finds are added to the index and to frame sidecars, and the
+// processor's OnVideoCreated hooks get the videos it makes.
+func New(ix *index.Index, store *framestore.Store, detector *detect.Detector, proc *processor.FrameProcessor, log *logger.Logger) *Replayer {
+	r := &Replayer{index: ix, store: store, detector: detector, processor: proc, logger: log}
+	if detector != nil {
+		detector.OnMotion(r.recordMotion)
+	}
+	return r
+}
+
+// Replay replays the frames opts picks.
+func (r *Replayer) Replay(ctx context.Context, opts Options) (Result, error) {
+	var res Result
+	if opts.CameraID == "" {
+		return res, fmt.Errorf("a camera is required")
+	}
+	if !opts.To.After(opts.From) {
+		return res, fmt.Errorf("the range must end after it starts")
+	}
+	if opts.Detect && r.detector == nil {
+		return res, fmt.Errorf("motion detection is not configured")
+	}
+	if opts.Consolidate && r.processor == nil {
+		return res, fmt.Errorf("video consolidation is not configured")
+	}
+
+	frames, err := r.frames(opts)
+	if err != nil {
+		return res, err
+	}
+	res.Frames = len(frames)
+
+	if opts.Detect {
+		if !opts.DryRun {
+			removed, err := r.index.DeleteMotionEvents(ctx, opts.CameraID, opts.From, opts.To)
+			if err != nil {
+				return res, err
+			}
+			res.Replaced = int(removed)
+		}
+		r.motionEvents = 0
+		if err := r.detect(ctx, opts, frames); err != nil {
+			return res, err
+		}
+		res.MotionEvents = r.motionEvents
+	}
+
+	if opts.Consolidate {
+		pending, err := r.unconsolidated(ctx, opts, frames)
+		if err != nil {
+			return res, err
+		}
+		res.Unconsolidated = len(pending)
+		if !opts.DryRun && len(pending) > 0 {
+			paths := make([]string, len(pending))
+			for i, f := range pending {
+				paths[i] = f.path
+			}
+			res.Videos, err = r.processor.Consolidate(opts.CameraID, paths)
+			if err != nil {
+				return res, err
+			}
+		}
+	}
+	return res, nil
+}
+
+// frame is a stored frame.
+type frame struct {
+	path   string
+	number uint64
+	time   time.Time
+}
+
+// frames lists the camera's frames in the range, in the order they were
+// taken.
+func (r *Replayer) frames(opts Options) ([]frame, error) {
+	paths, err := r.store.Frames(opts.CameraID, opts.From)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list frames: %w", err)
+	}
+	var frames []frame
+	for _, path := range paths {
+		n, t, ok := r.store.ParseName(filepath.Base(path))
+		if !ok || t.Before(opts.From) || !t.Before(opts.To) {
+			continue
+		}
+		frames = append(frames, frame{path: path, number: n, time: t})
+	}
+	// Numbers start over when a camera restarts
+	sort.Slice(frames, func(i, j int) bool {
+		if !frames[i].time.Equal(frames[j].time) {
+			return frames[i].time.Before(frames[j].time)
+		}
+		return frames[i].number < frames[j].number
+	})
+	return frames, nil
+}
+
+// detect runs motion detection over the frames, in a dry run only
+// counting what it finds.
+func (r *Replayer) detect(ctx context.Context, opts Options, frames []frame) error {
+	for _, f := range frames {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		data, err := os.ReadFile(f.path)
+		if os.IsNotExist(err) {
+			// Removed by retention since it was listed
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		path := f.path
+		if opts.DryRun {
+			path = ""
+		} else if err := framemeta.ClearDetections(f.path, "motion"); err != nil {
+			return fmt.Errorf("failed to clear frame metadata: %w", err)
+		}
+		r.detector.Detect(ctx, processor.FrameData{
+			CameraID:  opts.CameraID,
+			Data:      data,
+			Timestamp: f.time,
+			Number:    f.number,
+			Path:      path,
+		})
+	}
+	return nil
+}
+
+// recordMotion stores a motion event found in a replayed frame. Frames
+// of a dry run have no path.
+func (r *Replayer) recordMotion(e detect.MotionEvent) {
+	r.motionEvents++
+	if e.Frame == "" {
+		return
+	}
+	stored := index.MotionEvent{CameraID: e.CameraID, Time: e.Time, Box: e.Box, Intensity: e.Intensity, Zone: e.Zone}
+	if err := r.index.AddMotionEvent(context.Background(), &stored); err != nil {
+		r.logger.Error("Failed to index motion event",
+			zap.String("camera", e.CameraID),
+			zap.Error(err))
+	}
+	d := framemeta.Detection{Type: "motion", Box: e.Box, Intensity: e.Intensity, Zone: e.Zone}
+	if err := framemeta.AddDetection(e.Frame, d); err != nil {
+		r.logger.Warn("Failed to add motion to frame metadata",
+			zap.String("camera", e.CameraID),
+			zap.String("path", e.Frame),
+			zap.Error(err))
+	}
+}
+
+// unconsolidated returns the frames that no recording of the camera
+// covers.
+func (r *Replayer) unconsolidated(ctx context.Context, opts Options, frames []frame) ([]frame, error) {
+	recordings, err := r.index.ListRecordings(ctx, index.RecordingQuery{
+		CameraID: opts.CameraID,
+		Since:    opts.From,
+		Until:    opts.To,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var pending []frame
+	for _, f := range frames {
+		covered := false
+		for _, rec := range recordings {
+			if !f.time.Before(rec.StartTime) && !f.time.After(rec.EndTime) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			pending = append(pending, f)
+		}
+	}
+	return pending, nil
+}
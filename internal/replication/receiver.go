@@ -0,0 +1,188 @@
+package replication
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/index"
+	"github.com/raeeceip/cctv/internal/site"
+)
+
+var (
+	// ErrInvalidName is returned for origins and names that aren't plain
+	// file names.
+	ErrInvalidName = errors.New("invalid origin or name")
+	// ErrOffset is returned for a chunk that doesn't continue the upload.
+	ErrOffset = errors.New("upload offset mismatch")
+	// ErrIncomplete is returned when completing an upload that is missing
+	// data.
+	ErrIncomplete = errors.New("upload incomplete")
+	// ErrChecksum is returned when an upload doesn't match its checksum.
+	// The upload is discarded, so the sender starts over.
+	ErrChecksum = errors.New("upload checksum mismatch")
+)
+
+// Receiver stores recordings pushed by other servers, under
+// <output_dir>/replicas/<origin>. Uploads in progress are kept next to
+// them as hidden .part files.
+//
+// A camera receiver takes cameras' own recordings instead, under
+// <output_dir>/uploads/<camera>, with the camera as the origin.
+type Receiver struct {
+	index   *index.Index
+	dir     string
+	cameras bool
+
+	// Uploads are few and sequential per origin; one lock keeps the
+	// offset checks simple
+	mu sync.Mutex
+}
+
+// NewReceiver returns a receiver storing replicas below outputDir.
+func NewReceiver(ix *index.Index, outputDir string) *Receiver {
+	return &Receiver{index: ix, dir: filepath.Join(outputDir, "replicas")}
+}
+
+// NewCameraReceiver returns a receiver storing cameras' uploads below
+// outputDir.
+func NewCameraReceiver(ix *index.Index, outputDir string) *Receiver {
+	return &Receiver{index: ix, dir: filepath.Join(outputDir, "uploads"), cameras: true}
+}
+
+// Offset returns how much of an upload the receiver holds.
+func (rv *Receiver) Offset(origin, name string) (int64, error) {
+	part, _, err := rv.paths(origin, name)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(part)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Append writes a chunk of an upload at offset and returns the new offset.
+// Offset zero starts the upload over. Any other offset must be the current
+// one, or ErrOffset is returned along with it. If the chunk is cut short,
+// what arrived is kept and the upload resumes from there.
+func (rv *Receiver) Append(origin, name string, offset int64, chunk io.Reader) (int64, error) {
+	part, _, err := rv.paths(origin, name)
+	if err != nil {
+		return 0, err
+	}
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(part), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create replica directory: %w", err)
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open upload: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() != offset {
+		return info.Size(), ErrOffset
+	}
+	n, err := io.Copy(f, chunk)
+	if err != nil {
+		return offset + n, fmt.Errorf("failed to write upload: %w", err)
+	}
+	return offset + n, nil
+}
+
+// Complete checks a finished upload against its size and checksum, moves it
+// into place and indexes it as a replica. Completing the same recording
+// again replaces it.
+func (rv *Receiver) Complete(ctx context.Context, c Completion) (*index.Recording, error) {
+	part, path, err := rv.paths(c.Origin, c.Name)
+	if err != nil {
+		return nil, err
+	}
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+
+	f, err := os.Open(part)
+	if os.IsNotExist(err) {
+		return nil, ErrIncomplete
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload: %w", err)
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload: %w", err)
+	}
+	if size < c.Size {
+		return nil, ErrIncomplete
+	}
+	if size != c.Size || !strings.EqualFold(hex.EncodeToString(h.Sum(nil)), c.SHA256) {
+		os.Remove(part)
+		return nil, ErrChecksum
+	}
+
+	if err := os.Rename(part, path); err != nil {
+		return nil, fmt.Errorf("failed to store replica: %w", err)
+	}
+
+	// Indexed as new here, keeping what describes the footage. Cameras of
+	// origins without a site are filed under the origin's name; a camera's
+	// uploads are its own, whatever they claim.
+	r := c.Recording
+	r.ID = 0
+	r.CameraID = site.Qualify(c.Origin, r.CameraID)
+	r.Path = path
+	r.SizeBytes = size
+	r.CreatedAt = time.Time{}
+	r.DeletedAt = nil
+	r.TrashPath = ""
+	if rv.cameras {
+		r.CameraID = c.Origin
+		err = rv.index.AddRecording(ctx, &r)
+	} else {
+		err = rv.index.AddReplica(ctx, &r, c.Origin, c.Recording.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// paths returns where an upload is kept while in progress and once done.
+func (rv *Receiver) paths(origin, name string) (part, path string, err error) {
+	if !plainName(origin) || !plainName(name) {
+		return "", "", ErrInvalidName
+	}
+	dir := filepath.Join(rv.dir, origin)
+	return filepath.Join(dir, "."+name+".part"), filepath.Join(dir, name), nil
+}
+
+// plainName reports whether name can be used as a file name as it is.
+func plainName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") &&
+		!strings.ContainsAny(name, `/\:`+"\x00") && filepath.Base(name) == name
+}
@@ -0,0 +1,278 @@
+// Package replication copies recordings to a peer server, giving an
+// off-site copy without shared storage. Each new recording is pushed as a job:
+// its file is uploaded in chunks, resuming from whatever the peer already
+// has, and then its index row is sent along with a checksum the peer checks
+// before indexing it. Recordings received from another server are never
+// pushed on, so two servers can replicate to each other.
+package replication
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/index"
+	"github.com/raeeceip/cctv/internal/jobs"
+	"github.com/raeeceip/cctv/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// KindReplicate is the job kind that pushes one recording.
+const KindReplicate = "replicate"
+
+// OffsetHeader carries the offset of an uploaded chunk.
+const OffsetHeader = "Upload-Offset"
+
+// sweepBatch caps how many missed recordings one pass queues; the rest
+// follow on later passes.
+const sweepBatch = 1000
+
+// requestTimeout bounds each request to the peer, including a chunk upload.
+const requestTimeout = 5 * time.Minute
+
+// Completion is sent once a recording's file is uploaded.
+type Completion struct {
+	Origin    string          `json:"origin"`
+	Name      string          `json:"name"`
+	Size      int64           `json:"size"`
+	SHA256    string          `json:"sha256"`
+	Recording index.Recording `json:"recording"` // as indexed on the origin
+}
+
+type replicatePayload struct {
+	RecordingID int64 `json:"recording_id"`
+}
+
+// Manager pushes recordings to the configured peer.
+type Manager struct {
+	index    *index.Index
+	queue    *jobs.Queue
+	logger   *logger.Logger
+	peer     string
+	token    string
+	origin   string
+	chunk    int64
+	interval time.Duration
+	client   *http.Client
+}
+
+// New creates the manager and registers its job handler on q.
+func New(ix *index.Index, q *jobs.Queue, log *logger.Logger, cfg config.ReplicationConfig) *Manager {
+	m := &Manager{
+		index:    ix,
+		queue:    q,
+		logger:   log,
+		peer:     strings.TrimSuffix(cfg.Peer, "/"),
+		token:    cfg.Token,
+		origin:   cfg.Origin,
+		chunk:    int64(cfg.ChunkMB) << 20,
+		interval: cfg.Interval,
+		client:   &http.Client{Timeout: requestTimeout},
+	}
+	q.Handle(KindReplicate, m.handleReplicate)
+	return m
+}
+
+// Enqueue queues a recording to be pushed.
+func (m *Manager) Enqueue(ctx context.Context, id int64) error {
+	_, err := m.queue.Enqueue(ctx, KindReplicate, fmt.Sprintf("replicate:%d", id),
+		replicatePayload{RecordingID: id})
+	return err
+}
+
+// Run queues the recordings that have not reached the peer at startup and
+// then every interval until ctx is cancelled. This picks up recordings
+// whose jobs ran out of attempts while the peer was unreachable.
+func (m *Manager) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.sweep(ctx); err != nil && ctx.Err() == nil {
+			m.logger.Error("Failed to queue recordings for replication", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Manager) sweep(ctx context.Context) error {
+	pending, err := m.index.UnreplicatedRecordings(ctx, sweepBatch)
+	if err != nil {
+		return err
+	}
+	for _, r := range pending {
+		if err := m.Enqueue(ctx, r.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manager) handleReplicate(ctx context.Context, raw json.RawMessage) error {
+	var p replicatePayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return fmt.Errorf("invalid replicate payload: %w", err)
+	}
+
+	r, err := m.index.GetRecording(ctx, p.RecordingID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Deleted or trashed since it was queued
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if replica, err := m.index.IsReplica(ctx, r.ID); err != nil || replica {
+		return err
+	}
+
+	f, err := os.Open(r.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return fmt.Errorf("failed to read recording: %w", err)
+	}
+	done := Completion{
+		Origin:    m.origin,
+		Name:      fmt.Sprintf("%d_%s", r.ID, filepath.Base(r.Path)),
+		Size:      size,
+		SHA256:    hex.EncodeToString(h.Sum(nil)),
+		Recording: *r,
+	}
+	uploadPath := "/api/v1/replication/uploads/" + url.PathEscape(m.origin) + "/" + url.PathEscape(done.Name)
+
+	offset, err := m.offset(ctx, http.MethodGet, uploadPath, nil, -1)
+	if err != nil {
+		return err
+	}
+	if offset > size {
+		// Left over from a different file
+		offset = 0
+	}
+	resumed := offset
+	for offset < size {
+		n := size - offset
+		if n > m.chunk {
+			n = m.chunk
+		}
+		if offset, err = m.offset(ctx, http.MethodPatch, uploadPath, io.NewSectionReader(f, offset, n), offset); err != nil {
+			return err
+		}
+	}
+
+	body, err := json.Marshal(done)
+	if err != nil {
+		return err
+	}
+	resp, err := m.do(ctx, http.MethodPost, "/api/v1/replication/recordings", bytes.NewReader(body), func(req *http.Request) {
+		req.Header.Set("Content-Type", "application/json")
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if err := m.index.MarkReplicated(ctx, r.ID, time.Now()); err != nil {
+		return err
+	}
+	m.logger.Info("Recording replicated",
+		zap.Int64("recording", r.ID),
+		zap.String("peer", m.peer),
+		zap.Int64("bytes", size-resumed),
+		zap.Int64("resumed_at", resumed))
+	return nil
+}
+
+// offset sends a request for an upload and returns the offset the peer
+// reports. A chunk is sent with its offset unless that is negative; when
+// the peer holds a different amount the upload carries on from there.
+func (m *Manager) offset(ctx context.Context, method, path string, body io.Reader, offset int64) (int64, error) {
+	resp, err := m.do(ctx, method, path, body, func(req *http.Request) {
+		if offset >= 0 {
+			req.Header.Set(OffsetHeader, strconv.FormatInt(offset, 10))
+		}
+	})
+	var conflict *conflictError
+	if errors.As(err, &conflict) {
+		return conflict.offset, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var status struct {
+		Offset int64 `json:"offset"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return 0, fmt.Errorf("invalid response from peer: %w", err)
+	}
+	return status.Offset, nil
+}
+
+// conflictError is the peer refusing a chunk at the wrong offset.
+type conflictError struct {
+	offset int64
+}
+
+func (e *conflictError) Error() string {
+	return fmt.Sprintf("peer expects offset %d", e.offset)
+}
+
+// do sends an authenticated request to the peer. Responses other than 2xx
+// are returned as errors.
+func (m *Manager) do(ctx context.Context, method, path string, body io.Reader, prepare func(*http.Request)) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, m.peer+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if sr, ok := body.(*io.SectionReader); ok {
+		// Sent chunked otherwise
+		req.ContentLength = sr.Size()
+	}
+	req.Header.Set("Authorization", "Bearer "+m.token)
+	prepare(req)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach peer: %w", err)
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var reply struct {
+		Error  string `json:"error"`
+		Offset int64  `json:"offset"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&reply)
+	if resp.StatusCode == http.StatusConflict && method == http.MethodPatch {
+		return nil, &conflictError{offset: reply.Offset}
+	}
+	return nil, fmt.Errorf("peer returned %s: %s", resp.Status, reply.Error)
+}
@@ -0,0 +1,105 @@
+// Package reports rolls the index up into per-camera daily statistics for
+// management reporting: hours recorded, gaps, motion and storage used.
+// Each day is rolled up by a job shortly after it ends, and kept after
+// retention has deleted the recordings it summarizes.
+package reports
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/index"
+	"github.com/raeeceip/cctv/internal/jobs"
+	"github.com/raeeceip/cctv/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// KindRollup is the job kind that rolls up one day.
+const KindRollup = "rollup"
+
+// rollupDelay is how long after midnight the day before is rolled up, so
+// its last recordings have been consolidated and indexed.
+const rollupDelay = 15 * time.Minute
+
+// backfillDays is how many days before today are rolled up on start if
+// they have no statistics, e.g. for nights the server was down.
+const backfillDays = 7
+
+type rollupPayload struct {
+	Day string `json:"day"`
+}
+
+// Manager schedules the rollups.
+type Manager struct {
+	index  *index.Index
+	queue  *jobs.Queue
+	logger *logger.Logger
+}
+
+// New creates the manager and registers its job handler on q.
+func New(ix *index.Index, q *jobs.Queue, log *logger.Logger) *Manager {
+	m := &Manager{index: ix, queue: q, logger: log}
+	q.Handle(KindRollup, m.handleRollup)
+	return m
+}
+
+// Run queues the rollups of the days missing from the last backfillDays,
+// then of each day as it ends, until ctx is cancelled.
+func (m *Manager) Run(ctx context.Context) {
+	today := midnight(time.Now())
+	from := today.AddDate(0, 0, -backfillDays)
+	done, err := m.index.RolledUpDays(ctx, from.Format(index.DayLayout), today.Format(index.DayLayout))
+	if err != nil && ctx.Err() == nil {
+		m.logger.Error("Failed to check daily stats", zap.Error(err))
+	}
+	for day := from; day.Before(today); day = day.AddDate(0, 0, 1) {
+		if !done[day.Format(index.DayLayout)] {
+			m.schedule(ctx, day)
+		}
+	}
+
+	for {
+		next := midnight(time.Now()).AddDate(0, 0, 1).Add(rollupDelay)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			m.schedule(ctx, next.AddDate(0, 0, -1))
+		}
+	}
+}
+
+// schedule queues the rollup of day.
+func (m *Manager) schedule(ctx context.Context, day time.Time) {
+	d := day.Format(index.DayLayout)
+	if _, err := m.queue.Enqueue(ctx, KindRollup, KindRollup+":"+d, rollupPayload{Day: d}); err != nil && ctx.Err() == nil {
+		m.logger.Error("Failed to schedule daily stats rollup", zap.String("day", d), zap.Error(err))
+	}
+}
+
+func (m *Manager) handleRollup(ctx context.Context, raw json.RawMessage) error {
+	var p rollupPayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return fmt.Errorf("invalid rollup payload: %w", err)
+	}
+	day, err := time.ParseInLocation(index.DayLayout, p.Day, time.Local)
+	if err != nil {
+		return fmt.Errorf("invalid rollup day: %w", err)
+	}
+	cameras, err := m.index.RollupDay(ctx, day)
+	if err != nil {
+		return err
+	}
+	m.logger.Info("Rolled up daily stats", zap.String("day", p.Day), zap.Int("cameras", cameras))
+	return nil
+}
+
+// midnight returns the start of t's day in local time.
+func midnight(t time.Time) time.Time {
+	t = t.Local()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
@@ -0,0 +1,292 @@
+package retention
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/framestore"
+	"github.com/raeeceip/cctv/internal/index"
+	"github.com/raeeceip/cctv/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// quotaInterval is how often disk usage is checked against max_disk_usage.
+// A retention pass is too rare for a disk that cameras fill continuously.
+const quotaInterval = time.Minute
+
+// storedFrame is a frame file of a camera.
+type storedFrame struct {
+	cameraID string
+	path     string
+	time     time.Time
+}
+
+// reclaim deletes a file with remove and returns its size, counted as
+// reclaimed for reason. A file that is already gone reclaims nothing, nor
+// does a deduplicated frame that other frames share: the last one to go
+// reclaims its blob, which the next CollectBlobs deletes.
+func (m *Manager) reclaim(path, reason string, remove func(string) error) (int64, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	// More links than the frame and its blob
+	shared := framestore.LinkCount(path, info) > 2
+	if err := remove(path); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if shared {
+		return 0, nil
+	}
+	m.metrics.Reclaimed.WithLabelValues(reason).Add(float64(info.Size()))
+	return info.Size(), nil
+}
+
+// collectBlobs deletes the blobs of deduplicated frames that are gone.
+func (m *Manager) collectBlobs(store *framestore.Store) {
+	freed, err := store.CollectBlobs()
+	if err != nil {
+		m.logger.Warn("Failed to collect frame blobs", zap.Error(err))
+		return
+	}
+	if freed > 0 {
+		m.logger.Debug("Collected frame blobs", zap.Int64("freed", freed))
+	}
+}
+
+// frames lists the stored frames of every camera, oldest first.
+func (m *Manager) frames(store *framestore.Store) ([]storedFrame, error) {
+	entries, err := os.ReadDir(m.outputDir)
+	if err != nil {
+		return nil, err
+	}
+	var frames []storedFrame
+	for _, e := range entries {
+		// Directories other than cameras hold no frames
+		if !e.IsDir() {
+			continue
+		}
+		paths, err := store.Frames(e.Name(), time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			if _, t, ok := store.ParseName(filepath.Base(path)); ok {
+				frames = append(frames, storedFrame{cameraID: e.Name(), path: path, time: t})
+			}
+		}
+	}
+	sort.Slice(frames, func(i, j int) bool { return frames[i].time.Before(frames[j].time) })
+	return frames, nil
+}
+
+// expireRecordings deletes the recordings that ended before cutoff, with
+// their thumbnails, unless they are outside output_dir or still locked.
+func (m *Manager) expireRecordings(ctx context.Context, cutoff, now time.Time) (int, error) {
+	expired, err := m.index.ListRecordings(ctx, index.RecordingQuery{Before: cutoff})
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, r := range expired {
+		if !m.managed(r.Path) || m.locked(r, now) {
+			continue
+		}
+		if _, err := m.reclaim(r.Path, metrics.ReclaimAge, removeRecording); err != nil {
+			m.logger.Warn("Failed to delete expired recording", zap.String("path", r.Path), zap.Error(err))
+			continue
+		}
+		if err := m.index.DeleteRecording(ctx, r.ID); err != nil {
+			return deleted, err
+		}
+		m.removeThumbnails(r)
+		deleted++
+	}
+	return deleted, nil
+}
+
+// pruneFrames deletes the frame files taken before cutoff, whether or not
+// they were consolidated.
+func (m *Manager) pruneFrames(cutoff time.Time) (int, error) {
+	store, err := framestore.New(m.outputDir, m.layout, m.frameName, m.site)
+	if err != nil {
+		return 0, err
+	}
+	frames, err := m.frames(store)
+	if err != nil {
+		return 0, err
+	}
+	pruned := 0
+	for _, f := range frames {
+		if !f.time.Before(cutoff) {
+			break
+		}
+		if _, err := m.reclaim(f.path, metrics.ReclaimAge, store.Remove); err != nil {
+			m.logger.Warn("Failed to delete expired frame", zap.String("path", f.path), zap.Error(err))
+			continue
+		}
+		pruned++
+	}
+	m.collectBlobs(store)
+	return pruned, nil
+}
+
+// diskUsage returns the bytes taken by the files of store. Deduplicated
+// frames are counted once, through their blob.
+func diskUsage(store *framestore.Store) (int64, error) {
+	var used int64
+	err := filepath.WalkDir(store.Root(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Removed while walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			if framestore.LinkCount(path, info) > 1 && !store.IsBlob(path) {
+				return nil
+			}
+			used += info.Size()
+		}
+		return nil
+	})
+	return used, err
+}
+
+// enforceQuota deletes the oldest footage while the output directory
+// holds more than max_disk_usage: the trash first, then recordings and
+// frames in the order they were taken.
+func (m *Manager) enforceQuota(ctx context.Context) error {
+	maxDiskUsage := m.current().maxDiskUsage
+	if maxDiskUsage <= 0 {
+		return nil
+	}
+	store, err := framestore.New(m.outputDir, m.layout, m.frameName, m.site)
+	if err != nil {
+		return err
+	}
+	used, err := diskUsage(store)
+	if err != nil {
+		return err
+	}
+	m.metrics.DiskUsage.Set(float64(used))
+	excess := used - maxDiskUsage
+	if excess <= 0 {
+		return nil
+	}
+
+	var reclaimed int64
+	deleted := 0
+	trashed, err := m.index.ListRecordings(ctx, index.RecordingQuery{Trashed: true})
+	if err != nil {
+		return err
+	}
+	sort.Slice(trashed, func(i, j int) bool { return trashed[i].DeletedAt.Before(*trashed[j].DeletedAt) })
+	for _, r := range trashed {
+		if excess <= 0 {
+			break
+		}
+		var size int64
+		if r.TrashPath != "" {
+			if size, err = m.reclaim(r.TrashPath, metrics.ReclaimQuota, removeRecording); err != nil {
+				m.logger.Warn("Failed to purge trashed recording", zap.String("path", r.TrashPath), zap.Error(err))
+				continue
+			}
+		}
+		if err := m.index.DeleteRecording(ctx, r.ID); err != nil {
+			return err
+		}
+		m.removeThumbnails(r)
+		excess -= size
+		reclaimed += size
+		deleted++
+	}
+
+	live, err := m.index.ListRecordings(ctx, index.RecordingQuery{})
+	if err != nil {
+		return err
+	}
+	var recordings []index.Recording
+	now := time.Now()
+	for i := len(live) - 1; i >= 0; i-- {
+		// Footage within its WORM period stays even over quota
+		if m.managed(live[i].Path) && !m.locked(live[i], now) {
+			recordings = append(recordings, live[i])
+		}
+	}
+	frames, err := m.frames(store)
+	if err != nil {
+		return err
+	}
+
+	// Frames deleted per camera, to drop from the frame index afterwards
+	type span struct{ from, to time.Time }
+	spans := make(map[string]*span)
+	framesDeleted := 0
+	for excess > 0 && (len(recordings) > 0 || len(frames) > 0) {
+		if len(frames) == 0 || (len(recordings) > 0 && recordings[0].StartTime.Before(frames[0].time)) {
+			r := recordings[0]
+			recordings = recordings[1:]
+			size, err := m.reclaim(r.Path, metrics.ReclaimQuota, removeRecording)
+			if err != nil {
+				m.logger.Warn("Failed to delete recording over quota", zap.String("path", r.Path), zap.Error(err))
+				continue
+			}
+			if err := m.index.DeleteRecording(ctx, r.ID); err != nil {
+				return err
+			}
+			m.removeThumbnails(r)
+			excess -= size
+			reclaimed += size
+			deleted++
+			continue
+		}
+
+		f := frames[0]
+		frames = frames[1:]
+		size, err := m.reclaim(f.path, metrics.ReclaimQuota, store.Remove)
+		if err != nil {
+			m.logger.Warn("Failed to delete frame over quota", zap.String("path", f.path), zap.Error(err))
+			continue
+		}
+		if s, ok := spans[f.cameraID]; ok {
+			s.to = f.time
+		} else {
+			spans[f.cameraID] = &span{from: f.time, to: f.time}
+		}
+		excess -= size
+		reclaimed += size
+		framesDeleted++
+	}
+	for cameraID, s := range spans {
+		if _, err := m.index.DeleteFrames(ctx, cameraID, s.from, s.to); err != nil {
+			m.logger.Warn("Failed to drop deleted frames from the index", zap.String("camera", cameraID), zap.Error(err))
+		}
+	}
+	m.collectBlobs(store)
+	m.metrics.DiskUsage.Set(float64(used - reclaimed))
+
+	m.logger.Warn("Disk usage over max_disk_usage, deleted the oldest footage",
+		zap.Int64("used", used),
+		zap.Int64("max_disk_usage", maxDiskUsage),
+		zap.Int64("reclaimed", reclaimed),
+		zap.Int("recordings_deleted", deleted),
+		zap.Int("frames_deleted", framesDeleted))
+	if excess > 0 {
+		m.logger.Error("Still over max_disk_usage after deleting all the footage that could be",
+			zap.Int64("excess", excess))
+	}
+	return nil
+}
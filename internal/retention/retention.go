@@ -0,0 +1,363 @@
+// Package retention ages recordings out: past each configured tier they are
+// re-encoded to a lower quality, and past retention_hours they and the
+// stored frames are deleted. Recordings deleted through the API wait in the
+// trash for a grace period before the same pass purges them. The periodic
+// pass and the transcodes both run on the job queue. Separately, disk usage
+// is checked every minute against max_disk_usage, deleting the oldest
+// footage when it is over.
+package retention
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/framestore"
+	"github.com/raeeceip/cctv/internal/index"
+	"github.com/raeeceip/cctv/internal/jobs"
+	"github.com/raeeceip/cctv/internal/thumbnail"
+	"github.com/raeeceip/cctv/internal/videocodec"
+	"github.com/raeeceip/cctv/pkg/logger"
+	"github.com/raeeceip/cctv/pkg/metrics"
+	"github.com/raeeceip/cctv/pkg/pathutil"
+	"go.uber.org/zap"
+)
+
+// Job kinds
+const (
+	KindSweep     = "retention"
+	KindTranscode = "transcode"
+)
+
+// Finished jobs are kept this long for inspection
+const jobHistory = 7 * 24 * time.Hour
+
+type Manager struct {
+	index     *index.Index
+	queue     *jobs.Queue
+	logger    *logger.Logger
+	outputDir string
+	worm      time.Duration
+	codec     videocodec.Options // what aged copies are encoded with
+	encodes   *metrics.EncodeMetrics
+
+	// Frames are found in layout, named by frameName
+	layout    framestore.Layout
+	frameName string
+	site      string
+	metrics   *metrics.RetentionMetrics
+
+	mu      sync.RWMutex
+	policy  policy
+	changed chan struct{} // signals Run that the interval may have changed
+}
+
+// policy is what Apply changes while the server runs. WORM isn't among it:
+// shortening it would release recordings it was promised to protect.
+type policy struct {
+	maxAge       time.Duration
+	interval     time.Duration
+	trashGrace   time.Duration
+	tiers        []config.RetentionTier
+	maxDiskUsage int64
+}
+
+func policyOf(cfg *config.Config) policy {
+	return policy{
+		maxAge:       time.Duration(cfg.Storage.RetentionHours) * time.Hour,
+		interval:     cfg.Storage.Retention.Interval,
+		trashGrace:   cfg.Storage.Retention.TrashGrace,
+		tiers:        cfg.Storage.Retention.Tiers,
+		maxDiskUsage: cfg.Storage.MaxDiskUsage,
+	}
+}
+
+type transcodePayload struct {
+	RecordingID int64 `json:"recording_id"`
+	Tier        int   `json:"tier"`
+}
+
+// New creates the manager and registers its job handlers on q.
+func New(ix *index.Index, q *jobs.Queue, log *logger.Logger, cfg *config.Config) *Manager {
+	// MJPEG pass-through can't be scaled; aged copies are always encoded
+	codec := config.VideoCodecOptions(cfg)
+	if codec.Codec == videocodec.Copy {
+		codec.Codec = videocodec.H264
+	}
+
+	outputDir, err := filepath.Abs(cfg.Storage.OutputDir)
+	if err != nil {
+		outputDir = cfg.Storage.OutputDir
+	}
+
+	m := &Manager{
+		index:     ix,
+		queue:     q,
+		logger:    log,
+		outputDir: outputDir,
+		worm:      cfg.Storage.Retention.WORM,
+		codec:     codec,
+		encodes:   metrics.NewEncodeMetrics(KindTranscode),
+
+		layout:    framestore.Layout(cfg.Storage.FrameLayout),
+		frameName: cfg.Storage.Naming.Frame,
+		site:      cfg.Site,
+		metrics:   metrics.NewRetentionMetrics(),
+
+		policy:  policyOf(cfg),
+		changed: make(chan struct{}, 1),
+	}
+	m.metrics.DiskQuota.Set(float64(cfg.Storage.MaxDiskUsage))
+	q.Handle(KindSweep, m.handleSweep)
+	q.Handle(KindTranscode, m.handleTranscode)
+	return m
+}
+
+// Apply changes the retention age, interval, tiers, trash grace period and
+// disk quota to those of cfg, from the next pass on.
+func (m *Manager) Apply(cfg *config.Config) {
+	m.mu.Lock()
+	m.policy = policyOf(cfg)
+	m.mu.Unlock()
+	m.metrics.DiskQuota.Set(float64(cfg.Storage.MaxDiskUsage))
+	select {
+	case m.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Manager) current() policy {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.policy
+}
+
+// Run enqueues a retention pass at startup and then every interval, and
+// enforces the disk quota every quotaInterval, until ctx is cancelled.
+func (m *Manager) Run(ctx context.Context) {
+	interval := m.current().interval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	quota := time.NewTicker(quotaInterval)
+	defer quota.Stop()
+
+	sweep, checkQuota := true, true
+	for {
+		if sweep {
+			if _, err := m.queue.Enqueue(ctx, KindSweep, KindSweep, nil); err != nil && ctx.Err() == nil {
+				m.logger.Error("Failed to schedule retention pass", zap.Error(err))
+			}
+		}
+		if checkQuota {
+			if err := m.enforceQuota(ctx); err != nil && ctx.Err() == nil {
+				m.logger.Error("Failed to enforce max_disk_usage", zap.Error(err))
+			}
+		}
+
+		sweep, checkQuota = false, false
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sweep = true
+		case <-quota.C:
+			checkQuota = true
+		case <-m.changed:
+			if p := m.current(); p.interval != interval {
+				interval = p.interval
+				ticker.Reset(interval)
+			}
+			// The quota may have shrunk
+			checkQuota = true
+		}
+	}
+}
+
+// managed reports whether path lies under the output directory. Footage
+// registered by import stays where it is and is never modified.
+func (m *Manager) managed(path string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(m.outputDir, abs)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// removeThumbnails deletes the thumbnails of a recording deleted for good.
+// They stay beside its path while it is in the trash, so restoring it
+// brings them back too.
+func (m *Manager) removeThumbnails(r index.Recording) {
+	if !m.managed(r.Path) {
+		return
+	}
+	if err := thumbnail.Remove(r.Path); err != nil {
+		m.logger.Warn("Failed to delete recording thumbnails", zap.String("path", r.Path), zap.Error(err))
+	}
+}
+
+func (m *Manager) handleSweep(ctx context.Context, _ json.RawMessage) error {
+	now := time.Now()
+	p := m.current()
+
+	deleted, err := m.expireRecordings(ctx, now.Add(-p.maxAge), now)
+	if err != nil {
+		return err
+	}
+	prunedFrames, err := m.pruneFrames(now.Add(-p.maxAge))
+	if err != nil {
+		m.logger.Warn("Failed to delete expired frames", zap.Error(err))
+	}
+
+	// Oldest tier first so a recording jumps straight to the lowest quality
+	// it qualifies for
+	queued := 0
+	seen := make(map[int64]bool)
+	for i := len(p.tiers) - 1; i >= 0; i-- {
+		tier := i + 1
+		candidates, err := m.index.ListRecordings(ctx, index.RecordingQuery{Before: now.Add(-p.tiers[i].After)})
+		if err != nil {
+			return err
+		}
+		for _, r := range candidates {
+			if seen[r.ID] || r.Tier >= tier || r.Codec == "jpeg" || !m.managed(r.Path) || m.locked(r, now) {
+				continue
+			}
+			seen[r.ID] = true
+			added, err := m.queue.Enqueue(ctx, KindTranscode, fmt.Sprintf("transcode:%d", r.ID),
+				transcodePayload{RecordingID: r.ID, Tier: tier})
+			if err != nil {
+				return err
+			}
+			if added {
+				queued++
+			}
+		}
+	}
+
+	purged, err := m.purgeTrash(ctx, now, p.trashGrace)
+	if err != nil {
+		return err
+	}
+
+	if _, err := m.index.PruneJobs(ctx, now.Add(-jobHistory)); err != nil {
+		m.logger.Warn("Failed to prune job history", zap.Error(err))
+	}
+	if _, err := m.index.PruneFrames(ctx, now.Add(-p.maxAge)); err != nil {
+		m.logger.Warn("Failed to prune frame index", zap.Error(err))
+	}
+	if _, err := m.index.PruneMotionEvents(ctx, now.Add(-p.maxAge)); err != nil {
+		m.logger.Warn("Failed to prune motion events", zap.Error(err))
+	}
+
+	if deleted > 0 || prunedFrames > 0 || queued > 0 || purged > 0 {
+		m.logger.Info("Retention pass completed",
+			zap.Int("deleted", deleted),
+			zap.Int("frames_deleted", prunedFrames),
+			zap.Int("purged_from_trash", purged),
+			zap.Int("transcodes_queued", queued))
+	}
+	return nil
+}
+
+func (m *Manager) handleTranscode(ctx context.Context, raw json.RawMessage) error {
+	var p transcodePayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return fmt.Errorf("invalid transcode payload: %w", err)
+	}
+	tiers := m.current().tiers
+	if p.Tier < 1 || p.Tier > len(tiers) {
+		return fmt.Errorf("unknown retention tier %d", p.Tier)
+	}
+
+	r, err := m.index.GetRecording(ctx, p.RecordingID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Deleted since it was queued
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if r.Tier >= p.Tier || m.locked(*r, time.Now()) {
+		return nil
+	}
+
+	tier := tiers[p.Tier-1]
+	tmp := strings.TrimSuffix(r.Path, filepath.Ext(r.Path)) + ".tier" + strconv.Itoa(p.Tier) + ".tmp.mp4"
+	defer os.Remove(tmp)
+
+	enc := videocodec.Select(m.codec, m.logger)
+	start := time.Now()
+	if err := m.encode(ctx, enc, r.Path, tmp, tier); err != nil {
+		return err
+	}
+	if elapsed := time.Since(start); r.FrameCount > 0 && elapsed > 0 {
+		m.encodes.FramesPerSecond.Set(float64(r.FrameCount) / elapsed.Seconds())
+		m.encodes.Frames.Add(float64(r.FrameCount))
+	}
+
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return err
+	}
+	unseal(r.Path)
+	if err := os.Rename(tmp, r.Path); err != nil {
+		return fmt.Errorf("failed to replace recording: %w", err)
+	}
+	if err := m.index.UpdateRecordingQuality(ctx, r.ID, p.Tier, enc.Name, info.Size()); err != nil {
+		return err
+	}
+
+	m.logger.Info("Recording transcoded for retention",
+		zap.String("path", r.Path),
+		zap.Int("tier", p.Tier),
+		zap.Int64("old_size", r.SizeBytes),
+		zap.Int64("new_size", info.Size()))
+	return nil
+}
+
+func (m *Manager) encode(ctx context.Context, enc videocodec.Encoder, input, output string, tier config.RetentionTier) error {
+	in, err := pathutil.FFmpeg(input)
+	if err != nil {
+		return err
+	}
+	out, err := pathutil.FFmpeg(output)
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{"-y"}, enc.InputArgs()...)
+	args = append(args, "-i", in, "-an")
+	if tier.Height > 0 {
+		// -2 keeps the aspect ratio with an even width, as encoders require
+		args = append(args, enc.FilterArgs(fmt.Sprintf("scale=-2:%d", tier.Height))...)
+	} else {
+		// Rounded down to even for yuv420p, as MJPEG recordings may be odd
+		args = append(args, enc.FilterArgs("scale=trunc(iw/2)*2:trunc(ih/2)*2")...)
+	}
+	args = append(args, enc.Args(tier.Bitrate)...)
+	args = append(args, "-movflags", "+faststart", out)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	m.logger.Debug("Running FFmpeg command",
+		zap.String("command", fmt.Sprintf("ffmpeg %s", strings.Join(args, " "))))
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg error: %v\nOutput: %s", err, stderr.String())
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/index"
+	"github.com/raeeceip/cctv/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// ErrPathTaken is returned by Restore when a file has since appeared at the
+// recording's original path.
+var ErrPathTaken = errors.New("a file already exists at the recording's path")
+
+// trashDir returns the directory trashed recordings are moved to.
+func (m *Manager) trashDir() string {
+	return filepath.Join(m.outputDir, "trash")
+}
+
+// Trash moves a recording to the trash, where it stays for the grace period
+// before a retention pass purges it. Its file is moved to the trash
+// directory; imported footage outside the output directory is left in place.
+// Recordings within their WORM period return ErrLocked.
+func (m *Manager) Trash(ctx context.Context, r *index.Recording) error {
+	if m.locked(*r, time.Now()) {
+		return ErrLocked
+	}
+	var trashPath string
+	if m.managed(r.Path) {
+		if err := os.MkdirAll(m.trashDir(), 0755); err != nil {
+			return fmt.Errorf("failed to create trash directory: %w", err)
+		}
+		trashPath = filepath.Join(m.trashDir(), fmt.Sprintf("%d_%s", r.ID, filepath.Base(r.Path)))
+		if err := os.Rename(r.Path, trashPath); err != nil {
+			return fmt.Errorf("failed to move recording to trash: %w", err)
+		}
+	}
+
+	now := time.Now()
+	if err := m.index.TrashRecording(ctx, r.ID, trashPath, now); err != nil {
+		if trashPath != "" {
+			os.Rename(trashPath, r.Path)
+		}
+		return err
+	}
+	r.DeletedAt = &now
+	r.TrashPath = trashPath
+
+	m.logger.Info("Recording moved to trash",
+		zap.Int64("id", r.ID),
+		zap.String("path", r.Path),
+		zap.Time("purge_after", m.PurgeAfter(*r)))
+	return nil
+}
+
+// Restore takes a recording out of the trash and moves its file back. It
+// returns sql.ErrNoRows if the recording is not in the trash.
+func (m *Manager) Restore(ctx context.Context, id int64) (*index.Recording, error) {
+	r, err := m.index.GetTrashedRecording(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.TrashPath != "" {
+		if _, err := os.Stat(r.Path); err == nil {
+			return nil, ErrPathTaken
+		}
+		if err := os.MkdirAll(filepath.Dir(r.Path), 0755); err != nil {
+			return nil, fmt.Errorf("failed to recreate recording directory: %w", err)
+		}
+		if err := os.Rename(r.TrashPath, r.Path); err != nil {
+			return nil, fmt.Errorf("failed to move recording out of trash: %w", err)
+		}
+	}
+	if err := m.index.RestoreRecording(ctx, id); err != nil {
+		if r.TrashPath != "" {
+			os.Rename(r.Path, r.TrashPath)
+		}
+		return nil, err
+	}
+
+	m.logger.Info("Recording restored from trash",
+		zap.Int64("id", r.ID),
+		zap.String("path", r.Path))
+	r.DeletedAt = nil
+	r.TrashPath = ""
+	return r, nil
+}
+
+// PurgeAfter returns when a trashed recording becomes due for purging.
+func (m *Manager) PurgeAfter(r index.Recording) time.Time {
+	if r.DeletedAt == nil {
+		return time.Time{}
+	}
+	return r.DeletedAt.Add(m.current().trashGrace)
+}
+
+// purgeTrash permanently deletes recordings that have been in the trash
+// for longer than grace.
+func (m *Manager) purgeTrash(ctx context.Context, now time.Time, grace time.Duration) (int, error) {
+	due, err := m.index.ListRecordings(ctx, index.RecordingQuery{
+		Trashed:       true,
+		DeletedBefore: now.Add(-grace),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, r := range due {
+		if r.TrashPath != "" {
+			if _, err := m.reclaim(r.TrashPath, metrics.ReclaimTrash, removeRecording); err != nil {
+				m.logger.Warn("Failed to purge trashed recording", zap.String("path", r.TrashPath), zap.Error(err))
+				continue
+			}
+		}
+		if err := m.index.DeleteRecording(ctx, r.ID); err != nil {
+			return purged, err
+		}
+		m.removeThumbnails(r)
+		purged++
+	}
+	return purged, nil
+}
@@ -0,0 +1,49 @@
+package retention
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/index"
+)
+
+// ErrLocked is returned for recordings still within storage.retention.worm.
+var ErrLocked = errors.New("recording is write-once until its WORM period ends")
+
+// LockedUntil returns when a recording's WORM period ends, or the zero time
+// if write-once storage is off. Until then it can't be deleted, trashed or
+// re-encoded.
+func (m *Manager) LockedUntil(r index.Recording) time.Time {
+	if m.worm <= 0 {
+		return time.Time{}
+	}
+	return r.CreatedAt.Add(m.worm)
+}
+
+// locked reports whether r is within its WORM period at now.
+func (m *Manager) locked(r index.Recording, now time.Time) bool {
+	return now.Before(m.LockedUntil(r))
+}
+
+// Seal makes a new recording's file read-only when write-once storage is
+// on. Footage outside the output directory is left alone.
+func (m *Manager) Seal(path string) error {
+	if m.worm <= 0 || !m.managed(path) {
+		return nil
+	}
+	return os.Chmod(path, 0444)
+}
+
+// unseal makes a sealed file writable again once it may change, as Windows
+// refuses to delete or replace read-only files. Failures are left to the
+// removal or rename that follows to report.
+func unseal(path string) {
+	os.Chmod(path, 0644)
+}
+
+// removeRecording deletes a recording's file, sealed or not.
+func removeRecording(path string) error {
+	unseal(path)
+	return os.Remove(path)
+}
@@ -0,0 +1,371 @@
+package schedule
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// event is a VEVENT of a calendar.
+type event struct {
+	uid      string
+	summary  string
+	start    time.Time
+	duration time.Duration
+	rule     *rule       // nil unless the event recurs
+	exdates  []time.Time // occurrences left out
+	// recurrenceID is set on an event replacing one occurrence of the
+	// recurring event with the same uid
+	recurrenceID time.Time
+}
+
+// rule is the subset of an RRULE understood here: daily and weekly
+// recurrences with INTERVAL, COUNT, UNTIL and BYDAY.
+type rule struct {
+	freq     string
+	interval int
+	count    int
+	until    time.Time
+	byDay    []time.Weekday
+}
+
+// property is a content line: NAME;PARAM=VALUE:value.
+type property struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// parseCalendar reads the events of an iCalendar (RFC 5545) feed. Times
+// without a zone, and with a TZID that isn't an IANA name, are taken to be
+// in loc. Cancelled events are left out. It also returns how many events
+// recur in a way that isn't understood; only their first occurrence is
+// kept.
+func parseCalendar(r io.Reader, loc *time.Location) (events []event, unsupported int, err error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var cur *event
+	var cancelled, allDay bool
+	var end time.Time
+	for n, line := range lines {
+		p, ok := parseProperty(line)
+		if !ok {
+			continue
+		}
+		switch {
+		case p.name == "BEGIN" && strings.EqualFold(p.value, "VEVENT"):
+			cur, cancelled, allDay, end = &event{}, false, false, time.Time{}
+		case cur == nil:
+			// Outside events, including VTIMEZONE definitions
+		case p.name == "END" && strings.EqualFold(p.value, "VEVENT"):
+			if cur.start.IsZero() {
+				return nil, 0, fmt.Errorf("line %d: event without DTSTART", n+1)
+			}
+			if !end.IsZero() {
+				cur.duration = end.Sub(cur.start)
+			} else if cur.duration == 0 && allDay {
+				cur.duration = 24 * time.Hour
+			}
+			if !cancelled && cur.duration > 0 {
+				events = append(events, *cur)
+			}
+			cur = nil
+		case p.name == "UID":
+			cur.uid = p.value
+		case p.name == "SUMMARY":
+			cur.summary = unescape(p.value)
+		case p.name == "STATUS":
+			cancelled = strings.EqualFold(p.value, "CANCELLED")
+		case p.name == "DTSTART":
+			if cur.start, err = parseTime(p, loc); err != nil {
+				return nil, 0, fmt.Errorf("line %d: %w", n+1, err)
+			}
+			// A date without a time and without an end lasts the day
+			allDay = len(strings.TrimSpace(p.value)) == 8
+		case p.name == "DTEND":
+			if end, err = parseTime(p, loc); err != nil {
+				return nil, 0, fmt.Errorf("line %d: %w", n+1, err)
+			}
+		case p.name == "DURATION":
+			if cur.duration, err = parseDuration(p.value); err != nil {
+				return nil, 0, fmt.Errorf("line %d: %w", n+1, err)
+			}
+		case p.name == "RRULE":
+			rule, ok := parseRule(p.value, loc)
+			if !ok {
+				unsupported++
+				continue
+			}
+			cur.rule = rule
+		case p.name == "EXDATE":
+			for _, v := range strings.Split(p.value, ",") {
+				t, err := parseTime(property{params: p.params, value: v}, loc)
+				if err != nil {
+					return nil, 0, fmt.Errorf("line %d: %w", n+1, err)
+				}
+				cur.exdates = append(cur.exdates, t)
+			}
+		case p.name == "RECURRENCE-ID":
+			if cur.recurrenceID, err = parseTime(p, loc); err != nil {
+				return nil, 0, fmt.Errorf("line %d: %w", n+1, err)
+			}
+		}
+	}
+	return events, unsupported, nil
+}
+
+// unfold reads the content lines, joining lines folded onto the next by a
+// leading space or tab.
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read calendar: %w", err)
+	}
+	return lines, nil
+}
+
+func parseProperty(line string) (property, bool) {
+	// The value starts at the first colon outside quoted parameter values
+	quoted := false
+	colon := -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return property{}, false
+	}
+
+	parts := strings.Split(line[:colon], ";")
+	p := property{name: strings.ToUpper(parts[0]), params: make(map[string]string), value: line[colon+1:]}
+	for _, param := range parts[1:] {
+		if k, v, ok := strings.Cut(param, "="); ok {
+			p.params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+		}
+	}
+	return p, true
+}
+
+func unescape(s string) string {
+	return strings.NewReplacer(`\n`, " ", `\N`, " ", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(s)
+}
+
+// parseTime reads a DATE or DATE-TIME value: UTC with a trailing Z, in the
+// zone named by TZID, or else in loc.
+func parseTime(p property, loc *time.Location) (time.Time, error) {
+	if tzid := p.params["TZID"]; tzid != "" {
+		// Outlook names zones its own way; those fall back to loc
+		if l, err := time.LoadLocation(strings.TrimPrefix(tzid, "/")); err == nil {
+			loc = l
+		}
+	}
+	v := strings.TrimSpace(p.value)
+	switch {
+	case len(v) == 8:
+		return time.ParseInLocation("20060102", v, loc)
+	case strings.HasSuffix(v, "Z"):
+		return time.Parse("20060102T150405Z", v)
+	default:
+		t, err := time.ParseInLocation("20060102T150405", v, loc)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time %q", v)
+		}
+		return t, nil
+	}
+}
+
+// parseDuration reads a DURATION value such as PT1H30M or P1D.
+func parseDuration(v string) (time.Duration, error) {
+	s := strings.TrimPrefix(strings.TrimPrefix(v, "+"), "-")
+	if !strings.HasPrefix(s, "P") || len(s) < 3 {
+		return 0, fmt.Errorf("invalid duration %q", v)
+	}
+	var d time.Duration
+	inTime := false
+	num := ""
+	for _, c := range s[1:] {
+		switch {
+		case c == 'T':
+			inTime = true
+		case c >= '0' && c <= '9':
+			num += string(c)
+		default:
+			n, err := strconv.Atoi(num)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", v)
+			}
+			num = ""
+			unit := map[rune]time.Duration{'W': 7 * 24 * time.Hour, 'D': 24 * time.Hour}[c]
+			if inTime {
+				unit = map[rune]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second}[c]
+			}
+			if unit == 0 {
+				return 0, fmt.Errorf("invalid duration %q", v)
+			}
+			d += time.Duration(n) * unit
+		}
+	}
+	if strings.HasPrefix(v, "-") {
+		d = -d
+	}
+	return d, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// parseRule reads an RRULE, returning false for rules it doesn't
+// understand.
+func parseRule(v string, loc *time.Location) (*rule, bool) {
+	r := &rule{interval: 1}
+	for _, part := range strings.Split(v, ";") {
+		k, val, _ := strings.Cut(part, "=")
+		var err error
+		switch strings.ToUpper(k) {
+		case "FREQ":
+			r.freq = strings.ToUpper(val)
+		case "INTERVAL":
+			if r.interval, err = strconv.Atoi(val); err != nil || r.interval <= 0 {
+				return nil, false
+			}
+		case "COUNT":
+			if r.count, err = strconv.Atoi(val); err != nil || r.count <= 0 {
+				return nil, false
+			}
+		case "UNTIL":
+			if r.until, err = parseTime(property{value: val}, loc); err != nil {
+				return nil, false
+			}
+		case "BYDAY":
+			for _, day := range strings.Split(val, ",") {
+				wd, ok := weekdays[strings.ToUpper(day)]
+				if !ok {
+					// Ordinals such as 1MO only make sense monthly
+					return nil, false
+				}
+				r.byDay = append(r.byDay, wd)
+			}
+		case "WKST":
+		default:
+			return nil, false
+		}
+	}
+	if r.freq != "DAILY" && r.freq != "WEEKLY" {
+		return nil, false
+	}
+	return r, true
+}
+
+// occurrences returns the start times of an event's occurrences that may
+// overlap [from, to), in order.
+func (e *event) occurrences(from, to time.Time) []time.Time {
+	if e.rule == nil {
+		if e.start.Before(to) && e.start.Add(e.duration).After(from) {
+			return []time.Time{e.start}
+		}
+		return nil
+	}
+
+	var starts []time.Time
+	excluded := func(t time.Time) bool {
+		for _, ex := range e.exdates {
+			if ex.Equal(t) {
+				return true
+			}
+		}
+		return false
+	}
+	// add counts an occurrence and reports whether there may be more
+	count := 0
+	add := func(t time.Time) bool {
+		if t.Before(e.start) {
+			return true
+		}
+		if (!e.rule.until.IsZero() && t.After(e.rule.until)) || !t.Before(to) {
+			return false
+		}
+		count++
+		if e.rule.count > 0 && count > e.rule.count {
+			return false
+		}
+		if t.Add(e.duration).After(from) && !excluded(t) {
+			starts = append(starts, t)
+		}
+		return true
+	}
+
+	y, m, d := e.start.Date()
+	h, mi, s := e.start.Clock()
+	loc := e.start.Location()
+	at := func(days int) time.Time {
+		return time.Date(y, m, d+days, h, mi, s, 0, loc)
+	}
+
+	switch e.rule.freq {
+	case "DAILY":
+		for i := 0; ; i += e.rule.interval {
+			t := at(i)
+			if len(e.rule.byDay) > 0 && !hasDay(e.rule.byDay, t.Weekday()) {
+				if !t.Before(to) {
+					return starts
+				}
+				continue
+			}
+			if !add(t) {
+				return starts
+			}
+		}
+	case "WEEKLY":
+		days := e.rule.byDay
+		if len(days) == 0 {
+			days = []time.Weekday{e.start.Weekday()}
+		}
+		// Weeks start on Monday
+		offsets := make([]int, 0, len(days))
+		for _, wd := range days {
+			offsets = append(offsets, (int(wd)+6)%7)
+		}
+		sort.Ints(offsets)
+		monday := -((int(e.start.Weekday()) + 6) % 7)
+		for week := 0; ; week += e.rule.interval {
+			for _, off := range offsets {
+				if !add(at(monday + week*7 + off)) {
+					return starts
+				}
+			}
+		}
+	}
+	return starts
+}
+
+func hasDay(days []time.Weekday, wd time.Weekday) bool {
+	for _, d := range days {
+		if d == wd {
+			return true
+		}
+	}
+	return false
+}
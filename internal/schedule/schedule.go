@@ -0,0 +1,434 @@
+// Package schedule pauses recording or alerts for cameras during planned
+// windows: weekly windows from the configuration and the events of
+// iCalendar feeds, such as a facilities team's cleaning rota. A camera is
+// paused while any window covering it is open, wherever the window came
+// from.
+package schedule
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	// Calendars name arbitrary zones, which Windows has no database for
+	_ "time/tzdata"
+
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// What a window can pause
+const (
+	Recording = "recording"
+	Alerts    = "alerts"
+)
+
+// Bounds on fetching a calendar
+const (
+	fetchTimeout = 30 * time.Second
+	maxCalendar  = 10 << 20
+)
+
+// horizon is how far ahead calendar events are expanded, which is how long
+// a calendar keeps working while it can't be fetched.
+const horizon = 30 * 24 * time.Hour
+
+// checkInterval is how often pauses are checked for opening and closing,
+// which is only logged; Paused is exact.
+const checkInterval = 30 * time.Second
+
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Pause is one opening of a window.
+type Pause struct {
+	Source  string    `json:"source"` // "window" or "calendar"
+	Name    string    `json:"name"`   // of the window or calendar
+	Summary string    `json:"summary,omitempty"`
+	Cameras []string  `json:"cameras,omitempty"` // every camera when empty
+	Pause   []string  `json:"pause"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+}
+
+// covers reports whether the pause stops action for a camera.
+func (p *Pause) covers(cameraID, action string) bool {
+	return contains(p.Pause, action) && (len(p.Cameras) == 0 || contains(p.Cameras, cameraID))
+}
+
+// key identifies a pause for logging its opening and closing.
+func (p *Pause) key() string {
+	return p.Source + "/" + p.Name + "/" + p.Start.String()
+}
+
+// Calendar is the state of a calendar feed as last fetched.
+type Calendar struct {
+	Name      string     `json:"name"`
+	URL       string     `json:"url"`
+	LastFetch *time.Time `json:"last_fetch,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Events    int        `json:"events"` // occurrences within the horizon
+}
+
+// Schedule holds the windows and keeps the calendars fetched.
+type Schedule struct {
+	// mu guards windows and loc, which Apply replaces
+	mu      sync.RWMutex
+	windows []window
+	loc     *time.Location
+
+	calendars []*calendar
+	interval  time.Duration
+	client    *http.Client
+	logger    *logger.Logger
+	refresh   chan struct{}
+}
+
+type window struct {
+	cfg        config.ScheduleWindow
+	days       []time.Weekday
+	start, end time.Duration // since midnight
+}
+
+type calendar struct {
+	cfg config.ScheduleCalendar
+
+	mu          sync.RWMutex
+	state       Calendar
+	pauses      []Pause // sorted by start
+	unsupported int     // recurring events last found not understood
+}
+
+// New returns the configured schedule, or nil if it has no windows or
+// calendars. Nothing is ever paused by a nil schedule.
+func New(cfg config.SchedulesConfig, log *logger.Logger) (*Schedule, error) {
+	if len(cfg.Windows) == 0 && len(cfg.Calendars) == 0 {
+		return nil, nil
+	}
+	loc, windows, err := parseWindows(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Schedule{
+		windows:  windows,
+		loc:      loc,
+		interval: cfg.Refresh,
+		client:   &http.Client{Timeout: fetchTimeout},
+		logger:   log,
+		refresh:  make(chan struct{}, 1),
+	}
+	for _, cc := range cfg.Calendars {
+		s.calendars = append(s.calendars, &calendar{cfg: cc, state: Calendar{Name: cc.Name, URL: cc.URL}})
+	}
+	return s, nil
+}
+
+// Apply replaces the windows and timezone with those of cfg, for a
+// configuration reloaded while running. Calendars are only read by New.
+func (s *Schedule) Apply(cfg config.SchedulesConfig) error {
+	loc, windows, err := parseWindows(cfg)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.loc, s.windows = loc, windows
+	s.mu.Unlock()
+	return nil
+}
+
+// parseWindows returns the timezone and weekly windows of cfg, which is
+// already validated.
+func parseWindows(cfg config.SchedulesConfig) (*time.Location, []window, error) {
+	loc := time.Local
+	if cfg.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(cfg.Timezone); err != nil {
+			return nil, nil, fmt.Errorf("invalid schedule timezone: %w", err)
+		}
+	}
+	var windows []window
+	for _, wc := range cfg.Windows {
+		start, _ := time.Parse("15:04", wc.Start)
+		end, _ := time.Parse("15:04", wc.End)
+		w := window{
+			cfg:   wc,
+			start: time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute,
+			end:   time.Duration(end.Hour())*time.Hour + time.Duration(end.Minute())*time.Minute,
+		}
+		for _, day := range wc.Days {
+			w.days = append(w.days, dayNames[day])
+		}
+		windows = append(windows, w)
+	}
+	return loc, windows, nil
+}
+
+// Run fetches the calendars every refresh interval, or when asked to by
+// Refresh, and logs pauses opening and closing, until ctx is cancelled.
+func (s *Schedule) Run(ctx context.Context) {
+	s.fetchAll(ctx)
+	fetch := time.NewTicker(s.interval)
+	defer fetch.Stop()
+	check := time.NewTicker(checkInterval)
+	defer check.Stop()
+
+	open := make(map[string]bool)
+	s.logChanges(open)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-fetch.C:
+			s.fetchAll(ctx)
+		case <-s.refresh:
+			s.fetchAll(ctx)
+		case <-check.C:
+		}
+		s.logChanges(open)
+	}
+}
+
+// Refresh asks for the calendars to be fetched again without waiting for
+// the next interval.
+func (s *Schedule) Refresh() {
+	select {
+	case s.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// Paused reports whether action is paused for a camera at t.
+func (s *Schedule) Paused(cameraID, action string, t time.Time) bool {
+	if s == nil {
+		return false
+	}
+	for _, p := range s.pauses(t, t.Add(time.Nanosecond)) {
+		if p.covers(cameraID, action) {
+			return true
+		}
+	}
+	return false
+}
+
+// Pauses returns the pauses overlapping [from, to), by start.
+func (s *Schedule) Pauses(from, to time.Time) []Pause {
+	pauses := s.pauses(from, to)
+	sort.SliceStable(pauses, func(i, j int) bool { return pauses[i].Start.Before(pauses[j].Start) })
+	return pauses
+}
+
+// Calendars returns the state of every calendar, in configuration order.
+func (s *Schedule) Calendars() []Calendar {
+	calendars := make([]Calendar, 0, len(s.calendars))
+	for _, c := range s.calendars {
+		c.mu.RLock()
+		calendars = append(calendars, c.state)
+		c.mu.RUnlock()
+	}
+	return calendars
+}
+
+func (s *Schedule) pauses(from, to time.Time) []Pause {
+	var pauses []Pause
+	s.mu.RLock()
+	for i := range s.windows {
+		pauses = append(pauses, s.windows[i].pauses(from, to, s.loc)...)
+	}
+	s.mu.RUnlock()
+	for _, c := range s.calendars {
+		c.mu.RLock()
+		for _, p := range c.pauses {
+			if !p.Start.Before(to) {
+				break
+			}
+			if p.End.After(from) {
+				pauses = append(pauses, p)
+			}
+		}
+		c.mu.RUnlock()
+	}
+	return pauses
+}
+
+// pauses returns the openings of a window overlapping [from, to), starting
+// the day before from in case one runs past midnight.
+func (w *window) pauses(from, to time.Time, loc *time.Location) []Pause {
+	var pauses []Pause
+	y, m, d := from.In(loc).Date()
+	for day := time.Date(y, m, d-1, 0, 0, 0, 0, loc); day.Before(to); day = day.AddDate(0, 0, 1) {
+		if len(w.days) > 0 && !hasDay(w.days, day.Weekday()) {
+			continue
+		}
+		start := at(day, w.start)
+		end := at(day, w.end)
+		if w.end <= w.start {
+			end = at(day.AddDate(0, 0, 1), w.end)
+		}
+		if start.Before(to) && end.After(from) {
+			pauses = append(pauses, Pause{
+				Source:  "window",
+				Name:    w.cfg.Name,
+				Cameras: w.cfg.Cameras,
+				Pause:   w.cfg.Pause,
+				Start:   start,
+				End:     end,
+			})
+		}
+	}
+	return pauses
+}
+
+// at is a time of day on a date, by the clock so it is right across DST
+// changes.
+func at(day time.Time, since time.Duration) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, int(since/time.Minute), 0, 0, day.Location())
+}
+
+func (s *Schedule) fetchAll(ctx context.Context) {
+	for _, c := range s.calendars {
+		if ctx.Err() != nil {
+			return
+		}
+		s.fetch(ctx, c)
+	}
+}
+
+// fetch reads a calendar and replaces its pauses. A calendar that can't be
+// fetched keeps the pauses it had.
+func (s *Schedule) fetch(ctx context.Context, c *calendar) {
+	now := time.Now()
+	pauses, unsupported, err := s.read(ctx, c.cfg, now)
+
+	c.mu.Lock()
+	hadError := c.state.Error != ""
+	hadUnsupported := c.unsupported
+	c.state.LastFetch = &now
+	c.state.Error = ""
+	if err != nil {
+		c.state.Error = err.Error()
+	} else {
+		c.pauses = pauses
+		c.state.Events = len(pauses)
+		c.unsupported = unsupported
+	}
+	c.mu.Unlock()
+
+	switch {
+	case err != nil && ctx.Err() == nil:
+		s.logger.Warn("Failed to fetch schedule calendar",
+			zap.String("calendar", c.cfg.Name),
+			zap.Error(err))
+	case err == nil && unsupported > 0 && unsupported != hadUnsupported:
+		s.logger.Warn("Schedule calendar has recurring events that aren't understood; only their first occurrence pauses",
+			zap.String("calendar", c.cfg.Name),
+			zap.Int("events", unsupported))
+	case err == nil && hadError:
+		s.logger.Info("Schedule calendar fetched again",
+			zap.String("calendar", c.cfg.Name),
+			zap.Int("events", len(pauses)))
+	}
+}
+
+// read fetches a calendar and expands its events into pauses from a day
+// before now to the horizon.
+func (s *Schedule) read(ctx context.Context, cfg config.ScheduleCalendar, now time.Time) ([]Pause, int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.URL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", "text/calendar")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("calendar returned %s", resp.Status)
+	}
+	s.mu.RLock()
+	loc := s.loc
+	s.mu.RUnlock()
+	events, unsupported, err := parseCalendar(io.LimitReader(resp.Body, maxCalendar), loc)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Occurrences moved or changed individually replace those of the
+	// recurring event
+	replaced := make(map[string][]time.Time)
+	for _, e := range events {
+		if !e.recurrenceID.IsZero() {
+			replaced[e.uid] = append(replaced[e.uid], e.recurrenceID)
+		}
+	}
+
+	from, to := now.Add(-24*time.Hour), now.Add(horizon)
+	match := strings.ToLower(cfg.Match)
+	var pauses []Pause
+	for _, e := range events {
+		if match != "" && !strings.Contains(strings.ToLower(e.summary), match) {
+			continue
+		}
+		if e.recurrenceID.IsZero() {
+			e.exdates = append(e.exdates, replaced[e.uid]...)
+		}
+		for _, start := range e.occurrences(from, to) {
+			pauses = append(pauses, Pause{
+				Source:  "calendar",
+				Name:    cfg.Name,
+				Summary: e.summary,
+				Cameras: cfg.Cameras,
+				Pause:   cfg.Pause,
+				Start:   start,
+				End:     start.Add(e.duration),
+			})
+		}
+	}
+	sort.SliceStable(pauses, func(i, j int) bool { return pauses[i].Start.Before(pauses[j].Start) })
+	return pauses, unsupported, nil
+}
+
+// logChanges logs the pauses that opened or closed since it was last
+// called with open, which it updates.
+func (s *Schedule) logChanges(open map[string]bool) {
+	now := time.Now()
+	seen := make(map[string]bool)
+	for _, p := range s.pauses(now, now.Add(time.Nanosecond)) {
+		k := p.key()
+		seen[k] = true
+		if !open[k] {
+			open[k] = true
+			s.logger.Info("Schedule pause started",
+				zap.String("source", p.Source),
+				zap.String("name", p.Name),
+				zap.String("summary", p.Summary),
+				zap.Strings("cameras", p.Cameras),
+				zap.Strings("pause", p.Pause),
+				zap.Time("until", p.End))
+		}
+	}
+	for k := range open {
+		if !seen[k] {
+			delete(open, k)
+			s.logger.Info("Schedule pause ended", zap.String("pause", k))
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+// File: internal/server/activation.go
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// systemd passes activated sockets starting at this descriptor.
+const listenFDsStart = 3
+
+// activationListeners returns the sockets passed by systemd socket activation,
+// keyed by FileDescriptorName. Unnamed sockets are assigned in the order
+// "api", "ingest", matching the order of ListenStream= lines in the unit.
+// The environment is cleared so child processes (ffmpeg) don't inherit it.
+func activationListeners() (map[string]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+
+	var names []string
+	if v := os.Getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+	defaults := []string{"api", "ingest"}
+
+	listeners := make(map[string]net.Listener, count)
+	for i := 0; i < count; i++ {
+		name := ""
+		if i < len(names) && names[i] != "" && names[i] != "unknown" {
+			name = names[i]
+		} else if i < len(defaults) {
+			name = defaults[i]
+		} else {
+			return nil, fmt.Errorf("unexpected activation socket %d", i)
+		}
+
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to use activation socket %q: %w", name, err)
+		}
+		listeners[name] = ln
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,209 @@
+// File: internal/server/admin.go
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/raeeceip/cctv/internal/backup"
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/index"
+	"go.uber.org/zap"
+)
+
+// requireAdmin checks the bearer token against server.admin.token.
+func (s *Server) requireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s.mu.RLock()
+		token := s.config.Server.Admin.Token
+		s.mu.RUnlock()
+
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin API disabled"})
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(bearerToken(c)), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Reload re-reads the configuration file and applies the settings that can
+// change at runtime. Listener and storage settings require a restart.
+func (s *Server) Reload() error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to reload config: %w", err)
+	}
+	if s.schedule != nil {
+		if err := s.schedule.Apply(cfg.Schedules); err != nil {
+			return fmt.Errorf("failed to reload config: %w", err)
+		}
+	} else if len(cfg.Schedules.Windows) > 0 || len(cfg.Schedules.Calendars) > 0 {
+		s.logger.Warn("Schedules added to a server started without any apply on restart")
+	}
+
+	s.mu.Lock()
+	s.config.LogLevel = cfg.LogLevel
+	s.config.Server.Admin = cfg.Server.Admin
+	s.config.Server.Auth = cfg.Server.Auth
+	s.config.Server.BodyLimits = cfg.Server.BodyLimits
+	s.config.Server.ProtocolVersions = cfg.Server.ProtocolVersions
+	s.config.Server.FrameEncodings = cfg.Server.FrameEncodings
+	s.config.Server.Limits = cfg.Server.Limits
+	s.config.Replication.AcceptToken = cfg.Replication.AcceptToken
+	s.config.Privacy = cfg.Privacy
+	s.mu.Unlock()
+
+	s.logger.SetLevel(cfg.LogLevel)
+	s.retention.Apply(cfg)
+	s.disk.Apply(cfg.Storage.DiskMonitor)
+	s.health.Apply(cfg.Server.Health)
+	s.processor.SetVideoInterval(cfg.Storage.VideoConsolidation.Interval)
+	s.logger.Info("Configuration reloaded", zap.String("log_level", cfg.LogLevel))
+	return nil
+}
+
+// watchConfig reloads the configuration whenever its file changes, until
+// ctx is cancelled. A file that fails to load is logged and the running
+// configuration kept, so a half-edited file does no harm.
+func (s *Server) watchConfig(ctx context.Context) {
+	err := config.Watch(ctx, func() {
+		if err := s.Reload(); err != nil {
+			s.logger.Error("Reload after config change failed", zap.Error(err))
+		}
+	})
+	if err != nil {
+		s.logger.Error("Config watcher stopped", zap.Error(err))
+	}
+}
+
+// Drain stops accepting camera connections, asks connected cameras to go
+// away and flushes pending frames into videos. The API stays up and /health
+// reports draining so load balancers stop routing cameras here.
+func (s *Server) Drain() {
+	s.mu.Lock()
+	if s.draining {
+		s.mu.Unlock()
+		return
+	}
+	s.draining = true
+	s.mu.Unlock()
+
+	s.logger.Info("Draining server")
+
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server draining")
+	s.cameras.Range(func(_ string, conn *websocket.Conn) bool {
+		conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+		return true
+	})
+
+	if err := s.processor.Flush(); err != nil {
+		s.logger.Error("Failed to flush processor during drain", zap.Error(err))
+	}
+}
+
+// IsDraining reports whether Drain has been called.
+func (s *Server) IsDraining() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.draining
+}
+
+// RequestShutdown asks the server to shut down gracefully, as if the
+// context passed to Start had been cancelled.
+func (s *Server) RequestShutdown() {
+	s.stopRequestOnce.Do(func() {
+		close(s.stopRequested)
+	})
+}
+
+// ShutdownRequested is closed once RequestShutdown has been called.
+func (s *Server) ShutdownRequested() <-chan struct{} {
+	return s.stopRequested
+}
+
+func (s *Server) handleReload(c *gin.Context) {
+	if err := s.Reload(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "reloaded", "time": time.Now()})
+}
+
+func (s *Server) handleDrain(c *gin.Context) {
+	go s.Drain()
+	c.JSON(http.StatusAccepted, gin.H{"status": "draining", "time": time.Now()})
+}
+
+func (s *Server) handleShutdown(c *gin.Context) {
+	s.logger.Info("Shutdown requested via admin API", zap.String("remote", c.ClientIP()))
+	c.JSON(http.StatusAccepted, gin.H{"status": "shutting down", "time": time.Now()})
+	go s.RequestShutdown()
+}
+
+// handleBackup streams a backup archive. ?videos=24h includes videos that
+// ended within that window. Restoring needs the server stopped, so it is
+// only available from the command line.
+func (s *Server) handleBackup(c *gin.Context) {
+	opts := backup.Options{Index: s.index, ConfigFile: config.File()}
+	if window := c.Query("videos"); window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid videos window"})
+			return
+		}
+		if opts.Videos, err = backup.RecentVideos(c.Request.Context(), s.index, d); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	name := fmt.Sprintf("cctv-backup-%s.tar.gz", time.Now().Format("20060102_150405"))
+	c.Header("Content-Type", "application/gzip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	c.Status(http.StatusOK)
+
+	// Headers are gone by the time an error can happen, so a failed backup
+	// shows up as a truncated archive that Restore rejects
+	manifest, err := backup.Create(c.Request.Context(), c.Writer, opts)
+	if err != nil {
+		s.logger.Error("Backup failed", zap.Error(err))
+		return
+	}
+	s.logger.Info("Backup written via admin API",
+		zap.String("remote", c.ClientIP()),
+		zap.Int("files", len(manifest.Files)))
+}
+
+// handleListJobs shows the background job queue. ?status= filters by state.
+func (s *Server) handleListJobs(c *gin.Context) {
+	limit := 100
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = n
+	}
+
+	jobs, err := s.index.ListJobs(c.Request.Context(), c.Query("status"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if jobs == nil {
+		jobs = []index.Job{}
+	}
+	c.JSON(http.StatusOK, gin.H{"jobs": jobs})
+}
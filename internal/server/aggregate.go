@@ -0,0 +1,104 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/aggregator"
+	"github.com/raeeceip/cctv/pkg/client"
+)
+
+// aggregateRecording is a node's recording with where the aggregator plays
+// it back.
+type aggregateRecording struct {
+	aggregator.Recording
+	Link string `json:"link"`
+}
+
+// handleAggregateNodes reports the state of each node.
+func (s *Server) handleAggregateNodes(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"nodes": s.aggregator.Nodes()})
+}
+
+// handleAggregateCameras lists the cameras of every node. Query parameters:
+// site.
+func (s *Server) handleAggregateCameras(c *gin.Context) {
+	inSite := siteFilter(c)
+	cameras := []aggregator.Camera{}
+	for _, cam := range s.aggregator.Cameras() {
+		if inSite(cam.ID) {
+			cameras = append(cameras, cam)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"cameras": cameras})
+}
+
+// handleAggregateEvents streams the events of every node, like
+// handleEvents does for this server's.
+func (s *Server) handleAggregateEvents(c *gin.Context) {
+	sub := s.aggregator.Subscribe()
+	defer s.aggregator.Unsubscribe(sub)
+	streamEvents(c, sub, s.shutdown)
+}
+
+// handleAggregateRecordings searches the recordings of every node, taking
+// the query parameters of handleListRecordings. Nodes that can't be
+// searched are reported under errors; 502 means none could.
+func (s *Server) handleAggregateRecordings(c *gin.Context) {
+	q, ok := bindRecordingQuery(c)
+	if !ok {
+		return
+	}
+	recordings, failed, err := s.aggregator.Recordings(c.Request.Context(), client.RecordingQuery{
+		Camera: q.CameraID,
+		Site:   q.Site,
+		Since:  q.Since,
+		Until:  q.Until,
+		Limit:  q.Limit,
+	})
+
+	errs := make(map[string]string, len(failed))
+	for node, err := range failed {
+		errs[node] = err.Error()
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "errors": errs})
+		return
+	}
+
+	results := make([]aggregateRecording, len(recordings))
+	for i, r := range recordings {
+		results[i] = aggregateRecording{
+			Recording: r,
+			Link:      fmt.Sprintf("/api/v1/aggregate/nodes/%s/recordings/%d/file", r.Node, r.ID),
+		}
+	}
+	resp := gin.H{"recordings": results}
+	if len(errs) > 0 {
+		resp["errors"] = errs
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// handleAggregateRecordingFile plays back a recording from the node that
+// has it.
+func (s *Server) handleAggregateRecordingFile(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid recording id"})
+		return
+	}
+	proxy, err := s.aggregator.RecordingFile(c.Param("node"), id)
+	if errors.Is(err, aggregator.ErrUnknownNode) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "node not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	proxy.ServeHTTP(c.Writer, c.Request)
+}
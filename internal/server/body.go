@@ -0,0 +1,69 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// uploadRoutes take bodies of up to body_limits.upload_mb; the others are
+// held to json_kb.
+var uploadRoutes = map[string]bool{
+	"/api/v1/replication/uploads/:origin/:name": true,
+	"/api/v1/camera/uploads/:name":              true,
+}
+
+// limitBody refuses request bodies over the configured limits with 413:
+// up front when Content-Length gives them away, and otherwise once the
+// handler reads past the limit.
+func (s *Server) limitBody() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s.mu.RLock()
+		limits := s.config.Server.BodyLimits
+		s.mu.RUnlock()
+
+		limit := int64(limits.JSONKB) << 10
+		if uploadRoutes[c.FullPath()] {
+			limit = int64(limits.UploadMB) << 20
+		}
+		if c.Request.ContentLength > limit {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request body too large", "limit": limit})
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+	}
+}
+
+// tooLarge reports whether err comes from reading past the body limit.
+func tooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// multipartFile returns the form part called name of a multipart request.
+// Parts are read as they arrive rather than parsed into memory or temporary
+// files first, so the caller can stream the file to where it belongs; the
+// parts before it are skipped.
+func multipartFile(r *http.Request, name string) (*multipart.Part, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no %q part in form", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == name {
+			return part, nil
+		}
+		part.Close()
+	}
+}
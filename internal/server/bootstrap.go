@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/raeeceip/cctv/internal/index"
+)
+
+// ErrAlreadySetUp is returned by Bootstrap for an index that has users.
+var ErrAlreadySetUp = errors.New("the index already has users")
+
+// Credentials are the secrets Bootstrap issues. They are not stored and
+// can't be shown again.
+type Credentials struct {
+	User      index.User
+	UserToken string
+	// CameraTokens maps camera IDs to their tokens
+	CameraTokens map[string]string
+}
+
+// Bootstrap sets up the users and cameras of a new install: a first user
+// with a token carrying every scope, and a token for each of cameras. It
+// refuses an index that already has users, so it can't be used to take
+// over an existing install.
+func Bootstrap(ctx context.Context, ix *index.Index, userName string, cameras []string) (*Credentials, error) {
+	users, err := ix.ListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) > 0 {
+		return nil, ErrAlreadySetUp
+	}
+	for _, id := range cameras {
+		if !validCameraID.MatchString(id) {
+			return nil, fmt.Errorf("invalid camera id %q", id)
+		}
+	}
+
+	user, err := ix.CreateUser(ctx, userName)
+	if err != nil {
+		return nil, err
+	}
+	token, hash, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	if err := ix.CreateToken(ctx, &index.APIToken{UserID: user.ID, Name: "initial", Scopes: allScopes}, hash); err != nil {
+		return nil, err
+	}
+	creds := &Credentials{User: *user, UserToken: token, CameraTokens: make(map[string]string)}
+
+	for _, id := range cameras {
+		token, hash, err := newCameraToken()
+		if err != nil {
+			return nil, err
+		}
+		if err := ix.CreateCameraToken(ctx, &index.CameraToken{CameraID: id, Name: "initial"}, hash); err != nil {
+			return nil, err
+		}
+		creds.CameraTokens[id] = token
+	}
+	return creds, nil
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/codec"
+)
+
+// handleCalibration reports what a camera is actually delivering next to
+// what the stream configuration expects.
+func (s *Server) handleCalibration(c *gin.Context) {
+	cameraID := c.Param("id")
+
+	windows, ok := s.calibration.Measure(cameraID, time.Now())
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "camera not connected"})
+		return
+	}
+
+	resp := gin.H{
+		"camera_id": cameraID,
+		"expected": gin.H{
+			"fps":    s.config.Stream.Framerate,
+			"width":  s.config.Stream.Width,
+			"height": s.config.Stream.Height,
+		},
+		"windows": windows,
+		"time":    time.Now(),
+	}
+
+	// Resolution comes from the latest stored frame
+	if _, cur, ok := s.snapshots.Get(cameraID); ok {
+		if cfg, err := codec.DecodeConfig(cur.Data); err == nil {
+			resp["resolution"] = gin.H{"width": cfg.Width, "height": cfg.Height}
+		}
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
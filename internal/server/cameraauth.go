@@ -0,0 +1,226 @@
+package server
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/raeeceip/cctv/internal/index"
+	"github.com/raeeceip/cctv/internal/site"
+	"github.com/raeeceip/cctv/internal/wire"
+	"go.uber.org/zap"
+)
+
+// cameraTokenPrefix tells camera tokens apart from JWTs, and from user
+// tokens in config files and logs.
+const cameraTokenPrefix = "cctvcam_"
+
+// validCameraID matches camera IDs tokens can be issued for, with or
+// without a site.
+var validCameraID = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)?$`)
+
+// errCameraAuth is returned for cameras without a valid token.
+var errCameraAuth = errors.New("invalid camera token")
+
+// newCameraToken returns a random camera token and the hash it is stored
+// under.
+func newCameraToken() (token, hash string, err error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	token = cameraTokenPrefix + hex.EncodeToString(secret)
+	return token, hashToken(token), nil
+}
+
+// cameraToken returns the token a camera presents, as a bearer token or,
+// for devices that can't set headers on the handshake, as ?token=.
+func cameraToken(c *gin.Context) string {
+	if token := bearerToken(c); token != "" {
+		return token
+	}
+	return c.Query("token")
+}
+
+// errCameraID is returned for cameras declaring an ID that can't be used.
+var errCameraID = errors.New("invalid camera id")
+
+// declaredCameraID returns the ID a camera declares for itself.
+func declaredCameraID(c *gin.Context) string {
+	if id := c.GetHeader(wire.CameraIDHeader); id != "" {
+		return id
+	}
+	return c.Query("camera")
+}
+
+// identifyCamera returns the ID a connecting camera is stored under: the
+// one its certificate or token is for, or else the one it declares. A
+// camera may declare its certificate's or token's ID, but no other, and
+// can't declare an ID that has tokens without presenting one. It returns
+// "" for an anonymous camera.
+func (s *Server) identifyCamera(c *gin.Context) (string, error) {
+	declared := declaredCameraID(c)
+	// Sites are the server's to assign
+	if declared != "" && (!validCameraID.MatchString(declared) || site.Of(declared) != "") {
+		return "", errCameraID
+	}
+	authenticated, err := s.authenticateCamera(c)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case authenticated != "":
+		if declared != "" && declared != authenticated {
+			return "", fmt.Errorf("%w: credentials are for camera %s", errCameraAuth, authenticated)
+		}
+		return authenticated, nil
+	case declared != "":
+		tokens, err := s.index.ListCameraTokens(c.Request.Context(), declared)
+		if err != nil {
+			return "", err
+		}
+		if len(tokens) > 0 {
+			return "", fmt.Errorf("%w: camera %s needs its token", errCameraAuth, declared)
+		}
+		return declared, nil
+	}
+	return "", nil
+}
+
+// certificateCamera returns the camera ID a camera's client certificate is
+// for, its common name, if the camera connected over mutual TLS. It returns
+// "" without a verified certificate or if the name isn't a camera ID.
+func certificateCamera(c *gin.Context) string {
+	state := c.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return ""
+	}
+	name := state.VerifiedChains[0][0].Subject.CommonName
+	if !validCameraID.MatchString(name) {
+		return ""
+	}
+	return name
+}
+
+// authenticateCamera returns the camera ID the request's client certificate
+// or token is for. It returns "" for a request without either when none is
+// required.
+func (s *Server) authenticateCamera(c *gin.Context) (string, error) {
+	s.mu.RLock()
+	auth := s.config.Server.Auth
+	s.mu.RUnlock()
+
+	if id := certificateCamera(c); id != "" {
+		return id, nil
+	}
+
+	provided := cameraToken(c)
+	switch {
+	case provided == "":
+		if auth.Required {
+			return "", errCameraAuth
+		}
+		return "", nil
+
+	case strings.HasPrefix(provided, cameraTokenPrefix):
+		token, err := s.index.CameraTokenByHash(c.Request.Context(), hashToken(provided))
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", errCameraAuth
+		}
+		if err != nil {
+			return "", err
+		}
+		if err := s.index.TouchCameraToken(c.Request.Context(), token.ID, time.Now()); err != nil {
+			s.logger.Warn("Failed to record camera token use", zap.Int64("token", token.ID), zap.Error(err))
+		}
+		return token.CameraID, nil
+
+	case auth.JWTSecret != "":
+		claims := jwt.RegisteredClaims{}
+		_, err := jwt.ParseWithClaims(provided, &claims, func(*jwt.Token) (interface{}, error) {
+			return []byte(auth.JWTSecret), nil
+		}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+		if err != nil || !validCameraID.MatchString(claims.Subject) {
+			return "", errCameraAuth
+		}
+		return claims.Subject, nil
+	}
+	return "", errCameraAuth
+}
+
+// handleListCameraTokens lists the tokens issued for a camera.
+func (s *Server) handleListCameraTokens(c *gin.Context) {
+	tokens, err := s.index.ListCameraTokens(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if tokens == nil {
+		tokens = []index.CameraToken{}
+	}
+	c.JSON(http.StatusOK, gin.H{"tokens": tokens})
+}
+
+// handleCreateCameraToken issues a token a camera connects with. The secret
+// is only shown in this response.
+func (s *Server) handleCreateCameraToken(c *gin.Context) {
+	cameraID := c.Param("id")
+	if !validCameraID.MatchString(cameraID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid camera id"})
+		return
+	}
+	var body struct {
+		Name string `json:"name"`
+	}
+	// The body is optional
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	token, hash, err := newCameraToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	t := &index.CameraToken{CameraID: cameraID, Name: body.Name}
+	if err := s.index.CreateCameraToken(c.Request.Context(), t, hash); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.logger.Info("Camera token issued", zap.String("camera", cameraID), zap.Int64("token", t.ID))
+	c.JSON(http.StatusCreated, gin.H{"token": t, "secret": token})
+}
+
+// handleDeleteCameraToken revokes a camera token. A camera connected with
+// it stays connected until it reconnects.
+func (s *Server) handleDeleteCameraToken(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("token"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid token id"})
+		return
+	}
+
+	err = s.index.DeleteCameraToken(c.Request.Context(), c.Param("id"), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "token not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.logger.Info("Camera token revoked", zap.String("camera", c.Param("id")), zap.Int64("token", id))
+	c.Status(http.StatusNoContent)
+}
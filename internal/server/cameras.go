@@ -0,0 +1,293 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/raeeceip/cctv/internal/camera"
+	"github.com/raeeceip/cctv/internal/index"
+	"github.com/raeeceip/cctv/internal/wire"
+	"go.uber.org/zap"
+)
+
+// cameraDetail is the status of one camera.
+type cameraDetail struct {
+	ID          string     `json:"id"`
+	Source      string     `json:"source"`
+	Connected   bool       `json:"connected"`
+	RemoteAddr  string     `json:"remote_addr,omitempty"`
+	ConnectedAt *time.Time `json:"connected_at,omitempty"`
+	// Frames and Bytes were received over the current connection
+	Frames    uint64     `json:"frames"`
+	Bytes     uint64     `json:"bytes"`
+	LastFrame *time.Time `json:"last_frame,omitempty"`
+	// Protocol is what the current connection negotiated
+	Protocol *wire.Capabilities `json:"protocol,omitempty"`
+	// FPS is measured over the shortest calibration window
+	FPS float64          `json:"fps"`
+	Ban *index.CameraBan `json:"ban,omitempty"`
+	// GOP counts keyframes and deltas, for cameras sending in groups of
+	// pictures
+	GOP *camera.GOPStatus `json:"gop,omitempty"`
+	// PTZ is where a pan/tilt/zoom camera last reported pointing
+	PTZ *wire.PTZ `json:"ptz,omitempty"`
+}
+
+// handleGetCamera reports a camera's status: a connected camera, one the
+// server pulls from, or a banned one.
+func (s *Server) handleGetCamera(c *gin.Context) {
+	cameraID := c.Param("id")
+	now := time.Now()
+	cam := cameraDetail{ID: cameraID, Source: sourceWebSocket}
+	known := false
+
+	if st, ok := s.cameras.Status(cameraID); ok {
+		known = true
+		cam.Connected = true
+		cam.RemoteAddr = st.RemoteAddr
+		cam.ConnectedAt = &st.ConnectedAt
+		cam.Frames = st.Frames
+		cam.Bytes = st.Bytes
+		cam.LastFrame = st.LastFrame
+		cam.Protocol = &st.Protocol
+		cam.GOP = st.GOP
+		cam.PTZ = st.PTZ
+	} else if s.rtsp != nil && slices.Contains(s.rtsp.Cameras(), cameraID) {
+		known = true
+		cam.Source = sourceRTSP
+		_, cam.Connected = s.streaming.Load(cameraID)
+		if _, cur, ok := s.snapshots.Get(cameraID); ok {
+			cam.LastFrame = &cur.Time
+		}
+	}
+	if windows, ok := s.calibration.Measure(cameraID, now); ok {
+		cam.FPS = windows[0].FPS
+	}
+
+	ban, err := s.index.CameraBan(c.Request.Context(), cameraID, now)
+	switch {
+	case err == nil:
+		known = true
+		cam.Ban = ban
+	case !errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !known {
+		c.JSON(http.StatusNotFound, gin.H{"error": "camera not found"})
+		return
+	}
+	c.JSON(http.StatusOK, cam)
+}
+
+// disconnectCamera closes a camera's connection with a close message
+// giving code and reason. It reports whether the camera was connected.
+func (s *Server) disconnectCamera(cameraID string, code int, reason string) bool {
+	conn, ok := s.cameras.Conn(cameraID)
+	if !ok {
+		return false
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	conn.Close()
+	return true
+}
+
+// handleDisconnectCamera closes a camera's connection. The camera may
+// reconnect right away; ban it to keep it out.
+func (s *Server) handleDisconnectCamera(c *gin.Context) {
+	cameraID := c.Param("id")
+	if !s.disconnectCamera(cameraID, websocket.CloseNormalClosure, "disconnected by admin") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "camera not connected"})
+		return
+	}
+	s.logger.Info("Camera disconnected by admin", zap.String("camera", cameraID))
+	c.Status(http.StatusNoContent)
+}
+
+// maxWidth and maxHeight bound the resolution a camera can be asked for,
+// 8K UHD.
+const (
+	maxWidth  = 7680
+	maxHeight = 4320
+)
+
+// handleConfigureCamera asks a connected camera to send frames at another
+// resolution. The camera switches without reconnecting; whether it does is
+// seen in the frames that follow.
+func (s *Server) handleConfigureCamera(c *gin.Context) {
+	cameraID := c.Param("id")
+	var body struct {
+		Width  int `json:"width" binding:"required"`
+		Height int `json:"height" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if body.Width <= 0 || body.Height <= 0 || body.Width > maxWidth || body.Height > maxHeight {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("resolution must be between 2x2 and %dx%d", maxWidth, maxHeight)})
+		return
+	}
+	// Odd sizes can't be encoded as yuv420p video
+	if body.Width%2 != 0 || body.Height%2 != 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "width and height must be even"})
+		return
+	}
+	msg := wire.Control{Type: wire.ControlConfig, Width: body.Width, Height: body.Height}
+	connected, err := s.cameras.Send(cameraID, msg)
+	if !connected {
+		c.JSON(http.StatusNotFound, gin.H{"error": "camera not connected"})
+		return
+	}
+	if errors.Is(err, camera.ErrNoControl) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	s.logger.Info("Camera resolution change requested",
+		zap.String("camera", cameraID), zap.Int("width", body.Width), zap.Int("height", body.Height))
+	c.Status(http.StatusAccepted)
+}
+
+// handlePTZ moves a connected PTZ camera, one that reports where it points
+// in its frames. Cameras move at their own speed; where they are is seen in
+// the frames that follow.
+func (s *Server) handlePTZ(c *gin.Context) {
+	cameraID := c.Param("id")
+	var move wire.PTZMove
+	if err := c.ShouldBindJSON(&move); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !move.Valid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "pan, tilt or zoom required: pan and tilt from -1 to 1 and zoom from 0 to 1, or up to twice that either way when relative"})
+		return
+	}
+	st, ok := s.cameras.Status(cameraID)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "camera not connected"})
+		return
+	}
+	if st.PTZ == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "camera has not reported a PTZ position"})
+		return
+	}
+	connected, err := s.cameras.Send(cameraID, wire.Control{Type: wire.ControlPTZ, PTZ: &move})
+	if !connected {
+		c.JSON(http.StatusNotFound, gin.H{"error": "camera not connected"})
+		return
+	}
+	if errors.Is(err, camera.ErrNoControl) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	s.logger.Info("Camera PTZ move requested",
+		zap.String("camera", cameraID), zap.Any("move", move))
+	c.Status(http.StatusAccepted)
+}
+
+// handleBanCamera refuses a camera's connections, for a duration or until
+// unbanned, and disconnects it.
+func (s *Server) handleBanCamera(c *gin.Context) {
+	cameraID := c.Param("id")
+	if !validCameraID.MatchString(cameraID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid camera id"})
+		return
+	}
+	var body struct {
+		Reason   string `json:"reason"`
+		Duration string `json:"duration"` // e.g. "24h", empty for no end
+	}
+	// The body is optional
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	ban := &index.CameraBan{CameraID: cameraID, Reason: body.Reason, CreatedAt: time.Now()}
+	if body.Duration != "" {
+		d, err := time.ParseDuration(body.Duration)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "duration must be a positive duration such as 24h"})
+			return
+		}
+		expires := ban.CreatedAt.Add(d)
+		ban.ExpiresAt = &expires
+	}
+	if err := s.index.BanCamera(c.Request.Context(), ban); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	disconnected := s.disconnectCamera(cameraID, websocket.ClosePolicyViolation, "camera banned")
+	s.logger.Info("Camera banned",
+		zap.String("camera", cameraID),
+		zap.String("reason", body.Reason),
+		zap.Bool("disconnected", disconnected))
+	c.JSON(http.StatusOK, ban)
+}
+
+// handleUnbanCamera lifts a camera's ban.
+func (s *Server) handleUnbanCamera(c *gin.Context) {
+	err := s.index.UnbanCamera(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "camera is not banned"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.logger.Info("Camera unbanned", zap.String("camera", c.Param("id")))
+	c.Status(http.StatusNoContent)
+}
+
+// handleListCameraBans lists the bans in force.
+func (s *Server) handleListCameraBans(c *gin.Context) {
+	bans, err := s.index.ListCameraBans(c.Request.Context(), time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if bans == nil {
+		bans = []index.CameraBan{}
+	}
+	c.JSON(http.StatusOK, gin.H{"bans": bans})
+}
+
+// handleTrack lists where a mobile camera took its indexed frames, oldest
+// first. Query parameters: since, until and limit, as for recordings.
+func (s *Server) handleTrack(c *gin.Context) {
+	if s.frames == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "tracks need storage.frame_index enabled"})
+		return
+	}
+	q, ok := bindRecordingQuery(c)
+	if !ok {
+		return
+	}
+	track, err := s.index.FrameTrack(c.Request.Context(), c.Param("id"), q.Since, q.Until, q.Limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if track == nil {
+		track = []index.TrackPoint{}
+	}
+	c.JSON(http.StatusOK, gin.H{"track": track})
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/chaos"
+	"go.uber.org/zap"
+)
+
+// injectFaults answers API requests with a 500 as often as chaos testing
+// asks. Admin requests are let through, so the faults can always be
+// turned off again.
+func (s *Server) injectFaults() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		if strings.HasPrefix(path, "/api/") && !strings.HasPrefix(path, "/api/v1/admin/") && s.chaos.FailRequest() {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": chaos.ErrInjected.Error()})
+			return
+		}
+		c.Next()
+	}
+}
+
+// handleGetChaos returns the faults being injected.
+func (s *Server) handleGetChaos(c *gin.Context) {
+	c.JSON(http.StatusOK, s.chaos.Status())
+}
+
+// handleSetChaos replaces the faults being injected, for a duration or
+// until they are set again.
+func (s *Server) handleSetChaos(c *gin.Context) {
+	var body struct {
+		chaos.Faults
+		Duration string `json:"duration"` // e.g. "10m", empty for no end
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := body.Faults.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var until time.Time
+	if body.Duration != "" {
+		d, err := time.ParseDuration(body.Duration)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "duration must be a positive duration such as 10m"})
+			return
+		}
+		until = time.Now().Add(d)
+	}
+
+	s.chaos.Set(body.Faults, until)
+	s.logger.Warn("Chaos faults set",
+		zap.Float64("drop_frames", body.DropFrames),
+		zap.Int("persist_delay_ms", body.PersistDelayMs),
+		zap.Int("fail_ffmpeg_every", body.FailFFmpegEvery),
+		zap.Float64("api_errors", body.APIErrors),
+		zap.String("duration", body.Duration))
+	c.JSON(http.StatusOK, s.chaos.Status())
+}
+
+// handleClearChaos stops injecting faults.
+func (s *Server) handleClearChaos(c *gin.Context) {
+	s.chaos.Set(chaos.Faults{}, time.Time{})
+	s.logger.Warn("Chaos faults cleared")
+	c.JSON(http.StatusOK, s.chaos.Status())
+}
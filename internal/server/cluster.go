@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/cluster"
+	"github.com/raeeceip/cctv/internal/processor"
+)
+
+// localCameras lists the cameras this node has frames from, which it
+// registers with the cluster.
+func (s *Server) localCameras() []string {
+	var ids []string
+	for _, cam := range s.cameras.List() {
+		ids = append(ids, cam.ID)
+	}
+	if s.rtsp != nil {
+		for _, id := range s.rtsp.Cameras() {
+			if _, streaming := s.streaming.Load(id); streaming {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// showRemoteFrame shows a frame another node shared to this node's
+// viewers. It isn't stored here, so tails, which follow what is, don't get
+// it.
+func (s *Server) showRemoteFrame(f cluster.Frame) {
+	frame := processor.FrameData{CameraID: f.CameraID, Number: f.Number, Timestamp: f.Time, Data: f.Data}
+	s.snapshots.Put(frame.CameraID, frame.Data, frame.Timestamp)
+	s.lastFrames.Put(frame)
+	s.previews.publish(frame)
+	s.live.Publish(frame)
+}
+
+// shareEvents publishes this node's events to the cluster until ctx is
+// done.
+func (s *Server) shareEvents(ctx context.Context) {
+	sub := s.events.Subscribe()
+	defer s.events.Unsubscribe(sub)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-sub:
+			s.cluster.PublishEvent(e)
+		}
+	}
+}
+
+// handleClusterNodes lists the nodes of the cluster with their cameras,
+// this one first.
+func (s *Server) handleClusterNodes(c *gin.Context) {
+	s.mu.RLock()
+	self := cluster.Node{ID: s.cluster.Node(), URL: s.config.Cluster.URL, Cameras: s.localCameras(), Seen: time.Now().UTC()}
+	s.mu.RUnlock()
+	if self.Cameras == nil {
+		self.Cameras = []string{}
+	}
+	c.JSON(http.StatusOK, gin.H{"node": self.ID, "nodes": append([]cluster.Node{self}, s.cluster.Nodes()...)})
+}
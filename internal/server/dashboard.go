@@ -0,0 +1,28 @@
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dashboardFiles is the web dashboard: a static page that polls the
+// cameras and recordings APIs and shows each camera's MJPEG preview.
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// setupDashboard serves the dashboard at /dashboard/ and sends / there.
+func (s *Server) setupDashboard() {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		// The directory is embedded at build time
+		panic(err)
+	}
+	s.apiRouter.StaticFS("/dashboard", http.FS(files))
+	s.apiRouter.GET("/", func(c *gin.Context) {
+		c.Redirect(http.StatusFound, "/dashboard/")
+	})
+}
@@ -0,0 +1,190 @@
+"use strict";
+
+// How often camera frame rates and recordings are refreshed. Connections
+// and new recordings also arrive as events in between.
+const CAMERA_INTERVAL = 2000;
+const RECORDING_INTERVAL = 15000;
+const RECORDING_LIMIT = 20;
+
+const cards = new Map();
+const siteInput = document.getElementById("site");
+const status = document.getElementById("status");
+
+function site() {
+  return siteInput.value.trim();
+}
+
+function query(params) {
+  const q = new URLSearchParams(params);
+  if (site()) {
+    q.set("site", site());
+  }
+  return q.toString();
+}
+
+async function getJSON(url) {
+  const res = await fetch(url);
+  if (!res.ok) {
+    throw new Error(`${url}: ${res.status}`);
+  }
+  return res.json();
+}
+
+function setStatus(text, error) {
+  status.textContent = text;
+  status.classList.toggle("error", !!error);
+}
+
+// card returns a camera's card, creating it with an MJPEG preview and, when
+// the server packages the camera's recordings as HLS, a button to play them.
+function card(id) {
+  let c = cards.get(id);
+  if (c) {
+    return c;
+  }
+  const node = document.getElementById("camera").content.firstElementChild.cloneNode(true);
+  c = {
+    node,
+    img: node.querySelector("img"),
+    video: node.querySelector("video"),
+    state: node.querySelector(".state"),
+    fps: node.querySelector(".fps"),
+    hls: node.querySelector(".hls"),
+    connected: null,
+  };
+  node.querySelector(".id").textContent = id;
+  c.img.alt = id;
+
+  const playlist = `/hls/${encodeURIComponent(id)}/playlist.m3u8`;
+  fetch(playlist, { method: "HEAD" }).then((res) => {
+    c.hls.hidden = !res.ok;
+  }, () => {});
+  c.hls.addEventListener("click", () => {
+    const playing = !c.video.hidden;
+    if (playing) {
+      c.video.pause();
+      c.video.removeAttribute("src");
+      c.video.load();
+      c.hls.textContent = "HLS";
+      c.video.hidden = true;
+      c.img.hidden = false;
+      c.img.src = `/live/${encodeURIComponent(id)}?t=${Date.now()}`;
+      return;
+    }
+    if (!c.video.canPlayType("application/vnd.apple.mpegurl")) {
+      window.open(playlist);
+      return;
+    }
+    c.img.removeAttribute("src");
+    c.img.hidden = true;
+    c.video.hidden = false;
+    c.video.src = playlist;
+    c.video.play();
+    c.hls.textContent = "Live";
+  });
+
+  cards.set(id, c);
+  return c;
+}
+
+// update shows a camera as listed by the API, restarting its preview when
+// it comes back so the browser doesn't keep a dead stream open.
+function update(cam) {
+  const c = card(cam.id);
+  c.state.textContent = cam.connected ? cam.source : "offline";
+  c.state.className = "state " + (cam.connected ? "online" : "offline");
+  c.fps.textContent = cam.connected ? `${cam.fps.toFixed(1)} fps` : "";
+  if (cam.connected !== c.connected && c.video.hidden) {
+    c.img.src = `/live/${encodeURIComponent(cam.id)}?t=${Date.now()}`;
+  }
+  c.connected = cam.connected;
+}
+
+async function refreshCameras() {
+  const { cameras } = await getJSON("/api/v1/cameras?" + query({}));
+  const seen = new Set(cameras.map((cam) => cam.id));
+  for (const [id, c] of cards) {
+    if (!seen.has(id)) {
+      c.img.removeAttribute("src");
+      c.node.remove();
+      cards.delete(id);
+    }
+  }
+  const grid = document.getElementById("cameras");
+  for (const cam of cameras) {
+    update(cam);
+    grid.appendChild(cards.get(cam.id).node);
+  }
+  document.getElementById("no-cameras").hidden = cameras.length > 0;
+}
+
+function formatBytes(n) {
+  const units = ["B", "KB", "MB", "GB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return `${n.toFixed(i ? 1 : 0)} ${units[i]}`;
+}
+
+async function refreshRecordings() {
+  const { recordings } = await getJSON("/api/v1/recordings?" + query({ limit: RECORDING_LIMIT }));
+  const rows = recordings.map((r) => {
+    const tr = document.createElement("tr");
+    const cells = [
+      r.camera_id,
+      new Date(r.start_time).toLocaleString(),
+      `${r.duration_seconds.toFixed(0)}s`,
+      r.frame_count,
+      formatBytes(r.size_bytes),
+    ];
+    for (const text of cells) {
+      const td = document.createElement("td");
+      td.textContent = text;
+      tr.appendChild(td);
+    }
+    const td = document.createElement("td");
+    const a = document.createElement("a");
+    a.href = `/api/v1/recordings/${r.id}/file`;
+    a.textContent = "Play";
+    td.appendChild(a);
+    tr.appendChild(td);
+    return tr;
+  });
+  document.getElementById("recordings").replaceChildren(...rows);
+}
+
+async function refresh(fn) {
+  try {
+    await fn();
+    setStatus("Updated " + new Date().toLocaleTimeString());
+  } catch (err) {
+    setStatus(err.message, true);
+  }
+}
+
+// Events make connections and new recordings show up without waiting for
+// the next poll.
+let events;
+function subscribe() {
+  if (events) {
+    events.close();
+  }
+  events = new EventSource("/api/v1/events?" + query({}));
+  events.addEventListener("camera.connected", () => refresh(refreshCameras));
+  events.addEventListener("camera.disconnected", () => refresh(refreshCameras));
+  events.addEventListener("recording.created", () => refresh(refreshRecordings));
+}
+
+siteInput.addEventListener("change", () => {
+  subscribe();
+  refresh(refreshCameras);
+  refresh(refreshRecordings);
+});
+
+subscribe();
+refresh(refreshCameras);
+refresh(refreshRecordings);
+setInterval(() => refresh(refreshCameras), CAMERA_INTERVAL);
+setInterval(() => refresh(refreshRecordings), RECORDING_INTERVAL);
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/codec"
+	"github.com/raeeceip/cctv/internal/processor"
+	"go.uber.org/zap"
+)
+
+// errNotQueued is returned for dead letters the processor didn't take,
+// most likely as its queue is full, or that weren't handed to it as the
+// disk is low on space.
+var errNotQueued = errors.New("dead letter not queued")
+
+// handleListDeadLetters lists the frames that failed to be stored, newest
+// first, optionally of one camera.
+func (s *Server) handleListDeadLetters(c *gin.Context) {
+	letters, err := s.deadLetters.List(c.Query("camera"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"dead_letters": letters})
+}
+
+// handleGetDeadLetter describes a frame that failed to be stored.
+func (s *Server) handleGetDeadLetter(c *gin.Context) {
+	letter, err := s.deadLetters.Get(c.Param("id"))
+	if !deadLetterError(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, letter)
+}
+
+// handleDeadLetterFrame downloads a dead letter's payload as it arrived.
+func (s *Server) handleDeadLetterFrame(c *gin.Context) {
+	data, err := s.deadLetters.Data(c.Param("id"))
+	if !deadLetterError(c, err) {
+		return
+	}
+	contentType := "application/octet-stream"
+	switch codec.Encoding(data) {
+	case codec.JPEG:
+		contentType = "image/jpeg"
+	case codec.WebP:
+		contentType = "image/webp"
+	}
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// handleReprocessDeadLetter queues a dead letter to be stored again. It
+// is removed once queued; if it fails again it comes back under a new ID.
+func (s *Server) handleReprocessDeadLetter(c *gin.Context) {
+	letter, err := s.deadLetters.Get(c.Param("id"))
+	if !deadLetterError(c, err) {
+		return
+	}
+	if err := s.reprocessDeadLetter(letter); !deadLetterError(c, err) {
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"reprocessing": 1})
+}
+
+// handleReprocessDeadLetters queues every dead letter, or every one of a
+// camera, to be stored again, stopping if the processor's queue fills.
+func (s *Server) handleReprocessDeadLetters(c *gin.Context) {
+	letters, err := s.deadLetters.List(c.Query("camera"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	queued := 0
+	// Oldest first, as they arrived
+	for i := len(letters) - 1; i >= 0; i-- {
+		err := s.reprocessDeadLetter(letters[i])
+		if errors.Is(err, processor.ErrDeadLetterNotFound) {
+			continue
+		} else if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error(), "reprocessing": queued})
+			return
+		}
+		queued++
+	}
+	c.JSON(http.StatusAccepted, gin.H{"reprocessing": queued})
+}
+
+func (s *Server) reprocessDeadLetter(letter processor.DeadLetter) error {
+	data, err := s.deadLetters.Data(letter.ID)
+	if err != nil {
+		return err
+	}
+	// Gated like frames as they arrive, so reprocessing doesn't fill a low
+	// disk or get past the write throttle
+	if !s.disk.Writable() {
+		return fmt.Errorf("%w: disk is low on space", errNotQueued)
+	}
+	if !s.throttle.Wait(s.shutdown, letter.CameraID, len(data)) {
+		return fmt.Errorf("%w: server is shutting down", errNotQueued)
+	}
+	if err := s.processor.ProcessFrame(letter.Frame(data)); err != nil {
+		return fmt.Errorf("%w: %v", errNotQueued, err)
+	}
+	s.logger.Info("Reprocessing dead letter",
+		zap.String("id", letter.ID),
+		zap.String("camera", letter.CameraID),
+		zap.Uint64("frame", letter.Number))
+	return s.deadLetters.Remove(letter.ID)
+}
+
+// handleDeleteDeadLetter discards a dead letter.
+func (s *Server) handleDeleteDeadLetter(c *gin.Context) {
+	if err := s.deadLetters.Remove(c.Param("id")); !deadLetterError(c, err) {
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// deadLetterError responds to err, if any, returning whether there was
+// none.
+func deadLetterError(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, processor.ErrDeadLetterNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, errNotQueued):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/events"
+	"github.com/raeeceip/cctv/internal/site"
+)
+
+// Camera sources
+const (
+	sourceWebSocket = "websocket"
+	sourceRTSP      = "rtsp"
+	sourceCluster   = "cluster" // another node of the cluster
+)
+
+// keepAliveInterval is how often an idle event stream gets a comment, so
+// proxies don't time it out.
+const keepAliveInterval = 30 * time.Second
+
+// cameraInfo is a camera as listed by the API.
+type cameraInfo struct {
+	ID        string     `json:"id"`
+	Source    string     `json:"source"`
+	Connected bool       `json:"connected"`
+	LastFrame *time.Time `json:"last_frame,omitempty"`
+	FPS       float64    `json:"fps"`
+	// Health is online, degraded or offline, since HealthSince
+	Health        string     `json:"health,omitempty"`
+	HealthSince   *time.Time `json:"health_since,omitempty"`
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+	// Node is the cluster node the camera is connected to, for those of
+	// other nodes
+	Node string `json:"node,omitempty"`
+}
+
+// cameraEvent is the data of camera.connected and camera.disconnected.
+type cameraEvent struct {
+	Source string `json:"source"`
+}
+
+// publishCamera announces a camera connecting or disconnecting.
+func (s *Server) publishCamera(cameraID, source string, connected bool) {
+	typ := events.CameraDisconnected
+	if connected {
+		typ = events.CameraConnected
+	}
+	s.events.Publish(events.New(typ, cameraID, cameraEvent{Source: source}))
+}
+
+// siteFilter returns whether a camera belongs to the site in ?site=, which
+// every camera does without one.
+func siteFilter(c *gin.Context) func(cameraID string) bool {
+	prefix := site.Prefix(c.Query("site"))
+	return func(cameraID string) bool {
+		return c.Query("site") == "" || strings.HasPrefix(cameraID, prefix)
+	}
+}
+
+// handleListCameras lists the cameras connected to the server, those it
+// pulls from, connected or not, and those that disconnected lately, with
+// their health. Query parameters: site.
+func (s *Server) handleListCameras(c *gin.Context) {
+	inSite := siteFilter(c)
+	now := time.Now()
+	cameras := []cameraInfo{}
+	listed := make(map[string]bool)
+	add := func(id, source string, connected bool, node string) {
+		if !inSite(id) || listed[id] {
+			return
+		}
+		listed[id] = true
+		cam := cameraInfo{ID: id, Source: source, Connected: connected, Node: node}
+		if h, ok := s.health.Get(id); ok {
+			cam.Health = h.State
+			cam.HealthSince = &h.Since
+			cam.LastHeartbeat = h.LastHeartbeat
+		}
+		if _, cur, ok := s.snapshots.Get(id); ok {
+			cam.LastFrame = &cur.Time
+		}
+		if windows, ok := s.calibration.Measure(id, now); ok {
+			cam.FPS = windows[0].FPS
+		}
+		cameras = append(cameras, cam)
+	}
+
+	for _, cam := range s.cameras.List() {
+		add(cam.ID, sourceWebSocket, true, "")
+	}
+	if s.rtsp != nil {
+		for _, id := range s.rtsp.Cameras() {
+			_, streaming := s.streaming.Load(id)
+			add(id, sourceRTSP, streaming, "")
+		}
+	}
+	if s.cluster != nil {
+		// Before those disconnected here, which may have moved there
+		for _, n := range s.cluster.Nodes() {
+			for _, id := range n.Cameras {
+				add(id, sourceCluster, true, n.ID)
+			}
+		}
+	}
+	for _, h := range s.health.List() {
+		add(h.ID, sourceWebSocket, false, "")
+	}
+	sort.Slice(cameras, func(i, j int) bool { return cameras[i].ID < cameras[j].ID })
+	c.JSON(http.StatusOK, gin.H{"cameras": cameras})
+}
+
+// handleEvents streams events as server-sent events, named by event type
+// with the event as JSON data. Query parameters: camera and site.
+func (s *Server) handleEvents(c *gin.Context) {
+	sub := s.events.Subscribe()
+	defer s.events.Unsubscribe(sub)
+	streamEvents(c, sub, s.shutdown)
+}
+
+// streamEvents writes events from ch to the client until it goes away or
+// done is closed.
+func streamEvents(c *gin.Context, ch <-chan events.Event, done <-chan struct{}) {
+	camera := c.Query("camera")
+	inSite := siteFilter(c)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-done:
+			return
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(c.Writer, ": keep-alive\n\n")
+		case e := <-ch:
+			if (camera != "" && e.CameraID != camera) || !inSite(e.CameraID) {
+				continue
+			}
+			data, _ := json.Marshal(e)
+			_, err = fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", e.Type, data)
+		}
+		if err != nil {
+			return
+		}
+		c.Writer.Flush()
+	}
+}
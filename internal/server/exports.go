@@ -0,0 +1,266 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/export"
+	"github.com/raeeceip/cctv/internal/index"
+	"go.uber.org/zap"
+)
+
+// handleCreateExport queues the export of a recording to a format from
+// storage.export. The response has the export's state and, in Location,
+// where to follow it.
+func (s *Server) handleCreateExport(c *gin.Context) {
+	r, ok := s.lookupRecording(c)
+	if !ok {
+		return
+	}
+	var body struct {
+		Format string `json:"format" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if r.Codec == "jpeg" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "recording is a single frame"})
+		return
+	}
+
+	e, err := s.exports.Start(c.Request.Context(), r, body.Format)
+	if !s.exportError(c, err) {
+		return
+	}
+	s.logger.Info("Recording export requested",
+		zap.Int64("recording", r.ID),
+		zap.String("format", body.Format),
+		zap.String("status", e.Status))
+	c.Header("Location", c.Request.URL.Path+"/"+body.Format)
+	c.JSON(http.StatusAccepted, e)
+}
+
+// handleGetExport returns the state of a recording's export to a format.
+func (s *Server) handleGetExport(c *gin.Context) {
+	id, ok := recordingID(c)
+	if !ok {
+		return
+	}
+	e, err := s.exports.Status(c.Request.Context(), id, c.Param("format"))
+	if !s.exportError(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, e)
+}
+
+// handleExportFile downloads a finished export.
+func (s *Server) handleExportFile(c *gin.Context) {
+	id, ok := recordingID(c)
+	if !ok {
+		return
+	}
+	e, err := s.exports.Status(c.Request.Context(), id, c.Param("format"))
+	if !s.exportError(c, err) {
+		return
+	}
+	if e.Status != index.JobDone {
+		c.JSON(http.StatusConflict, gin.H{"error": "export is " + e.Status})
+		return
+	}
+
+	f, err := os.Open(e.Path)
+	if os.IsNotExist(err) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "export not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Named for the footage rather than after the file kept on disk
+	name := filepath.Base(e.Path)
+	if r, err := s.index.GetRecording(c.Request.Context(), id); err == nil {
+		name = s.exports.FileName(r.CameraID, r.StartTime, r.EndTime, strings.TrimPrefix(filepath.Ext(name), "."))
+	}
+	if ct, ok := recordingTypes[strings.ToLower(filepath.Ext(name))]; ok {
+		c.Header("Content-Type", ct)
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeContent(c.Writer, c.Request, name, info.ModTime(), f)
+}
+
+// exportError answers for an export error and returns false, or returns
+// true if there was none.
+func (s *Server) exportError(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, export.ErrUnknownFormat):
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("format must be one of %s",
+			strings.Join(s.exports.Formats(), ", "))})
+	case errors.Is(err, export.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+	return false
+}
+
+// maxClips bounds how many clips are stitched at once, as each runs FFmpeg.
+const maxClips = 4
+
+// maxOverlays bounds the events burnt into one clip, as each adds filters.
+const maxOverlays = 200
+
+// clipWriter sends a clip's headers with its first bytes, so a failure
+// before FFmpeg writes anything can still be answered with an error.
+type clipWriter struct {
+	c       *gin.Context
+	name    string
+	started bool
+}
+
+func (w *clipWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		w.c.Header("Content-Type", "video/mp4")
+		w.c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": w.name}))
+		w.c.Status(http.StatusOK)
+	}
+	return w.c.Writer.Write(p)
+}
+
+// eventClipBefore and eventClipAfter are how much footage around an event
+// its clip covers when ?from= and ?to= are left out.
+const (
+	eventClipBefore = 10 * time.Second
+	eventClipAfter  = 20 * time.Second
+)
+
+// handleClip streams a camera's footage from ?from= to ?to= (RFC 3339) as
+// one MP4, stitched from its recordings as it is sent. ?precise=true
+// re-encodes for cuts on the exact frames. ?event= ties the clip to one of
+// the camera's motion events, covering the time around it unless from and
+// to are given; ?overlay=true burns the motion events in the clip into it.
+func (s *Server) handleClip(c *gin.Context) {
+	cameraID := c.Param("id")
+	var from, to time.Time
+	var err error
+	if id := c.Query("event"); id != "" {
+		eventID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid event"})
+			return
+		}
+		e, err := s.index.GetMotionEvent(c.Request.Context(), eventID)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && e.CameraID != cameraID) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "event not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		from, to = e.Time.Add(-eventClipBefore), e.Time.Add(eventClipAfter)
+	}
+	if v := c.Query("from"); v != "" || from.IsZero() {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from"})
+			return
+		}
+	}
+	if v := c.Query("to"); v != "" || to.IsZero() {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to"})
+			return
+		}
+	}
+	if !to.After(from) || to.Sub(from) > export.MaxClip {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("to must be after from, by at most %s", export.MaxClip)})
+		return
+	}
+	precise := c.Query("precise") == "true"
+
+	var overlays []export.Overlay
+	if c.Query("overlay") == "true" {
+		found, err := s.index.ListMotionEvents(c.Request.Context(), index.MotionQuery{
+			CameraID: cameraID,
+			Since:    from,
+			Until:    to,
+			Limit:    maxOverlays,
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for _, e := range found {
+			label := "Motion"
+			if e.Zone != "" {
+				label += " in " + e.Zone
+			}
+			overlays = append(overlays, export.Overlay{Time: e.Time, Label: label, Box: e.Box})
+		}
+	}
+
+	select {
+	case s.clipSlots <- struct{}{}:
+		defer func() { <-s.clipSlots }()
+	default:
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "too many clips being stitched; try again shortly"})
+		return
+	}
+
+	recordings, err := s.index.ListRecordings(c.Request.Context(), index.RecordingQuery{
+		CameraID: cameraID,
+		Since:    from,
+		Until:    to,
+		Limit:    math.MaxInt32,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	start := time.Now()
+	w := &clipWriter{c: c, name: s.exports.FileName(cameraID, from, to, "mp4")}
+	err = s.exports.Stitch(c.Request.Context(), w, recordings, from, to, precise, overlays)
+	switch {
+	case errors.Is(err, export.ErrNoFootage):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case err != nil && !w.started:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		// Too late to answer with an error; the client gets a short clip
+		if c.Request.Context().Err() == nil {
+			s.logger.Warn("Failed to stitch clip", zap.String("camera", cameraID), zap.Error(err))
+		}
+		return
+	}
+	s.logger.Info("Clip sent",
+		zap.String("camera", cameraID),
+		zap.Time("from", from),
+		zap.Time("to", to),
+		zap.Bool("precise", precise),
+		zap.Int("overlays", len(overlays)),
+		zap.Duration("took", time.Since(start)))
+}
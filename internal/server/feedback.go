@@ -0,0 +1,40 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/camera"
+	"github.com/raeeceip/cctv/internal/wire"
+	"go.uber.org/zap"
+)
+
+// feedbackRoutine tells each connected camera that reads control messages
+// how full its processor queue is and how long its frames take to be
+// queued, every interval until ctx is cancelled. Cameras that adapt lower
+// their quality or frame rate while these are high.
+func (s *Server) feedbackRoutine(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, st := range s.cameras.List() {
+			if !st.Protocol.Control {
+				continue
+			}
+			msg := wire.Control{
+				Type:      wire.ControlFeedback,
+				QueueLoad: s.processor.QueueLoad(st.ID),
+				LatencyMs: st.IngestLatencyMs,
+			}
+			if _, err := s.cameras.Send(st.ID, msg); err != nil && !errors.Is(err, camera.ErrNoControl) {
+				s.logger.Debug("Failed to send feedback", zap.String("camera", st.ID), zap.Error(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/hls"
+)
+
+// hlsTypes are the content types of HLS files by extension.
+var hlsTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+	".mp4":  "video/mp4",
+}
+
+// handleHLS serves a camera's HLS playlist and its segments. Segment names
+// in the playlist are relative, so players fetch them from the same route.
+func (s *Server) handleHLS(c *gin.Context) {
+	cameraID, name := c.Param("camera"), c.Param("file")
+	ct, ok := hlsTypes[strings.ToLower(filepath.Ext(name))]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not an HLS file"})
+		return
+	}
+	path, ok := s.hls.File(cameraID, name)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid camera or file name"})
+		return
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		if name == hls.PlaylistName {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no video packaged for this camera yet"})
+		} else {
+			// Fell off the playlist
+			c.JSON(http.StatusNotFound, gin.H{"error": "segment not found"})
+		}
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	h := c.Writer.Header()
+	h.Set("Content-Type", ct)
+	if name == hls.PlaylistName {
+		// Rewritten with every video
+		h.Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(c.Writer, c.Request, name, info.ModTime(), f)
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/raeeceip/cctv/internal/codec"
+	"github.com/raeeceip/cctv/internal/processor"
+	"github.com/raeeceip/cctv/internal/schedule"
+	"github.com/raeeceip/cctv/internal/wire"
+	"go.uber.org/zap"
+)
+
+// readFrame reads the next frame of a camera into a pooled buffer. Text
+// messages are CameraMessage JSON with base64 data, a hello that
+// renegotiates caps, or a heartbeat; binary messages use the wire format
+// and are streamed into the buffer as they are. Frames that cannot be
+// decoded are logged and skipped; an error means the connection is
+// unusable. A frame in a
+// format caps doesn't allow, or a hello leaving none, closes the
+// connection, telling the camera why.
+func (s *Server) readFrame(conn *websocket.Conn, cameraID string, caps *wire.Capabilities) (processor.FrameData, error) {
+	refuse := func(code int, reason string) error {
+		s.logger.Warn("Camera broke its protocol", zap.String("camera", cameraID), zap.String("reason", reason))
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+		return errors.New(reason)
+	}
+	for {
+		messageType, r, err := conn.NextReader()
+		if err != nil {
+			return processor.FrameData{}, err
+		}
+		// Text messages may be a hello, so their format is only checked
+		// once decoded
+		if messageType == websocket.BinaryMessage && !caps.BinaryFrames {
+			return processor.FrameData{}, refuse(websocket.CloseUnsupportedData, frameFormatError(messageType, *caps))
+		}
+
+		buf := processor.GetBuffer()
+		var header wire.Header
+		switch messageType {
+		case websocket.BinaryMessage:
+			if header, err = wire.ReadHeader(r); err == nil {
+				_, err = buf.ReadFrom(r)
+			}
+		case websocket.TextMessage:
+			var msg struct {
+				CameraMessage
+				Proto        int      `json:"proto"`
+				Capabilities []string `json:"capabilities"`
+				FramesSent   uint64   `json:"frames_sent"`
+				FPS          float64  `json:"fps"`
+			}
+			if err = json.NewDecoder(r).Decode(&msg); err != nil {
+				break
+			}
+			if msg.Type == wire.HelloType {
+				processor.PutBuffer(buf)
+				hello := wire.Hello{Type: msg.Type, Proto: msg.Proto, Capabilities: msg.Capabilities}
+				if err := s.handleHello(cameraID, conn, caps, hello); err != nil {
+					return processor.FrameData{}, refuse(websocket.CloseProtocolError, err.Error())
+				}
+				continue
+			}
+			if msg.Type == wire.HeartbeatType {
+				processor.PutBuffer(buf)
+				s.health.Heartbeat(cameraID, wire.Heartbeat{Type: msg.Type, Time: msg.Time, FramesSent: msg.FramesSent, FPS: msg.FPS}, time.Now())
+				continue
+			}
+			if !caps.JSONFrames {
+				processor.PutBuffer(buf)
+				return processor.FrameData{}, refuse(websocket.CloseUnsupportedData, frameFormatError(messageType, *caps))
+			}
+			header = wire.Header{Camera: msg.Camera, Time: msg.Time, FrameNum: msg.FrameNum, Pattern: msg.Pattern, Location: msg.Location,
+				KeyFrame: msg.KeyFrame, GOP: msg.GOP, PTZ: msg.PTZ}
+			_, err = buf.ReadFrom(base64.NewDecoder(base64.StdEncoding, strings.NewReader(msg.Data)))
+			var corrupt base64.CorruptInputError
+			if errors.As(err, &corrupt) {
+				processor.PutBuffer(buf)
+				s.logger.Warn("Dropped frame with invalid base64 data",
+					zap.String("camera", cameraID),
+					zap.Uint64("frame", msg.FrameNum),
+					zap.Error(err))
+				continue
+			}
+		}
+		if err != nil {
+			processor.PutBuffer(buf)
+			return processor.FrameData{}, err
+		}
+
+		if !caps.WebP && codec.Encoding(buf.Bytes()) == codec.WebP {
+			processor.PutBuffer(buf)
+			return processor.FrameData{}, refuse(websocket.CloseUnsupportedData, "WebP frames weren't negotiated")
+		}
+
+		frame := processor.PooledFrame(buf)
+		frame.CameraID = cameraID
+		frame.Timestamp = header.Time
+		frame.Number = header.FrameNum
+		frame.Pattern = header.Pattern
+		frame.Delta = !header.IsKeyFrame()
+		frame.GOP = header.GOP
+		frame.PTZ = header.PTZ
+		if header.Location != nil && header.Location.Valid() {
+			frame.Location = header.Location
+		}
+		return frame, nil
+	}
+}
+
+// ingestFrame hands a frame to the processor, which takes over its buffer,
+// once the write throttle lets it through, rotated and mirrored as its
+// camera is set to. Frames of cameras that connect to the server and of
+// those it pulls from all come through here. While a schedule pauses
+// recording for the camera its frames are dropped, as are those chaos
+// testing drops, and those that can't be masked as their camera's privacy
+// masks say. While the disk is low on space frames only go to viewers.
+func (s *Server) ingestFrame(frame processor.FrameData) {
+	now := time.Now()
+	s.calibration.Record(frame.CameraID, len(frame.Data), now)
+	s.cameras.Record(frame.CameraID, len(frame.Data), now)
+	if frame.GOP != nil {
+		s.cameras.RecordGOP(frame.CameraID, frame.Number, frame.Delta, *frame.GOP)
+	}
+	if frame.PTZ != nil {
+		s.cameras.RecordPTZ(frame.CameraID, *frame.PTZ)
+	}
+	s.health.Frame(frame.CameraID, now)
+	if s.processor == nil || s.schedule.Paused(frame.CameraID, schedule.Recording, now) || s.chaos.DropFrame() {
+		frame.Release()
+		return
+	}
+	if !s.disk.Writable() {
+		if s.transformFrame(&frame) && s.jpegFrame(&frame) {
+			s.publishFrame(frame)
+		}
+		frame.Release()
+		return
+	}
+	if !s.throttle.Wait(s.shutdown, frame.CameraID, len(frame.Data)) {
+		frame.Release()
+		return
+	}
+	if !s.transformFrame(&frame) {
+		frame.Release()
+		return
+	}
+	id := frame.CameraID
+	s.processor.ProcessFrame(frame)
+	s.cameras.RecordLatency(id, time.Since(now))
+}
+
+// publishFrame hands a frame to what shows cameras live: snapshots, the
+// last frames, tails, previews and WebRTC viewers. Stored frames come
+// through here, and those not stored for lack of space.
+func (s *Server) publishFrame(f processor.FrameData) {
+	s.snapshots.Put(f.CameraID, f.Data, f.Timestamp)
+	s.lastFrames.Put(f)
+	s.tails.publish(f)
+	s.previews.publish(f)
+	s.live.Publish(f)
+	if s.cluster != nil {
+		s.cluster.PublishFrame(f.CameraID, f.Number, f.Timestamp, f.Data)
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/processor"
+	"github.com/raeeceip/cctv/internal/ratelimit"
+)
+
+// Labels of camera_limit_violations_total
+const (
+	limitConnections      = "connections"
+	limitConnectionsPerIP = "connections_per_ip"
+	limitFrameRate        = "frame_rate"
+)
+
+// connectionRetry is the Retry-After given to cameras refused by a
+// connection limit.
+const connectionRetry = 30 * time.Second
+
+var (
+	errTooManyCameras  = errors.New("too many cameras connected")
+	errTooManyFromAddr = errors.New("too many cameras connected from this address")
+)
+
+func (s *Server) cameraLimits() config.CameraLimitsConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config.Server.Limits
+}
+
+// admitCamera checks a camera connecting from addr against the connection
+// limits, and holds its place until release is called, once it has
+// connected or failed to. A camera replacing its own connection doesn't
+// count twice.
+func (s *Server) admitCamera(cameraID, addr string) (release func(), err error) {
+	limits := s.cameraLimits()
+	return s.cameras.Reserve(cameraID, addr, func(total, fromAddr int) error {
+		if limits.MaxConnections > 0 && total >= limits.MaxConnections {
+			s.limitMetrics.Violations.WithLabelValues(limitConnections).Inc()
+			return errTooManyCameras
+		}
+		if limits.MaxConnectionsPerIP > 0 && fromAddr >= limits.MaxConnectionsPerIP {
+			s.limitMetrics.Violations.WithLabelValues(limitConnectionsPerIP).Inc()
+			return errTooManyFromAddr
+		}
+		return nil
+	})
+}
+
+// refuseCamera answers a camera refused by admitCamera: 503 when the server
+// is full, 429 when its address has its share.
+func refuseCamera(c *gin.Context, err error) {
+	status := http.StatusServiceUnavailable
+	if errors.Is(err, errTooManyFromAddr) {
+		status = http.StatusTooManyRequests
+	}
+	c.Header("Retry-After", fmt.Sprint(int(connectionRetry.Seconds())))
+	c.JSON(status, gin.H{"error": err.Error()})
+}
+
+// frameRateLimit holds one connection to its camera's max_fps, allowing a
+// second's worth of frames at once. It is nil without a limit.
+type frameRateLimit struct {
+	limiter *ratelimit.Limiter
+	action  string
+	warned  bool // the camera has been logged as over the limit
+}
+
+func newFrameRateLimit(limits config.CameraLimitsConfig, cameraID string) *frameRateLimit {
+	fps := limits.PolicyFor(cameraID).MaxFPS
+	if fps <= 0 {
+		return nil
+	}
+	return &frameRateLimit{
+		limiter: ratelimit.New(fps, int(math.Ceil(fps))),
+		action:  limits.FrameRateAction,
+	}
+}
+
+// allow reports whether a camera's frame received at now is within the
+// limit.
+func (l *frameRateLimit) allow(cameraID string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	ok, _ := l.limiter.Allow(cameraID, now)
+	return ok
+}
+
+// resolutionLimits returns the resolution limits of the camera policies,
+// in their order so each camera keeps the policy config.PolicyFor gives.
+func resolutionLimits(limits config.CameraLimitsConfig) []processor.ResolutionLimit {
+	var out []processor.ResolutionLimit
+	for _, p := range limits.Cameras {
+		out = append(out, processor.ResolutionLimit{
+			Cameras:   p.Cameras,
+			MaxWidth:  p.MaxWidth,
+			MaxHeight: p.MaxHeight,
+			Drop:      p.ResolutionAction == config.ResolutionDrop,
+		})
+	}
+	return out
+}
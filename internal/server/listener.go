@@ -0,0 +1,168 @@
+// File: internal/server/listener.go
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/config"
+	"go.uber.org/zap"
+)
+
+// listener pairs an http.Server with where and how it is served.
+type listener struct {
+	name       string
+	srv        *http.Server
+	ssl        config.SSLConfig
+	socket     string
+	socketMode string
+	inherited  net.Listener
+}
+
+// address describes where the listener is bound, for logging.
+func (l *listener) address() string {
+	switch {
+	case l.inherited != nil:
+		return "systemd:" + l.inherited.Addr().String()
+	case l.socket != "":
+		return "unix:" + l.socket
+	default:
+		return l.srv.Addr
+	}
+}
+
+func (l *listener) listen() (net.Listener, error) {
+	if l.inherited != nil {
+		return l.inherited, nil
+	}
+	if l.socket == "" {
+		return net.Listen("tcp", l.srv.Addr)
+	}
+
+	// Remove a stale socket left behind by an unclean exit
+	if info, err := os.Stat(l.socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(l.socket)
+	}
+
+	ln, err := net.Listen("unix", l.socket)
+	if err != nil {
+		return nil, err
+	}
+	if l.socketMode != "" {
+		mode, _ := strconv.ParseUint(l.socketMode, 8, 32)
+		if err := os.Chmod(l.socket, os.FileMode(mode)); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("failed to set socket mode: %w", err)
+		}
+	}
+	return ln, nil
+}
+
+func (l *listener) serve() error {
+	ln, err := l.listen()
+	if err != nil {
+		return fmt.Errorf("%s listen error: %w", l.name, err)
+	}
+
+	if l.ssl.Enabled {
+		if l.srv.TLSConfig, err = clientAuth(l.ssl); err != nil {
+			ln.Close()
+			return fmt.Errorf("%s listener: %w", l.name, err)
+		}
+		err = l.srv.ServeTLS(ln, l.ssl.CertFile, l.ssl.KeyFile)
+	} else {
+		err = l.srv.Serve(ln)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("%s server error: %w", l.name, err)
+	}
+	return nil
+}
+
+// clientAuth returns the TLS settings that make clients present a
+// certificate signed by ssl's client CAs, or nil without any.
+func clientAuth(ssl config.SSLConfig) (*tls.Config, error) {
+	if ssl.ClientCAFile == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(ssl.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CAs: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", ssl.ClientCAFile)
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+func (s *Server) newListener(name string, port int, cfg config.ListenerConfig, handler http.Handler) *listener {
+	ssl := cfg.SSL
+	if !ssl.Enabled {
+		ssl = s.config.Server.SSL
+	}
+
+	return &listener{
+		name: name,
+		srv: &http.Server{
+			Addr:              fmt.Sprintf("%s:%d", s.config.Server.Host, port),
+			Handler:           handler,
+			ReadTimeout:       cfg.ReadTimeout,
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			WriteTimeout:      cfg.WriteTimeout,
+			IdleTimeout:       cfg.IdleTimeout,
+		},
+		ssl:        ssl,
+		socket:     cfg.Socket,
+		socketMode: cfg.SocketMode,
+	}
+}
+
+// listeners returns the HTTP servers to run: the operator API on port and
+// camera ingest on signal_port, or a single combined listener when both
+// ports are the same. Sockets handed over by systemd replace the configured
+// bind address of the listener with the matching name.
+func (s *Server) listeners(activated map[string]net.Listener) []*listener {
+	api := s.newListener("api", s.config.Server.Port, s.config.Server.API, s.apiRouter)
+	result := []*listener{api}
+	if s.config.Server.SignalPort != s.config.Server.Port {
+		ingest := s.newListener("ingest", s.config.Server.SignalPort, s.config.Server.Ingest, s.ingestRouter)
+		result = []*listener{ingest, api}
+	}
+
+	for _, l := range result {
+		if ln, ok := activated[l.name]; ok {
+			l.inherited = ln
+			delete(activated, l.name)
+		}
+	}
+	for name, ln := range activated {
+		s.logger.Warn("Ignoring unused activation socket", zap.String("name", name))
+		ln.Close()
+	}
+
+	return result
+}
+
+func (s *Server) shutdownListeners(listeners []*listener) {
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, l := range listeners {
+		if err := l.srv.Shutdown(shutdownCtx); err != nil {
+			s.logger.Error("Server shutdown error",
+				zap.String("listener", l.name),
+				zap.Error(err))
+		}
+	}
+}
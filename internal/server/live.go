@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/live"
+)
+
+// maxOffer bounds the size of an SDP offer.
+const maxOffer = 64 << 10
+
+// offerTimeout bounds answering an offer, which waits for ICE gathering.
+const offerTimeout = 10 * time.Second
+
+// handleWatch starts a WebRTC session for a camera. The body is the
+// browser's SDP offer (application/sdp); the response is the answer, with
+// the session's URL in Location for ending it. This follows WHEP, so WHEP
+// players work too.
+func (s *Server) handleWatch(c *gin.Context) {
+	cameraID := c.Param("id")
+	if !s.liveCamera(cameraID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "camera not found"})
+		return
+	}
+	offer, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxOffer))
+	if err != nil || len(offer) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "SDP offer required"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), offerTimeout)
+	defer cancel()
+	id, answer, err := s.live.Watch(ctx, cameraID, string(offer))
+	switch {
+	case err == nil:
+	case errors.Is(err, live.ErrInvalidOffer):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, live.ErrTooManySessions):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "timed out answering the offer"})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Location", c.Request.URL.Path+"/"+id)
+	c.Data(http.StatusCreated, "application/sdp", []byte(answer))
+}
+
+// liveCamera reports whether a camera has live frames to watch: it is
+// connected or pulled here, or connected to another node of the cluster.
+func (s *Server) liveCamera(cameraID string) bool {
+	if slices.Contains(s.cameraIDs(), cameraID) {
+		return true
+	}
+	if s.cluster != nil {
+		_, ok := s.cluster.NodeOf(cameraID)
+		return ok
+	}
+	return false
+}
+
+// handleStopWatching ends a WebRTC session.
+func (s *Server) handleStopWatching(c *gin.Context) {
+	err := s.live.Close(c.Param("session"))
+	if errors.Is(err, live.ErrNoSession) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/detect"
+	"github.com/raeeceip/cctv/internal/events"
+	"github.com/raeeceip/cctv/internal/framemeta"
+	"github.com/raeeceip/cctv/internal/index"
+	"github.com/raeeceip/cctv/internal/motion"
+	"github.com/raeeceip/cctv/internal/schedule"
+	"go.uber.org/zap"
+)
+
+// bindMotionSettings reads settings from the request body. Omitted fields
+// keep their defaults.
+func bindMotionSettings(c *gin.Context) (motion.Settings, bool) {
+	settings := motion.DefaultSettings()
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return settings, false
+	}
+	if err := settings.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return settings, false
+	}
+	return settings, true
+}
+
+func (s *Server) handleGetMotion(c *gin.Context) {
+	settings, err := s.index.MotionSettings(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
+
+func (s *Server) handlePutMotion(c *gin.Context) {
+	settings, ok := bindMotionSettings(c)
+	if !ok {
+		return
+	}
+
+	data, err := json.Marshal(settings)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.index.SaveCameraMotion(c.Request.Context(), c.Param("id"), string(data)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if s.detector != nil {
+		s.detector.Invalidate(c.Param("id"))
+	}
+	c.JSON(http.StatusOK, settings)
+}
+
+// handleMotionPreview renders the detection mask over the camera's latest
+// frame. GET uses the saved settings; POST previews the settings in the
+// body without saving them, for live tuning.
+func (s *Server) handleMotionPreview(c *gin.Context) {
+	cameraID := c.Param("id")
+
+	var settings motion.Settings
+	if c.Request.Method == http.MethodPost {
+		var ok bool
+		if settings, ok = bindMotionSettings(c); !ok {
+			return
+		}
+	} else {
+		var err error
+		if settings, err = s.index.MotionSettings(c.Request.Context(), cameraID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	ref, cur, ok := s.snapshots.Get(cameraID)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no frames received from camera"})
+		return
+	}
+
+	_, prev, err := motion.DecodeGray(ref.Data)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	img, gray, err := motion.DecodeGray(cur.Data)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := motion.Detect(prev, gray, settings)
+	if err != nil {
+		// Resolution changed between the two frames; compare the latest
+		// with itself so the zones can still be previewed
+		res, _ = motion.Detect(gray, gray, settings)
+	}
+
+	preview, err := motion.RenderPreview(img, res, settings)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("X-Motion", strconv.FormatBool(res.Motion))
+	c.Header("X-Motion-Changed", strconv.FormatFloat(res.Changed, 'f', 4, 64))
+	c.Header("X-Motion-Largest-Blob", strconv.FormatFloat(res.LargestBlob, 'f', 4, 64))
+	c.Header("X-Motion-Blobs", strconv.Itoa(res.Blobs))
+	c.Header("X-Frame-Time", cur.Time.Format("2006-01-02T15:04:05.000Z07:00"))
+	c.Data(http.StatusOK, "image/jpeg", preview)
+}
+
+// recordMotion stores a motion event in the index and publishes it, unless
+// a schedule pauses alerts for the camera.
+func (s *Server) recordMotion(e detect.MotionEvent) {
+	stored := index.MotionEvent{CameraID: e.CameraID, Time: e.Time, Box: e.Box, Intensity: e.Intensity, Zone: e.Zone}
+	if err := s.index.AddMotionEvent(context.Background(), &stored); err != nil {
+		s.logger.Error("Failed to index motion event",
+			zap.String("camera", e.CameraID),
+			zap.Error(err))
+	}
+	if e.Frame != "" {
+		d := framemeta.Detection{Type: "motion", Box: e.Box, Intensity: e.Intensity, Zone: e.Zone}
+		if err := framemeta.AddDetection(e.Frame, d); err != nil {
+			s.logger.Warn("Failed to add motion to frame metadata",
+				zap.String("camera", e.CameraID),
+				zap.String("path", e.Frame),
+				zap.Error(err))
+		}
+	}
+	if s.schedule.Paused(e.CameraID, schedule.Alerts, e.Time) {
+		return
+	}
+	s.events.Publish(events.New(events.MotionDetected, e.CameraID, stored))
+}
+
+// handleListMotionEvents searches the stored motion events, newest first.
+// Query parameters: camera, site, since, until and limit, as for
+// recordings.
+func (s *Server) handleListMotionEvents(c *gin.Context) {
+	q, ok := bindRecordingQuery(c)
+	if !ok {
+		return
+	}
+	found, err := s.index.ListMotionEvents(c.Request.Context(), index.MotionQuery{
+		CameraID: q.CameraID,
+		Site:     q.Site,
+		Since:    q.Since,
+		Until:    q.Until,
+		Limit:    q.Limit,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if found == nil {
+		found = []index.MotionEvent{}
+	}
+	c.JSON(http.StatusOK, gin.H{"events": found})
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"github.com/raeeceip/cctv/internal/events"
+	"github.com/raeeceip/cctv/internal/framemeta"
+	"github.com/raeeceip/cctv/internal/objects"
+	"github.com/raeeceip/cctv/internal/schedule"
+	"go.uber.org/zap"
+)
+
+// recordObjects adds the objects found in a frame to its metadata and
+// publishes them, unless a schedule pauses alerts for the camera.
+func (s *Server) recordObjects(e objects.Event) {
+	if e.Frame != "" {
+		ds := make([]framemeta.Detection, len(e.Objects))
+		for i, o := range e.Objects {
+			ds[i] = framemeta.Detection{Type: "object", Box: o.Box, Label: o.Label, Score: o.Score}
+		}
+		if err := framemeta.AddDetection(e.Frame, ds...); err != nil {
+			s.logger.Warn("Failed to add objects to frame metadata",
+				zap.String("camera", e.CameraID),
+				zap.String("path", e.Frame),
+				zap.Error(err))
+		}
+	}
+	if s.schedule.Paused(e.CameraID, schedule.Alerts, e.Time) {
+		return
+	}
+	s.events.Publish(events.New(events.ObjectsDetected, e.CameraID, e))
+}
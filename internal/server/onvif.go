@@ -0,0 +1,27 @@
+package server
+
+import (
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleONVIF answers the SOAP requests of NVR software to a camera's
+// ONVIF services.
+func (s *Server) handleONVIF(c *gin.Context) {
+	s.onvif.Serve(c.Writer, c.Request, c.Param("camera"), c.Param("service"))
+}
+
+// cameraIDs lists the cameras connected to the server and those it pulls
+// from, connected or not, as handleListCameras does.
+func (s *Server) cameraIDs() []string {
+	var ids []string
+	for _, cam := range s.cameras.List() {
+		ids = append(ids, cam.ID)
+	}
+	if s.rtsp != nil {
+		ids = append(ids, s.rtsp.Cameras()...)
+	}
+	sort.Strings(ids)
+	return ids
+}
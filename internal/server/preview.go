@@ -0,0 +1,171 @@
+package server
+
+import (
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/processor"
+	"go.uber.org/zap"
+)
+
+// previewFrame is a frame sent to a preview.
+type previewFrame struct {
+	Number uint64
+	Time   time.Time
+	Data   []byte
+}
+
+// preview is one client watching a camera's MJPEG preview. It holds only
+// the latest frame, so a slow client skips frames instead of falling behind.
+type preview struct {
+	frames  chan previewFrame
+	dropped int // guarded by previews.mu
+}
+
+// previews fans stored frames out to the clients watching each camera.
+type previews struct {
+	mu      sync.Mutex
+	cameras map[string]map[*preview]struct{}
+}
+
+func (ps *previews) subscribe(cameraID string) *preview {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.cameras == nil {
+		ps.cameras = make(map[string]map[*preview]struct{})
+	}
+	if ps.cameras[cameraID] == nil {
+		ps.cameras[cameraID] = make(map[*preview]struct{})
+	}
+	p := &preview{frames: make(chan previewFrame, 1)}
+	ps.cameras[cameraID][p] = struct{}{}
+	return p
+}
+
+// unsubscribe removes a preview and returns how many frames it dropped.
+func (ps *previews) unsubscribe(cameraID string, p *preview) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	delete(ps.cameras[cameraID], p)
+	if len(ps.cameras[cameraID]) == 0 {
+		delete(ps.cameras, cameraID)
+	}
+	return p.dropped
+}
+
+// publish hands a saved frame to the camera's previews without blocking,
+// replacing a frame a preview hasn't sent yet.
+func (ps *previews) publish(f processor.FrameData) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	subs := ps.cameras[f.CameraID]
+	if len(subs) == 0 {
+		return
+	}
+
+	// Data is recycled once the hook returns
+	frame := previewFrame{Number: f.Number, Time: f.Timestamp, Data: append([]byte(nil), f.Data...)}
+	for p := range subs {
+		select {
+		case <-p.frames:
+			p.dropped++
+		default:
+		}
+		select {
+		case p.frames <- frame:
+		default:
+		}
+	}
+}
+
+// handleLivePreview streams a camera's frames as MJPEG, a
+// multipart/x-mixed-replace response that browsers show in an <img>. It
+// starts with the latest cached frame, if any, and then sends frames as the
+// processor stores them. A client that can't keep up gets the latest frame
+// each time it is ready for one. With ?crop= and ?zoom= each client gets
+// just the part of the frames it asked for; frames the crop misses are
+// skipped.
+func (s *Server) handleLivePreview(c *gin.Context) {
+	cameraID := c.Param("cameraID")
+	crop, ok := bindCrop(c)
+	if !ok {
+		return
+	}
+	p := s.previews.subscribe(cameraID)
+	defer func() {
+		dropped := s.previews.unsubscribe(cameraID, p)
+		s.logger.Info("Live preview ended",
+			zap.String("camera", cameraID),
+			zap.String("remote", c.ClientIP()),
+			zap.Int("dropped", dropped))
+	}()
+
+	mw := multipart.NewWriter(c.Writer)
+	c.Header("Content-Type", "multipart/x-mixed-replace; boundary="+mw.Boundary())
+	c.Header("Cache-Control", "no-cache, no-store")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	s.logger.Info("Live preview started",
+		zap.String("camera", cameraID),
+		zap.String("remote", c.ClientIP()))
+
+	var last uint64
+	write := func(f previewFrame) error {
+		if !crop.Whole() {
+			data, err := crop.JPEG(f.Data, transformQuality)
+			if err != nil {
+				// The camera's resolution may have changed under the crop
+				s.logger.Debug("Failed to crop live preview frame",
+					zap.String("camera", cameraID),
+					zap.Error(err))
+				return nil
+			}
+			f.Data = data
+		}
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", "image/jpeg")
+		h.Set("Content-Length", strconv.Itoa(len(f.Data)))
+		h.Set("X-Frame-Number", strconv.FormatUint(f.Number, 10))
+		h.Set("X-Frame-Time", f.Time.Format(time.RFC3339Nano))
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		if _, err := part.Write(f.Data); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		last = f.Number
+		return nil
+	}
+
+	if f, ok := s.frameCache.At(cameraID, time.Time{}); ok {
+		if err := write(previewFrame{Number: f.Number, Time: f.Time, Data: f.Data}); err != nil {
+			return
+		}
+	}
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-s.shutdown:
+			mw.Close()
+			return
+		case f := <-p.frames:
+			if f.Number == last {
+				// Already sent from the cache
+				continue
+			}
+			if err := write(f); err != nil {
+				return
+			}
+		}
+	}
+}
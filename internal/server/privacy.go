@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/privacy"
+	"go.uber.org/zap"
+)
+
+// cameraPrivacy returns the saved privacy masks of a camera.
+func (s *Server) cameraPrivacy(ctx context.Context, cameraID string) (privacy.Masks, error) {
+	var masks privacy.Masks
+	profile, err := s.index.GetCameraProfile(ctx, cameraID)
+	if err != nil {
+		return nil, err
+	}
+	if profile.Privacy != "" {
+		if err := json.Unmarshal([]byte(profile.Privacy), &masks); err != nil {
+			return nil, fmt.Errorf("invalid saved privacy masks: %w", err)
+		}
+	}
+	return masks, nil
+}
+
+// masksFor returns the masks of a camera, those configured followed by
+// those saved, reading the saved ones from the index the first time. It
+// fails if they can't be read, and the next frame tries again.
+func (s *Server) masksFor(cameraID string) (privacy.Masks, error) {
+	s.mu.RLock()
+	masks := s.config.Privacy.MasksFor(cameraID)
+	s.mu.RUnlock()
+
+	saved, ok := s.privacy.Load(cameraID)
+	if !ok {
+		loaded, err := s.cameraPrivacy(context.Background(), cameraID)
+		if err != nil {
+			return nil, err
+		}
+		// Masks saved meanwhile win
+		saved, _ = s.privacy.LoadOrStore(cameraID, loaded)
+	}
+	return append(masks, saved.(privacy.Masks)...), nil
+}
+
+// cameraMasks is a camera's privacy masks as the API shows them.
+type cameraMasks struct {
+	// Masks are saved through the API
+	Masks privacy.Masks `json:"masks"`
+	// Configured are set in the configuration file, and apply too
+	Configured privacy.Masks `json:"configured"`
+}
+
+func (s *Server) handleGetPrivacy(c *gin.Context) {
+	cameraID := c.Param("id")
+	masks, err := s.cameraPrivacy(c.Request.Context(), cameraID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.mu.RLock()
+	configured := s.config.Privacy.MasksFor(cameraID)
+	s.mu.RUnlock()
+	c.JSON(http.StatusOK, cameraMasks{Masks: nonNil(masks), Configured: nonNil(configured)})
+}
+
+// handlePutPrivacy saves a camera's privacy masks, replacing those saved
+// before. They apply to the frames received from then on.
+func (s *Server) handlePutPrivacy(c *gin.Context) {
+	var body struct {
+		Masks privacy.Masks `json:"masks"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := body.Masks.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	masks := nonNil(body.Masks)
+	data, err := json.Marshal(masks)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	cameraID := c.Param("id")
+	if err := s.index.SaveCameraPrivacy(c.Request.Context(), cameraID, string(data)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.privacy.Store(cameraID, masks)
+	s.logger.Info("Camera privacy masks saved", zap.String("camera", cameraID), zap.Int("masks", len(masks)))
+
+	s.mu.RLock()
+	configured := s.config.Privacy.MasksFor(cameraID)
+	s.mu.RUnlock()
+	c.JSON(http.StatusOK, cameraMasks{Masks: masks, Configured: nonNil(configured)})
+}
+
+// nonNil returns masks, or an empty list for none, so it shows as [].
+func nonNil(masks privacy.Masks) privacy.Masks {
+	if masks == nil {
+		return privacy.Masks{}
+	}
+	return masks
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/raeeceip/cctv/internal/codec"
+	"github.com/raeeceip/cctv/internal/wire"
+	"go.uber.org/zap"
+)
+
+// negotiateProtocol picks the protocol version of a connecting camera from
+// the one it declares and those the server accepts. An error means the
+// camera can't connect with any of them. Cameras that declare
+// none predate versioning; their version is implied by the frame format
+// they offer, and their capabilities are only known once the subprotocol
+// is negotiated, so Version is 0.
+func (s *Server) negotiateProtocol(c *gin.Context) (wire.Capabilities, error) {
+	s.mu.RLock()
+	accepted := s.config.Server.ProtocolVersions
+	s.mu.RUnlock()
+
+	declared := c.GetHeader(wire.VersionHeader)
+	if declared == "" {
+		declared = c.Query("version")
+	}
+	if declared == "" {
+		implied := wire.VersionJSON
+		if slices.Contains(websocket.Subprotocols(c.Request), wire.BinaryProtocol) {
+			implied = wire.VersionBinary
+		}
+		if !slices.Contains(accepted, implied) {
+			return wire.Capabilities{}, fmt.Errorf("unsupported protocol version %d (implied by the frame format), the server accepts versions %s",
+				implied, wire.FormatVersions(accepted))
+		}
+		return wire.Capabilities{}, nil
+	}
+
+	version, err := wire.ParseVersion(declared)
+	if err != nil {
+		return wire.Capabilities{}, err
+	}
+	if version, err = wire.Negotiate(version, accepted); err != nil {
+		return wire.Capabilities{}, err
+	}
+	return wire.CapabilitiesOf(version), nil
+}
+
+// acceptsWebP reports whether the server accepts WebP frames from cameras
+// that ask for them.
+func (s *Server) acceptsWebP() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Contains(s.config.Server.FrameEncodings, codec.WebP)
+}
+
+// refuseProtocol answers a camera that can't connect with any accepted
+// protocol version, listing them in the version header.
+func (s *Server) refuseProtocol(c *gin.Context, err error) {
+	s.mu.RLock()
+	accepted := s.config.Server.ProtocolVersions
+	s.mu.RUnlock()
+	c.Header(wire.VersionHeader, wire.FormatVersions(accepted))
+	c.JSON(http.StatusUpgradeRequired, gin.H{"error": err.Error(), "versions": accepted})
+}
+
+// frameFormatError describes a frame message in a format the connection's
+// protocol version doesn't send.
+func frameFormatError(messageType int, caps wire.Capabilities) string {
+	if messageType == websocket.BinaryMessage {
+		return fmt.Sprintf("binary frames need protocol version %d or later, connected with %d", wire.VersionBinary, caps.Version)
+	}
+	return fmt.Sprintf("JSON frames are sent with protocol version %d, connected with %d", wire.VersionJSON, caps.Version)
+}
+
+// helloOf is the server's hello for a connection with caps.
+func (s *Server) helloOf(caps wire.Capabilities) wire.Hello {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h := wire.NewHello(caps)
+	h.Versions = s.config.Server.ProtocolVersions
+	return h
+}
+
+// handleHello renegotiates a connection with a camera's hello and replies
+// with the result. The camera may speak an older version than the
+// handshake settled on, or give up capabilities, but gain none besides
+// WebP, which it has to ask for. An error means nothing acceptable is left
+// and the connection should close.
+func (s *Server) handleHello(cameraID string, conn *websocket.Conn, caps *wire.Capabilities, h wire.Hello) error {
+	s.mu.RLock()
+	accepted := s.config.Server.ProtocolVersions
+	s.mu.RUnlock()
+
+	next := *caps
+	if proto := h.Proto; proto > 0 && proto != caps.Version {
+		if caps.Version > 0 {
+			proto = min(proto, caps.Version)
+		}
+		version, err := wire.Negotiate(proto, accepted)
+		if err != nil {
+			return err
+		}
+		next = wire.CapabilitiesOf(version)
+	}
+	next.WebP = s.acceptsWebP()
+	next = next.Restrict(h)
+	if !next.JSONFrames && !next.BinaryFrames {
+		return errors.New("hello leaves no frame format to send")
+	}
+
+	if next != *caps {
+		*caps = next
+		s.cameras.SetProtocol(cameraID, conn, next)
+		s.logger.Info("Camera renegotiated protocol",
+			zap.String("camera", cameraID),
+			zap.Int("version", next.Version),
+			zap.Strings("capabilities", next.Names()))
+	}
+	return s.cameras.SendHello(cameraID, conn, s.helloOf(next))
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/ratelimit"
+	"github.com/raeeceip/cctv/pkg/logger"
+	"github.com/raeeceip/cctv/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// rateLimitPolicy is a configured policy with its clients' buckets.
+type rateLimitPolicy struct {
+	config.RateLimitPolicy
+	limiter *ratelimit.Limiter
+}
+
+// rateLimits holds the policies of the API routes, keyed by "METHOD path"
+// or, for policies covering every method, by path.
+type rateLimits struct {
+	routes  map[string][]*rateLimitPolicy
+	metrics *metrics.RateLimitMetrics
+}
+
+// newRateLimits returns nil when no policy is configured.
+func newRateLimits(policies []config.RateLimitPolicy) *rateLimits {
+	if len(policies) == 0 {
+		return nil
+	}
+	rl := &rateLimits{
+		routes:  make(map[string][]*rateLimitPolicy),
+		metrics: metrics.NewRateLimitMetrics(),
+	}
+	for _, cfg := range policies {
+		p := &rateLimitPolicy{RateLimitPolicy: cfg, limiter: ratelimit.New(cfg.Rate, cfg.Burst)}
+		for _, route := range cfg.Routes {
+			rl.routes[route] = append(rl.routes[route], p)
+		}
+	}
+	return rl
+}
+
+// middleware refuses requests to limited routes from clients that have
+// used up their bucket, with 429 and a Retry-After header.
+func (rl *rateLimits) middleware(key func(*gin.Context, string) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.FullPath()
+		if route == "" {
+			return
+		}
+		now := time.Now()
+		for _, p := range rl.policies(c.Request.Method, route) {
+			ok, wait := p.limiter.Allow(key(c, p.Key), now)
+			if ok {
+				continue
+			}
+			retry := max(int(math.Ceil(wait.Seconds())), 1)
+			rl.metrics.Limited.WithLabelValues(p.Name).Inc()
+			c.Header("Retry-After", strconv.Itoa(retry))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error":       "rate limit exceeded",
+				"policy":      p.Name,
+				"retry_after": retry,
+			})
+			return
+		}
+	}
+}
+
+// policies returns the policies of a route for a method. The slices in
+// routes are shared by every request and must not be appended to.
+func (rl *rateLimits) policies(method, route string) []*rateLimitPolicy {
+	byMethod, any := rl.routes[method+" "+route], rl.routes[route]
+	if len(byMethod) == 0 {
+		return any
+	}
+	if len(any) == 0 {
+		return byMethod
+	}
+	return append(append([]*rateLimitPolicy(nil), byMethod...), any...)
+}
+
+// rateLimitKey tells clients apart by IP, or by bearer token when the
+// policy's key is "token" and the request has a valid admin, user or camera
+// token. Anything else would let a client get a fresh bucket per request by
+// making tokens up. Tokens are hashed so they aren't kept in memory in the
+// clear.
+func (s *Server) rateLimitKey(c *gin.Context, key string) string {
+	if key == "token" {
+		if provided := bearerToken(c); provided != "" && s.validToken(c, provided) {
+			return "token:" + hashToken(provided)
+		}
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// validToken reports whether provided is the admin token or an issued,
+// unexpired user or camera token. Lookup errors count as invalid.
+func (s *Server) validToken(c *gin.Context, provided string) bool {
+	ctx := c.Request.Context()
+	switch {
+	case s.isAdminToken(c):
+		return true
+	case strings.HasPrefix(provided, tokenPrefix):
+		token, _, err := s.index.TokenByHash(ctx, hashToken(provided))
+		return err == nil && !token.Expired(time.Now())
+	case strings.HasPrefix(provided, cameraTokenPrefix):
+		_, err := s.index.CameraTokenByHash(ctx, hashToken(provided))
+		return err == nil
+	}
+	return false
+}
+
+// warnUnknownRoutes logs the configured routes that match no API route,
+// which are most likely typos.
+func (rl *rateLimits) warnUnknownRoutes(routes gin.RoutesInfo, log *logger.Logger) {
+	known := make(map[string]bool)
+	for _, r := range routes {
+		known[r.Path] = true
+		known[r.Method+" "+r.Path] = true
+	}
+	for route, policies := range rl.routes {
+		if !known[route] {
+			log.Warn("Rate limited route does not exist",
+				zap.String("policy", policies[0].Name),
+				zap.String("route", route))
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/avsync"
+	"github.com/raeeceip/cctv/internal/index"
+	"github.com/raeeceip/cctv/internal/retention"
+	"github.com/raeeceip/cctv/internal/thumbnail"
+)
+
+// trashedRecording is a recording in the trash and when it will be purged.
+type trashedRecording struct {
+	index.Recording
+	PurgeAfter time.Time `json:"purge_after"`
+}
+
+// bindRecordingQuery reads the query parameters of a recording search:
+// camera, site, since and until (RFC 3339; from and to are accepted for
+// them) and limit (default 100). It answers 400 and returns false if one is
+// invalid.
+func bindRecordingQuery(c *gin.Context) (index.RecordingQuery, bool) {
+	q := index.RecordingQuery{CameraID: c.Query("camera"), Site: c.Query("site"), Limit: 100}
+
+	var err error
+	for _, name := range []string{"since", "from"} {
+		if v := c.Query(name); v != "" {
+			if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + name})
+				return q, false
+			}
+		}
+	}
+	for _, name := range []string{"until", "to"} {
+		if v := c.Query(name); v != "" {
+			if q.Until, err = time.Parse(time.RFC3339, v); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + name})
+				return q, false
+			}
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return q, false
+		}
+	}
+	return q, true
+}
+
+// handleListRecordings searches the index; see bindRecordingQuery for the
+// query parameters.
+func (s *Server) handleListRecordings(c *gin.Context) {
+	q, ok := bindRecordingQuery(c)
+	if !ok {
+		return
+	}
+
+	recordings, err := s.index.ListRecordings(c.Request.Context(), q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if recordings == nil {
+		recordings = []index.Recording{}
+	}
+	c.JSON(http.StatusOK, gin.H{"recordings": recordings})
+}
+
+func (s *Server) handleGetRecording(c *gin.Context) {
+	r, ok := s.lookupRecording(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, r)
+}
+
+// recordingTypes are the content types of recording files by extension.
+// Go's built-in table lacks most video types, and sniffing only looks at the
+// first bytes of the file.
+var recordingTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".mov":  "video/quicktime",
+	".mkv":  "video/x-matroska",
+	".webm": "video/webm",
+	".avi":  "video/x-msvideo",
+	".ts":   "video/mp2t",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+}
+
+// handleRecordingFile serves the video or image of a recording. It answers
+// range requests, so players can seek without downloading the whole file,
+// and conditional requests on the ETag and modification time. Retention
+// transcodes replace files in place, which changes both.
+func (s *Server) handleRecordingFile(c *gin.Context) {
+	r, ok := s.lookupRecording(c)
+	if !ok {
+		return
+	}
+	serveRecordingFile(c, r)
+}
+
+// serveRecordingFile serves the file of r; see handleRecordingFile.
+func serveRecordingFile(c *gin.Context, r *index.Recording) {
+	f, err := os.Open(r.Path)
+	if os.IsNotExist(err) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "recording file is missing"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	name := filepath.Base(r.Path)
+	h := c.Writer.Header()
+	if ct, ok := recordingTypes[strings.ToLower(filepath.Ext(name))]; ok {
+		h.Set("Content-Type", ct)
+	}
+	h.Set("ETag", fmt.Sprintf(`"%d-%x-%x"`, r.ID, info.Size(), info.ModTime().UnixNano()))
+	h.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": name}))
+	http.ServeContent(c.Writer, c.Request, name, info.ModTime(), f)
+}
+
+// handleRecordingThumbnail serves the thumbnail of a recording, a still of
+// its middle frame, or with ?format=gif its animated preview. Single-frame
+// recordings are their own thumbnail. Videos from before thumbnails were
+// made, and imported ones, have none.
+func (s *Server) handleRecordingThumbnail(c *gin.Context) {
+	r, ok := s.lookupRecording(c)
+	if !ok {
+		return
+	}
+	var path string
+	switch format := c.DefaultQuery("format", "jpeg"); {
+	case format == "jpeg" && r.Codec == "jpeg":
+		serveRecordingFile(c, r)
+		return
+	case format == "jpeg":
+		path = thumbnail.StillPath(r.Path)
+	case format == "gif" && r.Codec != "jpeg":
+		path = thumbnail.PreviewPath(r.Path)
+	case format == "gif":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "recording is a single frame"})
+		return
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be jpeg or gif"})
+		return
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "recording has no thumbnail"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	http.ServeContent(c.Writer, c.Request, filepath.Base(path), info.ModTime(), f)
+}
+
+// handleRecordingAVSync measures the A/V offset of a recording made with the
+// simulator's avsync pattern.
+func (s *Server) handleRecordingAVSync(c *gin.Context) {
+	r, ok := s.lookupRecording(c)
+	if !ok {
+		return
+	}
+	if r.Codec == "jpeg" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "recording is a single frame"})
+		return
+	}
+
+	report, err := avsync.Analyze(c.Request.Context(), r.Path)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// handleDeleteRecording moves a recording to the trash. It is purged by
+// retention after storage.retention.trash_grace unless restored. Recordings
+// within storage.retention.worm answer 423 until it ends.
+func (s *Server) handleDeleteRecording(c *gin.Context) {
+	r, ok := s.lookupRecording(c)
+	if !ok {
+		return
+	}
+	err := s.retention.Trash(c.Request.Context(), r)
+	if errors.Is(err, retention.ErrLocked) {
+		c.JSON(http.StatusLocked, gin.H{"error": err.Error(), "locked_until": s.retention.LockedUntil(*r)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, trashedRecording{Recording: *r, PurgeAfter: s.retention.PurgeAfter(*r)})
+}
+
+// handleListTrash lists the trash, most recent recordings first.
+func (s *Server) handleListTrash(c *gin.Context) {
+	recordings, err := s.index.ListRecordings(c.Request.Context(), index.RecordingQuery{
+		CameraID: c.Query("camera"),
+		Site:     c.Query("site"),
+		Trashed:  true,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	trash := []trashedRecording{}
+	for _, r := range recordings {
+		trash = append(trash, trashedRecording{Recording: r, PurgeAfter: s.retention.PurgeAfter(r)})
+	}
+	c.JSON(http.StatusOK, gin.H{"recordings": trash})
+}
+
+// handleRestoreRecording takes a recording out of the trash.
+func (s *Server) handleRestoreRecording(c *gin.Context) {
+	id, ok := recordingID(c)
+	if !ok {
+		return
+	}
+
+	r, err := s.retention.Restore(c.Request.Context(), id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "recording not in trash"})
+	case errors.Is(err, retention.ErrPathTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, r)
+	}
+}
+
+func recordingID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid recording id"})
+		return 0, false
+	}
+	return id, true
+}
+
+func (s *Server) lookupRecording(c *gin.Context) (*index.Recording, bool) {
+	id, ok := recordingID(c)
+	if !ok {
+		return nil, false
+	}
+
+	r, err := s.index.GetRecording(c.Request.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "recording not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return r, true
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/events"
+	"github.com/raeeceip/cctv/internal/replication"
+	"go.uber.org/zap"
+)
+
+// requireReplication checks the bearer token against
+// replication.accept_token.
+func (s *Server) requireReplication() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s.mu.RLock()
+		token := s.config.Replication.AcceptToken
+		s.mu.RUnlock()
+
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "replication not accepted"})
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(bearerToken(c)), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid replication token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// cameraKey is the context key requireCamera sets the camera ID under.
+const cameraKey = "camera"
+
+// requireCamera checks that the request carries a camera's token or
+// certificate, whatever server.auth.required says.
+func (s *Server) requireCamera() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cameraID, err := s.authenticateCamera(c)
+		if errors.Is(err, errCameraAuth) || err == nil && cameraID == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "camera token required"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Set(cameraKey, cameraID)
+		c.Next()
+	}
+}
+
+// uploadTarget returns the receiver and origin of an upload: the camera
+// receiver and the camera's ID for a camera's own uploads, otherwise the
+// replica receiver and the origin in the path.
+func (s *Server) uploadTarget(c *gin.Context) (*replication.Receiver, string) {
+	if cameraID := c.GetString(cameraKey); cameraID != "" {
+		return s.uploads, cameraID
+	}
+	return s.replicas, c.Param("origin")
+}
+
+// handleUploadOffset reports how much of an upload has been received.
+func (s *Server) handleUploadOffset(c *gin.Context) {
+	receiver, origin := s.uploadTarget(c)
+	offset, err := receiver.Offset(origin, c.Param("name"))
+	if err != nil {
+		replicationError(c, err, offset)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"offset": offset})
+}
+
+// handleUploadChunk appends the request body to an upload at the offset in
+// the Upload-Offset header. The body is the chunk itself, or a
+// multipart/form-data form with the chunk in its file part, as browsers and
+// curl -F send; either is written to disk as it arrives.
+func (s *Server) handleUploadChunk(c *gin.Context) {
+	offset, err := strconv.ParseInt(c.GetHeader(replication.OffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + replication.OffsetHeader})
+		return
+	}
+
+	var body io.Reader = c.Request.Body
+	if c.ContentType() == "multipart/form-data" {
+		part, err := multipartFile(c.Request, "file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer part.Close()
+		body = part
+	}
+	receiver, origin := s.uploadTarget(c)
+	offset, err = receiver.Append(origin, c.Param("name"), offset, body)
+	if err != nil {
+		replicationError(c, err, offset)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"offset": offset})
+}
+
+// handleCompleteUpload indexes a fully uploaded recording. A camera's
+// uploads are filed under its own ID, whatever origin they name.
+func (s *Server) handleCompleteUpload(c *gin.Context) {
+	var done replication.Completion
+	if err := c.ShouldBindJSON(&done); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	receiver, origin := s.uploadTarget(c)
+	if receiver == s.uploads {
+		done.Origin = origin
+	}
+	r, err := receiver.Complete(c.Request.Context(), done)
+	if err != nil {
+		replicationError(c, err, 0)
+		return
+	}
+	if receiver == s.uploads {
+		s.logger.Info("Received camera upload",
+			zap.String("camera", r.CameraID),
+			zap.Int64("recording", r.ID))
+	} else {
+		s.logger.Info("Received replica",
+			zap.String("origin", done.Origin),
+			zap.Int64("origin_id", done.Recording.ID),
+			zap.Int64("recording", r.ID))
+	}
+	s.events.Publish(events.New(events.RecordingCreated, r.CameraID, r))
+	c.JSON(http.StatusOK, r)
+}
+
+func replicationError(c *gin.Context, err error, offset int64) {
+	switch {
+	case errors.Is(err, replication.ErrInvalidName):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, replication.ErrOffset):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "offset": offset})
+	case errors.Is(err, replication.ErrIncomplete):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, replication.ErrChecksum):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case tooLarge(err):
+		// What arrived before the limit was kept
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request body too large", "offset": offset})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/index"
+)
+
+// dailyReportColumns head the CSV form of the daily report.
+var dailyReportColumns = []string{"day", "camera_id", "recordings", "recorded_hours",
+	"gap_minutes", "motion_minutes", "storage_bytes"}
+
+// handleDailyReport lists the per-camera statistics of each day rolled up
+// so far. Query parameters: camera, site, and from and to as days
+// (YYYY-MM-DD, inclusive). ?format=csv downloads them as CSV.
+func (s *Server) handleDailyReport(c *gin.Context) {
+	q := index.DailyStatsQuery{CameraID: c.Query("camera"), Site: c.Query("site")}
+	for _, p := range []struct {
+		name string
+		day  *string
+	}{{"from", &q.From}, {"to", &q.To}} {
+		if v := c.Query(p.name); v != "" {
+			if _, err := time.Parse(index.DayLayout, v); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + p.name + ", expected YYYY-MM-DD"})
+				return
+			}
+			*p.day = v
+		}
+	}
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+		return
+	}
+
+	stats, err := s.index.ListDailyStats(c.Request.Context(), q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if format == "json" {
+		if stats == nil {
+			stats = []index.DailyStats{}
+		}
+		c.JSON(http.StatusOK, gin.H{"days": stats})
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="daily-report.csv"`)
+	w := csv.NewWriter(c.Writer)
+	w.Write(dailyReportColumns)
+	for _, st := range stats {
+		w.Write([]string{
+			st.Day,
+			st.CameraID,
+			strconv.Itoa(st.Recordings),
+			strconv.FormatFloat(st.RecordedHours, 'f', 2, 64),
+			strconv.FormatFloat(st.GapMinutes, 'f', 1, 64),
+			strconv.Itoa(st.MotionMinutes),
+			strconv.FormatInt(st.StorageBytes, 10),
+		})
+	}
+	w.Flush()
+}
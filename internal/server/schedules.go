@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/schedule"
+)
+
+// handleSchedules shows the calendars as last fetched and the pauses open
+// now or starting within ?hours= (default 24, at most a week).
+func (s *Server) handleSchedules(c *gin.Context) {
+	if s.schedule == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no schedules configured"})
+		return
+	}
+	hours := 24
+	if v := c.Query("hours"); v != "" {
+		var err error
+		if hours, err = strconv.Atoi(v); err != nil || hours <= 0 || hours > 7*24 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid hours"})
+			return
+		}
+	}
+
+	now := time.Now()
+	pauses := s.schedule.Pauses(now, now.Add(time.Duration(hours)*time.Hour))
+	if pauses == nil {
+		pauses = []schedule.Pause{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"calendars": s.schedule.Calendars(),
+		"pauses":    pauses,
+		"time":      now,
+	})
+}
+
+// handleRefreshSchedules fetches the calendars again without waiting for
+// schedules.refresh, for calendar systems to call when a calendar changes.
+func (s *Server) handleRefreshSchedules(c *gin.Context) {
+	if s.schedule == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no schedules configured"})
+		return
+	}
+	s.schedule.Refresh()
+	c.Status(http.StatusAccepted)
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/index"
+)
+
+// searchHit is a search result with a link to what it found.
+type searchHit struct {
+	index.SearchResult
+	Link string `json:"link"`
+}
+
+// handleSearch runs a full-text search over the index. Query parameters: q,
+// site and limit (default 50).
+func (s *Server) handleSearch(c *gin.Context) {
+	q := c.Query("q")
+	if q == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
+		return
+	}
+	limit := 50
+	if v := c.Query("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+	}
+
+	results, err := s.index.Search(c.Request.Context(), q, c.Query("site"), limit)
+	if errors.Is(err, index.ErrEmptySearch) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	hits := []searchHit{}
+	for _, r := range results {
+		hit := searchHit{SearchResult: r}
+		switch r.Kind {
+		case "recording":
+			// Recordings start at the hit's time, so the file is the
+			// timeline position
+			hit.Link = "/api/v1/recordings/" + r.Ref + "/file"
+		case "search":
+			hit.Link = "/api/v1/searches/" + url.PathEscape(r.Ref) + "/recordings"
+		case "motion":
+			// A clip of the footage around the event
+			hit.Link = "/api/v1/cameras/" + url.PathEscape(r.CameraID) + "/clip?event=" + r.Ref
+		case "camera":
+			// The camera's recordings, newest first
+			hit.Link = "/api/v1/recordings?camera=" + url.QueryEscape(r.Ref)
+		}
+		hits = append(hits, hit)
+	}
+	c.JSON(http.StatusOK, gin.H{"query": q, "results": hits})
+}
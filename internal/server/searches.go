@@ -0,0 +1,176 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/index"
+)
+
+// savedSearchJSON is the API form of index.SavedSearch.
+type savedSearchJSON struct {
+	Name       string     `json:"name"`
+	Cameras    []string   `json:"cameras"`
+	Window     string     `json:"window,omitempty"` // e.g. "24h" for the last day
+	Since      *time.Time `json:"since,omitempty"`
+	Until      *time.Time `json:"until,omitempty"`
+	MotionOnly bool       `json:"motion_only"`
+	Shared     bool       `json:"shared"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+func toSavedSearchJSON(s *index.SavedSearch) savedSearchJSON {
+	out := savedSearchJSON{
+		Name:       s.Name,
+		Cameras:    s.Cameras,
+		MotionOnly: s.MotionOnly,
+		Shared:     s.UserID == 0,
+		UpdatedAt:  s.UpdatedAt,
+	}
+	if out.Cameras == nil {
+		out.Cameras = []string{}
+	}
+	if s.Window > 0 {
+		out.Window = s.Window.String()
+	}
+	if !s.Since.IsZero() {
+		out.Since = &s.Since
+	}
+	if !s.Until.IsZero() {
+		out.Until = &s.Until
+	}
+	return out
+}
+
+// searchOwner returns the user whose saved searches the request acts on:
+// the user of its token, or 0 for the shared searches.
+func searchOwner(c *gin.Context) int64 {
+	if user, ok := c.Get(userKey); ok {
+		return user.(*index.User).ID
+	}
+	return 0
+}
+
+func (s *Server) handleListSearches(c *gin.Context) {
+	searches, err := s.index.ListSearches(c.Request.Context(), searchOwner(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	out := []savedSearchJSON{}
+	for i := range searches {
+		out = append(out, toSavedSearchJSON(&searches[i]))
+	}
+	c.JSON(http.StatusOK, gin.H{"searches": out})
+}
+
+func (s *Server) handleGetSearch(c *gin.Context) {
+	search, ok := s.lookupSearch(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, toSavedSearchJSON(search))
+}
+
+// handlePutSearch creates or replaces the saved search named in the path.
+func (s *Server) handlePutSearch(c *gin.Context) {
+	var body savedSearchJSON
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	search := &index.SavedSearch{
+		UserID:     searchOwner(c),
+		Name:       c.Param("name"),
+		Cameras:    body.Cameras,
+		MotionOnly: body.MotionOnly,
+	}
+	if len(search.Name) > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is too long"})
+		return
+	}
+	if body.Window != "" {
+		window, err := time.ParseDuration(body.Window)
+		if err != nil || window <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid window"})
+			return
+		}
+		search.Window = window
+	}
+	if body.Since != nil {
+		search.Since = *body.Since
+	}
+	if body.Until != nil {
+		search.Until = *body.Until
+	}
+	if !search.Since.IsZero() && !search.Until.IsZero() && !search.Since.Before(search.Until) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "since must be before until"})
+		return
+	}
+
+	if err := s.index.SaveSearch(c.Request.Context(), search); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, toSavedSearchJSON(search))
+}
+
+func (s *Server) handleDeleteSearch(c *gin.Context) {
+	err := s.index.DeleteSearch(c.Request.Context(), searchOwner(c), c.Param("name"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "saved search not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// handleRunSearch returns the recordings a saved search matches now.
+// Query parameter: limit (default 100).
+func (s *Server) handleRunSearch(c *gin.Context) {
+	search, ok := s.lookupSearch(c)
+	if !ok {
+		return
+	}
+
+	q := search.Query(time.Now())
+	q.Limit = 100
+	if v := c.Query("limit"); v != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+	}
+
+	recordings, err := s.index.ListRecordings(c.Request.Context(), q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if recordings == nil {
+		recordings = []index.Recording{}
+	}
+	c.JSON(http.StatusOK, gin.H{"search": toSavedSearchJSON(search), "recordings": recordings})
+}
+
+func (s *Server) lookupSearch(c *gin.Context) (*index.SavedSearch, bool) {
+	search, err := s.index.GetSearch(c.Request.Context(), searchOwner(c), c.Param("name"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "saved search not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return search, true
+}
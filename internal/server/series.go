@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/index"
+)
+
+// Bounds on the steps of one series request
+const (
+	defaultSteps = 200
+	maxSteps     = 10000
+)
+
+// series is a time series the API can chart.
+type series struct {
+	Name        string `json:"name"`
+	Unit        string `json:"unit"`
+	Description string `json:"description"`
+	// FrameIndex is set when the series is built from storage.frame_index
+	FrameIndex bool `json:"requires_frame_index,omitempty"`
+
+	load func(s *Server, ctx context.Context, q index.SeriesQuery) ([]index.SeriesPoint, error)
+}
+
+var allSeries = []series{
+	{
+		Name:        "fps",
+		Unit:        "frames/s",
+		Description: "Frames stored per second, averaged over each step",
+		FrameIndex:  true,
+		load: func(s *Server, ctx context.Context, q index.SeriesQuery) ([]index.SeriesPoint, error) {
+			points, err := s.index.FrameSeries(ctx, q)
+			for i := range points {
+				points[i].Value /= q.Step.Seconds()
+			}
+			return points, err
+		},
+	},
+	{
+		Name:        "frames",
+		Unit:        "frames",
+		Description: "Frames stored in each step",
+		FrameIndex:  true,
+		load: func(s *Server, ctx context.Context, q index.SeriesQuery) ([]index.SeriesPoint, error) {
+			return s.index.FrameSeries(ctx, q)
+		},
+	},
+	{
+		Name:        "storage_bytes",
+		Unit:        "bytes",
+		Description: "Size of the recordings kept, by when they started",
+		load: func(s *Server, ctx context.Context, q index.SeriesQuery) ([]index.SeriesPoint, error) {
+			return s.index.StorageSeries(ctx, q)
+		},
+	},
+}
+
+func (s *Server) handleListSeries(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"series": allSeries})
+}
+
+// handleSeries returns one time series as points of time, camera and value,
+// a shape JSON datasources for Grafana can chart directly. Query
+// parameters: camera, from and to (RFC 3339 or Unix milliseconds, default
+// the last 24 hours) and step (e.g. "1m", default a 200th of the range).
+func (s *Server) handleSeries(c *gin.Context) {
+	var sr *series
+	for i := range allSeries {
+		if allSeries[i].Name == c.Param("name") {
+			sr = &allSeries[i]
+		}
+	}
+	if sr == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown series", "series": allSeries})
+		return
+	}
+	if sr.FrameIndex && s.frames == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "series " + sr.Name + " needs storage.frame_index enabled"})
+		return
+	}
+
+	q := index.SeriesQuery{CameraID: c.Query("camera"), To: time.Now()}
+	var ok bool
+	if v := c.Query("to"); v != "" {
+		if q.To, ok = parseSeriesTime(v); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to"})
+			return
+		}
+	}
+	q.From = q.To.Add(-24 * time.Hour)
+	if v := c.Query("from"); v != "" {
+		if q.From, ok = parseSeriesTime(v); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from"})
+			return
+		}
+	}
+	if !q.From.Before(q.To) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+
+	q.Step = (q.To.Sub(q.From) / defaultSteps).Truncate(time.Second)
+	if q.Step < time.Second {
+		q.Step = time.Second
+	}
+	if v := c.Query("step"); v != "" {
+		step, err := time.ParseDuration(v)
+		if err != nil || step < time.Second {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid step, it must be at least 1s"})
+			return
+		}
+		q.Step = step
+	}
+	if q.Buckets() > maxSteps {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "too many steps, use a larger step"})
+		return
+	}
+
+	points, err := sr.load(s, c.Request.Context(), q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"series": sr.Name,
+		"unit":   sr.Unit,
+		"from":   q.From,
+		"to":     q.To,
+		"step":   q.Step.String(),
+		"points": points,
+	})
+}
+
+// parseSeriesTime accepts RFC 3339 and Unix milliseconds, which is what
+// Grafana's ${__from} and ${__to} expand to.
+func parseSeriesTime(v string) (time.Time, bool) {
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.UnixMilli(ms), true
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	return t, err == nil
+}
@@ -3,41 +3,128 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/raeeceip/cctv/internal/aggregator"
+	"github.com/raeeceip/cctv/internal/calibration"
+	"github.com/raeeceip/cctv/internal/camera"
+	"github.com/raeeceip/cctv/internal/chaos"
+	"github.com/raeeceip/cctv/internal/cluster"
+	"github.com/raeeceip/cctv/internal/codec"
 	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/detect"
+	"github.com/raeeceip/cctv/internal/diskspace"
+	"github.com/raeeceip/cctv/internal/events"
+	"github.com/raeeceip/cctv/internal/export"
+	"github.com/raeeceip/cctv/internal/framecache"
+	"github.com/raeeceip/cctv/internal/framestore"
+	"github.com/raeeceip/cctv/internal/health"
+	"github.com/raeeceip/cctv/internal/hls"
+	"github.com/raeeceip/cctv/internal/index"
+	"github.com/raeeceip/cctv/internal/ingest"
+	"github.com/raeeceip/cctv/internal/jobs"
+	"github.com/raeeceip/cctv/internal/live"
+	"github.com/raeeceip/cctv/internal/motion"
+	"github.com/raeeceip/cctv/internal/objects"
+	"github.com/raeeceip/cctv/internal/onvif"
 	"github.com/raeeceip/cctv/internal/processor"
+	"github.com/raeeceip/cctv/internal/replication"
+	"github.com/raeeceip/cctv/internal/reports"
+	"github.com/raeeceip/cctv/internal/retention"
+	"github.com/raeeceip/cctv/internal/schedule"
+	"github.com/raeeceip/cctv/internal/shard"
+	"github.com/raeeceip/cctv/internal/site"
+	"github.com/raeeceip/cctv/internal/storage"
+	"github.com/raeeceip/cctv/internal/throttle"
+	"github.com/raeeceip/cctv/internal/wire"
 	"github.com/raeeceip/cctv/pkg/logger"
+	"github.com/raeeceip/cctv/pkg/metrics"
 	"go.uber.org/zap"
 )
 
 type CameraMessage struct {
-	Type     string    `json:"type"`
-	Data     string    `json:"data"`
-	Camera   string    `json:"camera"`
-	Time     time.Time `json:"time"`
-	FrameNum uint64    `json:"frame_num"`
-	Pattern  string    `json:"pattern"`
+	Type     string         `json:"type"`
+	Data     string         `json:"data"`
+	Camera   string         `json:"camera"`
+	Time     time.Time      `json:"time"`
+	FrameNum uint64         `json:"frame_num"`
+	Pattern  string         `json:"pattern"`
+	Location *wire.Location `json:"location,omitempty"`
+	KeyFrame bool           `json:"key_frame,omitempty"`
+	GOP      *wire.GOP      `json:"gop,omitempty"`
+	PTZ      *wire.PTZ      `json:"ptz,omitempty"`
 }
 
 type Server struct {
-	router          *gin.Engine
+	ingestRouter    *gin.Engine
+	apiRouter       *gin.Engine
 	logger          *logger.Logger
 	config          *config.Config
-	processor       *processor.FrameProcessor
+	processor       processor.Processor
+	index           *index.Index
+	frames          *index.FrameWriter // nil unless storage.frame_index is enabled
+	rtsp            *ingest.RTSP       // nil without sources.rtsp
+	jobs            *jobs.Queue
+	retention       *retention.Manager
+	exports         *export.Manager
+	reports         *reports.Manager
+	chaos           *chaos.Injector // nil unless chaos.enabled
+	clipSlots       chan struct{}
+	replication     *replication.Manager // nil without replication.peer
+	replicas        *replication.Receiver
+	uploads         *replication.Receiver  // cameras' own recordings
+	aggregator      *aggregator.Aggregator // nil without aggregator.nodes
+	cluster         *cluster.Cluster       // nil without cluster.redis
+	deadLetters     *processor.DeadLetters // nil unless storage.dead_letter is enabled
+	schedule        *schedule.Schedule     // nil without schedules
+	snapshots       *motion.Snapshots
+	lastFrames      *processor.LastFrames
+	calibration     *calibration.Tracker
+	throttle        *throttle.Limiter
+	disk            *diskspace.Monitor
+	health          *health.Tracker
+	limitMetrics    *metrics.CameraLimitMetrics
+	frameCache      *framecache.Cache // nil when disabled
+	detector        *detect.Detector  // nil when disabled
+	objects         *objects.Stage    // nil when disabled
+	hls             *hls.Packager     // nil when disabled
+	onvif           *onvif.Service    // nil when disabled
+	uploader        *storage.Uploader // nil without a storage backend
+	shareViewKey    []byte            // signs share view cookies; new on every start
+	tails           tails
+	previews        previews
+	live            *live.Manager
+	rtspOut         *live.RTSPServer // nil when disabled
+	events          events.Bus
+	streaming       sync.Map // RTSP cameras receiving frames
+	transforms      sync.Map // camera ID to its transform.Transform, once read
+	privacy         sync.Map // camera ID to its saved privacy.Masks, once read
+	background      sync.WaitGroup
 	upgrader        websocket.Upgrader
-	connections     sync.Map
+	cameras         *camera.CameraRegistry // cameras connected over WebSocket
 	shutdown        chan struct{}
 	activeProcesses sync.WaitGroup
 	shutdownOnce    sync.Once
+	stopOnce        sync.Once
+
+	// Lifecycle state driven by the admin API and signals
+	mu              sync.RWMutex
+	draining        bool
+	stopRequested   chan struct{}
+	stopRequestOnce sync.Once
 }
 
 type CameraHandler interface {
@@ -59,41 +146,335 @@ func New(cfg *config.Config, log *logger.Logger) (*Server, error) {
 		return nil, fmt.Errorf("failed to create output directory: %w", err)
 	}
 
-	// Initialize processor with configuration
-	proc, err := processor.NewFrameProcessor(processor.ProcessorConfig{
-		OutputDir:       cfg.Storage.OutputDir,
-		MaxFrames:       cfg.Storage.MaxFrames,
-		RetentionTime:   time.Duration(cfg.Storage.RetentionHours) * time.Hour,
-		BufferSize:      100,
-		VideoInterval:   10 * time.Second,
-		DeleteOriginals: false,
-	}, log)
+	shareViewKey := make([]byte, 32)
+	if _, err := rand.Read(shareViewKey); err != nil {
+		return nil, fmt.Errorf("failed to create share view key: %w", err)
+	}
+
+	jpegCodec, err := codec.Use(cfg.Processor.JPEGCodec)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Using JPEG codec",
+		zap.String("codec", jpegCodec.Name()),
+		zap.Strings("available", codec.Available()))
+
+	// Open the index, bringing its schema up to date
+	idx, applied, err := index.OpenAndMigrate(context.Background(), cfg.Storage.IndexPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index: %w", err)
+	}
+	for _, m := range applied {
+		log.Info("Applied index migration",
+			zap.Int("version", m.Version),
+			zap.String("name", m.Name))
+	}
+
+	var faults *chaos.Injector
+	if cfg.Chaos.Enabled {
+		log.Warn("Chaos testing is enabled; admins can inject faults")
+		faults = chaos.New(retention.KindTranscode, export.KindExport)
+	}
+
+	// Initialize processor with configuration, in shard worker processes
+	// when configured
+	var proc processor.Processor
+	if cfg.Processor.Shards > 1 {
+		proc, err = shard.NewPool(cfg.Processor, cfg.Storage.BufferSize, cfg.Storage.VideoConsolidation.Interval, log)
+	} else {
+		pcfg := ProcessorConfig(cfg)
+		pcfg.Chaos = faults
+		proc, err = processor.NewFrameProcessor(pcfg, log)
+	}
 	if err != nil {
+		idx.Close()
 		return nil, fmt.Errorf("failed to create processor: %w", err)
 	}
 
 	// Initialize server
 	server := &Server{
-		router:    gin.Default(),
 		logger:    log,
 		config:    cfg,
 		processor: proc,
+		index:     idx,
+		chaos:     faults,
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true
 			},
-			ReadBufferSize:  1024 * 1024, // 1MB
-			WriteBufferSize: 1024 * 1024, // 1MB
+			ReadBufferSize:  cfg.Server.WebsocketBufferSize,
+			WriteBufferSize: cfg.Server.WebsocketBufferSize,
+			Subprotocols:    wire.Protocols,
+			// Only used when the protocol version calls for it
+			EnableCompression: true,
 		},
-		shutdown: make(chan struct{}),
+		cameras:     camera.NewCameraRegistry(),
+		snapshots:   motion.NewSnapshots(time.Second),
+		lastFrames:  processor.NewLastFrames(),
+		calibration: calibration.NewTracker(),
+		throttle: throttle.New(metrics.NewThrottleMetrics(),
+			cfg.Storage.Throttle.CameraMBPerSec*1024*1024,
+			cfg.Storage.Throttle.GlobalMBPerSec*1024*1024),
+		disk:          diskspace.New(cfg.Storage.DiskMonitor, cfg.Storage.OutputDir, log),
+		health:        health.New(cfg.Server.Health, log),
+		limitMetrics:  metrics.NewCameraLimitMetrics(),
+		shareViewKey:  shareViewKey,
+		shutdown:      make(chan struct{}),
+		stopRequested: make(chan struct{}),
+	}
+
+	// Ingest and API get separate middleware chains; request logging is
+	// only useful on the API side, where every request is short-lived.
+	server.apiRouter = gin.New()
+	if err := server.apiRouter.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		idx.Close()
+		return nil, err
+	}
+	server.apiRouter.Use(gin.Logger(), gin.Recovery(), server.limitBody())
+	if faults != nil {
+		server.apiRouter.Use(server.injectFaults())
+	}
+	if cfg.Server.SignalPort == cfg.Server.Port {
+		server.ingestRouter = server.apiRouter
+	} else {
+		server.ingestRouter = gin.New()
+		if err := server.ingestRouter.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+			idx.Close()
+			return nil, err
+		}
+		server.ingestRouter.Use(gin.Recovery(), server.limitBody())
+	}
+
+	if server.live, err = live.New(cfg.Stream, config.H264Options(cfg), log); err != nil {
+		idx.Close()
+		return nil, err
+	}
+	if out := cfg.Stream.RTSP; out.Enabled {
+		server.rtspOut = live.NewRTSPServer(server.live, fmt.Sprintf("%s:%d", cfg.Server.Host, out.Port), func(id string) bool {
+			return slices.Contains(server.cameraIDs(), id)
+		}, log)
+	}
+
+	if fc := cfg.Storage.FrameCache; fc.Enabled {
+		server.frameCache = framecache.New(fc.Window, fc.CameraMB*1024*1024)
+	}
+
+	if fi := cfg.Storage.FrameIndex; fi.Enabled {
+		server.frames = idx.NewFrameWriter(fi.BatchSize, fi.FlushInterval)
+	}
+
+	proc.OnVideoCreated(server.indexVideo)
+	if h := cfg.Storage.HLS; h.Enabled {
+		// MJPEG, as the copy codec stores, can't go into HLS segments
+		transcode := cfg.Storage.VideoConsolidation.Codec == "copy"
+		server.hls = hls.New(filepath.Join(cfg.Storage.OutputDir, ".hls"), h, transcode, config.H264Options(cfg), log)
+		proc.OnVideoCreated(server.hls.Add)
+	}
+	backend, err := storage.New(cfg.Storage.Backend)
+	if err != nil {
+		idx.Close()
+		return nil, err
+	}
+	if backend != nil {
+		server.uploader = storage.NewUploader(backend, cfg.Storage.OutputDir, cfg.Storage.Backend.Workers, log)
+		proc.OnVideoCreated(func(v processor.Video) { server.uploader.AddVideo(v.Path) })
+		if cfg.Storage.Backend.Frames && cfg.Storage.SaveFrames {
+			proc.OnFrameSaved(func(f processor.FrameData) { server.uploader.AddFrame(f.Path) })
+		}
+	}
+	server.disk.OnChange(server.events.Publish)
+	server.health.OnChange(server.events.Publish)
+	proc.OnFrameSaved(func(f processor.FrameData) {
+		server.publishFrame(f)
+		if f.Path == "" {
+			// Encoded without being stored, so there is nothing to index
+			return
+		}
+		if err := server.frameCache.Put(f.CameraID, f.Number, f.Timestamp, f.Path, f.Data); err != nil {
+			log.Warn("Failed to cache frame", zap.String("camera", f.CameraID), zap.Error(err))
+		}
+		if server.frames != nil {
+			server.frames.Add(index.Frame{
+				CameraID:  f.CameraID,
+				Number:    f.Number,
+				Time:      f.Timestamp,
+				Path:      f.Path,
+				SizeBytes: int64(len(f.Data)),
+				Location:  f.Location,
+			})
+		}
+	})
+
+	if cfg.Motion.Detection {
+		server.detector = detect.New(cfg.Motion.Interval, idx.MotionSettings, log)
+		server.detector.OnMotion(server.recordMotion)
+		proc.OnFrameSaved(server.detector.Observe)
+	}
+	if o := cfg.Objects; o.Detection {
+		d, err := objects.Open(o.Detector, objects.Options{
+			Model:     o.Model,
+			InputSize: o.InputSize,
+			Labels:    o.Labels,
+			MinScore:  o.MinScore,
+			Threads:   o.Threads,
+		})
+		if err != nil {
+			idx.Close()
+			return nil, fmt.Errorf("failed to open object detector: %w", err)
+		}
+		classes := o.Classes
+		if len(classes) == 0 {
+			classes = objects.DefaultClasses
+		}
+		server.objects = objects.NewStage(d, o.Interval, o.Cooldown, classes, log)
+		server.objects.OnEvent(server.recordObjects)
+		proc.OnFrameSaved(server.objects.Observe)
+	}
+
+	// Cameras the server pulls from
+	if len(cfg.Sources.RTSP) > 0 {
+		store, err := framestore.New(cfg.Storage.OutputDir, framestore.Layout(cfg.Storage.FrameLayout), cfg.Storage.Naming.Frame, cfg.Site)
+		if err != nil {
+			idx.Close()
+			return nil, err
+		}
+		server.rtsp = ingest.NewRTSP(cfg.Sources.RTSP, cfg.Site, store, log, server.ingestFrame)
+		server.rtsp.OnStream(func(cameraID string, streaming bool) {
+			if streaming {
+				server.streaming.Store(cameraID, struct{}{})
+				server.health.Connected(cameraID, time.Now())
+			} else {
+				server.streaming.Delete(cameraID)
+				server.health.Disconnected(cameraID, time.Now())
+			}
+			server.publishCamera(cameraID, sourceRTSP, streaming)
+		})
+	}
+
+	// Background work shares the index, which also persists the queue
+	server.jobs = jobs.New(idx, log, cfg.Jobs)
+	server.jobs.InjectFaults(faults)
+	server.retention = retention.New(idx, server.jobs, log, cfg)
+	server.exports = export.New(idx, server.jobs, log, cfg)
+	server.reports = reports.New(idx, server.jobs, log)
+	server.clipSlots = make(chan struct{}, maxClips)
+	if cfg.Replication.Peer != "" {
+		server.replication = replication.New(idx, server.jobs, log, cfg.Replication)
+	}
+	server.replicas = replication.NewReceiver(idx, cfg.Storage.OutputDir)
+	server.uploads = replication.NewCameraReceiver(idx, cfg.Storage.OutputDir)
+	if len(cfg.Aggregator.Nodes) > 0 {
+		if server.aggregator, err = aggregator.New(cfg.Aggregator, log); err != nil {
+			idx.Close()
+			return nil, err
+		}
+	}
+	if cfg.Cluster.Redis != "" {
+		server.cluster = cluster.New(cfg.Cluster, server.localCameras, log)
+		server.cluster.OnFrame(server.showRemoteFrame)
+		server.cluster.OnEvent(server.events.Publish)
+	}
+	if dir := deadLetterDir(cfg); dir != "" {
+		if server.deadLetters, err = processor.NewDeadLetters(dir, cfg.Storage.DeadLetter.MaxMB, cfg.Storage.DeadLetter.Keep); err != nil {
+			idx.Close()
+			return nil, err
+		}
+	}
+	if server.schedule, err = schedule.New(cfg.Schedules, log); err != nil {
+		idx.Close()
+		return nil, err
+	}
+	if cfg.ONVIF.Enabled {
+		rtspPort := 0
+		if cfg.Stream.RTSP.Enabled {
+			rtspPort = cfg.Stream.RTSP.Port
+		}
+		server.onvif = onvif.New(cfg.ONVIF, onvif.Options{
+			Cameras:  server.cameraIDs,
+			Port:     cfg.Server.Port,
+			TLS:      cfg.Server.SSL.Enabled || cfg.Server.API.SSL.Enabled,
+			HLS:      server.hls != nil,
+			RTSPPort: rtspPort,
+			Stream:   cfg.Stream,
+		}, log)
+	}
+
+	// Middleware only applies to routes added after it
+	rateLimits := newRateLimits(cfg.Server.RateLimits)
+	if rateLimits != nil {
+		server.apiRouter.Use(rateLimits.middleware(server.rateLimitKey))
 	}
 
 	// Setup routes
-	server.setupRoutes()
+	server.setupIngestRoutes()
+	server.setupAPIRoutes()
+	if rateLimits != nil {
+		rateLimits.warnUnknownRoutes(server.apiRouter.Routes(), log)
+	}
 	return server, nil
 }
 
-func (s *Server) handleCameraConnection(cameraID string, conn *websocket.Conn) {
+// ProcessorConfig derives the frame processor settings from cfg. Shard
+// workers use it too, so they behave like an in-process processor.
+func ProcessorConfig(cfg *config.Config) processor.ProcessorConfig {
+	maxFrames := cfg.Storage.MaxFrames
+	if cfg.Storage.VideoConsolidation.MinFrames > 0 {
+		maxFrames = cfg.Storage.VideoConsolidation.MinFrames
+	}
+	return processor.ProcessorConfig{
+		OutputDir:          cfg.Storage.OutputDir,
+		MaxFrames:          maxFrames,
+		RetentionTime:      time.Duration(cfg.Storage.RetentionHours) * time.Hour,
+		BufferSize:         cfg.Storage.BufferSize,
+		Workers:            cfg.Processor.Workers,
+		VideoInterval:      cfg.Storage.VideoConsolidation.Interval,
+		DeleteOriginals:    cfg.Storage.VideoConsolidation.DeleteOriginals,
+		VideoConsolidation: cfg.Storage.VideoConsolidation.Enabled,
+		VideoCodec:         cfg.Storage.VideoConsolidation.Codec,
+		VideoBitrate:       cfg.Stream.VideoBitrate,
+		VideoHWAccel:       cfg.Storage.VideoConsolidation.HWAccel,
+		VideoDevice:        cfg.Storage.VideoConsolidation.Device,
+		VideoWidth:         cfg.Storage.VideoConsolidation.Width,
+		VideoHeight:        cfg.Storage.VideoConsolidation.Height,
+		VideoPipe:          cfg.Storage.VideoConsolidation.Pipe,
+		SegmentDuration:    cfg.Storage.VideoConsolidation.SegmentDuration,
+		DiscardFrames:      !cfg.Storage.SaveFrames,
+		FrameLayout:        framestore.Layout(cfg.Storage.FrameLayout),
+		FrameName:          cfg.Storage.Naming.Frame,
+		VideoName:          cfg.Storage.Naming.Video,
+		Site:               cfg.Site,
+		Dedup:              cfg.Storage.Dedup.Enabled,
+		DedupMinRatio:      cfg.Storage.Dedup.MinRatio,
+		FrameMetadata:      cfg.Storage.FrameMetadata,
+		Resolution:         resolutionLimits(cfg.Server.Limits),
+		DeadLetterDir:      deadLetterDir(cfg),
+		DeadLetterMaxMB:    cfg.Storage.DeadLetter.MaxMB,
+		DeadLetterKeep:     cfg.Storage.DeadLetter.Keep,
+		Plugins:            cfg.Processor.Plugins,
+		Stages:             stageConfigs(cfg.Processor.Stages),
+	}
+}
+
+// stageConfigs returns the frame stages configured, as the processor takes
+// them.
+func stageConfigs(stages []config.StageConfig) []processor.StageConfig {
+	var out []processor.StageConfig
+	for _, s := range stages {
+		out = append(out, processor.StageConfig{Name: s.Name, Cameras: s.Cameras, Options: s.Options})
+	}
+	return out
+}
+
+// deadLetterDir returns where frames that fail to be stored are kept, or
+// "" if they aren't.
+func deadLetterDir(cfg *config.Config) string {
+	if !cfg.Storage.DeadLetter.Enabled {
+		return ""
+	}
+	return cfg.Storage.DeadLetter.Dir
+}
+
+func (s *Server) handleCameraConnection(cameraID string, conn *websocket.Conn, caps wire.Capabilities) {
 	s.activeProcesses.Add(1)
 	defer s.activeProcesses.Done()
 
@@ -106,12 +487,28 @@ func (s *Server) handleCameraConnection(cameraID string, conn *websocket.Conn) {
 			websocket.CloseMessage,
 			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 		conn.Close()
-		s.connections.Delete(cameraID)
+		if s.cameras.Remove(cameraID, conn) {
+			// Not replaced by a newer connection of the camera
+			s.health.Disconnected(cameraID, time.Now())
+		}
+		s.calibration.Remove(cameraID)
+		s.throttle.Remove(cameraID)
+		s.frameCache.Remove(cameraID)
+		if s.detector != nil {
+			s.detector.Remove(cameraID)
+		}
+		if s.objects != nil {
+			s.objects.Remove(cameraID)
+		}
 		s.logger.Info("Camera disconnected", zap.String("id", cameraID))
+		s.publishCamera(cameraID, sourceWebSocket, false)
 	}()
 
 	// Set up connection parameters
-	conn.SetReadLimit(32 * 1024 * 1024)
+	s.mu.RLock()
+	frameLimit := int64(s.config.Server.BodyLimits.FrameMB) << 20
+	s.mu.RUnlock()
+	conn.SetReadLimit(frameLimit)
 	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	conn.SetPongHandler(func(string) error {
 		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
@@ -125,6 +522,15 @@ func (s *Server) handleCameraConnection(cameraID string, conn *websocket.Conn) {
 		s.handlePing(conn, cameraID)
 	}()
 
+	// Cameras reading control messages learn what the handshake settled on
+	if caps.Control {
+		if err := s.cameras.SendHello(cameraID, conn, s.helloOf(caps)); err != nil {
+			s.logger.Warn("Failed to send hello",
+				zap.String("camera", cameraID),
+				zap.Error(err))
+		}
+	}
+
 	// Create camera-specific directory
 	cameraDir := filepath.Join(s.config.Storage.OutputDir, cameraID)
 	if err := os.MkdirAll(cameraDir, 0755); err != nil {
@@ -135,9 +541,9 @@ func (s *Server) handleCameraConnection(cameraID string, conn *websocket.Conn) {
 	}
 
 	// Message handling loop
+	rate := newFrameRateLimit(s.cameraLimits(), cameraID)
 	for {
-		var msg CameraMessage
-		err := conn.ReadJSON(&msg)
+		frame, err := s.readFrame(conn, cameraID, &caps)
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
 				s.logger.Error("Websocket read error",
@@ -146,21 +552,28 @@ func (s *Server) handleCameraConnection(cameraID string, conn *websocket.Conn) {
 			}
 			return
 		}
+		if !rate.allow(cameraID, time.Now()) {
+			frame.Release()
+			s.limitMetrics.Violations.WithLabelValues(limitFrameRate).Inc()
+			if rate.action == config.FrameRateDisconnect {
+				s.logger.Warn("Camera disconnected for exceeding its frame rate limit", zap.String("camera", cameraID))
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "frame rate limit exceeded"),
+					time.Now().Add(time.Second))
+				return
+			}
+			if !rate.warned {
+				s.logger.Warn("Camera exceeds its frame rate limit, dropping frames", zap.String("camera", cameraID))
+				rate.warned = true
+			}
+			continue
+		}
 
 		s.logger.Debug("Received frame message",
 			zap.String("camera", cameraID),
-			zap.Uint64("frame", msg.FrameNum),
-			zap.Int("data_length", len(msg.Data)))
-
-		// Process frame
-		if s.processor != nil {
-			s.processor.ProcessFrame(processor.FrameData{
-				CameraID:  cameraID,
-				Data:      []byte(msg.Data),
-				Timestamp: msg.Time,
-				Number:    msg.FrameNum,
-			})
-		}
+			zap.Uint64("frame", frame.Number),
+			zap.Int("data_length", len(frame.Data)))
+		s.ingestFrame(frame)
 	}
 }
 
@@ -183,49 +596,156 @@ func (s *Server) handlePing(conn *websocket.Conn, cameraID string) {
 	}
 }
 
-func (s *Server) setupRoutes() {
+func (s *Server) setupIngestRoutes() {
 	// WebSocket endpoint for camera connections
-	s.router.GET("/camera/connect", func(c *gin.Context) {
-		conn, err := s.upgrader.Upgrade(c.Writer, c.Request, nil)
+	s.ingestRouter.GET("/camera/connect", func(c *gin.Context) {
+		if s.IsDraining() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "server is draining"})
+			return
+		}
+
+		cameraID, err := s.identifyCamera(c)
+		if errors.Is(err, errCameraAuth) {
+			s.logger.Warn("Camera refused", zap.String("remote", c.ClientIP()), zap.Error(err))
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, errCameraID) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if cameraID == "" {
+			cameraID = fmt.Sprintf("cam-%d", time.Now().Unix())
+		}
+		cameraID = site.Qualify(s.config.Site, cameraID)
+
+		ban, err := s.index.CameraBan(c.Request.Context(), cameraID, time.Now())
+		if err == nil {
+			s.logger.Warn("Banned camera refused",
+				zap.String("camera", cameraID),
+				zap.String("remote", c.ClientIP()),
+				zap.String("reason", ban.Reason))
+			c.JSON(http.StatusForbidden, gin.H{"error": "camera is banned"})
+			return
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		release, err := s.admitCamera(cameraID, c.ClientIP())
+		if err != nil {
+			s.logger.Warn("Camera refused",
+				zap.String("camera", cameraID),
+				zap.String("remote", c.ClientIP()),
+				zap.Error(err))
+			refuseCamera(c, err)
+			return
+		}
+		// Once registered below the camera counts as connected
+		defer release()
+
+		caps, err := s.negotiateProtocol(c)
+		if err != nil {
+			s.logger.Warn("Camera refused",
+				zap.String("camera", cameraID),
+				zap.String("remote", c.ClientIP()),
+				zap.Error(err))
+			s.refuseProtocol(c, err)
+			return
+		}
+		var header http.Header
+		if caps.Version != 0 {
+			header = http.Header{wire.VersionHeader: {strconv.Itoa(caps.Version)}}
+		}
+		conn, err := s.upgrader.Upgrade(c.Writer, c.Request, header)
 		if err != nil {
 			s.logger.Error("Websocket upgrade failed", zap.Error(err))
 			return
 		}
+		if caps.Version == 0 {
+			caps = wire.LegacyCapabilities(conn.Subprotocol())
+		}
+		conn.EnableWriteCompression(caps.Compression)
 
-		cameraID := fmt.Sprintf("cam-%d", time.Now().Unix())
-		s.connections.Store(cameraID, conn)
-		s.logger.Info("Camera connected", zap.String("id", cameraID))
+		// A camera reconnecting before its old connection timed out
+		// replaces it. From elsewhere, it may be another device with
+		// the same ID.
+		if prev, ok := s.cameras.Status(cameraID); ok && prev.RemoteAddr != c.ClientIP() {
+			s.logger.Warn("Camera connection replaced from another address",
+				zap.String("camera", cameraID),
+				zap.String("previous", prev.RemoteAddr),
+				zap.String("remote", c.ClientIP()))
+		}
+		if old := s.cameras.Add(cameraID, conn, c.ClientIP(), caps); old != nil {
+			old.Close()
+		}
+		s.logger.Info("Camera connected",
+			zap.String("id", cameraID),
+			zap.Int("version", caps.Version),
+			zap.String("protocol", conn.Subprotocol()))
+		s.health.Connected(cameraID, time.Now())
+		s.publishCamera(cameraID, sourceWebSocket, true)
 
 		// Handle camera connection in a goroutine
-		go s.handleCameraConnection(cameraID, conn)
+		go s.handleCameraConnection(cameraID, conn, caps)
 	})
+}
+
+func (s *Server) setupAPIRoutes() {
+	// Web dashboard for operators
+	s.setupDashboard()
 
-	// Debug endpoint
-	s.router.GET("/debug/frames", func(c *gin.Context) {
+	// Debug endpoint, the frames on disk as JSON
+	s.apiRouter.GET("/debug/frames", func(c *gin.Context) {
 		// Get frame directories info
 		info := make(map[string]interface{})
 
-		// List all files in the output directory
+		// Count frames per camera, in either layout, optionally only those
+		// of ?site=
 		outputDir := s.config.Storage.OutputDir
-		files, err := filepath.Glob(filepath.Join(outputDir, "cam-*", "frame_*.jpg"))
+		entries, err := os.ReadDir(outputDir)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		inSite := siteFilter(c)
 
-		// Count frames per camera
+		store, err := framestore.New(outputDir, framestore.Layout(s.config.Storage.FrameLayout), s.config.Storage.Naming.Frame, s.config.Site)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
 		frameCounts := make(map[string]int)
-		for _, file := range files {
-			cameraID := filepath.Base(filepath.Dir(file))
-			frameCounts[cameraID]++
+		total := 0
+		for _, e := range entries {
+			cameraID := e.Name()
+			if !e.IsDir() || !inSite(cameraID) {
+				continue
+			}
+			// Directories other than cameras hold no frames
+			files, err := store.Frames(cameraID, time.Time{})
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if len(files) > 0 {
+				frameCounts[cameraID] = len(files)
+				total += len(files)
+			}
 		}
 
 		info["frame_counts"] = frameCounts
-		info["total_frames"] = len(files)
+		info["total_frames"] = total
 
 		var activeConns []string
-		s.connections.Range(func(key, value interface{}) bool {
-			activeConns = append(activeConns, key.(string))
+		s.cameras.Range(func(id string, _ *websocket.Conn) bool {
+			if inSite(id) {
+				activeConns = append(activeConns, id)
+			}
 			return true
 		})
 		info["active_connections"] = activeConns
@@ -237,7 +757,14 @@ func (s *Server) setupRoutes() {
 	})
 
 	// Health check endpoint
-	s.router.GET("/health", func(c *gin.Context) {
+	s.apiRouter.GET("/health", func(c *gin.Context) {
+		if s.IsDraining() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status": "draining",
+				"time":   time.Now(),
+			})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{
 			"status": "healthy",
 			"time":   time.Now(),
@@ -245,7 +772,169 @@ func (s *Server) setupRoutes() {
 	})
 
 	// Metrics endpoint
-	s.router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	s.apiRouter.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	// Recording index
+	recordings := s.apiRouter.Group("/api/v1/recordings")
+	recordings.GET("", s.handleListRecordings)
+	recordings.GET("/:id", s.handleGetRecording)
+	recordings.GET("/:id/file", s.handleRecordingFile)
+	recordings.HEAD("/:id/file", s.handleRecordingFile)
+	recordings.GET("/:id/thumbnail", s.handleRecordingThumbnail)
+	recordings.GET("/:id/avsync", s.handleRecordingAVSync)
+	recordings.POST("/:id/exports", s.requireScope(scopeRecordings), s.handleCreateExport)
+	recordings.GET("/:id/exports/:format", s.handleGetExport)
+	recordings.GET("/:id/exports/:format/file", s.handleExportFile)
+	recordings.DELETE("/:id", s.requireScope(scopeRecordings), s.handleDeleteRecording)
+	recordings.POST("/:id/shares", s.requireScope(scopeShares), s.handleCreateShare)
+
+	// Links to recordings for people without a token
+	shares := s.apiRouter.Group("/api/v1/shares")
+	shares.GET("", s.requireScope(scopeShares), s.handleListShares)
+	shares.DELETE("/:id", s.requireScope(scopeShares), s.handleRevokeShare)
+	s.apiRouter.GET("/share/:token", s.handleShare)
+	s.apiRouter.HEAD("/share/:token", s.handleShare)
+
+	// Deleted recordings, until retention purges them
+	trash := s.apiRouter.Group("/api/v1/trash")
+	trash.GET("", s.handleListTrash)
+	trash.POST("/:id/restore", s.requireScope(scopeRecordings), s.handleRestoreRecording)
+
+	// Full-text search
+	s.apiRouter.GET("/api/v1/search", s.handleSearch)
+
+	// Saved recording searches, the user's own with a user token and the
+	// shared ones otherwise
+	searches := s.apiRouter.Group("/api/v1/searches")
+	searches.GET("", s.identifyUser(), s.handleListSearches)
+	searches.GET("/:name", s.identifyUser(), s.handleGetSearch)
+	searches.PUT("/:name", s.requireScope(scopeSearches), s.handlePutSearch)
+	searches.DELETE("/:name", s.requireScope(scopeSearches), s.handleDeleteSearch)
+	searches.GET("/:name/recordings", s.identifyUser(), s.handleRunSearch)
+
+	// Consolidation backlog
+	s.apiRouter.GET("/api/v1/processor/status", s.handleProcessorStatus)
+
+	// Processor and per-camera health as JSON
+	s.apiRouter.GET("/api/v1/stats", s.handleStats)
+
+	// Time series for dashboards
+	s.apiRouter.GET("/api/v1/series", s.handleListSeries)
+	s.apiRouter.GET("/api/v1/series/:name", s.handleSeries)
+
+	// Daily statistics for management reporting
+	s.apiRouter.GET("/api/v1/reports/daily", s.handleDailyReport)
+
+	// What happens on the server, as server-sent events
+	s.apiRouter.GET("/api/v1/events", s.handleEvents)
+	s.apiRouter.GET("/api/v1/events/motion", s.handleListMotionEvents)
+
+	// Per-camera tuning
+	cameras := s.apiRouter.Group("/api/v1/cameras")
+	cameras.GET("", s.handleListCameras)
+	cameras.GET("/:id", s.handleGetCamera)
+	cameras.GET("/:id/calibration", s.handleCalibration)
+	cameras.GET("/:id/track", s.handleTrack)
+	cameras.GET("/:id/tail", s.handleTail)
+	cameras.GET("/:id/clip", s.handleClip)
+	cameras.GET("/:id/frame", s.handleFrame)
+	cameras.GET("/:id/snapshot", s.handleSnapshot)
+	cameras.POST("/:id/webrtc", s.handleWatch)
+	cameras.DELETE("/:id/webrtc/:session", s.handleStopWatching)
+	cameras.GET("/:id/motion", s.handleGetMotion)
+	cameras.PUT("/:id/motion", s.requireAdmin(), s.handlePutMotion)
+	cameras.GET("/:id/transform", s.handleGetTransform)
+	cameras.PUT("/:id/transform", s.requireAdmin(), s.handlePutTransform)
+	cameras.POST("/:id/ptz", s.requireAdmin(), s.handlePTZ)
+	cameras.GET("/:id/privacy", s.handleGetPrivacy)
+	cameras.PUT("/:id/privacy", s.requireAdmin(), s.handlePutPrivacy)
+	cameras.GET("/:id/motion/preview", s.handleMotionPreview)
+	cameras.POST("/:id/motion/preview", s.handleMotionPreview)
+
+	// MJPEG preview for browsers and players without WebRTC
+	s.apiRouter.GET("/live/:cameraID", s.handleLivePreview)
+
+	// Self-service for users with their own tokens
+	me := s.apiRouter.Group("/api/v1/me")
+	me.GET("", s.requireUser(""), s.handleMe)
+	me.GET("/settings", s.requireUser(scopeSettings), s.handleGetSettings)
+	me.PUT("/settings", s.requireUser(scopeSettings), s.handlePutSettings)
+	me.GET("/tokens", s.requireUser(scopeTokens), s.handleListTokens)
+	me.POST("/tokens", s.requireUser(scopeTokens), s.handleCreateToken)
+	me.DELETE("/tokens/:id", s.requireUser(scopeTokens), s.handleDeleteToken)
+
+	// Recordings pushed by other servers
+	replicas := s.apiRouter.Group("/api/v1/replication", s.requireReplication())
+	replicas.GET("/uploads/:origin/:name", s.handleUploadOffset)
+	replicas.PATCH("/uploads/:origin/:name", s.handleUploadChunk)
+	replicas.POST("/recordings", s.handleCompleteUpload)
+
+	// Recordings uploaded by the cameras that made them
+	uploads := s.apiRouter.Group("/api/v1/camera", s.requireCamera())
+	uploads.GET("/uploads/:name", s.handleUploadOffset)
+	uploads.PATCH("/uploads/:name", s.handleUploadChunk)
+	uploads.POST("/recordings", s.handleCompleteUpload)
+
+	// Other servers, seen through their APIs
+	if s.aggregator != nil {
+		aggregate := s.apiRouter.Group("/api/v1/aggregate")
+		aggregate.GET("/nodes", s.handleAggregateNodes)
+		aggregate.GET("/cameras", s.handleAggregateCameras)
+		aggregate.GET("/events", s.handleAggregateEvents)
+		aggregate.GET("/recordings", s.handleAggregateRecordings)
+		aggregate.GET("/nodes/:node/recordings/:id/file", s.handleAggregateRecordingFile)
+		aggregate.HEAD("/nodes/:node/recordings/:id/file", s.handleAggregateRecordingFile)
+	}
+
+	if s.cluster != nil {
+		s.apiRouter.GET("/api/v1/cluster/nodes", s.handleClusterNodes)
+	}
+
+	// Consolidated videos as HLS playlists
+	if s.hls != nil {
+		s.apiRouter.GET("/hls/:camera/:file", s.handleHLS)
+		s.apiRouter.HEAD("/hls/:camera/:file", s.handleHLS)
+	}
+
+	// Cameras as ONVIF devices for NVR software
+	if s.onvif != nil {
+		s.apiRouter.POST("/onvif/:camera/:service", s.handleONVIF)
+	}
+
+	// Lifecycle management
+	admin := s.apiRouter.Group("/api/v1/admin", s.requireAdmin())
+	admin.POST("/reload", s.handleReload)
+	// The same reload where config tooling expects it
+	s.apiRouter.POST("/api/v1/config/reload", s.requireAdmin(), s.handleReload)
+	admin.POST("/drain", s.handleDrain)
+	admin.POST("/shutdown", s.handleShutdown)
+	admin.GET("/backup", s.handleBackup)
+	admin.GET("/jobs", s.handleListJobs)
+	admin.GET("/users", s.handleListUsers)
+	admin.POST("/users", s.handleCreateUser)
+	admin.GET("/cameras/:id/tokens", s.handleListCameraTokens)
+	admin.POST("/cameras/:id/tokens", s.handleCreateCameraToken)
+	admin.DELETE("/cameras/:id/tokens/:token", s.handleDeleteCameraToken)
+	admin.POST("/cameras/:id/disconnect", s.handleDisconnectCamera)
+	admin.POST("/cameras/:id/config", s.handleConfigureCamera)
+	admin.GET("/bans", s.handleListCameraBans)
+	admin.PUT("/cameras/:id/ban", s.handleBanCamera)
+	admin.DELETE("/cameras/:id/ban", s.handleUnbanCamera)
+	admin.GET("/schedules", s.handleSchedules)
+	admin.POST("/schedules/refresh", s.handleRefreshSchedules)
+	if s.deadLetters != nil {
+		admin.GET("/dead-letters", s.handleListDeadLetters)
+		admin.POST("/dead-letters/reprocess", s.handleReprocessDeadLetters)
+		admin.GET("/dead-letters/:id", s.handleGetDeadLetter)
+		admin.GET("/dead-letters/:id/frame", s.handleDeadLetterFrame)
+		admin.POST("/dead-letters/:id/reprocess", s.handleReprocessDeadLetter)
+		admin.DELETE("/dead-letters/:id", s.handleDeleteDeadLetter)
+	}
+	if s.chaos != nil {
+		admin.GET("/chaos", s.handleGetChaos)
+		admin.PUT("/chaos", s.handleSetChaos)
+		admin.DELETE("/chaos", s.handleClearChaos)
+	}
 }
 func (s *Server) Start(ctx context.Context) error {
 	// Start the processor if it hasn't been started
@@ -253,14 +942,163 @@ func (s *Server) Start(ctx context.Context) error {
 		return fmt.Errorf("failed to start processor: %w", err)
 	}
 
-	srv := &http.Server{
-		Addr:    fmt.Sprintf("%s:%d", s.config.Server.Host, s.config.Server.Port),
-		Handler: s.router,
+	// Background work stops whenever Start returns, including on a
+	// listener error
+	bgCtx, cancelBackground := context.WithCancel(ctx)
+	defer cancelBackground()
+
+	s.background.Add(6)
+	go func() {
+		defer s.background.Done()
+		s.jobs.Run(bgCtx)
+	}()
+	go func() {
+		defer s.background.Done()
+		s.disk.Run(bgCtx)
+	}()
+	go func() {
+		defer s.background.Done()
+		s.health.Run(bgCtx)
+	}()
+	go func() {
+		defer s.background.Done()
+		s.retention.Run(bgCtx)
+	}()
+	go func() {
+		defer s.background.Done()
+		s.exports.Run(bgCtx)
+	}()
+	go func() {
+		defer s.background.Done()
+		s.reports.Run(bgCtx)
+	}()
+	if s.replication != nil {
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			s.replication.Run(bgCtx)
+		}()
 	}
+	if s.aggregator != nil {
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			s.aggregator.Run(bgCtx)
+		}()
+	}
+	if s.cluster != nil {
+		s.background.Add(2)
+		go func() {
+			defer s.background.Done()
+			s.cluster.Run(bgCtx)
+		}()
+		go func() {
+			defer s.background.Done()
+			s.shareEvents(bgCtx)
+		}()
+	}
+	if s.schedule != nil {
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			s.schedule.Run(bgCtx)
+		}()
+	}
+	if interval := s.config.Server.FeedbackInterval; interval > 0 {
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			s.feedbackRoutine(bgCtx, interval)
+		}()
+	}
+	if s.config.WatchConfig {
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			s.watchConfig(bgCtx)
+		}()
+	}
+	if s.detector != nil {
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			s.detector.Run(bgCtx)
+		}()
+	}
+	if s.objects != nil {
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			s.objects.Run(bgCtx)
+		}()
+	}
+	if s.hls != nil {
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			s.hls.Run(bgCtx)
+		}()
+	}
+	if s.onvif != nil {
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			s.onvif.Run(bgCtx)
+		}()
+	}
+	if s.rtspOut != nil {
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			s.rtspOut.Run(bgCtx)
+		}()
+	}
+	if s.uploader != nil {
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			s.uploader.Run(bgCtx)
+		}()
+	}
+	if s.frames != nil {
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			s.frames.Run(bgCtx, func(err error) {
+				s.logger.Error("Failed to index frames", zap.Error(err))
+			})
+		}()
+	}
+
+	// Pulled cameras stop with the connected ones, before the processor
+	if s.rtsp != nil {
+		rtspCtx, cancelRTSP := context.WithCancel(bgCtx)
+		s.activeProcesses.Add(1)
+		go func() {
+			defer s.activeProcesses.Done()
+			s.rtsp.Run(rtspCtx)
+		}()
+		go func() {
+			defer cancelRTSP()
+			select {
+			case <-s.shutdown:
+			case <-rtspCtx.Done():
+			}
+		}()
+	}
+
+	activated, err := activationListeners()
+	if err != nil {
+		return err
+	}
+	listeners := s.listeners(activated)
 
 	// Handle graceful shutdown
 	go func() {
-		<-ctx.Done()
+		select {
+		case <-ctx.Done():
+		case <-s.stopRequested:
+		}
 		s.shutdownOnce.Do(func() {
 			s.logger.Info("Shutting down server...")
 
@@ -268,13 +1106,11 @@ func (s *Server) Start(ctx context.Context) error {
 			close(s.shutdown)
 
 			// Close all connections gracefully
-			s.connections.Range(func(key, value interface{}) bool {
-				if conn, ok := value.(*websocket.Conn); ok {
-					conn.WriteMessage(
-						websocket.CloseMessage,
-						websocket.FormatCloseMessage(websocket.CloseNormalClosure, "server shutdown"))
-					conn.Close()
-				}
+			s.cameras.Range(func(_ string, conn *websocket.Conn) bool {
+				conn.WriteMessage(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, "server shutdown"))
+				conn.Close()
 				return true
 			})
 
@@ -293,35 +1129,48 @@ func (s *Server) Start(ctx context.Context) error {
 				s.logger.Warn("Timeout waiting for processes to complete")
 			}
 
-			// Shutdown server
-			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			defer cancel()
-
-			if err := srv.Shutdown(shutdownCtx); err != nil {
-				s.logger.Error("Server shutdown error", zap.Error(err))
-			}
+			s.shutdownListeners(listeners)
 		})
 	}()
 
-	s.logger.Info("Server starting",
-		zap.String("address", srv.Addr))
+	errChan := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l *listener) {
+			s.logger.Info("Server starting",
+				zap.String("listener", l.name),
+				zap.String("address", l.address()),
+				zap.Bool("tls", l.ssl.Enabled))
+			errChan <- l.serve()
+		}(l)
+	}
 
-	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-		return fmt.Errorf("server error: %w", err)
+	// A listener that fails to serve takes the others down with it, so the
+	// server never runs with only half of its endpoints reachable.
+	var firstErr error
+	for range listeners {
+		if err := <-errChan; err != nil && firstErr == nil {
+			firstErr = err
+			s.shutdownListeners(listeners)
+		}
 	}
 
-	return nil
+	return firstErr
 }
 
 func (s *Server) Stop() {
-	s.shutdownOnce.Do(func() {
-		close(s.shutdown)
-		s.processor.Stop()
+	s.stopOnce.Do(func() {
+		// Start's shutdown path may already have signalled the handlers
+		s.shutdownOnce.Do(func() {
+			close(s.shutdown)
+		})
 
-		// Wait for active processes with timeout
+		// Wait for connection handlers first so nothing queues frames into
+		// a stopped processor, and for background jobs before the index
+		// they write to is closed
 		done := make(chan struct{})
 		go func() {
 			s.activeProcesses.Wait()
+			s.background.Wait()
 			close(done)
 		}()
 
@@ -331,5 +1180,69 @@ func (s *Server) Stop() {
 		case <-time.After(5 * time.Second):
 			s.logger.Warn("Timeout waiting for processes to complete")
 		}
+
+		s.live.Shutdown()
+		s.processor.Stop()
+		s.frameCache.Close()
+		if s.objects != nil {
+			s.objects.Close()
+		}
+
+		// The processor may have saved frames since the last group commit
+		if s.frames != nil {
+			if err := s.frames.Flush(context.Background()); err != nil {
+				s.logger.Error("Failed to index frames", zap.Error(err))
+			}
+		}
+
+		if err := s.index.Close(); err != nil {
+			s.logger.Error("Failed to close index", zap.Error(err))
+		}
 	})
 }
+
+// indexVideo records a consolidated video in the index, making its file
+// read-only first when write-once storage is on.
+func (s *Server) indexVideo(v processor.Video) {
+	if err := s.retention.Seal(v.Path); err != nil {
+		s.logger.Error("Failed to make recording read-only",
+			zap.String("path", v.Path),
+			zap.Error(err))
+	}
+	rec := &index.Recording{
+		CameraID:   v.CameraID,
+		Path:       v.Path,
+		StartTime:  v.StartTime,
+		EndTime:    v.EndTime,
+		FrameCount: v.FrameCount,
+		SizeBytes:  v.SizeBytes,
+		Codec:      v.Codec,
+	}
+	if err := s.index.AddRecording(context.Background(), rec); err != nil {
+		s.logger.Error("Failed to index recording",
+			zap.String("path", v.Path),
+			zap.Error(err))
+	} else {
+		s.events.Publish(events.New(events.RecordingCreated, rec.CameraID, rec))
+	}
+	if rec.ID != 0 && s.replication != nil {
+		if err := s.replication.Enqueue(context.Background(), rec.ID); err != nil {
+			s.logger.Error("Failed to queue recording for replication",
+				zap.Int64("recording", rec.ID),
+				zap.Error(err))
+		}
+	}
+
+	// The frames are gone once consolidated with delete_originals. Pending
+	// frame rows are committed first so none are left behind.
+	if s.frames != nil && s.config.Storage.VideoConsolidation.DeleteOriginals {
+		if err := s.frames.Flush(context.Background()); err != nil {
+			s.logger.Error("Failed to index frames", zap.Error(err))
+		}
+		if _, err := s.index.DeleteFrames(context.Background(), v.CameraID, v.StartTime, v.EndTime); err != nil {
+			s.logger.Error("Failed to remove consolidated frames from index",
+				zap.String("camera", v.CameraID),
+				zap.Error(err))
+		}
+	}
+}
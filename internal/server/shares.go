@@ -0,0 +1,255 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/index"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// shareTokenPrefix marks the tokens in share links.
+const shareTokenPrefix = "cctvshare_"
+
+const (
+	// shareViewCookie holds the viewing session a counted view starts
+	shareViewCookie = "cctv_share_view"
+	// shareViewTTL is how long a player may keep fetching ranges of a
+	// video without them counting as further views
+	shareViewTTL = time.Hour
+)
+
+// handleCreateShare creates a link to a recording that works without an
+// API token. The link is only shown in the response.
+func (s *Server) handleCreateShare(c *gin.Context) {
+	r, ok := s.lookupRecording(c)
+	if !ok {
+		return
+	}
+	var body struct {
+		Note      string `json:"note"`
+		Password  string `json:"password"`   // asked for by HTTP basic auth; none when empty
+		ExpiresIn string `json:"expires_in"` // e.g. "72h"; never when empty
+		MaxViews  int    `json:"max_views"`  // unlimited when 0
+	}
+	// The body is optional
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if body.MaxViews < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid max_views"})
+		return
+	}
+
+	share := &index.Share{RecordingID: r.ID, Note: body.Note, MaxViews: body.MaxViews}
+	if body.ExpiresIn != "" {
+		d, err := time.ParseDuration(body.ExpiresIn)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid expires_in"})
+			return
+		}
+		at := time.Now().Add(d)
+		share.ExpiresAt = &at
+	}
+	if body.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		share.PasswordHash = string(hash)
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	token := shareTokenPrefix + hex.EncodeToString(secret)
+	if err := s.index.CreateShare(c.Request.Context(), share, hashToken(token)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.logger.Info("Recording shared",
+		zap.Int64("recording", r.ID),
+		zap.Int64("share", share.ID),
+		zap.Bool("password", share.Password),
+		zap.Int("max_views", share.MaxViews))
+	c.JSON(http.StatusCreated, gin.H{"share": share, "token": token, "url": "/share/" + token})
+}
+
+// handleListShares lists shares, including revoked and expired ones, of the
+// recording given by the recording query parameter or of all recordings.
+func (s *Server) handleListShares(c *gin.Context) {
+	var recordingID int64
+	if v := c.Query("recording"); v != "" {
+		var err error
+		if recordingID, err = strconv.ParseInt(v, 10, 64); err != nil || recordingID <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid recording"})
+			return
+		}
+	}
+
+	shares, err := s.index.ListShares(c.Request.Context(), recordingID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if shares == nil {
+		shares = []index.Share{}
+	}
+	c.JSON(http.StatusOK, gin.H{"shares": shares})
+}
+
+// handleRevokeShare stops a share link from working. Downloads already
+// under way are not interrupted.
+func (s *Server) handleRevokeShare(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid share id"})
+		return
+	}
+
+	err = s.index.RevokeShare(c.Request.Context(), id, time.Now())
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "share not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.logger.Info("Share revoked", zap.Int64("share", id))
+	c.Status(http.StatusNoContent)
+}
+
+// handleShare serves the recording of a share link like
+// handleRecordingFile. Unknown and revoked links answer 404, expired and
+// used up ones 410. A password is asked for with HTTP basic auth, with any
+// user name.
+//
+// A GET counts as a view and starts a viewing session, a cookie signed for
+// the link. Players fetch the rest of a video in further range requests,
+// which are let through without counting while the session lasts, even
+// once the link has no views left. Range requests without one count like
+// any other GET. HEAD requests never count.
+func (s *Server) handleShare(c *gin.Context) {
+	token := c.Param("token")
+	if !strings.HasPrefix(token, shareTokenPrefix) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "share not found"})
+		return
+	}
+	ctx := c.Request.Context()
+	share, err := s.index.ShareByHash(ctx, hashToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "share not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	switch {
+	case share.RevokedAt != nil:
+		c.JSON(http.StatusNotFound, gin.H{"error": "share not found"})
+		return
+	case share.Expired(now):
+		c.JSON(http.StatusGone, gin.H{"error": "share has expired"})
+		return
+	}
+
+	if share.Password {
+		_, password, _ := c.Request.BasicAuth()
+		if bcrypt.CompareHashAndPassword([]byte(share.PasswordHash), []byte(password)) != nil {
+			c.Header("WWW-Authenticate", `Basic realm="clip"`)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "password required"})
+			return
+		}
+	}
+
+	rangeHeader := c.GetHeader("Range")
+	viewing := rangeHeader != "" && !strings.HasPrefix(rangeHeader, "bytes=0-") && s.viewingShare(c, share.ID, now)
+	if !viewing && share.UsedUp() {
+		c.JSON(http.StatusGone, gin.H{"error": "share has no views left"})
+		return
+	}
+	if c.Request.Method == http.MethodGet && !viewing {
+		counted, err := s.index.CountShareView(ctx, share.ID, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !counted {
+			c.JSON(http.StatusGone, gin.H{"error": "share has no views left"})
+			return
+		}
+		s.startShareView(c, share.ID, now)
+		s.logger.Info("Share viewed",
+			zap.Int64("share", share.ID),
+			zap.Int64("recording", share.RecordingID),
+			zap.Int("views", share.Views+1),
+			zap.String("client", c.ClientIP()))
+	}
+
+	r, err := s.index.GetRecording(ctx, share.RecordingID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "recording not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	serveRecordingFile(c, r)
+}
+
+// startShareView sets the cookie of a viewing session of a share, valid
+// for shareViewTTL and only on the share's own link.
+func (s *Server) startShareView(c *gin.Context, shareID int64, now time.Time) {
+	expires := strconv.FormatInt(now.Add(shareViewTTL).Unix(), 10)
+	value := expires + "." + s.signShareView(shareID, expires)
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(shareViewCookie, value, int(shareViewTTL.Seconds()), c.Request.URL.Path, "", c.Request.TLS != nil, true)
+}
+
+// viewingShare reports whether the request carries an unexpired viewing
+// session of the share.
+func (s *Server) viewingShare(c *gin.Context, shareID int64, now time.Time) bool {
+	value, err := c.Cookie(shareViewCookie)
+	if err != nil {
+		return false
+	}
+	expires, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+	at, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now.Unix() >= at {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(s.signShareView(shareID, expires)))
+}
+
+// signShareView signs a viewing session of a share that ends at expires,
+// in Unix seconds.
+func (s *Server) signShareView(shareID int64, expires string) string {
+	mac := hmac.New(sha256.New, s.shareViewKey)
+	fmt.Fprintf(mac, "%d.%s", shareID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/camera"
+	"github.com/raeeceip/cctv/internal/processor"
+	"github.com/raeeceip/cctv/internal/wire"
+	"go.uber.org/zap"
+)
+
+// Bounds of ?timeout= on fresh snapshots
+const (
+	defaultSnapshotTimeout = 5 * time.Second
+	maxSnapshotTimeout     = 30 * time.Second
+)
+
+// handleSnapshot returns the latest frame stored for a camera, from
+// memory. With ?fresh=true it instead waits, up to ?timeout= (default 5s),
+// for a frame stored after the request, asking a connected camera to send
+// one right away; cameras that don't read control messages are waited for.
+func (s *Server) handleSnapshot(c *gin.Context) {
+	cameraID := c.Param("id")
+	fresh, err := strconv.ParseBool(c.DefaultQuery("fresh", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid fresh"})
+		return
+	}
+	timeout := defaultSnapshotTimeout
+	if v := c.Query("timeout"); v != "" {
+		if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 || timeout > maxSnapshotTimeout {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "timeout must be a duration up to " + maxSnapshotTimeout.String()})
+			return
+		}
+	}
+
+	if !fresh {
+		f, ok := s.lastFrames.Get(cameraID)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no frame received from camera"})
+			return
+		}
+		writeSnapshot(c, cameraID, f)
+		return
+	}
+
+	requested := time.Now()
+	connected, err := s.cameras.Send(cameraID, wire.Control{Type: wire.ControlSnapshot})
+	if err != nil && !errors.Is(err, camera.ErrNoControl) {
+		s.logger.Warn("Failed to ask camera for a snapshot", zap.String("camera", cameraID), zap.Error(err))
+	}
+	if _, ok := s.lastFrames.Get(cameraID); !connected && !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "camera not connected"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+	f, err := s.lastFrames.Wait(ctx, cameraID, requested)
+	if err != nil {
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "camera sent no frame within " + timeout.String()})
+		return
+	}
+	writeSnapshot(c, cameraID, f)
+}
+
+func writeSnapshot(c *gin.Context, cameraID string, f processor.LastFrame) {
+	c.Header("Cache-Control", "no-cache, no-store")
+	c.Header("X-Camera-Id", cameraID)
+	c.Header("X-Frame-Number", strconv.FormatUint(f.Number, 10))
+	c.Header("X-Frame-Time", f.Timestamp.Format(time.RFC3339Nano))
+	c.Header("X-Frame-Received", f.Received.Format(time.RFC3339Nano))
+	c.Data(http.StatusOK, "image/jpeg", f.Data)
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/processor"
+)
+
+// cameraStats is the health of one camera's frames in the processor.
+type cameraStats struct {
+	CameraID  string `json:"camera_id"`
+	Connected bool   `json:"connected"`
+	// FramesReceived counts the frames of the current connection
+	FramesReceived uint64 `json:"frames_received"`
+	FramesStored   uint64 `json:"frames_stored"`
+	FrameErrors    uint64 `json:"frame_errors"`
+	// ErrorRate is the share of frames that failed to be stored
+	ErrorRate     float64 `json:"error_rate"`
+	PendingFrames int     `json:"pending_frames"`
+	// QueueUtilization is how full the queue the camera's frames wait in
+	// is, from 0 to 1
+	QueueUtilization  float64                        `json:"queue_utilization"`
+	LastConsolidation *processor.ConsolidationResult `json:"last_consolidation,omitempty"`
+}
+
+// handleStats reports the processor's totals and each camera's frame
+// counts, queue utilization and latest consolidation, along with the space
+// left on disk, for dashboards without Prometheus. Totals count from the
+// processor's start.
+func (s *Server) handleStats(c *gin.Context) {
+	stats := make(map[string]*cameraStats)
+	camera := func(id string) *cameraStats {
+		if stats[id] == nil {
+			stats[id] = &cameraStats{CameraID: id, QueueUtilization: s.processor.QueueLoad(id)}
+		}
+		return stats[id]
+	}
+	for _, st := range s.cameras.List() {
+		cs := camera(st.ID)
+		cs.Connected = true
+		cs.FramesReceived = st.Frames
+	}
+	for _, b := range s.processor.Backlog() {
+		cs := camera(b.CameraID)
+		cs.FramesStored = b.FramesStored
+		cs.FrameErrors = b.FrameErrors
+		if total := b.FramesStored + b.FrameErrors; total > 0 {
+			cs.ErrorRate = float64(b.FrameErrors) / float64(total)
+		}
+		cs.PendingFrames = b.PendingFrames
+		cs.LastConsolidation = b.LastConsolidation
+	}
+
+	cameras := make([]*cameraStats, 0, len(stats))
+	var stored, failed uint64
+	for _, cs := range stats {
+		cameras = append(cameras, cs)
+		stored += cs.FramesStored
+		failed += cs.FrameErrors
+	}
+	sort.Slice(cameras, func(i, j int) bool { return cameras[i].CameraID < cameras[j].CameraID })
+
+	m := s.processor.Metrics()
+	totals := m.GetMetrics()
+	totals["frame_error_rate"] = 0.0
+	if stored+failed > 0 {
+		totals["frame_error_rate"] = float64(failed) / float64(stored+failed)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"processor": totals,
+		"cameras":   cameras,
+		"disk":      s.disk.Status(),
+		"time":      time.Now(),
+	})
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/health"
+	"github.com/raeeceip/cctv/internal/processor"
+	"github.com/raeeceip/cctv/pkg/logger"
+)
+
+// handleProcessorStatus reports the consolidation backlog of each camera.
+func (s *Server) handleProcessorStatus(c *gin.Context) {
+	now := time.Now()
+	var cameras []gin.H
+	for _, b := range s.processor.Backlog() {
+		camera := gin.H{
+			"camera_id":      b.CameraID,
+			"pending_frames": b.PendingFrames,
+		}
+		if !b.OldestPending.IsZero() {
+			camera["oldest_pending"] = b.OldestPending
+			camera["oldest_pending_age_seconds"] = now.Sub(b.OldestPending).Seconds()
+		}
+		if b.LastConsolidation != nil {
+			camera["last_consolidation"] = b.LastConsolidation
+		}
+		if b.Dedup != nil {
+			camera["dedup"] = b.Dedup
+		}
+		cameras = append(cameras, camera)
+	}
+
+	s.mu.RLock()
+	status := gin.H{
+		"consolidation_enabled": s.config.Storage.VideoConsolidation.Enabled,
+		"interval":              s.config.Storage.VideoConsolidation.Interval.String(),
+		"pipe":                  s.config.Storage.VideoConsolidation.Pipe,
+		"batch_frames":          ProcessorConfig(s.config).MaxFrames,
+		"cameras":               cameras,
+		"time":                  now,
+	}
+	s.mu.RUnlock()
+	// Left out while it is still being probed
+	if encoder, ok := s.processor.Encoder(); ok {
+		status["encoder"] = encoder
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// BacklogView renders the consolidation backlog as a table for the
+// terminal UI.
+func (s *Server) BacklogView() string {
+	backlog := s.processor.Backlog()
+	if !s.config.Storage.VideoConsolidation.Enabled {
+		return "Video consolidation is disabled"
+	}
+	if len(backlog) == 0 {
+		return "No frames stored yet"
+	}
+
+	now := time.Now()
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CAMERA\tPENDING\tOLDEST\tLAST CONSOLIDATION")
+	for _, c := range backlog {
+		oldest := "-"
+		if !c.OldestPending.IsZero() {
+			oldest = now.Sub(c.OldestPending).Round(time.Second).String()
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", c.CameraID, c.PendingFrames, oldest, lastConsolidation(c.LastConsolidation, now))
+	}
+	tw.Flush()
+	return strings.TrimRight(b.String(), "\n")
+}
+
+func lastConsolidation(r *processor.ConsolidationResult, now time.Time) string {
+	if r == nil {
+		return "never"
+	}
+	ago := now.Sub(r.Time).Round(time.Second)
+	if r.Error != "" {
+		return fmt.Sprintf("failed %s ago: %s", ago, r.Error)
+	}
+	return fmt.Sprintf("%d frames %s ago", r.Frames, ago)
+}
+
+// Server feeds the terminal UI dashboard.
+var _ logger.StatusProvider = (*Server)(nil)
+
+// CameraStatus lists the cameras seen lately, by ID, with their health and
+// frame rate.
+func (s *Server) CameraStatus() []logger.CameraStatus {
+	now := time.Now()
+	var list []logger.CameraStatus
+	for _, h := range s.health.List() {
+		c := logger.CameraStatus{ID: h.ID, State: h.State}
+		if h.State != health.Offline {
+			c.QueueLoad = s.processor.QueueLoad(h.ID)
+			if windows, ok := s.calibration.Measure(h.ID, now); ok {
+				c.FPS = windows[0].FPS
+			}
+		}
+		if st, ok := s.cameras.Status(h.ID); ok {
+			c.Frames = st.Frames
+		}
+		list = append(list, c)
+	}
+	return list
+}
+
+// QueueStatus reports the frames waiting in the processor.
+func (s *Server) QueueStatus() logger.QueueStatus {
+	var q logger.QueueStatus
+	q.Queued, q.Capacity = s.processor.QueueDepth()
+	for _, b := range s.processor.Backlog() {
+		q.Pending += b.PendingFrames
+	}
+	m := s.processor.Metrics()
+	q.FramesProcessed = m.TotalFramesProcessed
+	q.Errors = m.TotalProcessingErrors
+	return q
+}
+
+// DiskStatus reports the last check of the space frames are stored in.
+func (s *Server) DiskStatus() logger.DiskStatus {
+	st := s.disk.Status()
+	return logger.DiskStatus{
+		Path:          st.Path,
+		FreeBytes:     st.FreeBytes,
+		TotalBytes:    st.TotalBytes,
+		LowWaterBytes: st.LowWaterBytes,
+		Low:           st.Low,
+		Error:         st.Error,
+	}
+}
@@ -0,0 +1,340 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/framecache"
+	"github.com/raeeceip/cctv/internal/framestore"
+	"github.com/raeeceip/cctv/internal/processor"
+	"github.com/raeeceip/cctv/internal/transform"
+	"go.uber.org/zap"
+)
+
+// tailBuffer is how many live frames a tail can fall behind before it has
+// to catch up from disk.
+const tailBuffer = 256
+
+// tailFrame is a stored frame sent to a tail.
+type tailFrame struct {
+	Number uint64
+	Time   time.Time
+	Path   string
+	Data   []byte
+}
+
+// tail is one client following a camera's frames.
+type tail struct {
+	frames chan tailFrame
+	lagged chan struct{} // closed when the client fell behind
+	once   sync.Once
+}
+
+// tails fans stored frames out to the clients following each camera.
+type tails struct {
+	mu      sync.Mutex
+	cameras map[string]map[*tail]struct{}
+}
+
+func (ts *tails) subscribe(cameraID string) *tail {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.cameras == nil {
+		ts.cameras = make(map[string]map[*tail]struct{})
+	}
+	if ts.cameras[cameraID] == nil {
+		ts.cameras[cameraID] = make(map[*tail]struct{})
+	}
+	t := &tail{frames: make(chan tailFrame, tailBuffer), lagged: make(chan struct{})}
+	ts.cameras[cameraID][t] = struct{}{}
+	return t
+}
+
+func (ts *tails) unsubscribe(cameraID string, t *tail) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	delete(ts.cameras[cameraID], t)
+	if len(ts.cameras[cameraID]) == 0 {
+		delete(ts.cameras, cameraID)
+	}
+}
+
+// publish hands a saved frame to the camera's tails without blocking. A
+// tail that is full is marked lagged rather than silently losing frames; a
+// mirror with gaps is worse than one that is a little behind.
+func (ts *tails) publish(f processor.FrameData) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	subs := ts.cameras[f.CameraID]
+	if len(subs) == 0 {
+		return
+	}
+
+	// Data is recycled once the hook returns
+	frame := tailFrame{
+		Number: f.Number,
+		Time:   f.Timestamp,
+		Path:   f.Path,
+		Data:   append([]byte(nil), f.Data...),
+	}
+	for t := range subs {
+		select {
+		case t.frames <- frame:
+		default:
+			t.once.Do(func() { close(t.lagged) })
+		}
+	}
+}
+
+// handleTail streams a camera's frames as they are stored, as a
+// multipart/mixed response with one JPEG part per frame. With since (RFC 3339)
+// the frames taken from then on that are still on disk are sent first, so a
+// client that reconnects with the time of the last frame it got misses
+// nothing but may get that frame again. A client that falls behind the live
+// frames catches up from disk the same way.
+func (s *Server) handleTail(c *gin.Context) {
+	cameraID := c.Param("id")
+	var since time.Time
+	if v := c.Query("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since"})
+			return
+		}
+	}
+	store, err := framestore.New(s.config.Storage.OutputDir, framestore.Layout(s.config.Storage.FrameLayout), s.config.Storage.Naming.Frame, s.config.Site)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	mw := multipart.NewWriter(c.Writer)
+	c.Header("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	s.logger.Info("Tail started",
+		zap.String("camera", cameraID),
+		zap.String("remote", c.ClientIP()),
+		zap.Time("since", since))
+
+	last := since
+	write := func(f tailFrame) error {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", "image/jpeg")
+		h.Set("Content-Length", strconv.Itoa(len(f.Data)))
+		h.Set("X-Camera-Id", cameraID)
+		h.Set("X-Frame-Number", strconv.FormatUint(f.Number, 10))
+		h.Set("X-Frame-Time", f.Time.Format(time.RFC3339Nano))
+		h.Set("X-Frame-Name", filepath.Base(f.Path))
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		if _, err := part.Write(f.Data); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		if f.Time.After(last) {
+			last = f.Time
+		}
+		return nil
+	}
+
+	for {
+		lagged, err := s.followTail(c, store, cameraID, last, write)
+		if err != nil || !lagged {
+			if err == nil {
+				mw.Close()
+			}
+			return
+		}
+		s.logger.Debug("Tail fell behind, catching up from disk",
+			zap.String("camera", cameraID),
+			zap.Time("from", last))
+	}
+}
+
+// followTail sends the frames stored since, if set, and then the live ones
+// until the client goes away, the server shuts down or the client falls
+// behind, which is reported as lagged.
+func (s *Server) followTail(c *gin.Context, store *framestore.Store, cameraID string,
+	since time.Time, write func(tailFrame) error) (lagged bool, err error) {
+	// Subscribe before listing the disk so no frame falls between them
+	t := s.tails.subscribe(cameraID)
+	defer s.tails.unsubscribe(cameraID, t)
+
+	sent := make(map[string]bool)
+	if !since.IsZero() {
+		stored, err := storedFrames(store, cameraID, since)
+		if err != nil {
+			return false, err
+		}
+		for _, f := range stored {
+			data, ok := s.frameCache.Read(cameraID, f.Path)
+			if !ok {
+				data, err = os.ReadFile(f.Path)
+				if os.IsNotExist(err) {
+					// Consolidated and deleted meanwhile
+					continue
+				}
+				if err != nil {
+					return false, err
+				}
+			}
+			f.Data = data
+			if err := write(f); err != nil {
+				return false, err
+			}
+			sent[f.Path] = true
+		}
+	}
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return false, c.Request.Context().Err()
+		case <-s.shutdown:
+			return false, nil
+		case <-t.lagged:
+			return true, nil
+		case f := <-t.frames:
+			if sent[f.Path] {
+				delete(sent, f.Path)
+				continue
+			}
+			if err := write(f); err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
+// frameLookback is how far before the requested time handleFrame looks
+// for a frame on disk.
+const frameLookback = time.Minute
+
+// handleFrame returns the frame a camera took at or last before ?at= (RFC
+// 3339), or its latest frame without it, for scrubbing through recent
+// footage. Frames still in the frame cache are served from memory, older
+// ones from disk if taken within a minute before at. ?crop= and ?zoom= serve
+// just part of the frame.
+func (s *Server) handleFrame(c *gin.Context) {
+	cameraID := c.Param("id")
+	crop, ok := bindCrop(c)
+	if !ok {
+		return
+	}
+	var at time.Time
+	if v := c.Query("at"); v != "" {
+		var err error
+		if at, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid at"})
+			return
+		}
+	}
+
+	f, cached := s.frameCache.At(cameraID, at)
+	if !cached {
+		var err error
+		var ok bool
+		if f, ok, err = s.storedFrameAt(cameraID, at); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no frame found"})
+			return
+		}
+	}
+
+	data := f.Data
+	if !crop.Whole() {
+		var err error
+		if data, err = crop.JPEG(f.Data, transformQuality); errors.Is(err, transform.ErrOutside) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.Header("X-Camera-Id", cameraID)
+	c.Header("X-Frame-Number", strconv.FormatUint(f.Number, 10))
+	c.Header("X-Frame-Time", f.Time.Format(time.RFC3339Nano))
+	c.Header("X-Frame-Name", filepath.Base(f.Path))
+	c.Header("X-Frame-Cache", strconv.FormatBool(cached))
+	c.Data(http.StatusOK, "image/jpeg", data)
+}
+
+// storedFrameAt reads the frame a camera took at or last before at from
+// disk, looking back up to frameLookback.
+func (s *Server) storedFrameAt(cameraID string, at time.Time) (framecache.Frame, bool, error) {
+	if at.IsZero() {
+		at = time.Now()
+	}
+	store, err := framestore.New(s.config.Storage.OutputDir, framestore.Layout(s.config.Storage.FrameLayout), s.config.Storage.Naming.Frame, s.config.Site)
+	if err != nil {
+		return framecache.Frame{}, false, err
+	}
+	stored, err := storedFrames(store, cameraID, at.Add(-frameLookback))
+	if err != nil {
+		return framecache.Frame{}, false, err
+	}
+	// Newest first, skipping frames consolidated and deleted meanwhile
+	for i := len(stored) - 1; i >= 0; i-- {
+		f := stored[i]
+		if f.Time.After(at) {
+			continue
+		}
+		data, err := os.ReadFile(f.Path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return framecache.Frame{}, false, err
+		}
+		return framecache.Frame{Number: f.Number, Time: f.Time, Path: f.Path, Data: data}, true, nil
+	}
+	return framecache.Frame{}, false, nil
+}
+
+// storedFrames lists a camera's frames on disk taken at or after since, in
+// order, without reading them.
+func storedFrames(store *framestore.Store, cameraID string, since time.Time) ([]tailFrame, error) {
+	paths, err := store.Frames(cameraID, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list frames: %w", err)
+	}
+
+	// Names only keep milliseconds
+	since = since.Truncate(time.Millisecond)
+	var frames []tailFrame
+	for _, path := range paths {
+		n, t, ok := store.ParseName(filepath.Base(path))
+		if !ok || t.Before(since) {
+			continue
+		}
+		frames = append(frames, tailFrame{Number: n, Time: t, Path: path})
+	}
+	sort.Slice(frames, func(i, j int) bool {
+		if !frames[i].Time.Equal(frames[j].Time) {
+			return frames[i].Time.Before(frames[j].Time)
+		}
+		return frames[i].Number < frames[j].Number
+	})
+	return frames, nil
+}
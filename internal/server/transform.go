@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/codec"
+	"github.com/raeeceip/cctv/internal/processor"
+	"github.com/raeeceip/cctv/internal/transform"
+	"go.uber.org/zap"
+)
+
+// transformQuality is the JPEG quality transformed frames are encoded at.
+const transformQuality = 90
+
+// cameraTransform returns the saved transform of a camera.
+func (s *Server) cameraTransform(ctx context.Context, cameraID string) (transform.Transform, error) {
+	var t transform.Transform
+	profile, err := s.index.GetCameraProfile(ctx, cameraID)
+	if err != nil {
+		return t, err
+	}
+	if profile.Transform != "" {
+		if err := json.Unmarshal([]byte(profile.Transform), &t); err != nil {
+			return t, fmt.Errorf("invalid saved transform: %w", err)
+		}
+	}
+	return t, nil
+}
+
+// transformFor returns a camera's transform, reading it from the index the
+// first time.
+func (s *Server) transformFor(cameraID string) transform.Transform {
+	if t, ok := s.transforms.Load(cameraID); ok {
+		return t.(transform.Transform)
+	}
+	t, err := s.cameraTransform(context.Background(), cameraID)
+	if err != nil {
+		// Frames go through as they are, and the next one tries again
+		s.logger.Warn("Failed to load camera transform", zap.String("camera", cameraID), zap.Error(err))
+		return transform.Transform{}
+	}
+	// A transform saved meanwhile wins
+	actual, _ := s.transforms.LoadOrStore(cameraID, t)
+	return actual.(transform.Transform)
+}
+
+// transformFrame rotates and mirrors a frame as its camera is set to, then
+// applies its privacy masks, before it is stored or viewed. Frames that
+// can't be decoded are left for the processor to refuse, unless they were
+// to be masked: it reports false for those, which mustn't be kept, and for
+// frames whose masks can't be read.
+func (s *Server) transformFrame(frame *processor.FrameData) bool {
+	t := s.transformFor(frame.CameraID)
+	masks, err := s.masksFor(frame.CameraID)
+	if err != nil {
+		s.logger.Warn("Failed to load camera privacy masks, dropping frame", zap.String("camera", frame.CameraID), zap.Error(err))
+		return false
+	}
+	if t.Identity() && len(masks) == 0 {
+		return true
+	}
+	img, err := codec.Decode(frame.Data)
+	if err != nil {
+		s.logger.Debug("Failed to transform frame", zap.String("camera", frame.CameraID), zap.Error(err))
+		return len(masks) == 0
+	}
+	if !t.Identity() {
+		img = t.Apply(img)
+	}
+	var buf bytes.Buffer
+	if err := codec.Encode(&buf, masks.Apply(img), transformQuality); err != nil {
+		s.logger.Debug("Failed to transform frame", zap.String("camera", frame.CameraID), zap.Error(err))
+		return len(masks) == 0
+	}
+	frame.SetData(buf.Bytes())
+	return true
+}
+
+// jpegFrame converts a WebP frame to the JPEG viewers get, which is
+// otherwise the processor's job. It reports false for those that can't be.
+func (s *Server) jpegFrame(frame *processor.FrameData) bool {
+	if codec.Encoding(frame.Data) == codec.JPEG {
+		return true
+	}
+	data, err := codec.ToJPEG(frame.Data, transformQuality)
+	if err != nil {
+		s.logger.Debug("Failed to convert frame", zap.String("camera", frame.CameraID), zap.Error(err))
+		return false
+	}
+	frame.SetData(data)
+	return true
+}
+
+func (s *Server) handleGetTransform(c *gin.Context) {
+	t, err := s.cameraTransform(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+// handlePutTransform saves a camera's transform. It applies to the frames
+// received from then on.
+func (s *Server) handlePutTransform(c *gin.Context) {
+	var t transform.Transform
+	if err := c.ShouldBindJSON(&t); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := t.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	cameraID := c.Param("id")
+	if err := s.index.SaveCameraTransform(c.Request.Context(), cameraID, string(data)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.transforms.Store(cameraID, t)
+	c.JSON(http.StatusOK, t)
+}
+
+// bindCrop reads the part of a camera's view a request asks for, from
+// ?crop=x,y,w,h and ?zoom=. It answers 400 and returns false if they are
+// invalid.
+func bindCrop(c *gin.Context) (transform.Crop, bool) {
+	crop, err := transform.ParseCrop(c.Query("crop"), c.Query("zoom"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return crop, false
+	}
+	return crop, true
+}
@@ -0,0 +1,352 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raeeceip/cctv/internal/index"
+	"go.uber.org/zap"
+)
+
+// Scopes a user token can carry
+const (
+	scopeRecordings = "recordings" // move recordings to and from the trash, and export them
+	scopeSearches   = "searches"   // save and delete saved searches
+	scopeSettings   = "settings"   // read and change the user's preferences
+	scopeShares     = "shares"     // create, list and revoke share links
+	scopeTokens     = "tokens"     // create, list and revoke the user's tokens
+)
+
+var allScopes = []string{scopeRecordings, scopeSearches, scopeSettings, scopeShares, scopeTokens}
+
+// tokenPrefix marks user tokens so they are recognisable in config files
+// and logs.
+const tokenPrefix = "cctv_"
+
+// touchInterval limits how often a token's last use is written.
+const touchInterval = time.Minute
+
+// Context keys set by requireScope and requireUser
+const (
+	userKey  = "user"
+	tokenKey = "token"
+)
+
+// newToken returns a random user token and the hash it is stored under.
+func newToken() (token, hash string, err error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	token = tokenPrefix + hex.EncodeToString(secret)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerToken returns the request's bearer token, "" without an
+// Authorization header of the Bearer scheme.
+func bearerToken(c *gin.Context) string {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return token
+}
+
+// isAdminToken reports whether the request carries the admin token.
+func (s *Server) isAdminToken(c *gin.Context) bool {
+	s.mu.RLock()
+	token := s.config.Server.Admin.Token
+	s.mu.RUnlock()
+	return token != "" && subtle.ConstantTimeCompare([]byte(bearerToken(c)), []byte(token)) == 1
+}
+
+// authenticateUser looks up the user token of the request. It aborts the
+// request and returns false if there is no valid one.
+func (s *Server) authenticateUser(c *gin.Context) bool {
+	provided := bearerToken(c)
+	if !strings.HasPrefix(provided, tokenPrefix) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "user token required"})
+		return false
+	}
+
+	token, user, err := s.index.TokenByHash(c.Request.Context(), hashToken(provided))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+		return false
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	now := time.Now()
+	if token.Expired(now) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "token expired"})
+		return false
+	}
+
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= touchInterval {
+		if err := s.index.TouchToken(c.Request.Context(), token.ID, now); err != nil {
+			s.logger.Warn("Failed to record token use", zap.Int64("token", token.ID), zap.Error(err))
+		}
+	}
+	c.Set(userKey, user)
+	c.Set(tokenKey, token)
+	return true
+}
+
+// requireScope lets through the admin token and user tokens with scope.
+func (s *Server) requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.isAdminToken(c) {
+			c.Next()
+			return
+		}
+		if !s.authenticateUser(c) {
+			return
+		}
+		if !c.MustGet(tokenKey).(*index.APIToken).HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "token lacks scope " + scope})
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireUser lets through user tokens, with scope unless it is empty. The
+// admin token has no user and is refused.
+func (s *Server) requireUser(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.authenticateUser(c) {
+			return
+		}
+		if scope != "" && !c.MustGet(tokenKey).(*index.APIToken).HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "token lacks scope " + scope})
+			return
+		}
+		c.Next()
+	}
+}
+
+// identifyUser authenticates a user token if the request carries one, so
+// handlers can act for that user; other requests pass through anonymously.
+func (s *Server) identifyUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if strings.HasPrefix(bearerToken(c), tokenPrefix) && !s.authenticateUser(c) {
+			return
+		}
+		c.Next()
+	}
+}
+
+func validScopes(scopes []string) bool {
+	for _, scope := range scopes {
+		known := false
+		for _, s := range allScopes {
+			known = known || s == scope
+		}
+		if !known {
+			return false
+		}
+	}
+	return true
+}
+
+// handleCreateUser adds a user and returns a first token with every scope,
+// which the user can then trade for narrower ones.
+func (s *Server) handleCreateUser(c *gin.Context) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+
+	user, err := s.index.CreateUser(c.Request.Context(), body.Name)
+	if errors.Is(err, index.ErrUserExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	token, secret, err := s.issueToken(c, &index.APIToken{UserID: user.ID, Name: "initial", Scopes: allScopes})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"user": user, "token": token, "secret": secret})
+}
+
+func (s *Server) handleListUsers(c *gin.Context) {
+	users, err := s.index.ListUsers(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if users == nil {
+		users = []index.User{}
+	}
+	c.JSON(http.StatusOK, gin.H{"users": users})
+}
+
+// handleMe describes the caller and the token in use.
+func (s *Server) handleMe(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"user":  c.MustGet(userKey),
+		"token": c.MustGet(tokenKey),
+	})
+}
+
+func (s *Server) handleGetSettings(c *gin.Context) {
+	user := c.MustGet(userKey).(*index.User)
+	settings, err := s.index.GetUserSettings(c.Request.Context(), user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
+
+// handlePutSettings replaces the caller's preferences.
+func (s *Server) handlePutSettings(c *gin.Context) {
+	var settings index.UserSettings
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if settings.Timezone != "" {
+		if _, err := time.LoadLocation(settings.Timezone); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown timezone"})
+			return
+		}
+	}
+	if len(settings.Notifications) > 0 {
+		var obj map[string]interface{}
+		if err := json.Unmarshal(settings.Notifications, &obj); err != nil || obj == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "notifications must be an object"})
+			return
+		}
+	} else {
+		settings.Notifications = json.RawMessage("{}")
+	}
+
+	user := c.MustGet(userKey).(*index.User)
+	if err := s.index.SaveUserSettings(c.Request.Context(), user.ID, &settings); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
+
+func (s *Server) handleListTokens(c *gin.Context) {
+	user := c.MustGet(userKey).(*index.User)
+	tokens, err := s.index.ListTokens(c.Request.Context(), user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if tokens == nil {
+		tokens = []index.APIToken{}
+	}
+	c.JSON(http.StatusOK, gin.H{"tokens": tokens})
+}
+
+// handleCreateToken issues the caller a new token. It can carry at most
+// the scopes of the token used to ask for it. The secret is only shown
+// in this response.
+func (s *Server) handleCreateToken(c *gin.Context) {
+	var body struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		ExpiresIn string   `json:"expires_in"` // e.g. "720h"; never when empty
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !validScopes(body.Scopes) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown scope", "scopes": allScopes})
+		return
+	}
+	caller := c.MustGet(tokenKey).(*index.APIToken)
+	for _, scope := range body.Scopes {
+		if !caller.HasScope(scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "cannot grant scope " + scope})
+			return
+		}
+	}
+
+	user := c.MustGet(userKey).(*index.User)
+	t := &index.APIToken{UserID: user.ID, Name: body.Name, Scopes: body.Scopes}
+	if body.ExpiresIn != "" {
+		d, err := time.ParseDuration(body.ExpiresIn)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid expires_in"})
+			return
+		}
+		at := time.Now().Add(d)
+		t.ExpiresAt = &at
+	}
+
+	token, secret, err := s.issueToken(c, t)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"token": token, "secret": secret})
+}
+
+// handleDeleteToken revokes one of the caller's tokens, which may be the
+// one in use.
+func (s *Server) handleDeleteToken(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid token id"})
+		return
+	}
+
+	user := c.MustGet(userKey).(*index.User)
+	err = s.index.DeleteToken(c.Request.Context(), user.ID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "token not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// issueToken generates a secret for t and stores it.
+func (s *Server) issueToken(c *gin.Context, t *index.APIToken) (*index.APIToken, string, error) {
+	secret, hash, err := newToken()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := s.index.CreateToken(c.Request.Context(), t, hash); err != nil {
+		return nil, "", err
+	}
+	s.logger.Info("API token issued",
+		zap.Int64("user", t.UserID),
+		zap.Int64("token", t.ID),
+		zap.Strings("scopes", t.Scopes))
+	return t, secret, nil
+}
@@ -0,0 +1,466 @@
+package shard
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/config"
+	"github.com/raeeceip/cctv/internal/processor"
+	"github.com/raeeceip/cctv/internal/videocodec"
+	"github.com/raeeceip/cctv/pkg/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	// A worker that exits is restarted after restartDelay, doubling up to
+	// maxRestartDelay while it keeps crashing soon after starting
+	restartDelay    = time.Second
+	maxRestartDelay = time.Minute
+	// flushTimeout bounds how long Flush waits for a worker to consolidate
+	flushTimeout = 5 * time.Minute
+)
+
+// Pool implements processor.Processor with one worker process per shard.
+type Pool struct {
+	logger   *logger.Logger
+	exe      string
+	launcher []string
+	workers  []*worker
+
+	onVideo []func(processor.Video)
+	onFrame []func(processor.FrameData)
+
+	intervalMu    sync.Mutex
+	videoInterval time.Duration // as last set
+
+	flushMu  sync.Mutex
+	stopOnce sync.Once
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+type worker struct {
+	shard int
+	// queue holds frames while the process is busy or being restarted
+	queue   chan message
+	flushed chan string
+	// control holds a video interval to send, apart from the frames so
+	// changing it never waits for a full queue
+	control chan time.Duration
+
+	mu      sync.Mutex
+	running bool
+	backlog []processor.CameraBacklog // as last reported
+	metrics processor.ProcessorMetrics
+	encoder *videocodec.Encoder // as reported, nil until chosen
+}
+
+// NewPool prepares cfg.Processor.Shards workers running this executable.
+// bufferSize frames are queued per shard. videoInterval is the one the
+// workers read from the configuration file.
+func NewPool(cfg config.ProcessorConfig, bufferSize int, videoInterval time.Duration, log *logger.Logger) (*Pool, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate worker executable: %w", err)
+	}
+
+	p := &Pool{
+		logger:   log,
+		exe:      exe,
+		launcher: cfg.Launcher,
+		stop:     make(chan struct{}),
+
+		videoInterval: videoInterval,
+	}
+	for i := 0; i < cfg.Shards; i++ {
+		p.workers = append(p.workers, &worker{
+			shard:   i,
+			queue:   make(chan message, bufferSize),
+			flushed: make(chan string, 1),
+			control: make(chan time.Duration, 1),
+		})
+	}
+	return p, nil
+}
+
+// Start launches the workers. They keep running, and are restarted when they
+// exit, until ctx is cancelled or Stop.
+func (p *Pool) Start(ctx context.Context) error {
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.stopOnce.Do(func() {
+				close(p.stop)
+			})
+		case <-p.stop:
+		}
+	}()
+	for _, w := range p.workers {
+		p.wg.Add(1)
+		go func(w *worker) {
+			defer p.wg.Done()
+			p.supervise(w)
+		}(w)
+	}
+
+	p.logger.Info("Frame processor shards started",
+		zap.Int("shards", len(p.workers)),
+		zap.String("executable", p.exe))
+	return nil
+}
+
+// ProcessFrame queues a frame for the shard of its camera. Like
+// FrameProcessor it takes over the frame's buffer.
+func (p *Pool) ProcessFrame(frame processor.FrameData) error {
+	if frame.CameraID == "" || frame.Number == 0 || len(frame.Data) == 0 {
+		frame.Release()
+		return fmt.Errorf("invalid frame data")
+	}
+
+	select {
+	case p.shardFor(frame.CameraID).queue <- message{Frame: &frame}:
+		return nil
+	default:
+		frame.Release()
+		return fmt.Errorf("frame processing queue full")
+	}
+}
+
+// QueueLoad returns how full the queue of a camera's shard is, from 0 for
+// empty to 1 for full, when frames are dropped.
+func (p *Pool) QueueLoad(cameraID string) float64 {
+	q := p.shardFor(cameraID).queue
+	if cap(q) == 0 {
+		return 0
+	}
+	return float64(len(q)) / float64(cap(q))
+}
+
+// QueueDepth returns how many frames wait in the shards' queues, and how
+// many they hold. Frames a worker process has read are not counted.
+func (p *Pool) QueueDepth() (queued, capacity int) {
+	for _, w := range p.workers {
+		queued += len(w.queue)
+		capacity += cap(w.queue)
+	}
+	return queued, capacity
+}
+
+// Flush asks every worker to consolidate its pending frames and waits for
+// them to finish.
+func (p *Pool) Flush() error {
+	p.flushMu.Lock()
+	defer p.flushMu.Unlock()
+
+	var errs []string
+	var waiting []*worker
+	for _, w := range p.workers {
+		if !w.isRunning() {
+			errs = append(errs, fmt.Sprintf("shard %d: not running", w.shard))
+			continue
+		}
+		// Discard the answer to an earlier flush that timed out
+		select {
+		case <-w.flushed:
+		default:
+		}
+		w.queue <- message{Flush: true}
+		waiting = append(waiting, w)
+	}
+
+	timeout := time.After(flushTimeout)
+	for _, w := range waiting {
+		select {
+		case msg := <-w.flushed:
+			if msg != "" {
+				errs = append(errs, fmt.Sprintf("shard %d: %s", w.shard, msg))
+			}
+		case <-timeout:
+			errs = append(errs, fmt.Sprintf("shard %d: timed out", w.shard))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("flush failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// SetVideoInterval changes how often every running worker consolidates,
+// without waiting for it. Workers started later read the interval from the
+// configuration file instead.
+func (p *Pool) SetVideoInterval(d time.Duration) {
+	p.intervalMu.Lock()
+	defer p.intervalMu.Unlock()
+	if d == p.videoInterval {
+		return
+	}
+	p.videoInterval = d
+	for _, w := range p.workers {
+		if !w.isRunning() {
+			continue
+		}
+		// Replace an interval the worker hasn't been sent yet; with the
+		// lock held, nothing else can fill the channel again
+		select {
+		case <-w.control:
+		default:
+		}
+		w.control <- d
+	}
+}
+
+// Stop closes the workers' input, unless cancelling Start's ctx did,
+// which makes them consolidate what they have and exit, and waits for them.
+func (p *Pool) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+	p.wg.Wait()
+	p.logger.Info("Frame processor shards stopped")
+}
+
+// Metrics returns the totals last reported by the workers, added up. A
+// restarted worker starts counting again.
+func (p *Pool) Metrics() processor.ProcessorMetrics {
+	var m processor.ProcessorMetrics
+	for _, w := range p.workers {
+		w.mu.Lock()
+		m.Merge(w.metrics)
+		w.mu.Unlock()
+	}
+	return m
+}
+
+// Backlog returns the consolidation backlog last reported by each worker.
+func (p *Pool) Backlog() []processor.CameraBacklog {
+	var list []processor.CameraBacklog
+	for _, w := range p.workers {
+		w.mu.Lock()
+		list = append(list, w.backlog...)
+		w.mu.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CameraID < list[j].CameraID
+	})
+	return list
+}
+
+// Encoder returns the encoder a worker reported choosing. The workers
+// share a configuration, so they choose the same unless their hardware
+// differs.
+func (p *Pool) Encoder() (videocodec.Encoder, bool) {
+	for _, w := range p.workers {
+		w.mu.Lock()
+		e := w.encoder
+		w.mu.Unlock()
+		if e != nil {
+			return *e, true
+		}
+	}
+	return videocodec.Encoder{}, false
+}
+
+// OnVideoCreated registers fn to be called for videos written by any
+// worker. Register hooks before Start.
+func (p *Pool) OnVideoCreated(fn func(processor.Video)) {
+	p.onVideo = append(p.onVideo, fn)
+}
+
+// OnFrameSaved registers fn to be called for frames stored by any worker.
+// Register hooks before Start.
+func (p *Pool) OnFrameSaved(fn func(processor.FrameData)) {
+	p.onFrame = append(p.onFrame, fn)
+}
+
+func (p *Pool) shardFor(cameraID string) *worker {
+	h := fnv.New32a()
+	h.Write([]byte(cameraID))
+	return p.workers[h.Sum32()%uint32(len(p.workers))]
+}
+
+func (w *worker) isRunning() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.running
+}
+
+func (w *worker) setRunning(running bool) {
+	w.mu.Lock()
+	w.running = running
+	if !running {
+		// A restarted worker only reports cameras it hears from again
+		w.backlog = nil
+	}
+	w.mu.Unlock()
+}
+
+// supervise runs a worker process and restarts it until Stop.
+func (p *Pool) supervise(w *worker) {
+	delay := restartDelay
+	for {
+		started := time.Now()
+		err := p.run(w)
+
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+
+		if time.Since(started) > maxRestartDelay {
+			delay = restartDelay
+		}
+		p.logger.Error("Shard worker exited, restarting",
+			zap.Int("shard", w.shard),
+			zap.Duration("restart_in", delay),
+			zap.Error(err))
+
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
+
+// run starts one worker process and feeds it until it exits or Stop is
+// called, in which case it waits for the worker to finish consolidating.
+func (p *Pool) run(w *worker) error {
+	args := []string{"worker", "-shard", strconv.Itoa(w.shard)}
+	name := p.exe
+	if len(p.launcher) > 0 {
+		var launcher []string
+		for _, a := range p.launcher {
+			launcher = append(launcher, strings.ReplaceAll(a, "{shard}", strconv.Itoa(w.shard)))
+		}
+		name = launcher[0]
+		args = append(append(launcher[1:], p.exe), args...)
+	}
+
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start worker: %w", err)
+	}
+	w.setRunning(true)
+	defer w.setRunning(false)
+
+	p.logger.Info("Shard worker started",
+		zap.Int("shard", w.shard),
+		zap.Int("pid", cmd.Process.Pid))
+
+	// Events are read until the worker closes its stdout by exiting
+	readDone := make(chan error, 1)
+	go func() {
+		readDone <- p.readEvents(w, stdout)
+	}()
+
+	enc := gob.NewEncoder(stdin)
+	var readErr error
+	stopped := false
+feed:
+	for {
+		select {
+		case msg := <-w.queue:
+			err := enc.Encode(msg)
+			if msg.Frame != nil {
+				msg.Frame.Release()
+			}
+			if err != nil {
+				// The worker died; the reader reports why. A lost frame is
+				// not worth replaying.
+				break feed
+			}
+		case d := <-w.control:
+			if err := enc.Encode(message{VideoInterval: d}); err != nil {
+				break feed
+			}
+		case readErr = <-readDone:
+			readDone = nil
+			break feed
+		case <-p.stop:
+			stopped = true
+			break feed
+		}
+	}
+
+	stdin.Close()
+	if readDone != nil {
+		readErr = <-readDone
+	}
+	err = cmd.Wait()
+	if stopped {
+		p.logger.Info("Shard worker stopped", zap.Int("shard", w.shard))
+		return nil
+	}
+	if err == nil {
+		err = readErr
+	}
+	if err == nil {
+		err = fmt.Errorf("worker exited")
+	}
+	return err
+}
+
+// readEvents dispatches a worker's events to the hooks until its output ends.
+func (p *Pool) readEvents(w *worker, r io.Reader) error {
+	dec := gob.NewDecoder(r)
+	for {
+		var ev event
+		if err := dec.Decode(&ev); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to read worker events: %w", err)
+		}
+
+		switch {
+		case ev.Video != nil:
+			for _, fn := range p.onVideo {
+				fn(*ev.Video)
+			}
+		case ev.Frame != nil:
+			for _, fn := range p.onFrame {
+				fn(*ev.Frame)
+			}
+		case ev.Encoder != nil:
+			w.mu.Lock()
+			w.encoder = ev.Encoder
+			w.mu.Unlock()
+		case ev.Flushed:
+			select {
+			case w.flushed <- ev.Err:
+			default:
+			}
+		case len(ev.Backlog) > 0:
+			w.mu.Lock()
+			w.backlog = ev.Backlog
+			if ev.Metrics != nil {
+				w.metrics = *ev.Metrics
+			}
+			w.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Package shard spreads frame processing over worker processes. Cameras are
+// assigned to a shard by hashing their ID, and each shard runs
+// "cctvserver worker" with its own FrameProcessor. The parent talks to a
+// worker over its stdin and stdout using gob.
+package shard
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/processor"
+	"github.com/raeeceip/cctv/internal/videocodec"
+	"github.com/raeeceip/cctv/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// message is sent from the parent to a worker.
+type message struct {
+	Frame         *processor.FrameData
+	Flush         bool
+	VideoInterval time.Duration // changed, if set
+}
+
+// backlogInterval is how often a worker reports its backlog.
+const backlogInterval = time.Second
+
+// event is sent from a worker to the parent.
+type event struct {
+	Video   *processor.Video
+	Frame   *processor.FrameData // saved frame, Data decoded
+	Flushed bool
+	Err     string
+	Backlog []processor.CameraBacklog   // periodic report, once there are cameras
+	Metrics *processor.ProcessorMetrics // periodic report, with Backlog
+	Encoder *videocodec.Encoder         // once chosen
+}
+
+// RunWorker starts proc and serves the parent over r and w until r is
+// closed, then stops proc, which consolidates the frames that are left.
+func RunWorker(proc processor.Processor, log *logger.Logger, r io.Reader, w io.Writer) error {
+	var mu sync.Mutex
+	enc := gob.NewEncoder(w)
+	send := func(ev event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := enc.Encode(ev); err != nil {
+			log.Error("Failed to send event to parent", zap.Error(err))
+		}
+	}
+
+	proc.OnVideoCreated(func(v processor.Video) {
+		send(event{Video: &v})
+	})
+	proc.OnFrameSaved(func(f processor.FrameData) {
+		send(event{Frame: &f})
+	})
+
+	// Same order as the server's shutdown: the processing routines end
+	// before Stop closes their channels
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := proc.Start(ctx); err != nil {
+		cancel()
+		return fmt.Errorf("failed to start processor: %w", err)
+	}
+	defer func() {
+		cancel()
+		proc.Stop()
+	}()
+
+	go func() {
+		ticker := time.NewTicker(backlogInterval)
+		defer ticker.Stop()
+		encoderSent := false
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if e, ok := proc.Encoder(); ok && !encoderSent {
+					encoderSent = true
+					send(event{Encoder: &e})
+				}
+				if backlog := proc.Backlog(); len(backlog) > 0 {
+					metrics := proc.Metrics()
+					send(event{Backlog: backlog, Metrics: &metrics})
+				}
+			}
+		}
+	}()
+
+	dec := gob.NewDecoder(r)
+	for {
+		var msg message
+		if err := dec.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read from parent: %w", err)
+		}
+
+		switch {
+		case msg.Frame != nil:
+			if err := proc.ProcessFrame(*msg.Frame); err != nil {
+				log.Warn("Dropped frame",
+					zap.String("camera", msg.Frame.CameraID),
+					zap.Uint64("frame", msg.Frame.Number),
+					zap.Error(err))
+			}
+		case msg.VideoInterval > 0:
+			proc.SetVideoInterval(msg.VideoInterval)
+		case msg.Flush:
+			ev := event{Flushed: true}
+			if err := proc.Flush(); err != nil {
+				ev.Err = err.Error()
+			}
+			send(ev)
+		}
+	}
+}
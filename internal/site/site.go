@@ -0,0 +1,33 @@
+// Package site namespaces camera IDs, so the cameras of several sites can be
+// aggregated on one server without their IDs colliding. A composite ID is
+// the site and the camera's own ID joined by a dot, e.g. "hq.cam-1". Site
+// and camera IDs can't contain dots themselves, so composite IDs are valid
+// directory names and path segments like plain ones.
+package site
+
+import "strings"
+
+// Separator joins a site and a camera ID.
+const Separator = "."
+
+// Qualify returns cameraID within site. IDs that already belong to a site
+// are returned as they are, as is every ID when site is empty.
+func Qualify(site, cameraID string) string {
+	if site == "" || Of(cameraID) != "" {
+		return cameraID
+	}
+	return site + Separator + cameraID
+}
+
+// Of returns the site of a camera ID, or "" if it has none.
+func Of(cameraID string) string {
+	if i := strings.Index(cameraID, Separator); i > 0 {
+		return cameraID[:i]
+	}
+	return ""
+}
+
+// Prefix returns what the IDs of a site's cameras start with.
+func Prefix(site string) string {
+	return site + Separator
+}
@@ -0,0 +1,205 @@
+package soak
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/framestore"
+	"github.com/raeeceip/cctv/internal/index"
+)
+
+// Check is the outcome of checking the invariants once.
+type Check struct {
+	Time     time.Time     `json:"time"`
+	Final    bool          `json:"final"`
+	Cameras  []CameraStats `json:"cameras"`
+	Failures []string      `json:"failures,omitempty"`
+}
+
+// Passed reports whether every invariant held.
+func (c *Check) Passed() bool {
+	return len(c.Failures) == 0
+}
+
+// CameraStats is what a check found for one camera.
+type CameraStats struct {
+	ID     string `json:"id"`
+	Sent   uint64 `json:"sent"`
+	Stored int    `json:"stored"`
+	// Lost counts frame numbers missing from the index
+	Lost              uint64  `json:"lost"`
+	LongestGapSeconds float64 `json:"longest_gap_seconds"`
+	Recordings        int     `json:"recordings"`
+}
+
+func (c *Check) fail(format string, args ...interface{}) {
+	c.Failures = append(c.Failures, fmt.Sprintf(format, args...))
+}
+
+// Check verifies the invariants for frames taken before cutoff:
+//
+//   - no camera went longer than MaxGap without a stored frame
+//   - every indexed frame and recording is on disk, and every frame and
+//     video on disk is indexed
+//   - with Consolidation, every frame is in one of its camera's recordings
+//
+// Checks while the cameras run pass a cutoff far enough back that frames
+// still on their way through the processor and the frame index are left
+// out. The final check, once the server has stopped, passes the zero time
+// to check everything, and only it requires frames to be consolidated,
+// since the server consolidates what is left when it stops.
+func (r *Runner) Check(ctx context.Context, ix *index.Index, cutoff time.Time, final bool) (*Check, error) {
+	check := &Check{Time: time.Now(), Final: final}
+	before := func(t time.Time) bool {
+		return cutoff.IsZero() || t.Before(cutoff)
+	}
+
+	store, err := framestore.New(r.opts.OutputDir, framestore.Layout(r.opts.FrameLayout), r.opts.FrameName, r.opts.Site)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, cam := range r.cameras {
+		ids = append(ids, cam.id)
+	}
+	recordings, err := ix.ListRecordings(ctx, index.RecordingQuery{CameraIDs: ids})
+	if err != nil {
+		return nil, err
+	}
+	byCamera := make(map[string][]index.Recording)
+	recordingPaths := make(map[string]bool)
+	for _, rec := range recordings {
+		if !before(rec.CreatedAt) {
+			continue
+		}
+		path := filepath.Clean(rec.Path)
+		if recordingPaths[path] {
+			check.fail("%s: more than one recording indexed as %s", rec.CameraID, rec.Path)
+		}
+		recordingPaths[path] = true
+		if _, err := os.Stat(rec.Path); err != nil {
+			check.fail("%s: recording %d is indexed but its file is missing: %v", rec.CameraID, rec.ID, err)
+		}
+		byCamera[rec.CameraID] = append(byCamera[rec.CameraID], rec)
+	}
+
+	for _, cam := range r.cameras {
+		cam.mu.Lock()
+		stats := CameraStats{ID: cam.id, Sent: cam.sent, Recordings: len(byCamera[cam.id])}
+		firstSent, lastSent, camErr := cam.firstSent, cam.lastSent, cam.err
+		cam.mu.Unlock()
+		if camErr != nil {
+			check.fail("%s: stopped sending: %v", cam.id, camErr)
+		}
+
+		frames, err := ix.ListFrames(ctx, cam.id, cutoff)
+		if err != nil {
+			return nil, err
+		}
+		stats.Stored = len(frames)
+
+		// Gaps, in frame numbers and in time, from the first frame sent
+		// to the last one sent before the cutoff
+		var prevNumber uint64
+		prevTime := firstSent
+		indexed := make(map[string]bool, len(frames))
+		for _, f := range frames {
+			indexed[filepath.Clean(f.Path)] = true
+			if f.Number == prevNumber {
+				check.fail("%s: frame %d is indexed more than once", cam.id, f.Number)
+				continue
+			}
+			stats.Lost += f.Number - prevNumber - 1
+			r.gap(check, &stats, prevTime, f.Time, fmt.Sprintf("before frame %d", f.Number))
+			prevNumber, prevTime = f.Number, f.Time
+		}
+		end := lastSent
+		if !cutoff.IsZero() && cutoff.Before(end) {
+			end = cutoff
+		}
+		if !firstSent.IsZero() {
+			r.gap(check, &stats, prevTime, end, "at the end")
+		}
+		if final && stats.Sent > prevNumber {
+			stats.Lost += stats.Sent - prevNumber
+		}
+
+		// Frames on disk and in the index
+		for _, f := range frames {
+			if _, err := os.Stat(f.Path); err != nil {
+				check.fail("%s: frame %d is indexed but its file is missing: %v", cam.id, f.Number, err)
+			}
+		}
+		files, err := store.Frames(cam.id, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range files {
+			_, t, ok := store.ParseName(filepath.Base(path))
+			if ok && before(t) && !indexed[filepath.Clean(path)] {
+				check.fail("%s: %s is stored but not indexed", cam.id, path)
+			}
+		}
+
+		if final && r.opts.Consolidation {
+			if n := unconsolidated(frames, byCamera[cam.id]); n > 0 {
+				check.fail("%s: %d of %d frames are in no recording", cam.id, n, len(frames))
+			}
+		}
+		check.Cameras = append(check.Cameras, stats)
+	}
+
+	// Videos nothing in the index points to
+	entries, err := os.ReadDir(filepath.Join(r.opts.OutputDir, "videos"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !strings.HasSuffix(e.Name(), ".mp4") || !before(info.ModTime()) {
+			continue
+		}
+		path := filepath.Clean(filepath.Join(r.opts.OutputDir, "videos", e.Name()))
+		if !recordingPaths[path] {
+			check.fail("%s is stored but not indexed", path)
+		}
+	}
+	return check, nil
+}
+
+// gap records the time between two frames and fails the check if it is
+// longer than MaxGap.
+func (r *Runner) gap(check *Check, stats *CameraStats, from, to time.Time, where string) {
+	d := to.Sub(from)
+	if d.Seconds() > stats.LongestGapSeconds {
+		stats.LongestGapSeconds = d.Seconds()
+	}
+	if d > r.opts.MaxGap {
+		check.fail("%s: no frames stored for %s %s", stats.ID, d.Round(time.Millisecond), where)
+	}
+}
+
+// unconsolidated counts the frames taken outside every recording. Times
+// are compared to the millisecond, as the index stores them.
+func unconsolidated(frames []index.Frame, recordings []index.Recording) int {
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].EndTime.Before(recordings[j].EndTime)
+	})
+	n := 0
+	for _, f := range frames {
+		t := f.Time.Truncate(time.Millisecond)
+		i := sort.Search(len(recordings), func(i int) bool {
+			return !recordings[i].EndTime.Truncate(time.Millisecond).Before(t)
+		})
+		if i == len(recordings) || recordings[i].StartTime.Truncate(time.Millisecond).After(t) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,180 @@
+// Package soak runs simulated cameras against a server and checks, while
+// they run and once they have stopped, that the server kept their frames,
+// turned them into recordings and indexed exactly what it stored.
+package soak
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/raeeceip/cctv/internal/site"
+	"github.com/raeeceip/cctv/internal/wire"
+)
+
+// Options configure a soak run.
+type Options struct {
+	// Addr is the server's /camera/connect URL
+	Addr    string
+	Cameras int
+	FPS     int
+	Width   int
+	Height  int
+	// Site qualifies the camera IDs, as the server does
+	Site string
+	// MaxGap is the longest a camera may go without a stored frame
+	MaxGap time.Duration
+	// Consolidation checks that every frame ended up in a recording
+	Consolidation bool
+	// OutputDir, FrameLayout and FrameName are where the server stores
+	// frames and what it names them
+	OutputDir   string
+	FrameLayout string
+	FrameName   string
+}
+
+// Runner drives the simulated cameras of a soak run.
+type Runner struct {
+	opts    Options
+	cameras []*camera
+	frames  [][]byte // encoded once and sent in turn by every camera
+}
+
+// camera is one simulated camera and what it has sent so far.
+type camera struct {
+	id string
+
+	mu        sync.Mutex
+	sent      uint64    // frames sent, numbered from 1
+	firstSent time.Time // capture times of the first and last frames sent
+	lastSent  time.Time
+	err       error // why the camera stopped early, if it did
+}
+
+// New returns a runner for opts, with its frames encoded.
+func New(opts Options) (*Runner, error) {
+	if opts.Cameras <= 0 || opts.FPS <= 0 {
+		return nil, fmt.Errorf("cameras and fps must be positive")
+	}
+	r := &Runner{opts: opts}
+	for i := 1; i <= opts.Cameras; i++ {
+		r.cameras = append(r.cameras, &camera{id: site.Qualify(opts.Site, fmt.Sprintf("soak-%d", i))})
+	}
+
+	// A second of frames with a bar moving across them, so consecutive
+	// frames differ as a camera's would
+	for i := 0; i < opts.FPS; i++ {
+		img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+		bar := i * opts.Width / opts.FPS
+		for y := 0; y < opts.Height; y++ {
+			for x := 0; x < opts.Width; x++ {
+				c := color.RGBA{uint8(x * 255 / opts.Width), uint8(y * 255 / opts.Height), 96, 255}
+				if x >= bar && x < bar+opts.Width/16+1 {
+					c = color.RGBA{255, 255, 255, 255}
+				}
+				img.SetRGBA(x, y, c)
+			}
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+			return nil, err
+		}
+		r.frames = append(r.frames, buf.Bytes())
+	}
+	return r, nil
+}
+
+// Run connects the cameras and sends frames at the frame rate until ctx is
+// cancelled. A camera whose connection fails stops; the checks report it.
+func (r *Runner) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, cam := range r.cameras {
+		wg.Add(1)
+		go func(cam *camera) {
+			defer wg.Done()
+			if err := r.stream(ctx, cam); err != nil && ctx.Err() == nil {
+				cam.mu.Lock()
+				cam.err = err
+				cam.mu.Unlock()
+			}
+		}(cam)
+	}
+	wg.Wait()
+}
+
+// stream sends a camera's frames over one connection.
+func (r *Runner) stream(ctx context.Context, cam *camera) error {
+	dialer := websocket.Dialer{
+		HandshakeTimeout: 10 * time.Second,
+		Subprotocols:     []string{wire.BinaryProtocol},
+	}
+	header := http.Header{}
+	header.Set(wire.CameraIDHeader, cam.id)
+	header.Set(wire.VersionHeader, strconv.Itoa(wire.VersionBinary))
+	conn, resp, err := dialer.DialContext(ctx, r.opts.Addr, header)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+	if v := resp.Header.Get(wire.VersionHeader); v != "" && v != strconv.Itoa(wire.VersionBinary) {
+		return fmt.Errorf("server picked protocol version %s, soak only sends binary frames", v)
+	}
+
+	// Reading answers the server's pings; control messages are ignored
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(time.Second / time.Duration(r.opts.FPS))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, "soak over"),
+				time.Now().Add(time.Second))
+			return nil
+		case err := <-readErr:
+			return fmt.Errorf("connection lost: %w", err)
+		case now := <-ticker.C:
+			cam.mu.Lock()
+			n := cam.sent + 1
+			cam.mu.Unlock()
+
+			w, err := conn.NextWriter(websocket.BinaryMessage)
+			if err != nil {
+				return fmt.Errorf("connection lost: %w", err)
+			}
+			h := wire.Header{Camera: cam.id, Time: now, FrameNum: n, Pattern: "soak"}
+			if err := wire.WriteFrame(w, h, r.frames[int(n)%len(r.frames)]); err != nil {
+				w.Close()
+				return fmt.Errorf("failed to send frame %d: %w", n, err)
+			}
+			if err := w.Close(); err != nil {
+				return fmt.Errorf("failed to send frame %d: %w", n, err)
+			}
+
+			cam.mu.Lock()
+			cam.sent = n
+			if n == 1 {
+				cam.firstSent = now
+			}
+			cam.lastSent = now
+			cam.mu.Unlock()
+		}
+	}
+}
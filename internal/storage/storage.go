@@ -0,0 +1,54 @@
+// Package storage stores files by key in a backend: a directory, such as
+// the output directory or a network mount, or an S3 or GCS bucket. The
+// processor writes and reads frames through a Local backend on the output
+// directory, which stays the working copy that consolidation, retention
+// and the API read. The configured backend gets a copy of each frame and
+// video once it is written, under its path relative to the output
+// directory.
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/raeeceip/cctv/internal/config"
+)
+
+// gcsEndpoint serves the S3-compatible XML API of Google Cloud Storage.
+const gcsEndpoint = "https://storage.googleapis.com"
+
+// ErrNotExist is matched by the errors of Get for missing keys.
+var ErrNotExist = fs.ErrNotExist
+
+// Storage stores files by key.
+type Storage interface {
+	// Put stores size bytes read from r under key, a slash-separated path,
+	// replacing what is there.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get opens what is stored under key, returning its size.
+	Get(ctx context.Context, key string) (io.ReadCloser, int64, error)
+}
+
+// New returns the configured backend, or nil for a local backend without
+// a path, which copies nothing.
+func New(cfg config.BackendConfig) (Storage, error) {
+	switch cfg.Type {
+	case "local":
+		if cfg.Path == "" {
+			return nil, nil
+		}
+		return NewLocal(cfg.Path)
+	case "s3":
+		return NewS3(cfg)
+	case "gcs":
+		// GCS takes S3 requests signed with an HMAC key
+		if cfg.Endpoint == "" {
+			cfg.Endpoint = gcsEndpoint
+		}
+		cfg.PathStyle = true
+		return NewS3(cfg)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", cfg.Type)
+}
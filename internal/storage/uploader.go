@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/raeeceip/cctv/pkg/logger"
+	"github.com/raeeceip/cctv/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// queueSize bounds the files waiting to be copied. Files beyond it are
+// skipped and counted as dropped.
+const queueSize = 4096
+
+// attempts is how often a file is tried before giving up on it.
+const attempts = 3
+
+const (
+	kindFrame = "frame"
+	kindVideo = "video"
+)
+
+type upload struct {
+	kind string
+	path string
+}
+
+// Uploader copies files from the output directory to a backend as the
+// processor writes them.
+type Uploader struct {
+	storage Storage
+	root    string
+	source  *Local // the output directory
+	workers int
+	logger  *logger.Logger
+	metrics *metrics.StorageMetrics
+	queue   chan upload
+	// failing is set from a file failing to copy until one is copied, so
+	// an outage is logged once rather than for every file
+	failing atomic.Bool
+}
+
+// NewUploader returns an uploader copying files below root to s with the
+// given number of workers.
+func NewUploader(s Storage, root string, workers int, log *logger.Logger) *Uploader {
+	return &Uploader{
+		storage: s,
+		root:    root,
+		source:  &Local{root: root},
+		workers: max(workers, 1),
+		logger:  log,
+		metrics: metrics.NewStorageMetrics(),
+		queue:   make(chan upload, queueSize),
+	}
+}
+
+// AddVideo queues a consolidated video, by its path, without blocking.
+func (u *Uploader) AddVideo(path string) {
+	u.add(upload{kind: kindVideo, path: path})
+}
+
+// AddFrame queues a stored frame, by its path, without blocking. The frame
+// is read back from its file, which may be gone by then if it was
+// consolidated with delete_originals.
+func (u *Uploader) AddFrame(path string) {
+	u.add(upload{kind: kindFrame, path: path})
+}
+
+func (u *Uploader) add(up upload) {
+	select {
+	case u.queue <- up:
+		u.metrics.Queued.Inc()
+	default:
+		u.metrics.Uploads.WithLabelValues(up.kind, metrics.UploadDropped).Inc()
+		if up.kind == kindVideo {
+			u.logger.Warn("Storage upload behind, skipped video", zap.String("path", up.path))
+		}
+	}
+}
+
+// Run copies the queued files until ctx is cancelled.
+func (u *Uploader) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < u.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case up := <-u.queue:
+					u.metrics.Queued.Dec()
+					u.copy(ctx, up)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// copy uploads a file, retrying with a growing delay. Only the first
+// failure of an outage is logged, and the first success after it.
+func (u *Uploader) copy(ctx context.Context, up upload) {
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var size int64
+		size, err = u.put(ctx, up.path)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Deleted since it was queued
+			return
+		}
+		if err == nil {
+			u.metrics.Uploads.WithLabelValues(up.kind, metrics.UploadOK).Inc()
+			u.metrics.UploadBytes.WithLabelValues(up.kind).Add(float64(size))
+			if u.failing.CompareAndSwap(true, false) {
+				u.logger.Info("Storage backend recovered, copying files again")
+			}
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+	}
+	u.metrics.Uploads.WithLabelValues(up.kind, metrics.UploadFailed).Inc()
+	if u.failing.CompareAndSwap(false, true) {
+		u.logger.Error("Failed to copy file to storage backend, further failures are only counted until one succeeds",
+			zap.String("kind", up.kind),
+			zap.String("path", up.path),
+			zap.Error(err))
+	}
+}
+
+func (u *Uploader) put(ctx context.Context, path string) (int64, error) {
+	key, err := u.key(path)
+	if err != nil {
+		return 0, err
+	}
+	f, size, err := u.source.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return size, u.storage.Put(ctx, key, f, size)
+}
+
+// key is a file's path relative to the output directory.
+func (u *Uploader) key(path string) (string, error) {
+	rel, err := filepath.Rel(u.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the output directory", path)
+	}
+	return filepath.ToSlash(rel), nil
+}
@@ -112,7 +112,7 @@ func (sm *StreamManager) captureFrames(ctx context.Context) {
 		frame := Frame{
 			Data:      event.Data,
 			Timestamp: event.Timestamp,
-			KeyFrame:  event.EventType == "keyframe",
+			KeyFrame:  event.KeyFrame,
 		}
 
 		// Send frame to processing
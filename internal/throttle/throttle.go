@@ -0,0 +1,137 @@
+// Package throttle limits how fast frames are written, per camera and for
+// all cameras together, so recording doesn't starve other users of a disk.
+// Limits are token buckets holding up to a second of writes: short bursts
+// pass at once, sustained writes above the limit are held back.
+package throttle
+
+import (
+	"sync"
+	"time"
+
+	"github.com/raeeceip/cctv/pkg/metrics"
+)
+
+// Metric scopes of the limits
+const (
+	ScopeCamera = "camera"
+	ScopeGlobal = "global"
+)
+
+// bucket is a token bucket of bytes.
+type bucket struct {
+	rate   float64 // bytes per second
+	tokens float64 // negative when writes are owed
+	last   time.Time
+}
+
+func newBucket(rate float64, now time.Time) *bucket {
+	return &bucket{rate: rate, tokens: rate, last: now}
+}
+
+// reserve takes n bytes and returns how long the write has to wait for
+// them. Writes larger than what is left go into debt, which later writes
+// wait out too, so the rate holds whatever the frame sizes.
+func (b *bucket) reserve(n int, now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Limiter holds back frame writes that exceed the limits. A nil Limiter
+// doesn't limit.
+type Limiter struct {
+	cameraRate float64
+	global     *bucket // nil without a global limit
+	metrics    *metrics.ThrottleMetrics
+
+	mu      sync.Mutex
+	cameras map[string]*bucket // nil buckets without a camera limit
+}
+
+// New returns a limiter of cameraBytesPerSec for each camera and
+// globalBytesPerSec for all of them, zero meaning no limit, reporting to m.
+// It returns nil if neither is set, once m shows both limits as 0.
+func New(m *metrics.ThrottleMetrics, cameraBytesPerSec, globalBytesPerSec float64) *Limiter {
+	m.Limit.WithLabelValues(ScopeCamera).Set(max(cameraBytesPerSec, 0))
+	m.Limit.WithLabelValues(ScopeGlobal).Set(max(globalBytesPerSec, 0))
+	if cameraBytesPerSec <= 0 && globalBytesPerSec <= 0 {
+		return nil
+	}
+	l := &Limiter{
+		cameraRate: cameraBytesPerSec,
+		metrics:    m,
+		cameras:    make(map[string]*bucket),
+	}
+	if globalBytesPerSec > 0 {
+		l.global = newBucket(globalBytesPerSec, time.Now())
+	}
+	return l
+}
+
+// Wait blocks until a camera may write n bytes. It returns false if done
+// is closed first.
+func (l *Limiter) Wait(done <-chan struct{}, cameraID string, n int) bool {
+	if l == nil {
+		return true
+	}
+
+	now := time.Now()
+	var delay time.Duration
+	l.mu.Lock()
+	b, ok := l.cameras[cameraID]
+	if !ok {
+		// Cameras show on the metrics from their first frame; without a
+		// camera limit they have no bucket
+		if l.cameraRate > 0 {
+			b = newBucket(l.cameraRate, now)
+		}
+		l.cameras[cameraID] = b
+		l.metrics.Throttled.WithLabelValues(cameraID).Set(0)
+		l.metrics.Delay.WithLabelValues(cameraID).Add(0)
+	}
+	if b != nil {
+		delay = b.reserve(n, now)
+	}
+	if l.global != nil {
+		if d := l.global.reserve(n, now); d > delay {
+			delay = d
+		}
+	}
+	l.mu.Unlock()
+	if delay <= 0 {
+		return true
+	}
+
+	throttled := l.metrics.Throttled.WithLabelValues(cameraID)
+	throttled.Set(1)
+	defer throttled.Set(0)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		l.metrics.Delay.WithLabelValues(cameraID).Add(delay.Seconds())
+		return true
+	case <-done:
+		l.metrics.Delay.WithLabelValues(cameraID).Add(time.Since(now).Seconds())
+		return false
+	}
+}
+
+// Remove forgets a camera, e.g. once it disconnects.
+func (l *Limiter) Remove(cameraID string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	delete(l.cameras, cameraID)
+	l.mu.Unlock()
+	l.metrics.Throttled.DeleteLabelValues(cameraID)
+	l.metrics.Delay.DeleteLabelValues(cameraID)
+}
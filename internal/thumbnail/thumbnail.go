@@ -0,0 +1,172 @@
+// Package thumbnail makes the stills and animated previews dashboards show
+// for consolidated videos. They are made from the video's JPEG frames
+// rather than the video, so no FFmpeg run is needed, and stored beside it.
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/raeeceip/cctv/internal/codec"
+)
+
+const (
+	stillWidth    = 320
+	previewWidth  = 160
+	previewFrames = 10
+	// previewDelay is the time each preview frame shows, in hundredths of
+	// a second
+	previewDelay = 50
+)
+
+// StillPath returns where the thumbnail of the video at path is stored.
+func StillPath(video string) string {
+	return strings.TrimSuffix(video, filepath.Ext(video)) + ".thumb.jpg"
+}
+
+// PreviewPath returns where the animated preview of the video at path is
+// stored.
+func PreviewPath(video string) string {
+	return strings.TrimSuffix(video, filepath.Ext(video)) + ".preview.gif"
+}
+
+// Write makes the thumbnail of a video from its middle frame, and the
+// animated preview from frames spread over it. frames are the paths of the
+// video's JPEG frames, in order.
+func Write(frames []string, video string) error {
+	return write(len(frames), func(i, width int) (*image.RGBA, error) {
+		return load(frames[i], width)
+	}, video)
+}
+
+// WriteData is Write for frames held in memory rather than stored, such
+// as a sample of a video's frames taken while it was encoded.
+func WriteData(frames [][]byte, video string) error {
+	return write(len(frames), func(i, width int) (*image.RGBA, error) {
+		img, err := codec.Decode(frames[i])
+		if err != nil {
+			return nil, err
+		}
+		return shrink(img, width), nil
+	}, video)
+}
+
+// write makes the thumbnail and preview from n frames, decoded and shrunk
+// to a width by frame.
+func write(n int, frame func(i, width int) (*image.RGBA, error), video string) error {
+	if n == 0 {
+		return errors.New("no frames")
+	}
+	still, err := frame(n/2, stillWidth)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := codec.Encode(&buf, still, 80); err != nil {
+		return err
+	}
+	if err := writeFile(StillPath(video), buf.Bytes()); err != nil {
+		return err
+	}
+
+	anim := &gif.GIF{}
+	count := min(previewFrames, n)
+	for i := 0; i < count; i++ {
+		img, err := frame(i*n/count, previewWidth)
+		if err != nil {
+			// A frame that can't be read leaves a gap in the preview
+			continue
+		}
+		paletted := image.NewPaletted(img.Bounds(), palette.Plan9)
+		draw.FloydSteinberg.Draw(paletted, img.Bounds(), img, image.Point{})
+		anim.Image = append(anim.Image, paletted)
+		anim.Delay = append(anim.Delay, previewDelay)
+	}
+	if len(anim.Image) == 0 {
+		return errors.New("no readable frames for the preview")
+	}
+	buf.Reset()
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		return err
+	}
+	return writeFile(PreviewPath(video), buf.Bytes())
+}
+
+// Remove deletes the thumbnail and preview of a video, if it has them.
+func Remove(video string) error {
+	var errs []error
+	for _, path := range []string{StillPath(video), PreviewPath(video)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// load decodes a JPEG frame and shrinks it to width, keeping its aspect
+// ratio. Smaller frames keep their size.
+func load(path string, width int) (*image.RGBA, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	img, err := codec.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", filepath.Base(path), err)
+	}
+	return shrink(img, width), nil
+}
+
+// shrink reduces img to width, averaging four samples per pixel, which is
+// enough to keep fine detail such as timestamps from breaking up.
+func shrink(img image.Image, width int) *image.RGBA {
+	b := img.Bounds()
+	w := min(width, b.Dx())
+	h := max(b.Dy()*w/b.Dx(), 1)
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var r, g, bl uint32
+			for _, off := range [4][2]int{{1, 1}, {3, 1}, {1, 3}, {3, 3}} {
+				sx := b.Min.X + (4*x+off[0])*b.Dx()/(4*w)
+				sy := b.Min.Y + (4*y+off[1])*b.Dy()/(4*h)
+				sr, sg, sb, _ := img.At(sx, sy).RGBA()
+				r, g, bl = r+sr, g+sg, bl+sb
+			}
+			out.SetRGBA(x, y, color.RGBA{uint8(r >> 10), uint8(g >> 10), uint8(bl >> 10), 255})
+		}
+	}
+	return out
+}
+
+// writeFile writes a file through a temporary one, so readers never see it
+// half written.
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".thumb-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	// Temporary files are private; thumbnails are as readable as videos
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
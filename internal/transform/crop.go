@@ -0,0 +1,152 @@
+package transform
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"strconv"
+	"strings"
+
+	"github.com/raeeceip/cctv/internal/codec"
+)
+
+// MaxZoom bounds digital zoom. Past it a region is a handful of pixels.
+const MaxZoom = 16
+
+// ErrOutside is returned when a crop misses the frame altogether.
+var ErrOutside = errors.New("crop is outside the frame")
+
+// Crop picks the part of a frame a viewer wants, so clients that only show
+// a region don't have to download and scale the whole frame. The region
+// keeps its pixels; it isn't scaled up.
+type Crop struct {
+	// Rect is the region, in frame pixels. The empty rectangle is the whole
+	// frame.
+	Rect image.Rectangle
+	// Zoom narrows the region around its center: 2 keeps the middle half
+	// of its width and height. 0 and 1 leave it as it is.
+	Zoom float64
+}
+
+// ParseCrop reads a crop from "x,y,w,h" and a zoom factor, either of which
+// may be empty.
+func ParseCrop(rect, zoom string) (Crop, error) {
+	var c Crop
+	if rect != "" {
+		parts := strings.Split(rect, ",")
+		if len(parts) != 4 {
+			return Crop{}, errors.New("crop must be x,y,w,h")
+		}
+		var v [4]int
+		for i, p := range parts {
+			n, err := strconv.Atoi(strings.TrimSpace(p))
+			if err != nil || n < 0 {
+				return Crop{}, fmt.Errorf("crop must be x,y,w,h in pixels, got %q", rect)
+			}
+			v[i] = n
+		}
+		if v[2] == 0 || v[3] == 0 {
+			return Crop{}, errors.New("crop width and height must be positive")
+		}
+		c.Rect = image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3])
+	}
+	if zoom != "" {
+		z, err := strconv.ParseFloat(zoom, 64)
+		if err != nil || z < 1 || z > MaxZoom {
+			return Crop{}, fmt.Errorf("zoom must be between 1 and %d", MaxZoom)
+		}
+		c.Zoom = z
+	}
+	return c, nil
+}
+
+// Whole reports whether c leaves frames as they are.
+func (c Crop) Whole() bool {
+	return c.Rect.Empty() && c.Zoom <= 1
+}
+
+// region returns the part of a frame with bounds b that c keeps. The crop
+// rectangle is clipped to the frame.
+func (c Crop) region(b image.Rectangle) (image.Rectangle, error) {
+	r := b
+	if !c.Rect.Empty() {
+		if r = c.Rect.Add(b.Min).Intersect(b); r.Empty() {
+			return image.Rectangle{}, ErrOutside
+		}
+	}
+	if c.Zoom > 1 {
+		w := max(int(float64(r.Dx())/c.Zoom), 1)
+		h := max(int(float64(r.Dy())/c.Zoom), 1)
+		corner := r.Min.Add(image.Pt((r.Dx()-w)/2, (r.Dy()-h)/2))
+		r = image.Rectangle{Min: corner, Max: corner.Add(image.Pt(w, h))}
+	}
+	return r, nil
+}
+
+// JPEG crops a JPEG frame, encoding the result at quality.
+func (c Crop) JPEG(data []byte, quality int) ([]byte, error) {
+	img, err := codec.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	out, err := c.Apply(img)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := codec.Encode(&buf, out, quality); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Apply returns the region of img that c keeps. YCbCr images share img's
+// planes; the region's corner moves up and left to the nearest chroma
+// sample, so that it can start at the origin, which the encoders' fast
+// paths need. Others are copied as RGBA.
+func (c Crop) Apply(img image.Image) (image.Image, error) {
+	r, err := c.region(img.Bounds())
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := img.(*image.YCbCr); ok {
+		if out, ok := cropYCbCr(m, r); ok {
+			return out, nil
+		}
+	}
+	out := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(out, out.Rect, img, r.Min, draw.Src)
+	return out, nil
+}
+
+// cropYCbCr returns region r of m as an image at the origin sharing m's
+// planes. It returns false for subsamplings it doesn't know.
+func cropYCbCr(m *image.YCbCr, r image.Rectangle) (*image.YCbCr, bool) {
+	var sx, sy int
+	switch m.SubsampleRatio {
+	case image.YCbCrSubsampleRatio444:
+		sx, sy = 1, 1
+	case image.YCbCrSubsampleRatio422:
+		sx, sy = 2, 1
+	case image.YCbCrSubsampleRatio420:
+		sx, sy = 2, 2
+	case image.YCbCrSubsampleRatio440:
+		sx, sy = 1, 2
+	default:
+		return nil, false
+	}
+	// Align to the chroma samples, relative to the image's own origin
+	corner := r.Min.Sub(m.Rect.Min)
+	r.Min = image.Pt(corner.X-corner.X%sx, corner.Y-corner.Y%sy).Add(m.Rect.Min)
+	return &image.YCbCr{
+		Y:              m.Y[m.YOffset(r.Min.X, r.Min.Y):],
+		Cb:             m.Cb[m.COffset(r.Min.X, r.Min.Y):],
+		Cr:             m.Cr[m.COffset(r.Min.X, r.Min.Y):],
+		YStride:        m.YStride,
+		CStride:        m.CStride,
+		SubsampleRatio: m.SubsampleRatio,
+		Rect:           image.Rect(0, 0, r.Dx(), r.Dy()),
+	}, true
+}
@@ -0,0 +1,165 @@
+// Package transform rotates and mirrors camera frames, for cameras mounted
+// sideways or upside down. Frames are transformed plane by plane in their
+// decoded color space, so YCbCr frames aren't converted to RGB and back. It
+// also crops frames to the region a viewer asks for.
+package transform
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+
+	"github.com/raeeceip/cctv/internal/codec"
+)
+
+// Transform is applied to every frame of a camera. The zero value leaves
+// frames as they are.
+type Transform struct {
+	// Rotate is clockwise, in degrees: 0, 90, 180 or 270
+	Rotate int `json:"rotate"`
+	// Mirror flips the frame left to right, before it is rotated
+	Mirror bool `json:"mirror"`
+}
+
+// Validate checks the rotation.
+func (t Transform) Validate() error {
+	switch t.Rotate {
+	case 0, 90, 180, 270:
+		return nil
+	}
+	return fmt.Errorf("rotate must be 0, 90, 180 or 270, got %d", t.Rotate)
+}
+
+// Identity reports whether t leaves frames as they are.
+func (t Transform) Identity() bool {
+	return t.Rotate == 0 && !t.Mirror
+}
+
+// JPEG transforms a JPEG frame, encoding the result at quality.
+func (t Transform) JPEG(data []byte, quality int) ([]byte, error) {
+	img, err := codec.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := codec.Encode(&buf, t.Apply(img), quality); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Apply returns img transformed, as a new image. YCbCr and gray images keep
+// their type; others become RGBA.
+func (t Transform) Apply(img image.Image) image.Image {
+	switch m := img.(type) {
+	case *image.YCbCr:
+		if out, ok := t.ycbcr(m); ok {
+			return out
+		}
+	case *image.Gray:
+		w, h := t.size(m.Rect.Dx(), m.Rect.Dy())
+		out := image.NewGray(image.Rect(0, 0, w, h))
+		t.plane(out.Pix, out.Stride, m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], m.Stride, m.Rect.Dx(), m.Rect.Dy(), 1)
+		return out
+	}
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		b := img.Bounds()
+		src = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(src, src.Rect, img, b.Min, draw.Src)
+	}
+	w, h := t.size(src.Rect.Dx(), src.Rect.Dy())
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	t.plane(out.Pix, out.Stride, src.Pix[src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y):], src.Stride, src.Rect.Dx(), src.Rect.Dy(), 4)
+	return out
+}
+
+// size returns the size of a w by h frame once transformed.
+func (t Transform) size(w, h int) (int, int) {
+	if t.Rotate == 90 || t.Rotate == 270 {
+		return h, w
+	}
+	return w, h
+}
+
+// rotatedRatios maps the chroma subsamplings to what they become when the
+// image is turned on its side. 4:1:1 and 4:1:0 have no counterpart.
+var rotatedRatios = map[image.YCbCrSubsampleRatio]image.YCbCrSubsampleRatio{
+	image.YCbCrSubsampleRatio444: image.YCbCrSubsampleRatio444,
+	image.YCbCrSubsampleRatio420: image.YCbCrSubsampleRatio420,
+	image.YCbCrSubsampleRatio422: image.YCbCrSubsampleRatio440,
+	image.YCbCrSubsampleRatio440: image.YCbCrSubsampleRatio422,
+}
+
+// ycbcr transforms each plane of m. It returns false for subsamplings it
+// can't keep turned on their side, and for images not at the origin, whose
+// chroma samples may not line up with it.
+func (t Transform) ycbcr(m *image.YCbCr) (*image.YCbCr, bool) {
+	ratio := m.SubsampleRatio
+	if t.Rotate == 90 || t.Rotate == 270 {
+		var ok bool
+		if ratio, ok = rotatedRatios[ratio]; !ok {
+			return nil, false
+		}
+	}
+	if m.Rect.Min != (image.Point{}) {
+		return nil, false
+	}
+	w, h := t.size(m.Rect.Dx(), m.Rect.Dy())
+	out := image.NewYCbCr(image.Rect(0, 0, w, h), ratio)
+	t.plane(out.Y, out.YStride, m.Y, m.YStride, m.Rect.Dx(), m.Rect.Dy(), 1)
+
+	// The chroma planes are transformed alike at their own size
+	cw, ch := chromaSize(m)
+	t.plane(out.Cb, out.CStride, m.Cb, m.CStride, cw, ch, 1)
+	t.plane(out.Cr, out.CStride, m.Cr, m.CStride, cw, ch, 1)
+	return out, true
+}
+
+// chromaSize returns the size of m's chroma planes. It is worked out from
+// the bounds, as decoders may leave the planes padded.
+func chromaSize(m *image.YCbCr) (int, int) {
+	w, h := m.Rect.Dx(), m.Rect.Dy()
+	switch m.SubsampleRatio {
+	case image.YCbCrSubsampleRatio422:
+		return (w + 1) / 2, h
+	case image.YCbCrSubsampleRatio420:
+		return (w + 1) / 2, (h + 1) / 2
+	case image.YCbCrSubsampleRatio440:
+		return w, (h + 1) / 2
+	case image.YCbCrSubsampleRatio411:
+		return (w + 3) / 4, h
+	case image.YCbCrSubsampleRatio410:
+		return (w + 3) / 4, (h + 1) / 2
+	}
+	return w, h
+}
+
+// plane writes the transform of a w by h plane of size-byte pixels from src
+// to dst.
+func (t Transform) plane(dst []byte, dstStride int, src []byte, srcStride, w, h, size int) {
+	for y := 0; y < h; y++ {
+		row := src[y*srcStride : y*srcStride+w*size]
+		for x := 0; x < w; x++ {
+			sx := x
+			if t.Mirror {
+				sx = w - 1 - x
+			}
+			// Where source pixel (x, y) of the mirrored frame lands
+			var dx, dy int
+			switch t.Rotate {
+			case 0:
+				dx, dy = x, y
+			case 90:
+				dx, dy = h-1-y, x
+			case 180:
+				dx, dy = w-1-x, h-1-y
+			case 270:
+				dx, dy = y, w-1-x
+			}
+			i := dy*dstStride + dx*size
+			copy(dst[i:i+size], row[sx*size:sx*size+size])
+		}
+	}
+}
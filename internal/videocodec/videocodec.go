@@ -0,0 +1,400 @@
+// Package videocodec chooses the FFmpeg encoder videos are made with from
+// a codec and a hardware accelerator. What is asked for is probed by
+// encoding a frame, since FFmpeg lists hardware encoders whether or not the
+// hardware is there, and anything that fails falls back to software and
+// finally to libx264.
+package videocodec
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raeeceip/cctv/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// Codecs, which may also be given as the name of an FFmpeg encoder
+const (
+	H264 = "h264"
+	H265 = "h265"
+	VP9  = "vp9"
+	AV1  = "av1"
+	// Copy passes JPEG frames through as MJPEG, without encoding
+	Copy = "copy"
+)
+
+// Hardware accelerators
+const (
+	None         = "none"
+	Auto         = "auto" // the first that works, in the order of autoOrder
+	NVENC        = "nvenc"
+	VAAPI        = "vaapi"
+	VideoToolbox = "videotoolbox"
+	V4L2M2M      = "v4l2m2m"
+)
+
+// DefaultDevice is the VAAPI render node used unless another is set.
+const DefaultDevice = "/dev/dri/renderD128"
+
+// Fallback is the encoder used when nothing asked for works.
+const Fallback = "libx264"
+
+// probeTimeout bounds encoding the probe frame, which hardware encoders
+// can take a while to initialise for.
+const probeTimeout = 15 * time.Second
+
+// Codecs lists the codecs, and Accelerators the hardware accelerators.
+var (
+	Codecs       = []string{H264, H265, VP9, AV1, Copy}
+	Accelerators = []string{None, Auto, NVENC, VAAPI, VideoToolbox, V4L2M2M}
+)
+
+// autoOrder is the order accelerators are tried in with Auto.
+var autoOrder = []string{NVENC, VAAPI, VideoToolbox, V4L2M2M}
+
+// software are the software encoders of each codec.
+var software = map[string]string{
+	H264: "libx264",
+	H265: "libx265",
+	VP9:  "libvpx-vp9",
+	AV1:  "libsvtav1",
+}
+
+// hardware are the encoders of each accelerator, by codec.
+var hardware = map[string]map[string]string{
+	NVENC:        {H264: "h264_nvenc", H265: "hevc_nvenc", AV1: "av1_nvenc"},
+	VAAPI:        {H264: "h264_vaapi", H265: "hevc_vaapi", VP9: "vp9_vaapi", AV1: "av1_vaapi"},
+	VideoToolbox: {H264: "h264_videotoolbox", H265: "hevc_videotoolbox"},
+	V4L2M2M:      {H264: "h264_v4l2m2m", H265: "hevc_v4l2m2m"},
+}
+
+// quality are the arguments software encoders are given for a constant
+// quality, rather than a bitrate.
+var quality = map[string][]string{
+	"libx264":    {"-preset", "medium", "-crf", "23"},
+	"libx265":    {"-preset", "medium", "-crf", "28"},
+	"libvpx-vp9": {"-crf", "32", "-b:v", "0", "-row-mt", "1"},
+	"libsvtav1":  {"-preset", "8", "-crf", "35"},
+	"libaom-av1": {"-crf", "35", "-b:v", "0", "-cpu-used", "6"},
+}
+
+// fast are the arguments software encoders are given instead of quality
+// for encodes someone is waiting on, trading size for speed.
+var fast = map[string][]string{
+	"libx264": {"-preset", "veryfast", "-crf", "23"},
+	"libx265": {"-preset", "veryfast", "-crf", "28"},
+}
+
+// Options describe the encoder wanted.
+type Options struct {
+	// Codec is one of Codecs or the name of an FFmpeg encoder, which is
+	// used as it is
+	Codec string
+	// HWAccel is one of Accelerators; empty is None
+	HWAccel string
+	// Device is the VAAPI render node; empty is DefaultDevice
+	Device string
+	// Bitrate is the target of hardware encoders, in kbps
+	Bitrate int
+}
+
+// Encoder is an FFmpeg encoder and how to run it.
+type Encoder struct {
+	Name    string `json:"name"`              // the FFmpeg encoder, or "copy"
+	Codec   string `json:"codec,omitempty"`   // one of Codecs, if known
+	HWAccel string `json:"hwaccel,omitempty"` // empty for software
+	Device  string `json:"device,omitempty"`  // with VAAPI
+	Bitrate int    `json:"bitrate_kbps"`      // for encoders without a quality setting
+}
+
+// Validate reports whether the options can be used, without probing.
+func (o Options) Validate() error {
+	if o.Codec == "" {
+		return fmt.Errorf("codec is required")
+	}
+	if o.HWAccel != "" && !slices.Contains(Accelerators, o.HWAccel) {
+		return fmt.Errorf("unknown hardware accelerator %q, expected one of %s", o.HWAccel, strings.Join(Accelerators, ", "))
+	}
+	if a := o.HWAccel; a != "" && a != None && a != Auto && isCodec(o.Codec) && o.Codec != Copy && hardware[a][o.Codec] == "" {
+		return fmt.Errorf("%s can't encode %s", a, o.Codec)
+	}
+	return nil
+}
+
+// H264 returns the options for an H.264 encoder, for what has to be H.264:
+// o itself if it names one, otherwise H.264 with o's accelerator, or the
+// accelerator of the hardware encoder o names.
+func (o Options) H264() Options {
+	if o.Codec == H264 || !isCodec(o.Codec) && codecOf(o.Codec) == H264 {
+		return o
+	}
+	if o.HWAccel == "" && !isCodec(o.Codec) {
+		o.HWAccel = hwaccelOf(o.Codec)
+	}
+	o.Codec = H264
+	return o
+}
+
+// Candidates returns the encoders to try for opts, best first, ending
+// with Fallback.
+func Candidates(opts Options) []Encoder {
+	if opts.Codec == Copy {
+		return []Encoder{{Name: Copy, Codec: Copy}}
+	}
+	device := opts.Device
+	if device == "" {
+		device = DefaultDevice
+	}
+	var encoders []Encoder
+	add := func(e Encoder) {
+		for _, seen := range encoders {
+			if seen.Name == e.Name {
+				return
+			}
+		}
+		e.Bitrate = opts.Bitrate
+		encoders = append(encoders, e)
+	}
+
+	if !isCodec(opts.Codec) {
+		add(Encoder{Name: opts.Codec, Codec: codecOf(opts.Codec), HWAccel: hwaccelOf(opts.Codec), Device: device})
+	} else {
+		var accels []string
+		switch opts.HWAccel {
+		case "", None:
+		case Auto:
+			for _, a := range autoOrder {
+				if available(a, device) {
+					accels = append(accels, a)
+				}
+			}
+		default:
+			accels = []string{opts.HWAccel}
+		}
+		for _, a := range accels {
+			if name := hardware[a][opts.Codec]; name != "" {
+				add(Encoder{Name: name, Codec: opts.Codec, HWAccel: a, Device: device})
+			}
+		}
+		add(Encoder{Name: software[opts.Codec], Codec: opts.Codec})
+	}
+	add(Encoder{Name: Fallback, Codec: H264})
+	for i := range encoders {
+		if encoders[i].HWAccel != VAAPI {
+			encoders[i].Device = ""
+		}
+	}
+	return encoders
+}
+
+var (
+	// selectMu is held while probing, and selectedMu while reading or
+	// adding to selected, so Selected never waits for a probe
+	selectMu   sync.Mutex
+	selectedMu sync.RWMutex
+	selected   = make(map[Options]Encoder)
+)
+
+// Select returns the first of opts' candidates that encodes a frame, or
+// Fallback if none do. The choice is made once per process for each
+// opts.
+func Select(opts Options, log *logger.Logger) Encoder {
+	selectMu.Lock()
+	defer selectMu.Unlock()
+	if e, ok := Selected(opts); ok {
+		return e
+	}
+
+	candidates := Candidates(opts)
+	chosen := candidates[len(candidates)-1]
+	for _, e := range candidates {
+		err := probe(e)
+		if err == nil {
+			chosen = e
+			break
+		}
+		log.Warn("Video encoder unavailable, trying the next",
+			zap.String("encoder", e.Name),
+			zap.String("hwaccel", e.HWAccel),
+			zap.Error(err))
+	}
+	log.Info("Selected video encoder",
+		zap.String("codec", opts.Codec),
+		zap.String("encoder", chosen.Name),
+		zap.String("hwaccel", chosen.HWAccel))
+	selectedMu.Lock()
+	selected[opts] = chosen
+	selectedMu.Unlock()
+	return chosen
+}
+
+// Selected returns the encoder Select chose for opts, without probing, if
+// it has been called.
+func Selected(opts Options) (Encoder, bool) {
+	selectedMu.RLock()
+	defer selectedMu.RUnlock()
+	e, ok := selected[opts]
+	return e, ok
+}
+
+// InputArgs returns the arguments that go before the input.
+func (e Encoder) InputArgs() []string {
+	if e.HWAccel == VAAPI {
+		return []string{"-vaapi_device", e.Device}
+	}
+	return nil
+}
+
+// Filter returns what goes at the end of the filter chain to hand frames
+// to the encoder, if anything.
+func (e Encoder) Filter() string {
+	if e.HWAccel == VAAPI {
+		return "format=nv12,hwupload"
+	}
+	return ""
+}
+
+// FilterArgs returns the -vf argument for chain followed by Filter, or
+// nothing if both are empty.
+func (e Encoder) FilterArgs(chain string) []string {
+	if f := e.Filter(); f != "" {
+		if chain != "" {
+			chain += ","
+		}
+		chain += f
+	}
+	if chain == "" {
+		return nil
+	}
+	return []string{"-vf", chain}
+}
+
+// Args returns the output arguments selecting and setting up the encoder.
+// A bitrate overrides the encoder's quality setting or default bitrate.
+func (e Encoder) Args(bitrate int) []string {
+	return e.args(bitrate, quality)
+}
+
+// FastArgs returns the output arguments like Args(0), with software
+// encoders set up for speed rather than size.
+func (e Encoder) FastArgs() []string {
+	return e.args(0, fast)
+}
+
+func (e Encoder) args(bitrate int, settings map[string][]string) []string {
+	if e.Name == Copy {
+		return []string{"-c:v", "copy"}
+	}
+	args := []string{"-c:v", e.Name}
+	q, hasQuality := settings[e.Name]
+	if !hasQuality {
+		q, hasQuality = quality[e.Name]
+	}
+	switch {
+	case bitrate > 0:
+		args = append(args, "-b:v", fmt.Sprintf("%dk", bitrate))
+	case hasQuality:
+		args = append(args, q...)
+	case e.Bitrate > 0:
+		// Hardware encoders don't take x264 presets; use a bitrate target
+		args = append(args, "-b:v", fmt.Sprintf("%dk", e.Bitrate))
+	}
+	if e.HWAccel != VAAPI {
+		// VAAPI frames are already in the encoder's format on the device
+		args = append(args, "-pix_fmt", "yuv420p")
+	}
+	if e.Codec == H265 {
+		// Lets Apple players open H.265 MP4s
+		args = append(args, "-tag:v", "hvc1")
+	}
+	return args
+}
+
+// probe encodes a generated frame with e.
+func probe(e Encoder) error {
+	if e.Name == Copy {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	args = append(args, e.InputArgs()...)
+	args = append(args, "-f", "lavfi", "-i", "color=c=black:s=320x240:r=1", "-frames:v", "1")
+	args = append(args, e.FilterArgs("")...)
+	args = append(args, e.Args(0)...)
+	args = append(args, "-f", "null", "-")
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, lastLine(msg))
+		}
+		return err
+	}
+	return nil
+}
+
+// available reports whether an accelerator could be present, to spare
+// probing those that can't.
+func available(accel, device string) bool {
+	switch accel {
+	case VAAPI:
+		_, err := os.Stat(device)
+		return err == nil
+	case VideoToolbox:
+		return runtime.GOOS == "darwin"
+	case V4L2M2M:
+		// The Raspberry Pi's bcm2835-codec
+		_, err := os.Stat("/dev/video11")
+		return err == nil
+	case NVENC:
+		return runtime.GOOS != "darwin"
+	}
+	return false
+}
+
+// codecOf returns the codec an FFmpeg encoder produces, if known.
+func codecOf(name string) string {
+	for codec, n := range software {
+		if n == name {
+			return codec
+		}
+	}
+	for _, encoders := range hardware {
+		for codec, n := range encoders {
+			if n == name {
+				return codec
+			}
+		}
+	}
+	return ""
+}
+
+// hwaccelOf returns the accelerator an FFmpeg encoder uses, if any.
+func hwaccelOf(name string) string {
+	for accel, encoders := range hardware {
+		for _, n := range encoders {
+			if n == name {
+				return accel
+			}
+		}
+	}
+	return ""
+}
+
+func isCodec(name string) bool {
+	return slices.Contains(Codecs, name)
+}
+
+func lastLine(s string) string {
+	return s[strings.LastIndexByte(s, '\n')+1:]
+}
@@ -0,0 +1,39 @@
+// Package webhook posts server events to URLs operators configure, so
+// alerting systems outside the server hear of them.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/raeeceip/cctv/internal/events"
+)
+
+// client posts webhooks, each bounded to 10 seconds.
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// Post sends an event to url as JSON. Answers other than 2xx fail.
+func Post(ctx context.Context, url string, e events.Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package wire
+
+import "slices"
+
+// HelloType is the type of hello messages. After the websocket upgrade the
+// server sends a hello to cameras that read control messages, with the
+// version and capabilities the handshake settled on. A camera may answer
+// with its own hello, at any time, to speak an older version or give up
+// capabilities, or to negotiate a version at all if it couldn't declare
+// one in the handshake; the server replies with the result. Cameras that
+// never send one keep what the handshake settled on.
+const HelloType = "hello"
+
+// Capability names in hello messages, one per field of Capabilities.
+// Unknown names are ignored, so later versions can add some.
+const (
+	CapJSONFrames   = "json_frames"
+	CapBinaryFrames = "binary_frames"
+	CapCompression  = "compression"
+	CapControl      = "control"
+	CapHeartbeat    = "heartbeat"
+	CapWebP         = "webp"
+)
+
+// Hello is a hello message, in either direction.
+type Hello struct {
+	Type string `json:"type"`
+	// Proto is a protocol version: the one in use from the server, the
+	// latest the camera speaks from a camera; 0 for none
+	Proto int `json:"proto"`
+	// Capabilities are what is in use from the server, or what the camera
+	// wants from a camera; a camera listing none keeps them all
+	Capabilities []string `json:"capabilities"`
+	// Versions are the protocol versions the server accepts; only the
+	// server sends them
+	Versions []int `json:"versions,omitempty"`
+}
+
+// NewHello returns the hello describing caps.
+func NewHello(caps Capabilities) Hello {
+	return Hello{Type: HelloType, Proto: caps.Version, Capabilities: caps.Names()}
+}
+
+// Names lists the capabilities that are set.
+func (c Capabilities) Names() []string {
+	names := []string{}
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{c.JSONFrames, CapJSONFrames},
+		{c.BinaryFrames, CapBinaryFrames},
+		{c.Compression, CapCompression},
+		{c.Control, CapControl},
+		{c.Heartbeat, CapHeartbeat},
+		{c.WebP, CapWebP},
+	} {
+		if f.set {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// Has reports whether a hello lists a capability.
+func (h Hello) Has(name string) bool {
+	return slices.Contains(h.Capabilities, name)
+}
+
+// Restrict returns c without the capabilities a camera's hello leaves out.
+// A hello listing none leaves c as it is, but for WebP, which is only kept
+// when the hello lists it.
+func (c Capabilities) Restrict(h Hello) Capabilities {
+	c.WebP = c.WebP && h.Has(CapWebP)
+	if len(h.Capabilities) == 0 {
+		return c
+	}
+	c.JSONFrames = c.JSONFrames && h.Has(CapJSONFrames)
+	c.BinaryFrames = c.BinaryFrames && h.Has(CapBinaryFrames)
+	c.Compression = c.Compression && h.Has(CapCompression)
+	c.Control = c.Control && h.Has(CapControl)
+	c.Heartbeat = c.Heartbeat && h.Has(CapHeartbeat)
+	return c
+}
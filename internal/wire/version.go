@@ -0,0 +1,111 @@
+package wire
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Protocol versions, declared by cameras in VersionHeader. Each version is
+// understood by every server that knows a later one, so a camera declares
+// the latest it speaks and the server answers with the version to use.
+const (
+	// VersionJSON sends frames as JSON text messages with base64 data.
+	VersionJSON = 1
+	// VersionBinary sends frames as binary frame messages.
+	VersionBinary = 2
+	// VersionCompressed sends binary frame messages over a connection with
+	// permessage-deflate, which shrinks the headers and control messages;
+	// the JPEGs are already compressed.
+	VersionCompressed = 3
+
+	// LatestVersion is the latest version this package speaks.
+	LatestVersion = VersionCompressed
+)
+
+// VersionHeader carries the protocol version of the websocket handshake:
+// the latest a camera speaks in the request, and the one the server picked
+// in the response. Cameras that can't set headers send ?version= instead.
+const VersionHeader = "X-Protocol-Version"
+
+// Capabilities are what one connection's camera and the server both
+// understand.
+type Capabilities struct {
+	// Version is the negotiated protocol version, 0 for a camera that
+	// declared none
+	Version int `json:"version"`
+	// JSONFrames and BinaryFrames are the frame message formats the camera
+	// may send
+	JSONFrames   bool `json:"json_frames"`
+	BinaryFrames bool `json:"binary_frames"`
+	// Compression is whether messages are sent with permessage-deflate
+	Compression bool `json:"compression"`
+	// Control is whether the camera reads control messages
+	Control bool `json:"control"`
+	// Heartbeat is whether the server reads heartbeats from the camera
+	Heartbeat bool `json:"heartbeat"`
+	// WebP is whether the camera may send WebP frames as well as JPEG. No
+	// version implies it: a camera asks for it in its hello, and learns
+	// from the server's answer
+	WebP bool `json:"webp"`
+}
+
+// CapabilitiesOf returns the capabilities of a protocol version.
+func CapabilitiesOf(version int) Capabilities {
+	return Capabilities{
+		Version:      version,
+		JSONFrames:   version == VersionJSON,
+		BinaryFrames: version >= VersionBinary,
+		Compression:  version >= VersionCompressed,
+		Control:      true,
+		Heartbeat:    true,
+	}
+}
+
+// LegacyCapabilities returns the capabilities of a camera that declared no
+// version, from the subprotocol it negotiated, if any. Cameras that
+// negotiate none predate control messages and may send either format.
+func LegacyCapabilities(subprotocol string) Capabilities {
+	switch subprotocol {
+	case BinaryProtocol:
+		return Capabilities{BinaryFrames: true, Control: true, Heartbeat: true}
+	case JSONProtocol:
+		return Capabilities{JSONFrames: true, Control: true, Heartbeat: true}
+	}
+	return Capabilities{JSONFrames: true, BinaryFrames: true, Heartbeat: true}
+}
+
+// ParseVersion parses a declared protocol version.
+func ParseVersion(s string) (int, error) {
+	v, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || v < 1 {
+		return 0, fmt.Errorf("invalid protocol version %q", s)
+	}
+	return v, nil
+}
+
+// Negotiate picks the version to speak with a camera that declared
+// declared: the latest of accepted no later than it. Cameras declaring a
+// version newer than any accepted are spoken to in an older one they also
+// understand; an error means the camera is too old for the server.
+func Negotiate(declared int, accepted []int) (int, error) {
+	best := 0
+	for _, v := range accepted {
+		if v <= declared && v > best {
+			best = v
+		}
+	}
+	if best == 0 {
+		return 0, fmt.Errorf("unsupported protocol version %d, the server accepts versions %s", declared, FormatVersions(accepted))
+	}
+	return best, nil
+}
+
+// FormatVersions lists versions as "1, 2, 3".
+func FormatVersions(versions []int) string {
+	s := make([]string, len(versions))
+	for i, v := range versions {
+		s[i] = strconv.Itoa(v)
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,233 @@
+// Package wire defines the binary camera frame message. It is an
+// alternative to the JSON text message that carries the JPEG as is rather
+// than base64 encoded, so the server can stream it straight into a buffer:
+//
+//	uint32   header length, big-endian
+//	[]byte   JSON Header
+//	[]byte   JPEG, or WebP if negotiated, the rest of the message
+//
+// Cameras declare a protocol version when connecting, which fixes the
+// format (see VersionHeader). Those from before versioning pick one through
+// the websocket subprotocol; one that negotiates neither is read in
+// whichever format it sends.
+package wire
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Websocket subprotocols naming the frame message formats.
+const (
+	// BinaryProtocol is the binary frame message.
+	BinaryProtocol = "cctv.frame.binary.v1"
+	// JSONProtocol is the JSON text message with base64 data.
+	JSONProtocol = "cctv.frame.json.v1"
+)
+
+// Protocols lists the formats in order of preference.
+var Protocols = []string{BinaryProtocol, JSONProtocol}
+
+// CameraIDHeader carries the ID a camera declares when connecting, so its
+// frames are stored under the same ID every time. Devices that can't set
+// headers on the handshake send ?camera= instead.
+const CameraIDHeader = "X-Camera-ID"
+
+// maxHeaderSize guards against reading a payload as a header length.
+const maxHeaderSize = 64 << 10
+
+// Header describes the frame that follows it.
+type Header struct {
+	Camera   string    `json:"camera"`
+	Time     time.Time `json:"time"`
+	FrameNum uint64    `json:"frame_num"`
+	Pattern  string    `json:"pattern,omitempty"`
+	// Location is where a mobile camera took the frame
+	Location *Location `json:"location,omitempty"`
+	// KeyFrame and GOP are sent by cameras that send in groups of
+	// pictures: KeyFrame marks the frame starting each group, and GOP
+	// places every frame in its group. The other frames of a group are
+	// deltas of its keyframe.
+	KeyFrame bool `json:"key_frame,omitempty"`
+	GOP      *GOP `json:"gop,omitempty"`
+	// PTZ is where a pan/tilt/zoom camera pointed when it took the frame
+	PTZ *PTZ `json:"ptz,omitempty"`
+}
+
+// IsKeyFrame reports whether the frame can be decoded on its own: it
+// starts a group of pictures, or its camera doesn't send in groups.
+func (h Header) IsKeyFrame() bool {
+	return h.GOP == nil || h.KeyFrame
+}
+
+// GOP places a frame in its group of pictures.
+type GOP struct {
+	Size     int    `json:"size"`      // frames from one keyframe to the next
+	KeyFrame uint64 `json:"key_frame"` // FrameNum of the group's keyframe
+	Index    int    `json:"index"`     // frames since the keyframe, 0 on it
+}
+
+// PTZ is a pan/tilt/zoom position.
+type PTZ struct {
+	Pan  float64 `json:"pan"`  // -1 full left to 1 full right
+	Tilt float64 `json:"tilt"` // -1 full down to 1 full up
+	Zoom float64 `json:"zoom"` // 0 widest to 1 narrowest
+}
+
+// Clamp returns the position limited to the range a camera can point.
+func (p PTZ) Clamp() PTZ {
+	return PTZ{Pan: clamp(p.Pan, -1, 1), Tilt: clamp(p.Tilt, -1, 1), Zoom: clamp(p.Zoom, 0, 1)}
+}
+
+// PTZMove is where a PTZ control message moves a camera. An absolute move
+// goes to the position given, keeping the axes left out; a relative one
+// adds to the position the camera is moving to.
+type PTZMove struct {
+	Pan      *float64 `json:"pan,omitempty"`
+	Tilt     *float64 `json:"tilt,omitempty"`
+	Zoom     *float64 `json:"zoom,omitempty"`
+	Relative bool     `json:"relative,omitempty"`
+}
+
+// Valid reports whether the move is within range: a position for an
+// absolute move, or up to the whole range either way for a relative one.
+// It must move at least one axis.
+func (m PTZMove) Valid() bool {
+	if m.Pan == nil && m.Tilt == nil && m.Zoom == nil {
+		return false
+	}
+	in := func(v *float64, min, max float64) bool {
+		return v == nil || (*v >= min && *v <= max)
+	}
+	if m.Relative {
+		return in(m.Pan, -2, 2) && in(m.Tilt, -2, 2) && in(m.Zoom, -1, 1)
+	}
+	return in(m.Pan, -1, 1) && in(m.Tilt, -1, 1) && in(m.Zoom, 0, 1)
+}
+
+// Apply returns where the move takes a camera moving to p.
+func (m PTZMove) Apply(p PTZ) PTZ {
+	axis := func(cur float64, v *float64) float64 {
+		switch {
+		case v == nil:
+			return cur
+		case m.Relative:
+			return cur + *v
+		}
+		return *v
+	}
+	return PTZ{Pan: axis(p.Pan, m.Pan), Tilt: axis(p.Tilt, m.Tilt), Zoom: axis(p.Zoom, m.Zoom)}.Clamp()
+}
+
+func clamp(v, min, max float64) float64 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// Location is a GPS fix.
+type Location struct {
+	Latitude  float64 `json:"lat"` // degrees
+	Longitude float64 `json:"lon"`
+	Altitude  float64 `json:"alt,omitempty"`     // meters
+	Heading   float64 `json:"heading,omitempty"` // degrees clockwise from north
+	Speed     float64 `json:"speed,omitempty"`   // meters per second
+}
+
+// Valid reports whether the coordinates are on the globe.
+func (l Location) Valid() bool {
+	return l.Latitude >= -90 && l.Latitude <= 90 && l.Longitude >= -180 && l.Longitude <= 180
+}
+
+// Control message types.
+const (
+	// ControlConfig changes the resolution a camera sends frames at.
+	ControlConfig = "config"
+	// ControlSnapshot asks a camera to send a frame right away, rather
+	// than at its next interval.
+	ControlSnapshot = "snapshot"
+	// ControlFeedback tells a camera how the server is keeping up with
+	// its frames, so it can send fewer or smaller ones under pressure.
+	ControlFeedback = "feedback"
+	// ControlPTZ moves a camera that reports a PTZ position in its frames.
+	ControlPTZ = "ptz"
+)
+
+// Control is a JSON text message the server sends a camera, in either
+// frame format. Cameras ignore types they don't know.
+type Control struct {
+	Type   string `json:"type"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	// QueueLoad is how full the queue the camera's frames wait in for
+	// storage is, from 0 to 1, when frames are dropped
+	QueueLoad float64 `json:"queue_load,omitempty"`
+	// LatencyMs is how long its frames take to be queued, smoothed
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+	// PTZ is where a ControlPTZ message moves the camera
+	PTZ *PTZMove `json:"ptz,omitempty"`
+}
+
+// HeartbeatType is the type of heartbeat messages, which cameras send as
+// JSON text messages in either frame format, while the server's hello
+// lists CapHeartbeat, so the server can tell a camera with nothing to send
+// from one that is gone.
+const HeartbeatType = "heartbeat"
+
+// Heartbeat is a heartbeat message.
+type Heartbeat struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// FramesSent counts the frames sent since the camera started, and FPS
+	// is how many it sent per second lately
+	FramesSent uint64  `json:"frames_sent"`
+	FPS        float64 `json:"fps"`
+}
+
+// WriteFrame writes a complete binary frame message to w.
+func WriteFrame(w io.Writer, h Header, jpeg []byte) error {
+	header, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(header)))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err = w.Write(jpeg)
+	return err
+}
+
+// ReadHeader reads the header of a binary frame message, leaving r at the
+// start of the JPEG.
+func ReadHeader(r io.Reader) (Header, error) {
+	var h Header
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return h, fmt.Errorf("failed to read frame header size: %w", err)
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxHeaderSize {
+		return h, fmt.Errorf("frame header of %d bytes is too large", n)
+	}
+
+	header := make([]byte, n)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return h, fmt.Errorf("failed to read frame header: %w", err)
+	}
+	if err := json.Unmarshal(header, &h); err != nil {
+		return h, fmt.Errorf("invalid frame header: %w", err)
+	}
+	return h, nil
+}
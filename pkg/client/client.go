@@ -0,0 +1,285 @@
+// Package client is a Go client for the cctvserver API. It covers what
+// programs consuming a server need: its cameras, searching recordings,
+// fetching their files and following its events, plus uploading
+// recordings.
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxEventSize bounds one server-sent event.
+const maxEventSize = 1 << 20
+
+// Client calls the API of one server.
+type Client struct {
+	base  *url.URL
+	token string
+
+	// HTTPClient sends the requests, http.DefaultClient if nil. Event
+	// streams stay open, so it shouldn't have a Timeout; the context of
+	// each call bounds it instead.
+	HTTPClient *http.Client
+}
+
+// New returns a client for the server at baseURL, e.g.
+// "https://nvr.example.com:8080". token is sent as a bearer token unless
+// empty.
+func New(baseURL, token string) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid server URL %q: scheme must be http or https", baseURL)
+	}
+	return &Client{base: u, token: token}, nil
+}
+
+// Camera is a camera of the server.
+type Camera struct {
+	ID        string     `json:"id"`
+	Source    string     `json:"source"` // "websocket", "rtsp" or "cluster"
+	Connected bool       `json:"connected"`
+	LastFrame *time.Time `json:"last_frame,omitempty"`
+}
+
+// Recording is an indexed video or image.
+type Recording struct {
+	ID         int64     `json:"id"`
+	CameraID   string    `json:"camera_id"`
+	Path       string    `json:"path"`
+	StartTime  time.Time `json:"start_time"`
+	EndTime    time.Time `json:"end_time"`
+	FrameCount int       `json:"frame_count"`
+	SizeBytes  int64     `json:"size_bytes"`
+	Codec      string    `json:"codec"`
+	Tier       int       `json:"tier"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// RecordingQuery filters recordings. Zero fields don't filter.
+type RecordingQuery struct {
+	Camera string
+	Site   string
+	Since  time.Time // recordings ending at or after Since
+	Until  time.Time // recordings starting before Until
+	Limit  int       // the server's default if zero
+}
+
+// Event types
+const (
+	CameraConnected    = "camera.connected"
+	CameraDisconnected = "camera.disconnected"
+	RecordingCreated   = "recording.created"
+	MotionDetected     = "motion.detected"
+	ObjectsDetected    = "objects.detected"
+)
+
+// Event is something that happened on the server.
+type Event struct {
+	Type     string          `json:"type"`
+	Time     time.Time       `json:"time"`
+	CameraID string          `json:"camera_id"`
+	Node     string          `json:"node,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+}
+
+// Recording returns the recording of a recording.created event.
+func (e Event) Recording() (*Recording, error) {
+	if e.Type != RecordingCreated {
+		return nil, fmt.Errorf("%s event has no recording", e.Type)
+	}
+	var r Recording
+	if err := json.Unmarshal(e.Data, &r); err != nil {
+		return nil, fmt.Errorf("invalid recording in event: %w", err)
+	}
+	return &r, nil
+}
+
+// Error is an error response of the server.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("server returned %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound reports whether err is a 404 response.
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+}
+
+// Cameras lists the server's cameras.
+func (c *Client) Cameras(ctx context.Context) ([]Camera, error) {
+	var resp struct {
+		Cameras []Camera `json:"cameras"`
+	}
+	if err := c.getJSON(ctx, "/api/v1/cameras", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Cameras, nil
+}
+
+// Recordings searches the server's recordings, newest first.
+func (c *Client) Recordings(ctx context.Context, q RecordingQuery) ([]Recording, error) {
+	params := url.Values{}
+	if q.Camera != "" {
+		params.Set("camera", q.Camera)
+	}
+	if q.Site != "" {
+		params.Set("site", q.Site)
+	}
+	if !q.Since.IsZero() {
+		params.Set("since", q.Since.Format(time.RFC3339))
+	}
+	if !q.Until.IsZero() {
+		params.Set("until", q.Until.Format(time.RFC3339))
+	}
+	if q.Limit > 0 {
+		params.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	var resp struct {
+		Recordings []Recording `json:"recordings"`
+	}
+	if err := c.getJSON(ctx, "/api/v1/recordings", params, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Recordings, nil
+}
+
+// Recording returns one recording.
+func (c *Client) Recording(ctx context.Context, id int64) (*Recording, error) {
+	var r Recording
+	if err := c.getJSON(ctx, "/api/v1/recordings/"+strconv.FormatInt(id, 10), nil, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// RecordingFileURL returns the URL serving a recording's file. Requests to
+// it need the client's token too.
+func (c *Client) RecordingFileURL(id int64) *url.URL {
+	return c.url("/api/v1/recordings/"+strconv.FormatInt(id, 10)+"/file", nil)
+}
+
+// EventStream is an open stream of the server's events. Events published
+// while no stream is open are not sent again.
+type EventStream struct {
+	body io.ReadCloser
+	sc   *bufio.Scanner
+}
+
+// Events opens the server's event stream. It returns once the server has
+// accepted it; the stream is closed when ctx is cancelled or by Close.
+func (c *Client) Events(ctx context.Context) (*EventStream, error) {
+	resp, err := c.do(ctx, http.MethodGet, c.url("/api/v1/events", nil))
+	if err != nil {
+		return nil, err
+	}
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64<<10), maxEventSize)
+	return &EventStream{body: resp.Body, sc: sc}, nil
+}
+
+// Next waits for the next event. It returns io.ErrUnexpectedEOF when the
+// server ends the stream.
+func (s *EventStream) Next() (Event, error) {
+	var data strings.Builder
+	for s.sc.Scan() {
+		line := s.sc.Text()
+		switch {
+		case line == "" && data.Len() > 0:
+			var e Event
+			if err := json.Unmarshal([]byte(data.String()), &e); err != nil {
+				return Event{}, fmt.Errorf("invalid event: %w", err)
+			}
+			return e, nil
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+		// Event names repeat the type; comments keep the stream alive
+	}
+	if err := s.sc.Err(); err != nil {
+		return Event{}, fmt.Errorf("event stream failed: %w", err)
+	}
+	return Event{}, io.ErrUnexpectedEOF
+}
+
+// Close closes the stream.
+func (s *EventStream) Close() error {
+	return s.body.Close()
+}
+
+func (c *Client) url(path string, params url.Values) *url.URL {
+	u := *c.base
+	u.Path += path
+	u.RawQuery = params.Encode()
+	return &u
+}
+
+// do sends a request and returns the response if it succeeded.
+func (c *Client) do(ctx context.Context, method string, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.send(req)
+}
+
+// send authenticates and sends req, returning the response if it
+// succeeded.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body)
+		if body.Error == "" {
+			body.Error = http.StatusText(resp.StatusCode)
+		}
+		return nil, &Error{StatusCode: resp.StatusCode, Message: body.Error}
+	}
+	return resp, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, params url.Values, v interface{}) error {
+	resp, err := c.do(ctx, http.MethodGet, c.url(path, params))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid response from %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// DefaultChunkSize is the upload chunk size used when none is given.
+const DefaultChunkSize = 8 << 20
+
+// Upload describes a recording file to upload.
+type Upload struct {
+	// Origin and Name identify the upload on the server, which files the
+	// recording under Origin and qualifies its camera ID with it. Both must
+	// be plain file names. Camera uploads have no origin; the server files
+	// them under the camera the token is for.
+	Origin string
+	Name   string
+	// File is read from offset zero up to Size
+	File io.ReaderAt
+	Size int64
+	// Recording describes the footage: camera, times, frames and codec
+	Recording Recording
+	ChunkSize int64 // DefaultChunkSize if zero
+}
+
+// UploadRecording sends a recording through the server's resumable upload
+// API, the one replication uses, and returns it as indexed. An upload
+// interrupted earlier resumes from what the server holds. The server
+// must accept replication, and the client's token must be its
+// replication.accept_token.
+func (c *Client) UploadRecording(ctx context.Context, up Upload) (*Recording, error) {
+	return c.upload(ctx, up,
+		"/api/v1/replication/uploads/"+url.PathEscape(up.Origin)+"/"+url.PathEscape(up.Name),
+		"/api/v1/replication/recordings")
+}
+
+// UploadCameraRecording uploads a camera's own recording like
+// UploadRecording. The client's token must be one of the camera's tokens;
+// the recording is indexed under that camera whatever up says.
+func (c *Client) UploadCameraRecording(ctx context.Context, up Upload) (*Recording, error) {
+	return c.upload(ctx, up, "/api/v1/camera/uploads/"+url.PathEscape(up.Name), "/api/v1/camera/recordings")
+}
+
+// upload sends up in chunks to uploadPath and completes it at
+// completePath.
+func (c *Client) upload(ctx context.Context, up Upload, uploadPath, completePath string) (*Recording, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(up.File, 0, up.Size)); err != nil {
+		return nil, fmt.Errorf("failed to read upload: %w", err)
+	}
+	chunk := up.ChunkSize
+	if chunk <= 0 {
+		chunk = DefaultChunkSize
+	}
+	u := c.url(uploadPath, nil)
+
+	offset, err := c.uploadOffset(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	if offset > up.Size {
+		// Left over from a different file
+		offset = 0
+	}
+	for offset < up.Size {
+		n := min(up.Size-offset, chunk)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPatch, u.String(), io.NewSectionReader(up.File, offset, n))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = n
+		req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		resp, err := c.send(req)
+		if e, ok := err.(*Error); ok && e.StatusCode == http.StatusConflict {
+			// The server holds a different amount; carry on from there
+			if offset, err = c.uploadOffset(ctx, u); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		offset, err = decodeOffset(resp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	body, err := json.Marshal(struct {
+		Origin    string    `json:"origin"`
+		Name      string    `json:"name"`
+		Size      int64     `json:"size"`
+		SHA256    string    `json:"sha256"`
+		Recording Recording `json:"recording"`
+	}{up.Origin, up.Name, up.Size, hex.EncodeToString(h.Sum(nil)), up.Recording})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		c.url(completePath, nil).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var r Recording
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("invalid response to upload: %w", err)
+	}
+	return &r, nil
+}
+
+// uploadOffset asks how much of an upload the server holds.
+func (c *Client) uploadOffset(ctx context.Context, u *url.URL) (int64, error) {
+	resp, err := c.do(ctx, http.MethodGet, u)
+	if err != nil {
+		return 0, err
+	}
+	return decodeOffset(resp)
+}
+
+func decodeOffset(resp *http.Response) (int64, error) {
+	defer resp.Body.Close()
+	var status struct {
+		Offset int64 `json:"offset"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return 0, fmt.Errorf("invalid upload offset: %w", err)
+	}
+	return status.Offset, nil
+}
@@ -0,0 +1,181 @@
+package logger
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+const (
+	// maxDashboardCameras is how many cameras the cameras pane lists
+	maxDashboardCameras = 8
+	// maxRecentErrors is how many errors the errors pane keeps
+	maxRecentErrors = 5
+)
+
+// StatusProvider feeds the dashboard panes of the UI. Its methods are
+// called from the UI goroutine about once a second, so they must not block.
+type StatusProvider interface {
+	CameraStatus() []CameraStatus
+	QueueStatus() QueueStatus
+	DiskStatus() DiskStatus
+}
+
+// CameraStatus is a camera as the dashboard lists it.
+type CameraStatus struct {
+	ID    string
+	State string // online, degraded or offline
+	FPS   float64
+	// Frames were received over the current connection
+	Frames uint64
+	// QueueLoad is how full the queue the camera's frames wait in is, from
+	// 0 to 1
+	QueueLoad float64
+}
+
+// QueueStatus is the processor as the dashboard shows it.
+type QueueStatus struct {
+	Queued   int // frames waiting to be stored
+	Capacity int
+	// Pending frames are stored and wait to be consolidated
+	Pending         int
+	FramesProcessed uint64
+	Errors          uint64
+}
+
+// DiskStatus is the volume frames are stored on.
+type DiskStatus struct {
+	Path          string
+	FreeBytes     uint64
+	TotalBytes    uint64
+	LowWaterBytes uint64
+	Low           bool // frames are not being stored
+	Error         string
+}
+
+// SetStatusProvider turns the UI into a dashboard fed by p, with panes for
+// cameras, the processor queue, disk space and recent errors above the
+// logs. Set it before StartUI.
+func (l *Logger) SetStatusProvider(p StatusProvider) {
+	l.status = p
+}
+
+// dashboardViews renders the dashboard panes, the cameras on top and the
+// rest side by side below them.
+func (m *UIModel) dashboardViews() []string {
+	if m.status == nil {
+		return nil
+	}
+	width := m.termWidth - 2
+	cameras := paneStyle.Width(width).Render(paneContent("Cameras", camerasView(m.status.CameraStatus())))
+
+	// Each of the three lower panes takes a third of the width, borders
+	// included, and is as high as the highest
+	third := (m.termWidth - 6) / 3
+	widths := []int{third, third, width - 2*(third+2)}
+	contents := []string{
+		paneContent("Processor", queueView(m.status.QueueStatus())),
+		paneContent("Disk", diskView(m.status.DiskStatus())),
+		paneContent("Recent errors", m.errorsView()),
+	}
+	height := 0
+	for i, c := range contents {
+		height = max(height, lipgloss.Height(paneStyle.Width(widths[i]).Render(c))-2)
+	}
+	row := make([]string, len(contents))
+	for i, c := range contents {
+		row[i] = paneStyle.Width(widths[i]).Height(height).Render(c)
+	}
+	return []string{cameras, lipgloss.JoinHorizontal(lipgloss.Top, row...)}
+}
+
+func paneContent(title, content string) string {
+	return titleStyle.Render(title) + "\n" + content
+}
+
+// recordError keeps an error entry for the errors pane.
+func (m *UIModel) recordError(entry LogEntry) {
+	line := timestampStyle.Render(entry.Timestamp.Format("15:04:05")) + " " + entry.Message + formatFields(entry.Fields)
+	m.errors = append(m.errors, line)
+	if len(m.errors) > maxRecentErrors {
+		m.errors = m.errors[len(m.errors)-maxRecentErrors:]
+	}
+}
+
+func (m *UIModel) errorsView() string {
+	if len(m.errors) == 0 {
+		return "No errors"
+	}
+	return strings.Join(m.errors, "\n")
+}
+
+func camerasView(cameras []CameraStatus) string {
+	if len(cameras) == 0 {
+		return "No cameras"
+	}
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	// The state is last as its colour would throw the columns out
+	fmt.Fprintln(tw, "CAMERA\tFPS\tFRAMES\tQUEUE\tSTATE")
+	for i, c := range cameras {
+		if i == maxDashboardCameras {
+			fmt.Fprintf(tw, "… %d more\n", len(cameras)-i)
+			break
+		}
+		fmt.Fprintf(tw, "%s\t%.1f\t%d\t%.0f%%\t%s\n", c.ID, c.FPS, c.Frames, c.QueueLoad*100, stateStyle(c.State).Render(c.State))
+	}
+	tw.Flush()
+	return strings.TrimRight(b.String(), "\n")
+}
+
+func stateStyle(state string) lipgloss.Style {
+	switch state {
+	case "online":
+		return debugStyle
+	case "degraded":
+		return warnStyle
+	default:
+		return errorStyle
+	}
+}
+
+func queueView(q QueueStatus) string {
+	load := 0.0
+	if q.Capacity > 0 {
+		load = float64(q.Queued) / float64(q.Capacity)
+	}
+	return fmt.Sprintf("Queued   %d / %d (%.0f%%)\nPending  %d frames\nStored   %d frames\nErrors   %d",
+		q.Queued, q.Capacity, load*100, q.Pending, q.FramesProcessed, q.Errors)
+}
+
+func diskView(d DiskStatus) string {
+	if d.Error != "" {
+		return errorStyle.Render(d.Error)
+	}
+	if d.TotalBytes == 0 {
+		return "Not checked yet"
+	}
+	used := 1 - float64(d.FreeBytes)/float64(d.TotalBytes)
+	view := fmt.Sprintf("%s\nFree  %s of %s\nUsed  %.0f%%\nLow   below %s",
+		d.Path, formatBytes(d.FreeBytes), formatBytes(d.TotalBytes), used*100, formatBytes(d.LowWaterBytes))
+	if d.Low {
+		view += "\n" + errorStyle.Render("Low on space, frames are not stored")
+	}
+	return view
+}
+
+// formatBytes renders n in binary units, like 1.5 GiB.
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
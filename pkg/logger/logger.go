@@ -3,6 +3,7 @@ package logger
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -15,6 +16,7 @@ import (
 	"github.com/charmbracelet/lipgloss"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 var (
@@ -38,8 +40,16 @@ var (
 
 	timestampStyle = lipgloss.NewStyle().
 			Foreground(lipgloss.Color("#56B6C2"))
+
+	paneStyle = lipgloss.NewStyle().
+			BorderStyle(lipgloss.RoundedBorder()).
+			BorderForeground(lipgloss.Color("62")).
+			Padding(0, 1)
 )
 
+// paneRefresh is how often panes are re-rendered.
+const paneRefresh = time.Second
+
 type LogLevel int
 
 const (
@@ -58,13 +68,24 @@ type LogEntry struct {
 
 type Logger struct {
 	*zap.Logger
-	logChan     chan LogEntry
-	done        chan struct{}
-	uiProgram   *tea.Program
-	outputFile  *os.File
-	level       LogLevel
-	mu          sync.RWMutex
-	initialized bool
+	consoleLevel zap.AtomicLevel
+	logChan      chan LogEntry
+	done         chan struct{}
+	uiProgram    *tea.Program
+	uiClosed     chan struct{}
+	panes        []Pane
+	status       StatusProvider
+	outputFile   io.WriteCloser
+	level        LogLevel
+	mu           sync.RWMutex
+	initialized  bool
+}
+
+// Pane is a status box shown above the logs in the UI. Render is called
+// from the UI goroutine about once a second.
+type Pane struct {
+	Title  string
+	Render func() string
 }
 
 type UIModel struct {
@@ -77,6 +98,11 @@ type UIModel struct {
 	logChan     chan LogEntry
 	done        chan struct{}
 	lastUpdated time.Time
+	panes       []Pane
+	status      StatusProvider
+	errors      []string // recent, for the dashboard
+	paneViews   string
+	paneUpdated time.Time
 }
 
 func extractFieldValue(field zapcore.Field) interface{} {
@@ -138,13 +164,26 @@ func formatFields(fields []zapcore.Field) string {
 	return result
 }
 
+// NewLogger logs to the console at level, and to config.OutputPath at every
+// level. The file is rotated once it grows past MaxSize megabytes, keeping
+// MaxBackups old files, compressed with Compress, for up to MaxAge days;
+// zero keeps 100 MB files, and old files of any number or age.
 func NewLogger(level string, config Config) (*Logger, error) {
 	if err := os.MkdirAll(filepath.Dir(config.OutputPath), 0755); err != nil {
 		return nil, fmt.Errorf("failed to create log directory: %w", err)
 	}
 
-	f, err := os.OpenFile(config.OutputPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
+	f := &lumberjack.Logger{
+		Filename:   config.OutputPath,
+		MaxSize:    config.MaxSize,
+		MaxBackups: config.MaxBackups,
+		MaxAge:     config.MaxAge,
+		Compress:   config.Compress,
+		LocalTime:  true,
+	}
+	// Open the file now, so a bad path fails here rather than on the
+	// first entry
+	if _, err := f.Write(nil); err != nil {
 		return nil, fmt.Errorf("failed to open log file: %w", err)
 	}
 
@@ -162,6 +201,8 @@ func NewLogger(level string, config Config) (*Logger, error) {
 		EncodeCaller:   zapcore.ShortCallerEncoder,
 	}
 
+	consoleLevel := zap.NewAtomicLevelAt(parseLogLevel(level))
+
 	core := zapcore.NewTee(
 		zapcore.NewCore(
 			zapcore.NewJSONEncoder(encoderConfig),
@@ -171,18 +212,19 @@ func NewLogger(level string, config Config) (*Logger, error) {
 		zapcore.NewCore(
 			zapcore.NewConsoleEncoder(encoderConfig),
 			zapcore.AddSync(os.Stdout),
-			zapcore.Level(parseLogLevel(level)),
+			consoleLevel,
 		),
 	)
 
 	zapLogger := zap.New(core)
 
 	return &Logger{
-		Logger:     zapLogger,
-		logChan:    make(chan LogEntry, 1000),
-		done:       make(chan struct{}),
-		outputFile: f,
-		level:      InfoLevel,
+		Logger:       zapLogger,
+		consoleLevel: consoleLevel,
+		logChan:      make(chan LogEntry, 1000),
+		done:         make(chan struct{}),
+		outputFile:   f,
+		level:        InfoLevel,
 	}, nil
 }
 
@@ -201,6 +243,29 @@ func parseLogLevel(level string) zapcore.Level {
 	}
 }
 
+// SetLevel changes the console log level at runtime. The log file always
+// records at debug level, and the console stays quiet while the UI runs.
+func (l *Logger) SetLevel(level string) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if !l.initialized {
+		l.consoleLevel.SetLevel(parseLogLevel(level))
+	}
+}
+
+// AddPane adds a status pane to the UI. Add panes before StartUI.
+func (l *Logger) AddPane(title string, render func() string) {
+	l.panes = append(l.panes, Pane{Title: title, Render: render})
+}
+
+// UIClosed is closed when the user quits the UI. It never is if the UI was
+// not started.
+func (l *Logger) UIClosed() <-chan struct{} {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.uiClosed
+}
+
 // Modified logging methods to handle field conversion
 func (l *Logger) Debug(msg string, fields ...zap.Field) {
 	convertedFields := make([]zapcore.Field, len(fields))
@@ -275,13 +340,19 @@ func (l *Logger) StartUI() error {
 		return nil
 	}
 	l.initialized = true
+	l.uiClosed = make(chan struct{})
+	// Log lines go to the UI instead of the console it draws on
+	l.consoleLevel.SetLevel(zapcore.FatalLevel)
 	l.mu.Unlock()
 
 	model := NewUIModel(l.logChan, l.done)
+	model.panes = l.panes
+	model.status = l.status
 	program := tea.NewProgram(model)
 	l.uiProgram = program
 
 	go func() {
+		defer close(l.uiClosed)
 		if _, err := program.Run(); err != nil {
 			l.Error("failed to start UI", zap.Error(err))
 		}
@@ -323,10 +394,9 @@ func (m UIModel) waitForLogs() tea.Msg {
 		return entry
 	case <-m.done:
 		return tea.Quit
-	case <-ticker.C:
-		return tea.Tick(time.Millisecond*100, func(t time.Time) tea.Msg {
-			return t
-		})
+	case t := <-ticker.C:
+		// Update waits again on a tick, which also refreshes the panes
+		return t
 	}
 }
 
@@ -349,10 +419,15 @@ func (m UIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 		m.termWidth = msg.Width
 		m.termHeight = msg.Height
-		m.viewport.Width = msg.Width - 2
-		m.viewport.Height = msg.Height - 4
+		m.renderPanes()
 
 	case LogEntry:
+		if msg.Level == ErrorLevel {
+			m.recordError(msg)
+			if m.ready {
+				m.renderPanes()
+			}
+		}
 		logLine := formatLogEntry(msg)
 		m.logs = append(m.logs, logLine)
 		if len(m.logs) > 1000 { // Prevent memory growth
@@ -371,6 +446,10 @@ func (m UIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		cmds = append(cmds, m.waitForLogs)
 	}
 
+	if m.ready && time.Since(m.paneUpdated) >= paneRefresh {
+		m.renderPanes()
+	}
+
 	var cmd tea.Cmd
 	m.viewport, cmd = m.viewport.Update(msg)
 	cmds = append(cmds, cmd)
@@ -420,13 +499,41 @@ func (m UIModel) View() string {
 	}
 
 	title := titleStyle.Render("CCTV System Logs")
+	if m.status != nil {
+		title = titleStyle.Render("CCTV System Dashboard")
+	}
 	spinner := m.spinner.View() + " "
 	timestamp := timestampStyle.Render(time.Now().Format("15:04:05"))
 
 	header := lipgloss.JoinHorizontal(lipgloss.Center, spinner, title, timestamp)
 	body := m.viewport.View()
 
-	return lipgloss.JoinVertical(lipgloss.Left, header, body)
+	if m.paneViews == "" {
+		return lipgloss.JoinVertical(lipgloss.Left, header, body)
+	}
+	return lipgloss.JoinVertical(lipgloss.Left, header, m.paneViews, body)
+}
+
+// renderPanes refreshes the panes and gives the logs what space is left.
+// The terminal size must be known.
+func (m *UIModel) renderPanes() {
+	m.paneUpdated = time.Now()
+	views := m.dashboardViews()
+	for _, p := range m.panes {
+		content := titleStyle.Render(p.Title) + "\n" + p.Render()
+		views = append(views, paneStyle.Width(m.termWidth-2).Render(content))
+	}
+	m.paneViews = lipgloss.JoinVertical(lipgloss.Left, views...)
+
+	height := m.termHeight - 4
+	if m.paneViews != "" {
+		height -= lipgloss.Height(m.paneViews)
+	}
+	if height < 3 {
+		height = 3
+	}
+	m.viewport.Width = m.termWidth - 2
+	m.viewport.Height = height
 }
 
 func formatLogEntry(entry LogEntry) string {
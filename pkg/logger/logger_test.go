@@ -0,0 +1,46 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewLoggerRotatesAtMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cctv.log")
+	log, err := NewLogger("error", Config{OutputPath: path, MaxSize: 1, MaxBackups: 2})
+	if err != nil {
+		t.Fatalf("NewLogger: %v", err)
+	}
+	defer log.Close()
+
+	// Debug entries only go to the file; 2 KB each, so 1.5 MB in all
+	msg := strings.Repeat("x", 2<<10)
+	for i := 0; i < 768; i++ {
+		log.Debug(msg)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var backups []string
+	for _, e := range entries {
+		if e.Name() != "cctv.log" && strings.HasPrefix(e.Name(), "cctv-") {
+			backups = append(backups, e.Name())
+		}
+	}
+	if len(backups) == 0 {
+		t.Fatalf("no rotated backup after writing past MaxSize, have %v", entries)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 1<<20 {
+		t.Errorf("log file is %d bytes, past MaxSize", info.Size())
+	}
+}
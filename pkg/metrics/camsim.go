@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SimulatorMetrics describes a camera simulator. A simulator sends as one
+// camera, so its camera_id and any labels given for the run are constant
+// labels, matching the server's camera_id label.
+type SimulatorMetrics struct {
+	FramesPerSecond prometheus.Gauge
+	FramesSent      prometheus.Counter
+	SentBytes       *prometheus.CounterVec
+	EncodeDuration  prometheus.Histogram
+	SendErrors      prometheus.Counter
+	Reconnects      prometheus.Counter
+	BufferedFrames  prometheus.Gauge
+	OutageFrames    prometheus.Gauge
+	DroppedFrames   prometheus.Counter
+	PendingUploads  prometheus.Gauge
+	UploadedBytes   prometheus.Counter
+	UploadErrors    prometheus.Counter
+	JPEGQuality     prometheus.Gauge
+	TargetFPS       prometheus.Gauge
+}
+
+func NewSimulatorMetrics(cameraID string, labels map[string]string) *SimulatorMetrics {
+	constLabels := prometheus.Labels{"camera_id": cameraID}
+	for k, v := range labels {
+		constLabels[k] = v
+	}
+	return &SimulatorMetrics{
+		FramesPerSecond: promauto.NewGauge(prometheus.GaugeOpts{
+			Name:        "camsim_frames_per_second",
+			Help:        "Frames sent per second over the last second",
+			ConstLabels: constLabels,
+		}),
+		FramesSent: promauto.NewCounter(prometheus.CounterOpts{
+			Name:        "camsim_frames_sent_total",
+			Help:        "Total number of frames sent",
+			ConstLabels: constLabels,
+		}),
+		SentBytes: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name:        "camsim_sent_bytes_total",
+			Help:        "Total bytes of frame images sent, by encoding",
+			ConstLabels: constLabels,
+		}, []string{"encoding"}),
+		EncodeDuration: promauto.NewHistogram(prometheus.HistogramOpts{
+			Name:        "camsim_encode_duration_seconds",
+			Help:        "Time to encode a frame as JPEG, and WebP with -encoding webp",
+			Buckets:     prometheus.ExponentialBuckets(0.0005, 2, 12),
+			ConstLabels: constLabels,
+		}),
+		SendErrors: promauto.NewCounter(prometheus.CounterOpts{
+			Name:        "camsim_send_errors_total",
+			Help:        "Total number of frames that failed to send",
+			ConstLabels: constLabels,
+		}),
+		Reconnects: promauto.NewCounter(prometheus.CounterOpts{
+			Name:        "camsim_reconnects_total",
+			Help:        "Total number of reconnections to the server",
+			ConstLabels: constLabels,
+		}),
+		BufferedFrames: promauto.NewGauge(prometheus.GaugeOpts{
+			Name:        "camsim_buffered_frames",
+			Help:        "Frames buffered for the next local video",
+			ConstLabels: constLabels,
+		}),
+		OutageFrames: promauto.NewGauge(prometheus.GaugeOpts{
+			Name:        "camsim_outage_frames",
+			Help:        "Frames waiting to be sent, e.g. while reconnecting",
+			ConstLabels: constLabels,
+		}),
+		DroppedFrames: promauto.NewCounter(prometheus.CounterOpts{
+			Name:        "camsim_dropped_frames_total",
+			Help:        "Total number of frames dropped because the outage buffer was full",
+			ConstLabels: constLabels,
+		}),
+		PendingUploads: promauto.NewGauge(prometheus.GaugeOpts{
+			Name:        "camsim_pending_uploads",
+			Help:        "Recorded videos waiting for the next upload burst",
+			ConstLabels: constLabels,
+		}),
+		UploadedBytes: promauto.NewCounter(prometheus.CounterOpts{
+			Name:        "camsim_uploaded_bytes_total",
+			Help:        "Total bytes of videos uploaded in bursts",
+			ConstLabels: constLabels,
+		}),
+		UploadErrors: promauto.NewCounter(prometheus.CounterOpts{
+			Name:        "camsim_upload_errors_total",
+			Help:        "Total number of upload bursts that failed",
+			ConstLabels: constLabels,
+		}),
+		JPEGQuality: promauto.NewGauge(prometheus.GaugeOpts{
+			Name:        "camsim_jpeg_quality",
+			Help:        "JPEG quality frames are encoded at",
+			ConstLabels: constLabels,
+		}),
+		TargetFPS: promauto.NewGauge(prometheus.GaugeOpts{
+			Name:        "camsim_target_fps",
+			Help:        "Frames generated per second, lowered by -adaptive under server pressure",
+			ConstLabels: constLabels,
+		}),
+	}
+}
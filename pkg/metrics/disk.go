@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// DiskMetrics describes the space of the volume frames are stored on.
+type DiskMetrics struct {
+	FreeBytes     prometheus.Gauge
+	TotalBytes    prometheus.Gauge
+	LowWaterBytes prometheus.Gauge
+	Low           prometheus.Gauge
+	Dropped       prometheus.Counter
+	Webhooks      *prometheus.CounterVec
+}
+
+func NewDiskMetrics() *DiskMetrics {
+	return &DiskMetrics{
+		FreeBytes: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "disk_free_bytes",
+			Help: "Space left on the volume frames are stored on",
+		}),
+		TotalBytes: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "disk_total_bytes",
+			Help: "Size of the volume frames are stored on",
+		}),
+		LowWaterBytes: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "disk_low_water_bytes",
+			Help: "Free space below which frames stop being stored, 0 for none",
+		}),
+		Low: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "disk_low",
+			Help: "Whether frames are not being stored for lack of space",
+		}),
+		Dropped: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "disk_low_frames_dropped_total",
+			Help: "Total number of frames not stored for lack of space",
+		}),
+		Webhooks: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "disk_webhooks_total",
+			Help: "Total number of disk space webhook deliveries by result (ok or failed)",
+		}, []string{"result"}),
+	}
+}
@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// FrameCacheMetrics describes the cache of recent frames.
+type FrameCacheMetrics struct {
+	Hits   prometheus.Counter
+	Misses prometheus.Counter
+	Mapped prometheus.Gauge
+}
+
+func NewFrameCacheMetrics() *FrameCacheMetrics {
+	return &FrameCacheMetrics{
+		Hits: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "frame_cache_hits_total",
+			Help: "Total number of frames served from the frame cache",
+		}),
+		Misses: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "frame_cache_misses_total",
+			Help: "Total number of frame lookups that had to go to disk",
+		}),
+		Mapped: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "frame_cache_mapped_bytes",
+			Help: "Memory mapped for the frame cache rings",
+		}),
+	}
+}
@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// HealthMetrics describes which cameras are working.
+type HealthMetrics struct {
+	State       *prometheus.GaugeVec
+	Transitions *prometheus.CounterVec
+	Webhooks    *prometheus.CounterVec
+}
+
+func NewHealthMetrics() *HealthMetrics {
+	return &HealthMetrics{
+		State: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "camera_health_state",
+			Help: "1 for a camera's current health state (online, degraded or offline), 0 for the others",
+		}, []string{"camera_id", "state"}),
+		Transitions: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "camera_health_transitions_total",
+			Help: "Total number of cameras entering each health state",
+		}, []string{"state"}),
+		Webhooks: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "camera_health_webhooks_total",
+			Help: "Total number of camera health webhook deliveries by result (ok or failed)",
+		}, []string{"result"}),
+	}
+}
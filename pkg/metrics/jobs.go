@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Job run results
+const (
+	JobOK     = "ok"
+	JobRetry  = "retry"  // failed, another attempt is scheduled
+	JobFailed = "failed" // failed for good
+)
+
+// JobMetrics describes the background job queue, labelled by job kind.
+type JobMetrics struct {
+	Running  *prometheus.GaugeVec
+	Queued   *prometheus.GaugeVec
+	Failed   *prometheus.GaugeVec
+	Runs     *prometheus.CounterVec
+	Duration *prometheus.HistogramVec
+}
+
+func NewJobMetrics() *JobMetrics {
+	return &JobMetrics{
+		Running: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "jobs_running",
+			Help: "Number of jobs being run",
+		}, []string{"kind"}),
+		Queued: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "jobs_queued",
+			Help: "Number of jobs waiting to run, including scheduled retries",
+		}, []string{"kind"}),
+		Failed: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "jobs_failed",
+			Help: "Number of jobs in the job history that failed for good",
+		}, []string{"kind"}),
+		Runs: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "job_runs_total",
+			Help: "Total number of job runs by result",
+		}, []string{"kind", "result"}),
+		Duration: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "job_duration_seconds",
+			Help:    "Histogram of job run time in seconds",
+			Buckets: prometheus.ExponentialBuckets(0.25, 2, 14), // up to ~34m
+		}, []string{"kind"}),
+	}
+}
+
+// EncodeMetrics describes FFmpeg encodes.
+type EncodeMetrics struct {
+	FramesPerSecond prometheus.Gauge
+	Frames          prometheus.Counter
+}
+
+func NewEncodeMetrics(name string) *EncodeMetrics {
+	return &EncodeMetrics{
+		FramesPerSecond: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: name + "_encode_fps",
+			Help: "Frames per second of the last " + name + " encode",
+		}),
+		Frames: promauto.NewCounter(prometheus.CounterOpts{
+			Name: name + "_encoded_frames_total",
+			Help: "Total number of frames encoded by " + name + " jobs",
+		}),
+	}
+}
@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// CameraLimitMetrics describes cameras held to server.limits.
+type CameraLimitMetrics struct {
+	Violations *prometheus.CounterVec
+}
+
+func NewCameraLimitMetrics() *CameraLimitMetrics {
+	return &CameraLimitMetrics{
+		Violations: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "camera_limit_violations_total",
+			Help: "Total camera connections refused and frames dropped by server.limits, by limit",
+		}, []string{"limit"}),
+	}
+}
+
+// ResolutionMetrics describes frames larger than their camera's
+// server.limits policy.
+type ResolutionMetrics struct {
+	Violations *prometheus.CounterVec
+}
+
+func NewResolutionMetrics() *ResolutionMetrics {
+	return &ResolutionMetrics{
+		Violations: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "frame_resolution_violations_total",
+			Help: "Total frames larger than their camera's resolution limit, by what was done with them",
+		}, []string{"action"}),
+	}
+}
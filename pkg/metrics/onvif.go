@@ -0,0 +1,25 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ONVIFMetrics describes the ONVIF services and discovery.
+type ONVIFMetrics struct {
+	Requests *prometheus.CounterVec
+	Probes   prometheus.Counter
+}
+
+func NewONVIFMetrics() *ONVIFMetrics {
+	return &ONVIFMetrics{
+		Requests: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "onvif_requests_total",
+			Help: "Total ONVIF requests, by operation (unsupported for the rest)",
+		}, []string{"operation"}),
+		Probes: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "onvif_discovery_probes_total",
+			Help: "Total WS-Discovery probes answered with at least one camera",
+		}),
+	}
+}
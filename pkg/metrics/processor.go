@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ProcessorQueueMetrics describes the queues of the frame processor's
+// workers, which fill up when frames arrive faster than they are saved.
+type ProcessorQueueMetrics struct {
+	Length   *prometheus.GaugeVec
+	Capacity prometheus.Gauge
+	Wait     prometheus.Histogram
+	Busy     prometheus.Gauge
+	Dropped  *prometheus.CounterVec
+}
+
+func NewProcessorQueueMetrics() *ProcessorQueueMetrics {
+	return &ProcessorQueueMetrics{
+		Length: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "processor_queue_length",
+			Help: "Number of frames waiting in each processor worker's queue",
+		}, []string{"worker"}),
+		Capacity: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "processor_queue_capacity",
+			Help: "Number of frames each processor worker's queue holds",
+		}),
+		Wait: promauto.NewHistogram(prometheus.HistogramOpts{
+			Name:    "processor_queue_wait_seconds",
+			Help:    "Histogram of the time frames wait before a worker saves them",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14), // up to ~8s
+		}),
+		Busy: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "processor_workers_busy",
+			Help: "Number of processor workers saving a frame",
+		}),
+		Dropped: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "processor_frames_dropped_total",
+			Help: "Total number of frames dropped because their worker's queue was full",
+		}, []string{"camera"}),
+	}
+}
+
+// DeadLetterMetrics describes frames kept after failing to be stored.
+type DeadLetterMetrics struct {
+	Frames prometheus.Counter
+}
+
+func NewDeadLetterMetrics() *DeadLetterMetrics {
+	return &DeadLetterMetrics{
+		Frames: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "processor_frames_dead_lettered_total",
+			Help: "Total frames that failed to be stored and were kept as dead letters",
+		}),
+	}
+}
+
+// StageMetrics describes the stages of the frame pipeline.
+type StageMetrics struct {
+	Duration *prometheus.HistogramVec
+	Errors   *prometheus.CounterVec
+}
+
+func NewStageMetrics() *StageMetrics {
+	return &StageMetrics{
+		Duration: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "processor_stage_duration_seconds",
+			Help:    "Time frames spend in each stage of the frame pipeline",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}, []string{"stage"}),
+		Errors: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "processor_stage_errors_total",
+			Help: "Total frames each stage of the frame pipeline failed, besides those it dropped",
+		}, []string{"stage"}),
+	}
+}
@@ -0,0 +1,20 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RateLimitMetrics describes API rate limiting.
+type RateLimitMetrics struct {
+	Limited *prometheus.CounterVec
+}
+
+func NewRateLimitMetrics() *RateLimitMetrics {
+	return &RateLimitMetrics{
+		Limited: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_rate_limited_total",
+			Help: "Total API requests refused with 429, by rate limit policy",
+		}, []string{"policy"}),
+	}
+}
@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Reasons retention deletes footage
+const (
+	ReclaimAge   = "age"   // older than retention_hours
+	ReclaimQuota = "quota" // the oldest, to get under max_disk_usage
+	ReclaimTrash = "trash" // trashed recordings past their grace period
+)
+
+// RetentionMetrics describes what retention deletes and the disk use it
+// keeps in check.
+type RetentionMetrics struct {
+	Reclaimed *prometheus.CounterVec
+	DiskUsage prometheus.Gauge
+	DiskQuota prometheus.Gauge
+}
+
+func NewRetentionMetrics() *RetentionMetrics {
+	return &RetentionMetrics{
+		Reclaimed: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "retention_reclaimed_bytes_total",
+			Help: "Total bytes of recordings and frames deleted by retention, by reason",
+		}, []string{"reason"}),
+		DiskUsage: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "storage_disk_usage_bytes",
+			Help: "Bytes used under the output directory at the last quota check",
+		}),
+		DiskQuota: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "storage_disk_quota_bytes",
+			Help: "Configured max_disk_usage, 0 when unlimited",
+		}),
+	}
+}
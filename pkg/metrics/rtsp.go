@@ -0,0 +1,25 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RTSPMetrics describes the RTSP output.
+type RTSPMetrics struct {
+	Sessions       *prometheus.GaugeVec
+	PacketsDropped prometheus.Counter
+}
+
+func NewRTSPMetrics() *RTSPMetrics {
+	return &RTSPMetrics{
+		Sessions: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "rtsp_sessions",
+			Help: "RTSP clients playing a camera, by transport (tcp or udp)",
+		}, []string{"transport"}),
+		PacketsDropped: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "rtsp_packets_dropped_total",
+			Help: "Total RTP packets dropped for RTSP clients too slow to take them",
+		}),
+	}
+}
@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Upload results
+const (
+	UploadOK      = "ok"
+	UploadFailed  = "failed"  // gave up after retrying
+	UploadDropped = "dropped" // the queue was full
+)
+
+// StorageMetrics describes copying frames and videos to the storage
+// backend, labelled by kind, "frame" or "video".
+type StorageMetrics struct {
+	Uploads     *prometheus.CounterVec
+	UploadBytes *prometheus.CounterVec
+	Queued      prometheus.Gauge
+}
+
+func NewStorageMetrics() *StorageMetrics {
+	return &StorageMetrics{
+		Uploads: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "storage_uploads_total",
+			Help: "Total number of files copied to the storage backend by result",
+		}, []string{"kind", "result"}),
+		UploadBytes: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "storage_upload_bytes_total",
+			Help: "Total bytes copied to the storage backend",
+		}, []string{"kind"}),
+		Queued: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "storage_upload_queue_length",
+			Help: "Files waiting to be copied to the storage backend",
+		}),
+	}
+}
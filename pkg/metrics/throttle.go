@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ThrottleMetrics describes frame write throttling.
+type ThrottleMetrics struct {
+	Limit     *prometheus.GaugeVec
+	Throttled *prometheus.GaugeVec
+	Delay     *prometheus.CounterVec
+}
+
+func NewThrottleMetrics() *ThrottleMetrics {
+	return &ThrottleMetrics{
+		Limit: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "write_throttle_limit_bytes_per_second",
+			Help: "Configured frame write limit, by scope (camera or global)",
+		}, []string{"scope"}),
+		Throttled: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "write_throttled",
+			Help: "Whether a camera's frames are being held back by the write throttle",
+		}, []string{"camera_id"}),
+		Delay: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "write_throttle_delay_seconds_total",
+			Help: "Total time a camera's frames were held back by the write throttle",
+		}, []string{"camera_id"}),
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !windows
+
+package pathutil
+
+func extendedLength(abs string) string {
+	return abs
+}
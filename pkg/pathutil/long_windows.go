@@ -0,0 +1,23 @@
+//go:build windows
+
+package pathutil
+
+import "strings"
+
+// maxPath is the legacy Win32 MAX_PATH limit, minus room for a file name
+// that tools append to directory paths.
+const maxPath = 248
+
+// extendedLength converts an absolute path over MAX_PATH to the \\?\ form,
+// which disables Win32 path parsing and therefore must use backslashes.
+func extendedLength(abs string) string {
+	if len(abs) < maxPath || strings.HasPrefix(abs, `\\?\`) {
+		return abs
+	}
+	abs = strings.ReplaceAll(abs, "/", `\`)
+	if strings.HasPrefix(abs, `\\`) {
+		// UNC share: \\server\share -> \\?\UNC\server\share
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
@@ -0,0 +1,35 @@
+// Package pathutil centralizes the path handling needed when file names are
+// passed to external tools such as FFmpeg, which are less forgiving than the
+// Go runtime about Windows backslashes and long paths.
+package pathutil
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// FFmpeg returns an absolute form of path that FFmpeg accepts on every
+// platform: forward slashes everywhere, except on Windows paths longer than
+// MAX_PATH, which use the \\?\ extended form FFmpeg passes straight through
+// to the file system.
+func FFmpeg(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to get absolute path: %w", err)
+	}
+	if long := extendedLength(abs); long != abs {
+		return long, nil
+	}
+	return filepath.ToSlash(abs), nil
+}
+
+// ConcatEntry formats path as a "file" directive for FFmpeg's concat
+// demuxer, quoting it so spaces and single quotes survive.
+func ConcatEntry(path string) (string, error) {
+	p, err := FFmpeg(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("file '%s'", strings.ReplaceAll(p, "'", `'\''`)), nil
+}
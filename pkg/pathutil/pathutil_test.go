@@ -0,0 +1,51 @@
+//go:build !windows
+
+package pathutil
+
+import "testing"
+
+func TestFFmpeg(t *testing.T) {
+	tests := []struct {
+		name, path, want string
+	}{
+		{"absolute", "/srv/cctv/frames/cam1/frame.jpg", "/srv/cctv/frames/cam1/frame.jpg"},
+		{"cleaned", "/srv/cctv/../cctv/frames//frame.jpg", "/srv/cctv/frames/frame.jpg"},
+		{"spaces", "/srv/cctv/front door/frame.jpg", "/srv/cctv/front door/frame.jpg"},
+		{"quote", "/home/o'brien/frames/frame.jpg", "/home/o'brien/frames/frame.jpg"},
+		// Backslashes are ordinary characters outside Windows
+		{"backslash", `/srv/cctv/a\b.jpg`, `/srv/cctv/a\b.jpg`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FFmpeg(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("FFmpeg(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConcatEntry(t *testing.T) {
+	tests := []struct {
+		name, path, want string
+	}{
+		{"plain", "/srv/cctv/frame.jpg", `file '/srv/cctv/frame.jpg'`},
+		{"spaces", "/srv/cctv/front door/frame.jpg", `file '/srv/cctv/front door/frame.jpg'`},
+		{"quote", "/home/o'brien/frame.jpg", `file '/home/o'\''brien/frame.jpg'`},
+		{"quotes and spaces", "/srv/cam 'a'/frame.jpg", `file '/srv/cam '\''a'\''/frame.jpg'`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ConcatEntry(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("ConcatEntry(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+//go:build windows
+
+package pathutil
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFFmpegWindows(t *testing.T) {
+	long := `C:\cctv\` + strings.Repeat(`camera\`, 40) + "frame.jpg"
+	tests := []struct {
+		name, path, want string
+	}{
+		{"drive letter", `C:\cctv\frames\cam1\frame.jpg`, "C:/cctv/frames/cam1/frame.jpg"},
+		{"forward slashes", `D:/cctv/frames/frame.jpg`, "D:/cctv/frames/frame.jpg"},
+		{"spaces", `C:\Program Files\cctv\front door\frame.jpg`, "C:/Program Files/cctv/front door/frame.jpg"},
+		{"quote", `C:\Users\o'brien\frames\frame.jpg`, "C:/Users/o'brien/frames/frame.jpg"},
+		{"UNC share", `\\nas\footage\cam1\frame.jpg`, "//nas/footage/cam1/frame.jpg"},
+		{"long path", long, `\\?\` + long},
+		{"long UNC path", `\\nas\footage\` + long[3:], `\\?\UNC\nas\footage\` + long[3:]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FFmpeg(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("FFmpeg(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConcatEntryWindows(t *testing.T) {
+	tests := []struct {
+		name, path, want string
+	}{
+		{"drive letter", `C:\cctv\frames\frame.jpg`, `file 'C:/cctv/frames/frame.jpg'`},
+		{"spaces", `C:\Program Files\cctv\front door\frame.jpg`, `file 'C:/Program Files/cctv/front door/frame.jpg'`},
+		{"quote", `C:\Users\o'brien\frame.jpg`, `file 'C:/Users/o'\''brien/frame.jpg'`},
+		{"quotes and spaces", `E:\cam 'a'\frame.jpg`, `file 'E:/cam '\''a'\''/frame.jpg'`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ConcatEntry(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("ConcatEntry(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
@@ -150,7 +150,7 @@ To start the CCTV system:
    .\bin\cctvserver.exe
 
 2. In a new terminal, start the camera simulator:
-   .\bin\camerasim.exe -id cam1 -addr "ws://localhost:8080/camera/connect"
+   .\bin\camerasim.exe -id cam1 -addr "ws://localhost:8081/camera/connect"
 
 The system will begin capturing frames and processing them into videos.
 
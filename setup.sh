@@ -106,7 +106,7 @@ fi
 
 # Start camera simulator
 echo "Starting camera simulator..."
-LOG_LEVEL=info ./bin/camerasim -id cam1 -addr "ws://localhost:8080/camera/connect" &
+LOG_LEVEL=info ./bin/camerasim -id cam1 -addr "ws://localhost:8081/camera/connect" &
 SIM_PID=$!
 echo "$SIM_PID:simulator" >> "$PID_FILE"
 